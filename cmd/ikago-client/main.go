@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -10,33 +12,79 @@
 	"github.com/xtaci/kcp-go"
 	"ikago/internal/addr"
 	"ikago/internal/config"
+	"ikago/internal/control"
 	"ikago/internal/crypto"
+	"ikago/internal/dashboard"
 	"ikago/internal/exec"
+	"ikago/internal/geoip"
 	"ikago/internal/log"
+	"ikago/internal/obfs"
 	"ikago/internal/pcap"
+	"ikago/internal/schedule"
+	"ikago/internal/socks"
 	"ikago/internal/stat"
+	"ikago/internal/tracing"
 	"io"
 	"math"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 type natIndicator struct {
 	srcHardwareAddr net.HardwareAddr
+	encap           *pcap.Encap
 	conn            *pcap.RawConn
 }
 
+// upstream describes a server and its health, which is learned from the connection to it while it is active. conn is
+// the connection to the server in load balancing.
+type upstream struct {
+	addr      *net.TCPAddr
+	weight    int
+	lock      sync.Mutex
+	conn      net.Conn
+	rtt       time.Duration
+	jitter    time.Duration
+	loss      float64
+	heard     time.Time
+	failovers int
+}
+
 const name string = "IkaGo-client"
 
 const keepSticky = 30 * time.Second
+const keepBridge = 5 * time.Minute
+
+// heartbeat is the interval the active server is probed in when nothing is heard from it, and failoverTimeout is the
+// duration segments sent to it are left unanswered before it is failed over.
+const heartbeat = time.Second
+const failoverTimeout = 5 * time.Second
+
+// roamTimeout is the duration segments sent to a server are left unanswered before the session is announced from the
+// current address in roaming, which is shorter than the failover timeout.
+const roamTimeout = 2 * time.Second
+
+// lossProbes is the number of probes loss of a server is measured in at least before it is avoided for the loss.
+const lossProbes = 10
+
+// srvParams are keys of options servers discovered by DNS set in their TXT records. Other options, like the method and
+// the password, are never taken from DNS.
+var srvParams = map[string]bool{"mode": true, "kcp": true, "obfs": true, "fingerprint": true, "mtu": true}
+
+// migrateInterval is the interval the upstream device and the default route are checked in, and the upstream is moved
+// to another device if they change.
+const migrateInterval = 5 * time.Second
 
 var (
 	version     = ""
@@ -48,18 +96,74 @@ type natIndicator struct {
 
 var (
 	argListDevs       = flag.Bool("list-devices", false, "List all valid devices in current computer.")
+	argJSON           = flag.Bool("json", false, "Print in JSON.")
+	argGenerateKey    = flag.Bool("generate-key", false, "Generate a key pair for authentication.")
 	argConfig         = flag.String("c", "", "Configuration file.")
+	argCheckConfig    = flag.Bool("check-config", false, "Check configuration.")
+	argProfile        = flag.String("profile", "", "Profile in configuration file.")
 	argListenDevs     = flag.String("listen-devices", "", "Devices for listening.")
 	argUpDev          = flag.String("upstream-device", "", "Device for routing upstream to.")
+	argBackends       = flag.String("backends", "", "Backends of devices.")
+	argPcapSnapLen    = flag.Int("pcap-snaplen", 0, "Snap length of libpcap.")
+	argPcapBuffer     = flag.Int("pcap-buffer", 0, "Buffer size of libpcap.")
+	argPcapImmediate  = flag.Bool("pcap-immediate", false, "Enable immediate mode of libpcap.")
+	argPcapTimeout    = flag.Int("pcap-timeout", 0, "Timeout of libpcap.")
+	argBatch          = flag.Int("batch", 0, "Max packets read and written in a batch.")
+	argBusyPoll       = flag.Bool("busy-poll", false, "Busy poll devices.")
+	argWorkers        = flag.Int("workers", 0, "Number of workers handling packets.")
+	argQueueSize      = flag.Int("queue-size", 0, "Length of queues of each traffic class in workers.")
+	argQueuePolicies  = flag.String("queue-policies", "", "Policies of queues of traffic classes when they are full.")
+	argQoS            = flag.String("qos", "", "QoS rules classifying packets into traffic classes.")
+	argDropLog        = flag.Int("drop-log", 0, "Number of packets dropped by QoS rules logged in each flow.")
+	argMemoryLimit    = flag.Int("memory-limit", 0, "Memory limit in MB.")
+	argShape          = flag.Int("shape", 0, "Shaping rate in Kbps.")
+	argShapeBurst     = flag.Int("shape-burst", 0, "Burst of shaping in KB.")
 	argGateway        = flag.String("gateway", "", "Gateway address.")
 	argMode           = flag.String("mode", "faketcp", "Mode.")
 	argMethod         = flag.String("method", "plain", "Method of encryption.")
 	argPassword       = flag.String("password", "", "Password of encryption.")
+	argPasswordFile   = flag.String("password-file", "", "File of password of encryption.")
+	argPasswordCmd    = flag.String("password-cmd", "", "Command printing password of encryption.")
+	argKDF            = flag.String("kdf", "", "Key derivation function.")
+	argKDFMemory      = flag.Int("kdf-memory", 0, "Memory of key derivation function.")
+	argKDFIters       = flag.Int("kdf-iterations", 0, "Iterations of key derivation function.")
+	argRekeyInterval  = flag.Int("rekey-interval", 0, "Interval of re-keying.")
+	argRekeyBytes     = flag.Int("rekey-bytes", 0, "Bytes of re-keying.")
+	argKeyExchange    = flag.Bool("key-exchange", false, "Enable key exchange.")
+	argPrivateKey     = flag.String("private-key", "", "Private key for authentication.")
+	argPeerKeys       = flag.String("peer-keys", "", "Public keys of peers.")
 	argRule           = flag.Bool("rule", false, "Add firewall rule.")
 	argVerbose        = flag.Bool("v", false, "Print verbose messages.")
 	argLog            = flag.String("log", "", "Log.")
+	argLogFormat      = flag.String("log-format", "", "Format of log.")
+	argLogMaxSize     = flag.Int("log-max-size", 0, "Size of log rotated at.")
+	argLogRotate      = flag.Int("log-rotate-interval", 0, "Interval of rotating log.")
+	argLogBackups     = flag.Int("log-backups", 0, "Number of rotated logs kept.")
+	argLogCompress    = flag.Bool("log-compress", false, "Compress rotated logs.")
+	argLogSyslog      = flag.String("log-syslog", "", "Syslog server log sent to.")
+	argLogEventLog    = flag.Bool("log-eventlog", false, "Report log to Windows Event Log.")
 	argMonitor        = flag.Int("monitor", 0, "Port for monitoring.")
+	argControl        = flag.String("control", "", "Path of control socket.")
+	argDump           = flag.String("dump", "", "File for dumping packets.")
+	argDumpLayer      = flag.String("dump-layer", "all", "Layer of packets dumped.")
+	argTrace          = flag.String("trace", "", "Endpoint of tracing.")
+	argTraceSample    = flag.Int("trace-sample", 0, "Sampling of tracing.")
+	argPProf          = flag.String("pprof", "", "Address for profiling.")
 	argMTU            = flag.Int("mtu", 0, "MTU.")
+	argNoECN          = flag.Bool("no-ecn", false, "Disable copying DSCP and ECN.")
+	argTTL            = flag.String("ttl", "", "TTL policy.")
+	argDSCP           = flag.String("dscp", "", "DSCP class.")
+	argEmulate        = flag.Bool("emulate", false, "Enable TCP emulation.")
+	argSYNOptions     = flag.String("syn-options", "", "TCP options in SYN.")
+	argKeepAlive      = flag.Int("keepalive", 0, "Interval of keepalive.")
+	argFingerprint    = flag.String("fingerprint", "", "OS fingerprint.")
+	argPace           = flag.Int("pace", 0, "Pacing rate.")
+	argObfs           = flag.String("obfs", "", "Obfuscation.")
+	argBridge         = flag.Bool("bridge", false, "Enable bridging.")
+	argAllow          = flag.String("allow", "", "Destinations allowed.")
+	argDeny           = flag.String("deny", "", "Destinations denied.")
+	argGeoIP          = flag.String("geoip", "", "GeoIP databases.")
+	argGeoIPReload    = flag.Int("geoip-reload", 0, "Interval of reloading GeoIP databases.")
 	argKCP            = flag.Bool("kcp", false, "Enable KCP.")
 	argKCPMTU         = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
 	argKCPSendWindow  = flag.Int("kcp-sndwnd", kcp.IKCP_WND_SND, "KCP tuning option sndwnd.")
@@ -72,38 +176,98 @@ type natIndicator struct {
 	argKCPResend      = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
 	argKCPNC          = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
 	argPublish        = flag.String("publish", "", "ARP publishing address.")
+	argTunnel         = flag.String("tunnel", "", "Destinations tunneled.")
+	argDomainRoute    = flag.String("domain-routes", "", "Routes of domains.")
 	argUpPort         = flag.Int("p", 0, "Port for routing upstream.")
 	argSources        = flag.String("r", "", "Sources.")
 	argServer         = flag.String("s", "", "Server.")
+	argServers        = flag.String("servers", "", "Backup servers.")
+	argBalance        = flag.String("balance", "", "Policy of load balancing.")
+	argProbe          = flag.Int("probe-interval", 0, "Interval of active probing.")
+	argProbeLoss      = flag.Int("probe-loss", 0, "Loss of probes servers are avoided at.")
+	argMultipath      = flag.String("multipath", "", "Second path in multipath.")
+	argRoaming        = flag.Bool("roaming", false, "Resume sessions after the address changes.")
+	argSocks          = flag.String("socks", "", "Address of SOCKS5 server.")
+	argHTTPProxy      = flag.String("http-proxy", "", "Address of HTTP proxy server.")
+	argTransparent    = flag.String("transparent", "", "Address of transparent proxy server.")
+	argTProxy         = flag.Bool("tproxy", false, "Receive traffic by TPROXY in transparent proxy.")
 )
 
 var (
-	publishIP  *net.IPAddr
-	upPort     uint16
-	sources    []*net.IPAddr
-	serverIP   net.IP
-	serverPort uint16
-	listenDevs []*pcap.Device
-	upDev      *pcap.Device
-	gatewayDev *pcap.Device
-	mode       string
-	crypt      crypto.Crypt
-	mtu        int
-	isKCP      bool
-	kcpConfig  *config.KCPConfig
+	reloadLock  sync.Mutex
+	loaded      *config.Config
+	publishIP   *net.IPAddr
+	tunnelRules []*addr.TunnelRule
+	isTunnelAll bool
+	isRouted    bool
+	router      *addr.DomainRouter
+	upPort      uint16
+	sources     []*net.IPAddr
+	upstreams   []*upstream
+	balancer    *pcap.Balancer
+	probeTime   time.Duration
+	probeLoss   float64
+	listenDevs  []*pcap.Device
+	upDevName   string
+	upGateway   net.IP
+	upDev       *pcap.Device
+	gatewayDev  *pcap.Device
+	dupDev      *pcap.Device
+	dupGateway  *pcap.Device
+	mode        string
+	crypt       crypto.Crypt
+	mtu         int
+	isECN       bool
+	ttlPolicy   *pcap.TTLPolicy
+	dscp        *pcap.DSCP
+	isEmulated  bool
+	synOptions  *pcap.SYNOptions
+	keepalive   time.Duration
+	fingerprint *pcap.Fingerprint
+	pace        int
+	obfuscator  obfs.Obfuscator
+	isBridge    bool
+	isRoaming   bool
+	socksAddr   string
+	httpAddr    string
+	transAddr   string
+	isTProxy    bool
+	acl         *addr.ACL
+	geo         *geoip.Database
+	workers     int
+	queueSize   int
+	queuePolicy map[pcap.TrafficClass]pcap.QueuePolicy
+	classifier  *pcap.Classifier
+	isKCP       bool
+	kcpConfig   *config.KCPConfig
+	srvOptions  map[string]string
 )
 
 var (
 	isClosed    bool
 	listenConns []*pcap.RawConn
+	upLock      sync.Mutex
 	upConn      net.Conn
-	c           chan pcap.ConnPacket
+	active      int
+	dupConn     net.Conn
+	dupID       uint32
+	dupSeq      uint64
+	workerPool  *pcap.WorkerPool
 	destick     *pcap.Desticker
 	natLock     sync.RWMutex
 	nat         map[string]*natIndicator
+	bridge      *pcap.Bridge
 	monitor     *stat.TrafficMonitor
+	memBudget   *stat.MemoryBudget
+	shaper      *stat.Shaper
+	controller  *control.Server
+	dumper      *pcap.Dumper
 	dnsLock     sync.RWMutex
 	dns         map[string]string
+	stack       *socks.Stack
+	socksServer *socks.Server
+	httpServer  *socks.Server
+	transServer *socks.Server
 )
 
 func init() {
@@ -122,19 +286,26 @@ func init() {
 	if commit != "" {
 		versionInfo = versionInfo + fmt.Sprintf("(%s)", commit)
 	}
-	log.Infof("%s %s\n\n", name, versionInfo)
-
 	// Start time
 	startTime = time.Now()
 
 	// Parse arguments
 	flag.Parse()
 
-	// Load config.json by default
-	if len(os.Args) <= 1 {
-		_, err := os.Stat("config.json")
-		if err == nil {
-			*argConfig = "config.json"
+	// Load config.json, config.yaml, config.yml or config.toml by default
+	isDefault := flag.NArg() <= 0 || flag.Arg(0) == "ctl"
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "v" && f.Name != "check-config" && f.Name != "profile" {
+			isDefault = false
+		}
+	})
+	if isDefault {
+		for _, path := range []string{"config.json", "config.yaml", "config.yml", "config.toml"} {
+			_, err := os.Stat(path)
+			if err == nil {
+				*argConfig = path
+				break
+			}
 		}
 	}
 
@@ -142,7 +313,6 @@ func init() {
 	listenDevs = make([]*pcap.Device, 0)
 
 	listenConns = make([]*pcap.RawConn, 0)
-	c = make(chan pcap.ConnPacket, 1000)
 	destick = pcap.NewDesticker()
 	destick.SetDeadline(keepSticky)
 	nat = make(map[string]*natIndicator)
@@ -156,26 +326,113 @@ func main() {
 		gateway net.IP
 	)
 
+	// List devices in JSON
+	if *argListDevs && *argJSON {
+		err := listDevsJSON()
+		if err != nil {
+			log.Fatalln(fmt.Errorf("list devices: %w", err))
+		}
+		os.Exit(0)
+	}
+
+	// Control client
+	if flag.Arg(0) == "ctl" {
+		err := ctl(flag.Args()[1:])
+		if err != nil {
+			log.Fatalln(fmt.Errorf("ctl: %w", err))
+		}
+		os.Exit(0)
+	}
+
+	// Setup wizard
+	if flag.Arg(0) == "init" {
+		path := *argConfig
+		if path == "" {
+			path = "config.json"
+		}
+
+		err := setup(path)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("setup: %w", err))
+		}
+		os.Exit(0)
+	}
+
 	// Configuration
 	if *argConfig != "" {
-		cfg, err = config.ParseFile(*argConfig)
+		cfg, err = config.ParseFile(*argConfig, *argProfile)
 		if err != nil {
 			log.Fatalln(fmt.Errorf("parse config file %s: %w", *argConfig, err))
 		}
-		log.Infof("Load configuration from %s\n", *argConfig)
 	} else {
+		if *argProfile != "" {
+			log.Fatalln(errors.New("profile not support without configuration file"))
+		}
+
 		cfg = config.NewConfig()
 		cfg.ListenDevs = splitArg(*argListenDevs)
 		cfg.UpDev = *argUpDev
+		cfg.Backends = splitMapArg(*argBackends)
+		cfg.SnapLen = *argPcapSnapLen
+		cfg.Buffer = *argPcapBuffer
+		cfg.Immediate = *argPcapImmediate
+		cfg.Timeout = *argPcapTimeout
+		cfg.Batch = *argBatch
+		cfg.BusyPoll = *argBusyPoll
+		cfg.Workers = *argWorkers
+		cfg.QueueSize = *argQueueSize
+		cfg.QueuePolicy = splitMapArg(*argQueuePolicies)
+		cfg.QoS = splitArg(*argQoS)
+		cfg.DropLog = *argDropLog
+		cfg.MemoryLimit = *argMemoryLimit
+		cfg.Shape = *argShape
+		cfg.ShapeBurst = *argShapeBurst
 		cfg.Gateway = *argGateway
 		cfg.Mode = *argMode
 		cfg.Method = *argMethod
 		cfg.Password = *argPassword
+		cfg.PassFile = *argPasswordFile
+		cfg.PassCmd = *argPasswordCmd
+		cfg.KDF = *argKDF
+		cfg.KDFMemory = *argKDFMemory
+		cfg.KDFIters = *argKDFIters
+		cfg.RekeyTime = *argRekeyInterval
+		cfg.RekeyBytes = *argRekeyBytes
+		cfg.KeyExchange = *argKeyExchange
+		cfg.PrivateKey = *argPrivateKey
+		cfg.PeerKeys = splitArg(*argPeerKeys)
 		cfg.Rule = *argRule
 		cfg.Verbose = *argVerbose
 		cfg.Log = *argLog
+		cfg.LogFormat = *argLogFormat
+		cfg.LogSize = *argLogMaxSize
+		cfg.LogInterval = *argLogRotate
+		cfg.LogBackups = *argLogBackups
+		cfg.LogCompress = *argLogCompress
+		cfg.LogSyslog = *argLogSyslog
+		cfg.LogEventLog = *argLogEventLog
 		cfg.Monitor = *argMonitor
+		cfg.Control = *argControl
+		cfg.Dump = *argDump
+		cfg.DumpLayer = *argDumpLayer
+		cfg.Trace = *argTrace
+		cfg.TraceSample = *argTraceSample
+		cfg.PProf = *argPProf
 		cfg.MTU = *argMTU
+		cfg.NoECN = *argNoECN
+		cfg.TTL = *argTTL
+		cfg.DSCP = *argDSCP
+		cfg.Emulate = *argEmulate
+		cfg.SYNOptions = *argSYNOptions
+		cfg.KeepAlive = *argKeepAlive
+		cfg.Fingerprint = *argFingerprint
+		cfg.Pace = *argPace
+		cfg.Obfs = *argObfs
+		cfg.Bridge = *argBridge
+		cfg.Allow = splitArg(*argAllow)
+		cfg.Deny = splitArg(*argDeny)
+		cfg.GeoIP = splitArg(*argGeoIP)
+		cfg.GeoIPReload = *argGeoIPReload
 		cfg.KCP = *argKCP
 		cfg.KCPConfig = *config.NewKCPConfig()
 		cfg.KCPConfig.MTU = *argKCPMTU
@@ -189,19 +446,96 @@ func main() {
 		cfg.KCPConfig.Resend = *argKCPResend
 		cfg.KCPConfig.NC = *argKCPNC
 		cfg.Publish = *argPublish
+		cfg.Tunnel = splitArg(*argTunnel)
+		cfg.DomainRoute = splitMapArg(*argDomainRoute)
 		cfg.Port = *argUpPort
 		cfg.Sources = splitArg(*argSources)
 		cfg.Server = *argServer
+		cfg.Servers = splitArg(*argServers)
+		cfg.Balance = *argBalance
+		cfg.Probe = *argProbe
+		cfg.ProbeLoss = *argProbeLoss
+		cfg.Multipath = *argMultipath
+		cfg.Roaming = *argRoaming
+		cfg.Socks = *argSocks
+		cfg.HTTPProxy = *argHTTPProxy
+		cfg.Transparent = *argTransparent
+		cfg.TProxy = *argTProxy
+	}
+
+	// Environment variables, which are overridden by arguments
+	set := make([]string, 0)
+	if *argConfig == "" {
+		flag.Visit(func(f *flag.Flag) {
+			set = append(set, argKey(f.Name))
+		})
+	}
+	envs, err := config.ApplyEnv(cfg, set)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("apply environment variables: %w", err))
 	}
-
 	// Log
 	log.SetVerbose(cfg.Verbose || *argVerbose)
+	err = log.SetFormat(cfg.LogFormat)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("log format %s: %w", cfg.LogFormat, err))
+	}
+	if cfg.LogSize < 0 {
+		log.Fatalln(fmt.Errorf("log max size %d out of range", cfg.LogSize))
+	}
+	if cfg.LogInterval < 0 {
+		log.Fatalln(fmt.Errorf("log rotate interval %d out of range", cfg.LogInterval))
+	}
+	if cfg.LogBackups < 0 {
+		log.Fatalln(fmt.Errorf("log backups %d out of range", cfg.LogBackups))
+	}
+	log.SetRotateOptions(log.RotateOptions{
+		Size:     int64(cfg.LogSize) * 1024 * 1024,
+		Interval: time.Duration(cfg.LogInterval) * time.Second,
+		Backups:  cfg.LogBackups,
+		Compress: cfg.LogCompress,
+	})
 	err = log.SetLog(cfg.Log)
 	if err != nil {
 		log.Fatalln(fmt.Errorf("log %s: %w", cfg.Log, err))
 	}
+	err = log.SetSyslog(cfg.LogSyslog, name)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("log syslog %s: %w", cfg.LogSyslog, err))
+	}
+	if cfg.LogEventLog {
+		err = log.SetEventLog(name)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("log event log: %w", err))
+		}
+	}
+
+	// Messages are printed after the log is set, so they are in the format of the log
+	log.Infof("%s %s\n\n", name, versionInfo)
 	if cfg.Log != "" {
 		log.Infof("Save log to file %s\n", cfg.Log)
+		if cfg.LogSize > 0 {
+			log.Infof("Rotate log every %d MB\n", cfg.LogSize)
+		}
+		if cfg.LogInterval > 0 {
+			log.Infof("Rotate log every %d seconds\n", cfg.LogInterval)
+		}
+	}
+	if cfg.LogSyslog != "" {
+		log.Infof("Send log to syslog %s\n", cfg.LogSyslog)
+	}
+	if cfg.LogEventLog {
+		log.Infof("Report log to Windows Event Log as %s\n", name)
+	}
+	if *argConfig != "" {
+		if *argProfile != "" {
+			log.Infof("Load configuration from %s in profile %s\n", *argConfig, *argProfile)
+		} else {
+			log.Infof("Load configuration from %s\n", *argConfig)
+		}
+	}
+	if len(envs) > 0 {
+		log.Infof("Override %s by environment variables\n", strings.Join(envs, ", "))
 	}
 
 	// Check permission
@@ -237,14 +571,81 @@ func main() {
 		}
 		os.Exit(0)
 	}
+	if *argGenerateKey {
+		private, public, err := crypto.GenerateIdentity()
+		if err != nil {
+			log.Fatalln(fmt.Errorf("generate key: %w", err))
+		}
+		log.Infoln("Key pair is generated below, use -private-key [private key] in this side, and -peer-keys [public key] in the peer:")
+		log.Infof("  Private key: %s\n", private)
+		log.Infof("  Public key:  %s\n", public)
+		os.Exit(0)
+	}
 
 	// Verify parameters
-	if len(cfg.Sources) <= 0 {
+	if len(cfg.Sources) <= 0 && !cfg.Bridge && cfg.Socks == "" && cfg.HTTPProxy == "" && cfg.Transparent == "" {
 		log.Fatalln("Please provide sources by -r addresses.")
 	}
 	if cfg.Server == "" {
 		log.Fatalln("Please provide server by -s address.")
 	}
+	if addr.IsSRVName(cfg.Server) {
+		params, err := addr.LookupParams(cfg.Server)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("lookup parameters of server %s: %w", cfg.Server, err))
+		}
+		for key := range params {
+			if !srvParams[key] {
+				log.Infof("Ignore option %s of server %s\n", key, cfg.Server)
+				delete(params, key)
+			}
+		}
+
+		// Options set already are kept
+		keys, err := config.ApplyParams(cfg, params)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("apply parameters of server %s: %w", cfg.Server, err))
+		}
+		if len(keys) > 0 {
+			log.Infof("Apply %s from server %s\n", strings.Join(keys, ", "), cfg.Server)
+		}
+		srvOptions = params
+	}
+
+	// Servers discovered by DNS in order of their priorities, the first of which is the server and others are backup
+	// servers, with weights of their SRV records
+	servers := make([]string, 0)
+	for _, server := range append([]string{cfg.Server}, cfg.Servers...) {
+		if !addr.IsSRVName(server) {
+			servers = append(servers, server)
+			continue
+		}
+
+		serverAddrs, ws, err := addr.LookupSRV(server)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("discover servers %s: %w", server, err))
+		}
+
+		// Backup servers are not supported in KCP and multipath
+		if cfg.KCP || cfg.Multipath != "" {
+			serverAddrs, ws = serverAddrs[:1], ws[:1]
+		}
+
+		ss := make([]string, 0, len(serverAddrs))
+		for i, serverAddr := range serverAddrs {
+			s := serverAddr.String()
+			if ws[i] > 0 {
+				s = fmt.Sprintf("%s=%d", s, ws[i])
+			}
+			ss = append(ss, s)
+		}
+		servers = append(servers, ss...)
+
+		log.Infof("Discover servers %s from %s\n", strings.Join(ss, ", "), server)
+	}
+	if cfg.Password != "" && cfg.PassFile != "" || cfg.Password != "" && cfg.PassCmd != "" || cfg.PassFile != "" && cfg.PassCmd != "" {
+		log.Fatalln(errors.New("password, password file and password command are exclusive"))
+	}
 	if cfg.Gateway != "" {
 		gateway = net.ParseIP(cfg.Gateway)
 		if gateway == nil {
@@ -254,14 +655,130 @@ func main() {
 	if cfg.Monitor < 0 || cfg.Monitor > 65535 {
 		log.Fatalln(fmt.Errorf("monitor port %d out of range", cfg.Monitor))
 	}
-	if cfg.MTU < 576 || cfg.MTU > pcap.MaxMTU {
-		if cfg.MTU == 0 {
-			cfg.MTU = pcap.MaxMTU
-		} else {
-			log.Fatalln(fmt.Errorf("mtu %d out of range", cfg.MTU))
+	if cfg.PProf != "" {
+		_, _, err := net.SplitHostPort(cfg.PProf)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse pprof address %s: %w", cfg.PProf, err))
 		}
 	}
-	if cfg.KCPConfig.MTU > 1500 {
+	if cfg.SnapLen != 0 && (cfg.SnapLen < pcap.MinSnapLen(cfg.MTU) || cfg.SnapLen > 262144) {
+		log.Fatalln(fmt.Errorf("pcap snap length %d out of range", cfg.SnapLen))
+	}
+	if cfg.Buffer < 0 {
+		log.Fatalln(fmt.Errorf("pcap buffer size %d out of range", cfg.Buffer))
+	}
+	if cfg.Timeout < 0 {
+		log.Fatalln(fmt.Errorf("pcap timeout %d out of range", cfg.Timeout))
+	}
+	if cfg.Batch < 0 {
+		log.Fatalln(fmt.Errorf("batch %d out of range", cfg.Batch))
+	}
+	if cfg.Workers < 0 {
+		log.Fatalln(fmt.Errorf("workers %d out of range", cfg.Workers))
+	}
+	if cfg.QueueSize < 0 {
+		log.Fatalln(fmt.Errorf("queue size %d out of range", cfg.QueueSize))
+	}
+	if cfg.MemoryLimit < 0 {
+		log.Fatalln(fmt.Errorf("memory limit %d out of range", cfg.MemoryLimit))
+	}
+	if cfg.DropLog < 0 {
+		log.Fatalln(fmt.Errorf("drop log %d out of range", cfg.DropLog))
+	}
+	if cfg.Shape < 0 {
+		log.Fatalln(fmt.Errorf("shape %d out of range", cfg.Shape))
+	}
+	if cfg.ShapeBurst < 0 {
+		log.Fatalln(fmt.Errorf("shape burst %d out of range", cfg.ShapeBurst))
+	}
+	if cfg.GeoIPReload < 0 {
+		log.Fatalln(fmt.Errorf("geoip reload interval %d out of range", cfg.GeoIPReload))
+	}
+	if cfg.KeepAlive < 0 {
+		log.Fatalln(fmt.Errorf("keepalive %d out of range", cfg.KeepAlive))
+	}
+	if cfg.Pace < 0 {
+		log.Fatalln(fmt.Errorf("pace %d out of range", cfg.Pace))
+	}
+	if cfg.RekeyTime < 0 {
+		log.Fatalln(fmt.Errorf("rekey interval %d out of range", cfg.RekeyTime))
+	}
+	if cfg.KDFMemory < 0 {
+		log.Fatalln(fmt.Errorf("kdf memory %d out of range", cfg.KDFMemory))
+	}
+	if cfg.KDFIters < 0 {
+		log.Fatalln(fmt.Errorf("kdf iterations %d out of range", cfg.KDFIters))
+	}
+	if cfg.RekeyBytes < 0 {
+		log.Fatalln(fmt.Errorf("rekey bytes %d out of range", cfg.RekeyBytes))
+	}
+	if cfg.KeyExchange && cfg.KCP {
+		log.Fatalln(errors.New("key exchange not support with kcp"))
+	}
+	if cfg.PrivateKey != "" && cfg.KCP {
+		log.Fatalln(errors.New("private key not support with kcp"))
+	}
+	if len(cfg.Servers) > 0 && cfg.KCP {
+		log.Fatalln(errors.New("backup servers not support with kcp"))
+	}
+	if cfg.Balance != "" && len(servers) <= 1 {
+		log.Fatalln(errors.New("load balancing not support without backup servers"))
+	}
+	if cfg.Balance != "" && cfg.Bridge {
+		log.Fatalln(errors.New("load balancing not support with bridging"))
+	}
+	if cfg.Probe < 0 {
+		log.Fatalln(fmt.Errorf("probe interval %d out of range", cfg.Probe))
+	}
+	if cfg.ProbeLoss < 0 || cfg.ProbeLoss > 100 {
+		log.Fatalln(fmt.Errorf("probe loss %d out of range", cfg.ProbeLoss))
+	}
+	if cfg.Probe > 0 && cfg.Mode != "faketcp" {
+		log.Fatalln(fmt.Errorf("active probing not support in mode %s", cfg.Mode))
+	}
+	if cfg.Probe > 0 && cfg.KCP {
+		log.Fatalln(errors.New("active probing not support with kcp"))
+	}
+	if cfg.ProbeLoss > 0 && cfg.Probe <= 0 {
+		log.Fatalln(errors.New("missing probe interval"))
+	}
+	if cfg.Multipath != "" && cfg.Mode != "faketcp" {
+		log.Fatalln(fmt.Errorf("multipath not support in mode %s", cfg.Mode))
+	}
+	if cfg.Multipath != "" && cfg.KCP {
+		log.Fatalln(errors.New("multipath not support with kcp"))
+	}
+	if cfg.Multipath != "" && len(cfg.Servers) > 0 {
+		log.Fatalln(errors.New("multipath not support with backup servers"))
+	}
+	if cfg.Multipath != "" && cfg.Bridge {
+		log.Fatalln(errors.New("multipath not support with bridging"))
+	}
+	if cfg.Roaming && cfg.Mode != "faketcp" {
+		log.Fatalln(fmt.Errorf("roaming not support in mode %s", cfg.Mode))
+	}
+	if cfg.Roaming && !cfg.KeyExchange && cfg.PrivateKey == "" {
+		log.Fatalln(errors.New("roaming not support without key exchange"))
+	}
+	if cfg.Socks != "" && cfg.Bridge {
+		log.Fatalln(errors.New("socks not support with bridging"))
+	}
+	if cfg.HTTPProxy != "" && cfg.Bridge {
+		log.Fatalln(errors.New("http proxy not support with bridging"))
+	}
+	if cfg.Transparent != "" && runtime.GOOS != "linux" {
+		log.Fatalln(fmt.Errorf("transparent proxy not support in %s", runtime.GOOS))
+	}
+	if cfg.Transparent != "" && cfg.Bridge {
+		log.Fatalln(errors.New("transparent proxy not support with bridging"))
+	}
+	if cfg.TProxy && cfg.Transparent == "" {
+		log.Fatalln(errors.New("missing transparent proxy address"))
+	}
+	if cfg.MTU != 0 && (cfg.MTU < 576 || cfg.MTU > pcap.MaxMTU) {
+		log.Fatalln(fmt.Errorf("mtu %d out of range", cfg.MTU))
+	}
+	if cfg.KCPConfig.MTU > pcap.MaxMTU {
 		log.Fatalln(fmt.Errorf("kcp mtu %d out of range", cfg.KCPConfig.MTU))
 	}
 	if cfg.KCPConfig.SendWindow <= 0 || cfg.KCPConfig.SendWindow > math.MaxInt32 {
@@ -288,6 +805,9 @@ func main() {
 	if cfg.Port < 0 || cfg.Port > 65535 {
 		log.Fatalln(fmt.Errorf("upstream port %d out of range", cfg.Port))
 	}
+	if cfg.Monitor != 0 && cfg.Monitor == cfg.Port {
+		log.Fatalln(fmt.Errorf("same monitor port with upstream port"))
+	}
 
 	// Randomize upstream port
 	if cfg.Port == 0 {
@@ -308,13 +828,46 @@ func main() {
 		sources = append(sources, &net.IPAddr{IP: ip})
 	}
 
-	// Server
-	serverAddr, err := addr.ParseTCPAddr(cfg.Server)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("parse server %s: %w", cfg.Server, err))
+	// Servers, the first of which is active, with optional weights in load balancing
+	weights := make([]int, 0)
+	for _, server := range servers {
+		weight := 1
+		if i := strings.LastIndex(server, "="); i >= 0 {
+			w, err := strconv.Atoi(server[i+1:])
+			if err != nil || w <= 0 {
+				log.Fatalln(fmt.Errorf("weight of server %s out of range", server))
+			}
+			weight = w
+			server = server[:i]
+		}
+
+		serverAddr, err := addr.ParseTCPAddr(server)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse server %s: %w", server, err))
+		}
+		upstreams = append(upstreams, &upstream{addr: serverAddr, weight: weight})
+		weights = append(weights, weight)
+	}
+	if cfg.Balance != "" {
+		policy, err := pcap.ParseBalancePolicy(cfg.Balance)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse balance policy: %w", err))
+		}
+		balancer = pcap.NewBalancer(policy, weights)
+		log.Infof("Balance flows across servers in %s\n", policy)
+	} else if len(upstreams) > 1 {
+		log.Infof("Fail over to backup servers %s\n", strings.Join(servers[1:], ", "))
+	}
+
+	// Active probing
+	if cfg.Probe > 0 {
+		probeTime = time.Duration(cfg.Probe) * time.Second
+		log.Infof("Probe servers every %d seconds\n", cfg.Probe)
+	}
+	if cfg.ProbeLoss > 0 {
+		probeLoss = float64(cfg.ProbeLoss) / 100
+		log.Infof("Avoid servers losing %d%% of probes\n", cfg.ProbeLoss)
 	}
-	serverIP = serverAddr.IP
-	serverPort = uint16(serverAddr.Port)
 
 	// Publish
 	if cfg.Publish != "" {
@@ -328,6 +881,81 @@ func main() {
 		log.Infof("Publish %s\n", publishIP.IP)
 	}
 
+	// GeoIP
+	if len(cfg.GeoIP) > 0 {
+		geo, err = geoip.Open(cfg.GeoIP)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("open geoip: %w", err))
+		}
+		log.Infof("Use GeoIP databases %s\n", geo)
+
+		interval := cfg.GeoIPReload
+		if interval <= 0 {
+			interval = 86400
+		}
+		if !*argCheckConfig {
+			go func() {
+				for range time.Tick(time.Duration(interval) * time.Second) {
+					err := geo.Reload()
+					if err != nil {
+						log.Errorln(fmt.Errorf("reload geoip: %w", err))
+					} else {
+						log.Infoln("Reload GeoIP databases")
+					}
+				}
+			}()
+		}
+		log.Infof("Reload GeoIP databases every %d seconds\n", interval)
+	}
+
+	// Split tunneling
+	for _, s := range cfg.Tunnel {
+		rule, err := addr.ParseTunnelRule(s, geo)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse tunnel rule %s: %w", s, err))
+		}
+		tunnelRules = append(tunnelRules, rule)
+
+		// Rules of locations are matched in handling
+		if rule.IsLocation() {
+			isRouted = true
+		}
+	}
+	if len(tunnelRules) > 0 {
+		if cfg.Bridge {
+			log.Fatalln(errors.New("split tunneling not support with bridging"))
+		}
+		if len(tunnelRules) == 1 {
+			log.Infof("Tunnel destinations %s\n", tunnelRules[0])
+		} else {
+			log.Infoln("Tunnel destinations:")
+			for _, rule := range tunnelRules {
+				log.Infof("  %s\n", rule)
+			}
+		}
+	}
+
+	// Domain routing
+	if len(cfg.DomainRoute) > 0 {
+		var add, remove func(ip net.IP, route addr.Route)
+		if cfg.Rule && !*argCheckConfig {
+			add, remove = addRouteFirewallRule, deleteRouteFirewallRule
+		}
+
+		router, err = addr.NewDomainRouter(cfg.DomainRoute, add, remove)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse domain routes: %w", err))
+		}
+		if cfg.Bridge {
+			log.Fatalln(errors.New("domain routing not support with bridging"))
+		}
+
+		// Destinations routed by neither domains nor rules are tunneled if no domain is routed by the tunnel
+		isTunnelAll = len(tunnelRules) <= 0 && !router.HasTunnel()
+		isRouted = true
+		log.Infof("Route domains %s\n", router)
+	}
+
 	// Mode
 	switch cfg.Mode {
 	case "faketcp":
@@ -340,32 +968,139 @@ func main() {
 		log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
 	}
 
+	// KDF
+	kdf, err := crypto.ParseKDF(cfg.KDF, cfg.KDFMemory, cfg.KDFIters)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse kdf: %w", err))
+	}
+	crypto.SetKDF(kdf)
+
+	// Rekey
+	crypto.SetRekeyOptions(crypto.RekeyOptions{
+		Interval: time.Duration(cfg.RekeyTime) * time.Second,
+		Bytes:    int64(cfg.RekeyBytes) * 1024 * 1024,
+	})
+
+	// Key exchange
+	crypto.SetKeyExchange(cfg.KeyExchange)
+
+	// Identity
+	if cfg.PrivateKey != "" {
+		identity, err := crypto.ParseIdentity(cfg.PrivateKey, cfg.PeerKeys)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse identity: %w", err))
+		}
+		crypto.SetIdentity(identity)
+		log.Infof("Authenticate as %s with %d peer keys\n", identity.PublicKey(), identity.Len())
+	}
+
 	// Crypt
-	crypt, err = crypto.ParseCrypt(cfg.Method, cfg.Password)
+	password := []byte(cfg.Password)
+	if cfg.PassFile != "" || cfg.PassCmd != "" {
+		password, err = config.ReadPassword(cfg.PassFile, cfg.PassCmd)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("read password: %w", err))
+		}
+	}
+	crypt, err = crypto.ParseCryptSecret(cfg.Method, password)
 	if err != nil {
 		log.Fatalln(fmt.Errorf("parse crypt: %w", err))
 	}
 	method := crypt.Method()
+	if method == crypto.MethodPlain && cfg.PrivateKey != "" {
+		log.Fatalln(errors.New("private key not support with method plain"))
+	}
 	if method != crypto.MethodPlain {
-		log.Infof("Encrypt with %s\n", method)
+		if method == crypto.MethodHMAC {
+			log.Infof("Authenticate with %s without encryption\n", method)
+		} else {
+			log.Infof("Encrypt with %s\n", method)
+		}
+		if !kdf.IsDefault() {
+			log.Infof("Derive keys with %s\n", kdf)
+		}
+		if cfg.KeyExchange || cfg.PrivateKey != "" {
+			log.Infoln("Exchange session keys with X25519")
+		}
+		if cfg.RekeyTime > 0 {
+			log.Infof("Re-key every %d seconds\n", cfg.RekeyTime)
+		}
+		if cfg.RekeyBytes > 0 {
+			log.Infof("Re-key every %d MB\n", cfg.RekeyBytes)
+		}
+	}
+
+	// Bridge
+	isBridge = cfg.Bridge
+	if isBridge {
+		bridge = pcap.NewBridge()
+		bridge.SetDeadline(keepBridge)
+		destick = pcap.NewFrameDesticker()
+		destick.SetDeadline(keepSticky)
+		log.Infoln("Enable bridging")
+	}
+
+	// ACL
+	acl, err = addr.ParseACL(cfg.Allow, cfg.Deny, geo)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse acl: %w", err))
+	}
+	if !acl.IsEmpty() {
+		log.Infof("Allow destinations %s\n", acl)
 	}
 
 	// Add firewall rule
-	if cfg.Rule {
-		err := exec.DisableIPForwarding()
-		if err != nil {
-			log.Errorln(fmt.Errorf("disable ip forwarding: %w", err))
+	if cfg.Rule && !*argCheckConfig {
+		if len(tunnelRules) <= 0 && router == nil {
+			err := exec.DisableIPForwarding()
+			if err != nil {
+				log.Errorln(fmt.Errorf("disable ip forwarding: %w", err))
+			} else {
+				log.Infoln("Disable IP forwarding")
+			}
 		} else {
-			log.Infoln("Disable IP forwarding")
+			// Packets bypassing the tunnel are forwarded normally, and packets in the tunnel are dropped in forwarding
+			err := exec.EnableIPForwarding()
+			if err != nil {
+				log.Errorln(fmt.Errorf("enable ip forwarding: %w", err))
+			} else {
+				log.Infoln("Enable IP forwarding")
+			}
+
+			for _, rule := range tunnelRules {
+				if rule.IsLocation() {
+					log.Errorln(fmt.Errorf("add forward firewall rule %s: location not support", rule))
+					continue
+				}
+				low, high := rule.Ports()
+				err := exec.AddForwardFirewallRule(rule.IPNet(), rule.Protocol(), low, high)
+				if err != nil {
+					log.Errorln(fmt.Errorf("add forward firewall rule %s: %w", rule, err))
+				} else {
+					log.Infof("Add forward firewall rule %s\n", rule)
+				}
+			}
+			if isTunnelAll {
+				for _, source := range sources {
+					err := exec.AddForwardSourceFirewallRule(source.IP)
+					if err != nil {
+						log.Errorln(fmt.Errorf("add forward firewall rule from %s: %w", source.IP, err))
+					} else {
+						log.Infof("Add forward firewall rule from %s\n", source.IP)
+					}
+				}
+			}
 		}
 
 		switch mode {
 		case "faketcp":
-			err = exec.AddSpecificFirewallRule(serverIP, serverPort)
-			if err != nil {
-				log.Errorln(fmt.Errorf("add firewall rule: %w", err))
-			} else {
-				log.Infoln("Add firewall rule")
+			for _, server := range upstreams {
+				err = exec.AddSpecificFirewallRule(server.addr.IP, uint16(server.addr.Port))
+				if err != nil {
+					log.Errorln(fmt.Errorf("add firewall rule of %s: %w", server.addr, err))
+				} else {
+					log.Infof("Add firewall rule of %s\n", server.addr)
+				}
 			}
 		case "tcp":
 			break
@@ -375,16 +1110,19 @@ func main() {
 	}
 
 	// Monitor
-	if cfg.Monitor != 0 {
-		if cfg.Monitor == int(upPort) {
-			log.Fatalln(fmt.Errorf("same monitor port with upstream port"))
-		}
-
+	if cfg.Monitor != 0 && !*argCheckConfig {
 		monitor = stat.NewTrafficMonitor()
 
+		dashboardHandler, err := dashboard.Handler(name)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("create dashboard: %w", err))
+		}
+
+		// The default mux is not used, where pprof registers itself
+		mux := http.NewServeMux()
 		go func() {
-			http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-				b, err := json.Marshal(&struct {
+			mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+				serveJSON(w, req, http.StatusOK, &struct {
 					Name    string               `json:"name"`
 					Version string               `json:"version"`
 					Time    int                  `json:"time"`
@@ -395,21 +1133,45 @@ func main() {
 					Time:    int(time.Now().Sub(startTime).Seconds()),
 					Monitor: monitor,
 				})
-				if err != nil {
-					log.Errorln(fmt.Errorf("monitor: %w", err))
-					return
-				}
+			})
 
-				// Handle CORS
-				w.Header().Set("Access-Control-Allow-Origin", "*")
+			mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+				status, isUp := upstreamStatus()
 
-				_, err = io.WriteString(w, string(b))
-				if err != nil {
-					log.Errorln(fmt.Errorf("monitor: %w", err))
+				// Unavailable until upstream is up for health checks
+				code := http.StatusOK
+				if !isUp {
+					code = http.StatusServiceUnavailable
 				}
+
+				serveJSON(w, req, code, &struct {
+					Name     string      `json:"name"`
+					Version  string      `json:"version"`
+					Time     int         `json:"time"`
+					Upstream interface{} `json:"upstream"`
+				}{
+					Name:     name,
+					Version:  versionInfo,
+					Time:     int(time.Now().Sub(startTime).Seconds()),
+					Upstream: status,
+				})
+			})
+
+			mux.HandleFunc("/clients", func(w http.ResponseWriter, req *http.Request) {
+				serveJSON(w, req, http.StatusOK, dumpSources())
+			})
+
+			mux.HandleFunc("/flows", func(w http.ResponseWriter, req *http.Request) {
+				serveJSON(w, req, http.StatusOK, monitor.Flows())
+			})
+
+			mux.HandleFunc("/errors", func(w http.ResponseWriter, req *http.Request) {
+				serveJSON(w, req, http.StatusOK, log.RecentErrors())
 			})
 
-			http.HandleFunc("/dns", func(w http.ResponseWriter, req *http.Request) {
+			mux.Handle("/dashboard", dashboardHandler)
+
+			mux.HandleFunc("/dns", func(w http.ResponseWriter, req *http.Request) {
 				type IPName struct {
 					IP   string `json:"ip"`
 					Name string `json:"name"`
@@ -425,88 +1187,296 @@ type IPName struct {
 				}
 				dnsLock.RUnlock()
 
-				b, err := json.Marshal(ipNames)
-				if err != nil {
-					log.Errorln(fmt.Errorf("monitor: %w", err))
-					return
-				}
-
-				// Handle CORS
-				w.Header().Set("Access-Control-Allow-Origin", "*")
-
-				_, err = io.WriteString(w, string(b))
-				if err != nil {
-					log.Errorln(fmt.Errorf("monitor: %w", err))
-				}
+				serveJSON(w, req, http.StatusOK, ipNames)
 			})
 
-			err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Monitor), nil)
+			err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Monitor), mux)
 			if err != nil {
 				log.Errorln(fmt.Errorf("monitor: %w", err))
 			}
 		}()
 
 		log.Infof("Monitor on :%d\n", cfg.Monitor)
+		log.Infof("Dashboard on http://localhost:%d/dashboard\n", cfg.Monitor)
 		log.Infoln("You can now observe traffic on http://ikago.ikas.ink")
 	}
 
+	// Profiling
+	if cfg.PProf != "" && !*argCheckConfig {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		go func() {
+			err := http.ListenAndServe(cfg.PProf, mux)
+			if err != nil {
+				log.Errorln(fmt.Errorf("pprof: %w", err))
+			}
+		}()
+
+		log.Infof("Profile on http://%s/debug/pprof/\n", cfg.PProf)
+	}
+
 	// Mode-related options
 	switch mode {
 	case "faketcp":
 		// MTU
 		mtu = cfg.MTU
-		if mtu != pcap.MaxMTU {
+		if mtu != 0 {
 			log.Infof("Set MTU to %d Bytes\n", mtu)
 		}
 
-		// KCP
-		isKCP = cfg.KCP
-		kcpConfig = &cfg.KCPConfig
-		if isKCP {
-			log.Infoln("Enable KCP")
+		// ECN
+		isECN = !cfg.NoECN
+		if !isECN {
+			log.Infoln("Disable copying DSCP and ECN")
 		}
-	case "tcp":
-		break
-	default:
-		log.Fatalln(fmt.Errorf("mode %s not support", mode))
-	}
 
-	if len(sources) == 1 {
-		log.Infof("Proxy %s through :%d to %s\n", sources[0], upPort, serverAddr)
-	} else {
-		log.Infoln("Proxy:")
-		for i, f := range sources {
+		// TTL
+		ttlPolicy, err = pcap.ParseTTLPolicy(cfg.TTL)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse ttl policy: %w", err))
+		}
+		if !ttlPolicy.IsDefault() {
+			log.Infof("Set TTL policy to %s\n", ttlPolicy)
+		}
+
+		// DSCP
+		dscp, err = pcap.ParseDSCP(cfg.DSCP)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse dscp: %w", err))
+		}
+		if !dscp.IsDefault() {
+			log.Infof("Mark DSCP %s\n", dscp)
+		}
+
+		// Emulation
+		isEmulated = cfg.Emulate
+		if isEmulated {
+			log.Infoln("Enable TCP emulation")
+		}
+
+		// Fingerprint
+		fingerprint, err = pcap.ParseFingerprint(cfg.Fingerprint)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse fingerprint: %w", err))
+		}
+		if !fingerprint.IsDefault() {
+			log.Infof("Imitate fingerprint of %s\n", fingerprint)
+		}
+
+		// SYN options
+		synOptions, err = pcap.ParseSYNOptions(cfg.SYNOptions)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse syn options: %w", err))
+		}
+		if !synOptions.IsDefault() {
+			log.Infof("Set SYN options to %s\n", synOptions)
+		}
+
+		// Keepalive
+		keepalive = time.Duration(cfg.KeepAlive) * time.Second
+		if keepalive > 0 {
+			log.Infof("Send keepalive every %d seconds\n", cfg.KeepAlive)
+		}
+
+		// Pace
+		pace = cfg.Pace
+		if pace > 0 {
+			log.Infof("Pace segments at %d Kbps\n", pace)
+		}
+
+		// Obfuscation
+		obfuscator, err = obfs.ParseObfuscator(cfg.Obfs)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse obfs: %w", err))
+		}
+		if obfuscator.Method() != obfs.MethodPlain {
+			log.Infof("Obfuscate in %s\n", obfuscator.Method())
+		}
+
+		// KCP
+		isKCP = cfg.KCP
+		kcpConfig = &cfg.KCPConfig
+		if isKCP {
+			log.Infoln("Enable KCP")
+		}
+	case "tcp":
+		break
+	default:
+		log.Fatalln(fmt.Errorf("mode %s not support", mode))
+	}
+
+	if len(sources) == 1 {
+		log.Infof("Proxy %s through :%d to %s\n", sources[0], upPort, upstreams[0].addr)
+	} else if len(sources) > 1 {
+		log.Infoln("Proxy:")
+		for i, f := range sources {
 			if i != len(sources)-1 {
 				log.Infof("  %s\n", f)
 			} else {
-				log.Infof("  %s through :%d to %s\n", f, upPort, serverAddr)
+				log.Infof("  %s through :%d to %s\n", f, upPort, upstreams[0].addr)
 			}
 		}
 	}
 
-	// Find devices
-	listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
+	// Dump
+	dumpLayer, err := pcap.ParseDumpLayer(cfg.DumpLayer)
 	if err != nil {
-		log.Fatalln(fmt.Errorf("find listen devices: %w", err))
+		log.Fatalln(fmt.Errorf("parse dump layer: %w", err))
 	}
-	if len(cfg.ListenDevs) <= 0 {
-		// Remove loopback devices by default
-		result := make([]*pcap.Device, 0)
+	if cfg.Dump != "" && !*argCheckConfig {
+		dumper, err = pcap.CreateDumper(cfg.Dump, dumpLayer)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("create dump %s: %w", cfg.Dump, err))
+		}
+		pcap.SetDumper(dumper)
 
-		for _, dev := range listenDevs {
-			if dev.IsLoop() {
-				continue
-			}
-			result = append(result, dev)
+		log.Infof("Dump %s packets to %s\n", dumpLayer, cfg.Dump)
+	}
+
+	// Tracing
+	if cfg.TraceSample < 0 {
+		log.Fatalln(fmt.Errorf("trace sample %d out of range", cfg.TraceSample))
+	}
+	if cfg.Trace != "" && !*argCheckConfig {
+		err = tracing.Setup(tracing.Options{
+			Endpoint: cfg.Trace,
+			Sample:   cfg.TraceSample,
+			Service:  name,
+			Version:  version,
+		})
+		if err != nil {
+			log.Fatalln(fmt.Errorf("set up tracing: %w", err))
+		}
+
+		sample := cfg.TraceSample
+		if sample == 0 {
+			sample = tracing.DefaultSample
+		}
+		log.Infof("Trace 1 of every %d packets to %s\n", sample, cfg.Trace)
+	}
+
+	// Libpcap
+	pcap.SetPcapOptions(pcap.PcapOptions{
+		SnapLen:     cfg.SnapLen,
+		BufferSize:  cfg.Buffer,
+		IsImmediate: cfg.Immediate,
+		Timeout:     time.Duration(cfg.Timeout) * time.Millisecond,
+	})
+
+	// Batch
+	pcap.SetBatchSize(cfg.Batch)
+	if cfg.Batch > 1 {
+		log.Infof("Read and write up to %d packets in a batch\n", cfg.Batch)
+	}
+
+	// Busy poll
+	pcap.SetBusyPoll(cfg.BusyPoll)
+	if cfg.BusyPoll {
+		log.Infoln("Busy poll devices")
+	}
+
+	// Workers
+	workers = cfg.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	log.Infof("Handle packets in %d workers\n", workers)
+
+	// Queues
+	queueSize = cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = 1000
+	}
+	queuePolicy = make(map[pcap.TrafficClass]pcap.QueuePolicy)
+	for class, policy := range pcap.DefaultQueuePolicies {
+		queuePolicy[class] = policy
+	}
+	for name, s := range cfg.QueuePolicy {
+		class, err := pcap.ParseTrafficClass(name)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse traffic class: %w", err))
+		}
+		policy, err := pcap.ParseQueuePolicy(s)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse queue policy of traffic class %s: %w", class, err))
+		}
+		queuePolicy[class] = policy
+	}
+	for class := pcap.ClassRealtime; class <= pcap.ClassBulk; class++ {
+		log.Infof("Queue up to %d %s packets in each worker, which %s when full\n", queueSize, class, queuePolicy[class])
+	}
+
+	// QoS
+	classifier, err = pcap.ParseClassifier(cfg.QoS, cfg.DropLog)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse qos: %w", err))
+	}
+	if !classifier.IsEmpty() {
+		log.Infof("Classify %s\n", classifier)
+	}
+
+	// Schedule
+	schedule.Start(applySchedules)
+
+	// Memory budget
+	if cfg.MemoryLimit > 0 {
+		memBudget = stat.NewMemoryBudget(uint64(cfg.MemoryLimit) * 1024 * 1024)
+		log.Infof("Shed load when the heap approaches %d MB\n", cfg.MemoryLimit)
+	}
+
+	// Shaper
+	if cfg.Shape > 0 {
+		shaper = stat.NewShaper(cfg.Shape, cfg.ShapeBurst)
+		if cfg.ShapeBurst > 0 {
+			log.Infof("Shape egress at %d Kbps with bursts of %d KB\n", cfg.Shape, cfg.ShapeBurst)
+		} else {
+			log.Infof("Shape egress at %d Kbps\n", cfg.Shape)
 		}
+	}
 
-		listenDevs = result
+	// Backends
+	for name, s := range cfg.Backends {
+		backend, err := pcap.ParseBackend(s)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse backend of device %s: %w", name, err))
+		}
+		pcap.SetBackend(name, backend)
+		if backend != pcap.BackendPcap {
+			log.Infof("Use %s backend in device %s\n", backend, name)
+		}
 	}
-	if len(listenDevs) <= 0 {
-		log.Fatalln(errors.New("cannot determine listen device"))
+
+	// Find devices, and nothing is listened on without sources, where proxy servers are the only entries
+	if len(sources) > 0 || isBridge {
+		listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("find listen devices: %w", err))
+		}
+		if len(cfg.ListenDevs) <= 0 {
+			// Remove loopback devices by default
+			result := make([]*pcap.Device, 0)
+
+			for _, dev := range listenDevs {
+				if dev.IsLoop() {
+					continue
+				}
+				result = append(result, dev)
+			}
+
+			listenDevs = result
+		}
+		if len(listenDevs) <= 0 {
+			log.Fatalln(errors.New("cannot determine listen device"))
+		}
 	}
 
-	upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
+	upDevName, upGateway = cfg.UpDev, gateway
+	upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(upDevName, upGateway)
 	if err != nil {
 		log.Fatalln(fmt.Errorf("find upstream device and gateway device: %w", err))
 	}
@@ -520,6 +1490,52 @@ type IPName struct {
 		log.Fatalln(errors.New("cannot determine gateway device"))
 	}
 
+	// Second path in multipath, which is a device with an optional gateway
+	if cfg.Multipath != "" {
+		var ip net.IP
+		name := cfg.Multipath
+		if i := strings.Index(name, ":"); i >= 0 {
+			ip = net.ParseIP(name[i+1:])
+			if ip == nil {
+				log.Fatalln(fmt.Errorf("invalid gateway %s", name[i+1:]))
+			}
+			name = name[:i]
+		}
+
+		dupDev, dupGateway, err = pcap.FindUpstreamDevAndGatewayDev(name, ip)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("find multipath device and gateway device: %w", err))
+		}
+		if dupDev == nil || dupGateway == nil {
+			log.Fatalln(errors.New("cannot determine multipath device and gateway device"))
+		}
+		dupID = rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
+	}
+
+	// Roaming
+	if cfg.Roaming {
+		isRoaming = true
+		log.Infoln("Resume sessions from new addresses in roaming")
+	}
+
+	// Proxy servers
+	socksAddr, httpAddr = cfg.Socks, cfg.HTTPProxy
+	transAddr, isTProxy = cfg.Transparent, cfg.TProxy
+
+	// Detect MTU
+	if mtu == 0 {
+		mtu = pcap.DetectMTU(append(append(make([]*pcap.Device, 0), listenDevs...), upDev)...)
+		if mtu != pcap.DefaultMTU {
+			log.Infof("Detect MTU %d Bytes\n", mtu)
+		}
+	}
+
+	// Check configuration only
+	if *argCheckConfig {
+		log.Infoln("Configuration is valid")
+		os.Exit(0)
+	}
+
 	// Wait signals
 	sig := make(chan os.Signal)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
@@ -529,6 +1545,31 @@ type IPName struct {
 		os.Exit(0)
 	}()
 
+	// Reload configuration on SIGHUP
+	if *argConfig != "" {
+		loaded = cfg
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				err := reload(*argConfig)
+				if err != nil {
+					log.Errorln(fmt.Errorf("reload configuration: %w", err))
+				}
+			}
+		}()
+	}
+
+	// Control
+	if cfg.Control != "" {
+		err = serveControl(cfg.Control)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("control: %w", err))
+		}
+		log.Infof("Control on %s\n", cfg.Control)
+	}
+
 	// Open pcap
 	err = open()
 	if err != nil {
@@ -541,7 +1582,7 @@ func open() error {
 
 	if len(listenDevs) == 1 {
 		log.Infof("Listen on %s\n", listenDevs[0].String())
-	} else {
+	} else if len(listenDevs) > 1 {
 		log.Infoln("Listen on:")
 		for _, dev := range listenDevs {
 			log.Infof("  %s\n", dev.String())
@@ -564,8 +1605,33 @@ func open() error {
 		fs = append(fs, s)
 	}
 	f := strings.Join(fs, " || ")
-	filter := fmt.Sprintf("ip && (((tcp || udp) && (%s) && not (src host %s && src port %d)) || ((icmp || (ip[6:2] & 0x1fff) != 0) && (%s) && not src host %s))",
-		f, serverIP, serverPort, f, serverIP)
+
+	// Traffic of all servers is excluded, so servers failed over to are not captured
+	sfs, hfs, bfs := make([]string, 0), make([]string, 0), make([]string, 0)
+	for _, server := range upstreams {
+		sfs = append(sfs, fmt.Sprintf("(src host %s && src port %d)", server.addr.IP, server.addr.Port))
+		hfs = append(hfs, fmt.Sprintf("src host %s", server.addr.IP))
+		bfs = append(bfs, fmt.Sprintf("(host %s && tcp port %d)", server.addr.IP, server.addr.Port))
+	}
+	sf, hf := strings.Join(sfs, " || "), strings.Join(hfs, " || ")
+
+	filter := fmt.Sprintf("(ip && (((tcp || udp) && (%s) && not (%s)) || ((icmp || (ip[6:2] & 0x1fff) != 0) && (%s) && not (%s)))) || (ip6 && ((tcp || udp) || (icmp6 && (ip6[40] <= 4 || ip6[40] == 128 || ip6[40] == 129)) || ip6[6] == 43 || ip6[6] == 44 || ip6[6] == 51 || ip6[6] == 60 || (ip6[6] == 0 && ip6[40] != 58)) && (%s) && not (%s)))",
+		f, sf, f, hf, f, hf)
+	if isRouted {
+		// Packets are routed in handling, and DNS responses to sources are sniffed
+		dfs := make([]string, 0)
+		for _, f := range sources {
+			s, err := addr.DstBPFFilter(f)
+			if err != nil {
+				return fmt.Errorf("parse filter %s: %w", f, err)
+			}
+
+			dfs = append(dfs, s)
+		}
+		filter = fmt.Sprintf("(%s) || (udp src port 53 && (%s))", filter, strings.Join(dfs, " || "))
+	} else if len(tunnelRules) > 0 {
+		filter = fmt.Sprintf("(%s) && (%s)", filter, addr.TunnelBPFFilter(tunnelRules))
+	}
 	if publishIP != nil {
 		s, err := addr.DstBPFFilter(publishIP)
 		if err != nil {
@@ -573,6 +1639,9 @@ func open() error {
 		}
 		filter = filter + fmt.Sprintf(" || (arp[6:2] = 1 && %s)", s)
 	}
+	if isBridge {
+		filter = fmt.Sprintf("not (%s)", strings.Join(bfs, " || "))
+	}
 
 	// Handles for listening
 	for _, dev := range listenDevs {
@@ -590,33 +1659,140 @@ func open() error {
 			return fmt.Errorf("open listen device %s: %w", conn.LocalDev().Alias(), err)
 		}
 
+		// Frames injected must not be bridged again
+		if isBridge {
+			err := conn.SetInbound()
+			if err != nil {
+				log.Errorln(fmt.Errorf("set inbound in device %s: %w", conn.LocalDev().Alias(), err))
+			}
+			bridge.AddPort(conn)
+		}
+
+		conn.SetDumpLayer(pcap.DumpInner)
 		listenConns = append(listenConns, conn)
 	}
 
-	// Handle for routing upstream
-	switch mode {
-	case "faketcp":
-		if isKCP {
-			upConn, err = pcap.DialFakeTCPWithKCP(upDev, gatewayDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt, mtu, kcpConfig)
-		} else {
-			upConn, err = pcap.DialFakeTCP(upDev, gatewayDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt, mtu)
+	// Handle for routing upstream, which are all servers in load balancing, and servers are checked for their health
+	if balancer != nil {
+		for i := range upstreams {
+			redial(i, nil)
+			go checkBalanced(i)
+		}
+	} else {
+		upConn, active, err = dialUpstreams(0)
+		if err != nil {
+			return fmt.Errorf("open upstream: %w", err)
+		}
+		if isBridge {
+			bridge.AddPort(upConn)
+		}
+		if len(upstreams) > 1 || probeTime > 0 {
+			go checkUpstream()
 		}
-	case "tcp":
-		upConn, err = pcap.DialTCP(upDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt)
-	default:
-		err = fmt.Errorf("mode %s not support", mode)
 	}
-	if err != nil {
-		return fmt.Errorf("open upstream: %w", err)
+
+	// Handle for the second path in multipath
+	if dupDev != nil {
+		dupConn, err = pcap.DialFakeTCP(dupDev, dupGateway, upPort, upstreams[0].addr, crypt, mtu, isECN, ttlPolicy, dscp, isEmulated, synOptions, keepalive, fingerprint, pace, obfuscator)
+		if err != nil {
+			return fmt.Errorf("open multipath: %w", err)
+		}
+		log.Infof("Duplicate realtime and interactive packets through %s\n", dupDev)
+
+		go readMultipath()
+	}
+
+	if isRoaming {
+		go roam()
+	}
+	go checkDev()
+
+	// Proxy servers, whose streams and datagrams are made into packets from the stack, which is shared by them
+	if socksAddr != "" || httpAddr != "" || transAddr != "" {
+		size := mtu - 60 - crypt.Cost()
+		if obfuscator != nil {
+			size = size - obfuscator.Cost()
+		}
+		stack = socks.NewStack(size, writeSocks)
+		allows := func(a net.Addr) bool {
+			return acl.IsEmpty() || acl.Allows(a)
+		}
+
+		if socksAddr != "" {
+			socksServer, err = socks.Listen(socksAddr, stack, allows)
+			if err != nil {
+				return fmt.Errorf("open socks: %w", err)
+			}
+			log.Infof("Serve SOCKS5 on %s\n", socksServer.Addr())
+
+			go func() {
+				err := socksServer.Serve()
+				if err != nil {
+					log.Errorln(fmt.Errorf("serve socks: %w", err))
+				}
+			}()
+		}
+
+		if httpAddr != "" {
+			httpServer, err = socks.ListenHTTP(httpAddr, stack, allows)
+			if err != nil {
+				return fmt.Errorf("open http proxy: %w", err)
+			}
+			log.Infof("Serve HTTP proxy on %s\n", httpServer.Addr())
+
+			go func() {
+				err := httpServer.Serve()
+				if err != nil {
+					log.Errorln(fmt.Errorf("serve http proxy: %w", err))
+				}
+			}()
+		}
+
+		if transAddr != "" {
+			transServer, err = socks.ListenTransparent(transAddr, isTProxy, stack, allows)
+			if err != nil {
+				return fmt.Errorf("open transparent proxy: %w", err)
+			}
+			if isTProxy {
+				log.Infof("Serve transparent proxy of TCP and UDP by TPROXY on %s\n", transServer.Addr())
+			} else {
+				log.Infof("Serve transparent proxy of TCP by REDIRECT on %s\n", transServer.Addr())
+			}
+
+			go func() {
+				err := transServer.Serve()
+				if err != nil {
+					log.Errorln(fmt.Errorf("serve transparent proxy: %w", err))
+				}
+			}()
+		}
 	}
 
-	// Start handling
+	// Start handling, packets of a flow are handled by the same worker in order
+	workerPool = pcap.NewWorkerPool(workers, queueSize, queuePolicy, func(v interface{}) {
+		cp := v.(pcap.ConnPacket)
+
+		var err error
+		if isBridge {
+			err = bridgeFrame(cp.Packet.Data(), cp.Conn)
+		} else {
+			ctx, span := tracing.StartPacket("listen", cp.Packet.Metadata().Timestamp)
+			err = handleListen(ctx, cp.Packet, cp.Conn)
+			tracing.End(span, err)
+		}
+		if err != nil {
+			log.Errorw(pcap.Flow(cp.Packet), fmt.Errorf("handle listen in device %s: %w", cp.Conn.LocalDev().Alias(), err))
+			log.Verboseln(cp.Packet)
+		}
+		pcap.ReleasePacket(cp.Packet)
+	})
+
 	for i := 0; i < len(listenConns); i++ {
 		conn := listenConns[i]
 
 		go func() {
 			for {
-				packet, err := conn.ReadPacket()
+				packets, err := conn.ReadPackets()
 				if err != nil {
 					if isClosed {
 						return
@@ -625,79 +1801,395 @@ func open() error {
 					continue
 				}
 
-				c <- pcap.ConnPacket{Packet: packet, Conn: conn}
+				for _, packet := range packets {
+					if !classifier.Allows(packet) || !workerPool.Submit(pcap.FlowHash(packet), classifier.Classify(packet), len(packet.Data()), pcap.ConnPacket{Packet: packet, Conn: conn}) {
+						pcap.ReleasePacket(packet)
+					}
+				}
 			}
 		}()
 	}
 
-	go func() {
-		for cp := range c {
-			err := handleListen(cp.Packet, cp.Conn)
-			if err != nil {
-				log.Errorln(fmt.Errorf("handle listen in device %s: %w", cp.Conn.LocalDev().Alias(), err))
-				log.Verboseln(cp.Packet)
-				continue
+	if balancer != nil {
+		for i := 1; i < len(upstreams); i++ {
+			index := i
+
+			go func() {
+				err := readUpstream(index)
+				if err != nil {
+					log.Errorln(fmt.Errorf("read upstream %s: %w", upstreams[index].addr, err))
+				}
+			}()
+		}
+	}
+
+	return readUpstream(0)
+}
+
+// readMultipath reads and handles packets from the connection of the second path in multipath until the client is
+// closed.
+func readMultipath() {
+	b := make([]byte, pcap.IPv4MaxSize)
+	for {
+		n, err := dupConn.Read(b)
+		if err != nil {
+			if isClosed {
+				return
 			}
+			log.Errorln(fmt.Errorf("read multipath: %w", err))
+			continue
 		}
-	}()
 
+		ctx, span := tracing.StartPacket("upstream", time.Time{})
+		err = handleUpstream(ctx, b[:n])
+		tracing.End(span, err)
+		if err != nil {
+			log.Errorw(log.Fields{"server": dupConn.RemoteAddr().String()}, fmt.Errorf("handle multipath in address %s: %w", dupConn.LocalAddr().String(), err))
+			log.Verbosef("Source: %s\nSize: %d Bytes\n\n", dupConn.RemoteAddr().String(), n)
+			continue
+		}
+	}
+}
+
+// upstreamConn returns the connection to the server of the index in load balancing, or to the active server, which may
+// be nil if it is not connected.
+func upstreamConn(index int) net.Conn {
+	if balancer == nil {
+		return upConn
+	}
+
+	return upstreams[index].conn
+}
+
+// readUpstream reads and handles packets from the connection to the server of the index in load balancing, or to the
+// active server, until the client is closed.
+func readUpstream(index int) error {
 	b := make([]byte, pcap.IPv4MaxSize)
 	for {
-		n, err := upConn.Read(b)
+		conn := upstreamConn(index)
+		if conn == nil {
+			if isClosed {
+				return nil
+			}
+			time.Sleep(heartbeat)
+			continue
+		}
+
+		n, err := conn.Read(b)
 		if err != nil {
 			if isClosed {
 				return nil
 			}
+			// The connection is closed in failover
+			if conn != upstreamConn(index) {
+				continue
+			}
 			if errors.Is(err, io.EOF) {
-				log.Fatalf("Connection to server %s is closed, is the server or your network down?\n", upConn.RemoteAddr())
+				if len(upstreams) <= 1 {
+					log.Fatalf("Connection to server %s is closed, is the server or your network down?\n", conn.RemoteAddr())
+				}
+
+				log.Errorf("Connection to server %s is closed\n", conn.RemoteAddr())
+				if balancer != nil {
+					redial(index, conn)
+				} else {
+					failover(conn)
+				}
+				continue
 			}
 			log.Errorln(fmt.Errorf("read upstream: %w", err))
 			continue
 		}
 
-		err = handleUpstream(b[:n])
+		ctx, span := tracing.StartPacket("upstream", time.Time{})
+		err = handleUpstream(ctx, b[:n])
+		tracing.End(span, err)
 		if err != nil {
-			log.Errorln(fmt.Errorf("handle upstream in address %s: %w", upConn.LocalAddr().String(), err))
-			log.Verbosef("Source: %s\nSize: %d Bytes\n\n", upConn.RemoteAddr().String(), n)
+			log.Errorw(log.Fields{"server": conn.RemoteAddr().String()}, fmt.Errorf("handle upstream in address %s: %w", conn.LocalAddr().String(), err))
+			log.Verbosef("Source: %s\nSize: %d Bytes\n\n", conn.RemoteAddr().String(), n)
 			continue
 		}
 	}
 }
 
-func closeAll() {
-	isClosed = true
-	for _, handle := range listenConns {
-		if handle != nil {
-			handle.Close()
-		}
+// reload reloads the configuration file and applies options which can be changed without reconnecting. Other options
+// changed are reported and take effect after restarting.
+func reload(path string) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	cfg, err := config.ParseFile(path, *argProfile)
+	if err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
 	}
-	if upConn != nil {
-		upConn.Close()
+	_, err = config.ApplyEnv(cfg, nil)
+	if err != nil {
+		return fmt.Errorf("apply environment variables: %w", err)
 	}
-}
 
-func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
-	var (
-		indicator    *pcap.PacketIndicator
-		arpLayer     *layers.ARP
-		newARPLayer  *layers.ARP
-		linkLayer    gopacket.Layer
-		newLinkLayer *layers.Ethernet
-	)
+	// Upstream port is randomized
+	if cfg.Port == 0 {
+		cfg.Port = loaded.Port
+	}
 
-	// Parse packet
-	indicator, err := pcap.ParsePacket(packet)
+	// Options discovered by DNS are kept
+	_, err = config.ApplyParams(cfg, srvOptions)
 	if err != nil {
-		return fmt.Errorf("parse packet: %w", err)
+		return fmt.Errorf("apply parameters of server %s: %w", cfg.Server, err)
 	}
 
-	if t := indicator.NetworkLayer().LayerType(); t != layers.LayerTypeARP {
-		return fmt.Errorf("network layer type %s not support", t)
+	newACL, err := addr.ParseACL(cfg.Allow, cfg.Deny, geo)
+	if err != nil {
+		return fmt.Errorf("parse acl: %w", err)
 	}
 
-	// Create new ARP layer
-	arpLayer = indicator.ARPLayer()
-	newARPLayer = &layers.ARP{
+	for _, key := range config.Diff(loaded, cfg) {
+		switch key {
+		case "verbose":
+			log.SetVerbose(cfg.Verbose || *argVerbose)
+		case "log":
+			err := log.SetLog(cfg.Log)
+			if err != nil {
+				return fmt.Errorf("set log %s: %w", cfg.Log, err)
+			}
+		case "log-format":
+			err := log.SetFormat(cfg.LogFormat)
+			if err != nil {
+				return fmt.Errorf("set log format %s: %w", cfg.LogFormat, err)
+			}
+		case "log-syslog":
+			err := log.SetSyslog(cfg.LogSyslog, name)
+			if err != nil {
+				return fmt.Errorf("set log syslog %s: %w", cfg.LogSyslog, err)
+			}
+		case "log-eventlog":
+			source := ""
+			if cfg.LogEventLog {
+				source = name
+			}
+			err := log.SetEventLog(source)
+			if err != nil {
+				return fmt.Errorf("set log event log: %w", err)
+			}
+		case "allow", "deny":
+			acl = newACL
+		default:
+			log.Infof("Option %s changed, restart to apply\n", key)
+			continue
+		}
+
+		log.Infof("Apply option %s\n", key)
+	}
+
+	// Options not applied are kept, so they are reported again until restarting
+	applied := *loaded
+	applied.Verbose, applied.Log, applied.LogFormat = cfg.Verbose, cfg.Log, cfg.LogFormat
+	applied.LogSyslog, applied.LogEventLog = cfg.LogSyslog, cfg.LogEventLog
+	applied.Allow, applied.Deny = cfg.Allow, cfg.Deny
+	loaded = &applied
+
+	log.Infof("Reload configuration from %s\n", path)
+
+	return nil
+}
+
+// serveControl serves the control server on the path.
+func serveControl(path string) error {
+	var err error
+
+	controller, err = control.Listen(path)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	controller.Handle("status", func(args []string) (interface{}, error) {
+		var queues []pcap.QueueStat
+		if workerPool != nil {
+			queues = workerPool.Stats()
+		}
+		var memory interface{}
+		if memBudget != nil {
+			memory = memBudget
+		}
+		var shaping interface{}
+		if shaper != nil {
+			shaping = shaper
+		}
+		var servers interface{}
+		if len(upstreams) > 1 {
+			servers = upstreamsStatus()
+		}
+		var drops interface{}
+		if conn, ok := upstreamConn(active).(*pcap.FakeTCPConn); ok {
+			drops = conn.Drops()
+		}
+		var multipath interface{}
+		if dupConn != nil {
+			multipath = &struct {
+				Device     string `json:"device"`
+				Local      string `json:"local"`
+				Duplicates uint64 `json:"duplicates"`
+			}{
+				Device:     dupDev.Alias(),
+				Local:      dupConn.LocalAddr().String(),
+				Duplicates: atomic.LoadUint64(&dupSeq),
+			}
+		}
+
+		return &struct {
+			Name    string           `json:"name"`
+			Version string           `json:"version"`
+			Time    int              `json:"time"`
+			Server  string           `json:"server"`
+			Servers interface{}      `json:"servers,omitempty"`
+			Paths   interface{}      `json:"multipath,omitempty"`
+			Queues  []pcap.QueueStat `json:"queues,omitempty"`
+			Memory  interface{}      `json:"memory,omitempty"`
+			Shaper  interface{}      `json:"shaper,omitempty"`
+			Drops   interface{}      `json:"fakeTCPDrops,omitempty"`
+		}{
+			Name:    name,
+			Version: versionInfo,
+			Time:    int(time.Now().Sub(startTime).Seconds()),
+			Server:  upstreams[active].addr.String(),
+			Servers: servers,
+			Paths:   multipath,
+			Queues:  queues,
+			Memory:  memory,
+			Shaper:  shaping,
+			Drops:   drops,
+		}, nil
+	})
+	controller.Handle("reload", func(args []string) (interface{}, error) {
+		if *argConfig == "" {
+			return nil, errors.New("reload not support without configuration file")
+		}
+
+		return nil, reload(*argConfig)
+	})
+	controller.Handle("set-log-level", func(args []string) (interface{}, error) {
+		if len(args) <= 0 {
+			return nil, errors.New("missing log level")
+		}
+
+		switch strings.ToLower(args[0]) {
+		case "info":
+			log.SetVerbose(false)
+		case "verbose":
+			log.SetVerbose(true)
+		default:
+			return nil, fmt.Errorf("log level %s not support", args[0])
+		}
+		log.Infof("Set log level to %s by control\n", strings.ToLower(args[0]))
+
+		return nil, nil
+	})
+
+	go func() {
+		err := controller.Serve()
+		if err != nil && !isClosed {
+			log.Errorln(fmt.Errorf("serve control: %w", err))
+		}
+	}()
+
+	return nil
+}
+
+// ctl sends the command in arguments to the control server, and prints the result.
+func ctl(args []string) error {
+	if len(args) <= 0 {
+		return errors.New("missing command")
+	}
+
+	path := *argControl
+	if path == "" && *argConfig != "" {
+		cfg, err := config.ParseFile(*argConfig, *argProfile)
+		if err != nil {
+			return fmt.Errorf("parse config file %s: %w", *argConfig, err)
+		}
+		path = cfg.Control
+	}
+	if path == "" {
+		return errors.New("missing control path")
+	}
+
+	result, err := control.Request(path, args[0], args[1:])
+	if err != nil {
+		return err
+	}
+	if len(result) <= 0 {
+		return nil
+	}
+
+	var b bytes.Buffer
+	err = json.Indent(&b, result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("indent: %w", err)
+	}
+	log.Infoln(b.String())
+
+	return nil
+}
+
+func closeAll() {
+	isClosed = true
+	if controller != nil {
+		controller.Close()
+	}
+	for _, handle := range listenConns {
+		if handle != nil {
+			handle.Close()
+		}
+	}
+	for _, conn := range upConns() {
+		conn.Close()
+	}
+	if dupConn != nil {
+		dupConn.Close()
+	}
+	if socksServer != nil {
+		socksServer.Close()
+	}
+	if httpServer != nil {
+		httpServer.Close()
+	}
+	if transServer != nil {
+		transServer.Close()
+	}
+	if stack != nil {
+		stack.Close()
+	}
+	if dumper != nil {
+		dumper.Close()
+	}
+	err := tracing.Shutdown()
+	if err != nil {
+		log.Errorln(fmt.Errorf("shutdown tracing: %w", err))
+	}
+}
+
+func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
+	var (
+		indicator    *pcap.PacketIndicator
+		arpLayer     *layers.ARP
+		newARPLayer  *layers.ARP
+		linkLayer    gopacket.Layer
+		newLinkLayer *layers.Ethernet
+	)
+
+	// Parse packet
+	indicator, err := pcap.ParsePacket(packet)
+	if err != nil {
+		return fmt.Errorf("parse packet: %w", err)
+	}
+
+	if t := indicator.NetworkLayer().LayerType(); t != layers.LayerTypeARP {
+		return fmt.Errorf("network layer type %s not support", t)
+	}
+
+	// Create new ARP layer
+	arpLayer = indicator.ARPLayer()
+	newARPLayer = &layers.ARP{
 		AddrType:          arpLayer.AddrType,
 		Protocol:          arpLayer.Protocol,
 		HwAddressSize:     arpLayer.HwAddressSize,
@@ -723,8 +2215,13 @@ func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
 		return fmt.Errorf("link layer type %s not support", t)
 	}
 
-	// Serialize layers
-	data, err := pcap.Serialize(newLinkLayer, newARPLayer)
+	// Serialize layers, and re-attach the 802.1Q tag
+	var data []byte
+	if indicator.Encap() != nil && indicator.Encap().Dot1Q != nil {
+		data, err = pcap.Serialize(newLinkLayer, indicator.Encap().Dot1Q, newARPLayer)
+	} else {
+		data, err = pcap.Serialize(newLinkLayer, newARPLayer)
+	}
 	if err != nil {
 		return fmt.Errorf("serialize: %w", err)
 	}
@@ -736,16 +2233,16 @@ func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
 	}
 
 	// Reconnect
-	if upConn != nil {
-		switch upConn.(type) {
+	for _, conn := range upConns() {
+		switch conn.(type) {
 		case *pcap.FakeTCPConn:
-			err = upConn.(*pcap.FakeTCPConn).Reconnect()
+			err = conn.(*pcap.FakeTCPConn).Reconnect()
 		default:
 			break
 		}
-	}
-	if err != nil {
-		return fmt.Errorf("reconnect: %w", err)
+		if err != nil {
+			return fmt.Errorf("reconnect: %w", err)
+		}
 	}
 
 	log.Infof("Device %s [%s] joined the network\n", indicator.SrcIP(), net.HardwareAddr(arpLayer.SourceHwAddress))
@@ -754,13 +2251,17 @@ func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
 	return nil
 }
 
-func handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
+func handleListen(ctx context.Context, packet gopacket.Packet, conn *pcap.RawConn) error {
 	var (
 		hardwareAddr net.HardwareAddr
 		data         []byte
 	)
 
+	stages := tracing.NewStages(ctx)
+	defer stages.End()
+
 	// Parse packet
+	stages.Next("parse")
 	indicator, err := pcap.ParsePacket(packet)
 	if err != nil {
 		return fmt.Errorf("parse packet: %w", err)
@@ -775,24 +2276,87 @@ func handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
 		return nil
 	}
 
+	// Domain routing and rules of locations
+	if isRouted {
+		if indicator.DNSIndicator() != nil && isSource(indicator.DstIP()) {
+			learnDNS(indicator.DNSIndicator())
+			return nil
+		}
+		if !isTunneled(indicator) {
+			log.Verbosef("Bypass an outbound %s packet: %s -> %s\n", indicator.TransportProtocol(), indicator.Src(), indicator.Dst())
+			return nil
+		}
+	}
+
 	// Record source hardware address
 	hardwareAddr = indicator.SrcHardwareAddr()
 
+	// ACL
+	if !acl.IsEmpty() && !acl.Allows(indicator.Dst()) {
+		log.Verbosef("Deny an outbound %s packet: %s -> %s\n", indicator.TransportProtocol(), indicator.Src(), indicator.Dst())
+		return nil
+	}
+
+	// New sources are shed under memory pressure
+	if memBudget.Pressure() >= stat.PressureFlows {
+		natLock.RLock()
+		_, ok := nat[indicator.SrcIP().String()]
+		natLock.RUnlock()
+		if !ok && !memBudget.AllowFlow() {
+			log.Verbosef("Shed a packet from new source %s under memory pressure\n", indicator.SrcIP())
+			return nil
+		}
+	}
+
+	stages.Next("serialize")
 	data = make([]byte, 0)
 	data = append(data, packet.NetworkLayer().LayerContents()...)
+	// Hop-by-hop options header is decoded as a part of the IPv6 layer
+	if indicator.IPv6Layer() != nil && indicator.IPv6Layer().HopByHop != nil {
+		data = append(data, indicator.IPv6Layer().HopByHop.Contents...)
+	}
 	data = append(data, packet.NetworkLayer().LayerPayload()...)
 
-	// Write packet data
-	_, err = upConn.Write(data)
+	// Shape
+	class := classifier.Classify(packet)
+	if !shaper.Wait(len(data), class < pcap.ClassBulk) {
+		log.Verbosef("Drop an outbound %s packet over shaping rate: %s -> %s\n", indicator.TransportProtocol(), indicator.Src(), indicator.Dst())
+		return nil
+	}
+
+	// Server of the flow
+	up := pickUpConn(packet)
+	if up == nil {
+		log.Verbosef("Drop an outbound %s packet for no server is up: %s -> %s\n", indicator.TransportProtocol(), indicator.Src(), indicator.Dst())
+		return nil
+	}
+
+	// Latency-critical packets are duplicated through both paths in multipath, and the server takes the first copy
+	isDuplicated := dupConn != nil && class < pcap.ClassBulk
+	if isDuplicated {
+		data = pcap.EncodeDuplicate(dupID, atomic.AddUint64(&dupSeq, 1), data)
+	}
+
+	// Write packet data, which is encrypted in the connection
+	stages.End()
+	_, err = pcap.WriteContext(ctx, up, data)
 	if err != nil {
 		return fmt.Errorf("write: %w", err)
 	}
+	if isDuplicated {
+		_, err := pcap.WriteContext(ctx, dupConn, data)
+		if err != nil {
+			return fmt.Errorf("write multipath: %w", err)
+		}
+	}
 
 	// Record the connection of the packet
+	natLock.RLock()
 	ni, ok := nat[indicator.SrcIP().String()]
+	natLock.RUnlock()
 	if !ok || ni.srcHardwareAddr.String() != hardwareAddr.String() {
 		natLock.Lock()
-		nat[indicator.SrcIP().String()] = &natIndicator{srcHardwareAddr: hardwareAddr, conn: conn}
+		nat[indicator.SrcIP().String()] = &natIndicator{srcHardwareAddr: hardwareAddr, encap: indicator.Encap(), conn: conn}
 		natLock.Unlock()
 	}
 
@@ -808,12 +2372,66 @@ func handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
 	return nil
 }
 
-func handleUpstream(contents []byte) error {
+// writeSocks writes the packet from the stack of proxy servers to the server of its flow, in the same way as packets
+// from sources.
+func writeSocks(data []byte) error {
+	var packet gopacket.Packet
+	if len(data) > 0 && data[0]>>4 == 6 {
+		packet = gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.Lazy)
+	} else {
+		packet = gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Lazy)
+	}
+	if packet.NetworkLayer() == nil {
+		return errors.New("missing network layer")
+	}
+	flow := packet.NetworkLayer().NetworkFlow()
+
+	// Shape
+	class := classifier.Classify(packet)
+	if !shaper.Wait(len(data), class < pcap.ClassBulk) {
+		log.Verbosef("Drop an outbound proxy packet over shaping rate: %s -> %s\n", flow.Src(), flow.Dst())
+		return nil
+	}
+
+	// Server of the flow
+	up := pickUpConn(packet)
+	if up == nil {
+		log.Verbosef("Drop an outbound proxy packet for no server is up: %s -> %s\n", flow.Src(), flow.Dst())
+		return nil
+	}
+
+	isDuplicated := dupConn != nil && class < pcap.ClassBulk
+	if isDuplicated {
+		data = pcap.EncodeDuplicate(dupID, atomic.AddUint64(&dupSeq, 1), data)
+	}
+
+	_, err := pcap.WriteContext(context.Background(), up, data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	if isDuplicated {
+		_, err := pcap.WriteContext(context.Background(), dupConn, data)
+		if err != nil {
+			return fmt.Errorf("write multipath: %w", err)
+		}
+	}
+
+	// Statistics
+	if monitor != nil {
+		monitor.AddBidirectional(flow.Src().String(), flow.Dst().String(), stat.DirectionOut, uint(len(data)))
+	}
+
+	log.Verbosef("Send an outbound proxy packet: %s -> %s (%d Bytes)\n", flow.Src(), flow.Dst(), len(data))
+
+	return nil
+}
+
+func handleUpstream(ctx context.Context, contents []byte) error {
 	var (
 		contentss        [][]byte
 		newLinkLayer     gopacket.Layer
 		newLinkLayerType gopacket.LayerType
-		data             []byte
+		datas            [][]byte
 	)
 
 	// Empty payload
@@ -822,22 +2440,53 @@ func handleUpstream(contents []byte) error {
 		return nil
 	}
 
+	stages := tracing.NewStages(ctx)
+	defer stages.End()
+
 	// Destick
+	stages.Next("parse")
 	contentss, err := destick.Append(contents)
 	if err != nil {
 		return fmt.Errorf("destick: %w", err)
 	}
 
+	// Bridge
+	if isBridge {
+		for _, frame := range contentss {
+			err := bridgeFrame(frame, upConn)
+			if err != nil {
+				return fmt.Errorf("bridge: %w", err)
+			}
+		}
+
+		return nil
+	}
+
 	// TODO: Use flag instead of return when error occurred
 	// TODO: Merge desticker to pcap.TCPConn
 	for _, contents := range contentss {
 		// Parse embedded packet
+		stages.Next("parse")
 		embIndicator, err := pcap.ParseEmbPacket(contents)
 		if err != nil {
 			return fmt.Errorf("parse embedded packet: %w", err)
 		}
 
+		// Packets to the stack are taken to clients of proxy servers
+		if stack != nil && socks.IsStackIP(embIndicator.DstIP()) {
+			stack.Deliver(contents)
+
+			if monitor != nil {
+				monitor.AddBidirectional(embIndicator.DstIP().String(), embIndicator.SrcIP().String(), stat.DirectionIn, uint(embIndicator.Size()))
+			}
+
+			log.Verbosef("Receive an inbound %s packet to proxy: %s <- %s (%d Bytes)\n",
+				embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String(), embIndicator.Size())
+			continue
+		}
+
 		// Check map
+		stages.Next("nat")
 		natLock.RLock()
 		ni, ok := nat[embIndicator.DstIP().String()]
 		natLock.RUnlock()
@@ -845,8 +2494,11 @@ func handleUpstream(contents []byte) error {
 			return fmt.Errorf("missing nat to %s", embIndicator.DstIP())
 		}
 
-		// Decide Loopback or Ethernet
-		if ni.conn.IsLoop() {
+		// Decide TUN, Loopback or Ethernet
+		stages.Next("serialize")
+		if ni.conn.IsTun() {
+			newLinkLayerType = gopacket.LayerTypeZero
+		} else if ni.conn.IsLoop() {
 			newLinkLayerType = layers.LayerTypeLoopback
 		} else {
 			newLinkLayerType = layers.LayerTypeEthernet
@@ -854,10 +2506,13 @@ func handleUpstream(contents []byte) error {
 
 		// Create new link layer
 		switch newLinkLayerType {
+		case gopacket.LayerTypeZero:
+			// TUN devices have no link layer
+			newLinkLayer = nil
 		case layers.LayerTypeLoopback:
 			newLinkLayer = pcap.CreateLoopbackLayer()
 		case layers.LayerTypeEthernet:
-			newLinkLayer, err = pcap.CreateEthernetLayer(ni.conn.LocalDev().HardwareAddr(), ni.srcHardwareAddr, embIndicator.NetworkLayer().(gopacket.NetworkLayer))
+			newLinkLayer, err = pcap.CreateEthernetLayer(ni.conn.LocalDev().HardwareAddr(), ni.srcHardwareAddr, ni.encap, embIndicator.NetworkLayer().(gopacket.NetworkLayer))
 		default:
 			return fmt.Errorf("link layer type %s not support", newLinkLayerType)
 		}
@@ -865,20 +2520,37 @@ func handleUpstream(contents []byte) error {
 			return fmt.Errorf("create link layer: %w", err)
 		}
 
-		// Serialize layers
-		data, err = pcap.SerializeRaw(newLinkLayer.(gopacket.SerializableLayer),
-			gopacket.Payload(embIndicator.NetworkLayer().LayerContents()),
-			gopacket.Payload(embIndicator.NetworkPayload()))
-		if err != nil {
-			return fmt.Errorf("serialize: %w", err)
+		// Serialize layers, and fragment if the packet exceeds the MTU
+		if !embIndicator.DontFragment() && embIndicator.MTU() > mtu {
+			datas, err = pcap.CreateFragmentPackets(newLinkLayer, embIndicator.NetworkLayer(), nil,
+				gopacket.Payload(embIndicator.NetworkPayload()), mtu)
+			if err != nil {
+				return fmt.Errorf("create fragments: %w", err)
+			}
+		} else {
+			var layer gopacket.SerializableLayer
+			if newLinkLayer != nil {
+				layer = newLinkLayer.(gopacket.SerializableLayer)
+			}
+			data, err := pcap.SerializeRaw(layer, gopacket.Payload(contents))
+			if err != nil {
+				return fmt.Errorf("serialize: %w", err)
+			}
+
+			datas = append(make([][]byte, 0), data)
 		}
 
 		// Write packet data
-		_, err = ni.conn.Write(data)
-		if err != nil {
-			return fmt.Errorf("write: %w", err)
+		stages.Next("inject")
+		for _, data := range datas {
+			_, err = ni.conn.Write(data)
+			if err != nil {
+				return fmt.Errorf("write: %w", err)
+			}
 		}
 
+		stages.End()
+
 		// Statistics
 		if monitor != nil {
 			monitor.AddBidirectional(embIndicator.DstIP().String(), embIndicator.SrcIP().String(), stat.DirectionIn, uint(embIndicator.Size()))
@@ -896,6 +2568,7 @@ func handleUpstream(contents []byte) error {
 					}
 					dnsLock.Unlock()
 				}
+				learnDNS(embIndicator.DNSIndicator())
 			}
 		}
 
@@ -906,6 +2579,709 @@ func handleUpstream(contents []byte) error {
 	return nil
 }
 
+func isSource(ip net.IP) bool {
+	for _, source := range sources {
+		if source.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isTunneled returns if the packet is carried by the tunnel, where routes of domains take precedence over rules.
+func isTunneled(indicator *pcap.PacketIndicator) bool {
+	route, ok := router.Lookup(indicator.DstIP())
+	if ok {
+		return route == addr.RouteTunnel
+	}
+
+	return isTunnelAll || addr.MatchesTunnelRules(tunnelRules, indicator.Dst())
+}
+
+// learnDNS routes destinations in the DNS response by the domain they are resolved from.
+func learnDNS(indicator *pcap.DNSIndicator) {
+	if !indicator.IsResponse() {
+		return
+	}
+
+	name := indicator.Question()
+	_, ips := indicator.Answers()
+	if name == "" || len(ips) <= 0 {
+		return
+	}
+
+	if router.Learn(name, ips, time.Duration(indicator.TTL())*time.Second) {
+		log.Verbosef("Route %s resolved from %s\n", ips, name)
+	}
+}
+
+func addRouteFirewallRule(ip net.IP, route addr.Route) {
+	ipNet := hostIPNet(ip)
+
+	var err error
+	switch route {
+	case addr.RouteTunnel:
+		err = exec.AddForwardFirewallRule(ipNet, "", 0, 0)
+	case addr.RouteBypass:
+		err = exec.AddForwardBypassFirewallRule(ipNet)
+	}
+	if err != nil {
+		log.Errorln(fmt.Errorf("add forward firewall rule %s via %s: %w", ip, route, err))
+	}
+}
+
+func deleteRouteFirewallRule(ip net.IP, route addr.Route) {
+	ipNet := hostIPNet(ip)
+
+	var err error
+	switch route {
+	case addr.RouteTunnel:
+		err = exec.DeleteForwardFirewallRule(ipNet, "", 0, 0)
+	case addr.RouteBypass:
+		err = exec.DeleteForwardBypassFirewallRule(ipNet)
+	}
+	if err != nil {
+		log.Errorln(fmt.Errorf("delete forward firewall rule %s via %s: %w", ip, route, err))
+	}
+}
+
+func hostIPNet(ip net.IP) *net.IPNet {
+	if ip.To4() != nil {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func bridgeFrame(frame []byte, from io.Writer) error {
+	ports, err := bridge.Forward(frame, from)
+	if err != nil {
+		return fmt.Errorf("forward: %w", err)
+	}
+
+	for _, port := range ports {
+		// Frames to the server are shaped
+		if port == upConn && !shaper.Wait(len(frame), false) {
+			log.Verbosef("Drop a frame over shaping rate: %s -> %s\n", net.HardwareAddr(frame[6:12]), net.HardwareAddr(frame[0:6]))
+			continue
+		}
+
+		err := pcap.WriteFrame(port, frame)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+
+	log.Verbosef("Bridge a frame: %s -> %s (%d Bytes)\n", net.HardwareAddr(frame[6:12]), net.HardwareAddr(frame[0:6]), len(frame))
+
+	return nil
+}
+
+// applySchedules puts QoS rules in effect by their schedules.
+func applySchedules(now time.Time) {
+	if classifier.Apply(now) {
+		log.Infof("Apply QoS rules %s\n", classifier.Active())
+	}
+}
+
+// dialUpstream connects to the server, and establishes a new session with it.
+func dialUpstream(server *net.TCPAddr) (net.Conn, error) {
+	switch mode {
+	case "faketcp":
+		if isKCP {
+			return pcap.DialFakeTCPWithKCP(upDev, gatewayDev, upPort, server, crypt, mtu, kcpConfig)
+		}
+
+		return pcap.DialFakeTCP(upDev, gatewayDev, upPort, server, crypt, mtu, isECN, ttlPolicy, dscp, isEmulated, synOptions, keepalive, fingerprint, pace, obfuscator)
+	case "tcp":
+		return pcap.DialTCP(upDev, upPort, server, crypt)
+	default:
+		return nil, fmt.Errorf("mode %s not support", mode)
+	}
+}
+
+// dialUpstreams connects to servers in order from the index, and returns the connection to the first server connected
+// and its index.
+func dialUpstreams(from int) (net.Conn, int, error) {
+	var err error
+	for i := 0; i < len(upstreams); i++ {
+		index := (from + i) % len(upstreams)
+
+		var conn net.Conn
+		conn, err = dialUpstream(upstreams[index].addr)
+		if err == nil {
+			return conn, index, nil
+		}
+		if len(upstreams) > 1 {
+			log.Errorln(fmt.Errorf("connect to server %s: %w", upstreams[index].addr, err))
+		}
+	}
+
+	return nil, 0, err
+}
+
+// failover switches the upstream from the connection to the next server, and re-establishes the session with it. It
+// does nothing if the connection is not the upstream anymore, which is failed over already.
+func failover(conn net.Conn) {
+	upLock.Lock()
+	defer upLock.Unlock()
+
+	if isClosed || conn != upConn {
+		return
+	}
+
+	// Keep the last health of the server
+	server := upstreams[active]
+	server.failovers++
+	if c, ok := conn.(*pcap.FakeTCPConn); ok {
+		server.rtt, server.jitter, server.heard = c.RTT(), c.Jitter(), c.Heard()
+		server.loss, _ = c.Loss()
+	}
+
+	newConn, index, err := dialUpstreams(active + 1)
+	if err != nil {
+		log.Errorln(fmt.Errorf("fail over from server %s: %w", server.addr, err))
+		return
+	}
+
+	log.Infof("Fail over from server %s to %s\n", server.addr, upstreams[index].addr)
+
+	if isBridge {
+		bridge.RemovePort(conn)
+		bridge.AddPort(newConn)
+	}
+	upConn, active = newConn, index
+
+	// The server may be down, so the connection is closed in the background
+	go conn.Close()
+}
+
+// checkUpstream probes the active server when nothing is heard from it in the heartbeat, or in the probe interval in
+// active probing, and fails over it when segments sent to it are unanswered for the failover timeout, or it loses
+// probes at the probe loss. Only FakeTCP connections without KCP are checked, and others are failed over when they are
+// closed.
+func checkUpstream() {
+	for {
+		time.Sleep(heartbeat)
+		if isClosed {
+			return
+		}
+
+		conn, ok := upConn.(*pcap.FakeTCPConn)
+		if !ok {
+			return
+		}
+
+		// The only server is not failed over
+		if len(upstreams) > 1 {
+			if conn.Unanswered() >= failoverTimeout {
+				log.Errorf("Server %s does not respond in %s\n", conn.RemoteAddr(), failoverTimeout)
+				failover(conn)
+				continue
+			}
+			if loss, ok := isLossy(conn); ok {
+				log.Errorf("Server %s loses %.0f%% of probes\n", conn.RemoteAddr(), loss*100)
+				failover(conn)
+				continue
+			}
+		}
+
+		if isProbeDue(conn) {
+			err := conn.Probe()
+			if err != nil {
+				log.Errorln(fmt.Errorf("probe %s: %w", conn.RemoteAddr(), err))
+			}
+		}
+	}
+}
+
+// isProbeDue returns if the connection is to be probed, which is nothing is heard from it in the heartbeat, or nothing
+// is probed in the probe interval in active probing.
+func isProbeDue(conn *pcap.FakeTCPConn) bool {
+	now := time.Now()
+	if now.Sub(conn.Heard()) >= heartbeat {
+		return true
+	}
+
+	return probeTime > 0 && now.Sub(conn.Probed()) >= probeTime
+}
+
+// isLossy returns the loss of probes of the connection, and if it is at the probe loss, which is only measured in enough
+// probes.
+func isLossy(conn *pcap.FakeTCPConn) (float64, bool) {
+	loss, n := conn.Loss()
+
+	return loss, probeLoss > 0 && n >= lossProbes && loss >= probeLoss
+}
+
+// roam announces sessions to servers whose segments sent are unanswered for the roaming timeout, so the server moves
+// the session to the current address of the client if it is changed. Idle servers are probed, so changes of the
+// address are learned.
+func roam() {
+	for {
+		time.Sleep(heartbeat)
+		if isClosed {
+			return
+		}
+
+		for _, conn := range upConns() {
+			conn, ok := conn.(*pcap.FakeTCPConn)
+			if !ok {
+				continue
+			}
+
+			var err error
+			switch {
+			case conn.Unanswered() >= roamTimeout:
+				err = conn.Roam()
+			case time.Now().Sub(conn.Heard()) >= roamTimeout:
+				err = conn.Probe()
+			}
+			if err != nil {
+				log.Errorln(fmt.Errorf("roam %s: %w", conn.RemoteAddr(), err))
+			}
+		}
+	}
+}
+
+// checkDev checks the upstream device and the default route in the migration interval, and moves the upstream when
+// the device is gone, down or its address is changed, or the default route moves to another gateway, like from Wi-Fi
+// to Ethernet.
+func checkDev() {
+	for {
+		time.Sleep(migrateInterval)
+		if isClosed {
+			return
+		}
+
+		reason := devChange()
+		if reason == "" {
+			continue
+		}
+		log.Infof("Upstream device %s %s\n", upDev.Alias(), reason)
+
+		err := migrate()
+		if err != nil {
+			log.Errorln(fmt.Errorf("move upstream: %w", err))
+		}
+	}
+}
+
+// devChange returns why the upstream is not routed through the upstream device and the gateway anymore, or an empty
+// string if nothing changes.
+func devChange() string {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		log.Errorln(fmt.Errorf("find all devices: %w", err))
+		return ""
+	}
+
+	// Devices down are not found
+	var dev *pcap.Device
+	for _, d := range devs {
+		if d.Alias() == upDev.Alias() {
+			dev = d
+			break
+		}
+	}
+	if dev == nil {
+		return "is down"
+	}
+	if pcap.FindDev(append(make([]*pcap.Device, 0), dev), upDev.IPAddr().IP) == nil {
+		return "changes its address"
+	}
+
+	// The gateway is fixed if it is set, and TUN, TAP and loopback devices have no gateway on the link
+	if upGateway != nil || gatewayDev == upDev {
+		return ""
+	}
+	ip, err := pcap.FindGatewayAddr()
+	if err != nil {
+		return "has no default route"
+	}
+	if !ip.Equal(gatewayDev.IPAddr().IP) {
+		return fmt.Sprintf("is not routed to gateway %s", ip)
+	}
+
+	return ""
+}
+
+// migrate moves the upstream to the device and the gateway found again, and re-establishes sessions with servers
+// through it. Servers are not failed over for it, so the active server stays active.
+func migrate() error {
+	newUpDev, newGatewayDev, err := pcap.FindUpstreamDevAndGatewayDev(upDevName, upGateway)
+	if err != nil {
+		return fmt.Errorf("find upstream device and gateway device: %w", err)
+	}
+	if newUpDev == nil || newGatewayDev == nil {
+		return errors.New("cannot determine upstream device and gateway device")
+	}
+
+	upLock.Lock()
+	oldUpDev, oldGatewayDev := upDev, gatewayDev
+	upDev, gatewayDev = newUpDev, newGatewayDev
+
+	if balancer != nil {
+		upLock.Unlock()
+
+		for i, server := range upstreams {
+			redial(i, server.conn)
+		}
+	} else {
+		defer upLock.Unlock()
+
+		conn := upConn
+		newConn, index, err := dialUpstreams(active)
+		if err != nil {
+			// Devices are kept, so it is moved again in the next check
+			upDev, gatewayDev = oldUpDev, oldGatewayDev
+			return fmt.Errorf("connect to server %s: %w", upstreams[active].addr, err)
+		}
+
+		if isBridge {
+			bridge.RemovePort(conn)
+			bridge.AddPort(newConn)
+		}
+		upConn, active = newConn, index
+
+		// The device may be gone, so the connection is closed in the background
+		go conn.Close()
+	}
+
+	if !newGatewayDev.IsLoop() {
+		log.Infof("Move upstream from %s to %s through %s\n", oldUpDev.Alias(), newUpDev, newGatewayDev)
+	} else {
+		log.Infof("Move upstream from %s to %s\n", oldUpDev.Alias(), newUpDev)
+	}
+
+	return nil
+}
+
+// upConns returns connections to servers, which are all servers connected in load balancing, or the active server.
+func upConns() []net.Conn {
+	conns := make([]net.Conn, 0)
+	for i := range upstreams {
+		if balancer == nil && i > 0 {
+			break
+		}
+
+		conn := upstreamConn(i)
+		if conn != nil {
+			conns = append(conns, conn)
+		}
+	}
+
+	return conns
+}
+
+// pickUpConn returns the connection to the server the packet goes to, which is the server of its flow in load
+// balancing, or the active server. It returns nil if no server is up. Flows are balanced by their addresses rather than
+// ports, so fragments, which have no ports except the first one, go to the same server as their flows.
+func pickUpConn(packet gopacket.Packet) net.Conn {
+	if balancer == nil {
+		return upConn
+	}
+
+	index := balancer.Pick(packet.NetworkLayer().NetworkFlow().FastHash())
+	if index < 0 {
+		return nil
+	}
+
+	return upstreams[index].conn
+}
+
+// redial re-establishes the connection to the server of the index in load balancing, and flows of the server are moved
+// to other servers until it is up again. It does nothing if the connection is not the one to the server anymore, which
+// is re-established already.
+func redial(index int, conn net.Conn) {
+	server := upstreams[index]
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	if isClosed || conn != server.conn {
+		return
+	}
+
+	// Keep the last health of the server
+	balancer.SetHealth(index, false, 0, 0, false)
+	if conn != nil {
+		server.failovers++
+		if c, ok := conn.(*pcap.FakeTCPConn); ok {
+			server.rtt, server.jitter, server.heard = c.RTT(), c.Jitter(), c.Heard()
+			server.loss, _ = c.Loss()
+		}
+
+		// The server may be down, so the connection is closed in the background
+		server.conn = nil
+		go conn.Close()
+	}
+
+	newConn, err := dialUpstream(server.addr)
+	if err != nil {
+		log.Errorln(fmt.Errorf("connect to server %s: %w", server.addr, err))
+		return
+	}
+	server.conn = newConn
+
+	// FakeTCP connections are up when the server responds
+	if _, ok := newConn.(*pcap.FakeTCPConn); !ok {
+		balancer.SetHealth(index, true, 0, 0, false)
+	}
+}
+
+// checkBalanced probes the server of the index in load balancing when nothing is heard from it in the heartbeat, and
+// re-establishes the connection to it when segments sent to it are unanswered for the failover timeout, or it is not
+// connected.
+func checkBalanced(index int) {
+	server := upstreams[index]
+
+	for {
+		time.Sleep(heartbeat)
+		if isClosed {
+			return
+		}
+
+		conn := server.conn
+		if conn == nil {
+			redial(index, nil)
+			continue
+		}
+
+		c, ok := conn.(*pcap.FakeTCPConn)
+		if !ok {
+			continue
+		}
+
+		if c.Unanswered() >= failoverTimeout {
+			log.Errorf("Server %s does not respond in %s\n", c.RemoteAddr(), failoverTimeout)
+			redial(index, conn)
+			continue
+		}
+		_, lossy := isLossy(c)
+		balancer.SetHealth(index, !c.Heard().IsZero(), c.RTT(), c.Jitter(), lossy)
+
+		if isProbeDue(c) {
+			err := c.Probe()
+			if err != nil {
+				log.Errorln(fmt.Errorf("probe %s: %w", c.RemoteAddr(), err))
+			}
+		}
+	}
+}
+
+// upstreamsStatus returns servers with their health, and flows of them in load balancing.
+func upstreamsStatus() interface{} {
+	type serverStatus struct {
+		Server    string  `json:"server"`
+		IsActive  bool    `json:"isActive"`
+		Weight    int     `json:"weight,omitempty"`
+		Flows     int     `json:"flows,omitempty"`
+		RTT       float64 `json:"rtt,omitempty"`
+		Jitter    float64 `json:"jitter,omitempty"`
+		Loss      float64 `json:"loss,omitempty"`
+		Heard     int     `json:"heard,omitempty"`
+		Failovers int     `json:"failovers"`
+	}
+
+	upLock.Lock()
+	defer upLock.Unlock()
+
+	var flows []int
+	if balancer != nil {
+		flows = balancer.Flows()
+	}
+
+	result := make([]serverStatus, 0, len(upstreams))
+	for i, server := range upstreams {
+		rtt, jitter, loss, heard := server.rtt, server.jitter, server.loss, server.heard
+		isActive := i == active
+		if balancer != nil {
+			isActive = balancer.IsUp(i)
+		}
+		if conn, ok := upstreamConn(i).(*pcap.FakeTCPConn); ok && isActive {
+			rtt, jitter, heard = conn.RTT(), conn.Jitter(), conn.Heard()
+			loss, _ = conn.Loss()
+		}
+
+		status := serverStatus{
+			Server:    server.addr.String(),
+			IsActive:  isActive,
+			RTT:       float64(rtt.Microseconds()) / 1000,
+			Jitter:    float64(jitter.Microseconds()) / 1000,
+			Loss:      loss * 100,
+			Failovers: server.failovers,
+		}
+		if balancer != nil {
+			status.Weight, status.Flows = server.weight, flows[i]
+		}
+		if !heard.IsZero() {
+			status.Heard = int(time.Now().Sub(heard).Seconds())
+		}
+
+		result = append(result, status)
+	}
+
+	return result
+}
+
+// listDevsJSON prints all valid devices in JSON.
+// upstreamStatus returns the status of the connection to the server, and if it is up.
+func upstreamStatus() (interface{}, bool) {
+	var local string
+	conns := upConns()
+	if len(conns) > 0 {
+		local = conns[0].LocalAddr().String()
+	}
+
+	isUp := !isClosed && len(conns) > 0
+	server := upstreams[active].addr.String()
+	if balancer != nil {
+		isAnyUp := false
+		servers := make([]string, 0, len(upstreams))
+		for i, upstream := range upstreams {
+			isAnyUp = isAnyUp || balancer.IsUp(i)
+			servers = append(servers, upstream.addr.String())
+		}
+		isUp = isUp && isAnyUp
+		server = strings.Join(servers, ", ")
+	}
+
+	return &struct {
+		IsUp   bool   `json:"isUp"`
+		Mode   string `json:"mode"`
+		Local  string `json:"local,omitempty"`
+		Server string `json:"server"`
+	}{
+		IsUp:   isUp,
+		Mode:   mode,
+		Local:  local,
+		Server: server,
+	}, isUp
+}
+
+// dumpSources returns sources with their devices and traffic.
+func dumpSources() interface{} {
+	type sourceStatus struct {
+		Source       string                 `json:"source"`
+		Device       string                 `json:"device,omitempty"`
+		HardwareAddr string                 `json:"hardwareAddr,omitempty"`
+		In           *stat.TrafficIndicator `json:"in"`
+		Out          *stat.TrafficIndicator `json:"out"`
+	}
+
+	result := make([]sourceStatus, 0)
+	for _, source := range sources {
+		status := sourceStatus{Source: source.IP.String()}
+
+		natLock.RLock()
+		ni, ok := nat[status.Source]
+		natLock.RUnlock()
+		if ok {
+			status.Device = ni.conn.LocalDev().Alias()
+			if ni.srcHardwareAddr != nil {
+				status.HardwareAddr = ni.srcHardwareAddr.String()
+			}
+		}
+
+		if monitor != nil {
+			status.In, status.Out = monitor.Local(status.Source)
+		}
+
+		result = append(result, status)
+	}
+
+	return result
+}
+
+// serveJSON writes the value in JSON as the response of a read-only request to the monitor.
+func serveJSON(w http.ResponseWriter, req *http.Request, code int, v interface{}) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Errorln(fmt.Errorf("monitor: %w", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Handle CORS
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	_, err = w.Write(b)
+	if err != nil {
+		log.Errorln(fmt.Errorf("monitor: %w", err))
+	}
+}
+
+func listDevsJSON() error {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return err
+	}
+
+	// Gateway is omitted if it cannot be determined
+	gateway, _ := pcap.FindGatewayAddr()
+
+	infos := make([]*pcap.DeviceInfo, 0)
+	for _, dev := range devs {
+		infos = append(infos, dev.Info(gateway))
+	}
+
+	b, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	log.Infoln(string(b))
+
+	return nil
+}
+
+// argKey returns the key in the configuration of the argument.
+func argKey(name string) string {
+	switch name {
+	case "v":
+		return "verbose"
+	case "p":
+		return "port"
+	case "r":
+		return "sources"
+	case "s":
+		return "server"
+	}
+	if strings.HasPrefix(name, "kcp-") {
+		return "kcp-tuning." + strings.TrimPrefix(name, "kcp-")
+	}
+
+	return name
+}
+
+func splitMapArg(s string) map[string]string {
+	strs := splitArg(s)
+	if strs == nil {
+		return nil
+	}
+
+	result := make(map[string]string)
+
+	for _, str := range strs {
+		kv := strings.SplitN(str, ":", 2)
+		if len(kv) != 2 {
+			log.Fatalln(fmt.Errorf("invalid argument %s", str))
+		}
+		result[strings.Trim(kv[0], " ")] = strings.Trim(kv[1], " ")
+	}
+
+	return result
+}
+
 func splitArg(s string) []string {
 	if s == "" {
 		return nil
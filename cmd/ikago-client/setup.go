@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ikago/internal/addr"
+	"ikago/internal/crypto"
+	"ikago/internal/log"
+	"ikago/internal/pcap"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// setupConfig describes the configuration written by the setup wizard, which contains essential options only.
+type setupConfig struct {
+	ListenDevs []string `json:"listen-devices"`
+	UpDev      string   `json:"upstream-device"`
+	Method     string   `json:"method"`
+	Password   string   `json:"password"`
+	Sources    []string `json:"sources"`
+	Server     string   `json:"server"`
+}
+
+// setupWizard describes an interactive wizard which writes a configuration file.
+type setupWizard struct {
+	scanner *bufio.Scanner
+}
+
+// ask prints the question and returns the answer, or the default value if the answer is empty.
+func (w *setupWizard) ask(question, def string) (string, error) {
+	if def != "" {
+		log.Infof("%s [%s]: ", question, def)
+	} else {
+		log.Infof("%s: ", question)
+	}
+
+	if !w.scanner.Scan() {
+		err := w.scanner.Err()
+		if err == nil {
+			err = errors.New("unexpected end of input")
+		}
+		return "", err
+	}
+
+	answer := strings.TrimSpace(w.scanner.Text())
+	if answer == "" {
+		return def, nil
+	}
+
+	return answer, nil
+}
+
+// askUntil asks the question until the answer is verified.
+func (w *setupWizard) askUntil(question, def string, verify func(answer string) error) (string, error) {
+	for {
+		answer, err := w.ask(question, def)
+		if err != nil {
+			return "", err
+		}
+
+		err = verify(answer)
+		if err == nil {
+			return answer, nil
+		}
+		log.Infof("  %s\n", err)
+	}
+}
+
+// setup runs the setup wizard and writes the configuration file to the path.
+func setup(path string) error {
+	w := &setupWizard{scanner: bufio.NewScanner(os.Stdin)}
+
+	// Devices
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return fmt.Errorf("find all devices: %w", err)
+	}
+	if len(devs) <= 0 {
+		return errors.New("cannot find any device")
+	}
+	log.Infoln("Available devices are listed below:")
+	for i, dev := range devs {
+		log.Infof("  %d. %s\n", i+1, dev)
+	}
+
+	// Gateway
+	var (
+		gatewayIP     net.IP
+		upDevAlias    string
+		listenDevHint string
+	)
+	gatewayIP, err = pcap.FindGatewayAddr()
+	if err != nil {
+		log.Infof("Cannot detect gateway: %s\n", err)
+	} else {
+		upDev, gatewayDev, err := pcap.FindUpstreamDevAndGatewayDev("", gatewayIP)
+		if err == nil && upDev != nil && gatewayDev != nil {
+			upDevAlias = upDev.Alias()
+			listenDevHint = upDev.Alias()
+			log.Infof("Detect gateway %s through %s\n", gatewayIP, upDev.Alias())
+		} else {
+			log.Infof("Detect gateway %s\n", gatewayIP)
+		}
+	}
+
+	findDev := func(s string) *pcap.Device {
+		i, err := strconv.Atoi(s)
+		if err == nil && i > 0 && i <= len(devs) {
+			return devs[i-1]
+		}
+		for _, dev := range devs {
+			if dev.Alias() == s || dev.Name() == s {
+				return dev
+			}
+		}
+
+		return nil
+	}
+
+	// Listen devices
+	listenDevs := make([]*pcap.Device, 0)
+	_, err = w.askUntil("Devices for listening, in names or numbers separated by commas", listenDevHint, func(answer string) error {
+		listenDevs = listenDevs[:0]
+		for _, s := range splitArg(answer) {
+			dev := findDev(s)
+			if dev == nil {
+				return fmt.Errorf("device %s not found", s)
+			}
+			listenDevs = append(listenDevs, dev)
+		}
+		if len(listenDevs) <= 0 {
+			return errors.New("missing device")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Upstream device
+	var upDev *pcap.Device
+	_, err = w.askUntil("Device for routing upstream to, in a name or a number", upDevAlias, func(answer string) error {
+		upDev = findDev(answer)
+		if upDev == nil {
+			return fmt.Errorf("device %s not found", answer)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Sources, suggested in networks of listen devices excluding the gateway
+	subnets := make([]string, 0)
+	for _, dev := range listenDevs {
+		for _, a := range dev.IPAddrs() {
+			if a.IP.To4() != nil {
+				subnets = append(subnets, (&net.IPNet{IP: a.IP.Mask(a.Mask), Mask: a.Mask}).String())
+			}
+		}
+	}
+	if len(subnets) > 0 {
+		log.Infof("Sources are usually devices like consoles in %s, excluding the gateway\n", strings.Join(subnets, ", "))
+	}
+	sources, err := w.askUntil("Sources, in addresses separated by commas", "", func(answer string) error {
+		strs := splitArg(answer)
+		if len(strs) <= 0 {
+			return errors.New("missing source")
+		}
+		for _, s := range strs {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return fmt.Errorf("invalid source %s", s)
+			}
+			if ip.Equal(gatewayIP) {
+				return fmt.Errorf("source %s is the gateway", s)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Server
+	server, err := w.askUntil("Server, in an address like 203.0.113.1:18081", "", func(answer string) error {
+		_, err := addr.ParseTCPAddr(answer)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Crypt
+	password, err := w.ask("Password, leave empty to disable encryption", "")
+	if err != nil {
+		return err
+	}
+	method := "plain"
+	if password != "" {
+		method, err = w.askUntil("Method of encryption", "aes-128-gcm", func(answer string) error {
+			_, err := crypto.ParseCrypt(answer, password)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Write
+	aliases := make([]string, 0)
+	for _, dev := range listenDevs {
+		aliases = append(aliases, dev.Alias())
+	}
+	b, err := json.MarshalIndent(&setupConfig{
+		ListenDevs: aliases,
+		UpDev:      upDev.Alias(),
+		Method:     method,
+		Password:   password,
+		Sources:    splitArg(sources),
+		Server:     server,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	_, err = os.Stat(path)
+	if err == nil {
+		answer, err := w.ask(fmt.Sprintf("%s exists, overwrite it? (y/n)", path), "n")
+		if err != nil {
+			return err
+		}
+		if strings.ToLower(answer) != "y" {
+			return errors.New("canceled")
+		}
+	}
+
+	err = ioutil.WriteFile(path, append(b, '\n'), 0600)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+
+	log.Infof("Write configuration to %s, run IkaGo with -c %s\n", path, path)
+
+	return nil
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"container/list"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -8,22 +11,34 @@
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/xtaci/kcp-go"
+	"hash/fnv"
 	"ikago/internal/addr"
 	"ikago/internal/config"
+	"ikago/internal/control"
 	"ikago/internal/crypto"
+	"ikago/internal/dashboard"
 	"ikago/internal/exec"
+	"ikago/internal/geoip"
 	"ikago/internal/log"
+	"ikago/internal/obfs"
 	"ikago/internal/pcap"
+	"ikago/internal/schedule"
 	"ikago/internal/stat"
+	"ikago/internal/tracing"
 	"io"
+	"io/ioutil"
 	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -32,14 +47,135 @@ type quintuple struct {
 	src      string
 	dst      string
 	protocol gopacket.LayerType
+	// peer is the destination of sources, which is set only in symmetric NAT
+	peer string
+}
+
+// natSlot describes a port or an ID distributed in NAT.
+type natSlot struct {
+	protocol gopacket.LayerType
+	value    uint16
+}
+
+// natEntry describes a mapping in NAT in the LRU list. Counters are placed first, so they are aligned for atomic
+// operations in 32-bit platforms.
+type natEntry struct {
+	bytesIn  uint64
+	bytesOut uint64
+	// touched is if the mapping is used since it is moved in the LRU list
+	touched int32
+	q       quintuple
+	slot    natSlot
 }
 
 type natIndicator struct {
 	src    net.Addr
 	embSrc net.Addr
 	conn   net.Conn
+	filter *natFilter
+}
+
+// natType describes the behavior of NAT in mapping and filtering, defined in RFC 4787.
+type natType int
+
+const (
+	// natFullCone describes endpoint-independent mapping and filtering.
+	natFullCone natType = iota
+	// natRestricted describes endpoint-independent mapping and address-dependent filtering.
+	natRestricted
+	// natPortRestricted describes endpoint-independent mapping and address and port-dependent filtering.
+	natPortRestricted
+	// natSymmetric describes address and port-dependent mapping and filtering.
+	natSymmetric
+)
+
+func parseNATType(s string) (natType, error) {
+	switch strings.ToLower(s) {
+	case "", "full-cone":
+		return natFullCone, nil
+	case "restricted":
+		return natRestricted, nil
+	case "port-restricted":
+		return natPortRestricted, nil
+	case "symmetric":
+		return natSymmetric, nil
+	default:
+		return 0, fmt.Errorf("nat type %s not support", s)
+	}
+}
+
+func (t natType) String() string {
+	switch t {
+	case natFullCone:
+		return "full cone"
+	case natRestricted:
+		return "restricted cone"
+	case natPortRestricted:
+		return "port-restricted cone"
+	case natSymmetric:
+		return "symmetric"
+	default:
+		return ""
+	}
+}
+
+// natFilter describes destinations sources in a mapping in NAT sent to, and packets from other destinations are
+// filtered. Open filters accept any destination, which are used in expectations whose destinations are unknown.
+type natFilter struct {
+	lock   sync.Mutex
+	peers  map[string]time.Time
+	isOpen bool
+}
+
+func newNATFilter() *natFilter {
+	return &natFilter{peers: make(map[string]time.Time)}
+}
+
+// add adds the destination to the filter, and removes destinations idle for longer than the timeout.
+func (f *natFilter) add(peer string, timeout time.Duration) {
+	now := time.Now()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	_, ok := f.peers[peer]
+	if !ok {
+		for p, last := range f.peers {
+			if now.Sub(last) > timeout {
+				delete(f.peers, p)
+			}
+		}
+	}
+
+	f.peers[peer] = now
+}
+
+// allow returns if packets from the destination pass the filter.
+func (f *natFilter) allow(peer string, timeout time.Duration) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.isOpen {
+		return true
+	}
+
+	last, ok := f.peers[peer]
+
+	return ok && time.Now().Sub(last) <= timeout
 }
 
+// natTCPState describes the state of a TCP port in NAT, which decides its idle timeout.
+type natTCPState int
+
+const (
+	// natTCPOpening describes the port is opened by a SYN and waits for the connection established.
+	natTCPOpening natTCPState = iota
+	// natTCPEstablished describes the connection of the port is established.
+	natTCPEstablished
+	// natTCPClosing describes the connection of the port is closed by a FIN or a RST.
+	natTCPClosing
+)
+
 func (indicator *natIndicator) embSrcIP() net.IP {
 	switch t := indicator.embSrc.(type) {
 	case *net.IPAddr:
@@ -57,9 +193,19 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 
 const name string = "IkaGo-server"
 
-const keepAlive = 30 * time.Second
 const keepFragments = 30 * time.Second
 const keepSticky = 30 * time.Second
+const keepBridge = 5 * time.Minute
+const keepConn = 10 * time.Minute
+const defaultNATSave = time.Minute
+const natGossipInterval = 5 * time.Second
+const standbyTimeout = 3 * natGossipInterval
+const maxNATGossip = 64 << 20
+const defaultAcctSave = time.Minute
+
+// natOwnedFilter matches packets from upstream to ports and IDs of NAT, including ICMP errors of them, which are the
+// only packets in the upstream device the server owns.
+const natOwnedFilter = "(ip && (((tcp || udp) && dst portrange 49152-65535) || (icmp && (icmp[0] == 0 || ((icmp[0] == 3 || icmp[0] == 11 || icmp[0] == 12) && (icmp[17] == 1 || icmp[8 + ((icmp[8] & 0xf) << 2):2] >= 49152)))))) || (ip6 && (((tcp || udp) && dst portrange 49152-65535) || (icmp6 && (ip6[40] == 129 || (ip6[40] >= 1 && ip6[40] <= 4 && (ip6[54] == 58 || ip6[88:2] >= 49152))))))"
 
 var (
 	version     = ""
@@ -71,18 +217,74 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 
 var (
 	argListDevs       = flag.Bool("list-devices", false, "List all valid devices in current computer.")
+	argJSON           = flag.Bool("json", false, "Print in JSON.")
+	argGenerateKey    = flag.Bool("generate-key", false, "Generate a key pair for authentication.")
 	argConfig         = flag.String("c", "", "Configuration file.")
+	argCheckConfig    = flag.Bool("check-config", false, "Check configuration.")
+	argProfile        = flag.String("profile", "", "Profile in configuration file.")
 	argListenDevs     = flag.String("listen-devices", "", "Devices for listening.")
 	argUpDev          = flag.String("upstream-device", "", "Device for routing upstream to.")
+	argBackends       = flag.String("backends", "", "Backends of devices.")
+	argPcapSnapLen    = flag.Int("pcap-snaplen", 0, "Snap length of libpcap.")
+	argPcapBuffer     = flag.Int("pcap-buffer", 0, "Buffer size of libpcap.")
+	argPcapImmediate  = flag.Bool("pcap-immediate", false, "Enable immediate mode of libpcap.")
+	argPcapTimeout    = flag.Int("pcap-timeout", 0, "Timeout of libpcap.")
+	argBatch          = flag.Int("batch", 0, "Max packets read and written in a batch.")
+	argBusyPoll       = flag.Bool("busy-poll", false, "Busy poll devices.")
+	argWorkers        = flag.Int("workers", 0, "Number of workers handling packets.")
+	argQueueSize      = flag.Int("queue-size", 0, "Length of queues of each traffic class in workers.")
+	argQueuePolicies  = flag.String("queue-policies", "", "Policies of queues of traffic classes when they are full.")
+	argQoS            = flag.String("qos", "", "QoS rules classifying packets into traffic classes.")
+	argDropLog        = flag.Int("drop-log", 0, "Number of packets dropped by QoS rules logged in each flow.")
+	argMemoryLimit    = flag.Int("memory-limit", 0, "Memory limit in MB.")
+	argShape          = flag.Int("shape", 0, "Shaping rate in Kbps.")
+	argShapeBurst     = flag.Int("shape-burst", 0, "Burst of shaping in KB.")
 	argGateway        = flag.String("gateway", "", "Gateway address.")
 	argMode           = flag.String("mode", "faketcp", "Mode.")
 	argMethod         = flag.String("method", "plain", "Method of encryption.")
 	argPassword       = flag.String("password", "", "Password of encryption.")
+	argPasswordFile   = flag.String("password-file", "", "File of password of encryption.")
+	argPasswordCmd    = flag.String("password-cmd", "", "Command printing password of encryption.")
+	argKDF            = flag.String("kdf", "", "Key derivation function.")
+	argKDFMemory      = flag.Int("kdf-memory", 0, "Memory of key derivation function.")
+	argKDFIters       = flag.Int("kdf-iterations", 0, "Iterations of key derivation function.")
+	argRekeyInterval  = flag.Int("rekey-interval", 0, "Interval of re-keying.")
+	argRekeyBytes     = flag.Int("rekey-bytes", 0, "Bytes of re-keying.")
+	argKeyExchange    = flag.Bool("key-exchange", false, "Enable key exchange.")
+	argPrivateKey     = flag.String("private-key", "", "Private key for authentication.")
+	argPeerKeys       = flag.String("peer-keys", "", "Public keys of peers.")
 	argRule           = flag.Bool("rule", false, "Add firewall rule.")
 	argVerbose        = flag.Bool("v", false, "Print verbose messages.")
 	argLog            = flag.String("log", "", "Log.")
+	argLogFormat      = flag.String("log-format", "", "Format of log.")
+	argLogMaxSize     = flag.Int("log-max-size", 0, "Size of log rotated at.")
+	argLogRotate      = flag.Int("log-rotate-interval", 0, "Interval of rotating log.")
+	argLogBackups     = flag.Int("log-backups", 0, "Number of rotated logs kept.")
+	argLogCompress    = flag.Bool("log-compress", false, "Compress rotated logs.")
+	argLogSyslog      = flag.String("log-syslog", "", "Syslog server log sent to.")
+	argLogEventLog    = flag.Bool("log-eventlog", false, "Report log to Windows Event Log.")
 	argMonitor        = flag.Int("monitor", 0, "Port for monitoring.")
+	argControl        = flag.String("control", "", "Path of control socket.")
+	argDump           = flag.String("dump", "", "File for dumping packets.")
+	argDumpLayer      = flag.String("dump-layer", "all", "Layer of packets dumped.")
+	argTrace          = flag.String("trace", "", "Endpoint of tracing.")
+	argTraceSample    = flag.Int("trace-sample", 0, "Sampling of tracing.")
+	argPProf          = flag.String("pprof", "", "Address for profiling.")
 	argMTU            = flag.Int("mtu", 0, "MTU.")
+	argNoECN          = flag.Bool("no-ecn", false, "Disable copying DSCP and ECN.")
+	argTTL            = flag.String("ttl", "", "TTL policy.")
+	argDSCP           = flag.String("dscp", "", "DSCP class.")
+	argEmulate        = flag.Bool("emulate", false, "Enable TCP emulation.")
+	argSYNOptions     = flag.String("syn-options", "", "TCP options in SYN.")
+	argKeepAlive      = flag.Int("keepalive", 0, "Interval of keepalive.")
+	argFingerprint    = flag.String("fingerprint", "", "OS fingerprint.")
+	argPace           = flag.Int("pace", 0, "Pacing rate.")
+	argObfs           = flag.String("obfs", "", "Obfuscation.")
+	argBridge         = flag.Bool("bridge", false, "Enable bridging.")
+	argAllow          = flag.String("allow", "", "Destinations allowed.")
+	argDeny           = flag.String("deny", "", "Destinations denied.")
+	argGeoIP          = flag.String("geoip", "", "GeoIP databases.")
+	argGeoIPReload    = flag.Int("geoip-reload", 0, "Interval of reloading GeoIP databases.")
 	argKCP            = flag.Bool("kcp", false, "Enable KCP.")
 	argKCPMTU         = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
 	argKCPSendWindow  = flag.Int("kcp-sndwnd", kcp.IKCP_WND_SND, "KCP tuning option sndwnd.")
@@ -94,37 +296,111 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 	argKCPInterval    = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
 	argKCPResend      = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
 	argKCPNC          = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
+	argNATUDP         = flag.Int("nat-udp", 300, "NAT timeout of UDP.")
+	argNATTCPEst      = flag.Int("nat-tcp-established", 7440, "NAT timeout of established TCP.")
+	argNATTCPTrans    = flag.Int("nat-tcp-transitory", 240, "NAT timeout of transitory TCP.")
+	argNATICMP        = flag.Int("nat-icmp", 60, "NAT timeout of ICMP query.")
+	argNATFile        = flag.String("nat-file", "", "File for persisting NAT.")
+	argNATSave        = flag.Int("nat-save-interval", 0, "Interval of persisting NAT.")
+	argNATType        = flag.String("nat-type", "", "NAT type.")
+	argNATMax         = flag.Int("nat-max-entries", 0, "Max entries in NAT.")
+	argNATPortBlock   = flag.Int("nat-port-block", 0, "Size of port blocks of clients in NAT.")
+	argNATPeers       = flag.String("nat-peers", "", "Peers replicating NAT.")
+	argNATGossipPort  = flag.Int("nat-gossip-port", 0, "Port for replicating NAT with peers.")
+	argStandby        = flag.Bool("standby", false, "Run as a hot standby of peers.")
+	argAccountingFile = flag.String("accounting-file", "", "File for persisting accounting of clients.")
+	argALG            = flag.String("alg", "", "Application-layer gateways.")
+	argUpstream       = flag.String("upstream", "", "Next server in relay.")
 	argPort           = flag.Int("p", 0, "Port for listening.")
 )
 
 var (
-	port       uint16
-	listenDevs []*pcap.Device
-	upDev      *pcap.Device
-	gatewayDev *pcap.Device
-	mode       string
-	crypt      crypto.Crypt
-	mtu        int
-	isKCP      bool
-	kcpConfig  *config.KCPConfig
+	reloadLock  sync.Mutex
+	loaded      *config.Config
+	port        uint16
+	listenDevs  []*pcap.Device
+	upDev       *pcap.Device
+	gatewayDev  *pcap.Device
+	mode        string
+	crypt       crypto.Crypt
+	keyring     *crypto.Keyring
+	mtu         int
+	isECN       bool
+	ttlPolicy   *pcap.TTLPolicy
+	dscp        *pcap.DSCP
+	isEmulated  bool
+	synOptions  *pcap.SYNOptions
+	keepalive   time.Duration
+	fingerprint *pcap.Fingerprint
+	pace        int
+	obfuscator  obfs.Obfuscator
+	isBridge    bool
+	acl         *addr.ACL
+	geo         *geoip.Database
+	limiter     *stat.RateLimiter
+	workers     int
+	queueSize   int
+	queuePolicy map[pcap.TrafficClass]pcap.QueuePolicy
+	classifier  *pcap.Classifier
+	isKCP       bool
+	kcpConfig   *config.KCPConfig
+	natConfig   *config.NATConfig
+	natFile     string
+	acctFile    string
+	natMode     natType
+	natMax      int
+	portBlock   int
+	isFTPALG    bool
+	isSIPALG    bool
+	relayAddr   *net.TCPAddr
+	relayPort   uint16
+	natPeers    []string
+	natCrypt    crypto.Crypt
+	isStandby   bool
 )
 
 var (
 	isClosed     bool
 	listeners    []net.Listener
 	upConn       *pcap.RawConn
-	c            chan pcap.ConnBytes
+	relayConn    net.Conn
+	listenPool   *pcap.WorkerPool
+	upPool       *pcap.WorkerPool
 	defrag       *pcap.EasyDefragmenter
 	nextTCPPort  uint16
-	tcpPortPool  []time.Time
+	tcpPortPool  portPool
+	tcpPortState natTCPStates
 	nextUDPPort  uint16
-	udpPortPool  []time.Time
+	udpPortPool  portPool
 	nextICMPv4Id uint16
-	icmpv4IdPool []time.Time
-	patMap       map[quintuple]uint16
+	icmpv4IdPool portPool
+	nextICMPv6Id uint16
+	icmpv6IdPool portPool
+	natLRU       *list.List
+	natEvictions uint64
+	natListener  net.Listener
+	natMerged    uint64
+	standbyLock  sync.Mutex
+	standbys     map[string]*standbyPeer
+	takeovers    uint64
+	blockLock    sync.Mutex
+	blockClients map[string]int
+	blockOwners  []string
+	exhaustions  map[string]uint64
+	distLock     sync.Mutex
 	natLock      sync.RWMutex
-	nat          map[pcap.NATGuide]*natIndicator
+	nat          *natTable
+	ftpSessions  map[uint16]*pcap.FTPSession
+	bridge       *pcap.Bridge
 	monitor      *stat.TrafficMonitor
+	memBudget    *stat.MemoryBudget
+	shaper       *stat.Shaper
+	dedup        *pcap.Deduplicator
+	accounting   *stat.Accounting
+	controller   *control.Server
+	dumper       *pcap.Dumper
+	connLock     sync.Mutex
+	connected    map[string]func()
 	dnsLock      sync.RWMutex
 	dns          map[string]string
 )
@@ -145,34 +421,48 @@ func init() {
 	if commit != "" {
 		versionInfo = versionInfo + fmt.Sprintf("(%s)", commit)
 	}
-	log.Infof("%s %s\n\n", name, versionInfo)
-
 	// Start time
 	startTime = time.Now()
 
 	// Parse arguments
 	flag.Parse()
 
-	// Load config.json by default
-	if len(os.Args) <= 1 {
-		_, err := os.Stat("config.json")
-		if err == nil {
-			*argConfig = "config.json"
+	// Load config.json, config.yaml, config.yml or config.toml by default
+	isDefault := flag.NArg() <= 0 || flag.Arg(0) == "ctl"
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "v" && f.Name != "check-config" && f.Name != "profile" {
+			isDefault = false
+		}
+	})
+	if isDefault {
+		for _, path := range []string{"config.json", "config.yaml", "config.yml", "config.toml"} {
+			_, err := os.Stat(path)
+			if err == nil {
+				*argConfig = path
+				break
+			}
 		}
 	}
 
 	listenDevs = make([]*pcap.Device, 0)
 
 	listeners = make([]net.Listener, 0)
-	c = make(chan pcap.ConnBytes, 1000)
 	defrag = pcap.NewEasyDefragmenter()
 	defrag.SetDeadline(keepFragments)
-	tcpPortPool = make([]time.Time, 16384)
-	udpPortPool = make([]time.Time, 16384)
-	icmpv4IdPool = make([]time.Time, 65536)
-	patMap = make(map[quintuple]uint16)
-	nat = make(map[pcap.NATGuide]*natIndicator)
+	tcpPortPool = make(portPool, 16384)
+	tcpPortState = make(natTCPStates, 16384)
+	udpPortPool = make(portPool, 16384)
+	icmpv4IdPool = make(portPool, 65536)
+	icmpv6IdPool = make(portPool, 65536)
+	natLRU = list.New()
+	blockClients = make(map[string]int)
+	exhaustions = make(map[string]uint64)
+	nat = newNATTable()
+	ftpSessions = make(map[uint16]*pcap.FTPSession)
 	dns = make(map[string]string)
+	connected = make(map[string]func())
+	dedup = pcap.NewDeduplicator()
+	accounting = stat.NewAccounting()
 }
 
 func main() {
@@ -182,26 +472,99 @@ func main() {
 		gateway net.IP
 	)
 
+	// List devices in JSON
+	if *argListDevs && *argJSON {
+		err := listDevsJSON()
+		if err != nil {
+			log.Fatalln(fmt.Errorf("list devices: %w", err))
+		}
+		os.Exit(0)
+	}
+
+	// Control client
+	if flag.Arg(0) == "ctl" {
+		err := ctl(flag.Args()[1:])
+		if err != nil {
+			log.Fatalln(fmt.Errorf("ctl: %w", err))
+		}
+		os.Exit(0)
+	}
+
 	// Configuration file
 	if *argConfig != "" {
-		cfg, err = config.ParseFile(*argConfig)
+		cfg, err = config.ParseFile(*argConfig, *argProfile)
 		if err != nil {
 			log.Fatalln(fmt.Errorf("parse config file %s: %w", *argConfig, err))
 		}
-		log.Infof("Load configuration from %s\n", *argConfig)
 	} else {
+		if *argProfile != "" {
+			log.Fatalln(errors.New("profile not support without configuration file"))
+		}
+
 		cfg = config.NewConfig()
 		cfg.ListenDevs = splitArg(*argListenDevs)
 		cfg.UpDev = *argUpDev
+		cfg.Backends = splitMapArg(*argBackends)
+		cfg.SnapLen = *argPcapSnapLen
+		cfg.Buffer = *argPcapBuffer
+		cfg.Immediate = *argPcapImmediate
+		cfg.Timeout = *argPcapTimeout
+		cfg.Batch = *argBatch
+		cfg.BusyPoll = *argBusyPoll
+		cfg.Workers = *argWorkers
+		cfg.QueueSize = *argQueueSize
+		cfg.QueuePolicy = splitMapArg(*argQueuePolicies)
+		cfg.QoS = splitArg(*argQoS)
+		cfg.DropLog = *argDropLog
+		cfg.MemoryLimit = *argMemoryLimit
+		cfg.Shape = *argShape
+		cfg.ShapeBurst = *argShapeBurst
 		cfg.Gateway = *argGateway
 		cfg.Mode = *argMode
 		cfg.Method = *argMethod
 		cfg.Password = *argPassword
+		cfg.PassFile = *argPasswordFile
+		cfg.PassCmd = *argPasswordCmd
+		cfg.KDF = *argKDF
+		cfg.KDFMemory = *argKDFMemory
+		cfg.KDFIters = *argKDFIters
+		cfg.RekeyTime = *argRekeyInterval
+		cfg.RekeyBytes = *argRekeyBytes
+		cfg.KeyExchange = *argKeyExchange
+		cfg.PrivateKey = *argPrivateKey
+		cfg.PeerKeys = splitArg(*argPeerKeys)
 		cfg.Rule = *argRule
 		cfg.Verbose = *argVerbose
 		cfg.Log = *argLog
+		cfg.LogFormat = *argLogFormat
+		cfg.LogSize = *argLogMaxSize
+		cfg.LogInterval = *argLogRotate
+		cfg.LogBackups = *argLogBackups
+		cfg.LogCompress = *argLogCompress
+		cfg.LogSyslog = *argLogSyslog
+		cfg.LogEventLog = *argLogEventLog
 		cfg.Monitor = *argMonitor
+		cfg.Control = *argControl
+		cfg.Dump = *argDump
+		cfg.DumpLayer = *argDumpLayer
+		cfg.Trace = *argTrace
+		cfg.TraceSample = *argTraceSample
+		cfg.PProf = *argPProf
 		cfg.MTU = *argMTU
+		cfg.NoECN = *argNoECN
+		cfg.TTL = *argTTL
+		cfg.DSCP = *argDSCP
+		cfg.Emulate = *argEmulate
+		cfg.SYNOptions = *argSYNOptions
+		cfg.KeepAlive = *argKeepAlive
+		cfg.Fingerprint = *argFingerprint
+		cfg.Pace = *argPace
+		cfg.Obfs = *argObfs
+		cfg.Bridge = *argBridge
+		cfg.Allow = splitArg(*argAllow)
+		cfg.Deny = splitArg(*argDeny)
+		cfg.GeoIP = splitArg(*argGeoIP)
+		cfg.GeoIPReload = *argGeoIPReload
 		cfg.KCP = *argKCP
 		cfg.KCPConfig = *config.NewKCPConfig()
 		cfg.KCPConfig.MTU = *argKCPMTU
@@ -214,17 +577,98 @@ func main() {
 		cfg.KCPConfig.Interval = *argKCPInterval
 		cfg.KCPConfig.Resend = *argKCPResend
 		cfg.KCPConfig.NC = *argKCPNC
+		cfg.NATConfig = *config.NewNATConfig()
+		cfg.NATConfig.UDP = *argNATUDP
+		cfg.NATConfig.TCPEstablished = *argNATTCPEst
+		cfg.NATConfig.TCPTransitory = *argNATTCPTrans
+		cfg.NATConfig.ICMP = *argNATICMP
+		cfg.NATFile = *argNATFile
+		cfg.NATSave = *argNATSave
+		cfg.NATType = *argNATType
+		cfg.NATMax = *argNATMax
+		cfg.NATBlock = *argNATPortBlock
+		cfg.NATPeers = splitArg(*argNATPeers)
+		cfg.NATGossip = *argNATGossipPort
+		cfg.Standby = *argStandby
+		cfg.AcctFile = *argAccountingFile
+		cfg.ALG = splitArg(*argALG)
+		cfg.Upstream = *argUpstream
 		cfg.Port = *argPort
 	}
 
+	// Environment variables, which are overridden by arguments
+	set := make([]string, 0)
+	if *argConfig == "" {
+		flag.Visit(func(f *flag.Flag) {
+			set = append(set, argKey(f.Name))
+		})
+	}
+	envs, err := config.ApplyEnv(cfg, set)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("apply environment variables: %w", err))
+	}
 	// Log
 	log.SetVerbose(cfg.Verbose || *argVerbose)
+	err = log.SetFormat(cfg.LogFormat)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("log format %s: %w", cfg.LogFormat, err))
+	}
+	if cfg.LogSize < 0 {
+		log.Fatalln(fmt.Errorf("log max size %d out of range", cfg.LogSize))
+	}
+	if cfg.LogInterval < 0 {
+		log.Fatalln(fmt.Errorf("log rotate interval %d out of range", cfg.LogInterval))
+	}
+	if cfg.LogBackups < 0 {
+		log.Fatalln(fmt.Errorf("log backups %d out of range", cfg.LogBackups))
+	}
+	log.SetRotateOptions(log.RotateOptions{
+		Size:     int64(cfg.LogSize) * 1024 * 1024,
+		Interval: time.Duration(cfg.LogInterval) * time.Second,
+		Backups:  cfg.LogBackups,
+		Compress: cfg.LogCompress,
+	})
 	err = log.SetLog(cfg.Log)
 	if err != nil {
 		log.Fatalln(fmt.Errorf("log %s: %w", cfg.Log, err))
 	}
+	err = log.SetSyslog(cfg.LogSyslog, name)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("log syslog %s: %w", cfg.LogSyslog, err))
+	}
+	if cfg.LogEventLog {
+		err = log.SetEventLog(name)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("log event log: %w", err))
+		}
+	}
+
+	// Messages are printed after the log is set, so they are in the format of the log
+	log.Infof("%s %s\n\n", name, versionInfo)
 	if cfg.Log != "" {
 		log.Infof("Save log to file %s\n", cfg.Log)
+		if cfg.LogSize > 0 {
+			log.Infof("Rotate log every %d MB\n", cfg.LogSize)
+		}
+		if cfg.LogInterval > 0 {
+			log.Infof("Rotate log every %d seconds\n", cfg.LogInterval)
+		}
+	}
+	if cfg.LogSyslog != "" {
+		log.Infof("Send log to syslog %s\n", cfg.LogSyslog)
+	}
+	if cfg.LogEventLog {
+		log.Infof("Report log to Windows Event Log as %s\n", name)
+	}
+	if *argConfig != "" {
+		if *argProfile != "" {
+			log.Infof("Load configuration from %s in profile %s\n", *argConfig, *argProfile)
+		} else {
+			log.Infof("Load configuration from %s\n", *argConfig)
+		}
+	}
+	if len(envs) > 0 {
+		log.Infof("Override %s by environment variables\n", strings.Join(envs, ", "))
 	}
 
 	// Check permission
@@ -260,11 +704,24 @@ func main() {
 		}
 		os.Exit(0)
 	}
+	if *argGenerateKey {
+		private, public, err := crypto.GenerateIdentity()
+		if err != nil {
+			log.Fatalln(fmt.Errorf("generate key: %w", err))
+		}
+		log.Infoln("Key pair is generated below, use -private-key [private key] in this side, and -peer-keys [public key] in the peer:")
+		log.Infof("  Private key: %s\n", private)
+		log.Infof("  Public key:  %s\n", public)
+		os.Exit(0)
+	}
 
 	// Verify parameters
 	if cfg.Port == 0 {
 		log.Fatalln("Please provide listen port by -p port.")
 	}
+	if cfg.Password != "" && cfg.PassFile != "" || cfg.Password != "" && cfg.PassCmd != "" || cfg.PassFile != "" && cfg.PassCmd != "" {
+		log.Fatalln(errors.New("password, password file and password command are exclusive"))
+	}
 	if cfg.Gateway != "" {
 		gateway = net.ParseIP(cfg.Gateway)
 		if gateway == nil {
@@ -274,14 +731,73 @@ func main() {
 	if cfg.Monitor < 0 || cfg.Monitor > 65535 {
 		log.Fatalln(fmt.Errorf("monitor port %d out of range", cfg.Monitor))
 	}
-	if cfg.MTU < 576 || cfg.MTU > pcap.MaxMTU {
-		if cfg.MTU == 0 {
-			cfg.MTU = pcap.MaxMTU
-		} else {
-			log.Fatalln(fmt.Errorf("mtu %d out of range", cfg.MTU))
+	if cfg.PProf != "" {
+		_, _, err := net.SplitHostPort(cfg.PProf)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse pprof address %s: %w", cfg.PProf, err))
 		}
 	}
-	if cfg.KCPConfig.MTU > 1500 {
+	if cfg.SnapLen != 0 && (cfg.SnapLen < pcap.MinSnapLen(cfg.MTU) || cfg.SnapLen > 262144) {
+		log.Fatalln(fmt.Errorf("pcap snap length %d out of range", cfg.SnapLen))
+	}
+	if cfg.Buffer < 0 {
+		log.Fatalln(fmt.Errorf("pcap buffer size %d out of range", cfg.Buffer))
+	}
+	if cfg.Timeout < 0 {
+		log.Fatalln(fmt.Errorf("pcap timeout %d out of range", cfg.Timeout))
+	}
+	if cfg.Batch < 0 {
+		log.Fatalln(fmt.Errorf("batch %d out of range", cfg.Batch))
+	}
+	if cfg.Workers < 0 {
+		log.Fatalln(fmt.Errorf("workers %d out of range", cfg.Workers))
+	}
+	if cfg.QueueSize < 0 {
+		log.Fatalln(fmt.Errorf("queue size %d out of range", cfg.QueueSize))
+	}
+	if cfg.MemoryLimit < 0 {
+		log.Fatalln(fmt.Errorf("memory limit %d out of range", cfg.MemoryLimit))
+	}
+	if cfg.DropLog < 0 {
+		log.Fatalln(fmt.Errorf("drop log %d out of range", cfg.DropLog))
+	}
+	if cfg.Shape < 0 {
+		log.Fatalln(fmt.Errorf("shape %d out of range", cfg.Shape))
+	}
+	if cfg.ShapeBurst < 0 {
+		log.Fatalln(fmt.Errorf("shape burst %d out of range", cfg.ShapeBurst))
+	}
+	if cfg.GeoIPReload < 0 {
+		log.Fatalln(fmt.Errorf("geoip reload interval %d out of range", cfg.GeoIPReload))
+	}
+	if cfg.KeepAlive < 0 {
+		log.Fatalln(fmt.Errorf("keepalive %d out of range", cfg.KeepAlive))
+	}
+	if cfg.Pace < 0 {
+		log.Fatalln(fmt.Errorf("pace %d out of range", cfg.Pace))
+	}
+	if cfg.RekeyTime < 0 {
+		log.Fatalln(fmt.Errorf("rekey interval %d out of range", cfg.RekeyTime))
+	}
+	if cfg.KDFMemory < 0 {
+		log.Fatalln(fmt.Errorf("kdf memory %d out of range", cfg.KDFMemory))
+	}
+	if cfg.KDFIters < 0 {
+		log.Fatalln(fmt.Errorf("kdf iterations %d out of range", cfg.KDFIters))
+	}
+	if cfg.RekeyBytes < 0 {
+		log.Fatalln(fmt.Errorf("rekey bytes %d out of range", cfg.RekeyBytes))
+	}
+	if cfg.KeyExchange && cfg.KCP {
+		log.Fatalln(errors.New("key exchange not support with kcp"))
+	}
+	if cfg.PrivateKey != "" && cfg.KCP {
+		log.Fatalln(errors.New("private key not support with kcp"))
+	}
+	if cfg.MTU != 0 && (cfg.MTU < 576 || cfg.MTU > pcap.MaxMTU) {
+		log.Fatalln(fmt.Errorf("mtu %d out of range", cfg.MTU))
+	}
+	if cfg.KCPConfig.MTU > pcap.MaxMTU {
 		log.Fatalln(fmt.Errorf("kcp mtu %d out of range", cfg.KCPConfig.MTU))
 	}
 	if cfg.KCPConfig.SendWindow <= 0 || cfg.KCPConfig.SendWindow > math.MaxInt32 {
@@ -305,13 +821,140 @@ func main() {
 	if cfg.KCPConfig.NC < 0 {
 		log.Fatalln(fmt.Errorf("kcp nc %d out of range", cfg.KCPConfig.NC))
 	}
+	if cfg.NATConfig.UDP <= 0 {
+		log.Fatalln(fmt.Errorf("nat udp timeout %d out of range", cfg.NATConfig.UDP))
+	}
+	if cfg.NATConfig.TCPEstablished <= 0 {
+		log.Fatalln(fmt.Errorf("nat tcp established timeout %d out of range", cfg.NATConfig.TCPEstablished))
+	}
+	if cfg.NATConfig.TCPTransitory <= 0 {
+		log.Fatalln(fmt.Errorf("nat tcp transitory timeout %d out of range", cfg.NATConfig.TCPTransitory))
+	}
+	if cfg.NATConfig.ICMP <= 0 {
+		log.Fatalln(fmt.Errorf("nat icmp timeout %d out of range", cfg.NATConfig.ICMP))
+	}
+	if cfg.NATSave < 0 {
+		log.Fatalln(fmt.Errorf("nat save interval %d out of range", cfg.NATSave))
+	}
+	if cfg.NATMax < 0 {
+		log.Fatalln(fmt.Errorf("nat max entries %d out of range", cfg.NATMax))
+	}
+	if cfg.NATBlock < 0 || cfg.NATBlock > 16384 {
+		log.Fatalln(fmt.Errorf("nat port block %d out of range", cfg.NATBlock))
+	}
+	if cfg.NATGossip < 0 || cfg.NATGossip > 65535 {
+		log.Fatalln(fmt.Errorf("nat gossip port %d out of range", cfg.NATGossip))
+	}
+	if len(cfg.NATPeers) > 0 && cfg.NATGossip == 0 {
+		log.Fatalln(errors.New("missing nat gossip port"))
+	}
+	if cfg.NATGossip != 0 && (cfg.NATGossip == cfg.Port || cfg.NATGossip == cfg.Monitor) {
+		log.Fatalln(errors.New("same nat gossip port with listen or monitor port"))
+	}
 	if cfg.Port <= 0 || cfg.Port > 65535 {
 		log.Fatalln(fmt.Errorf("listen port %d out of range", cfg.Port))
 	}
+	if cfg.Monitor != 0 && cfg.Monitor == cfg.Port {
+		log.Fatalln(fmt.Errorf("same monitor port with listen port"))
+	}
 
 	// Port
 	port = uint16(cfg.Port)
 
+	// NAT timeouts
+	natConfig = &cfg.NATConfig
+	log.Verbosef("NAT timeouts are UDP %d seconds, TCP established %d seconds, TCP transitory %d seconds and ICMP %d seconds\n",
+		natConfig.UDP, natConfig.TCPEstablished, natConfig.TCPTransitory, natConfig.ICMP)
+
+	// NAT type
+	natMode, err = parseNATType(cfg.NATType)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse nat type: %w", err))
+	}
+	if natMode != natFullCone {
+		log.Infof("Use %s NAT\n", natMode)
+	}
+
+	// NAT limit
+	natMax = cfg.NATMax
+	if natMax > 0 {
+		log.Infof("Limit NAT to %d entries\n", natMax)
+	}
+
+	// Port blocks
+	portBlock = cfg.NATBlock
+	if portBlock > 0 {
+		blockOwners = make([]string, 16384/portBlock)
+		log.Infof("Distribute %d ports to each client in %d blocks\n", portBlock, len(blockOwners))
+	}
+
+	// NAT persistence
+	if cfg.NATFile != "" {
+		if cfg.Bridge {
+			log.Fatalln(errors.New("nat file not support with bridge"))
+		}
+
+		natFile = cfg.NATFile
+
+		n, err := loadNAT(natFile)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("load nat: %w", err))
+		}
+		if n > 0 {
+			log.Infof("Restore %d NAT mappings from %s\n", n, natFile)
+		}
+
+		interval := defaultNATSave
+		if cfg.NATSave > 0 {
+			interval = time.Duration(cfg.NATSave) * time.Second
+		}
+
+		go func() {
+			for !isClosed {
+				time.Sleep(interval)
+				if isClosed {
+					return
+				}
+
+				err := saveNAT(natFile)
+				if err != nil {
+					log.Errorln(fmt.Errorf("save nat: %w", err))
+				}
+			}
+		}()
+
+		log.Infof("Persist NAT in %s every %s\n", natFile, interval)
+	}
+
+	// Accounting persistence
+	if cfg.AcctFile != "" {
+		acctFile = cfg.AcctFile
+
+		n, err := loadAccounting(acctFile)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("load accounting: %w", err))
+		}
+		if n > 0 {
+			log.Infof("Restore accounting of %d clients from %s\n", n, acctFile)
+		}
+
+		go func() {
+			for !isClosed {
+				time.Sleep(defaultAcctSave)
+				if isClosed {
+					return
+				}
+
+				err := saveAccounting(acctFile)
+				if err != nil {
+					log.Errorln(fmt.Errorf("save accounting: %w", err))
+				}
+			}
+		}()
+
+		log.Infof("Persist accounting in %s every %s\n", acctFile, defaultAcctSave)
+	}
+
 	// Mode
 	switch cfg.Mode {
 	case "faketcp":
@@ -324,18 +967,240 @@ func main() {
 		log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
 	}
 
+	// KDF
+	kdf, err := crypto.ParseKDF(cfg.KDF, cfg.KDFMemory, cfg.KDFIters)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse kdf: %w", err))
+	}
+	crypto.SetKDF(kdf)
+
+	// Rekey
+	crypto.SetRekeyOptions(crypto.RekeyOptions{
+		Interval: time.Duration(cfg.RekeyTime) * time.Second,
+		Bytes:    int64(cfg.RekeyBytes) * 1024 * 1024,
+	})
+
+	// Direction, keys of packets to clients differ from keys of packets from them
+	crypto.SetServer(true)
+
+	// Key exchange
+	crypto.SetKeyExchange(cfg.KeyExchange)
+
+	// Identity
+	if cfg.PrivateKey != "" {
+		identity, err := crypto.ParseIdentity(cfg.PrivateKey, cfg.PeerKeys)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse identity: %w", err))
+		}
+		crypto.SetIdentity(identity)
+		log.Infof("Authenticate as %s with %d peer keys\n", identity.PublicKey(), identity.Len())
+	}
+
 	// Crypt
-	crypt, err = crypto.ParseCrypt(cfg.Method, cfg.Password)
+	password := []byte(cfg.Password)
+	if cfg.PassFile != "" || cfg.PassCmd != "" {
+		password, err = config.ReadPassword(cfg.PassFile, cfg.PassCmd)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("read password: %w", err))
+		}
+	}
+	// Peers replicating NAT share a crypt of both directions without key exchange, which is derived before the password
+	// is zeroed
+	if len(cfg.NATPeers) > 0 {
+		if strings.ToLower(cfg.Method) == "plain" {
+			natCrypt = crypto.CreatePlainCrypt()
+		} else {
+			natCrypt, err = crypto.CreateAESGCMCrypt(crypto.DeriveKey(string(password), 32))
+			if err != nil {
+				log.Fatalln(fmt.Errorf("parse nat crypt: %w", err))
+			}
+		}
+	}
+	crypt, err = crypto.ParseCryptSecret(cfg.Method, password)
 	if err != nil {
 		log.Fatalln(fmt.Errorf("parse crypt: %w", err))
 	}
 	method := crypt.Method()
+	if method == crypto.MethodPlain && cfg.PrivateKey != "" {
+		log.Fatalln(errors.New("private key not support with method plain"))
+	}
 	if method != crypto.MethodPlain {
-		log.Infof("Encrypt with %s\n", method)
+		if method == crypto.MethodHMAC {
+			log.Infof("Authenticate with %s without encryption\n", method)
+		} else {
+			log.Infof("Encrypt with %s\n", method)
+		}
+		if !kdf.IsDefault() {
+			log.Infof("Derive keys with %s\n", kdf)
+		}
+		if cfg.KeyExchange || cfg.PrivateKey != "" {
+			log.Infoln("Exchange session keys with X25519")
+		}
+		if cfg.RekeyTime > 0 {
+			log.Infof("Re-key every %d seconds\n", cfg.RekeyTime)
+		}
+		if cfg.RekeyBytes > 0 {
+			log.Infof("Re-key every %d MB\n", cfg.RekeyBytes)
+		}
+	}
+
+	// Keyring
+	if len(cfg.Clients) > 0 {
+		if cfg.KCP {
+			log.Fatalln(errors.New("clients not support with kcp"))
+		}
+
+		keyring, err = crypto.ParseKeyring(cfg.Method, cfg.Clients)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse keyring: %w", err))
+		}
+		log.Infof("Accept %d clients with individual keys\n", keyring.Len())
+	}
+
+	// Bridge
+	isBridge = cfg.Bridge
+	if isBridge {
+		bridge = pcap.NewBridge()
+		bridge.SetDeadline(keepBridge)
+		log.Infoln("Enable bridging")
+	}
+
+	// GeoIP
+	if len(cfg.GeoIP) > 0 {
+		geo, err = geoip.Open(cfg.GeoIP)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("open geoip: %w", err))
+		}
+		log.Infof("Use GeoIP databases %s\n", geo)
+
+		interval := cfg.GeoIPReload
+		if interval <= 0 {
+			interval = 86400
+		}
+		if !*argCheckConfig {
+			go func() {
+				for range time.Tick(time.Duration(interval) * time.Second) {
+					err := geo.Reload()
+					if err != nil {
+						log.Errorln(fmt.Errorf("reload geoip: %w", err))
+					} else {
+						log.Infoln("Reload GeoIP databases")
+					}
+				}
+			}()
+		}
+		log.Infof("Reload GeoIP databases every %d seconds\n", interval)
+	}
+
+	// ACL
+	acl, err = addr.ParseACL(cfg.Allow, cfg.Deny, geo)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse acl: %w", err))
+	}
+	if !acl.IsEmpty() {
+		log.Infof("Allow destinations %s\n", acl)
+	}
+
+	// Rate limit
+	limiter, err = parseRateLimits(cfg.RateLimits)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse rate limits: %w", err))
+	}
+	if !limiter.IsEmpty() {
+		if isBridge {
+			log.Fatalln(errors.New("rate limit not support with bridge"))
+		}
+		log.Infof("Limit rates of clients %s\n", limiter)
+	}
+
+	// ALG
+	for _, alg := range cfg.ALG {
+		switch strings.ToLower(alg) {
+		case "ftp":
+			isFTPALG = true
+		case "sip":
+			isSIPALG = true
+		default:
+			log.Fatalln(fmt.Errorf("alg %s not support", alg))
+		}
+		if isBridge {
+			log.Fatalln(errors.New("alg not support with bridge"))
+		}
+	}
+	if isFTPALG {
+		log.Infoln("Enable FTP ALG")
+	}
+	if isSIPALG {
+		log.Infoln("Enable SIP ALG")
+	}
+
+	// Relay
+	if cfg.Upstream != "" {
+		if isBridge {
+			log.Fatalln(errors.New("relay not support with bridge"))
+		}
+
+		relayAddr, err = addr.ParseTCPAddr(cfg.Upstream)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse upstream %s: %w", cfg.Upstream, err))
+		}
+		// Ports from 49152 are distributed in NAT
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		relayPort = uint16(32768 + r.Intn(16384))
+		log.Infof("Relay to server %s\n", relayAddr)
+	}
+
+	// NAT replication
+	if len(cfg.NATPeers) > 0 {
+		if isBridge {
+			log.Fatalln(errors.New("nat peers not support with bridge"))
+		}
+		if portBlock > 0 {
+			log.Fatalln(errors.New("nat peers not support with nat port block"))
+		}
+
+		natPeers = cfg.NATPeers
+
+		if !*argCheckConfig {
+			natListener, err = net.Listen("tcp", fmt.Sprintf(":%d", cfg.NATGossip))
+			if err != nil {
+				log.Fatalln(fmt.Errorf("listen nat gossip: %w", err))
+			}
+
+			go serveNATGossip(natListener)
+			go gossipNAT()
+		}
+
+		log.Infof("Replicate NAT with peers %s in port %d\n", strings.Join(natPeers, ", "), cfg.NATGossip)
+	}
+
+	// Hot standby
+	if cfg.Standby {
+		if len(cfg.NATPeers) <= 0 {
+			log.Fatalln(errors.New("standby missing nat peers"))
+		}
+		if cfg.Mode != "faketcp" {
+			log.Fatalln(fmt.Errorf("standby not support with mode %s", cfg.Mode))
+		}
+		if cfg.KCP {
+			log.Fatalln(errors.New("standby not support with kcp"))
+		}
+		if cfg.RekeyTime > 0 || cfg.RekeyBytes > 0 {
+			log.Fatalln(errors.New("standby not support with re-keying"))
+		}
+
+		isStandby = true
+		standbys = make(map[string]*standbyPeer)
+
+		if !*argCheckConfig {
+			go watchStandby()
+		}
+
+		log.Infoln("Run as a hot standby of peers")
 	}
 
 	// Add firewall rule
-	if cfg.Rule {
+	if cfg.Rule && !*argCheckConfig {
 		err := exec.DisableIPForwarding()
 		if err != nil {
 			log.Fatalln(fmt.Errorf("disable ip forwarding: %w", err))
@@ -352,41 +1217,80 @@ func main() {
 	}
 
 	// Monitor
-	if cfg.Monitor != 0 {
-		if cfg.Monitor == int(port) {
-			log.Fatalln(fmt.Errorf("same monitor port with listen port"))
-		}
-
+	if cfg.Monitor != 0 && !*argCheckConfig {
 		monitor = stat.NewTrafficMonitor()
 
+		dashboardHandler, err := dashboard.Handler(name)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("create dashboard: %w", err))
+		}
+
+		// The default mux is not used, where pprof registers itself
+		mux := http.NewServeMux()
 		go func() {
-			http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-				b, err := json.Marshal(&struct {
+			mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+				serveJSON(w, req, http.StatusOK, &struct {
 					Name    string               `json:"name"`
 					Version string               `json:"version"`
 					Time    int                  `json:"time"`
 					Monitor *stat.TrafficMonitor `json:"monitor"`
+					NAT     interface{}          `json:"nat"`
 				}{
 					Name:    name,
 					Version: versionInfo,
 					Time:    int(time.Now().Sub(startTime).Seconds()),
 					Monitor: monitor,
+					NAT:     natStatus(),
 				})
-				if err != nil {
-					log.Errorln(fmt.Errorf("monitor: %w", err))
-					return
-				}
+			})
 
-				// Handle CORS
-				w.Header().Set("Access-Control-Allow-Origin", "*")
+			mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+				status, isUp := upstreamStatus()
 
-				_, err = io.WriteString(w, string(b))
-				if err != nil {
-					log.Errorln(fmt.Errorf("monitor: %w", err))
+				// Unavailable until upstream is up for health checks
+				code := http.StatusOK
+				if !isUp {
+					code = http.StatusServiceUnavailable
 				}
+
+				connLock.Lock()
+				clients := len(connected)
+				connLock.Unlock()
+
+				serveJSON(w, req, code, &struct {
+					Name     string      `json:"name"`
+					Version  string      `json:"version"`
+					Time     int         `json:"time"`
+					Upstream interface{} `json:"upstream"`
+					Clients  int         `json:"clients"`
+				}{
+					Name:     name,
+					Version:  versionInfo,
+					Time:     int(time.Now().Sub(startTime).Seconds()),
+					Upstream: status,
+					Clients:  clients,
+				})
+			})
+
+			mux.HandleFunc("/clients", func(w http.ResponseWriter, req *http.Request) {
+				serveJSON(w, req, http.StatusOK, dumpClients())
+			})
+
+			mux.HandleFunc("/nat", func(w http.ResponseWriter, req *http.Request) {
+				serveJSON(w, req, http.StatusOK, dumpNAT(req.URL.Query().Get("client")))
+			})
+
+			mux.HandleFunc("/accounting", func(w http.ResponseWriter, req *http.Request) {
+				serveJSON(w, req, http.StatusOK, dumpAccounting(req.URL.Query().Get("client")))
+			})
+
+			mux.HandleFunc("/errors", func(w http.ResponseWriter, req *http.Request) {
+				serveJSON(w, req, http.StatusOK, log.RecentErrors())
 			})
 
-			http.HandleFunc("/dns", func(w http.ResponseWriter, req *http.Request) {
+			mux.Handle("/dashboard", dashboardHandler)
+
+			mux.HandleFunc("/dns", func(w http.ResponseWriter, req *http.Request) {
 				type IPName struct {
 					IP   string `json:"ip"`
 					Name string `json:"name"`
@@ -402,40 +1306,117 @@ type IPName struct {
 				}
 				dnsLock.RUnlock()
 
-				b, err := json.Marshal(ipNames)
-				if err != nil {
-					log.Errorln(fmt.Errorf("monitor: %w", err))
-					return
-				}
-
-				// Handle CORS
-				w.Header().Set("Access-Control-Allow-Origin", "*")
-
-				_, err = io.WriteString(w, string(b))
-				if err != nil {
-					log.Errorln(fmt.Errorf("monitor: %w", err))
-				}
+				serveJSON(w, req, http.StatusOK, ipNames)
 			})
 
-			err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Monitor), nil)
+			err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Monitor), mux)
 			if err != nil {
 				log.Errorln(fmt.Errorf("monitor: %w", err))
 			}
 		}()
 
 		log.Infof("Monitor on :%d\n", cfg.Monitor)
+		log.Infof("Dashboard on http://localhost:%d/dashboard\n", cfg.Monitor)
 		log.Infoln("You can now observe traffic on http://ikago.ikas.ink")
 	}
 
+	// Profiling
+	if cfg.PProf != "" && !*argCheckConfig {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		go func() {
+			err := http.ListenAndServe(cfg.PProf, mux)
+			if err != nil {
+				log.Errorln(fmt.Errorf("pprof: %w", err))
+			}
+		}()
+
+		log.Infof("Profile on http://%s/debug/pprof/\n", cfg.PProf)
+	}
+
 	// Mode-related options
 	switch mode {
 	case "faketcp":
 		// MTU
 		mtu = cfg.MTU
-		if mtu != pcap.MaxMTU {
+		if mtu != 0 {
 			log.Infof("Set MTU to %d Bytes\n", mtu)
 		}
 
+		// ECN
+		isECN = !cfg.NoECN
+		if !isECN {
+			log.Infoln("Disable copying DSCP and ECN")
+		}
+
+		// TTL
+		ttlPolicy, err = pcap.ParseTTLPolicy(cfg.TTL)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse ttl policy: %w", err))
+		}
+		if !ttlPolicy.IsDefault() {
+			log.Infof("Set TTL policy to %s\n", ttlPolicy)
+		}
+
+		// DSCP
+		dscp, err = pcap.ParseDSCP(cfg.DSCP)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse dscp: %w", err))
+		}
+		if !dscp.IsDefault() {
+			log.Infof("Mark DSCP %s\n", dscp)
+		}
+
+		// Emulation
+		isEmulated = cfg.Emulate
+		if isEmulated {
+			log.Infoln("Enable TCP emulation")
+		}
+
+		// Fingerprint
+		fingerprint, err = pcap.ParseFingerprint(cfg.Fingerprint)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse fingerprint: %w", err))
+		}
+		if !fingerprint.IsDefault() {
+			log.Infof("Imitate fingerprint of %s\n", fingerprint)
+		}
+
+		// SYN options
+		synOptions, err = pcap.ParseSYNOptions(cfg.SYNOptions)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse syn options: %w", err))
+		}
+		if !synOptions.IsDefault() {
+			log.Infof("Set SYN options to %s\n", synOptions)
+		}
+
+		// Keepalive
+		keepalive = time.Duration(cfg.KeepAlive) * time.Second
+		if keepalive > 0 {
+			log.Infof("Send keepalive every %d seconds\n", cfg.KeepAlive)
+		}
+
+		// Pace
+		pace = cfg.Pace
+		if pace > 0 {
+			log.Infof("Pace segments at %d Kbps\n", pace)
+		}
+
+		// Obfuscation
+		obfuscator, err = obfs.ParseObfuscator(cfg.Obfs)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse obfs: %w", err))
+		}
+		if obfuscator.Method() != obfs.MethodPlain {
+			log.Infof("Obfuscate in %s\n", obfuscator.Method())
+		}
+
 		// KCP
 		isKCP = cfg.KCP
 		kcpConfig = &cfg.KCPConfig
@@ -450,6 +1431,134 @@ type IPName struct {
 
 	log.Infof("Proxy from :%d\n", cfg.Port)
 
+	// Dump
+	dumpLayer, err := pcap.ParseDumpLayer(cfg.DumpLayer)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse dump layer: %w", err))
+	}
+	if cfg.Dump != "" && !*argCheckConfig {
+		dumper, err = pcap.CreateDumper(cfg.Dump, dumpLayer)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("create dump %s: %w", cfg.Dump, err))
+		}
+		pcap.SetDumper(dumper)
+
+		log.Infof("Dump %s packets to %s\n", dumpLayer, cfg.Dump)
+	}
+
+	// Tracing
+	if cfg.TraceSample < 0 {
+		log.Fatalln(fmt.Errorf("trace sample %d out of range", cfg.TraceSample))
+	}
+	if cfg.Trace != "" && !*argCheckConfig {
+		err = tracing.Setup(tracing.Options{
+			Endpoint: cfg.Trace,
+			Sample:   cfg.TraceSample,
+			Service:  name,
+			Version:  version,
+		})
+		if err != nil {
+			log.Fatalln(fmt.Errorf("set up tracing: %w", err))
+		}
+
+		sample := cfg.TraceSample
+		if sample == 0 {
+			sample = tracing.DefaultSample
+		}
+		log.Infof("Trace 1 of every %d packets to %s\n", sample, cfg.Trace)
+	}
+
+	// Libpcap
+	pcap.SetPcapOptions(pcap.PcapOptions{
+		SnapLen:     cfg.SnapLen,
+		BufferSize:  cfg.Buffer,
+		IsImmediate: cfg.Immediate,
+		Timeout:     time.Duration(cfg.Timeout) * time.Millisecond,
+	})
+
+	// Batch
+	pcap.SetBatchSize(cfg.Batch)
+	if cfg.Batch > 1 {
+		log.Infof("Read and write up to %d packets in a batch\n", cfg.Batch)
+	}
+
+	// Busy poll
+	pcap.SetBusyPoll(cfg.BusyPoll)
+	if cfg.BusyPoll {
+		log.Infoln("Busy poll devices")
+	}
+
+	// Workers
+	workers = cfg.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	log.Infof("Handle packets in %d workers\n", workers)
+
+	// Queues
+	queueSize = cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = 1000
+	}
+	queuePolicy = make(map[pcap.TrafficClass]pcap.QueuePolicy)
+	for class, policy := range pcap.DefaultQueuePolicies {
+		queuePolicy[class] = policy
+	}
+	for name, s := range cfg.QueuePolicy {
+		class, err := pcap.ParseTrafficClass(name)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse traffic class: %w", err))
+		}
+		policy, err := pcap.ParseQueuePolicy(s)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse queue policy of traffic class %s: %w", class, err))
+		}
+		queuePolicy[class] = policy
+	}
+	for class := pcap.ClassRealtime; class <= pcap.ClassBulk; class++ {
+		log.Infof("Queue up to %d %s packets in each worker, which %s when full\n", queueSize, class, queuePolicy[class])
+	}
+
+	// QoS
+	classifier, err = pcap.ParseClassifier(cfg.QoS, cfg.DropLog)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse qos: %w", err))
+	}
+	if !classifier.IsEmpty() {
+		log.Infof("Classify %s\n", classifier)
+	}
+
+	// Schedule
+	schedule.Start(applySchedules)
+
+	// Memory budget
+	if cfg.MemoryLimit > 0 {
+		memBudget = stat.NewMemoryBudget(uint64(cfg.MemoryLimit) * 1024 * 1024)
+		log.Infof("Shed load when the heap approaches %d MB\n", cfg.MemoryLimit)
+	}
+
+	// Shaper
+	if cfg.Shape > 0 {
+		shaper = stat.NewShaper(cfg.Shape, cfg.ShapeBurst)
+		if cfg.ShapeBurst > 0 {
+			log.Infof("Shape egress at %d Kbps with bursts of %d KB\n", cfg.Shape, cfg.ShapeBurst)
+		} else {
+			log.Infof("Shape egress at %d Kbps\n", cfg.Shape)
+		}
+	}
+
+	// Backends
+	for name, s := range cfg.Backends {
+		backend, err := pcap.ParseBackend(s)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse backend of device %s: %w", name, err))
+		}
+		pcap.SetBackend(name, backend)
+		if backend != pcap.BackendPcap {
+			log.Infof("Use %s backend in device %s\n", backend, name)
+		}
+	}
+
 	// Find devices
 	listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
 	if err != nil {
@@ -486,6 +1595,20 @@ type IPName struct {
 		log.Fatalln(errors.New("cannot determine gateway device"))
 	}
 
+	// Detect MTU
+	if mtu == 0 {
+		mtu = pcap.DetectMTU(append(append(make([]*pcap.Device, 0), listenDevs...), upDev)...)
+		if mtu != pcap.DefaultMTU {
+			log.Infof("Detect MTU %d Bytes\n", mtu)
+		}
+	}
+
+	// Check configuration only
+	if *argCheckConfig {
+		log.Infoln("Configuration is valid")
+		os.Exit(0)
+	}
+
 	// Wait signals
 	sig := make(chan os.Signal)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
@@ -495,6 +1618,31 @@ type IPName struct {
 		os.Exit(0)
 	}()
 
+	// Reload configuration on SIGHUP
+	if *argConfig != "" {
+		loaded = cfg
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				err := reload(*argConfig)
+				if err != nil {
+					log.Errorln(fmt.Errorf("reload configuration: %w", err))
+				}
+			}
+		}()
+	}
+
+	// Control
+	if cfg.Control != "" {
+		err = serveControl(cfg.Control)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("control: %w", err))
+		}
+		log.Infof("Control on %s\n", cfg.Control)
+	}
+
 	// Open pcap
 	err = open()
 	if err != nil {
@@ -545,13 +1693,13 @@ func open() error {
 				if isKCP {
 					listener, err = pcap.ListenFakeTCPWithKCP(dev, dev, port, crypt, mtu, kcpConfig)
 				} else {
-					listener, err = pcap.ListenFakeTCP(dev, dev, port, crypt, mtu)
+					listener, err = pcap.ListenFakeTCP(dev, dev, port, crypt, mtu, isECN, ttlPolicy, dscp, isEmulated, synOptions, keepalive, fingerprint, pace, obfuscator)
 				}
 			} else {
 				if isKCP {
 					listener, err = pcap.ListenFakeTCPWithKCP(dev, gatewayDev, port, crypt, mtu, kcpConfig)
 				} else {
-					listener, err = pcap.ListenFakeTCP(dev, gatewayDev, port, crypt, mtu)
+					listener, err = pcap.ListenFakeTCP(dev, gatewayDev, port, crypt, mtu, isECN, ttlPolicy, dscp, isEmulated, synOptions, keepalive, fingerprint, pace, obfuscator)
 				}
 			}
 		case "tcp":
@@ -563,16 +1711,90 @@ func open() error {
 			return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
 		}
 
+		// Keyring
+		if keyring != nil {
+			switch t := listener.(type) {
+			case *pcap.FakeTCPListener:
+				t.SetKeyring(keyring)
+			case *pcap.TCPListener:
+				t.SetKeyring(keyring)
+			}
+		}
+
+		// Roaming
+		if t, ok := listener.(*pcap.FakeTCPListener); ok {
+			t.SetRoaming(roamClient)
+		}
+
 		listeners = append(listeners, listener)
 	}
 
 	// Handles for routing upstream
-	upConn, err = pcap.CreateRawConn(upDev, gatewayDev, fmt.Sprintf("ip && (((tcp || udp) && not dst port %d) || icmp || (ip[6:2] & 0x1fff) != 0)", port))
+	if isBridge {
+		upConn, err = pcap.CreateRawConn(upDev, gatewayDev, fmt.Sprintf("not (tcp && port %d)", port))
+	} else {
+		filter := fmt.Sprintf("(ip && (((tcp || udp) && not dst port %d) || icmp || (ip[6:2] & 0x1fff) != 0)) || (ip6 && (((tcp || udp) && not dst port %d) || (icmp6 && (ip6[40] <= 4 || ip6[40] == 128 || ip6[40] == 129)) || ip6[6] == 43 || ip6[6] == 44 || ip6[6] == 51 || ip6[6] == 60 || (ip6[6] == 0 && ip6[40] != 58)))", port, port)
+		// Traffic from the next server in relay is handled in the relay
+		if relayAddr != nil {
+			filter = fmt.Sprintf("(%s) && not (src host %s && tcp src port %d)", filter, relayAddr.IP, relayAddr.Port)
+		}
+		// Only packets to NAT are taken from the kernel by backends like xdp, so traffic of the server is kept
+		upConn, err = pcap.CreateOwnedRawConn(upDev, gatewayDev, filter, natOwnedFilter)
+	}
 	if err != nil {
 		return fmt.Errorf("open upstream device %s: %w", upDev.Alias(), err)
 	}
+	upConn.SetDumpLayer(pcap.DumpInner)
+
+	// Handle for relaying to the next server
+	if relayAddr != nil {
+		relayConn, err = dialRelay()
+		if err != nil {
+			return fmt.Errorf("open relay: %w", err)
+		}
+	}
+
+	// Frames injected must not be bridged again
+	if isBridge {
+		err := upConn.SetInbound()
+		if err != nil {
+			log.Errorln(fmt.Errorf("set inbound in device %s: %w", upDev.Alias(), err))
+		}
+		bridge.AddPort(upConn)
+	}
+
+	// Start handling, bytes from a client are handled by the same worker in order, and so are packets of a flow from
+	// upstream. Both directions of a flow are handled in their own pools in parallel, so the ports they share are kept
+	// atomically. Bytes are never dropped since they are parts of streams, and clients are pushed back instead
+	listenPool = pcap.NewWorkerPool(workers, queueSize, nil, func(v interface{}) {
+		cab := v.(pcap.ConnBytes)
+
+		ctx, span := tracing.StartPacket("listen", time.Time{})
+		err := handleListen(ctx, cab.Bytes, cab.Conn, cab.Destick, cab.Defrag)
+		tracing.End(span, err)
+		if err != nil {
+			log.Errorw(log.Fields{"client": cab.Conn.RemoteAddr().String()}, fmt.Errorf("handle listen in address %s: %w", cab.Conn.LocalAddr().String(), err))
+			log.Verbosef("Source: %s\nSize: %d Bytes\n\n", cab.Conn.RemoteAddr().String(), len(cab.Bytes))
+		}
+	})
+	upPool = pcap.NewWorkerPool(workers, queueSize, queuePolicy, func(v interface{}) {
+		packet := v.(gopacket.Packet)
+
+		var err error
+		if isBridge {
+			err = bridgeFrame(packet.Data(), upConn)
+		} else {
+			ctx, span := tracing.StartPacket("upstream", packet.Metadata().Timestamp)
+			err = handleUpstream(ctx, packet)
+			tracing.End(span, err)
+		}
+		if err != nil {
+			log.Errorw(pcap.Flow(packet), fmt.Errorf("handle upstream in device %s: %w", upConn.LocalDev().Alias(), err))
+			log.Verboseln(packet)
+		}
+		pcap.ReleasePacket(packet)
+	})
 
-	// Start handling
 	for i := 0; i < len(listeners); i++ {
 		listener := listeners[i]
 		go func() {
@@ -589,66 +1811,17 @@ func open() error {
 					continue
 				}
 
-				// Tune
-				switch conn.(type) {
-				case *kcp.UDPSession:
-					err := pcap.TuneKCP(conn.(*kcp.UDPSession), kcpConfig)
-					if err != nil {
-						conn.Close()
-						log.Errorln(fmt.Errorf("tune: %w", err))
-						continue
-					}
-				default:
-					break
-				}
-
-				destick := pcap.NewDesticker()
-				destick.SetDeadline(keepSticky)
-
-				log.Infof("Connect from client %s\n", conn.RemoteAddr().String())
-
-				go func() {
-					b := make([]byte, pcap.IPv4MaxSize)
-					for {
-						n, err := conn.Read(b)
-						if err != nil {
-							if isClosed {
-								return
-							}
-							if errors.Is(err, io.EOF) {
-								log.Infof("Disconnect from client %s\n", conn.RemoteAddr())
-								return
-							}
-							log.Errorln(fmt.Errorf("read listen: %w", err))
-							continue
-						}
-
-						newB := make([]byte, n)
-						copy(newB, b[:n])
-						c <- pcap.ConnBytes{
-							Bytes:   newB,
-							Conn:    conn,
-							Destick: destick,
-						}
-					}
-				}()
+				serveConn(conn)
 			}
 		}()
 	}
 
-	go func() {
-		for cab := range c {
-			err := handleListen(cab.Bytes, cab.Conn, cab.Destick)
-			if err != nil {
-				log.Errorln(fmt.Errorf("handle listen in address %s: %w", cab.Conn.LocalAddr().String(), err))
-				log.Verbosef("Source: %s\nSize: %d Bytes\n\n", cab.Conn.RemoteAddr().String(), len(cab.Bytes))
-				continue
-			}
-		}
-	}()
+	if relayConn != nil {
+		go readRelay()
+	}
 
 	for {
-		packet, err := upConn.ReadPacket()
+		packets, err := upConn.ReadPackets()
 		if err != nil {
 			if isClosed {
 				return nil
@@ -657,103 +1830,678 @@ func open() error {
 			continue
 		}
 
-		err = handleUpstream(packet)
-		if err != nil {
-			log.Errorln(fmt.Errorf("handle upstream in device %s: %w", upConn.LocalDev().Alias(), err))
-			log.Verboseln(packet)
-			continue
+		for _, packet := range packets {
+			if !classifier.Allows(packet) || !upPool.Submit(pcap.FlowHash(packet), classifier.Classify(packet), len(packet.Data()), packet) {
+				pcap.ReleasePacket(packet)
+			}
 		}
 	}
 }
 
-func closeAll() {
-	isClosed = true
-	for _, handle := range listeners {
-		if handle != nil {
-			handle.Close()
+// roamClient moves the state of the client roaming from the address to its new address, so its mappings in NAT are
+// kept.
+func roamClient(conn net.Conn, from net.Addr) {
+	to := conn.RemoteAddr().String()
+
+	connLock.Lock()
+	if disconnect, ok := connected[from.String()]; ok {
+		delete(connected, from.String())
+		connected[to] = disconnect
+	}
+	connLock.Unlock()
+
+	accounting.Move(from.String(), to)
+
+	// Mappings
+	n := 0
+	natLock.Lock()
+	for e := natLRU.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*natEntry)
+		if entry.q.dst != from.String() {
+			continue
 		}
+		nat.pats.delete(entry.q)
+		entry.q.dst = to
+		nat.pats.store(entry.q, entry.slot.value)
+		n++
 	}
-	if upConn != nil {
-		upConn.Close()
+	natLock.Unlock()
+
+	// Block of ports
+	blockLock.Lock()
+	if b, ok := blockClients[from.String()]; ok {
+		delete(blockClients, from.String())
+		blockClients[to] = b
+		blockOwners[b] = to
+		exhaustions[to] = exhaustions[from.String()]
+		delete(exhaustions, from.String())
 	}
-}
+	blockLock.Unlock()
 
-func handleListen(contents []byte, conn net.Conn, destick *pcap.Desticker) error {
-	var (
-		contentss         [][]byte
-		upValue           uint16
-		newTransportLayer gopacket.Layer
-		newNetworkLayer   gopacket.NetworkLayer
-		upIP              net.IP
-		newLinkLayerType  gopacket.LayerType
-		newLinkLayer      gopacket.Layer
-		data              []byte
-		guide             pcap.NATGuide
-		ni                *natIndicator
-	)
+	log.Infow(log.Fields{"client": to}, "Move %d NAT mappings of client %s to %s\n", n, from, to)
+}
 
-	// Empty payload
-	if len(contents) <= 0 {
-		// return errors.New("empty payload")
-		return nil
+// serveConn serves the connection from a client until it is disconnected or expires.
+func serveConn(conn net.Conn) {
+	// Tune
+	switch conn.(type) {
+	case *kcp.UDPSession:
+		err := pcap.TuneKCP(conn.(*kcp.UDPSession), kcpConfig)
+		if err != nil {
+			conn.Close()
+			log.Errorln(fmt.Errorf("tune: %w", err))
+			return
+		}
+	case *pcap.FakeTCPConn:
+		conn.(*pcap.FakeTCPConn).SetBacklog(func() float64 {
+			return listenPool.Backlog(uint64(hashString(fnvOffset, conn.RemoteAddr().String())))
+		})
+	default:
+		break
 	}
 
-	// Destick
-	contentss, err := destick.Append(contents)
-	if err != nil {
-		return fmt.Errorf("destick: %w", err)
+	var destick *pcap.Desticker
+	if isBridge {
+		destick = pcap.NewFrameDesticker()
+		bridge.AddPort(conn)
+	} else {
+		destick = pcap.NewDesticker()
 	}
+	destick.SetDeadline(keepSticky)
+	embDefrag := pcap.NewEasyDefragmenter()
+	embDefrag.SetDeadline(keepFragments)
 
-	// TODO: Use flag instead of return when error occurred
-	// TODO: Merge desticker to pcap.TCPConn
-	for _, contents := range contentss {
-		// Parse embedded packet
-		embIndicator, err := pcap.ParseEmbPacket(contents)
-		if err != nil {
-			return fmt.Errorf("parse embedded packet: %w", err)
+	log.Infow(log.Fields{"client": conn.RemoteAddr().String()}, "Connect from client %s\n", conn.RemoteAddr().String())
+
+	// Expire
+	appear := time.Now()
+	isFinished := false
+	go func() {
+		for !isClosed && !isFinished {
+			time.Sleep(time.Minute)
+			if !isFinished && time.Now().Sub(appear) > keepConn {
+				isFinished = true
+				log.Infow(log.Fields{"client": conn.RemoteAddr().String()}, "Connection from client %s expires\n", conn.RemoteAddr())
+				if isBridge {
+					bridge.RemovePort(conn)
+				}
+				conn.Close()
+			}
 		}
+	}()
 
-		// Distribute port/Id by source and client address and protocol
-		if !embIndicator.IsFrag() {
-			var ok bool
+	// Disconnect by control
+	connLock.Lock()
+	connected[conn.RemoteAddr().String()] = func() {
+		isFinished = true
+		if isBridge {
+			bridge.RemovePort(conn)
+		}
+		conn.Close()
+	}
+	connLock.Unlock()
 
-			q := quintuple{
-				src:      embIndicator.NATSrc().String(),
-				dst:      conn.RemoteAddr().String(),
-				protocol: embIndicator.NATProtocol(),
-			}
-			upValue, ok = patMap[q]
-			if !ok {
-				var err error
+	// Accounting
+	accounting.Connect(conn.RemoteAddr().String(), accountName(conn.RemoteAddr()))
 
-				// if ICMPv4 error is not in NAT, drop it
-				if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv4 && !embIndicator.ICMPv4Indicator().IsQuery() {
-					return errors.New("missing nat")
+	go func() {
+		b := make([]byte, pcap.IPv4MaxSize)
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				if isClosed {
+					return
 				}
-
-				upValue, err = dist(embIndicator.TransportLayer().LayerType())
-				if err != nil {
-					return fmt.Errorf("distribute: %w", err)
+				if isFinished || errors.Is(err, io.EOF) {
+					if isBridge {
+						bridge.RemovePort(conn)
+					}
+					if !isFinished {
+						isFinished = true
+						conn.Close()
+					}
+					connLock.Lock()
+					delete(connected, conn.RemoteAddr().String())
+					connLock.Unlock()
+					accounting.Disconnect(conn.RemoteAddr().String())
+					log.Infow(log.Fields{"client": conn.RemoteAddr().String()}, "Disconnect from client %s\n", conn.RemoteAddr())
+					return
 				}
-
-				patMap[q] = upValue
+				log.Errorln(fmt.Errorf("read listen: %w", err))
+				continue
 			}
+			appear = time.Now()
+
+			newB := make([]byte, n)
+			copy(newB, b[:n])
+			listenPool.Submit(uint64(hashString(fnvOffset, conn.RemoteAddr().String())), pcap.ClassBulk, n, pcap.ConnBytes{
+				Bytes:   newB,
+				Conn:    conn,
+				Destick: destick,
+				Defrag:  embDefrag,
+			})
 		}
+	}()
+}
 
-		// Create new transport layer
-		if embIndicator.TransportLayer() != nil {
-			switch t := embIndicator.TransportLayer().LayerType(); t {
-			case layers.LayerTypeTCP:
-				tcpLayer := embIndicator.TCPLayer()
-				temp := *tcpLayer
-				newTransportLayer = &temp
+// reload reloads the configuration file and applies options which can be changed without dropping clients and NAT.
+// Other options changed are reported and take effect after restarting.
+func reload(path string) error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
 
-				newTCPLayer := newTransportLayer.(*layers.TCP)
+	cfg, err := config.ParseFile(path, *argProfile)
+	if err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	_, err = config.ApplyEnv(cfg, nil)
+	if err != nil {
+		return fmt.Errorf("apply environment variables: %w", err)
+	}
 
-				newTCPLayer.SrcPort = layers.TCPPort(upValue)
-			case layers.LayerTypeUDP:
-				udpLayer := embIndicator.UDPLayer()
-				temp := *udpLayer
+	// Verify parameters
+	if cfg.NATConfig.UDP <= 0 {
+		return fmt.Errorf("nat udp timeout %d out of range", cfg.NATConfig.UDP)
+	}
+	if cfg.NATConfig.TCPEstablished <= 0 {
+		return fmt.Errorf("nat tcp established timeout %d out of range", cfg.NATConfig.TCPEstablished)
+	}
+	if cfg.NATConfig.TCPTransitory <= 0 {
+		return fmt.Errorf("nat tcp transitory timeout %d out of range", cfg.NATConfig.TCPTransitory)
+	}
+	if cfg.NATConfig.ICMP <= 0 {
+		return fmt.Errorf("nat icmp timeout %d out of range", cfg.NATConfig.ICMP)
+	}
+	if cfg.NATMax < 0 {
+		return fmt.Errorf("nat max entries %d out of range", cfg.NATMax)
+	}
+	newNATMode, err := parseNATType(cfg.NATType)
+	if err != nil {
+		return fmt.Errorf("parse nat type: %w", err)
+	}
+	var newFTPALG, newSIPALG bool
+	for _, alg := range cfg.ALG {
+		switch strings.ToLower(alg) {
+		case "ftp":
+			newFTPALG = true
+		case "sip":
+			newSIPALG = true
+		default:
+			return fmt.Errorf("alg %s not support", alg)
+		}
+		if isBridge {
+			return errors.New("alg not support with bridge")
+		}
+	}
+	newACL, err := addr.ParseACL(cfg.Allow, cfg.Deny, geo)
+	if err != nil {
+		return fmt.Errorf("parse acl: %w", err)
+	}
+	newLimiter, err := parseRateLimits(cfg.RateLimits)
+	if err != nil {
+		return fmt.Errorf("parse rate limits: %w", err)
+	}
+	if !newLimiter.IsEmpty() && isBridge {
+		return errors.New("rate limit not support with bridge")
+	}
+	var newKeyring *crypto.Keyring
+	if len(cfg.Clients) > 0 && keyring != nil {
+		newKeyring, err = crypto.ParseKeyring(cfg.Method, cfg.Clients)
+		if err != nil {
+			return fmt.Errorf("parse keyring: %w", err)
+		}
+	}
+
+	for _, key := range config.Diff(loaded, cfg) {
+		switch key {
+		case "verbose":
+			log.SetVerbose(cfg.Verbose || *argVerbose)
+		case "log":
+			err := log.SetLog(cfg.Log)
+			if err != nil {
+				return fmt.Errorf("set log %s: %w", cfg.Log, err)
+			}
+		case "log-format":
+			err := log.SetFormat(cfg.LogFormat)
+			if err != nil {
+				return fmt.Errorf("set log format %s: %w", cfg.LogFormat, err)
+			}
+		case "log-syslog":
+			err := log.SetSyslog(cfg.LogSyslog, name)
+			if err != nil {
+				return fmt.Errorf("set log syslog %s: %w", cfg.LogSyslog, err)
+			}
+		case "log-eventlog":
+			source := ""
+			if cfg.LogEventLog {
+				source = name
+			}
+			err := log.SetEventLog(source)
+			if err != nil {
+				return fmt.Errorf("set log event log: %w", err)
+			}
+		case "nat-timeouts":
+			natConfig = &cfg.NATConfig
+		case "nat-type":
+			natMode = newNATMode
+		case "nat-max-entries":
+			natLock.Lock()
+			natMax = cfg.NATMax
+			natLock.Unlock()
+		case "alg":
+			isFTPALG, isSIPALG = newFTPALG, newSIPALG
+		case "allow", "deny":
+			acl = newACL
+		case "rate-limits":
+			limiter = newLimiter
+		case "clients":
+			if newKeyring == nil {
+				log.Infof("Option %s changed, restart to apply\n", key)
+				continue
+			}
+			keyring = newKeyring
+			for _, listener := range listeners {
+				switch t := listener.(type) {
+				case *pcap.FakeTCPListener:
+					t.SetKeyring(keyring)
+				case *pcap.TCPListener:
+					t.SetKeyring(keyring)
+				}
+			}
+		default:
+			log.Infof("Option %s changed, restart to apply\n", key)
+			continue
+		}
+
+		log.Infof("Apply option %s\n", key)
+	}
+
+	// Options not applied are kept, so they are reported again until restarting
+	applied := *loaded
+	applied.Verbose, applied.Log, applied.LogFormat = cfg.Verbose, cfg.Log, cfg.LogFormat
+	applied.LogSyslog, applied.LogEventLog = cfg.LogSyslog, cfg.LogEventLog
+	applied.NATConfig, applied.NATType, applied.NATMax = cfg.NATConfig, cfg.NATType, cfg.NATMax
+	applied.ALG = cfg.ALG
+	applied.Allow, applied.Deny = cfg.Allow, cfg.Deny
+	applied.RateLimits = cfg.RateLimits
+	if newKeyring != nil {
+		applied.Clients = cfg.Clients
+	}
+	loaded = &applied
+
+	log.Infof("Reload configuration from %s\n", path)
+
+	return nil
+}
+
+// serveControl serves the control server on the path.
+func serveControl(path string) error {
+	var err error
+
+	controller, err = control.Listen(path)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	controller.Handle("status", func(args []string) (interface{}, error) {
+		clients := make([]string, 0)
+		connLock.Lock()
+		for client := range connected {
+			clients = append(clients, client)
+		}
+		connLock.Unlock()
+		sort.Strings(clients)
+
+		var memory interface{}
+		if memBudget != nil {
+			memory = memBudget
+		}
+		var shaping interface{}
+		if shaper != nil {
+			shaping = shaper
+		}
+		var drops interface{}
+		if !limiter.IsEmpty() {
+			drops = limiter.Drops()
+		}
+		var duplicates interface{}
+		if dedup.Drops() > 0 {
+			duplicates = dedup.Drops()
+		}
+		var fakeTCPDrops *pcap.FakeTCPDrops
+		for _, listener := range listeners {
+			t, ok := listener.(*pcap.FakeTCPListener)
+			if !ok {
+				continue
+			}
+			if fakeTCPDrops == nil {
+				fakeTCPDrops = &pcap.FakeTCPDrops{}
+			}
+			d := t.Drops()
+			fakeTCPDrops.Window = fakeTCPDrops.Window + d.Window
+			fakeTCPDrops.Pace = fakeTCPDrops.Pace + d.Pace
+		}
+
+		return &struct {
+			Name    string      `json:"name"`
+			Version string      `json:"version"`
+			Time    int         `json:"time"`
+			Clients []string    `json:"clients"`
+			NAT     interface{} `json:"nat"`
+			Queues  interface{} `json:"queues"`
+			Memory  interface{} `json:"memory,omitempty"`
+			Drops   interface{} `json:"rateDrops,omitempty"`
+			Shaper  interface{} `json:"shaper,omitempty"`
+			Dups    interface{} `json:"duplicateDrops,omitempty"`
+			FakeTCP interface{} `json:"fakeTCPDrops,omitempty"`
+		}{
+			Name:    name,
+			Version: versionInfo,
+			Time:    int(time.Now().Sub(startTime).Seconds()),
+			Clients: clients,
+			NAT:     natStatus(),
+			Queues:  queueStatus(),
+			Memory:  memory,
+			Drops:   drops,
+			Shaper:  shaping,
+			Dups:    duplicates,
+			FakeTCP: fakeTCPDrops,
+		}, nil
+	})
+	controller.Handle("reload", func(args []string) (interface{}, error) {
+		if *argConfig == "" {
+			return nil, errors.New("reload not support without configuration file")
+		}
+
+		return nil, reload(*argConfig)
+	})
+	controller.Handle("dump-nat", func(args []string) (interface{}, error) {
+		var client string
+		if len(args) > 0 {
+			client = args[0]
+		}
+
+		return dumpNAT(client), nil
+	})
+	controller.Handle("accounting", func(args []string) (interface{}, error) {
+		var client string
+		if len(args) > 0 {
+			client = args[0]
+		}
+
+		return dumpAccounting(client), nil
+	})
+	controller.Handle("disconnect-client", func(args []string) (interface{}, error) {
+		if len(args) <= 0 {
+			return nil, errors.New("missing client")
+		}
+
+		connLock.Lock()
+		disconnect, ok := connected[args[0]]
+		connLock.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("client %s not found", args[0])
+		}
+
+		disconnect()
+		log.Infof("Disconnect client %s by control\n", args[0])
+
+		return nil, nil
+	})
+	controller.Handle("set-log-level", func(args []string) (interface{}, error) {
+		if len(args) <= 0 {
+			return nil, errors.New("missing log level")
+		}
+
+		switch strings.ToLower(args[0]) {
+		case "info":
+			log.SetVerbose(false)
+		case "verbose":
+			log.SetVerbose(true)
+		default:
+			return nil, fmt.Errorf("log level %s not support", args[0])
+		}
+		log.Infof("Set log level to %s by control\n", strings.ToLower(args[0]))
+
+		return nil, nil
+	})
+
+	go func() {
+		err := controller.Serve()
+		if err != nil && !isClosed {
+			log.Errorln(fmt.Errorf("serve control: %w", err))
+		}
+	}()
+
+	return nil
+}
+
+// ctl sends the command in arguments to the control server, and prints the result.
+func ctl(args []string) error {
+	if len(args) <= 0 {
+		return errors.New("missing command")
+	}
+
+	path := *argControl
+	if path == "" && *argConfig != "" {
+		cfg, err := config.ParseFile(*argConfig, *argProfile)
+		if err != nil {
+			return fmt.Errorf("parse config file %s: %w", *argConfig, err)
+		}
+		path = cfg.Control
+	}
+	if path == "" {
+		return errors.New("missing control path")
+	}
+
+	result, err := control.Request(path, args[0], args[1:])
+	if err != nil {
+		return err
+	}
+	if len(result) <= 0 {
+		return nil
+	}
+
+	var b bytes.Buffer
+	err = json.Indent(&b, result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("indent: %w", err)
+	}
+	log.Infoln(b.String())
+
+	return nil
+}
+
+func closeAll() {
+	isClosed = true
+	if controller != nil {
+		controller.Close()
+	}
+	if natFile != "" {
+		err := saveNAT(natFile)
+		if err != nil {
+			log.Errorln(fmt.Errorf("save nat: %w", err))
+		}
+	}
+	if acctFile != "" {
+		err := saveAccounting(acctFile)
+		if err != nil {
+			log.Errorln(fmt.Errorf("save accounting: %w", err))
+		}
+	}
+	for _, handle := range listeners {
+		if handle != nil {
+			handle.Close()
+		}
+	}
+	if upConn != nil {
+		upConn.Close()
+	}
+	if relayConn != nil {
+		relayConn.Close()
+	}
+	if natListener != nil {
+		natListener.Close()
+	}
+	if dumper != nil {
+		dumper.Close()
+	}
+	err := tracing.Shutdown()
+	if err != nil {
+		log.Errorln(fmt.Errorf("shutdown tracing: %w", err))
+	}
+}
+
+func handleListen(ctx context.Context, contents []byte, conn net.Conn, destick *pcap.Desticker, embDefrag *pcap.EasyDefragmenter) error {
+	var (
+		contentss         [][]byte
+		newTransportLayer gopacket.Layer
+		newPayload        []byte
+		newNetworkLayer   gopacket.NetworkLayer
+		upIP              net.IP
+		newLinkLayerType  gopacket.LayerType
+		newLinkLayer      gopacket.Layer
+		fragment          int
+		datas             [][]byte
+		guide             pcap.NATGuide
+		ni                *natIndicator
+	)
+
+	// Empty payload
+	if len(contents) <= 0 {
+		// return errors.New("empty payload")
+		return nil
+	}
+
+	stages := tracing.NewStages(ctx)
+	defer stages.End()
+
+	// Duplicates in multipath, where the first copy wins
+	if id, seq, data, ok := pcap.DecodeDuplicate(contents); ok {
+		if !dedup.Accept(id, seq) {
+			log.Verbosef("Drop a duplicate %d from client %s\n", seq, conn.RemoteAddr())
+			return nil
+		}
+		contents = data
+	}
+
+	// Destick
+	stages.Next("parse")
+	contentss, err := destick.Append(contents)
+	if err != nil {
+		return fmt.Errorf("destick: %w", err)
+	}
+
+	// Bridge
+	if isBridge {
+		for _, frame := range contentss {
+			err := bridgeFrame(frame, conn)
+			if err != nil {
+				return fmt.Errorf("bridge: %w", err)
+			}
+		}
+
+		return nil
+	}
+
+	// TODO: Use flag instead of return when error occurred
+	// TODO: Merge desticker to pcap.TCPConn
+	for _, contents := range contentss {
+		// Parse embedded packet
+		stages.Next("parse")
+		embIndicator, err := pcap.ParseEmbPacket(contents)
+		if err != nil {
+			return fmt.Errorf("parse embedded packet: %w", err)
+		}
+
+		// Reassemble fragments before NAT, fragments are shed first under memory pressure
+		if embIndicator.IsFrag() && !memBudget.AllowFragment() {
+			log.Verbosef("Shed an inbound fragment under memory pressure: %s -> %s\n", embIndicator.SrcIP(), embIndicator.DstIP())
+			continue
+		}
+		embIndicator, err = embDefrag.Append(embIndicator)
+		if err != nil {
+			return fmt.Errorf("defrag: %w", err)
+		}
+		if embIndicator == nil {
+			continue
+		}
+
+		// ACL
+		if !acl.IsEmpty() && !acl.Allows(embIndicator.Dst()) {
+			log.Verbosef("Deny an inbound %s packet: %s -> %s\n", embIndicator.TransportProtocol(), embIndicator.Src(), embIndicator.Dst())
+			continue
+		}
+
+		// Rate limit
+		if !limiter.IsEmpty() && !limiter.Allow(accountName(conn.RemoteAddr()), stat.DirectionOut, uint(embIndicator.Size())) {
+			log.Verbosef("Drop an inbound %s packet over rate limit: %s -> %s\n", embIndicator.TransportProtocol(), embIndicator.Src(), embIndicator.Dst())
+			continue
+		}
+
+		// Distribute port/Id by source and client address and protocol
+		stages.Next("nat")
+		q := quintuple{
+			src:      embIndicator.NATSrc().String(),
+			dst:      conn.RemoteAddr().String(),
+			protocol: embIndicator.NATProtocol(),
+		}
+		if natMode == natSymmetric {
+			q.peer = embIndicator.NATDst().String()
+		}
+		upValue, ok := nat.pats.load(q)
+		if !ok && q.peer != "" {
+			// Expectations accept any destination
+			upValue, ok = nat.pats.load(quintuple{src: q.src, dst: q.dst, protocol: q.protocol})
+		}
+		if ok {
+			touchMapping(q.protocol, upValue, stat.DirectionOut, embIndicator.Size())
+		}
+		if !ok {
+			var err error
+
+			// if ICMPv4 error is not in NAT, drop it
+			if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv4 && !embIndicator.ICMPv4Indicator().IsQuery() {
+				return errors.New("missing nat")
+			}
+			// if ICMPv6 error is not in NAT, drop it
+			if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv6 && !embIndicator.ICMPv6Indicator().IsQuery() {
+				return errors.New("missing nat")
+			}
+
+			// New flows are shed under memory pressure
+			if !memBudget.AllowFlow() {
+				log.Verbosef("Shed an inbound %s flow under memory pressure: %s -> %s\n", embIndicator.TransportProtocol(), embIndicator.NATSrc(), embIndicator.NATDst())
+				continue
+			}
+
+			upValue, err = dist(embIndicator.TransportLayer().LayerType(), conn.RemoteAddr().String())
+			if err != nil {
+				return fmt.Errorf("distribute: %w", err)
+			}
+
+			natLock.Lock()
+			addMapping(q, upValue)
+			touchMapping(q.protocol, upValue, stat.DirectionOut, embIndicator.Size())
+			natLock.Unlock()
+		}
+
+		// Create new transport layer
+		stages.Next("serialize")
+		newPayload = embIndicator.Payload()
+		if embIndicator.TransportLayer() != nil {
+			switch t := embIndicator.TransportLayer().LayerType(); t {
+			case layers.LayerTypeTCP:
+				tcpLayer := embIndicator.TCPLayer()
+				temp := *tcpLayer
+				newTransportLayer = &temp
+
+				newTCPLayer := newTransportLayer.(*layers.TCP)
+
+				newTCPLayer.SrcPort = layers.TCPPort(upValue)
+			case layers.LayerTypeUDP:
+				udpLayer := embIndicator.UDPLayer()
+				temp := *udpLayer
 				newTransportLayer = &temp
 
 				newUDPLayer := newTransportLayer.(*layers.UDP)
@@ -775,7 +2523,7 @@ func handleListen(contents []byte, conn net.Conn, destick *pcap.Desticker) error
 					temp := *embIndicator.ICMPv4Indicator().EmbIPv4Layer()
 					newEmbIPv4Layer := &temp
 
-					newEmbIPv4Layer.DstIP = upConn.LocalDev().IPAddr().IP
+					newEmbIPv4Layer.DstIP = upConn.LocalDev().IPv4Addr().IP
 
 					var (
 						err                  error
@@ -824,6 +2572,69 @@ func handleListen(contents []byte, conn net.Conn, destick *pcap.Desticker) error
 					}
 
 					newICMPv4Layer.Payload = payload
+					newPayload = payload
+				}
+			case layers.LayerTypeICMPv6:
+				newTransportLayer = embIndicator.ICMPv6Indicator().NewPureICMPv6Layer()
+
+				if embIndicator.ICMPv6Indicator().IsQuery() {
+					newPayload = embIndicator.ICMPv6Indicator().NewBody(upValue)
+				} else {
+					if upConn.LocalDev().IPv6Addr() == nil {
+						return fmt.Errorf("missing ipv6 address in device %s", upConn.LocalDev().Alias())
+					}
+
+					newEmbIPv6Layer := embIndicator.ICMPv6Indicator().EmbIPv6Indicator().NewPureIPv6Layer()
+
+					newEmbIPv6Layer.DstIP = upConn.LocalDev().IPv6Addr().IP
+
+					var (
+						err                  error
+						newEmbTransportLayer gopacket.Layer
+						newEmbPayload        []byte
+					)
+
+					embTransportLayerType := embIndicator.ICMPv6Indicator().EmbTransportLayer().LayerType()
+					switch embTransportLayerType {
+					case layers.LayerTypeTCP:
+						temp := *embIndicator.ICMPv6Indicator().EmbTCPLayer()
+						newEmbTransportLayer = &temp
+
+						newEmbTCPLayer := newEmbTransportLayer.(*layers.TCP)
+
+						newEmbTCPLayer.DstPort = layers.TCPPort(upValue)
+						newEmbPayload = newEmbTCPLayer.Payload
+
+						err = newEmbTCPLayer.SetNetworkLayerForChecksum(newEmbIPv6Layer)
+					case layers.LayerTypeUDP:
+						temp := *embIndicator.ICMPv6Indicator().EmbUDPLayer()
+						newEmbTransportLayer = &temp
+
+						newEmbUDPLayer := newEmbTransportLayer.(*layers.UDP)
+
+						newEmbUDPLayer.DstPort = layers.UDPPort(upValue)
+						newEmbPayload = newEmbUDPLayer.Payload
+
+						err = newEmbUDPLayer.SetNetworkLayerForChecksum(newEmbIPv6Layer)
+					case layers.LayerTypeICMPv6:
+						newEmbICMPv6Layer := &layers.ICMPv6{TypeCode: embIndicator.ICMPv6Indicator().EmbICMPv6Layer().TypeCode}
+						newEmbTransportLayer = newEmbICMPv6Layer
+						newEmbPayload = embIndicator.ICMPv6Indicator().NewEmbBody(upValue)
+
+						err = newEmbICMPv6Layer.SetNetworkLayerForChecksum(newEmbIPv6Layer)
+					default:
+						return fmt.Errorf("create transport layer: %w", fmt.Errorf("transport layer type %s not support", embTransportLayerType))
+					}
+					if err != nil {
+						return fmt.Errorf("create transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
+					}
+
+					payload, err := pcap.Serialize(newEmbIPv6Layer, newEmbTransportLayer.(gopacket.SerializableLayer), gopacket.Payload(newEmbPayload))
+					if err != nil {
+						return fmt.Errorf("create transport layer: %w", fmt.Errorf("serialize: %w", err))
+					}
+
+					newPayload = append(append(make([]byte, 0), embIndicator.ICMPv6Indicator().ErrorHeader()...), payload...)
 				}
 			default:
 				return fmt.Errorf("transport layer type %s not support", t)
@@ -839,12 +2650,51 @@ func handleListen(contents []byte, conn net.Conn, destick *pcap.Desticker) error
 
 			newIPv4Layer := newNetworkLayer.(*layers.IPv4)
 
-			newIPv4Layer.SrcIP = upConn.LocalDev().IPAddr().IP
+			newIPv4Layer.SrcIP = upConn.LocalDev().IPv4Addr().IP
 			upIP = newIPv4Layer.SrcIP
-		default:
+		case layers.LayerTypeIPv6:
+			if upConn.LocalDev().IPv6Addr() == nil {
+				return fmt.Errorf("missing ipv6 address in device %s", upConn.LocalDev().Alias())
+			}
+
+			newNetworkLayer = embIndicator.IPv6Indicator().NewPureIPv6Layer()
+
+			newIPv6Layer := newNetworkLayer.(*layers.IPv6)
+
+			newIPv6Layer.SrcIP = upConn.LocalDev().IPv6Addr().IP
+			upIP = newIPv6Layer.SrcIP
+		default:
 			return fmt.Errorf("network layer type %s not support", t)
 		}
 
+		// FTP ALG
+		isALG := false
+		if isFTPALG && newTransportLayer != nil && newTransportLayer.LayerType() == layers.LayerTypeTCP {
+			newTCPLayer := newTransportLayer.(*layers.TCP)
+			if newTCPLayer.DstPort == pcap.FTPControlPort {
+				isALG = true
+				newPayload, err = handleFTP(newTCPLayer, newPayload, upIP, embIndicator, conn)
+				if err != nil {
+					return fmt.Errorf("ftp alg: %w", err)
+				}
+			}
+		}
+
+		// SIP ALG
+		if isSIPALG && newTransportLayer != nil && newTransportLayer.LayerType() == layers.LayerTypeUDP {
+			newUDPLayer := newTransportLayer.(*layers.UDP)
+			if newUDPLayer.DstPort == pcap.SIPPort {
+				isALG = true
+				src := embIndicator.NATSrc().(*net.UDPAddr)
+				newPayload, err = pcap.RewriteSIP(newPayload, src, &net.UDPAddr{IP: upIP, Port: int(upValue)}, func(a *net.UDPAddr) (*net.UDPAddr, error) {
+					return expectSIP(a, upIP, embIndicator, conn)
+				})
+				if err != nil {
+					return fmt.Errorf("sip alg: %w", err)
+				}
+			}
+		}
+
 		// Set network layer for transport layer
 		if newTransportLayer != nil {
 			switch t := newTransportLayer.LayerType(); t {
@@ -858,6 +2708,10 @@ func handleListen(contents []byte, conn net.Conn, destick *pcap.Desticker) error
 				err = udpLayer.SetNetworkLayerForChecksum(newNetworkLayer)
 			case layers.LayerTypeICMPv4:
 				break
+			case layers.LayerTypeICMPv6:
+				icmpv6Layer := newTransportLayer.(*layers.ICMPv6)
+
+				err = icmpv6Layer.SetNetworkLayerForChecksum(newNetworkLayer)
 			default:
 				return fmt.Errorf("transport layer type %s not support", t)
 			}
@@ -866,8 +2720,10 @@ func handleListen(contents []byte, conn net.Conn, destick *pcap.Desticker) error
 			}
 		}
 
-		// Decide Loopback or Ethernet
-		if upConn.IsLoop() {
+		// Decide TUN, Loopback or Ethernet
+		if upConn.IsTun() {
+			newLinkLayerType = gopacket.LayerTypeZero
+		} else if upConn.IsLoop() {
 			newLinkLayerType = layers.LayerTypeLoopback
 		} else {
 			newLinkLayerType = layers.LayerTypeEthernet
@@ -875,10 +2731,13 @@ func handleListen(contents []byte, conn net.Conn, destick *pcap.Desticker) error
 
 		// Create new link layer
 		switch newLinkLayerType {
+		case gopacket.LayerTypeZero:
+			// TUN devices have no link layer
+			newLinkLayer = nil
 		case layers.LayerTypeLoopback:
 			newLinkLayer = pcap.CreateLoopbackLayer()
 		case layers.LayerTypeEthernet:
-			newLinkLayer, err = pcap.CreateEthernetLayer(upConn.LocalDev().HardwareAddr(), upConn.RemoteDev().HardwareAddr(), newNetworkLayer)
+			newLinkLayer, err = pcap.CreateEthernetLayer(upConn.LocalDev().HardwareAddr(), upConn.RemoteDev().HardwareAddr(), upConn.RemoteDev().Encap(), newNetworkLayer)
 		default:
 			return fmt.Errorf("link layer type %s not support", newLinkLayerType)
 		}
@@ -886,28 +2745,77 @@ func handleListen(contents []byte, conn net.Conn, destick *pcap.Desticker) error
 			return fmt.Errorf("create link layer: %w", err)
 		}
 
-		// Serialize layers
-		if newTransportLayer == nil {
-			data, err = pcap.Serialize(newLinkLayer.(gopacket.SerializableLayer),
-				newNetworkLayer.(gopacket.SerializableLayer),
-				gopacket.Payload(embIndicator.Payload()))
+		// Hairpin TCP and UDP packets to mappings in NAT back to clients, like RFC 4787 REQ-9
+		isHairpin := false
+		if t := embIndicator.TransportLayer(); t != nil && (t.LayerType() == layers.LayerTypeTCP || t.LayerType() == layers.LayerTypeUDP) &&
+			embIndicator.DstIP().Equal(upIP) {
+			_, isHairpin = nat.guides.load(pcap.NATGuide{
+				Src:      embIndicator.NATDst().String(),
+				Protocol: embIndicator.NATProtocol(),
+			})
+		}
+
+		// Fragment if the packet exceeds the MTU, packets hairpinned are never fragmented
+		if embIndicator.DontFragment() || isHairpin {
+			fragment = pcap.IPv4MaxSize
 		} else {
-			data, err = pcap.Serialize(newLinkLayer.(gopacket.SerializableLayer),
-				newNetworkLayer.(gopacket.SerializableLayer),
-				newTransportLayer.(gopacket.SerializableLayer),
-				gopacket.Payload(embIndicator.Payload()))
+			fragment = mtu
 		}
-		if err != nil {
-			return fmt.Errorf("serialize: %w", err)
+
+		// Rewrite the source in place if only the address and the port change and the packet is not fragmented, where
+		// checksums are updated incrementally, and the IPv4 header checksum is skipped if the kernel fills it
+		datas = nil
+		if !isALG && embIndicator.IsRewritable() && embIndicator.MTU() <= fragment {
+			data, err := embIndicator.RewriteSrc(upIP, upValue, upConn.IsIPv4ChecksumOffload() && !isHairpin && relayConn == nil)
+			if err != nil {
+				return fmt.Errorf("rewrite: %w", err)
+			}
+			if newLinkLayer != nil {
+				data, err = pcap.Serialize(newLinkLayer.(gopacket.SerializableLayer), gopacket.Payload(data))
+				if err != nil {
+					return fmt.Errorf("serialize: %w", err)
+				}
+			}
+			datas = [][]byte{data}
+		}
+
+		// Serialize layers
+		if datas == nil {
+			datas, err = pcap.CreateFragmentPackets(newLinkLayer, newNetworkLayer, newTransportLayer, gopacket.Payload(newPayload), fragment)
+			if err != nil {
+				return fmt.Errorf("create fragments: %w", err)
+			}
 		}
 
 		// Write packet data
-		_, err = upConn.Write(data)
-		if err != nil {
-			return fmt.Errorf("write: %w", err)
+		stages.Next("inject")
+		for _, data := range datas {
+			if isHairpin {
+				log.Verbosef("Hairpin an inbound %s packet: %s -> %s\n", embIndicator.TransportProtocol(), embIndicator.Src(), embIndicator.Dst())
+
+				err = handleUpstream(ctx, upConn.Decode(data))
+				if err != nil {
+					return fmt.Errorf("hairpin: %w", err)
+				}
+				continue
+			}
+
+			if relayConn != nil {
+				err = relay(ctx, data)
+				if err != nil {
+					return fmt.Errorf("relay: %w", err)
+				}
+				continue
+			}
+
+			_, err = upConn.Write(data)
+			if err != nil {
+				return fmt.Errorf("write: %w", err)
+			}
 		}
 
 		// NAT
+		stages.Next("nat")
 		if embIndicator.TransportLayer() != nil {
 			// Record the source and the source device of the packet
 			var addNAT bool
@@ -943,29 +2851,54 @@ func handleListen(contents []byte, conn net.Conn, destick *pcap.Desticker) error
 					}
 					addNAT = true
 				}
+			case layers.LayerTypeICMPv6:
+				if embIndicator.ICMPv6Indicator().IsQuery() {
+					guide = pcap.NATGuide{
+						Src: addr.ICMPQueryAddr{
+							IP: upIP,
+							Id: upValue,
+						}.String(),
+						Protocol: t,
+					}
+					addNAT = true
+				}
 			default:
 				return fmt.Errorf("transport layer type %s not support", t)
 			}
 			if addNAT {
+				shard := nat.guides.shard(guide)
+				shard.lock.Lock()
+				// Keep destinations in the filter while the mapping belongs to the same source
+				filter := newNATFilter()
+				last, ok := shard.m[guide]
+				if ok && last.embSrc.String() == embIndicator.NATSrc().String() {
+					filter = last.filter
+				}
 				ni = &natIndicator{
 					src:    conn.RemoteAddr(),
 					embSrc: embIndicator.NATSrc(),
 					conn:   conn,
+					filter: filter,
+				}
+				shard.m[guide] = ni
+				shard.lock.Unlock()
+
+				if natMode != natFullCone {
+					ni.filter.add(natPeer(embIndicator.NATDst()), natTimeout(guide.Protocol))
 				}
-				natLock.Lock()
-				nat[guide] = ni
-				natLock.Unlock()
 			}
 
 			// Keep alive
 			protocol := embIndicator.NATProtocol()
 			switch protocol {
 			case layers.LayerTypeTCP:
-				tcpPortPool[convertFromPort(upValue)] = time.Now()
+				keepTCP(convertFromPort(upValue), embIndicator.TCPLayer())
 			case layers.LayerTypeUDP:
-				udpPortPool[convertFromPort(upValue)] = time.Now()
+				udpPortPool.store(convertFromPort(upValue), time.Now())
 			case layers.LayerTypeICMPv4:
-				icmpv4IdPool[upValue] = time.Now()
+				icmpv4IdPool.store(upValue, time.Now())
+			case layers.LayerTypeICMPv6:
+				icmpv6IdPool.store(upValue, time.Now())
 			default:
 				return fmt.Errorf("transport layer type %s not support", protocol)
 			}
@@ -975,6 +2908,7 @@ func handleListen(contents []byte, conn net.Conn, destick *pcap.Desticker) error
 		if monitor != nil {
 			monitor.Add(conn.RemoteAddr().String(), stat.DirectionOut, uint(embIndicator.Size()))
 		}
+		accounting.Add(conn.RemoteAddr().String(), stat.DirectionOut, uint(embIndicator.Size()))
 
 		log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (%d Bytes)\n",
 			embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), embIndicator.Size())
@@ -983,25 +2917,30 @@ func handleListen(contents []byte, conn net.Conn, destick *pcap.Desticker) error
 	return nil
 }
 
-func handleUpstream(packet gopacket.Packet) error {
+func handleUpstream(ctx context.Context, packet gopacket.Packet) error {
 	var (
-		err               error
-		indicator         *pcap.PacketIndicator
-		frags             []*pcap.PacketIndicator
-		ni                *natIndicator
-		embTransportLayer gopacket.Layer
-		embNetworkLayer   gopacket.NetworkLayer
-		data              []byte
+		err       error
+		indicator *pcap.PacketIndicator
+		ni        *natIndicator
+		data      []byte
 	)
 
+	stages := tracing.NewStages(ctx)
+	defer stages.End()
+
 	// Parse packet
+	stages.Next("parse")
 	indicator, err = pcap.ParsePacket(packet)
 	if err != nil {
 		return fmt.Errorf("parse packet: %w", err)
 	}
 
-	// Handle fragments
-	indicator, frags, err = defrag.AppendOriginal(indicator)
+	// Reassemble fragments before NAT, fragments are shed first under memory pressure
+	if indicator.IsFrag() && !memBudget.AllowFragment() {
+		log.Verbosef("Shed an outbound fragment under memory pressure: %s -> %s\n", indicator.SrcIP(), indicator.DstIP())
+		return nil
+	}
+	indicator, err = defrag.Append(indicator)
 	if err != nil {
 		return fmt.Errorf("defrag: %w", err)
 	}
@@ -1010,233 +2949,407 @@ func handleUpstream(packet gopacket.Packet) error {
 	}
 
 	// NAT
+	stages.Next("nat")
 	guide := pcap.NATGuide{
 		Src:      indicator.NATDst().String(),
-		Protocol: indicator.TransportLayer().LayerType(),
+		Protocol: indicator.NATProtocol(),
 	}
-	natLock.RLock()
-	ni, ok := nat[guide]
-	natLock.RUnlock()
+	ni, ok := nat.guides.load(guide)
 	if !ok {
 		return nil
 	}
 
+	// Filter
+	if natMode != natFullCone && !ni.filter.allow(natPeer(indicator.NATSrc()), natTimeout(guide.Protocol)) {
+		log.Verbosef("Filter an outbound %s packet: %s -> %s\n", indicator.TransportProtocol(), indicator.NATSrc(), indicator.NATDst())
+		return nil
+	}
+
+	// Rate limit
+	if !limiter.IsEmpty() && !limiter.Allow(accountName(ni.conn.RemoteAddr()), stat.DirectionIn, uint(indicator.MTU())) {
+		log.Verbosef("Drop an outbound %s packet over rate limit: %s -> %s\n", indicator.TransportProtocol(), indicator.NATSrc(), indicator.NATDst())
+		return nil
+	}
+
 	// Keep alive
 	protocol := indicator.NATProtocol()
+	var value uint16
 	switch protocol {
 	case layers.LayerTypeTCP:
-		tcpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
+		value = uint16(indicator.NATDst().(*net.TCPAddr).Port)
+		keepTCP(convertFromPort(value), indicator.TCPLayer())
 	case layers.LayerTypeUDP:
-		udpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
+		value = uint16(indicator.NATDst().(*net.UDPAddr).Port)
+		udpPortPool.store(convertFromPort(value), time.Now())
 	case layers.LayerTypeICMPv4:
-		icmpv4IdPool[indicator.ICMPv4Indicator().Id()] = time.Now()
+		value = indicator.NATDst().(*addr.ICMPQueryAddr).Id
+		icmpv4IdPool.store(value, time.Now())
+	case layers.LayerTypeICMPv6:
+		value = indicator.NATDst().(*addr.ICMPQueryAddr).Id
+		icmpv6IdPool.store(value, time.Now())
 	default:
 		return fmt.Errorf("transport layer type %s not support", protocol)
 	}
+	touchMapping(protocol, value, stat.DirectionIn, indicator.Size())
+
+	// Rewrite the destination in place if only the address and the port change, where checksums are updated
+	// incrementally
+	stages.Next("serialize")
+	if indicator.IsRewritable() && !isUpstreamALG(indicator) {
+		var port uint16
+		switch t := ni.embSrc.(type) {
+		case *net.TCPAddr:
+			port = uint16(t.Port)
+		case *net.UDPAddr:
+			port = uint16(t.Port)
+		}
+		data, err = indicator.RewriteDst(ni.embSrcIP(), port, false)
+	} else {
+		data, err = serializeUpstream(indicator, ni)
+	}
+	if err != nil {
+		return err
+	}
 
-	for _, frag := range frags {
-		// Create embedded transport layer
-		if frag.TransportLayer() != nil {
-			switch t := frag.TransportLayer().LayerType(); t {
-			case layers.LayerTypeTCP:
-				embTCPLayer := frag.TCPLayer()
-				temp := *embTCPLayer
-				embTransportLayer = &temp
+	// Shape
+	if !shaper.Wait(len(data), classifier.Classify(packet) < pcap.ClassBulk) {
+		log.Verbosef("Drop an outbound %s packet over shaping rate: %s -> %s\n", indicator.TransportProtocol(), indicator.NATSrc(), indicator.NATDst())
+		return nil
+	}
 
-				newEmbTCPLayer := embTransportLayer.(*layers.TCP)
+	// Write packet data, which is encrypted in the connection
+	stages.End()
+	_, err = pcap.WriteContext(ctx, ni.conn, data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
 
-				newEmbTCPLayer.DstPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
-			case layers.LayerTypeUDP:
-				embUDPLayer := frag.UDPLayer()
-				temp := *embUDPLayer
-				embTransportLayer = &temp
+	// Statistics
+	size := indicator.MTU()
+	if monitor != nil {
+		monitor.Add(ni.conn.RemoteAddr().String(), stat.DirectionIn, uint(size))
+	}
+	accounting.Add(ni.conn.RemoteAddr().String(), stat.DirectionIn, uint(size))
 
-				newEmbUDPLayer := embTransportLayer.(*layers.UDP)
+	log.Verbosef("Redirect an outbound %s packet: %s <- %s <- %s (%d Bytes)\n",
+		indicator.TransportProtocol(), ni.embSrc.String(), ni.src.String(), indicator.Src(), size)
 
-				newEmbUDPLayer.DstPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
-			case layers.LayerTypeICMPv4:
-				if frag.ICMPv4Indicator().IsQuery() {
-					embICMPv4Layer := frag.ICMPv4Indicator().ICMPv4Layer()
-					temp := *embICMPv4Layer
-					embTransportLayer = &temp
+	// Record DNS
+	if indicator.DNSIndicator() != nil {
+		if indicator.DNSIndicator().IsResponse() {
+			name, ips := indicator.DNSIndicator().Answers()
+			if name != "" && len(ips) > 0 {
+				dnsLock.Lock()
+				for _, ip := range ips {
+					dns[ip.String()] = name
+					log.Verbosef("Record DNS record %s = %s\n", name, ip)
+				}
+				dnsLock.Unlock()
+			}
+		}
+	}
 
-					newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
+	return nil
+}
 
-					newEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
-				} else {
-					embTransportLayer = frag.ICMPv4Indicator().NewPureICMPv4Layer()
+// isUpstreamALG returns if the packet from upstream is handled by ALGs, whose payload or sequence may change.
+func isUpstreamALG(indicator *pcap.PacketIndicator) bool {
+	switch indicator.TransportProtocol() {
+	case layers.LayerTypeTCP:
+		return isFTPALG && indicator.SrcPort() == pcap.FTPControlPort
+	case layers.LayerTypeUDP:
+		return isSIPALG && indicator.SrcPort() == pcap.SIPPort
+	default:
+		return false
+	}
+}
 
-					newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
+// serializeUpstream returns the embedded packet of the packet from upstream to the client in NAT, which is serialized
+// from layers created again.
+func serializeUpstream(indicator *pcap.PacketIndicator, ni *natIndicator) ([]byte, error) {
+	var (
+		err               error
+		embTransportLayer gopacket.Layer
+		embPayload        []byte
+		embNetworkLayer   gopacket.NetworkLayer
+		data              []byte
+	)
 
-					temp := *frag.ICMPv4Indicator().EmbIPv4Layer()
-					newEmbEmbIPv4Layer := &temp
+	// Create embedded transport layer
+	embPayload = indicator.Payload()
+	if indicator.TransportLayer() != nil {
+		switch t := indicator.TransportLayer().LayerType(); t {
+		case layers.LayerTypeTCP:
+			embTCPLayer := indicator.TCPLayer()
+			temp := *embTCPLayer
+			embTransportLayer = &temp
+
+			newEmbTCPLayer := embTransportLayer.(*layers.TCP)
+
+			newEmbTCPLayer.DstPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
+
+			// FTP ALG
+			if isFTPALG && newEmbTCPLayer.SrcPort == pcap.FTPControlPort && newEmbTCPLayer.ACK {
+				natLock.RLock()
+				session, ok := ftpSessions[convertFromPort(uint16(indicator.NATDst().(*net.TCPAddr).Port))]
+				natLock.RUnlock()
+				if ok {
+					newEmbTCPLayer.Ack = session.Inbound(newEmbTCPLayer.Ack)
+				}
+			}
+		case layers.LayerTypeUDP:
+			embUDPLayer := indicator.UDPLayer()
+			temp := *embUDPLayer
+			embTransportLayer = &temp
 
-					newEmbEmbIPv4Layer.SrcIP = ni.embSrcIP()
+			newEmbUDPLayer := embTransportLayer.(*layers.UDP)
 
-					var (
-						err                     error
-						newEmbEmbTransportLayer gopacket.Layer
-					)
+			newEmbUDPLayer.DstPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
 
-					switch t := frag.ICMPv4Indicator().EmbTransportLayer().LayerType(); t {
-					case layers.LayerTypeTCP:
-						temp := *frag.ICMPv4Indicator().EmbTCPLayer()
-						newEmbEmbTransportLayer = &temp
+			// SIP ALG
+			if isSIPALG && newEmbUDPLayer.SrcPort == pcap.SIPPort {
+				embPayload = pcap.RestoreSIP(embPayload, indicator.NATDst().(*net.UDPAddr), ni.embSrc.(*net.UDPAddr))
+			}
+		case layers.LayerTypeICMPv4:
+			if indicator.ICMPv4Indicator().IsQuery() {
+				embICMPv4Layer := indicator.ICMPv4Indicator().ICMPv4Layer()
+				temp := *embICMPv4Layer
+				embTransportLayer = &temp
 
-						newEmbEmbTCPLayer := newEmbEmbTransportLayer.(*layers.TCP)
+				newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
 
-						newEmbEmbTCPLayer.SrcPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
+				newEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
+			} else {
+				embTransportLayer = indicator.ICMPv4Indicator().NewPureICMPv4Layer()
 
-						err = newEmbEmbTCPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
-					case layers.LayerTypeUDP:
-						temp := *frag.ICMPv4Indicator().EmbUDPLayer()
-						newEmbEmbTransportLayer = &temp
+				newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
 
-						newEmbEmbUDPLayer := newEmbEmbTransportLayer.(*layers.UDP)
+				temp := *indicator.ICMPv4Indicator().EmbIPv4Layer()
+				newEmbEmbIPv4Layer := &temp
 
-						newEmbEmbUDPLayer.SrcPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
+				newEmbEmbIPv4Layer.SrcIP = ni.embSrcIP()
 
-						err = newEmbEmbUDPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
-					case layers.LayerTypeICMPv4:
-						temp := *frag.ICMPv4Indicator().EmbICMPv4Layer()
-						newEmbEmbTransportLayer = &temp
+				var (
+					err                     error
+					newEmbEmbTransportLayer gopacket.Layer
+				)
 
-						if frag.ICMPv4Indicator().IsEmbQuery() {
-							newEmbEmbICMPv4Layer := newEmbEmbTransportLayer.(*layers.ICMPv4)
+				switch t := indicator.ICMPv4Indicator().EmbTransportLayer().LayerType(); t {
+				case layers.LayerTypeTCP:
+					temp := *indicator.ICMPv4Indicator().EmbTCPLayer()
+					newEmbEmbTransportLayer = &temp
 
-							newEmbEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
-						}
-					default:
-						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("transport layer type %s not support", t))
-					}
-					if err != nil {
-						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
-					}
+					newEmbEmbTCPLayer := newEmbEmbTransportLayer.(*layers.TCP)
 
-					payload, err := pcap.Serialize(newEmbEmbIPv4Layer, newEmbEmbTransportLayer.(gopacket.SerializableLayer))
-					if err != nil {
-						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("serialize: %w", err))
+					newEmbEmbTCPLayer.SrcPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
+
+					err = newEmbEmbTCPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
+				case layers.LayerTypeUDP:
+					temp := *indicator.ICMPv4Indicator().EmbUDPLayer()
+					newEmbEmbTransportLayer = &temp
+
+					newEmbEmbUDPLayer := newEmbEmbTransportLayer.(*layers.UDP)
+
+					newEmbEmbUDPLayer.SrcPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
+
+					err = newEmbEmbUDPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
+				case layers.LayerTypeICMPv4:
+					temp := *indicator.ICMPv4Indicator().EmbICMPv4Layer()
+					newEmbEmbTransportLayer = &temp
+
+					if indicator.ICMPv4Indicator().IsEmbQuery() {
+						newEmbEmbICMPv4Layer := newEmbEmbTransportLayer.(*layers.ICMPv4)
+
+						newEmbEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
 					}
+				default:
+					return nil, fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("transport layer type %s not support", t))
+				}
+				if err != nil {
+					return nil, fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
+				}
 
-					newEmbICMPv4Layer.Payload = payload
+				payload, err := pcap.Serialize(newEmbEmbIPv4Layer, newEmbEmbTransportLayer.(gopacket.SerializableLayer))
+				if err != nil {
+					return nil, fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("serialize: %w", err))
 				}
-			default:
-				return fmt.Errorf("embedded transport layer type %s not support", t)
+
+				newEmbICMPv4Layer.Payload = payload
+				embPayload = payload
 			}
-		}
+		case layers.LayerTypeICMPv6:
+			embTransportLayer = indicator.ICMPv6Indicator().NewPureICMPv6Layer()
 
-		// Create embedded network layer
-		switch t := frag.NetworkLayer().LayerType(); t {
-		case layers.LayerTypeIPv4:
-			embIPv4Layer := frag.IPv4Layer()
-			temp := *embIPv4Layer
-			embNetworkLayer = &temp
+			if indicator.ICMPv6Indicator().IsQuery() {
+				embPayload = indicator.ICMPv6Indicator().NewBody(ni.embSrc.(*addr.ICMPQueryAddr).Id)
+			} else {
+				newEmbEmbIPv6Layer := indicator.ICMPv6Indicator().EmbIPv6Indicator().NewPureIPv6Layer()
 
-			newEmbIPv4Layer := embNetworkLayer.(*layers.IPv4)
+				newEmbEmbIPv6Layer.SrcIP = ni.embSrcIP()
 
-			newEmbIPv4Layer.DstIP = ni.embSrcIP()
-		default:
-			return fmt.Errorf("embedded network layer type %s not support", t)
-		}
+				var (
+					err                     error
+					newEmbEmbTransportLayer gopacket.Layer
+					newEmbEmbPayload        []byte
+				)
 
-		// Set network layer for transport layer
-		if embTransportLayer != nil {
-			switch t := embTransportLayer.LayerType(); t {
-			case layers.LayerTypeTCP:
-				embTCPLayer := embTransportLayer.(*layers.TCP)
+				switch t := indicator.ICMPv6Indicator().EmbTransportLayer().LayerType(); t {
+				case layers.LayerTypeTCP:
+					temp := *indicator.ICMPv6Indicator().EmbTCPLayer()
+					newEmbEmbTransportLayer = &temp
 
-				err = embTCPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
-			case layers.LayerTypeUDP:
-				embUDPLayer := embTransportLayer.(*layers.UDP)
+					newEmbEmbTCPLayer := newEmbEmbTransportLayer.(*layers.TCP)
 
-				err = embUDPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
-			case layers.LayerTypeICMPv4:
-				break
-			default:
-				return fmt.Errorf("embedded transport layer type %s not support", t)
-			}
-			if err != nil {
-				return fmt.Errorf("set embedded network layer for checksum: %w", err)
+					newEmbEmbTCPLayer.SrcPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
+					newEmbEmbPayload = newEmbEmbTCPLayer.Payload
+
+					err = newEmbEmbTCPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv6Layer)
+				case layers.LayerTypeUDP:
+					temp := *indicator.ICMPv6Indicator().EmbUDPLayer()
+					newEmbEmbTransportLayer = &temp
+
+					newEmbEmbUDPLayer := newEmbEmbTransportLayer.(*layers.UDP)
+
+					newEmbEmbUDPLayer.SrcPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
+					newEmbEmbPayload = newEmbEmbUDPLayer.Payload
+
+					err = newEmbEmbUDPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv6Layer)
+				case layers.LayerTypeICMPv6:
+					newEmbEmbICMPv6Layer := &layers.ICMPv6{TypeCode: indicator.ICMPv6Indicator().EmbICMPv6Layer().TypeCode}
+					newEmbEmbTransportLayer = newEmbEmbICMPv6Layer
+					newEmbEmbPayload = indicator.ICMPv6Indicator().NewEmbBody(ni.embSrc.(*addr.ICMPQueryAddr).Id)
+
+					err = newEmbEmbICMPv6Layer.SetNetworkLayerForChecksum(newEmbEmbIPv6Layer)
+				default:
+					return nil, fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("transport layer type %s not support", t))
+				}
+				if err != nil {
+					return nil, fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
+				}
+
+				payload, err := pcap.Serialize(newEmbEmbIPv6Layer, newEmbEmbTransportLayer.(gopacket.SerializableLayer), gopacket.Payload(newEmbEmbPayload))
+				if err != nil {
+					return nil, fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("serialize: %w", err))
+				}
+
+				embPayload = append(append(make([]byte, 0), indicator.ICMPv6Indicator().ErrorHeader()...), payload...)
 			}
+		default:
+			return nil, fmt.Errorf("embedded transport layer type %s not support", t)
 		}
+	}
 
-		// Serialize layers
-		if embTransportLayer == nil {
-			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
-				gopacket.Payload(frag.Payload()))
-		} else {
-			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
-				embTransportLayer.(gopacket.SerializableLayer),
-				gopacket.Payload(frag.Payload()))
-		}
-		if err != nil {
-			return fmt.Errorf("serialize: %w", err)
-		}
+	// Create embedded network layer
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		embIPv4Layer := indicator.IPv4Layer()
+		temp := *embIPv4Layer
+		embNetworkLayer = &temp
 
-		// Write packet data
-		_, err = ni.conn.Write(data)
-		if err != nil {
-			return fmt.Errorf("write: %w", err)
-		}
+		newEmbIPv4Layer := embNetworkLayer.(*layers.IPv4)
 
-		// Statistics
-		size := frag.MTU()
-		if monitor != nil {
-			monitor.Add(ni.conn.RemoteAddr().String(), stat.DirectionIn, uint(size))
-		}
+		newEmbIPv4Layer.DstIP = ni.embSrcIP()
+	case layers.LayerTypeIPv6:
+		embNetworkLayer = indicator.IPv6Indicator().NewPureIPv6Layer()
 
-		log.Verbosef("Redirect an outbound %s packet: %s <- %s <- %s (%d Bytes)\n",
-			frag.TransportProtocol(), ni.embSrc.String(), ni.src.String(), frag.Src(), size)
+		newEmbIPv6Layer := embNetworkLayer.(*layers.IPv6)
+
+		newEmbIPv6Layer.DstIP = ni.embSrcIP()
+	default:
+		return nil, fmt.Errorf("embedded network layer type %s not support", t)
 	}
 
-	// Record DNS
-	if indicator.DNSIndicator() != nil {
-		if indicator.DNSIndicator().IsResponse() {
-			name, ips := indicator.DNSIndicator().Answers()
-			if name != "" && len(ips) > 0 {
-				dnsLock.Lock()
-				for _, ip := range ips {
-					dns[ip.String()] = name
-					log.Verbosef("Record DNS record %s = %s\n", name, ip)
-				}
-				dnsLock.Unlock()
-			}
+	// Set network layer for transport layer
+	if embTransportLayer != nil {
+		switch t := embTransportLayer.LayerType(); t {
+		case layers.LayerTypeTCP:
+			embTCPLayer := embTransportLayer.(*layers.TCP)
+
+			err = embTCPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
+		case layers.LayerTypeUDP:
+			embUDPLayer := embTransportLayer.(*layers.UDP)
+
+			err = embUDPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
+		case layers.LayerTypeICMPv4:
+			break
+		case layers.LayerTypeICMPv6:
+			embICMPv6Layer := embTransportLayer.(*layers.ICMPv6)
+
+			err = embICMPv6Layer.SetNetworkLayerForChecksum(embNetworkLayer)
+		default:
+			return nil, fmt.Errorf("embedded transport layer type %s not support", t)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("set embedded network layer for checksum: %w", err)
 		}
 	}
 
-	return nil
+	// Serialize layers
+	if embTransportLayer == nil {
+		data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
+			gopacket.Payload(indicator.Payload()))
+	} else {
+		data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
+			embTransportLayer.(gopacket.SerializableLayer),
+			gopacket.Payload(embPayload))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	return data, nil
 }
 
-func dist(t gopacket.LayerType) (uint16, error) {
+// dist distributes a port or an ID of the protocol to the client. Ports are distributed in the block of the client if
+// port blocks are enabled.
+func dist(t gopacket.LayerType, client string) (uint16, error) {
+	// Workers distribute in turn
+	distLock.Lock()
+	defer distLock.Unlock()
+
 	now := time.Now()
 
+	// Block
+	start, size := 0, 16384
+	if portBlock > 0 && (t == layers.LayerTypeTCP || t == layers.LayerTypeUDP) {
+		b, err := clientBlock(client)
+		if err != nil {
+			return 0, fmt.Errorf("distribute block: %w", err)
+		}
+		start, size = b*portBlock, portBlock
+	}
+
 	switch t {
 	case layers.LayerTypeTCP:
-		for i := 0; i < 16384; i++ {
-			s := nextTCPPort % 16384
+		for i := 0; i < size; i++ {
+			s := uint16(start + int(nextTCPPort)%size)
 
 			// Point to next port
 			nextTCPPort++
 
 			// Check if the port is alive
-			last := tcpPortPool[s]
-			if now.Sub(last) > keepAlive {
+			last := tcpPortPool.load(s)
+			if isTCPExpired(s, now) {
 				if !last.IsZero() {
 					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
 				}
+				tcpPortState.store(s, natTCPOpening)
+				natLock.Lock()
+				delete(ftpSessions, s)
+				natLock.Unlock()
 				return 49152 + s, nil
 			}
 		}
 	case layers.LayerTypeUDP:
-		for i := 0; i < 16384; i++ {
-			s := nextUDPPort % 16384
+		for i := 0; i < size; i++ {
+			s := uint16(start + int(nextUDPPort)%size)
 
 			// Point to next port
 			nextUDPPort++
 
 			// Check if the port is alive
-			last := udpPortPool[s]
-			if now.Sub(last) > keepAlive {
+			last := udpPortPool.load(s)
+			if now.Sub(last) > time.Duration(natConfig.UDP)*time.Second {
 				if !last.IsZero() {
 					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
 				}
@@ -1251,8 +3364,24 @@ func dist(t gopacket.LayerType) (uint16, error) {
 			nextICMPv4Id++
 
 			// Check if the Id is alive
-			last := icmpv4IdPool[s]
-			if now.Sub(last) > keepAlive {
+			last := icmpv4IdPool.load(s)
+			if now.Sub(last) > time.Duration(natConfig.ICMP)*time.Second {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s ID %d\n", t, s)
+				}
+				return s, nil
+			}
+		}
+	case layers.LayerTypeICMPv6:
+		for i := 0; i < 65536; i++ {
+			s := nextICMPv6Id
+
+			// Point to next Id
+			nextICMPv6Id++
+
+			// Check if the Id is alive
+			last := icmpv6IdPool.load(s)
+			if now.Sub(last) > time.Duration(natConfig.ICMP)*time.Second {
 				if !last.IsZero() {
 					log.Verbosef("Recycle %s ID %d\n", t, s)
 				}
@@ -1263,11 +3392,1355 @@ func dist(t gopacket.LayerType) (uint16, error) {
 		return 0, fmt.Errorf("transport layer type %s not support", t)
 	}
 
+	if portBlock > 0 && (t == layers.LayerTypeTCP || t == layers.LayerTypeUDP) {
+		blockLock.Lock()
+		exhaustions[client]++
+		blockLock.Unlock()
+
+		return 0, fmt.Errorf("%s pool of client %s empty", t, client)
+	}
+
 	return 0, fmt.Errorf("%s pool empty", t)
 }
 
-func convertFromPort(port uint16) uint16 {
-	return port - 49152
+// clientBlock returns the block of ports of the client. The block is decided by the hash of the client, and the next
+// block is used if it is taken by another client alive.
+func clientBlock(client string) (int, error) {
+	blockLock.Lock()
+	defer blockLock.Unlock()
+
+	b, ok := blockClients[client]
+	if ok {
+		return b, nil
+	}
+
+	n := 16384 / portBlock
+	h := fnv.New32a()
+	h.Write([]byte(client))
+	first := int(h.Sum32() % uint32(n))
+
+	for i := 0; i < n; i++ {
+		b := (first + i) % n
+
+		owner := blockOwners[b]
+		if owner != "" && isBlockAlive(b) {
+			continue
+		}
+		if owner != "" {
+			delete(blockClients, owner)
+			delete(exhaustions, owner)
+			log.Verbosef("Recycle ports %d-%d of client %s\n", 49152+b*portBlock, 49152+(b+1)*portBlock-1, owner)
+		}
+
+		blockOwners[b] = client
+		blockClients[client] = b
+		log.Infof("Distribute ports %d-%d to client %s\n", 49152+b*portBlock, 49152+(b+1)*portBlock-1, client)
+
+		return b, nil
+	}
+
+	return 0, errors.New("blocks empty")
+}
+
+// isBlockAlive returns if any TCP or UDP port in the block is alive.
+func isBlockAlive(b int) bool {
+	now := time.Now()
+
+	for s := b * portBlock; s < (b+1)*portBlock; s++ {
+		if !isTCPExpired(uint16(s), now) || now.Sub(udpPortPool.load(uint16(s))) <= time.Duration(natConfig.UDP)*time.Second {
+			return true
+		}
+	}
+
+	return false
+}
+
+// blockStatus returns blocks of ports of clients and how many times they are exhausted.
+func blockStatus() interface{} {
+	type clientStatus struct {
+		Client      string `json:"client"`
+		Ports       string `json:"ports"`
+		Exhaustions uint64 `json:"exhaustions"`
+	}
+
+	blockLock.Lock()
+	defer blockLock.Unlock()
+
+	result := make([]clientStatus, 0)
+	for b, client := range blockOwners {
+		if client == "" {
+			continue
+		}
+		result = append(result, clientStatus{
+			Client:      client,
+			Ports:       fmt.Sprintf("%d-%d", 49152+b*portBlock, 49152+(b+1)*portBlock-1),
+			Exhaustions: exhaustions[client],
+		})
+	}
+
+	return result
+}
+
+// keepTCP refreshes the TCP port in NAT by a segment from either side, which also moves its state.
+func keepTCP(s uint16, layer *layers.TCP) {
+	tcpPortPool.store(s, time.Now())
+
+	// ICMP errors referring to the port carry no TCP layer
+	if layer == nil {
+		return
+	}
+
+	switch {
+	case layer.RST || layer.FIN:
+		tcpPortState.store(s, natTCPClosing)
+	case layer.SYN:
+		tcpPortState.store(s, natTCPOpening)
+	case layer.ACK:
+		tcpPortState.transit(s, natTCPOpening, natTCPEstablished)
+	}
+}
+
+// isTCPExpired returns if the TCP port in NAT is idle for longer than the timeout of its state.
+func isTCPExpired(s uint16, now time.Time) bool {
+	timeout := natConfig.TCPTransitory
+	if tcpPortState.load(s) == natTCPEstablished {
+		timeout = natConfig.TCPEstablished
+	}
+
+	return now.Sub(tcpPortPool.load(s)) > time.Duration(timeout)*time.Second
+}
+
+// handleFTP rewrites a segment of an FTP control connection from a client, and returns the new payload.
+func handleFTP(layer *layers.TCP, payload []byte, upIP net.IP, embIndicator *pcap.PacketIndicator, conn net.Conn) ([]byte, error) {
+	s := convertFromPort(uint16(layer.SrcPort))
+
+	natLock.Lock()
+	session, ok := ftpSessions[s]
+	if !ok || layer.SYN {
+		session = pcap.NewFTPSession()
+		ftpSessions[s] = session
+	}
+	natLock.Unlock()
+
+	seq, payload, err := session.Outbound(layer.Seq, payload, func(a *net.TCPAddr) (*net.TCPAddr, error) {
+		return expectFTP(a, upIP, embIndicator, conn)
+	})
+	if err != nil {
+		return nil, err
+	}
+	layer.Seq = seq
+
+	return payload, nil
+}
+
+// expectFTP opens a mapping in NAT for the active data connection from the FTP server to the address of the client,
+// and returns the address in NAT.
+func expectFTP(a *net.TCPAddr, upIP net.IP, embIndicator *pcap.PacketIndicator, conn net.Conn) (*net.TCPAddr, error) {
+	// Data connections to other hosts are not allowed, like FTP bounce attacks
+	if !a.IP.Equal(embIndicator.SrcIP()) {
+		return nil, fmt.Errorf("address %s mismatch with source %s", a.IP, embIndicator.SrcIP())
+	}
+
+	peer := &net.TCPAddr{IP: embIndicator.DstIP(), Port: pcap.FTPDataPort}
+
+	upValue, err := expectNAT(a, peer, upIP, conn)
+	if err != nil {
+		return nil, err
+	}
+	upAddr := &net.TCPAddr{IP: upIP, Port: int(upValue)}
+
+	log.Verbosef("Expect an FTP data connection: %s -> %s -> %s\n", peer, upAddr, a)
+
+	return upAddr, nil
+}
+
+// expectSIP opens a mapping in NAT for the RTP or RTCP stream to the address of the client, and returns the address in
+// NAT.
+func expectSIP(a *net.UDPAddr, upIP net.IP, embIndicator *pcap.PacketIndicator, conn net.Conn) (*net.UDPAddr, error) {
+	if !a.IP.Equal(embIndicator.SrcIP()) {
+		return nil, fmt.Errorf("address %s mismatch with source %s", a.IP, embIndicator.SrcIP())
+	}
+
+	upValue, err := expectNAT(a, nil, upIP, conn)
+	if err != nil {
+		return nil, err
+	}
+	upAddr := &net.UDPAddr{IP: upIP, Port: int(upValue)}
+
+	log.Verbosef("Expect an RTP stream: %s -> %s\n", upAddr, a)
+
+	return upAddr, nil
+}
+
+// expectNAT opens a mapping in NAT to the address of the client for connections from the peer before the client sends
+// any packet, and returns the port distributed. Connections from any peer are accepted if the peer is nil.
+func expectNAT(a net.Addr, peer net.Addr, upIP net.IP, conn net.Conn) (uint16, error) {
+	var (
+		err      error
+		protocol gopacket.LayerType
+	)
+
+	switch a.(type) {
+	case *net.TCPAddr:
+		protocol = layers.LayerTypeTCP
+	case *net.UDPAddr:
+		protocol = layers.LayerTypeUDP
+	default:
+		return 0, fmt.Errorf("type %T not support", a)
+	}
+
+	// Distribute port
+	q := quintuple{
+		src:      a.String(),
+		dst:      conn.RemoteAddr().String(),
+		protocol: protocol,
+	}
+	if natMode == natSymmetric && peer != nil {
+		q.peer = peer.String()
+	}
+	upValue, ok := nat.pats.load(q)
+	if !ok {
+		upValue, err = dist(protocol, conn.RemoteAddr().String())
+		if err != nil {
+			return 0, fmt.Errorf("distribute: %w", err)
+		}
+
+		natLock.Lock()
+		addMapping(q, upValue)
+		natLock.Unlock()
+	}
+
+	// Keep alive
+	switch protocol {
+	case layers.LayerTypeTCP:
+		keepTCP(convertFromPort(upValue), nil)
+	case layers.LayerTypeUDP:
+		udpPortPool.store(convertFromPort(upValue), time.Now())
+	}
+
+	// NAT
+	var upAddr net.Addr
+	switch protocol {
+	case layers.LayerTypeTCP:
+		upAddr = &net.TCPAddr{IP: upIP, Port: int(upValue)}
+	case layers.LayerTypeUDP:
+		upAddr = &net.UDPAddr{IP: upIP, Port: int(upValue)}
+	}
+	ni := &natIndicator{
+		src:    conn.RemoteAddr(),
+		embSrc: a,
+		conn:   conn,
+		filter: newNATFilter(),
+	}
+	if peer == nil {
+		ni.filter.isOpen = true
+	}
+	nat.guides.store(pcap.NATGuide{Src: upAddr.String(), Protocol: protocol}, ni)
+	if natMode != natFullCone && peer != nil {
+		ni.filter.add(natPeer(peer), natTimeout(protocol))
+	}
+
+	return upValue, nil
+}
+
+// addMapping adds the mapping to the port or the ID in NAT, which replaces the stale mapping recycled, and evicts the
+// least recently used mapping if NAT is full. It must be called with natLock held.
+func addMapping(q quintuple, value uint16) {
+	slot := natSlot{protocol: q.protocol, value: value}
+
+	// Stale mapping of the port or the ID recycled
+	e, ok := nat.owners.load(slot)
+	if ok {
+		nat.pats.delete(e.Value.(*natEntry).q)
+		nat.owners.delete(slot)
+		natLRU.Remove(e)
+	}
+
+	// Evict, mappings used since they are moved get a second chance, which approximates LRU without moving mappings
+	// in every packet
+	for natMax > 0 && natLRU.Len() >= natMax {
+		back := natLRU.Back()
+		if atomic.CompareAndSwapInt32(&back.Value.(*natEntry).touched, 1, 0) {
+			natLRU.MoveToFront(back)
+			continue
+		}
+		evictMapping(back)
+	}
+
+	nat.pats.store(q, value)
+	nat.owners.store(slot, natLRU.PushFront(&natEntry{q: q, slot: slot}))
+}
+
+// touchMapping marks the mapping to the port or the ID in NAT used recently by a packet in the direction. It does not
+// need natLock, so packets of different flows are not serialized.
+func touchMapping(protocol gopacket.LayerType, value uint16, direction stat.Direction, size int) {
+	e, ok := nat.owners.load(natSlot{protocol: protocol, value: value})
+	if !ok {
+		return
+	}
+
+	entry := e.Value.(*natEntry)
+	if atomic.LoadInt32(&entry.touched) == 0 {
+		atomic.StoreInt32(&entry.touched, 1)
+	}
+	switch direction {
+	case stat.DirectionIn:
+		atomic.AddUint64(&entry.bytesIn, uint64(size))
+	case stat.DirectionOut:
+		atomic.AddUint64(&entry.bytesOut, uint64(size))
+	}
+}
+
+// evictMapping removes the mapping from NAT and frees its port or ID. It must be called with natLock held.
+func evictMapping(e *list.Element) {
+	entry := e.Value.(*natEntry)
+
+	natLRU.Remove(e)
+	nat.owners.delete(entry.slot)
+	nat.pats.delete(entry.q)
+
+	// Free
+	value := entry.slot.value
+	switch entry.slot.protocol {
+	case layers.LayerTypeTCP:
+		s := convertFromPort(value)
+		tcpPortPool.store(s, time.Time{})
+		tcpPortState.store(s, natTCPOpening)
+		delete(ftpSessions, s)
+	case layers.LayerTypeUDP:
+		udpPortPool.store(convertFromPort(value), time.Time{})
+	case layers.LayerTypeICMPv4:
+		icmpv4IdPool.store(value, time.Time{})
+	case layers.LayerTypeICMPv6:
+		icmpv6IdPool.store(value, time.Time{})
+	}
+
+	// Guides in both IPv4 and IPv6
+	if upConn != nil {
+		ips := make([]net.IP, 0)
+		if upConn.LocalDev().IPv4Addr() != nil {
+			ips = append(ips, upConn.LocalDev().IPv4Addr().IP)
+		}
+		if upConn.LocalDev().IPv6Addr() != nil {
+			ips = append(ips, upConn.LocalDev().IPv6Addr().IP)
+		}
+		for _, ip := range ips {
+			var a net.Addr
+			switch entry.slot.protocol {
+			case layers.LayerTypeTCP:
+				a = &net.TCPAddr{IP: ip, Port: int(value)}
+			case layers.LayerTypeUDP:
+				a = &net.UDPAddr{IP: ip, Port: int(value)}
+			default:
+				a = &addr.ICMPQueryAddr{IP: ip, Id: value}
+			}
+			nat.guides.delete(pcap.NATGuide{Src: a.String(), Protocol: entry.slot.protocol})
+		}
+	}
+
+	atomic.AddUint64(&natEvictions, 1)
+	log.Verbosef("Evict %s mapping %s from NAT\n", entry.slot.protocol, entry.q.src)
+}
+
+// dumpNAT returns mappings in NAT of the client, or all clients if the client is empty, roughly from the most recently
+// used.
+func dumpNAT(client string) interface{} {
+	type mappingStatus struct {
+		Client   string `json:"client"`
+		Protocol string `json:"protocol"`
+		Internal string `json:"internal"`
+		External string `json:"external"`
+		Peer     string `json:"peer,omitempty"`
+		Idle     int    `json:"idle"`
+		BytesIn  uint64 `json:"bytesIn"`
+		BytesOut uint64 `json:"bytesOut"`
+	}
+
+	now := time.Now()
+	result := make([]mappingStatus, 0)
+
+	natLock.RLock()
+	defer natLock.RUnlock()
+
+	for e := natLRU.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*natEntry)
+		if client != "" && entry.q.dst != client {
+			continue
+		}
+
+		// External address in the same family with the internal one
+		var ip net.IP
+		if upConn != nil {
+			if strings.HasPrefix(entry.q.src, "[") {
+				if upConn.LocalDev().IPv6Addr() != nil {
+					ip = upConn.LocalDev().IPv6Addr().IP
+				}
+			} else if upConn.LocalDev().IPv4Addr() != nil {
+				ip = upConn.LocalDev().IPv4Addr().IP
+			}
+		}
+
+		var (
+			external string
+			last     time.Time
+		)
+		value := entry.slot.value
+		switch entry.slot.protocol {
+		case layers.LayerTypeTCP:
+			external = (&net.TCPAddr{IP: ip, Port: int(value)}).String()
+			last = tcpPortPool.load(convertFromPort(value))
+		case layers.LayerTypeUDP:
+			external = (&net.UDPAddr{IP: ip, Port: int(value)}).String()
+			last = udpPortPool.load(convertFromPort(value))
+		case layers.LayerTypeICMPv4:
+			external = addr.ICMPQueryAddr{IP: ip, Id: value}.String()
+			last = icmpv4IdPool.load(value)
+		case layers.LayerTypeICMPv6:
+			external = addr.ICMPQueryAddr{IP: ip, Id: value}.String()
+			last = icmpv6IdPool.load(value)
+		}
+
+		result = append(result, mappingStatus{
+			Client:   entry.q.dst,
+			Protocol: entry.slot.protocol.String(),
+			Internal: entry.q.src,
+			External: external,
+			Peer:     entry.q.peer,
+			Idle:     int(now.Sub(last).Seconds()),
+			BytesIn:  atomic.LoadUint64(&entry.bytesIn),
+			BytesOut: atomic.LoadUint64(&entry.bytesOut),
+		})
+	}
+
+	return result
+}
+
+// upstreamStatus returns the status of listeners and the upstream device, and if they are up.
+func upstreamStatus() (interface{}, bool) {
+	addrs := make([]string, 0)
+	for _, listener := range listeners {
+		addrs = append(addrs, listener.Addr().String())
+	}
+
+	var device, gateway string
+	if upConn != nil {
+		device = upConn.LocalDev().Alias()
+		if !upConn.IsLoop() && upConn.RemoteDev() != nil && len(upConn.RemoteDev().IPAddrs()) > 0 {
+			gateway = upConn.RemoteDev().IPAddrs()[0].IP.String()
+		}
+	}
+
+	var relayStr string
+	if relayAddr != nil {
+		relayStr = relayAddr.String()
+	}
+
+	isUp := !isClosed && upConn != nil && len(listeners) > 0 && (relayAddr == nil || relayConn != nil)
+
+	return &struct {
+		IsUp      bool     `json:"isUp"`
+		Mode      string   `json:"mode"`
+		Device    string   `json:"device,omitempty"`
+		Gateway   string   `json:"gateway,omitempty"`
+		Relay     string   `json:"relay,omitempty"`
+		Standby   bool     `json:"standby,omitempty"`
+		Takeovers uint64   `json:"takeovers,omitempty"`
+		Listeners []string `json:"listeners"`
+	}{
+		IsUp:      isUp,
+		Mode:      mode,
+		Device:    device,
+		Gateway:   gateway,
+		Relay:     relayStr,
+		Standby:   isStandby,
+		Takeovers: atomic.LoadUint64(&takeovers),
+		Listeners: addrs,
+	}, isUp
+}
+
+// dumpClients returns connected clients with their traffic and mappings in NAT.
+func dumpClients() interface{} {
+	type clientStatus struct {
+		Client   string                 `json:"client"`
+		Mappings int                    `json:"mappings"`
+		Ports    string                 `json:"ports,omitempty"`
+		In       *stat.TrafficIndicator `json:"in"`
+		Out      *stat.TrafficIndicator `json:"out"`
+	}
+
+	clients := make([]string, 0)
+	connLock.Lock()
+	for client := range connected {
+		clients = append(clients, client)
+	}
+	connLock.Unlock()
+	sort.Strings(clients)
+
+	mappings := make(map[string]int)
+	natLock.RLock()
+	for e := natLRU.Front(); e != nil; e = e.Next() {
+		mappings[e.Value.(*natEntry).q.dst]++
+	}
+	natLock.RUnlock()
+
+	result := make([]clientStatus, 0)
+	for _, client := range clients {
+		status := clientStatus{
+			Client:   client,
+			Mappings: mappings[client],
+		}
+
+		if portBlock > 0 {
+			blockLock.Lock()
+			b, ok := blockClients[client]
+			blockLock.Unlock()
+			if ok {
+				status.Ports = fmt.Sprintf("%d-%d", 49152+b*portBlock, 49152+(b+1)*portBlock-1)
+			}
+		}
+
+		if monitor != nil {
+			status.In, status.Out = monitor.Local(client)
+		}
+
+		result = append(result, status)
+	}
+
+	return result
+}
+
+// natTimeout returns the longest timeout of mappings of the protocol in NAT.
+func natTimeout(protocol gopacket.LayerType) time.Duration {
+	switch protocol {
+	case layers.LayerTypeTCP:
+		return time.Duration(natConfig.TCPEstablished) * time.Second
+	case layers.LayerTypeUDP:
+		return time.Duration(natConfig.UDP) * time.Second
+	default:
+		return time.Duration(natConfig.ICMP) * time.Second
+	}
+}
+
+// natPeer returns the key of the destination in filters of NAT, which is its address in restricted cone NAT, and its
+// address and port otherwise. ICMP queries have no ports, and replies carry the ID translated rather than the ID of
+// the query, so they are always keyed by their addresses.
+func natPeer(a net.Addr) string {
+	if t, ok := a.(*addr.ICMPQueryAddr); ok {
+		return t.IP.String()
+	}
+	if natMode != natRestricted {
+		return a.String()
+	}
+
+	switch t := a.(type) {
+	case *net.TCPAddr:
+		return t.IP.String()
+	case *net.UDPAddr:
+		return t.IP.String()
+	default:
+		return a.String()
+	}
+}
+
+// queueStatus returns the length and drops of queues of each traffic class in workers.
+func queueStatus() interface{} {
+	status := make(map[string][]pcap.QueueStat)
+	if listenPool != nil {
+		status["listen"] = listenPool.Stats()
+	}
+	if upPool != nil {
+		status["upstream"] = upPool.Stats()
+	}
+
+	return status
+}
+
+// natStatus returns the timeouts and the number of mappings alive of each protocol in NAT.
+func natStatus() interface{} {
+	type protocolStatus struct {
+		Timeout  int `json:"timeout"`
+		Mappings int `json:"mappings"`
+	}
+
+	now := time.Now()
+	alive := func(pool portPool, timeout int) int {
+		count := 0
+		for i := range pool {
+			if now.Sub(pool.load(uint16(i))) <= time.Duration(timeout)*time.Second {
+				count++
+			}
+		}
+
+		return count
+	}
+
+	tcpEstablished, tcpTransitory := 0, 0
+	for s := range tcpPortPool {
+		if isTCPExpired(uint16(s), now) {
+			continue
+		}
+		if tcpPortState.load(uint16(s)) == natTCPEstablished {
+			tcpEstablished++
+		} else {
+			tcpTransitory++
+		}
+	}
+
+	natLock.RLock()
+	entries := natLRU.Len()
+	natLock.RUnlock()
+
+	var blocks interface{}
+	if portBlock > 0 {
+		blocks = blockStatus()
+	}
+
+	return &struct {
+		Type           string         `json:"type"`
+		Entries        int            `json:"entries"`
+		MaxEntries     int            `json:"maxEntries"`
+		Evictions      uint64         `json:"evictions"`
+		Peers          []string       `json:"peers,omitempty"`
+		Merged         uint64         `json:"merged,omitempty"`
+		Blocks         interface{}    `json:"blocks,omitempty"`
+		UDP            protocolStatus `json:"udp"`
+		TCPEstablished protocolStatus `json:"tcpEstablished"`
+		TCPTransitory  protocolStatus `json:"tcpTransitory"`
+		ICMPv4         protocolStatus `json:"icmpv4"`
+		ICMPv6         protocolStatus `json:"icmpv6"`
+	}{
+		Type:           natMode.String(),
+		Entries:        entries,
+		MaxEntries:     natMax,
+		Evictions:      atomic.LoadUint64(&natEvictions),
+		Peers:          natPeers,
+		Merged:         atomic.LoadUint64(&natMerged),
+		Blocks:         blocks,
+		UDP:            protocolStatus{Timeout: natConfig.UDP, Mappings: alive(udpPortPool, natConfig.UDP)},
+		TCPEstablished: protocolStatus{Timeout: natConfig.TCPEstablished, Mappings: tcpEstablished},
+		TCPTransitory:  protocolStatus{Timeout: natConfig.TCPTransitory, Mappings: tcpTransitory},
+		ICMPv4:         protocolStatus{Timeout: natConfig.ICMP, Mappings: alive(icmpv4IdPool, natConfig.ICMP)},
+		ICMPv6:         protocolStatus{Timeout: natConfig.ICMP, Mappings: alive(icmpv6IdPool, natConfig.ICMP)},
+	}
+}
+
+// standbyPeer describes the state of a peer held by a standby, which is taken over once the peer is silent.
+type standbyPeer struct {
+	heard    time.Time
+	sessions []pcap.FakeTCPSession
+}
+
+// natGossip describes the state sent to peers, which is mappings in NAT and sessions of clients for standbys.
+type natGossip struct {
+	Mappings []natMapping          `json:"mappings"`
+	Sessions []pcap.FakeTCPSession `json:"sessions,omitempty"`
+}
+
+// natMapping describes a mapping in NAT persisted in file.
+type natMapping struct {
+	Src      string      `json:"src"`
+	Client   string      `json:"client"`
+	Peer     string      `json:"peer,omitempty"`
+	Protocol string      `json:"protocol"`
+	Value    uint16      `json:"value"`
+	Last     time.Time   `json:"last"`
+	State    natTCPState `json:"state,omitempty"`
+}
+
+// parseNATProtocol returns the layer type of the protocol in NAT by its name.
+func parseNATProtocol(protocol string) (gopacket.LayerType, error) {
+	for _, t := range []gopacket.LayerType{layers.LayerTypeTCP, layers.LayerTypeUDP, layers.LayerTypeICMPv4, layers.LayerTypeICMPv6} {
+		if t.String() == protocol {
+			return t, nil
+		}
+	}
+
+	return 0, fmt.Errorf("protocol %s not support", protocol)
+}
+
+// snapshotNAT returns mappings alive in NAT.
+func snapshotNAT() []natMapping {
+	now := time.Now()
+	mappings := make([]natMapping, 0)
+
+	natLock.RLock()
+	for e := natLRU.Front(); e != nil; e = e.Next() {
+		q, value := e.Value.(*natEntry).q, e.Value.(*natEntry).slot.value
+		mapping := natMapping{
+			Src:      q.src,
+			Client:   q.dst,
+			Peer:     q.peer,
+			Protocol: q.protocol.String(),
+			Value:    value,
+		}
+
+		switch q.protocol {
+		case layers.LayerTypeTCP:
+			s := convertFromPort(value)
+			if isTCPExpired(s, now) {
+				continue
+			}
+			mapping.Last, mapping.State = tcpPortPool.load(s), tcpPortState.load(s)
+		case layers.LayerTypeUDP:
+			mapping.Last = udpPortPool.load(convertFromPort(value))
+			if now.Sub(mapping.Last) > time.Duration(natConfig.UDP)*time.Second {
+				continue
+			}
+		case layers.LayerTypeICMPv4:
+			mapping.Last = icmpv4IdPool.load(value)
+			if now.Sub(mapping.Last) > time.Duration(natConfig.ICMP)*time.Second {
+				continue
+			}
+		case layers.LayerTypeICMPv6:
+			mapping.Last = icmpv6IdPool.load(value)
+			if now.Sub(mapping.Last) > time.Duration(natConfig.ICMP)*time.Second {
+				continue
+			}
+		default:
+			continue
+		}
+
+		mappings = append(mappings, mapping)
+	}
+	natLock.RUnlock()
+
+	return mappings
+}
+
+// saveNAT writes mappings alive in NAT to the file. The file is replaced atomically, so a crash during saving leaves
+// the previous one.
+func saveNAT(path string) error {
+	mappings := snapshotNAT()
+
+	b, err := json.Marshal(mappings)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	temp := path + ".tmp"
+	err = ioutil.WriteFile(temp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	err = os.Rename(temp, path)
+	if err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	log.Verbosef("Save %d NAT mappings to %s\n", len(mappings), path)
+
+	return nil
+}
+
+// loadNAT restores mappings in NAT from the file, and returns the number of mappings restored. Mappings expired during
+// the restart are ignored. Mappings are attached to the client again once it sends a packet through the mapping.
+func loadNAT(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("read: %w", err)
+	}
+
+	mappings := make([]natMapping, 0)
+	err = json.Unmarshal(b, &mappings)
+	if err != nil {
+		return 0, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	return restoreNAT(mappings, false)
+}
+
+// restoreNAT adds mappings to NAT, and returns the number of mappings added. Mappings expired are ignored. Mappings of
+// peers are merged if isMerged is set, where mappings conflicting with local ones and mappings used more recently in
+// local are ignored, and the same mappings are refreshed.
+func restoreNAT(mappings []natMapping, isMerged bool) (int, error) {
+	now := time.Now()
+	n := 0
+
+	natLock.Lock()
+	defer natLock.Unlock()
+
+	for _, mapping := range mappings {
+		protocol, err := parseNATProtocol(mapping.Protocol)
+		if err != nil {
+			return n, fmt.Errorf("parse protocol: %w", err)
+		}
+
+		switch protocol {
+		case layers.LayerTypeTCP, layers.LayerTypeUDP:
+			if mapping.Value < 49152 {
+				return n, fmt.Errorf("port %d out of range", mapping.Value)
+			}
+		}
+
+		q := quintuple{
+			src:      mapping.Src,
+			dst:      mapping.Client,
+			protocol: protocol,
+			peer:     mapping.Peer,
+		}
+
+		isExisting := false
+		if isMerged {
+			value, ok := nat.pats.load(q)
+			if ok && value != mapping.Value {
+				continue
+			}
+			e, ok := nat.owners.load(natSlot{protocol: protocol, value: mapping.Value})
+			if ok && e.Value.(*natEntry).q != q {
+				continue
+			}
+			isExisting = ok
+		}
+		isNewer := func(last time.Time) bool {
+			return !isMerged || mapping.Last.After(last)
+		}
+
+		switch protocol {
+		case layers.LayerTypeTCP:
+			s := convertFromPort(mapping.Value)
+			if !isNewer(tcpPortPool.load(s)) {
+				continue
+			}
+			tcpPortPool.store(s, mapping.Last)
+			tcpPortState.store(s, mapping.State)
+			if isTCPExpired(s, now) {
+				continue
+			}
+		case layers.LayerTypeUDP:
+			s := convertFromPort(mapping.Value)
+			if now.Sub(mapping.Last) > time.Duration(natConfig.UDP)*time.Second || !isNewer(udpPortPool.load(s)) {
+				continue
+			}
+			udpPortPool.store(s, mapping.Last)
+		case layers.LayerTypeICMPv4:
+			if now.Sub(mapping.Last) > time.Duration(natConfig.ICMP)*time.Second || !isNewer(icmpv4IdPool.load(mapping.Value)) {
+				continue
+			}
+			icmpv4IdPool.store(mapping.Value, mapping.Last)
+		case layers.LayerTypeICMPv6:
+			if now.Sub(mapping.Last) > time.Duration(natConfig.ICMP)*time.Second || !isNewer(icmpv6IdPool.load(mapping.Value)) {
+				continue
+			}
+			icmpv6IdPool.store(mapping.Value, mapping.Last)
+		}
+
+		if !isExisting {
+			addMapping(q, mapping.Value)
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// gossipNAT sends mappings alive in NAT to peers periodically, so a client landing on a peer keeps its mappings.
+func gossipNAT() {
+	isDown := make(map[string]bool)
+	for !isClosed {
+		time.Sleep(natGossipInterval)
+		if isClosed {
+			return
+		}
+
+		b, err := json.Marshal(&natGossip{Mappings: snapshotNAT(), Sessions: snapshotSessions()})
+		if err != nil {
+			log.Errorln(fmt.Errorf("marshal nat: %w", err))
+			continue
+		}
+		b, err = natCrypt.Encrypt(b)
+		if err != nil {
+			log.Errorln(fmt.Errorf("encrypt nat: %w", err))
+			continue
+		}
+
+		// Errors of a peer are logged once until it is reachable again
+		for _, peer := range natPeers {
+			err := sendNAT(peer, b)
+			if err != nil {
+				if !isDown[peer] {
+					log.Errorln(fmt.Errorf("gossip nat to peer %s: %w", peer, err))
+				}
+				isDown[peer] = true
+				continue
+			}
+			if isDown[peer] {
+				log.Infof("Gossip NAT to peer %s again\n", peer)
+			}
+			isDown[peer] = false
+		}
+	}
+}
+
+func sendNAT(peer string, b []byte) error {
+	conn, err := net.DialTimeout("tcp", peer, natGossipInterval)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+
+	err = conn.SetWriteDeadline(time.Now().Add(natGossipInterval))
+	if err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	_, err = conn.Write(b)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return nil
+}
+
+// serveNATGossip receives mappings in NAT from peers and merges them.
+func serveNATGossip(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if isClosed {
+				return
+			}
+			log.Errorln(fmt.Errorf("accept nat gossip: %w", err))
+			continue
+		}
+
+		go func() {
+			err := receiveNAT(conn)
+			if err != nil {
+				log.Errorln(fmt.Errorf("receive nat from peer %s: %w", conn.RemoteAddr(), err))
+			}
+		}()
+	}
+}
+
+func receiveNAT(conn net.Conn) error {
+	defer conn.Close()
+
+	err := conn.SetReadDeadline(time.Now().Add(natGossipInterval))
+	if err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(conn, maxNATGossip))
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	b, err = natCrypt.Decrypt(b)
+	if err != nil {
+		return fmt.Errorf("decrypt: %w", err)
+	}
+
+	gossip := &natGossip{}
+	err = json.Unmarshal(b, gossip)
+	if err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+
+	n, err := restoreNAT(gossip.Mappings, true)
+	atomic.AddUint64(&natMerged, uint64(n))
+	if err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+
+	log.Verbosef("Merge %d NAT mappings from peer %s\n", n, conn.RemoteAddr())
+
+	// Sessions of the peer are replaced by the latest
+	if isStandby {
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			return fmt.Errorf("split host port: %w", err)
+		}
+
+		standbyLock.Lock()
+		standbys[host] = &standbyPeer{heard: time.Now(), sessions: gossip.Sessions}
+		standbyLock.Unlock()
+	}
+
+	return nil
+}
+
+// snapshotSessions returns sessions of clients connected in FakeTCP, which are handed off to standbys.
+func snapshotSessions() []pcap.FakeTCPSession {
+	sessions := make([]pcap.FakeTCPSession, 0)
+	for _, listener := range listeners {
+		l, ok := listener.(*pcap.FakeTCPListener)
+		if !ok {
+			continue
+		}
+		sessions = append(sessions, l.Sessions()...)
+	}
+
+	return sessions
+}
+
+// watchStandby takes over sessions of peers silent for the standby timeout, whose address is supposed to be moved to
+// this server by external help, like VRRP.
+func watchStandby() {
+	for !isClosed {
+		time.Sleep(natGossipInterval)
+		if isClosed {
+			return
+		}
+
+		now := time.Now()
+		silent := make(map[string][]pcap.FakeTCPSession)
+		standbyLock.Lock()
+		for peer, p := range standbys {
+			if now.Sub(p.heard) < standbyTimeout {
+				continue
+			}
+			if len(p.sessions) > 0 {
+				silent[peer] = p.sessions
+			}
+			delete(standbys, peer)
+		}
+		standbyLock.Unlock()
+
+		for peer, sessions := range silent {
+			takeOver(peer, sessions)
+		}
+	}
+}
+
+// takeOver resumes sessions of the peer, so clients of the peer continue their connections with this server.
+func takeOver(peer string, sessions []pcap.FakeTCPSession) {
+	var listener *pcap.FakeTCPListener
+	for _, l := range listeners {
+		fl, ok := l.(*pcap.FakeTCPListener)
+		if ok {
+			listener = fl
+			break
+		}
+	}
+	if listener == nil {
+		return
+	}
+
+	log.Infof("Take over %d sessions of peer %s\n", len(sessions), peer)
+	atomic.AddUint64(&takeovers, 1)
+
+	for _, session := range sessions {
+		conn, err := listener.Resume(session)
+		if err != nil {
+			log.Errorln(fmt.Errorf("resume session of client %s: %w", session.Client, err))
+			continue
+		}
+
+		serveConn(conn)
+	}
+}
+
+// accountName returns the client an address is accounted to, which is the IP or CIDR block of the client in the
+// keyring, or its IP without keyring.
+func accountName(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+
+	if keyring != nil {
+		name := keyring.Name(net.ParseIP(host))
+		if name != "" {
+			return name
+		}
+	}
+
+	return host
+}
+
+// parseRateLimits returns a rate limiter by the given limits of clients, which are keyed by IPs or CIDR blocks in
+// clients, or * for the default limits of each client.
+func parseRateLimits(limits config.RateLimits) (*stat.RateLimiter, error) {
+	limiter := stat.NewRateLimiter()
+
+	for client, limit := range limits {
+		if limit.UpPackets < 0 || limit.UpBytes < 0 || limit.DownPackets < 0 || limit.DownBytes < 0 {
+			return nil, fmt.Errorf("rate limit of %s out of range", client)
+		}
+		limiter.SetLimit(client, stat.DirectionOut, stat.Rate{Packets: limit.UpPackets, Bytes: limit.UpBytes})
+		limiter.SetLimit(client, stat.DirectionIn, stat.Rate{Packets: limit.DownPackets, Bytes: limit.DownBytes})
+		if limit.Schedule != "" {
+			sched, err := schedule.Parse(limit.Schedule)
+			if err != nil {
+				return nil, fmt.Errorf("parse schedule of %s: %w", client, err)
+			}
+			limiter.SetSchedule(client, sched)
+		}
+	}
+
+	return limiter, nil
+}
+
+// applySchedules puts QoS rules and rate limits in effect by their schedules.
+func applySchedules(now time.Time) {
+	if classifier.Apply(now) {
+		log.Infof("Apply QoS rules %s\n", classifier.Active())
+	}
+	if limiter.Apply(now) {
+		log.Infof("Apply rate limits of clients %s\n", limiter.Active())
+	}
+}
+
+// dumpAccounting returns accounts of clients, or the account of the given client.
+func dumpAccounting(client string) interface{} {
+	accounts := accounting.Accounts()
+	if client == "" {
+		return accounts
+	}
+
+	result := make([]stat.Account, 0)
+	for _, account := range accounts {
+		if account.Client == client {
+			result = append(result, account)
+		}
+	}
+
+	return result
+}
+
+// saveAccounting saves accounts of clients to the file, sessions in progress are saved with their durations so far.
+func saveAccounting(path string) error {
+	accounts := accounting.Accounts()
+
+	b, err := json.Marshal(accounts)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	temp := path + ".tmp"
+	err = ioutil.WriteFile(temp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	err = os.Rename(temp, path)
+	if err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	log.Verbosef("Save accounting of %d clients to %s\n", len(accounts), path)
+
+	return nil
+}
+
+// loadAccounting restores accounts of clients from the file, and returns the number of clients restored. A missing
+// file is not an error.
+func loadAccounting(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("read: %w", err)
+	}
+
+	accounts := make([]stat.Account, 0)
+	err = json.Unmarshal(b, &accounts)
+	if err != nil {
+		return 0, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	accounting.Restore(accounts)
+
+	return len(accounts), nil
+}
+
+func convertFromPort(port uint16) uint16 {
+	return port - 49152
+}
+
+// dialRelay connects to the next server in relay, which sees this server as its client.
+func dialRelay() (net.Conn, error) {
+	switch mode {
+	case "faketcp":
+		if isKCP {
+			return pcap.DialFakeTCPWithKCP(upDev, gatewayDev, relayPort, relayAddr, crypt, mtu, kcpConfig)
+		}
+
+		return pcap.DialFakeTCP(upDev, gatewayDev, relayPort, relayAddr, crypt, mtu, isECN, ttlPolicy, dscp, isEmulated, synOptions, keepalive, fingerprint, pace, obfuscator)
+	case "tcp":
+		return pcap.DialTCP(upDev, relayPort, relayAddr, crypt)
+	default:
+		return nil, fmt.Errorf("mode %s not support", mode)
+	}
+}
+
+// relay sends the frame to the next server in relay instead of the upstream device, where the link layer is stripped.
+func relay(ctx context.Context, frame []byte) error {
+	packet := upConn.Decode(frame)
+	if packet.NetworkLayer() == nil {
+		return errors.New("missing network layer")
+	}
+
+	data := make([]byte, 0)
+	data = append(data, packet.NetworkLayer().LayerContents()...)
+	// Hop-by-hop options header is decoded as a part of the IPv6 layer
+	if ipv6Layer, ok := packet.NetworkLayer().(*layers.IPv6); ok && ipv6Layer.HopByHop != nil {
+		data = append(data, ipv6Layer.HopByHop.Contents...)
+	}
+	data = append(data, packet.NetworkLayer().LayerPayload()...)
+
+	_, err := pcap.WriteContext(ctx, relayConn, data)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// readRelay reads packets from the next server in relay, which are handled like packets from the upstream device.
+func readRelay() {
+	destick := pcap.NewDesticker()
+	b := make([]byte, pcap.IPv4MaxSize)
+	for {
+		n, err := relayConn.Read(b)
+		if err != nil {
+			if isClosed {
+				return
+			}
+			if errors.Is(err, io.EOF) {
+				log.Fatalf("Connection to server %s is closed, is the server or your network down?\n", relayConn.RemoteAddr())
+			}
+			log.Errorln(fmt.Errorf("read relay: %w", err))
+			continue
+		}
+
+		contentss, err := destick.Append(b[:n])
+		if err != nil {
+			log.Errorln(fmt.Errorf("destick relay: %w", err))
+			continue
+		}
+
+		for _, contents := range contentss {
+			var networkLayerType gopacket.LayerType
+			switch contents[0] >> 4 {
+			case 4:
+				networkLayerType = layers.LayerTypeIPv4
+			case 6:
+				networkLayerType = layers.LayerTypeIPv6
+			default:
+				log.Verbosef("Drop a relayed packet of network layer type not support (%d Bytes)\n", len(contents))
+				continue
+			}
+
+			packet := gopacket.NewPacket(contents, networkLayerType, gopacket.Default)
+			if !classifier.Allows(packet) {
+				continue
+			}
+			upPool.Submit(pcap.FlowHash(packet), classifier.Classify(packet), len(packet.Data()), packet)
+		}
+	}
+}
+
+func bridgeFrame(frame []byte, from io.Writer) error {
+	ports, err := bridge.Forward(frame, from)
+	if err != nil {
+		return fmt.Errorf("forward: %w", err)
+	}
+
+	for _, port := range ports {
+		// Frames to clients are shaped
+		if port != upConn && !shaper.Wait(len(frame), false) {
+			log.Verbosef("Drop a frame over shaping rate: %s -> %s\n", net.HardwareAddr(frame[6:12]), net.HardwareAddr(frame[0:6]))
+			continue
+		}
+
+		err := pcap.WriteFrame(port, frame)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+
+	log.Verbosef("Bridge a frame: %s -> %s (%d Bytes)\n", net.HardwareAddr(frame[6:12]), net.HardwareAddr(frame[0:6]), len(frame))
+
+	return nil
+}
+
+// listDevsJSON prints all valid devices in JSON.
+// serveJSON writes the value in JSON as the response of a read-only request to the monitor.
+func serveJSON(w http.ResponseWriter, req *http.Request, code int, v interface{}) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Errorln(fmt.Errorf("monitor: %w", err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Handle CORS
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	_, err = w.Write(b)
+	if err != nil {
+		log.Errorln(fmt.Errorf("monitor: %w", err))
+	}
+}
+
+func listDevsJSON() error {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return err
+	}
+
+	// Gateway is omitted if it cannot be determined
+	gateway, _ := pcap.FindGatewayAddr()
+
+	infos := make([]*pcap.DeviceInfo, 0)
+	for _, dev := range devs {
+		infos = append(infos, dev.Info(gateway))
+	}
+
+	b, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	log.Infoln(string(b))
+
+	return nil
+}
+
+// argKey returns the key in the configuration of the argument.
+func argKey(name string) string {
+	switch name {
+	case "v":
+		return "verbose"
+	case "p":
+		return "port"
+	case "nat-udp", "nat-tcp-established", "nat-tcp-transitory", "nat-icmp":
+		return "nat-timeouts." + strings.TrimPrefix(name, "nat-")
+	}
+	if strings.HasPrefix(name, "kcp-") {
+		return "kcp-tuning." + strings.TrimPrefix(name, "kcp-")
+	}
+
+	return name
+}
+
+func splitMapArg(s string) map[string]string {
+	strs := splitArg(s)
+	if strs == nil {
+		return nil
+	}
+
+	result := make(map[string]string)
+
+	for _, str := range strs {
+		kv := strings.SplitN(str, ":", 2)
+		if len(kv) != 2 {
+			log.Fatalln(fmt.Errorf("invalid argument %s", str))
+		}
+		result[strings.Trim(kv[0], " ")] = strings.Trim(kv[1], " ")
+	}
+
+	return result
 }
 
 func splitArg(s string) []string {
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/config"
+	"ikago/internal/pcap"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Flags of tests are registered before init parses flags.
+var _ = func() bool {
+	testing.Init()
+	return true
+}()
+
+// TestPortPoolRace keeps ports from listen and upstream workers in parallel, while they are distributed and checked,
+// which is run with -race.
+func TestPortPoolRace(t *testing.T) {
+	natConfig = &config.NATConfig{UDP: 1, TCPEstablished: 2, TCPTransitory: 1}
+	portBlock = 0
+	defer func() {
+		portBlock = 0
+	}()
+
+	const rounds = 1000
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+
+	// Listen
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			s := uint16(i % 64)
+			keepTCP(s, &layers.TCP{SYN: true})
+			udpPortPool.store(s, time.Now())
+			icmpv4IdPool.store(uint16(i), time.Now())
+		}
+	}()
+
+	// Upstream
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			s := uint16(i % 64)
+			keepTCP(s, &layers.TCP{ACK: true})
+			keepTCP(s, &layers.TCP{FIN: true, ACK: true})
+			udpPortPool.store(s, time.Now())
+		}
+	}()
+
+	// Distribute
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			_, err := dist(layers.LayerTypeTCP, "10.0.0.2")
+			if err != nil {
+				t.Errorf("distribute tcp: %v", err)
+				return
+			}
+			_, err = dist(layers.LayerTypeUDP, "10.0.0.2")
+			if err != nil {
+				t.Errorf("distribute udp: %v", err)
+				return
+			}
+		}
+	}()
+
+	// Check
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			isTCPExpired(uint16(i%64), time.Now())
+			isBlockAlive(0)
+		}
+	}()
+
+	wg.Wait()
+}
+
+// TestNATTCPStates moves states of a TCP port by segments.
+func TestNATTCPStates(t *testing.T) {
+	tests := []struct {
+		name  string
+		from  natTCPState
+		layer *layers.TCP
+		want  natTCPState
+	}{
+		{"syn", natTCPClosing, &layers.TCP{SYN: true}, natTCPOpening},
+		{"ack opening", natTCPOpening, &layers.TCP{ACK: true}, natTCPEstablished},
+		{"ack closing", natTCPClosing, &layers.TCP{ACK: true}, natTCPClosing},
+		{"fin", natTCPEstablished, &layers.TCP{FIN: true, ACK: true}, natTCPClosing},
+		{"rst", natTCPOpening, &layers.TCP{RST: true}, natTCPClosing},
+		{"icmp", natTCPEstablished, nil, natTCPEstablished},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tcpPortState.store(0, test.from)
+			keepTCP(0, test.layer)
+			if got := tcpPortState.load(0); got != test.want {
+				t.Errorf("state %d, want %d", got, test.want)
+			}
+			if tcpPortPool.load(0).IsZero() {
+				t.Error("port not kept")
+			}
+		})
+	}
+}
+
+// icmpEcho returns an IPv4 ICMP echo request or reply between the addresses of the ID.
+func icmpEcho(t *testing.T, src, dst net.IP, id uint16, reply bool) gopacket.Packet {
+	t.Helper()
+
+	typeCode := layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)
+	if reply {
+		typeCode = layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0)
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: src, DstIP: dst},
+		&layers.ICMPv4{TypeCode: typeCode, Id: id, Seq: 1},
+		gopacket.Payload("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return gopacket.NewPacket(buffer.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+}
+
+// TestNATFilterPing allows echo replies carrying the ID translated through filters of each NAT mode, where the filter
+// learns the destination from the echo request of the client.
+func TestNATFilterPing(t *testing.T) {
+	defer func(mode natType) {
+		natMode = mode
+	}(natMode)
+
+	client, dst, up := net.IPv4(10, 6, 0, 2).To4(), net.IPv4(203, 0, 113, 1).To4(), net.IPv4(192, 0, 2, 1).To4()
+
+	request, err := pcap.ParsePacket(icmpEcho(t, client, dst, 100, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := pcap.ParsePacket(icmpEcho(t, dst, up, 50000, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := pcap.ParsePacket(icmpEcho(t, net.IPv4(203, 0, 113, 2).To4(), up, 50000, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []natType{natRestricted, natPortRestricted, natSymmetric} {
+		natMode = mode
+
+		filter := newNATFilter()
+		filter.add(natPeer(request.NATDst()), time.Minute)
+		if !filter.allow(natPeer(reply.NATSrc()), time.Minute) {
+			t.Errorf("%s: reply filtered", mode)
+		}
+		if filter.allow(natPeer(other.NATSrc()), time.Minute) {
+			t.Errorf("%s: reply of another destination allowed", mode)
+		}
+	}
+}
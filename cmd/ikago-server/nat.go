@@ -0,0 +1,197 @@
+package main
+
+import (
+	"container/list"
+	"ikago/internal/pcap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// natShards is the number of shards of each index in NAT, which is a power of 2.
+const natShards = 64
+
+const (
+	fnvOffset = 2166136261
+	fnvPrime  = 16777619
+)
+
+// natTable describes indexes of mappings in NAT, which are sharded by hashes of their keys with a lock in each shard,
+// so packets of different flows are translated in parallel. Indexes are looked up by packets without natLock, and
+// mappings are added and evicted with natLock held.
+type natTable struct {
+	guides natGuides
+	pats   natPats
+	owners natOwners
+}
+
+func newNATTable() *natTable {
+	t := &natTable{}
+	for i := 0; i < natShards; i++ {
+		t.guides[i].m = make(map[pcap.NATGuide]*natIndicator)
+		t.pats[i].m = make(map[quintuple]uint16)
+		t.owners[i].m = make(map[natSlot]*list.Element)
+	}
+
+	return t
+}
+
+// hashString returns the FNV-1a hash of the string continued from the hash, which does not allocate.
+func hashString(h uint32, s string) uint32 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= fnvPrime
+	}
+
+	return h
+}
+
+// guideShard describes a shard of guides to clients in NAT.
+type guideShard struct {
+	lock sync.RWMutex
+	m    map[pcap.NATGuide]*natIndicator
+}
+
+type natGuides [natShards]guideShard
+
+// shard returns the shard of the guide, which is locked by callers replacing the guide by its last value.
+func (g *natGuides) shard(guide pcap.NATGuide) *guideShard {
+	h := hashString(fnvOffset, guide.Src) ^ uint32(guide.Protocol)
+
+	return &g[h&(natShards-1)]
+}
+
+func (g *natGuides) load(guide pcap.NATGuide) (*natIndicator, bool) {
+	s := g.shard(guide)
+	s.lock.RLock()
+	ni, ok := s.m[guide]
+	s.lock.RUnlock()
+
+	return ni, ok
+}
+
+func (g *natGuides) store(guide pcap.NATGuide, ni *natIndicator) {
+	s := g.shard(guide)
+	s.lock.Lock()
+	s.m[guide] = ni
+	s.lock.Unlock()
+}
+
+func (g *natGuides) delete(guide pcap.NATGuide) {
+	s := g.shard(guide)
+	s.lock.Lock()
+	delete(s.m, guide)
+	s.lock.Unlock()
+}
+
+// patShard describes a shard of ports and IDs distributed to quintuples in NAT.
+type patShard struct {
+	lock sync.RWMutex
+	m    map[quintuple]uint16
+}
+
+type natPats [natShards]patShard
+
+func (p *natPats) shard(q quintuple) *patShard {
+	h := hashString(hashString(hashString(fnvOffset, q.src), q.dst), q.peer) ^ uint32(q.protocol)
+
+	return &p[h&(natShards-1)]
+}
+
+func (p *natPats) load(q quintuple) (uint16, bool) {
+	s := p.shard(q)
+	s.lock.RLock()
+	value, ok := s.m[q]
+	s.lock.RUnlock()
+
+	return value, ok
+}
+
+func (p *natPats) store(q quintuple, value uint16) {
+	s := p.shard(q)
+	s.lock.Lock()
+	s.m[q] = value
+	s.lock.Unlock()
+}
+
+func (p *natPats) delete(q quintuple) {
+	s := p.shard(q)
+	s.lock.Lock()
+	delete(s.m, q)
+	s.lock.Unlock()
+}
+
+// ownerShard describes a shard of mappings owning ports and IDs in the LRU list.
+type ownerShard struct {
+	lock sync.RWMutex
+	m    map[natSlot]*list.Element
+}
+
+type natOwners [natShards]ownerShard
+
+func (o *natOwners) shard(slot natSlot) *ownerShard {
+	h := uint32(slot.value) ^ uint32(slot.protocol)*fnvPrime
+
+	return &o[h&(natShards-1)]
+}
+
+func (o *natOwners) load(slot natSlot) (*list.Element, bool) {
+	s := o.shard(slot)
+	s.lock.RLock()
+	e, ok := s.m[slot]
+	s.lock.RUnlock()
+
+	return e, ok
+}
+
+func (o *natOwners) store(slot natSlot, e *list.Element) {
+	s := o.shard(slot)
+	s.lock.Lock()
+	s.m[slot] = e
+	s.lock.Unlock()
+}
+
+func (o *natOwners) delete(slot natSlot) {
+	s := o.shard(slot)
+	s.lock.Lock()
+	delete(s.m, slot)
+	s.lock.Unlock()
+}
+
+// portPool describes the times ports or IDs in NAT are last used in Unix nanoseconds, where 0 is never. Packets of a
+// flow in both directions are handled by different workers in parallel, so times are loaded and stored atomically.
+type portPool []int64
+
+func (p portPool) load(i uint16) time.Time {
+	t := atomic.LoadInt64(&p[i])
+	if t == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, t)
+}
+
+func (p portPool) store(i uint16, t time.Time) {
+	if t.IsZero() {
+		atomic.StoreInt64(&p[i], 0)
+		return
+	}
+
+	atomic.StoreInt64(&p[i], t.UnixNano())
+}
+
+// natTCPStates describes the states of TCP ports in NAT, which are loaded and stored atomically like portPool.
+type natTCPStates []int32
+
+func (s natTCPStates) load(i uint16) natTCPState {
+	return natTCPState(atomic.LoadInt32(&s[i]))
+}
+
+func (s natTCPStates) store(i uint16, state natTCPState) {
+	atomic.StoreInt32(&s[i], int32(state))
+}
+
+// transit changes the state of the port from one to another, and leaves it if it is not in the state from.
+func (s natTCPStates) transit(i uint16, from, to natTCPState) {
+	atomic.CompareAndSwapInt32(&s[i], int32(from), int32(to))
+}
@@ -0,0 +1,282 @@
+package addr
+
+import (
+	"errors"
+	"fmt"
+	"ikago/internal/geoip"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ACL describes access control lists of destinations. A destination is allowed if the allow list is empty or it
+// matches any entry in the allow list, and it matches no entry in the deny list. A nil ACL allows any destination.
+type ACL struct {
+	allow []destination
+	deny  []destination
+}
+
+// destination describes a CIDR with a range of ports in a protocol, where the CIDR is nil if it matches any IP, the range
+// is empty if it matches any port, and the protocol is empty if it matches any protocol. The CIDR can be a country or an
+// autonomous system looked up in GeoIP databases instead.
+type destination struct {
+	protocol string
+	ipNet    *net.IPNet
+	low      uint16
+	high     uint16
+	country  string
+	asn      uint32
+	geo      *geoip.Database
+}
+
+// ParseACL returns an ACL by the given allow and deny lists. Entries are CIDRs or IPs with optional ports or ranges of
+// ports, like 10.0.0.0/8, 192.0.2.1:53, 198.51.100.0/24:27015-27030 and [2001:db8::/32]:443, countries and autonomous
+// systems in GeoIP databases, like country:JP and asn:13335, or * for any IP, like *:25. Entries can be prefixed with
+// a protocol tcp, udp or icmp, like udp:*:1024-65535.
+func ParseACL(allow, deny []string, geo *geoip.Database) (*ACL, error) {
+	acl := &ACL{}
+
+	for _, s := range allow {
+		entry, err := parseDestination(s, geo)
+		if err != nil {
+			return nil, fmt.Errorf("parse allow %s: %w", s, err)
+		}
+		acl.allow = append(acl.allow, entry)
+	}
+	for _, s := range deny {
+		entry, err := parseDestination(s, geo)
+		if err != nil {
+			return nil, fmt.Errorf("parse deny %s: %w", s, err)
+		}
+		acl.deny = append(acl.deny, entry)
+	}
+
+	return acl, nil
+}
+
+// parseDestination returns a destination by the given string, a CIDR or an IP with an optional port or a range of
+// ports, where IPv6 CIDRs are bracketed with ports, or a country or an autonomous system, with an optional protocol
+// prefix.
+func parseDestination(s string, geo *geoip.Database) (destination, error) {
+	var entry destination
+
+	for _, protocol := range []string{"tcp", "udp", "icmp"} {
+		if strings.HasPrefix(s, protocol+":") {
+			entry.protocol = protocol
+			s = s[len(protocol)+1:]
+			break
+		}
+	}
+
+	// Locations
+	if strings.HasPrefix(s, "country:") || strings.HasPrefix(s, "asn:") {
+		if geo == nil {
+			return entry, errors.New("missing geoip database")
+		}
+		entry.geo = geo
+
+		if strings.HasPrefix(s, "country:") {
+			entry.country = strings.ToUpper(s[len("country:"):])
+			if len(entry.country) != 2 {
+				return entry, fmt.Errorf("invalid country %s", entry.country)
+			}
+
+			return entry, nil
+		}
+
+		asnStr := strings.TrimPrefix(strings.ToUpper(s[len("asn:"):]), "AS")
+		asn, err := strconv.ParseUint(asnStr, 10, 32)
+		if err != nil || asn <= 0 {
+			return entry, fmt.Errorf("invalid asn %s", asnStr)
+		}
+		entry.asn = uint32(asn)
+
+		return entry, nil
+	}
+
+	hostStr, portStr := s, ""
+	if strings.HasPrefix(s, "[") || strings.Count(s, ":") == 1 {
+		var err error
+		hostStr, portStr, err = net.SplitHostPort(s)
+		if err != nil {
+			return entry, fmt.Errorf("split host port: %w", err)
+		}
+	}
+
+	switch {
+	case hostStr == "*":
+		break
+	case strings.Contains(hostStr, "/"):
+		_, ipNet, err := net.ParseCIDR(hostStr)
+		if err != nil {
+			return entry, fmt.Errorf("parse cidr: %w", err)
+		}
+		entry.ipNet = ipNet
+	default:
+		ip := net.ParseIP(hostStr)
+		if ip == nil {
+			return entry, fmt.Errorf("invalid ip %s", hostStr)
+		}
+		if ip.To4() != nil {
+			entry.ipNet = &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+		} else {
+			entry.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+		}
+	}
+
+	if portStr == "" {
+		return entry, nil
+	}
+
+	lowStr, highStr := portStr, portStr
+	if i := strings.Index(portStr, "-"); i >= 0 {
+		lowStr, highStr = portStr[:i], portStr[i+1:]
+	}
+	low, err := strconv.ParseUint(lowStr, 10, 16)
+	if err != nil {
+		return entry, fmt.Errorf("parse port %s: %w", lowStr, err)
+	}
+	high, err := strconv.ParseUint(highStr, 10, 16)
+	if err != nil {
+		return entry, fmt.Errorf("parse port %s: %w", highStr, err)
+	}
+	if low <= 0 || low > high {
+		return entry, fmt.Errorf("port range %s out of range", portStr)
+	}
+	if entry.protocol == "icmp" {
+		return entry, errors.New("ports of icmp not support")
+	}
+	entry.low, entry.high = uint16(low), uint16(high)
+
+	return entry, nil
+}
+
+// matches returns if the destination matches the entry. Destinations without ports, like ICMP and fragments, only
+// match entries without ports, and destinations without protocols, like fragments, only match entries without
+// protocols.
+func (entry destination) matches(protocol string, ip net.IP, port uint16) bool {
+	if entry.protocol != "" && entry.protocol != protocol {
+		return false
+	}
+	if !entry.contains(ip) {
+		return false
+	}
+	if entry.high <= 0 {
+		return true
+	}
+
+	return port >= entry.low && port <= entry.high
+}
+
+// contains returns if the IP is in the CIDR, the country or the autonomous system.
+func (entry destination) contains(ip net.IP) bool {
+	switch {
+	case entry.country != "":
+		return entry.geo.Lookup(ip).Country == entry.country
+	case entry.asn > 0:
+		return entry.geo.Lookup(ip).ASN == entry.asn
+	case entry.ipNet == nil:
+		return true
+	default:
+		return entry.ipNet.Contains(ip)
+	}
+}
+
+func (entry destination) String() string {
+	var s string
+	switch {
+	case entry.country != "":
+		s = fmt.Sprintf("country:%s", entry.country)
+	case entry.asn > 0:
+		s = fmt.Sprintf("asn:%d", entry.asn)
+	default:
+		host := "*"
+		if entry.ipNet != nil {
+			host = entry.ipNet.String()
+		}
+
+		switch {
+		case entry.high <= 0:
+			s = host
+		case entry.low == entry.high:
+			s = net.JoinHostPort(host, strconv.Itoa(int(entry.low)))
+		default:
+			s = net.JoinHostPort(host, fmt.Sprintf("%d-%d", entry.low, entry.high))
+		}
+	}
+
+	if entry.protocol == "" {
+		return s
+	}
+
+	return fmt.Sprintf("%s:%s", entry.protocol, s)
+}
+
+// splitAddr returns the protocol, the IP and the port of the address, where ports are only in TCP and UDP addresses,
+// and protocols are empty in IP addresses.
+func splitAddr(addr net.Addr) (string, net.IP, uint16) {
+	switch t := addr.(type) {
+	case *net.TCPAddr:
+		return "tcp", t.IP, uint16(t.Port)
+	case *net.UDPAddr:
+		return "udp", t.IP, uint16(t.Port)
+	case *net.IPAddr:
+		return "", t.IP, 0
+	case *ICMPQueryAddr:
+		return "icmp", t.IP, 0
+	default:
+		panic(fmt.Errorf("type %T not support", t))
+	}
+}
+
+// IsEmpty returns if the ACL allows any destination.
+func (acl *ACL) IsEmpty() bool {
+	return acl == nil || len(acl.allow) <= 0 && len(acl.deny) <= 0
+}
+
+// Allows returns if the destination is allowed. Ports are only in TCP and UDP addresses.
+func (acl *ACL) Allows(addr net.Addr) bool {
+	if acl.IsEmpty() {
+		return true
+	}
+
+	protocol, ip, port := splitAddr(addr)
+	for _, entry := range acl.deny {
+		if entry.matches(protocol, ip, port) {
+			return false
+		}
+	}
+	if len(acl.allow) <= 0 {
+		return true
+	}
+	for _, entry := range acl.allow {
+		if entry.matches(protocol, ip, port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (acl *ACL) String() string {
+	format := func(entries []destination) string {
+		s := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			s = append(s, entry.String())
+		}
+
+		return strings.Join(s, ", ")
+	}
+
+	if acl.IsEmpty() {
+		return "any"
+	}
+	if len(acl.allow) <= 0 {
+		return fmt.Sprintf("any except %s", format(acl.deny))
+	}
+	if len(acl.deny) <= 0 {
+		return format(acl.allow)
+	}
+
+	return fmt.Sprintf("%s except %s", format(acl.allow), format(acl.deny))
+}
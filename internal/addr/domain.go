@@ -0,0 +1,248 @@
+package addr
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// domainKeep is the minimum time destinations resolved are kept after they are resolved or seen last, so flows are
+	// not moved between the tunnel and the normal path while they are alive.
+	domainKeep = 5 * time.Minute
+	// domainSweepPeriod is the period destinations expired are swept in.
+	domainSweepPeriod = time.Minute
+)
+
+// Route describes how packets to a destination are routed in split tunneling.
+type Route int
+
+const (
+	// RouteTunnel carries packets by the tunnel.
+	RouteTunnel Route = iota
+	// RouteBypass leaves packets on the normal path.
+	RouteBypass
+)
+
+// ParseRoute returns a route by the given string, can be tunnel or bypass.
+func ParseRoute(s string) (Route, error) {
+	switch s {
+	case "tunnel":
+		return RouteTunnel, nil
+	case "bypass":
+		return RouteBypass, nil
+	default:
+		return RouteTunnel, fmt.Errorf("route %s not support", s)
+	}
+}
+
+func (route Route) String() string {
+	switch route {
+	case RouteTunnel:
+		return "tunnel"
+	case RouteBypass:
+		return "bypass"
+	default:
+		panic(fmt.Errorf("route %d not support", route))
+	}
+}
+
+// domainRoute describes a route of domains matching a pattern, which is a domain or a wildcard like *.nintendo.net
+// matching the domain and its subdomains.
+type domainRoute struct {
+	pattern string
+	route   Route
+}
+
+func (r domainRoute) matches(domain string) bool {
+	if !strings.HasPrefix(r.pattern, "*.") {
+		return domain == r.pattern
+	}
+	suffix := r.pattern[2:]
+
+	return domain == suffix || strings.HasSuffix(domain, "."+suffix)
+}
+
+type domainEntry struct {
+	route  Route
+	expire time.Time
+}
+
+// DomainRouter routes destinations by domains they are resolved from, which are learned from DNS responses. A nil
+// router routes no destination.
+type DomainRouter struct {
+	routes  []domainRoute
+	lock    sync.Mutex
+	entries map[string]*domainEntry
+	add     func(ip net.IP, route Route)
+	remove  func(ip net.IP, route Route)
+}
+
+// NewDomainRouter returns a new domain router by the given routes of patterns, and sweeps destinations expired in the
+// background. Functions add and remove are called when a destination enters and leaves a route, and can be nil.
+func NewDomainRouter(routes map[string]string, add, remove func(ip net.IP, route Route)) (*DomainRouter, error) {
+	r := &DomainRouter{entries: make(map[string]*domainEntry), add: add, remove: remove}
+
+	for pattern, s := range routes {
+		route, err := ParseRoute(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse route of %s: %w", pattern, err)
+		}
+		pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+		if pattern == "" || pattern == "*." {
+			return nil, errors.New("empty pattern")
+		}
+		r.routes = append(r.routes, domainRoute{pattern: pattern, route: route})
+	}
+
+	// More specific patterns are matched first, and a domain is more specific than a wildcard of the same suffix
+	sort.Slice(r.routes, func(i, j int) bool {
+		si, sj := strings.TrimPrefix(r.routes[i].pattern, "*."), strings.TrimPrefix(r.routes[j].pattern, "*.")
+		if len(si) != len(sj) {
+			return len(si) > len(sj)
+		}
+
+		return r.routes[i].pattern < r.routes[j].pattern
+	})
+
+	go func() {
+		for range time.Tick(domainSweepPeriod) {
+			r.sweep()
+		}
+	}()
+
+	return r, nil
+}
+
+// Match returns the route of the domain, and if any pattern matches it.
+func (r *DomainRouter) Match(domain string) (Route, bool) {
+	if r == nil {
+		return RouteTunnel, false
+	}
+
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	for _, route := range r.routes {
+		if route.matches(domain) {
+			return route.route, true
+		}
+	}
+
+	return RouteTunnel, false
+}
+
+// HasTunnel returns if any pattern is routed by the tunnel.
+func (r *DomainRouter) HasTunnel() bool {
+	if r == nil {
+		return false
+	}
+
+	for _, route := range r.routes {
+		if route.route == RouteTunnel {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Learn routes destinations resolved from the domain for the TTL, but no less than the minimum time kept. It returns
+// if the domain is routed.
+func (r *DomainRouter) Learn(domain string, ips []net.IP, ttl time.Duration) bool {
+	route, ok := r.Match(domain)
+	if !ok {
+		return false
+	}
+	if ttl < domainKeep {
+		ttl = domainKeep
+	}
+
+	type change struct {
+		ip   net.IP
+		last *domainEntry
+	}
+	changes := make([]change, 0)
+
+	r.lock.Lock()
+	expire := time.Now().Add(ttl)
+	for _, ip := range ips {
+		entry, ok := r.entries[ip.String()]
+		if ok && entry.route == route {
+			if expire.After(entry.expire) {
+				entry.expire = expire
+			}
+			continue
+		}
+
+		r.entries[ip.String()] = &domainEntry{route: route, expire: expire}
+		changes = append(changes, change{ip: ip, last: entry})
+	}
+	r.lock.Unlock()
+
+	// Hooks may be slow, and are called without holding the lock
+	for _, c := range changes {
+		if c.last != nil && r.remove != nil {
+			r.remove(c.ip, c.last.route)
+		}
+		if r.add != nil {
+			r.add(c.ip, route)
+		}
+	}
+
+	return true
+}
+
+// Lookup returns the route of the destination, and if it is resolved from a domain routed. Destinations looked up are
+// kept for the minimum time at least.
+func (r *DomainRouter) Lookup(ip net.IP) (Route, bool) {
+	if r == nil {
+		return RouteTunnel, false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	entry, ok := r.entries[ip.String()]
+	if !ok {
+		return RouteTunnel, false
+	}
+	expire := time.Now().Add(domainKeep)
+	if expire.After(entry.expire) {
+		entry.expire = expire
+	}
+
+	return entry.route, true
+}
+
+func (r *DomainRouter) sweep() {
+	now := time.Now()
+	expired := make(map[string]Route)
+
+	r.lock.Lock()
+	for k, entry := range r.entries {
+		if now.After(entry.expire) {
+			expired[k] = entry.route
+			delete(r.entries, k)
+		}
+	}
+	r.lock.Unlock()
+
+	if r.remove == nil {
+		return
+	}
+	for k, route := range expired {
+		r.remove(net.ParseIP(k), route)
+	}
+}
+
+func (r *DomainRouter) String() string {
+	s := make([]string, 0, len(r.routes))
+	for _, route := range r.routes {
+		s = append(s, fmt.Sprintf("%s via %s", route.pattern, route.route))
+	}
+
+	return strings.Join(s, ", ")
+}
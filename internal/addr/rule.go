@@ -0,0 +1,140 @@
+package addr
+
+import (
+	"fmt"
+	"ikago/internal/geoip"
+	"net"
+	"strings"
+)
+
+// TunnelRule describes destinations carried by the tunnel in split tunneling, which are a CIDR with a range of ports
+// in a protocol. Destinations matching no rule bypass the tunnel.
+type TunnelRule struct {
+	destination
+}
+
+// ParseTunnelRule returns a tunnel rule by the given string, a destination in the same format as ACLs, like
+// udp:198.51.100.0/24:27015-27030, tcp:[2001:db8::/32]:443, 10.0.0.0/8 and udp:country:JP.
+func ParseTunnelRule(s string, geo *geoip.Database) (*TunnelRule, error) {
+	entry, err := parseDestination(s, geo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TunnelRule{destination: entry}, nil
+}
+
+// IsLocation returns if the rule matches a country or an autonomous system, which has no CIDR or BPF filter, and is
+// matched in user space.
+func (rule *TunnelRule) IsLocation() bool {
+	return rule.country != "" || rule.asn > 0
+}
+
+// IPNet returns the CIDR of the rule, or nil if the rule matches any IP or is a location.
+func (rule *TunnelRule) IPNet() *net.IPNet {
+	return rule.ipNet
+}
+
+// Protocol returns the protocol of the rule, can be tcp, udp, icmp, or empty if it matches any protocol.
+func (rule *TunnelRule) Protocol() string {
+	return rule.protocol
+}
+
+// Ports returns the range of ports of the rule, which is empty if it matches any port.
+func (rule *TunnelRule) Ports() (low, high uint16) {
+	return rule.low, rule.high
+}
+
+// BPFFilter returns a BPF filter matching packets to destinations of the rule. Fragments to the CIDR are matched if
+// the rule has ports, because fragments except the first one have no ports. Rules of locations have no BPF filter.
+func (rule *TunnelRule) BPFFilter() string {
+	if rule.IsLocation() {
+		return ""
+	}
+
+	// Rules of any IP are in both IPv4 and IPv6
+	fs := make([]string, 0)
+	isIPv4, isIPv6 := true, true
+	if rule.ipNet != nil {
+		isIPv4 = rule.ipNet.IP.To4() != nil
+		isIPv6 = !isIPv4
+		ones, _ := rule.ipNet.Mask.Size()
+		fs = append(fs, fmt.Sprintf("dst net %s/%d", fullString(rule.ipNet.IP), ones))
+	}
+
+	var protocol string
+	switch rule.protocol {
+	case "tcp", "udp":
+		protocol = rule.protocol
+	case "icmp":
+		switch {
+		case isIPv4 && isIPv6:
+			protocol = "(icmp || icmp6)"
+		case isIPv4:
+			protocol = "icmp"
+		default:
+			protocol = "icmp6"
+		}
+	}
+
+	if rule.high <= 0 {
+		if protocol != "" {
+			fs = append(fs, protocol)
+		}
+		if len(fs) <= 0 {
+			return "(ip || ip6)"
+		}
+
+		return fmt.Sprintf("(%s)", strings.Join(fs, " && "))
+	}
+
+	port := fmt.Sprintf("dst port %d", rule.low)
+	if rule.low != rule.high {
+		port = fmt.Sprintf("dst portrange %d-%d", rule.low, rule.high)
+	}
+	if protocol != "" {
+		port = fmt.Sprintf("%s %s", protocol, port)
+	}
+	frags := make([]string, 0, 2)
+	if isIPv4 {
+		frags = append(frags, "(ip[6:2] & 0x1fff) != 0")
+	}
+	if isIPv6 {
+		frags = append(frags, "ip6[6] == 44")
+	}
+	fs = append(fs, fmt.Sprintf("(%s || %s)", port, strings.Join(frags, " || ")))
+
+	return fmt.Sprintf("(%s)", strings.Join(fs, " && "))
+}
+
+// Matches returns if the destination matches the rule. Destinations of IP addresses, like fragments, match rules of
+// the CIDR or the location regardless of protocols and ports.
+func (rule *TunnelRule) Matches(addr net.Addr) bool {
+	protocol, ip, port := splitAddr(addr)
+	if protocol == "" {
+		return rule.contains(ip)
+	}
+
+	return rule.matches(protocol, ip, port)
+}
+
+// MatchesTunnelRules returns if the destination matches any of the rules.
+func MatchesTunnelRules(rules []*TunnelRule, addr net.Addr) bool {
+	for _, rule := range rules {
+		if rule.Matches(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TunnelBPFFilter returns a BPF filter matching packets to destinations of any of the rules.
+func TunnelBPFFilter(rules []*TunnelRule) string {
+	fs := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		fs = append(fs, rule.BPFFilter())
+	}
+
+	return strings.Join(fs, " || ")
+}
@@ -0,0 +1,72 @@
+package addr
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IsSRVName returns if the address is the name of SRV records, like _ikago._tcp.example.com, which has no port and
+// starts with an underscore.
+func IsSRVName(s string) bool {
+	return strings.HasPrefix(s, "_") && !strings.Contains(s, ":")
+}
+
+// LookupSRV returns addresses of servers in SRV records of the name, in order of their priorities and randomized by
+// their weights, and their weights. Targets are resolved to their first IP.
+func LookupSRV(name string) ([]*net.TCPAddr, []int, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("lookup srv: %w", err)
+	}
+
+	addrs, weights := make([]*net.TCPAddr, 0, len(records)), make([]int, 0, len(records))
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		// A target of . means the service is not available in the domain
+		if target == "" {
+			continue
+		}
+
+		ips, err := net.LookupIP(target)
+		if err != nil {
+			return nil, nil, fmt.Errorf("lookup %s: %w", target, err)
+		}
+
+		addrs = append(addrs, &net.TCPAddr{IP: ips[0], Port: int(record.Port)})
+		weights = append(weights, int(record.Weight))
+	}
+	if len(addrs) <= 0 {
+		return nil, nil, errors.New("service not available")
+	}
+
+	return addrs, weights, nil
+}
+
+// LookupParams returns parameters in TXT records of the name, which are pairs like key=value separated by spaces, like
+// mode=faketcp obfs=http. Names without TXT records have no parameter.
+func LookupParams(name string) (map[string]string, error) {
+	records, err := net.LookupTXT(name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return make(map[string]string), nil
+		}
+
+		return nil, fmt.Errorf("lookup txt: %w", err)
+	}
+
+	result := make(map[string]string)
+	for _, record := range records {
+		for _, pair := range strings.Fields(record) {
+			i := strings.Index(pair, "=")
+			if i <= 0 {
+				return nil, fmt.Errorf("invalid parameter %s", pair)
+			}
+			result[pair[:i]] = pair[i+1:]
+		}
+	}
+
+	return result, nil
+}
@@ -5,29 +5,112 @@
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"strings"
 )
 
 // Config describes the configuration of IkaGo.
 type Config struct {
-	ListenDevs []string  `json:"listen-devices"`
-	UpDev      string    `json:"upstream-device"`
-	Gateway    string    `json:"gateway"`
-	Mode       string    `json:"mode"`
-	Method     string    `json:"method"`
-	Password   string    `json:"password"`
-	Rule       bool      `json:"rule"`
-	Verbose    bool      `json:"verbose"`
-	Log        string    `json:"log"`
-	Monitor    int       `json:"monitor"`
-	MTU        int       `json:"mtu"`
-	KCP        bool      `json:"kcp"`
-	KCPConfig  KCPConfig `json:"kcp-tuning"`
-	Port       int       `json:"port"`
-	Publish    string    `json:"publish"`
-	Sources    []string  `json:"sources"`
-	Server     string    `json:"server"`
+	ListenDevs  []string          `json:"listen-devices"`
+	UpDev       string            `json:"upstream-device"`
+	Backends    map[string]string `json:"backends"`
+	SnapLen     int               `json:"pcap-snaplen"`
+	Buffer      int               `json:"pcap-buffer"`
+	Immediate   bool              `json:"pcap-immediate"`
+	Timeout     int               `json:"pcap-timeout"`
+	Batch       int               `json:"batch"`
+	BusyPoll    bool              `json:"busy-poll"`
+	Workers     int               `json:"workers"`
+	QueueSize   int               `json:"queue-size"`
+	QueuePolicy map[string]string `json:"queue-policies"`
+	QoS         []string          `json:"qos"`
+	DropLog     int               `json:"drop-log"`
+	MemoryLimit int               `json:"memory-limit"`
+	Shape       int               `json:"shape"`
+	ShapeBurst  int               `json:"shape-burst"`
+	Gateway     string            `json:"gateway"`
+	Mode        string            `json:"mode"`
+	Method      string            `json:"method"`
+	Password    string            `json:"password"`
+	PassFile    string            `json:"password-file"`
+	PassCmd     string            `json:"password-cmd"`
+	KDF         string            `json:"kdf"`
+	KDFMemory   int               `json:"kdf-memory"`
+	KDFIters    int               `json:"kdf-iterations"`
+	RekeyTime   int               `json:"rekey-interval"`
+	RekeyBytes  int               `json:"rekey-bytes"`
+	KeyExchange bool              `json:"key-exchange"`
+	PrivateKey  string            `json:"private-key"`
+	PeerKeys    []string          `json:"peer-keys"`
+	Rule        bool              `json:"rule"`
+	Verbose     bool              `json:"verbose"`
+	Log         string            `json:"log"`
+	LogFormat   string            `json:"log-format"`
+	LogSize     int               `json:"log-max-size"`
+	LogInterval int               `json:"log-rotate-interval"`
+	LogBackups  int               `json:"log-backups"`
+	LogCompress bool              `json:"log-compress"`
+	LogSyslog   string            `json:"log-syslog"`
+	LogEventLog bool              `json:"log-eventlog"`
+	Monitor     int               `json:"monitor"`
+	Control     string            `json:"control"`
+	Dump        string            `json:"dump"`
+	DumpLayer   string            `json:"dump-layer"`
+	Trace       string            `json:"trace"`
+	TraceSample int               `json:"trace-sample"`
+	PProf       string            `json:"pprof"`
+	MTU         int               `json:"mtu"`
+	NoECN       bool              `json:"no-ecn"`
+	TTL         string            `json:"ttl"`
+	DSCP        string            `json:"dscp"`
+	Emulate     bool              `json:"emulate"`
+	SYNOptions  string            `json:"syn-options"`
+	KeepAlive   int               `json:"keepalive"`
+	Fingerprint string            `json:"fingerprint"`
+	Pace        int               `json:"pace"`
+	Obfs        string            `json:"obfs"`
+	Bridge      bool              `json:"bridge"`
+	Allow       []string          `json:"allow"`
+	Deny        []string          `json:"deny"`
+	GeoIP       []string          `json:"geoip"`
+	GeoIPReload int               `json:"geoip-reload-interval"`
+	KCP         bool              `json:"kcp"`
+	KCPConfig   KCPConfig         `json:"kcp-tuning"`
+	Port        int               `json:"port"`
+	Clients     map[string]string `json:"clients"`
+	RateLimits  RateLimits        `json:"rate-limits"`
+	NATConfig   NATConfig         `json:"nat-timeouts"`
+	NATFile     string            `json:"nat-file"`
+	NATSave     int               `json:"nat-save-interval"`
+	NATType     string            `json:"nat-type"`
+	NATMax      int               `json:"nat-max-entries"`
+	NATBlock    int               `json:"nat-port-block"`
+	NATPeers    []string          `json:"nat-peers"`
+	NATGossip   int               `json:"nat-gossip-port"`
+	Standby     bool              `json:"standby"`
+	AcctFile    string            `json:"accounting-file"`
+	ALG         []string          `json:"alg"`
+	Upstream    string            `json:"upstream"`
+	Publish     string            `json:"publish"`
+	Tunnel      []string          `json:"tunnel"`
+	DomainRoute map[string]string `json:"domain-routes"`
+	Sources     []string          `json:"sources"`
+	Server      string            `json:"server"`
+	Servers     []string          `json:"servers"`
+	Balance     string            `json:"balance"`
+	Probe       int               `json:"probe-interval"`
+	ProbeLoss   int               `json:"probe-loss"`
+	Multipath   string            `json:"multipath"`
+	Roaming     bool              `json:"roaming"`
+	Socks       string            `json:"socks"`
+	HTTPProxy   string            `json:"http-proxy"`
+	Transparent string            `json:"transparent"`
+	TProxy      bool              `json:"tproxy"`
 }
 
 // NewConfig returns a new config.
@@ -36,54 +119,227 @@ func NewConfig() *Config {
 		Mode:      "faketcp",
 		Method:    "plain",
 		KCPConfig: *NewKCPConfig(),
+		NATConfig: *NewNATConfig(),
 		Sources:   make([]string, 0),
 	}
 }
 
-// ParseFile returns the config parsed from file.
-func ParseFile(path string) (*Config, error) {
+// ParseFile returns the config parsed from file. The format is detected by the extension, files in .yaml, .yml and
+// .toml are parsed as YAML and TOML, and others are parsed as JSON. If profile is not empty, options in the profile of
+// profiles override options outside.
+func ParseFile(path, profile string) (*Config, error) {
 	config := NewConfig()
 
+	buffer, isJSON, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Include
+	var include struct {
+		Include interface{} `json:"include"`
+	}
+	err = json.Unmarshal(buffer, &include)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", locate(err, buffer, isJSON))
+	}
+	if include.Include != nil {
+		buffer, err = mergeFile(path)
+		if err != nil {
+			return nil, err
+		}
+		isJSON = false
+	}
+
+	// Unmarshal
+	err = json.Unmarshal(buffer, config)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", locate(err, buffer, isJSON))
+	}
+
+	// Profile
+	if profile != "" {
+		var profiles struct {
+			Profiles map[string]json.RawMessage `json:"profiles"`
+		}
+		err = json.Unmarshal(buffer, &profiles)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal profiles: %w", err)
+		}
+
+		data, ok := profiles.Profiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("profile %s not found", profile)
+		}
+
+		err = json.Unmarshal(data, config)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal profile %s: %w", profile, locate(err, nil, false))
+		}
+	}
+
+	return config, nil
+}
+
+// readFile returns the file converted to JSON, and if the file is originally in JSON.
+func readFile(path string) ([]byte, bool, error) {
 	// Open file
 	file, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("open: %w", err)
+		return nil, false, fmt.Errorf("open: %w", err)
 	}
+	defer file.Close()
 
 	fi, err := file.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("stat: %w", err)
+		return nil, false, fmt.Errorf("stat: %w", err)
 	}
 
 	// Empty file
 	size := fi.Size()
 	if size == 0 {
-		return nil, errors.New("empty file")
+		return nil, false, errors.New("empty file")
 	}
 
 	// Read file
 	buffer := make([]byte, size)
 	_, err = file.Read(buffer)
 	if err != nil {
-		return nil, fmt.Errorf("read: %w", err)
+		return nil, false, fmt.Errorf("read: %w", err)
 	}
 
-	// Trim comments
-	buffer, err = trimComments(buffer)
-	if err != nil {
-		return nil, fmt.Errorf("trim comments: %w", err)
+	// Convert YAML and TOML to JSON, keys are the same in all formats
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		buffer, err = yamlToJSON([]byte(os.ExpandEnv(string(buffer))))
+		if err != nil {
+			return nil, false, fmt.Errorf("parse yaml: %w", err)
+		}
+	case ".toml":
+		buffer, err = tomlToJSON([]byte(os.ExpandEnv(string(buffer))))
+		if err != nil {
+			return nil, false, fmt.Errorf("parse toml: %w", err)
+		}
+	default:
+		// Trim comments
+		buffer, err = trimComments(buffer)
+		if err != nil {
+			return nil, false, fmt.Errorf("trim comments: %w", err)
+		}
+
+		// Expand environment variables
+		buffer = []byte(os.ExpandEnv(string(buffer)))
+
+		return buffer, true, nil
 	}
 
-	// Expand environment variables
-	buffer = []byte(os.ExpandEnv(string(buffer)))
+	return buffer, false, nil
+}
 
-	// Unmarshal
-	err = json.Unmarshal(buffer, config)
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	err := yaml.Unmarshal(data, &v)
 	if err != nil {
 		return nil, fmt.Errorf("unmarshal: %w", err)
 	}
 
-	return config, nil
+	v, err = convertYAML(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+// convertYAML converts maps in YAML, whose keys may be any type, to maps with string keys, which can be marshaled
+// into JSON.
+func convertYAML(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{})
+		for key, value := range t {
+			k, ok := key.(string)
+			if !ok {
+				k = fmt.Sprint(key)
+			}
+
+			value, err := convertYAML(value)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = value
+		}
+
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, len(t))
+		for i, value := range t {
+			value, err := convertYAML(value)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = value
+		}
+
+		return result, nil
+	default:
+		return v, nil
+	}
+}
+
+func tomlToJSON(data []byte) ([]byte, error) {
+	v := make(map[string]interface{})
+	_, err := toml.Decode(string(data), &v)
+	if err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+
+	return json.Marshal(v)
+}
+
+// Diff returns keys of options which are different in two configs.
+func Diff(a, b *Config) []string {
+	result := make([]string, 0)
+
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			result = append(result, va.Type().Field(i).Tag.Get("json"))
+		}
+	}
+
+	return result
+}
+
+// locate returns the error with the key and, if the data is the original JSON, the line and column it occurs.
+func locate(err error, data []byte, isJSON bool) error {
+	var offset int64
+	switch t := err.(type) {
+	case *json.SyntaxError:
+		offset = t.Offset
+	case *json.UnmarshalTypeError:
+		offset = t.Offset
+		if t.Field != "" {
+			err = fmt.Errorf("key %s: %w", t.Field, err)
+		}
+	default:
+		return err
+	}
+	if !isJSON || offset <= 0 || offset > int64(len(data)) {
+		return err
+	}
+
+	line, column := 1, 1
+	for _, b := range data[:offset-1] {
+		if b == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+
+	return fmt.Errorf("line %d column %d: %w", line, column, err)
 }
 
 func trimComments(data []byte) ([]byte, error) {
@@ -99,7 +355,10 @@ func trimComments(data []byte) ([]byte, error) {
 			return nil, fmt.Errorf("match: %w", err)
 		}
 
-		if !match {
+		// Comments are left as empty lines, so lines of errors are not shifted
+		if match {
+			filtered = append(filtered, []byte{})
+		} else {
 			filtered = append(filtered, line)
 		}
 	}
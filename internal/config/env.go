@@ -0,0 +1,192 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is the prefix of environment variables overriding options.
+const EnvPrefix = "IKAGO_"
+
+// EnvName returns the name of the environment variable of the key. Keys in nested options are joined with dots, like
+// kcp-tuning.mtu, whose environment variable is IKAGO_KCP_TUNING_MTU.
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+}
+
+// ApplyEnv overrides options in the config by environment variables, except options of keys in skip, and returns keys
+// of options overridden. Lists are separated by commas, and maps are either in JSON or pairs like key:value separated
+// by commas, where maps of objects are in JSON only.
+func ApplyEnv(config *Config, skip []string) ([]string, error) {
+	skipped := make(map[string]bool)
+	for _, key := range skip {
+		skipped[key] = true
+	}
+
+	return applyEnv(reflect.ValueOf(config).Elem(), "", skipped)
+}
+
+// ApplyParams sets options in the config by parameters of their keys, in the same format as environment variables, and
+// returns keys of options set. Only options left as default are set, so options set already are kept.
+func ApplyParams(config *Config, params map[string]string) ([]string, error) {
+	result, err := applyParams(reflect.ValueOf(config).Elem(), reflect.ValueOf(NewConfig()).Elem(), "", params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unknown options
+	known := make(map[string]bool)
+	checkKeys(reflect.TypeOf(*config), "", known)
+	for key := range params {
+		if !known[key] {
+			return nil, fmt.Errorf("unknown option %s", key)
+		}
+	}
+
+	return result, nil
+}
+
+func applyParams(v, defaults reflect.Value, prefix string, params map[string]string) ([]string, error) {
+	result := make([]string, 0)
+
+	for i := 0; i < v.NumField(); i++ {
+		key := prefix + v.Type().Field(i).Tag.Get("json")
+		field := v.Field(i)
+
+		// Nested options
+		if field.Kind() == reflect.Struct {
+			keys, err := applyParams(field, defaults.Field(i), key+".", params)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, keys...)
+			continue
+		}
+
+		s, ok := params[key]
+		if !ok || !reflect.DeepEqual(field.Interface(), defaults.Field(i).Interface()) {
+			continue
+		}
+
+		err := setEnv(field, s)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", key, err)
+		}
+		result = append(result, key)
+	}
+
+	return result, nil
+}
+
+func checkKeys(t reflect.Type, prefix string, keys map[string]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		key := prefix + t.Field(i).Tag.Get("json")
+		if t.Field(i).Type.Kind() == reflect.Struct {
+			checkKeys(t.Field(i).Type, key+".", keys)
+			continue
+		}
+		keys[key] = true
+	}
+}
+
+func applyEnv(v reflect.Value, prefix string, skipped map[string]bool) ([]string, error) {
+	result := make([]string, 0)
+
+	for i := 0; i < v.NumField(); i++ {
+		key := prefix + v.Type().Field(i).Tag.Get("json")
+		field := v.Field(i)
+
+		// Nested options
+		if field.Kind() == reflect.Struct {
+			keys, err := applyEnv(field, key+".", skipped)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, keys...)
+			continue
+		}
+
+		if skipped[key] {
+			continue
+		}
+		s, ok := os.LookupEnv(EnvName(key))
+		if !ok {
+			continue
+		}
+
+		err := setEnv(field, s)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", EnvName(key), err)
+		}
+		result = append(result, key)
+	}
+
+	return result, nil
+}
+
+func setEnv(field reflect.Value, s string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Slice:
+		result := make([]string, 0)
+		for _, str := range strings.Split(s, ",") {
+			str = strings.Trim(str, " ")
+			if str != "" {
+				result = append(result, str)
+			}
+		}
+		field.Set(reflect.ValueOf(result))
+	case reflect.Map:
+		// Maps of objects are in JSON only
+		if field.Type().Elem().Kind() != reflect.String {
+			result := reflect.New(field.Type())
+			err := json.Unmarshal([]byte(s), result.Interface())
+			if err != nil {
+				return err
+			}
+			field.Set(result.Elem())
+			break
+		}
+
+		result := make(map[string]string)
+		if strings.HasPrefix(strings.TrimSpace(s), "{") {
+			err := json.Unmarshal([]byte(s), &result)
+			if err != nil {
+				return err
+			}
+		} else {
+			for _, str := range strings.Split(s, ",") {
+				if strings.Trim(str, " ") == "" {
+					continue
+				}
+				kv := strings.SplitN(str, ":", 2)
+				if len(kv) != 2 {
+					return fmt.Errorf("invalid pair %s", str)
+				}
+				result[strings.Trim(kv[0], " ")] = strings.Trim(kv[1], " ")
+			}
+		}
+		field.Set(reflect.ValueOf(result))
+	default:
+		return fmt.Errorf("type %s not support", field.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// fragments describes files merged by include, and which file defines each key.
+type fragments struct {
+	values  map[string]interface{}
+	owners  map[string]string
+	visited map[string]bool
+}
+
+// mergeFile returns the file merged with files in include in JSON. Files in include are relative to the file including
+// them, and may include other files. Objects are merged by keys, and other keys defined in multiple files conflict.
+func mergeFile(path string) ([]byte, error) {
+	f := &fragments{
+		values:  make(map[string]interface{}),
+		owners:  make(map[string]string),
+		visited: make(map[string]bool),
+	}
+
+	err := f.merge(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(f.values)
+}
+
+func (f *fragments) merge(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("abs %s: %w", path, err)
+	}
+	if f.visited[abs] {
+		return fmt.Errorf("include %s circularly", path)
+	}
+	f.visited[abs] = true
+	defer delete(f.visited, abs)
+
+	buffer, isJSON, err := readFile(path)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+
+	values := make(map[string]interface{})
+	err = json.Unmarshal(buffer, &values)
+	if err != nil {
+		return fmt.Errorf("unmarshal %s: %w", path, locate(err, buffer, isJSON))
+	}
+
+	// Include
+	includes, err := parseInclude(values["include"])
+	if err != nil {
+		return fmt.Errorf("parse include in %s: %w", path, err)
+	}
+	delete(values, "include")
+
+	err = f.mergeValues(f.values, values, "", path)
+	if err != nil {
+		return err
+	}
+
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+
+		err := f.merge(include)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeValues merges values defined in the file into dst.
+func (f *fragments) mergeValues(dst, src map[string]interface{}, prefix, path string) error {
+	for k, v := range src {
+		key := prefix + k
+
+		old, ok := dst[k]
+		if !ok {
+			dst[k] = v
+			f.owners[key] = path
+			continue
+		}
+
+		oldMap, isOldMap := old.(map[string]interface{})
+		newMap, isNewMap := v.(map[string]interface{})
+		if isOldMap && isNewMap {
+			err := f.mergeValues(oldMap, newMap, key+".", path)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		return fmt.Errorf("key %s defined in both %s and %s", key, f.owner(key), path)
+	}
+
+	return nil
+}
+
+// owner returns the file defines the key, or its nearest parent.
+func (f *fragments) owner(key string) string {
+	for {
+		path, ok := f.owners[key]
+		if ok {
+			return path
+		}
+
+		index := strings.LastIndex(key, ".")
+		if index < 0 {
+			return ""
+		}
+		key = key[:index]
+	}
+}
+
+func parseInclude(v interface{}) ([]string, error) {
+	switch t := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{t}, nil
+	case []interface{}:
+		result := make([]string, 0)
+		for _, include := range t {
+			s, ok := include.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid file %v", include)
+			}
+			result = append(result, s)
+		}
+
+		return result, nil
+	default:
+		return nil, errors.New("invalid include")
+	}
+}
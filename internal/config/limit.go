@@ -0,0 +1,15 @@
+package config
+
+// RateLimits describes rate limits of clients, which map clients to their limits.
+type RateLimits map[string]RateLimitConfig
+
+// RateLimitConfig describes rate limits of a client in packets and Bytes per second, 0 as unlimited. Up is traffic
+// from the client to destinations, and down is traffic from destinations to the client. Limits with a schedule like
+// 20:00-23:00 are only in effect in the schedule.
+type RateLimitConfig struct {
+	UpPackets   int    `json:"up-pps"`
+	UpBytes     int    `json:"up-bytes"`
+	DownPackets int    `json:"down-pps"`
+	DownBytes   int    `json:"down-bytes"`
+	Schedule    string `json:"schedule"`
+}
@@ -0,0 +1,19 @@
+package config
+
+// NATConfig describes idle timeouts of NAT mappings in seconds.
+type NATConfig struct {
+	UDP            int `json:"udp"`
+	TCPEstablished int `json:"tcp-established"`
+	TCPTransitory  int `json:"tcp-transitory"`
+	ICMP           int `json:"icmp"`
+}
+
+// NewNATConfig returns a new NAT config, whose timeouts follow RFC 4787, RFC 5382 and RFC 5508.
+func NewNATConfig() *NATConfig {
+	return &NATConfig{
+		UDP:            300,
+		TCPEstablished: 7440,
+		TCPTransitory:  240,
+		ICMP:           60,
+	}
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// ReadPassword returns the password read from the file, or printed by the command in the shell. Trailing line breaks
+// are trimmed.
+func ReadPassword(file, command string) ([]byte, error) {
+	var (
+		result []byte
+		err    error
+	)
+
+	switch {
+	case file != "":
+		result, err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", file, err)
+		}
+	case command != "":
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", command)
+		} else {
+			cmd = exec.Command("sh", "-c", command)
+		}
+		cmd.Stderr = os.Stderr
+
+		result, err = cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("run %s: %w", command, err)
+		}
+	default:
+		return nil, errors.New("missing file or command")
+	}
+
+	result = bytes.TrimRight(result, "\r\n")
+	if len(result) <= 0 {
+		return nil, errors.New("empty password")
+	}
+
+	return result, nil
+}
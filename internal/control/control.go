@@ -0,0 +1,154 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Handler handles a command with arguments, and returns the result which is marshaled in JSON.
+type Handler func(args []string) (interface{}, error)
+
+// request describes a request of a command in the control protocol.
+type request struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// response describes a response of a command in the control protocol.
+type response struct {
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Server describes a control server which handles commands from a Unix domain socket, or a named pipe in Windows. Each
+// connection carries one request and one response in JSON in lines.
+type Server struct {
+	lock     sync.RWMutex
+	listener net.Listener
+	handlers map[string]Handler
+}
+
+// Listen returns a control server listening on the path, which is a Unix domain socket, or a named pipe like
+// \\.\pipe\ikago in Windows.
+func Listen(path string) (*Server, error) {
+	listener, err := listen(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		listener: listener,
+		handlers: make(map[string]Handler),
+	}, nil
+}
+
+// Handle registers the handler of the command.
+func (s *Server) Handle(command string, handler Handler) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.handlers[command] = handler
+}
+
+// Serve accepts connections and handles commands until the server is closed.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var (
+		req  request
+		resp response
+	)
+
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		return
+	}
+
+	err := json.Unmarshal(scanner.Bytes(), &req)
+	if err != nil {
+		resp.Error = fmt.Errorf("unmarshal: %s", err).Error()
+	} else {
+		s.lock.RLock()
+		handler, ok := s.handlers[req.Command]
+		s.lock.RUnlock()
+
+		if !ok {
+			resp.Error = fmt.Sprintf("command %s not support", req.Command)
+		} else {
+			resp.Result, err = handler(req.Args)
+			if err != nil {
+				resp.Error = err.Error()
+			}
+		}
+	}
+
+	b, err := json.Marshal(&resp)
+	if err != nil {
+		b, _ = json.Marshal(&response{Error: fmt.Errorf("marshal: %s", err).Error()})
+	}
+	conn.Write(append(b, '\n'))
+}
+
+// Close closes the server.
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// Request sends the command with arguments to the control server listening on the path, and returns the result in
+// JSON.
+func Request(path, command string, args []string) (json.RawMessage, error) {
+	conn, err := dial(path)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+
+	b, err := json.Marshal(&request{Command: command, Args: args})
+	if err != nil {
+		return nil, fmt.Errorf("marshal: %w", err)
+	}
+
+	_, err = conn.Write(append(b, '\n'))
+	if err != nil {
+		return nil, fmt.Errorf("write: %w", err)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	if !scanner.Scan() {
+		err := scanner.Err()
+		if err == nil {
+			err = errors.New("connection closed")
+		}
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  string          `json:"error"`
+	}
+	err = json.Unmarshal(scanner.Bytes(), &resp)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+
+	return resp.Result, nil
+}
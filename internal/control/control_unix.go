@@ -0,0 +1,43 @@
+// +build !windows
+
+package control
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+func listen(path string) (net.Listener, error) {
+	// Remove the stale socket left by an unclean exit
+	fi, err := os.Stat(path)
+	if err == nil && fi.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s in use", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("remove stale socket %s: %w", path, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %w", path, err)
+	}
+
+	// Only the owner can control
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("chmod %s: %w", path, err)
+	}
+
+	return listener, nil
+}
+
+func dial(path string) (net.Conn, error) {
+	return net.Dial("unix", path)
+}
@@ -0,0 +1,22 @@
+// +build windows
+
+package control
+
+import (
+	"fmt"
+	"github.com/Microsoft/go-winio"
+	"net"
+)
+
+func listen(path string) (net.Listener, error) {
+	listener, err := winio.ListenPipe(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %w", path, err)
+	}
+
+	return listener, nil
+}
+
+func dial(path string) (net.Conn, error) {
+	return winio.DialPipe(path, nil)
+}
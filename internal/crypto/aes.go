@@ -3,110 +3,44 @@
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"errors"
-	"fmt"
 )
 
-// AESCFBCrypt describes an AES-CFB crypt.
-type AESCFBCrypt struct {
-	block     cipher.Block
-	encrypter cipher.Stream
-	decrypter cipher.Stream
-}
-
-// CreateAESCFBCrypt returns an AES-CFB crypt by given key and IV.
-func CreateAESCFBCrypt(key, iv []byte) (*AESCFBCrypt, error) {
-	// Cipher
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("new cipher: %w", err)
-	}
-
-	encrypter := cipher.NewCFBEncrypter(block, iv)
-	decrypter := cipher.NewCFBDecrypter(block, iv)
-
-	return &AESCFBCrypt{
-		block:     block,
-		encrypter: encrypter,
-		decrypter: decrypter,
-	}, nil
-}
-
-func (c *AESCFBCrypt) Encrypt(data []byte) ([]byte, error) {
-	result := make([]byte, len(data))
-
-	c.encrypter.XORKeyStream(data, result)
-
-	return result, nil
-}
-
-func (c *AESCFBCrypt) Decrypt(data []byte) ([]byte, error) {
-	result := make([]byte, len(data))
-
-	c.decrypter.XORKeyStream(data, result)
-
-	return result, nil
-}
-
-func (c *AESCFBCrypt) Method() Method {
-	return MethodAESCFB
-}
-
-func (c *AESCFBCrypt) Cost() int {
-	return 0
-}
-
 // AESGCMCrypt describes an AES-GCM crypt.
 type AESGCMCrypt struct {
-	block cipher.Block
-	aead  cipher.AEAD
+	crypt *sessionCrypt
 }
 
-// CreateAESGCMCrypt returns an AES-GCM crypt by given key.
+// CreateAESGCMCrypt returns an AES-GCM crypt by given key. Both sides send packets in the same direction, so it is
+// for peers which are neither client nor server.
 func CreateAESGCMCrypt(key []byte) (*AESGCMCrypt, error) {
-	// Cipher
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("new cipher: %w", err)
-	}
+	return newAESGCMCrypt(key, directionBoth)
+}
 
-	// AEAD
-	aead, err := cipher.NewGCM(block)
+func newAESGCMCrypt(key []byte, send direction) (*AESGCMCrypt, error) {
+	crypt, err := newSessionCrypt(key, newGCM, send)
 	if err != nil {
-		return nil, fmt.Errorf("new cipher: %w", err)
+		return nil, err
 	}
 
-	return &AESGCMCrypt{
-		block: block,
-		aead:  aead,
-	}, nil
+	return &AESGCMCrypt{crypt: crypt}, nil
 }
 
-func (c *AESGCMCrypt) Encrypt(data []byte) ([]byte, error) {
-	nonce, err := GenerateNonce(c.aead.NonceSize())
+// newGCM returns an AES-GCM AEAD by given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, fmt.Errorf("generate nonce: %w", err)
+		return nil, err
 	}
 
-	result := c.aead.Seal(nil, nonce, data, nil)
-	result = append(nonce, result...)
+	return cipher.NewGCM(block)
+}
 
-	return result, nil
+func (c *AESGCMCrypt) Encrypt(data []byte) ([]byte, error) {
+	return c.crypt.Encrypt(data)
 }
 
 func (c *AESGCMCrypt) Decrypt(data []byte) ([]byte, error) {
-	size := c.aead.NonceSize()
-	if len(data) < size {
-		return nil, errors.New("missing nonce")
-	}
-	nonce := data[:size]
-
-	result, err := c.aead.Open(nil, nonce, data[size:], nil)
-	if err != nil {
-		return nil, fmt.Errorf("open: %w", err)
-	}
-
-	return result, nil
+	return c.crypt.Decrypt(data)
 }
 
 func (c *AESGCMCrypt) Method() Method {
@@ -114,5 +48,5 @@ func (c *AESGCMCrypt) Method() Method {
 }
 
 func (c *AESGCMCrypt) Cost() int {
-	return c.aead.NonceSize() + 16
+	return c.crypt.Cost()
 }
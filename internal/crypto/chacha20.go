@@ -1,54 +1,35 @@
 package crypto
 
 import (
-	"crypto/cipher"
-	"errors"
-	"fmt"
 	"golang.org/x/crypto/chacha20poly1305"
-	"golang.org/x/crypto/poly1305"
 )
 
 // ChaCha20Poly1305Crypt describes an ChaCha20-Poly1305 crypt.
 type ChaCha20Poly1305Crypt struct {
-	aead cipher.AEAD
+	crypt *sessionCrypt
 }
 
-// CreateChaCha20Poly1305Crypt returns an ChaCha20-Poly1305 crypt by given key.
+// CreateChaCha20Poly1305Crypt returns an ChaCha20-Poly1305 crypt by given key. Both sides send packets in the same
+// direction, so it is for peers which are neither client nor server.
 func CreateChaCha20Poly1305Crypt(key []byte) (*ChaCha20Poly1305Crypt, error) {
-	// AEAD
-	aead, err := chacha20poly1305.New(key)
-	if err != nil {
-		return nil, fmt.Errorf("new aead: %w", err)
-	}
-
-	return &ChaCha20Poly1305Crypt{aead: aead}, nil
+	return newChaCha20Poly1305Crypt(key, directionBoth)
 }
 
-func (c *ChaCha20Poly1305Crypt) Encrypt(data []byte) ([]byte, error) {
-	nonce, err := GenerateNonce(c.aead.NonceSize())
+func newChaCha20Poly1305Crypt(key []byte, send direction) (*ChaCha20Poly1305Crypt, error) {
+	crypt, err := newSessionCrypt(key, chacha20poly1305.New, send)
 	if err != nil {
-		return nil, fmt.Errorf("generate nonce: %w", err)
+		return nil, err
 	}
 
-	result := c.aead.Seal(nil, nonce, data, nil)
-	result = append(nonce, result...)
+	return &ChaCha20Poly1305Crypt{crypt: crypt}, nil
+}
 
-	return result, nil
+func (c *ChaCha20Poly1305Crypt) Encrypt(data []byte) ([]byte, error) {
+	return c.crypt.Encrypt(data)
 }
 
 func (c *ChaCha20Poly1305Crypt) Decrypt(data []byte) ([]byte, error) {
-	size := c.aead.NonceSize()
-	if len(data) < size {
-		return nil, errors.New("missing nonce")
-	}
-	nonce := data[:size]
-
-	result, err := c.aead.Open(nil, nonce, data[size:], nil)
-	if err != nil {
-		return nil, fmt.Errorf("open: %w", err)
-	}
-
-	return result, nil
+	return c.crypt.Decrypt(data)
 }
 
 func (c *ChaCha20Poly1305Crypt) Method() Method {
@@ -56,50 +37,35 @@ func (c *ChaCha20Poly1305Crypt) Method() Method {
 }
 
 func (c *ChaCha20Poly1305Crypt) Cost() int {
-	return c.aead.NonceSize() + poly1305.TagSize
+	return c.crypt.Cost()
 }
 
 // XChaCha20Poly1305Crypt describes an XChaCha20-Poly1305 crypt.
 type XChaCha20Poly1305Crypt struct {
-	aead cipher.AEAD
+	crypt *sessionCrypt
 }
 
-// CreateXChaCha20Poly1305Crypt returns an XChaCha20-Poly1305 crypt by given key.
+// CreateXChaCha20Poly1305Crypt returns an XChaCha20-Poly1305 crypt by given key. Both sides send packets in the same
+// direction, so it is for peers which are neither client nor server.
 func CreateXChaCha20Poly1305Crypt(key []byte) (*XChaCha20Poly1305Crypt, error) {
-	// AEAD
-	aead, err := chacha20poly1305.NewX(key)
-	if err != nil {
-		return nil, fmt.Errorf("new aead: %w", err)
-	}
-
-	return &XChaCha20Poly1305Crypt{aead: aead}, nil
+	return newXChaCha20Poly1305Crypt(key, directionBoth)
 }
 
-func (c *XChaCha20Poly1305Crypt) Encrypt(data []byte) ([]byte, error) {
-	nonce, err := GenerateNonce(c.aead.NonceSize())
+func newXChaCha20Poly1305Crypt(key []byte, send direction) (*XChaCha20Poly1305Crypt, error) {
+	crypt, err := newSessionCrypt(key, chacha20poly1305.NewX, send)
 	if err != nil {
-		return nil, fmt.Errorf("generate nonce: %w", err)
+		return nil, err
 	}
 
-	result := c.aead.Seal(nil, nonce, data, nil)
-	result = append(nonce, result...)
+	return &XChaCha20Poly1305Crypt{crypt: crypt}, nil
+}
 
-	return result, nil
+func (c *XChaCha20Poly1305Crypt) Encrypt(data []byte) ([]byte, error) {
+	return c.crypt.Encrypt(data)
 }
 
 func (c *XChaCha20Poly1305Crypt) Decrypt(data []byte) ([]byte, error) {
-	size := c.aead.NonceSize()
-	if len(data) < size {
-		return nil, errors.New("missing nonce")
-	}
-	nonce := data[:size]
-
-	result, err := c.aead.Open(nil, nonce, data[size:], nil)
-	if err != nil {
-		return nil, fmt.Errorf("open: %w", err)
-	}
-
-	return result, nil
+	return c.crypt.Decrypt(data)
 }
 
 func (c *XChaCha20Poly1305Crypt) Method() Method {
@@ -107,5 +73,5 @@ func (c *XChaCha20Poly1305Crypt) Method() Method {
 }
 
 func (c *XChaCha20Poly1305Crypt) Cost() int {
-	return c.aead.NonceSize() + poly1305.TagSize
+	return c.crypt.Cost()
 }
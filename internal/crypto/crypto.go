@@ -1,7 +1,10 @@
 package crypto
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
 	"strconv"
 	"strings"
 )
@@ -12,28 +15,28 @@
 const (
 	// MethodPlain describes the encryption is in plain which will not encrypt the data.
 	MethodPlain Method = iota
-	// MethodAESCFB describes the encryption is in AES-CFB.
-	MethodAESCFB
 	// MethodAESGCM describes the encryption is in AES-GCM.
 	MethodAESGCM
 	// MethodChaCha20Poly1305 describes the encryption is in ChaCha20-Poly1305.
 	MethodChaCha20Poly1305
 	// MethodXChaCha20Poly1305 describes the encryption is in XChaCha20-Poly1305.
 	MethodXChaCha20Poly1305
+	// MethodHMAC describes the encryption is in plain but authenticated by HMAC-SHA256.
+	MethodHMAC
 )
 
 func (m Method) String() string {
 	switch m {
 	case MethodPlain:
 		return "Plain"
-	case MethodAESCFB:
-		return "AES-CFB"
 	case MethodAESGCM:
 		return "AES-GCM"
 	case MethodChaCha20Poly1305:
 		return "ChaCha20-Poly1305"
 	case MethodXChaCha20Poly1305:
 		return "XChaCha20-Poly1305"
+	case MethodHMAC:
+		return "Plain+HMAC"
 	default:
 		return strconv.Itoa(int(m))
 	}
@@ -51,8 +54,57 @@ type Crypt interface {
 	Cost() int
 }
 
-// ParseCrypt returns a crypt by given method and password.
+// ParseCrypt returns a crypt by given method and password, which is stretched by the key derivation function set. The
+// crypt exchanges session keys if key exchange or the identity is set, and re-keys if re-keying is set.
 func ParseCrypt(method, password string) (Crypt, error) {
+	return ParseCryptSecret(method, []byte(password))
+}
+
+// ParseCryptSecret returns a crypt like ParseCrypt by given method and password in bytes, which is zeroed after the key
+// is derived.
+func ParseCryptSecret(method string, password []byte) (Crypt, error) {
+	// Plain crypts need no key
+	if strings.ToLower(method) == "plain" {
+		zero(password)
+		return CreatePlainCrypt(), nil
+	}
+
+	key := kdf.derive(password)
+	zero(password)
+
+	send := side()
+
+	c, err := createCrypt(method, key, send)
+	if err != nil {
+		return nil, err
+	}
+
+	// Key exchange
+	if c.Method() != MethodPlain && (isExchanged || identity != nil) {
+		ec, err := newExchangeCrypt(method, key(32), send)
+		if err != nil {
+			return nil, err
+		}
+
+		return ec, nil
+	}
+
+	// Re-keying
+	if c.Method() != MethodPlain && rekeyOptions.isEnabled() {
+		rc, err := newRekeyCrypt(method, key(32), send)
+		if err != nil {
+			return nil, err
+		}
+
+		return rc, nil
+	}
+
+	return c, nil
+}
+
+// createCrypt returns a crypt by given method and the key of the size the method needs, which sends packets in the
+// direction.
+func createCrypt(method string, key func(size int) []byte, send direction) (Crypt, error) {
 	var (
 		err error
 		c   Crypt
@@ -62,15 +114,21 @@ func ParseCrypt(method, password string) (Crypt, error) {
 	case "plain":
 		c = CreatePlainCrypt()
 	case "aes-128-gcm":
-		c, err = CreateAESGCMCrypt(DeriveKey(password, 16))
+		c, err = newAESGCMCrypt(key(16), send)
 	case "aes-192-gcm":
-		c, err = CreateAESGCMCrypt(DeriveKey(password, 24))
+		c, err = newAESGCMCrypt(key(24), send)
 	case "aes-256-gcm":
-		c, err = CreateAESGCMCrypt(DeriveKey(password, 32))
+		c, err = newAESGCMCrypt(key(32), send)
 	case "chacha20-poly1305":
-		c, err = CreateChaCha20Poly1305Crypt(DeriveKey(password, 32))
+		c, err = newChaCha20Poly1305Crypt(key(32), send)
 	case "xchacha20-poly1305":
-		c, err = CreateXChaCha20Poly1305Crypt(DeriveKey(password, 32))
+		c, err = newXChaCha20Poly1305Crypt(key(32), send)
+	case "plain+hmac":
+		c, err = newHMACCrypt(key(32), send)
+	case "aes-128-cfb", "aes-192-cfb", "aes-256-cfb":
+		// AES-CFB has no integrity, so packets can be forged
+		return nil, fmt.Errorf("method %s not support any more, use %s instead", method,
+			strings.TrimSuffix(strings.ToLower(method), "-cfb")+"-gcm")
 	default:
 		return nil, fmt.Errorf("method %s not support", method)
 	}
@@ -80,3 +138,28 @@ func ParseCrypt(method, password string) (Crypt, error) {
 
 	return c, nil
 }
+
+// sessionInfo is the info of HKDF in deriving session keys.
+const sessionInfo = "ikago session key"
+
+// deriveCrypt returns a crypt by given method and the key derived from the secret by HKDF-SHA256 with the info, which
+// sends packets in the direction.
+func deriveCrypt(method string, secret, info []byte, send direction) (Crypt, error) {
+	r := hkdf.New(sha256.New, secret, nil, info)
+
+	var err error
+	c, e := createCrypt(method, func(size int) []byte {
+		key := make([]byte, size)
+		_, err = io.ReadFull(r, key)
+
+		return key
+	}, send)
+	if e != nil {
+		return nil, e
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+
+	return c, nil
+}
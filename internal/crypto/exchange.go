@@ -0,0 +1,466 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	exchangeData byte = iota
+	exchangeHello
+	exchangeReply
+)
+
+// exchangeVersion is the version of key exchange, messages of other versions are rejected.
+const exchangeVersion = 1
+
+// exchangeTimeSize is the size of the time a message is sent at in seconds.
+const exchangeTimeSize = 8
+
+// exchangeHeaderSize is the size of type, version and method of a message.
+const exchangeHeaderSize = 3
+
+// exchangeMethods are methods of encryption told in messages by their indexes, so both sides agree on the method.
+var exchangeMethods = []string{"aes-128-gcm", "aes-192-gcm", "aes-256-gcm", "chacha20-poly1305", "xchacha20-poly1305", "plain+hmac"}
+
+// exchangeMethod returns the index of the method in messages.
+func exchangeMethod(method string) (byte, error) {
+	for i, m := range exchangeMethods {
+		if strings.ToLower(method) == m {
+			return byte(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("method %s not support", method)
+}
+
+var isExchanged bool
+
+// SetKeyExchange sets if crypts parsed later exchange session keys.
+func SetKeyExchange(exchange bool) {
+	isExchanged = exchange
+}
+
+var identity *Identity
+
+// SetIdentity sets the identity authenticates key exchange of crypts parsed later instead of the password, which
+// enables key exchange.
+func SetIdentity(i *Identity) {
+	identity = i
+}
+
+// ExchangeCrypt describes a crypt whose session key is exchanged by ephemeral X25519 in handshaking, and the master
+// key only authenticates the exchange, so sessions in the past stay secret even if the password is leaked. Each packet
+// is prefixed with its type, so messages of the exchange are told from data.
+type ExchangeCrypt struct {
+	method   string
+	methodID byte
+	master   []byte
+	send     direction
+	identity *Identity
+	lock     sync.Mutex
+	private  []byte
+	public   []byte
+	peer     []byte
+	reply    []byte
+	secret   []byte
+	crypt    Crypt
+	m        Method
+	cost     int
+}
+
+// newExchangeCrypt returns a crypt exchanges session keys by given method and master key, which sends packets in the
+// direction.
+func newExchangeCrypt(method string, master []byte, send direction) (*ExchangeCrypt, error) {
+	// The crypt of the session tells the cost
+	c, err := createSession(method, master, send)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := exchangeMethod(method)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExchangeCrypt{
+		method:   method,
+		methodID: id,
+		master:   master,
+		send:     send,
+		identity: identity,
+		m:        c.Method(),
+		cost:     1 + c.Cost(),
+	}, nil
+}
+
+// Session returns a crypt with the same master key and no session, which exchanges the session key of another stream.
+func (c *ExchangeCrypt) Session() *ExchangeCrypt {
+	return &ExchangeCrypt{
+		method:   c.method,
+		methodID: c.methodID,
+		master:   c.master,
+		send:     c.send,
+		identity: c.identity,
+		m:        c.m,
+		cost:     c.cost,
+	}
+}
+
+// Hello returns the message starts the exchange. The key pair is generated once, so hellos sent again in case of loss
+// lead to the same session.
+func (c *ExchangeCrypt) Hello() ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.private == nil {
+		err := c.generate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c.message(exchangeHello, exchangeVersion, nil), nil
+}
+
+// Exchange handles the message of the exchange from the peer, and returns the reply, or nil if no reply. Messages not
+// sent recently are rejected, and hellos of other sessions are ignored once the session is established, so hellos
+// replayed never replace the session. Messages of another method are rejected, since the method is not negotiated.
+func (c *ExchangeCrypt) Exchange(data []byte) ([]byte, error) {
+	if len(data) != exchangeHeaderSize+curve25519.ScalarSize+exchangeTimeSize+c.authSize() {
+		return nil, errors.New("invalid message size")
+	}
+	t, version, method := data[0], int(data[1]), data[2]
+	public := data[exchangeHeaderSize : exchangeHeaderSize+curve25519.ScalarSize]
+	at := data[exchangeHeaderSize+curve25519.ScalarSize : exchangeHeaderSize+curve25519.ScalarSize+exchangeTimeSize]
+	auth := data[exchangeHeaderSize+curve25519.ScalarSize+exchangeTimeSize:]
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	switch t {
+	case exchangeHello:
+		err := c.verify(t, version, method, public, at, nil, auth)
+		if err != nil {
+			return nil, err
+		}
+		if version <= 0 || version > exchangeVersion {
+			return nil, fmt.Errorf("version %d not support", version)
+		}
+		err = c.match(method)
+		if err != nil {
+			return nil, err
+		}
+
+		// Hello sent again
+		if c.reply != nil && bytes.Equal(public, c.peer) {
+			return c.reply, nil
+		}
+
+		// Hellos replayed or from others
+		if c.crypt != nil {
+			return nil, nil
+		}
+		if !isFresh(time.Unix(int64(binary.BigEndian.Uint64(at)), 0), time.Now()) {
+			return nil, errors.New("stale hello")
+		}
+
+		err = c.generate()
+		if err != nil {
+			return nil, err
+		}
+
+		err = c.establish(public, public, c.public)
+		if err != nil {
+			return nil, err
+		}
+
+		c.peer = append([]byte{}, public...)
+		c.reply = c.message(exchangeReply, version, c.peer)
+
+		return c.reply, nil
+	case exchangeReply:
+		if c.private == nil {
+			return nil, errors.New("unexpected reply")
+		}
+		err := c.verify(t, version, method, public, at, c.public, auth)
+		if err != nil {
+			return nil, err
+		}
+		if version <= 0 || version > exchangeVersion {
+			return nil, fmt.Errorf("version %d not support", version)
+		}
+		err = c.match(method)
+		if err != nil {
+			return nil, err
+		}
+		if !isFresh(time.Unix(int64(binary.BigEndian.Uint64(at)), 0), time.Now()) {
+			return nil, errors.New("stale reply")
+		}
+
+		// Reply received again
+		if c.crypt != nil {
+			return nil, nil
+		}
+
+		return nil, c.establish(public, c.public, public)
+	default:
+		return nil, fmt.Errorf("message type %d not support", t)
+	}
+}
+
+// match returns an error if the method of the peer is not the method of the crypt.
+func (c *ExchangeCrypt) match(method byte) error {
+	if method == c.methodID {
+		return nil
+	}
+
+	peer := fmt.Sprintf("%d", method)
+	if int(method) < len(exchangeMethods) {
+		peer = exchangeMethods[method]
+	}
+
+	return fmt.Errorf("method %s of peer mismatches %s", peer, strings.ToLower(c.method))
+}
+
+// generate generates an ephemeral key pair.
+func (c *ExchangeCrypt) generate() error {
+	private, err := GenerateNonce(curve25519.ScalarSize)
+	if err != nil {
+		return fmt.Errorf("generate private key: %w", err)
+	}
+
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return fmt.Errorf("generate public key: %w", err)
+	}
+
+	c.private, c.public = private, public
+
+	return nil
+}
+
+// establish derives the session key from the shared secret with the public key of the peer, salted with public keys
+// of the client and the server.
+func (c *ExchangeCrypt) establish(peer, client, server []byte) error {
+	shared, err := curve25519.X25519(c.private, peer)
+	if err != nil {
+		return fmt.Errorf("exchange: %w", err)
+	}
+
+	secret := make([]byte, 32)
+	_, err = io.ReadFull(hkdf.New(sha256.New, shared, append(append([]byte{}, client...), server...), []byte("ikago key exchange")), secret)
+	if err != nil {
+		return fmt.Errorf("read secret: %w", err)
+	}
+
+	crypt, err := createSession(c.method, secret, c.send)
+	if err != nil {
+		return err
+	}
+	c.secret = secret
+	c.crypt = crypt
+
+	return nil
+}
+
+// Secret returns the secret of the session, or nil if the session is not established. The secret is handed off to a
+// standby, so it resumes the session by Resume.
+func (c *ExchangeCrypt) Secret() []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.secret == nil {
+		return nil
+	}
+
+	return append([]byte{}, c.secret...)
+}
+
+// RoamKey returns the key authenticating roamings of the session, which is derived from its secret, so both sides know
+// it without telling it, or false if the session is not established.
+func (c *ExchangeCrypt) RoamKey() ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.secret == nil {
+		return nil, false
+	}
+
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte("ikago roam key"))
+
+	return mac.Sum(nil), true
+}
+
+// Resume establishes the session by the secret of a session handed off, without exchanging.
+func (c *ExchangeCrypt) Resume(secret []byte) error {
+	crypt, err := createSession(c.method, secret, c.send)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.secret = append([]byte{}, secret...)
+	c.crypt = crypt
+
+	return nil
+}
+
+// message returns the message of the type with the public key and the time now, authenticated with the public key of
+// the peer if any. A message is composed of type, version, method, public key, time, and MAC by the master key, or the
+// public key of the identity and its signature if the identity is set.
+func (c *ExchangeCrypt) message(t byte, version int, peer []byte) []byte {
+	at := make([]byte, exchangeTimeSize)
+	binary.BigEndian.PutUint64(at, uint64(time.Now().Unix()))
+
+	content := c.content(t, version, c.methodID, c.public, at, peer)
+
+	result := make([]byte, 0, exchangeHeaderSize+curve25519.ScalarSize+exchangeTimeSize+c.authSize())
+	result = append(result, t, byte(version), c.methodID)
+	result = append(result, c.public...)
+	result = append(result, at...)
+
+	if c.identity != nil {
+		result = append(result, c.identity.private.Public().(ed25519.PublicKey)...)
+
+		return append(result, ed25519.Sign(c.identity.private, content)...)
+	}
+
+	h := hmac.New(sha256.New, c.master)
+	h.Write(content)
+
+	return append(result, h.Sum(nil)...)
+}
+
+// verify returns an error if the message is not authenticated by the master key, or by a peer pinned in the identity
+// if the identity is set.
+func (c *ExchangeCrypt) verify(t byte, version int, method byte, public, at, peer, auth []byte) error {
+	content := c.content(t, version, method, public, at, peer)
+
+	if c.identity != nil {
+		key := ed25519.PublicKey(auth[:ed25519.PublicKeySize])
+		if !c.identity.isPinned(key) {
+			return fmt.Errorf("peer key %s unauthorized", base64.StdEncoding.EncodeToString(key))
+		}
+		if !ed25519.Verify(key, content, auth[ed25519.PublicKeySize:]) {
+			return errors.New("invalid signature")
+		}
+
+		return nil
+	}
+
+	h := hmac.New(sha256.New, c.master)
+	h.Write(content)
+	if !hmac.Equal(auth, h.Sum(nil)) {
+		return errors.New("unauthorized")
+	}
+
+	return nil
+}
+
+// content returns the content authenticated in a message.
+func (c *ExchangeCrypt) content(t byte, version int, method byte, public, at, peer []byte) []byte {
+	result := []byte{t, byte(version), method}
+	result = append(result, public...)
+	result = append(result, at...)
+
+	return append(result, peer...)
+}
+
+// authSize returns the size of authentication in a message.
+func (c *ExchangeCrypt) authSize() int {
+	if c.identity != nil {
+		return ed25519.PublicKeySize + ed25519.SignatureSize
+	}
+
+	return sha256.Size
+}
+
+// IsExchange returns if the data is a message of the exchange.
+func (c *ExchangeCrypt) IsExchange(data []byte) bool {
+	return len(data) > 0 && data[0] != exchangeData
+}
+
+// IsEstablished returns if the session key is exchanged.
+func (c *ExchangeCrypt) IsEstablished() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.crypt != nil
+}
+
+func (c *ExchangeCrypt) session() (Crypt, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.crypt == nil {
+		return nil, errors.New("no session")
+	}
+
+	return c.crypt, nil
+}
+
+func (c *ExchangeCrypt) Encrypt(data []byte) ([]byte, error) {
+	crypt, err := c.session()
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := crypt.Encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{exchangeData}, contents...), nil
+}
+
+func (c *ExchangeCrypt) Decrypt(data []byte) ([]byte, error) {
+	if len(data) <= 0 || data[0] != exchangeData {
+		return nil, errors.New("missing data type")
+	}
+
+	crypt, err := c.session()
+	if err != nil {
+		return nil, err
+	}
+
+	return crypt.Decrypt(data[1:])
+}
+
+func (c *ExchangeCrypt) Method() Method {
+	return c.m
+}
+
+func (c *ExchangeCrypt) Cost() int {
+	return c.cost
+}
+
+// createSession returns the crypt of a session by given method and secret, which sends packets in the direction, and
+// re-keys if re-keying is set.
+func createSession(method string, secret []byte, send direction) (Crypt, error) {
+	if rekeyOptions.isEnabled() {
+		c, err := newRekeyCrypt(method, secret, send)
+		if err != nil {
+			return nil, err
+		}
+
+		return c, nil
+	}
+
+	return deriveCrypt(method, secret, []byte(sessionInfo), send)
+}
@@ -0,0 +1,183 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"golang.org/x/crypto/curve25519"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newExchangePair returns crypts of the client and the server which exchange session keys.
+func newExchangePair(t *testing.T) (*ExchangeCrypt, *ExchangeCrypt) {
+	t.Helper()
+
+	master := bytes.Repeat([]byte{1}, 32)
+
+	client, err := newExchangeCrypt("aes-256-gcm", master, directionClient)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	server, err := newExchangeCrypt("aes-256-gcm", master, directionServer)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	return client, server
+}
+
+// exchange exchanges session keys between the client and the server.
+func exchange(t *testing.T, client, server *ExchangeCrypt) []byte {
+	t.Helper()
+
+	hello, err := client.Hello()
+	if err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+	reply, err := server.Exchange(hello)
+	if err != nil {
+		t.Fatalf("exchange hello: %v", err)
+	}
+	_, err = client.Exchange(reply)
+	if err != nil {
+		t.Fatalf("exchange reply: %v", err)
+	}
+
+	return hello
+}
+
+// resign returns the message of the crypt sent at the time, authenticated by the master key again.
+func resign(c *ExchangeCrypt, data []byte, version int, at time.Time) []byte {
+	result := append([]byte{}, data[:exchangeHeaderSize+curve25519.ScalarSize+exchangeTimeSize]...)
+	result[1] = byte(version)
+	binary.BigEndian.PutUint64(result[exchangeHeaderSize+curve25519.ScalarSize:], uint64(at.Unix()))
+
+	h := hmac.New(sha256.New, c.master)
+	h.Write(result)
+
+	return h.Sum(result)
+}
+
+// roundTrip returns if data from the client is decrypted by the server.
+func roundTrip(t *testing.T, client, server *ExchangeCrypt) bool {
+	t.Helper()
+
+	data, err := client.Encrypt([]byte("ping"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	result, err := server.Decrypt(data)
+
+	return err == nil && bytes.Equal(result, []byte("ping"))
+}
+
+func TestExchangeCrypt(t *testing.T) {
+	client, server := newExchangePair(t)
+	hello := exchange(t, client, server)
+
+	if !roundTrip(t, client, server) || !roundTrip(t, server, client) {
+		t.Fatal("session not established")
+	}
+
+	// Hello sent again
+	reply, err := server.Exchange(hello)
+	if err != nil || reply == nil {
+		t.Errorf("hello sent again: %v, %v", reply, err)
+	}
+
+	// Hello of another session replayed
+	old, oldServer := newExchangePair(t)
+	oldHello := exchange(t, old, oldServer)
+	reply, err = server.Exchange(oldHello)
+	if err != nil || reply != nil {
+		t.Errorf("hello replayed: %v, %v", reply, err)
+	}
+	if !roundTrip(t, client, server) {
+		t.Error("session replaced by hello replayed")
+	}
+}
+
+func TestExchangeCryptHello(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		version int
+		at      time.Time
+		isErr   bool
+	}{
+		{name: "valid", version: exchangeVersion, at: now},
+		{name: "version 0", version: 0, at: now, isErr: true},
+		{name: "version higher", version: exchangeVersion + 1, at: now, isErr: true},
+		{name: "stale", version: exchangeVersion, at: now.Add(-sessionFreshness), isErr: true},
+		{name: "in future", version: exchangeVersion, at: now.Add(sessionFreshness + time.Second), isErr: true},
+		{name: "skewed", version: exchangeVersion, at: now.Add(-sessionFreshness / 2)},
+	}
+
+	for _, test := range tests {
+		client, server := newExchangePair(t)
+
+		hello, err := client.Hello()
+		if err != nil {
+			t.Fatalf("%s: hello: %v", test.name, err)
+		}
+
+		reply, err := server.Exchange(resign(client, hello, test.version, test.at))
+		if test.isErr {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			if server.IsEstablished() {
+				t.Errorf("%s: session established", test.name)
+			}
+			continue
+		}
+		if err != nil || reply == nil {
+			t.Fatalf("%s: %v, %v", test.name, reply, err)
+		}
+	}
+}
+
+func TestExchangeCryptTampered(t *testing.T) {
+	client, server := newExchangePair(t)
+
+	hello, err := client.Hello()
+	if err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+	hello[2+curve25519.ScalarSize+exchangeTimeSize-1] ^= 1
+
+	_, err = server.Exchange(hello)
+	if err == nil {
+		t.Error("tampered hello accepted")
+	}
+}
+
+// TestExchangeCryptMethodMismatch rejects hellos of another method.
+func TestExchangeCryptMethodMismatch(t *testing.T) {
+	master := bytes.Repeat([]byte{1}, 32)
+
+	client, err := newExchangeCrypt("aes-256-gcm", master, directionClient)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	server, err := newExchangeCrypt("chacha20-poly1305", master, directionServer)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	hello, err := client.Hello()
+	if err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+	_, err = server.Exchange(hello)
+	if err == nil || !strings.Contains(err.Error(), "method aes-256-gcm of peer mismatches chacha20-poly1305") {
+		t.Errorf("exchange: %v, want method mismatch", err)
+	}
+	if server.IsEstablished() {
+		t.Error("session established")
+	}
+}
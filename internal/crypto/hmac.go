@@ -0,0 +1,101 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"sync"
+)
+
+// hmacNonceSize is the size of the nonce in HMAC crypts, which tells packets for replay protection.
+const hmacNonceSize = 12
+
+// hmacTagSize is the size of the tag in HMAC crypts, which is HMAC-SHA256 truncated like AEAD tags.
+const hmacTagSize = 16
+
+// HMACCrypt describes a crypt which authenticates the data with HMAC-SHA256 but does not encrypt it.
+type HMACCrypt struct {
+	crypt *sessionCrypt
+}
+
+// CreateHMACCrypt returns an HMAC crypt by given key. Both sides send packets in the same direction, so it is for
+// peers which are neither client nor server.
+func CreateHMACCrypt(key []byte) (*HMACCrypt, error) {
+	return newHMACCrypt(key, directionBoth)
+}
+
+func newHMACCrypt(key []byte, send direction) (*HMACCrypt, error) {
+	crypt, err := newSessionCrypt(key, newHMACAEAD, send)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HMACCrypt{crypt: crypt}, nil
+}
+
+func (c *HMACCrypt) Encrypt(data []byte) ([]byte, error) {
+	return c.crypt.Encrypt(data)
+}
+
+func (c *HMACCrypt) Decrypt(data []byte) ([]byte, error) {
+	return c.crypt.Decrypt(data)
+}
+
+func (c *HMACCrypt) Method() Method {
+	return MethodHMAC
+}
+
+func (c *HMACCrypt) Cost() int {
+	return c.crypt.Cost()
+}
+
+// hmacAEAD describes an AEAD which leaves the plaintext as is, and appends the tag of the nonce and the plaintext.
+type hmacAEAD struct {
+	lock sync.Mutex
+	hash hash.Hash
+}
+
+func newHMACAEAD(key []byte) (cipher.AEAD, error) {
+	return &hmacAEAD{hash: hmac.New(sha256.New, key)}, nil
+}
+
+// tag returns the tag of the nonce and the data.
+func (a *hmacAEAD) tag(nonce, data []byte) []byte {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.hash.Reset()
+	a.hash.Write(nonce)
+	a.hash.Write(data)
+
+	return a.hash.Sum(nil)[:hmacTagSize]
+}
+
+func (a *hmacAEAD) NonceSize() int {
+	return hmacNonceSize
+}
+
+func (a *hmacAEAD) Overhead() int {
+	return hmacTagSize
+}
+
+func (a *hmacAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	dst = append(dst, plaintext...)
+
+	return append(dst, a.tag(nonce, plaintext)...)
+}
+
+func (a *hmacAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < hmacTagSize {
+		return nil, errors.New("missing tag")
+	}
+	contents, tag := ciphertext[:len(ciphertext)-hmacTagSize], ciphertext[len(ciphertext)-hmacTagSize:]
+
+	if !hmac.Equal(tag, a.tag(nonce, contents)) {
+		return nil, errors.New("message authentication failed")
+	}
+
+	return append(dst, contents...), nil
+}
@@ -0,0 +1,81 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Identity describes an Ed25519 key pair authenticates key exchange, and public keys of peers pinned.
+type Identity struct {
+	private ed25519.PrivateKey
+	peers   []ed25519.PublicKey
+}
+
+// ParseIdentity returns an identity by given private key and public keys of peers, which are in base64. The private
+// key is the seed of 32 Bytes.
+func ParseIdentity(privateKey string, peerKeys []string) (*Identity, error) {
+	seed, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("decode private key: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("private key size %d not support", len(seed))
+	}
+
+	if len(peerKeys) <= 0 {
+		return nil, errors.New("missing peer key")
+	}
+
+	i := &Identity{
+		private: ed25519.NewKeyFromSeed(seed),
+		peers:   make([]ed25519.PublicKey, 0),
+	}
+
+	for _, peerKey := range peerKeys {
+		key, err := base64.StdEncoding.DecodeString(peerKey)
+		if err != nil {
+			return nil, fmt.Errorf("decode peer key %s: %w", peerKey, err)
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("peer key %s size %d not support", peerKey, len(key))
+		}
+
+		i.peers = append(i.peers, key)
+	}
+
+	return i, nil
+}
+
+// GenerateIdentity returns a new private key and its public key in base64.
+func GenerateIdentity() (string, string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(private.Seed()), base64.StdEncoding.EncodeToString(public), nil
+}
+
+// PublicKey returns the public key of the identity in base64.
+func (i *Identity) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(i.private.Public().(ed25519.PublicKey))
+}
+
+// Len returns the number of peers pinned.
+func (i *Identity) Len() int {
+	return len(i.peers)
+}
+
+func (i *Identity) isPinned(key ed25519.PublicKey) bool {
+	for _, peer := range i.peers {
+		if bytes.Equal(peer, key) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,98 @@
+package crypto
+
+import (
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"strings"
+)
+
+// KDFMethod describes the method of the key derivation function of passwords.
+type KDFMethod int
+
+const (
+	// KDFMD5 describes keys are derived by MD5 like EVP_BytesToKey of OpenSSL.
+	KDFMD5 KDFMethod = iota
+	// KDFArgon2id describes keys are derived by Argon2id.
+	KDFArgon2id
+)
+
+// DefaultArgon2Memory is the default memory of Argon2id in MB.
+const DefaultArgon2Memory = 64
+
+// DefaultArgon2Iterations is the default number of iterations of Argon2id.
+const DefaultArgon2Iterations = 3
+
+// argon2Threads is the number of threads of Argon2id, which needs to be the same in both sides.
+const argon2Threads = 4
+
+// maxKeySize is the size of keys derived, which is the largest size methods need.
+const maxKeySize = 32
+
+// argon2Salt is the salt of Argon2id. Both sides derive the same key from the password without a handshake, so the
+// salt is fixed.
+const argon2Salt = "ikago argon2id salt"
+
+// KDF describes the key derivation function of passwords.
+type KDF struct {
+	method     KDFMethod
+	memory     int
+	iterations int
+}
+
+// ParseKDF returns a key derivation function by given method, memory in MB and number of iterations, which are used
+// only in Argon2id, and 0 as default.
+func ParseKDF(method string, memory, iterations int) (*KDF, error) {
+	kdf := &KDF{memory: memory, iterations: iterations}
+
+	switch strings.ToLower(method) {
+	case "", "md5":
+		kdf.method = KDFMD5
+	case "argon2id":
+		kdf.method = KDFArgon2id
+		if kdf.memory <= 0 {
+			kdf.memory = DefaultArgon2Memory
+		}
+		if kdf.iterations <= 0 {
+			kdf.iterations = DefaultArgon2Iterations
+		}
+	default:
+		return nil, fmt.Errorf("kdf %s not support", method)
+	}
+
+	return kdf, nil
+}
+
+var kdf *KDF
+
+// SetKDF sets the key derivation function of passwords, crypts parsed later will use it.
+func SetKDF(k *KDF) {
+	kdf = k
+}
+
+// IsDefault returns if the key derivation function is the default MD5.
+func (k *KDF) IsDefault() bool {
+	return k == nil || k.method == KDFMD5
+}
+
+// derive returns the function returns the key of the size derived from the password. The key is derived only once, and
+// keys of different sizes are prefixes of its output, so the password is not needed after deriving.
+func (k *KDF) derive(password []byte) func(size int) []byte {
+	var key []byte
+	if k.IsDefault() {
+		key = deriveKey(password, maxKeySize)
+	} else {
+		key = argon2.IDKey(password, []byte(argon2Salt), uint32(k.iterations), uint32(k.memory*1024), argon2Threads, maxKeySize)
+	}
+
+	return func(size int) []byte {
+		return key[:size]
+	}
+}
+
+func (k *KDF) String() string {
+	if k.IsDefault() {
+		return "MD5"
+	}
+
+	return fmt.Sprintf("Argon2id (%d MB, %d iterations)", k.memory, k.iterations)
+}
@@ -3,18 +3,25 @@
 import (
 	"crypto/md5"
 	"crypto/rand"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"sync/atomic"
 )
 
 // DeriveKey derives a key from a string of password.
 func DeriveKey(password string, length int) []byte {
+	return deriveKey([]byte(password), length)
+}
+
+func deriveKey(password []byte, length int) []byte {
 	var key, prev []byte
 
 	h := md5.New()
 
 	for len(key) < length {
 		h.Write(prev)
-		h.Write([]byte(password))
+		h.Write(password)
 		key = h.Sum(key)
 		prev = key[len(key)-h.Size():]
 		h.Reset()
@@ -23,6 +30,13 @@ func DeriveKey(password string, length int) []byte {
 	return key[:length]
 }
 
+// zero overwrites the buffer with zeros, which clears secrets no longer needed.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 // GenerateIV generates a random IV of the given size.
 func GenerateIV(size int) ([]byte, error) {
 	iv := make([]byte, size)
@@ -44,3 +58,35 @@ func GenerateNonce(size int) ([]byte, error) {
 
 	return nonce, nil
 }
+
+// counterSize is the size of the counter in a nonce.
+const counterSize = 8
+
+// nonceCounter generates nonces of a counter in a session, which are zeros followed by the counter in big endian.
+// Each session has its own key, so nonces never repeat under a key.
+type nonceCounter struct {
+	// counter comes first for 64-bit alignment of atomic operations on 32-bit platforms.
+	counter uint64
+	size    int
+}
+
+func newNonceCounter(size int) (*nonceCounter, error) {
+	if size < counterSize {
+		return nil, fmt.Errorf("nonce size %d too short", size)
+	}
+
+	return &nonceCounter{size: size}, nil
+}
+
+// next returns the next nonce in the session, where the counter starts from 1.
+func (n *nonceCounter) next() []byte {
+	return counterNonce(n.size, atomic.AddUint64(&n.counter, 1))
+}
+
+// counterNonce returns the nonce of the size of the counter.
+func counterNonce(size int, counter uint64) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-counterSize:], counter)
+
+	return nonce
+}
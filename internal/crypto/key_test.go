@@ -0,0 +1,45 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNonceCounter(t *testing.T) {
+	tests := []struct {
+		size  int
+		isErr bool
+	}{
+		{size: 4, isErr: true},
+		{size: 12},
+		{size: 24},
+	}
+
+	for _, test := range tests {
+		n, err := newNonceCounter(test.size)
+		if test.isErr {
+			if err == nil {
+				t.Errorf("size %d: no error", test.size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("size %d: %v", test.size, err)
+		}
+
+		nonces := make(map[string]bool)
+		for i := uint64(1); i <= 1000; i++ {
+			nonce := n.next()
+			if len(nonce) != test.size {
+				t.Fatalf("size %d: nonce of size %d", test.size, len(nonce))
+			}
+			if !bytes.Equal(nonce, counterNonce(test.size, i)) {
+				t.Fatalf("size %d: nonce %x, want counter %d", test.size, nonce, i)
+			}
+			if nonces[string(nonce)] {
+				t.Fatalf("size %d: nonce %x repeated", test.size, nonce)
+			}
+			nonces[string(nonce)] = true
+		}
+	}
+}
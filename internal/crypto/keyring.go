@@ -0,0 +1,102 @@
+package crypto
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+type keyringEntry struct {
+	name  string
+	ipNet *net.IPNet
+	crypt Crypt
+}
+
+// Keyring describes crypts of clients by their source addresses, so each client can have its own key.
+type Keyring struct {
+	entries []keyringEntry
+}
+
+// ParseKeyring returns a keyring by given method and passwords of clients, which are keyed by IPs or CIDR blocks.
+func ParseKeyring(method string, passwords map[string]string) (*Keyring, error) {
+	keyring := &Keyring{entries: make([]keyringEntry, 0)}
+
+	for client, password := range passwords {
+		var ipNet *net.IPNet
+
+		if strings.Contains(client, "/") {
+			_, n, err := net.ParseCIDR(client)
+			if err != nil {
+				return nil, fmt.Errorf("parse cidr %s: %w", client, err)
+			}
+			ipNet = n
+		} else {
+			ip := net.ParseIP(client)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %s", client)
+			}
+			if ip.To4() != nil {
+				ipNet = &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+			} else {
+				ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+			}
+		}
+
+		c, err := ParseCrypt(method, password)
+		if err != nil {
+			return nil, fmt.Errorf("parse crypt of %s: %w", client, err)
+		}
+
+		keyring.entries = append(keyring.entries, keyringEntry{name: client, ipNet: ipNet, crypt: c})
+	}
+
+	return keyring, nil
+}
+
+// Crypt returns the crypt of the client by its IP, the most specific block wins. It returns nil if the client is
+// unknown.
+func (k *Keyring) Crypt(ip net.IP) Crypt {
+	entry := k.lookup(ip)
+	if entry == nil {
+		return nil
+	}
+
+	return entry.crypt
+}
+
+// Name returns the IP or CIDR block the client is keyed by in the keyring, the most specific block wins. It returns an
+// empty string if the client is unknown.
+func (k *Keyring) Name(ip net.IP) string {
+	entry := k.lookup(ip)
+	if entry == nil {
+		return ""
+	}
+
+	return entry.name
+}
+
+func (k *Keyring) lookup(ip net.IP) *keyringEntry {
+	var (
+		result *keyringEntry
+		size   = -1
+	)
+
+	for i, entry := range k.entries {
+		if !entry.ipNet.Contains(ip) {
+			continue
+		}
+
+		ones, _ := entry.ipNet.Mask.Size()
+		if ones > size {
+			result = &k.entries[i]
+			size = ones
+		}
+	}
+
+	return result
+}
+
+// Len returns the number of clients in the keyring.
+func (k *Keyring) Len() int {
+	return len(k.entries)
+}
@@ -0,0 +1,182 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RekeyOptions describes when crypts derive fresh session keys from the master key.
+type RekeyOptions struct {
+	// Interval is the duration a session key is used for at most, 0 as unlimited.
+	Interval time.Duration
+	// Bytes is the size of data a session key encrypts at most, 0 as unlimited.
+	Bytes int64
+}
+
+var rekeyOptions RekeyOptions
+
+// SetRekeyOptions sets the options of re-keying, crypts parsed later will use the options.
+func SetRekeyOptions(options RekeyOptions) {
+	rekeyOptions = options
+}
+
+func (options RekeyOptions) isEnabled() bool {
+	return options.Interval > 0 || options.Bytes > 0
+}
+
+// rekeyCacheSize is the number of session keys kept for decryption.
+const rekeyCacheSize = 64
+
+// epochSize is the size of the epoch prefixed to each packet.
+const epochSize = 4
+
+// rekeyCrypt describes a crypt which encrypts with session keys derived from the master key in epochs. Each packet
+// is prefixed with the epoch of its session key, so the receiver derives the same key.
+type rekeyCrypt struct {
+	method  string
+	master  []byte
+	send    direction
+	options RekeyOptions
+	lock    sync.Mutex
+	epoch   uint32
+	start   time.Time
+	bytes   int64
+	crypt   Crypt
+	crypts  map[uint32]Crypt
+	epochs  []uint32
+	retired map[uint32]struct{}
+}
+
+// newRekeyCrypt returns a crypt re-keys by given method and master key, which starts from a random epoch and sends
+// packets in the direction.
+func newRekeyCrypt(method string, master []byte, send direction) (*rekeyCrypt, error) {
+	b, err := GenerateNonce(epochSize)
+	if err != nil {
+		return nil, fmt.Errorf("generate epoch: %w", err)
+	}
+
+	c := &rekeyCrypt{
+		method:  method,
+		master:  master,
+		send:    send,
+		options: rekeyOptions,
+		epoch:   binary.BigEndian.Uint32(b),
+		start:   time.Now(),
+		crypts:  make(map[uint32]Crypt),
+		epochs:  make([]uint32, 0),
+		retired: make(map[uint32]struct{}),
+	}
+
+	c.crypt, err = c.derive(c.epoch)
+	if err != nil {
+		return nil, fmt.Errorf("derive: %w", err)
+	}
+
+	return c, nil
+}
+
+// derive returns the crypt of the session key of the epoch.
+func (c *rekeyCrypt) derive(epoch uint32) (Crypt, error) {
+	info := make([]byte, epochSize)
+	binary.BigEndian.PutUint32(info, epoch)
+
+	return deriveCrypt(c.method, c.master, append([]byte(sessionInfo), info...), c.send)
+}
+
+func (c *rekeyCrypt) Encrypt(data []byte) ([]byte, error) {
+	c.lock.Lock()
+
+	// Next epoch
+	if (c.options.Interval > 0 && time.Now().Sub(c.start) >= c.options.Interval) ||
+		(c.options.Bytes > 0 && c.bytes >= c.options.Bytes) {
+		crypt, err := c.derive(c.epoch + 1)
+		if err != nil {
+			c.lock.Unlock()
+			return nil, fmt.Errorf("derive: %w", err)
+		}
+
+		c.epoch++
+		c.start = time.Now()
+		c.bytes = 0
+		c.crypt = crypt
+	}
+
+	crypt, epoch := c.crypt, c.epoch
+	c.bytes = c.bytes + int64(len(data))
+
+	c.lock.Unlock()
+
+	contents, err := crypt.Encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, epochSize, epochSize+len(contents))
+	binary.BigEndian.PutUint32(result, epoch)
+
+	return append(result, contents...), nil
+}
+
+func (c *rekeyCrypt) Decrypt(data []byte) ([]byte, error) {
+	if len(data) < epochSize {
+		return nil, errors.New("missing epoch")
+	}
+	epoch := binary.BigEndian.Uint32(data)
+
+	crypt, err := c.session(epoch)
+	if err != nil {
+		return nil, err
+	}
+
+	return crypt.Decrypt(data[epochSize:])
+}
+
+// session returns the crypt of the epoch for decryption, which is derived once and kept for later packets.
+func (c *rekeyCrypt) session(epoch uint32) (Crypt, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	crypt, ok := c.crypts[epoch]
+	if ok {
+		return crypt, nil
+	}
+
+	// Session keys evicted lose their replay windows, so their packets are never accepted again
+	_, ok = c.retired[epoch]
+	if ok {
+		return nil, errors.New("stale epoch")
+	}
+
+	crypt, err := c.derive(epoch)
+	if err != nil {
+		return nil, fmt.Errorf("derive: %w", err)
+	}
+
+	// Evict the oldest session key
+	if len(c.epochs) >= rekeyCacheSize {
+		delete(c.crypts, c.epochs[0])
+		c.retired[c.epochs[0]] = struct{}{}
+		c.epochs = c.epochs[1:]
+	}
+	c.crypts[epoch] = crypt
+	c.epochs = append(c.epochs, epoch)
+
+	return crypt, nil
+}
+
+func (c *rekeyCrypt) Method() Method {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.crypt.Method()
+}
+
+func (c *rekeyCrypt) Cost() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return epochSize + c.crypt.Cost()
+}
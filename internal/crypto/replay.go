@@ -0,0 +1,124 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrReplayed is returned by decryption if the packet is received before.
+var ErrReplayed = errors.New("replayed")
+
+// ErrStale is returned by decryption if the session of the packet is not started recently, which is replayed, or the
+// clock of the peer is not synchronized with this side.
+var ErrStale = errors.New("stale session, are clocks synchronized")
+
+// replayWindowSize is the number of counters behind the highest one a replay window accepts.
+const replayWindowSize = 1024
+
+// replaySessions is the number of sessions a replay filter keeps windows for at most.
+const replaySessions = 16384
+
+// replayWindow describes a sliding window of counters received in a session, like the anti-replay window of IPsec.
+type replayWindow struct {
+	top    uint64
+	bitmap [replayWindowSize / 64]uint64
+}
+
+// accept returns if the counter is neither received nor behind the window, and marks it received.
+func (w *replayWindow) accept(counter uint64) bool {
+	// Slide forward
+	if counter > w.top {
+		diff := counter - w.top
+		if diff >= replayWindowSize {
+			w.bitmap = [replayWindowSize / 64]uint64{}
+		} else {
+			for i := w.top + 1; i <= counter; i++ {
+				w.bitmap[(i/64)%uint64(len(w.bitmap))] &^= 1 << (i % 64)
+			}
+		}
+		w.top = counter
+	} else if w.top-counter >= replayWindowSize {
+		// Stale
+		return false
+	}
+
+	index, bit := (counter/64)%uint64(len(w.bitmap)), uint64(1)<<(counter%64)
+	if w.bitmap[index]&bit != 0 {
+		return false
+	}
+	w.bitmap[index] |= bit
+
+	return true
+}
+
+// replaySession describes a session authenticated, with its AEAD and its replay window.
+type replaySession struct {
+	start  time.Time
+	aead   cipher.AEAD
+	window replayWindow
+}
+
+// replayFilter describes replay windows of sessions told by their IDs, each sender has its own session. Sessions are
+// kept as long as they are fresh, and only sessions started recently are accepted, so sessions evicted and sessions
+// before a restart are never accepted again.
+type replayFilter struct {
+	lock     sync.Mutex
+	sessions map[string]*replaySession
+	purgedAt time.Time
+}
+
+func newReplayFilter() *replayFilter {
+	return &replayFilter{
+		sessions: make(map[string]*replaySession),
+		purgedAt: time.Now(),
+	}
+}
+
+// aead returns the AEAD of the session of the ID, or nil if the session is unknown.
+func (f *replayFilter) aead(id []byte) cipher.AEAD {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	s, ok := f.sessions[string(id)]
+	if !ok {
+		return nil
+	}
+
+	return s.aead
+}
+
+// accept returns if the counter in the session of the ID starting at the time is neither replayed nor stale at now,
+// and keeps the session with the AEAD if it is unknown. It must be called only after the packet is authenticated.
+func (f *replayFilter) accept(id []byte, start time.Time, aead cipher.AEAD, counter uint64, now time.Time) bool {
+	if !isFresh(start, now) {
+		return false
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	s, ok := f.sessions[string(id)]
+	if !ok {
+		// Purge sessions no longer fresh
+		if len(f.sessions) >= replaySessions || now.Sub(f.purgedAt) >= sessionLifetime {
+			for key, s := range f.sessions {
+				if !isFresh(s.start, now) {
+					delete(f.sessions, key)
+				}
+			}
+			f.purgedAt = now
+		}
+
+		// Fresh sessions are never evicted, or they could be replayed
+		if len(f.sessions) >= replaySessions {
+			return false
+		}
+
+		s = &replaySession{start: start, aead: aead}
+		f.sessions[string(id)] = s
+	}
+
+	return s.window.accept(counter)
+}
@@ -0,0 +1,87 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayWindow(t *testing.T) {
+	tests := []struct {
+		counter  uint64
+		isAccept bool
+	}{
+		{counter: 1, isAccept: true},
+		{counter: 1, isAccept: false},
+		{counter: 3, isAccept: true},
+		{counter: 2, isAccept: true},
+		{counter: 2, isAccept: false},
+		{counter: 2000, isAccept: true},
+		{counter: 3, isAccept: false},
+		{counter: 2000 - replayWindowSize, isAccept: false},
+		{counter: 2000 - replayWindowSize + 1, isAccept: true},
+		{counter: 1999, isAccept: true},
+		{counter: 1999, isAccept: false},
+		{counter: 2000 + 2*replayWindowSize, isAccept: true},
+		{counter: 2000, isAccept: false},
+	}
+
+	var w replayWindow
+	for i, test := range tests {
+		if w.accept(test.counter) != test.isAccept {
+			t.Errorf("#%d: accept %d: %t, want %t", i, test.counter, !test.isAccept, test.isAccept)
+		}
+	}
+}
+
+func TestReplayFilterAccept(t *testing.T) {
+	now := time.Now()
+	a, b, stale, future := []byte("a"), []byte("b"), []byte("stale"), []byte("future")
+
+	tests := []struct {
+		name     string
+		id       []byte
+		start    time.Time
+		counter  uint64
+		now      time.Time
+		isAccept bool
+	}{
+		{name: "new session", id: a, start: now, counter: 1, now: now, isAccept: true},
+		{name: "replayed", id: a, start: now, counter: 1, now: now, isAccept: false},
+		{name: "next", id: a, start: now, counter: 2, now: now, isAccept: true},
+		{name: "another session", id: b, start: now, counter: 1, now: now, isAccept: true},
+		{name: "stale session", id: stale, start: now.Add(-sessionFreshness), counter: 1, now: now, isAccept: false},
+		{name: "session in future", id: future, start: now.Add(sessionFreshness), counter: 1, now: now, isAccept: false},
+		{name: "skewed session", id: future, start: now.Add(sessionFreshness / 2), counter: 1, now: now, isAccept: true},
+		{name: "session no longer fresh", id: a, start: now, counter: 3, now: now.Add(sessionFreshness), isAccept: false},
+		{name: "session evicted", id: b, start: now, counter: 2, now: now.Add(2 * sessionFreshness), isAccept: false},
+	}
+
+	f := newReplayFilter()
+	for _, test := range tests {
+		if f.accept(test.id, test.start, nil, test.counter, test.now) != test.isAccept {
+			t.Errorf("%s: %t, want %t", test.name, !test.isAccept, test.isAccept)
+		}
+	}
+}
+
+func TestReplayFilterFull(t *testing.T) {
+	now := time.Now()
+	f := newReplayFilter()
+
+	for i := 0; i < replaySessions; i++ {
+		if !f.accept([]byte{byte(i >> 8), byte(i)}, now, nil, 1, now) {
+			t.Fatalf("session %d rejected", i)
+		}
+	}
+
+	// Fresh sessions are never evicted
+	if f.accept([]byte("new"), now, nil, 1, now) {
+		t.Error("session accepted when full of fresh sessions")
+	}
+
+	// Stale sessions are purged
+	later := now.Add(sessionFreshness)
+	if !f.accept([]byte("new"), later, nil, 1, later) {
+		t.Error("session rejected when full of stale sessions")
+	}
+}
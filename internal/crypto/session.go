@@ -0,0 +1,269 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"sync"
+	"time"
+)
+
+// sessionIDSize is the size of the ID of a session, which salts the key of the session. The ID is composed of the time
+// the session starts in seconds in 4 Bytes and random bytes.
+const sessionIDSize = 16
+
+// sessionHeaderSize is the size of the ID of the session and the counter prefixed to each packet.
+const sessionHeaderSize = sessionIDSize + counterSize
+
+const (
+	// sessionLifetime is the duration a sender keeps a session for, so receivers always see sessions started recently.
+	sessionLifetime = 30 * time.Second
+	// sessionFreshness is the age of sessions a receiver accepts at most, which also tolerates clock skew between sides.
+	sessionFreshness = 2 * time.Minute
+)
+
+// deriveRate is the number of keys of sessions unknown a receiver derives in a second at most, which is also the burst.
+// Keys are derived before packets are authenticated, so packets of forged sessions cannot spend the CPU on HKDF, while
+// each peer only starts a session in every lifetime.
+const deriveRate = 256
+
+// packetInfo is the info of HKDF in deriving keys of sessions, followed by the direction.
+const packetInfo = "ikago packet key"
+
+// direction describes the side sending packets, so both sides never encrypt under the same key.
+type direction byte
+
+const (
+	// directionBoth describes packets sent by both sides, for peers which are neither client nor server.
+	directionBoth direction = iota
+	// directionClient describes packets sent by the client.
+	directionClient
+	// directionServer describes packets sent by the server.
+	directionServer
+)
+
+// peer returns the direction of packets sent by the peer.
+func (d direction) peer() direction {
+	switch d {
+	case directionClient:
+		return directionServer
+	case directionServer:
+		return directionClient
+	default:
+		return directionBoth
+	}
+}
+
+var isServer bool
+
+// SetServer sets if crypts parsed later are of the server, which tells the direction of packets they send.
+func SetServer(server bool) {
+	isServer = server
+}
+
+// side returns the direction of packets sent by crypts parsed.
+func side() direction {
+	if isServer {
+		return directionServer
+	}
+
+	return directionClient
+}
+
+// sessionCrypt describes a crypt of an AEAD whose key is never used directly. The sender starts a session with an ID
+// of the time and random bytes, and derives the key of the session from the key of the crypt by HKDF-SHA256 salted
+// with the ID, with its direction in the info. Nonces are counters in the session, so a nonce never repeats under a
+// key, and each packet is prefixed with the ID of its session and the counter. The sender starts a new session in
+// every lifetime, so receivers reject sessions not started recently, which are replayed.
+type sessionCrypt struct {
+	key      []byte
+	newAEAD  func(key []byte) (cipher.AEAD, error)
+	send     direction
+	overhead int
+	lock     sync.Mutex
+	session  *session
+	replay   *replayFilter
+	derives  deriveLimiter
+}
+
+// session describes a session of a sender.
+type session struct {
+	id    []byte
+	start time.Time
+	aead  cipher.AEAD
+	nonce *nonceCounter
+}
+
+// newSessionCrypt returns a crypt of the AEAD by given key, which sends packets in the direction.
+func newSessionCrypt(key []byte, newAEAD func(key []byte) (cipher.AEAD, error), send direction) (*sessionCrypt, error) {
+	c := &sessionCrypt{
+		key:     key,
+		newAEAD: newAEAD,
+		send:    send,
+		replay:  newReplayFilter(),
+	}
+
+	var err error
+	c.session, err = c.newSession(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	c.overhead = c.session.aead.Overhead()
+
+	return c, nil
+}
+
+// newSession returns a new session of the sender starting at the time.
+func (c *sessionCrypt) newSession(start time.Time) (*session, error) {
+	id, err := GenerateNonce(sessionIDSize)
+	if err != nil {
+		return nil, fmt.Errorf("generate session id: %w", err)
+	}
+	binary.BigEndian.PutUint32(id, uint32(start.Unix()))
+
+	aead, err := c.derive(id, c.send)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := newNonceCounter(aead.NonceSize())
+	if err != nil {
+		return nil, fmt.Errorf("new nonce counter: %w", err)
+	}
+
+	return &session{
+		id:    id,
+		start: start,
+		aead:  aead,
+		nonce: nonce,
+	}, nil
+}
+
+// derive returns the AEAD of the session of the ID in the direction.
+func (c *sessionCrypt) derive(id []byte, d direction) (cipher.AEAD, error) {
+	key := make([]byte, len(c.key))
+	_, err := io.ReadFull(hkdf.New(sha256.New, c.key, id, append([]byte(packetInfo), byte(d))), key)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+
+	aead, err := c.newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("new aead: %w", err)
+	}
+
+	return aead, nil
+}
+
+func (c *sessionCrypt) Encrypt(data []byte) ([]byte, error) {
+	c.lock.Lock()
+
+	// Next session
+	now := time.Now()
+	if now.Sub(c.session.start) >= sessionLifetime {
+		s, err := c.newSession(now)
+		if err != nil {
+			c.lock.Unlock()
+			return nil, err
+		}
+
+		c.session = s
+	}
+
+	s := c.session
+
+	c.lock.Unlock()
+
+	nonce := s.nonce.next()
+
+	result := make([]byte, 0, sessionHeaderSize+len(data)+c.overhead)
+	result = append(result, s.id...)
+	result = append(result, nonce[len(nonce)-counterSize:]...)
+
+	return s.aead.Seal(result, nonce, data, nil), nil
+}
+
+func (c *sessionCrypt) Decrypt(data []byte) ([]byte, error) {
+	if len(data) < sessionHeaderSize {
+		return nil, errors.New("missing session")
+	}
+	id, counter := data[:sessionIDSize], binary.BigEndian.Uint64(data[sessionIDSize:sessionHeaderSize])
+	start, now := sessionStart(id), time.Now()
+
+	// Sessions not started recently are never accepted, even if they are not known
+	if !isFresh(start, now) {
+		return nil, ErrStale
+	}
+
+	// Sessions are derived once they are authenticated
+	aead := c.replay.aead(id)
+	if aead == nil {
+		if !c.derives.allow(now) {
+			return nil, errors.New("too many sessions")
+		}
+
+		var err error
+		aead, err = c.derive(id, c.send.peer())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := aead.Open(nil, counterNonce(aead.NonceSize(), counter), data[sessionHeaderSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	// Replay
+	if !c.replay.accept(id, start, aead, counter, now) {
+		return nil, ErrReplayed
+	}
+
+	return result, nil
+}
+
+func (c *sessionCrypt) Cost() int {
+	return sessionHeaderSize + c.overhead
+}
+
+// deriveLimiter is a token bucket of keys of sessions derived.
+type deriveLimiter struct {
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// allow returns if a key can be derived at now, and takes a token if so.
+func (l *deriveLimiter) allow(now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.tokens = l.tokens + now.Sub(l.last).Seconds()*deriveRate
+	if l.tokens > deriveRate {
+		l.tokens = deriveRate
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+
+	return true
+}
+
+// sessionStart returns the time the session of the ID starts.
+func sessionStart(id []byte) time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint32(id)), 0)
+}
+
+// isFresh returns if the session starting at the time is started recently, either before or after it in the skew.
+func isFresh(start, now time.Time) bool {
+	d := now.Sub(start)
+
+	return d > -sessionFreshness && d < sessionFreshness
+}
@@ -0,0 +1,170 @@
+package crypto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPair returns crypts of the client and the server by given method and key.
+func newPair(t *testing.T, method string, key []byte) (Crypt, Crypt) {
+	t.Helper()
+
+	create := func(send direction) Crypt {
+		c, err := createCrypt(method, func(size int) []byte {
+			return key[:size]
+		}, send)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+
+		return c
+	}
+
+	return create(directionClient), create(directionServer)
+}
+
+func TestSessionCrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	methods := []string{"aes-128-gcm", "aes-192-gcm", "aes-256-gcm", "chacha20-poly1305", "xchacha20-poly1305", "plain+hmac"}
+
+	for _, method := range methods {
+		client, server := newPair(t, method, key)
+
+		// Both directions
+		for _, pair := range [][2]Crypt{{client, server}, {server, client}} {
+			data, err := pair[0].Encrypt([]byte("ping"))
+			if err != nil {
+				t.Fatalf("%s: encrypt: %v", method, err)
+			}
+			if len(data) != 4+pair[0].Cost() {
+				t.Errorf("%s: size %d, want %d", method, len(data), 4+pair[0].Cost())
+			}
+
+			result, err := pair[1].Decrypt(data)
+			if err != nil {
+				t.Fatalf("%s: decrypt: %v", method, err)
+			}
+			if !bytes.Equal(result, []byte("ping")) {
+				t.Fatalf("%s: decrypt %q, want %q", method, result, "ping")
+			}
+		}
+
+		// Reflected to the sender
+		data, err := client.Encrypt([]byte("ping"))
+		if err != nil {
+			t.Fatalf("%s: encrypt: %v", method, err)
+		}
+		_, err = client.Decrypt(data)
+		if err == nil {
+			t.Errorf("%s: reflected packet accepted", method)
+		}
+
+		// Tampered
+		data, err = client.Encrypt([]byte("ping"))
+		if err != nil {
+			t.Fatalf("%s: encrypt: %v", method, err)
+		}
+		data[sessionHeaderSize] ^= 1
+		_, err = server.Decrypt(data)
+		if err == nil {
+			t.Errorf("%s: tampered packet accepted", method)
+		}
+	}
+}
+
+func TestCreateCryptCFB(t *testing.T) {
+	_, err := createCrypt("AES-256-CFB", func(size int) []byte {
+		return make([]byte, size)
+	}, directionClient)
+	if err == nil || !strings.Contains(err.Error(), "aes-256-gcm") {
+		t.Fatalf("error %v, want aes-256-gcm suggested", err)
+	}
+}
+
+func TestSessionCryptReplay(t *testing.T) {
+	client, server := newPair(t, "aes-256-gcm", bytes.Repeat([]byte{1}, 32))
+
+	data, err := client.Encrypt([]byte("ping"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	_, err = server.Decrypt(data)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	_, err = server.Decrypt(data)
+	if err != ErrReplayed {
+		t.Errorf("replayed: %v, want %v", err, ErrReplayed)
+	}
+
+	// Sessions not started recently are rejected even by a restarted server, which does not know them
+	c := client.(*AESGCMCrypt).crypt
+	s, err := c.newSession(time.Now().Add(-sessionFreshness))
+	if err != nil {
+		t.Fatalf("new session: %v", err)
+	}
+	nonce := s.nonce.next()
+	data = append(append([]byte{}, s.id...), nonce[len(nonce)-counterSize:]...)
+	data = s.aead.Seal(data, nonce, []byte("ping"), nil)
+
+	_, restarted := newPair(t, "aes-256-gcm", bytes.Repeat([]byte{1}, 32))
+	_, err = restarted.Decrypt(data)
+	if err != ErrStale {
+		t.Errorf("stale: %v, want %v", err, ErrStale)
+	}
+}
+
+// TestSessionCryptDeriveLimit rejects sessions unknown once keys are derived up to the rate, while sessions known are
+// still accepted.
+func TestSessionCryptDeriveLimit(t *testing.T) {
+	client, server := newPair(t, "aes-256-gcm", bytes.Repeat([]byte{1}, 32))
+
+	known, err := client.Encrypt([]byte("ping"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	_, err = server.Decrypt(known)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+
+	// Derive up to the rate
+	c := server.(*AESGCMCrypt).crypt
+	for c.derives.allow(time.Now()) {
+	}
+
+	forged := append([]byte{}, known...)
+	forged[sessionIDSize-1] ^= 0xff
+	_, err = server.Decrypt(forged)
+	if err == nil || !strings.Contains(err.Error(), "too many sessions") {
+		t.Errorf("forged: %v, want too many sessions", err)
+	}
+
+	data, err := client.Encrypt([]byte("ping"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	_, err = server.Decrypt(data)
+	if err != nil {
+		t.Errorf("decrypt known: %v", err)
+	}
+}
+
+func TestDeriveLimiter(t *testing.T) {
+	var l deriveLimiter
+	now := time.Now()
+
+	for i := 0; i < deriveRate; i++ {
+		if !l.allow(now) {
+			t.Fatalf("derive %d: not allowed", i)
+		}
+	}
+	if l.allow(now) {
+		t.Error("derive over the burst: allowed")
+	}
+	if !l.allow(now.Add(time.Second / deriveRate)) {
+		t.Error("derive after refilled: not allowed")
+	}
+}
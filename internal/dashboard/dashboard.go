@@ -0,0 +1,205 @@
+package dashboard
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+// Handler returns a handler serving the dashboard of the monitor, which polls the API of the monitor in the same
+// origin, and shows throughput, clients, NAT or flows, and recent errors.
+func Handler(name string) (http.Handler, error) {
+	t, err := template.New("dashboard").Parse(page)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+
+	var b bytes.Buffer
+	err = t.Execute(&b, &struct{ Name string }{Name: name})
+	if err != nil {
+		return nil, fmt.Errorf("execute: %w", err)
+	}
+	content := b.Bytes()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(content)
+	}), nil
+}
+
+const page = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}</title>
+<style>
+body { margin: 0 auto; max-width: 960px; padding: 16px; font: 14px sans-serif; color: #222; }
+h1 { font-size: 20px; }
+h2 { font-size: 16px; margin-top: 24px; }
+table { width: 100%; border-collapse: collapse; }
+th, td { padding: 4px 8px; border-bottom: 1px solid #ddd; text-align: left; white-space: nowrap; }
+canvas { width: 100%; height: 160px; border: 1px solid #ddd; }
+.up { color: #2a2; }
+.down { color: #c22; }
+.in { color: #27c; }
+.out { color: #e80; }
+.empty { color: #888; }
+</style>
+</head>
+<body>
+<h1>{{.Name}} <span id="health"></span></h1>
+<div id="summary"></div>
+<h2>Throughput <span class="in">&#9632; in</span> <span class="out">&#9632; out</span></h2>
+<canvas id="graph" width="920" height="160"></canvas>
+<h2 id="clients-title">Clients</h2>
+<table id="clients"></table>
+<h2 id="table-title"></h2>
+<table id="table"></table>
+<h2>Recent errors</h2>
+<table id="errors"></table>
+<script>
+var points = 60, history = [], last = null;
+
+function size(b) {
+  if (b === undefined || b === null) return "-";
+  if (b < 1024) return b + " B";
+  if (b < 1048576) return (b / 1024).toFixed(2) + " KB";
+  if (b < 1073741824) return (b / 1048576).toFixed(2) + " MB";
+  return (b / 1073741824).toFixed(2) + " GB";
+}
+
+function duration(s) {
+  var d = Math.floor(s / 86400), h = Math.floor(s % 86400 / 3600), m = Math.floor(s % 3600 / 60);
+  return (d > 0 ? d + "d " : "") + (h > 0 ? h + "h " : "") + m + "m " + s % 60 + "s";
+}
+
+function get(path) {
+  return fetch(path, {cache: "no-store"}).then(function (resp) { return resp.json(); });
+}
+
+function render(id, headers, rows) {
+  var table = document.getElementById(id);
+  table.textContent = "";
+  var tr = table.insertRow();
+  headers.forEach(function (h) {
+    var th = document.createElement("th");
+    th.textContent = h;
+    tr.appendChild(th);
+  });
+  if (rows.length === 0) {
+    var td = table.insertRow().insertCell();
+    td.colSpan = headers.length;
+    td.className = "empty";
+    td.textContent = "None";
+  }
+  rows.forEach(function (row) {
+    var tr = table.insertRow();
+    row.forEach(function (v) { tr.insertCell().textContent = v; });
+  });
+}
+
+function total(manager) {
+  var sum = 0;
+  for (var node in manager || {}) sum += manager[node].size;
+  return sum;
+}
+
+function draw() {
+  var canvas = document.getElementById("graph"), ctx = canvas.getContext("2d");
+  ctx.clearRect(0, 0, canvas.width, canvas.height);
+  var max = 1;
+  history.forEach(function (p) { max = Math.max(max, p.in, p.out); });
+  ctx.fillStyle = "#888";
+  ctx.fillText(size(max) + "/s", 4, 12);
+  ["in", "out"].forEach(function (k) {
+    ctx.strokeStyle = k === "in" ? "#27c" : "#e80";
+    ctx.beginPath();
+    history.forEach(function (p, i) {
+      var x = canvas.width * (i + points - history.length) / (points - 1);
+      var y = canvas.height - 2 - (canvas.height - 20) * p[k] / max;
+      if (i === 0) ctx.moveTo(x, y); else ctx.lineTo(x, y);
+    });
+    ctx.stroke();
+  });
+}
+
+function update() {
+  get("/").then(function (m) {
+    var now = Date.now(), p = {time: now, in: total(m.monitor.local.in), out: total(m.monitor.local.out)};
+    if (last !== null) {
+      var seconds = Math.max((now - last.time) / 1000, 0.001);
+      history.push({in: Math.max(p.in - last.in, 0) / seconds, out: Math.max(p.out - last.out, 0) / seconds});
+      if (history.length > points) history.shift();
+    }
+    last = p;
+    draw();
+  });
+
+  get("/status").then(function (s) {
+    var health = document.getElementById("health");
+    health.textContent = s.upstream.isUp ? "healthy" : "down";
+    health.className = s.upstream.isUp ? "up" : "down";
+    var items = ["Version " + (s.version || "unknown"), "Uptime " + duration(s.time), "Mode " + s.upstream.mode];
+    if (s.upstream.server) items.push("Server " + s.upstream.server);
+    if (s.upstream.device) items.push("Device " + s.upstream.device);
+    if (s.upstream.listeners) items.push("Listen " + s.upstream.listeners.join(", "));
+    if (s.clients !== undefined) items.push(s.clients + " clients");
+    document.getElementById("summary").textContent = items.join(" · ");
+
+    var isServer = s.clients !== undefined;
+    document.getElementById("clients-title").textContent = isServer ? "Clients" : "Sources";
+    get("/clients").then(function (clients) {
+      if (isServer) {
+        render("clients", ["Client", "Mappings", "Ports", "In", "Out"], clients.map(function (c) {
+          return [c.client, c.mappings, c.ports || "-", size(c.in && c.in.size), size(c.out && c.out.size)];
+        }));
+      } else {
+        render("clients", ["Source", "Device", "Hardware address", "In", "Out"], clients.map(function (c) {
+          return [c.source, c.device || "-", c.hardwareAddr || "-", size(c.in && c.in.size), size(c.out && c.out.size)];
+        }));
+      }
+    });
+
+    if (isServer) {
+      document.getElementById("table-title").textContent = "NAT";
+      get("/nat").then(function (mappings) {
+        render("table", ["Client", "Protocol", "Internal", "External", "Idle", "In", "Out"], mappings.slice(0, 100).map(function (m) {
+          return [m.client, m.protocol, m.internal, m.external, m.idle + "s", size(m.bytesIn), size(m.bytesOut)];
+        }));
+      });
+    } else {
+      document.getElementById("table-title").textContent = "Flows";
+      get("/flows").then(function (flows) {
+        render("table", ["Source", "Destination", "In", "Out"], flows.slice(-100).reverse().map(function (f) {
+          return [f.local, f.remote, size(f.in && f.in.size), size(f.out && f.out.size)];
+        }));
+      });
+    }
+  }).catch(function () {
+    var health = document.getElementById("health");
+    health.textContent = "unreachable";
+    health.className = "down";
+  });
+
+  get("/errors").then(function (errors) {
+    render("errors", ["Time", "Error"], errors.slice(0, 20).map(function (e) {
+      return [new Date(e.time).toLocaleString(), e.message];
+    }));
+  });
+}
+
+update();
+setInterval(update, 1000);
+</script>
+</body>
+</html>
+`
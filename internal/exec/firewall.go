@@ -41,3 +41,91 @@ func AddSpecificFirewallRule(ip net.IP, port uint16) error {
 
 	return nil
 }
+
+// AddForwardFirewallRule adds a rule for firewall blocking forwarded packets to destinations in the CIDR with a range of
+// ports in the protocol, where a nil CIDR matches any IP, an empty protocol matches any protocol, and an empty range
+// matches any port.
+func AddForwardFirewallRule(ipNet *net.IPNet, protocol string, low, high uint16) error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = addForwardFirewallRule(ipNet, protocol, low, high)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteForwardFirewallRule deletes a rule added by AddForwardFirewallRule.
+func DeleteForwardFirewallRule(ipNet *net.IPNet, protocol string, low, high uint16) error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = deleteForwardFirewallRule(ipNet, protocol, low, high)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddForwardBypassFirewallRule adds a rule for firewall accepting forwarded packets to destinations in the CIDR before
+// rules blocking them.
+func AddForwardBypassFirewallRule(ipNet *net.IPNet) error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = addForwardBypassFirewallRule(ipNet)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteForwardBypassFirewallRule deletes a rule added by AddForwardBypassFirewallRule.
+func DeleteForwardBypassFirewallRule(ipNet *net.IPNet) error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = deleteForwardBypassFirewallRule(ipNet)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddForwardSourceFirewallRule adds a rule for firewall blocking forwarded packets from the host.
+func AddForwardSourceFirewallRule(ip net.IP) error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = addForwardSourceFirewallRule(ip)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
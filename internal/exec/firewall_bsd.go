@@ -13,6 +13,26 @@ func addGlobalFirewallRule() error {
 	return nil
 }
 
+func addForwardFirewallRule(ipNet *net.IPNet, protocol string, low, high uint16) error {
+	return nil
+}
+
+func deleteForwardFirewallRule(ipNet *net.IPNet, protocol string, low, high uint16) error {
+	return nil
+}
+
+func addForwardBypassFirewallRule(ipNet *net.IPNet) error {
+	return nil
+}
+
+func deleteForwardBypassFirewallRule(ipNet *net.IPNet) error {
+	return nil
+}
+
+func addForwardSourceFirewallRule(ip net.IP) error {
+	return nil
+}
+
 func addSpecificFirewallRule(ip net.IP, port uint16) error {
 	file, err := os.OpenFile("./pf.conf", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 755)
 	if err != nil {
@@ -14,14 +14,109 @@ func addGlobalFirewallRule() error {
 		return fmt.Errorf("exec iptables: %w", err)
 	}
 
+	routeCmd = exec.Command("ip6tables", "-A", "OUTPUT", "-p", "tcp", "--tcp-flags", "RST", "RST", "-j", "DROP")
+	_, err = routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec ip6tables: %w", err)
+	}
+
 	return nil
 }
 
 func addSpecificFirewallRule(ip net.IP, port uint16) error {
-	routeCmd := exec.Command("iptables", "-A", "OUTPUT", "-s", ip.String(), "-p", "tcp", "--dport", strconv.Itoa(int(port)), "-j", "DROP")
+	cmd := "iptables"
+	if ip.To4() == nil {
+		cmd = "ip6tables"
+	}
+
+	routeCmd := exec.Command(cmd, "-A", "OUTPUT", "-s", ip.String(), "-p", "tcp", "--dport", strconv.Itoa(int(port)), "-j", "DROP")
 	_, err := routeCmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("exec iptables: %w", err)
+		return fmt.Errorf("exec %s: %w", cmd, err)
+	}
+
+	return nil
+}
+
+func addForwardFirewallRule(ipNet *net.IPNet, protocol string, low, high uint16) error {
+	return forwardFirewallRule("-A", "DROP", ipNet, protocol, low, high)
+}
+
+func deleteForwardFirewallRule(ipNet *net.IPNet, protocol string, low, high uint16) error {
+	return forwardFirewallRule("-D", "DROP", ipNet, protocol, low, high)
+}
+
+// Bypass rules are inserted before rules dropping packets
+func addForwardBypassFirewallRule(ipNet *net.IPNet) error {
+	return forwardFirewallRule("-I", "ACCEPT", ipNet, "", 0, 0)
+}
+
+func deleteForwardBypassFirewallRule(ipNet *net.IPNet) error {
+	return forwardFirewallRule("-D", "ACCEPT", ipNet, "", 0, 0)
+}
+
+func addForwardSourceFirewallRule(ip net.IP) error {
+	cmd := "iptables"
+	if ip.To4() == nil {
+		cmd = "ip6tables"
+	}
+
+	routeCmd := exec.Command(cmd, "-A", "FORWARD", "-s", ip.String(), "-j", "DROP")
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec %s: %w", cmd, err)
+	}
+
+	return nil
+}
+
+func forwardFirewallRule(op, target string, ipNet *net.IPNet, protocol string, low, high uint16) error {
+	// Rules of any IP are added in both IPv4 and IPv6
+	cmds := []string{"iptables", "ip6tables"}
+	if ipNet != nil {
+		cmds = cmds[:1]
+		if ipNet.IP.To4() == nil {
+			cmds = []string{"ip6tables"}
+		}
+	}
+
+	for _, cmd := range cmds {
+		icmp := "icmp"
+		if cmd == "ip6tables" {
+			icmp = "ipv6-icmp"
+		}
+
+		// Ports are only matched with a protocol
+		protocols := []string{protocol}
+		switch protocol {
+		case "":
+			protocols = []string{"tcp", "udp"}
+			if high <= 0 {
+				protocols = []string{""}
+			}
+		case "icmp":
+			protocols = []string{icmp}
+		}
+
+		for _, p := range protocols {
+			args := []string{op, "FORWARD"}
+			if ipNet != nil {
+				args = append(args, "-d", ipNet.String())
+			}
+			if p != "" {
+				args = append(args, "-p", p)
+			}
+			if high > 0 {
+				args = append(args, "--dport", fmt.Sprintf("%d:%d", low, high))
+			}
+			args = append(args, "-j", target)
+
+			routeCmd := exec.Command(cmd, args...)
+			_, err := routeCmd.CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("exec %s: %w", cmd, err)
+			}
+		}
 	}
 
 	return nil
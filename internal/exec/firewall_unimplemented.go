@@ -11,3 +11,23 @@ func addGlobalFirewallRule() error {
 func addSpecificFirewallRule(ip net.IP, port uint16) error {
 	return nil
 }
+
+func addForwardFirewallRule(ipNet *net.IPNet, protocol string, low, high uint16) error {
+	return nil
+}
+
+func deleteForwardFirewallRule(ipNet *net.IPNet, protocol string, low, high uint16) error {
+	return nil
+}
+
+func addForwardBypassFirewallRule(ipNet *net.IPNet) error {
+	return nil
+}
+
+func deleteForwardBypassFirewallRule(ipNet *net.IPNet) error {
+	return nil
+}
+
+func addForwardSourceFirewallRule(ip net.IP) error {
+	return nil
+}
@@ -23,3 +23,22 @@ func DisableIPForwarding() error {
 
 	return nil
 }
+
+// EnableIPForwarding enables IP forwarding.
+func EnableIPForwarding() error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "darwin", "freebsd":
+		err = enableIPForwarding()
+	case "linux":
+		err = enableIPForwarding()
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
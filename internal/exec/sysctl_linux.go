@@ -14,3 +14,13 @@ func disableIPForwarding() error {
 
 	return nil
 }
+
+func enableIPForwarding() error {
+	routeCmd := exec.Command("sysctl", "-w", "net.ipv4.ip_forward=1")
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec sysctl: %w", err)
+	}
+
+	return nil
+}
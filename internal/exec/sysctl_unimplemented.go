@@ -5,3 +5,7 @@
 func disableIPForwarding() error {
 	return nil
 }
+
+func enableIPForwarding() error {
+	return nil
+}
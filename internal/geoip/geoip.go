@@ -0,0 +1,120 @@
+package geoip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+)
+
+// cacheSize is the maximum number of locations cached, and the cache is cleared when it is full.
+const cacheSize = 65536
+
+// Location describes the country and the autonomous system of an IP. Fields are empty if they are unknown.
+type Location struct {
+	Country string
+	ASN     uint32
+}
+
+// Database describes GeoIP databases in the MaxMind DB format, like GeoLite2 Country and GeoLite2 ASN, whose records
+// of an IP are merged.
+type Database struct {
+	paths   []string
+	lock    sync.RWMutex
+	readers []*reader
+	cache   map[string]Location
+}
+
+// Open returns GeoIP databases by the given paths.
+func Open(paths []string) (*Database, error) {
+	db := &Database{paths: paths}
+
+	err := db.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Reload reads databases again, like they are updated. Databases are kept if any of them fails.
+func (db *Database) Reload() error {
+	readers := make([]*reader, 0, len(db.paths))
+	for _, path := range db.paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+
+		r, err := newReader(b)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+		readers = append(readers, r)
+	}
+
+	db.lock.Lock()
+	db.readers = readers
+	db.cache = make(map[string]Location)
+	db.lock.Unlock()
+
+	return nil
+}
+
+// Lookup returns the location of the IP. Records malformed are treated as unknown.
+func (db *Database) Lookup(ip net.IP) Location {
+	key := ip.String()
+
+	db.lock.RLock()
+	location, ok := db.cache[key]
+	readers := db.readers
+	db.lock.RUnlock()
+	if ok {
+		return location
+	}
+
+	for _, r := range readers {
+		v, err := r.lookup(ip)
+		if err != nil {
+			continue
+		}
+		record, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if location.Country == "" {
+			location.Country = isoCode(record, "country")
+		}
+		if location.Country == "" {
+			location.Country = isoCode(record, "registered_country")
+		}
+		if asn, ok := record["autonomous_system_number"].(uint64); ok && location.ASN == 0 {
+			location.ASN = uint32(asn)
+		}
+	}
+
+	db.lock.Lock()
+	if len(db.cache) >= cacheSize {
+		db.cache = make(map[string]Location)
+	}
+	db.cache[key] = location
+	db.lock.Unlock()
+
+	return location
+}
+
+func isoCode(record map[string]interface{}, key string) string {
+	country, ok := record[key].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	code, _ := country["iso_code"].(string)
+
+	return strings.ToUpper(code)
+}
+
+func (db *Database) String() string {
+	return strings.Join(db.paths, ", ")
+}
@@ -0,0 +1,334 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+// metadataMarker is the marker the metadata of a MaxMind DB follows.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const (
+	// dataSeparatorSize is the size of the separator between the search tree and the data section.
+	dataSeparatorSize = 16
+	// maxDecodeDepth is the maximum depth of nested fields and pointers, so malformed databases do not recurse forever.
+	maxDecodeDepth = 32
+)
+
+// Types of fields in the data section
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// reader is a reader of a database in the MaxMind DB format, which is a binary search tree of IP addresses pointing to
+// records in the data section.
+type reader struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+func newReader(b []byte) (*reader, error) {
+	i := bytes.LastIndex(b, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("missing metadata")
+	}
+
+	d := &decoder{buffer: b[i+len(metadataMarker):]}
+	v, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("decode metadata: %w", err)
+	}
+	metadata, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid metadata")
+	}
+
+	r := &reader{}
+	fields := map[string]*uint{
+		"node_count":  &r.nodeCount,
+		"record_size": &r.recordSize,
+		"ip_version":  &r.ipVersion,
+	}
+	for key, p := range fields {
+		n, ok := metadata[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("missing metadata %s", key)
+		}
+		*p = uint(n)
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("record size %d not support", r.recordSize)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+dataSeparatorSize > uint(i) {
+		return nil, errors.New("search tree out of bounds")
+	}
+	r.tree = b[:treeSize]
+	r.data = b[treeSize+dataSeparatorSize : i]
+
+	// IPv4 addresses are mapped in ::/96 of IPv6 databases
+	if r.ipVersion == 6 {
+		for j := 0; j < 96 && r.ipv4Start < r.nodeCount; j++ {
+			r.ipv4Start, err = r.readNode(r.ipv4Start, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// readNode returns the left record of the node if the bit is 0, or the right one if it is 1.
+func (r *reader) readNode(node uint, bit uint) (uint, error) {
+	offset := node * r.recordSize / 4
+	if offset+r.recordSize/4 > uint(len(r.tree)) {
+		return 0, errors.New("node out of bounds")
+	}
+	b := r.tree[offset:]
+
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:])), nil
+	}
+}
+
+// lookup returns the record of the IP, or nil if it is not in the database.
+func (r *reader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < bits && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+
+		var err error
+		node, err = r.readNode(node, bit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case node == r.nodeCount:
+		return nil, nil
+	case node < r.nodeCount:
+		return nil, errors.New("invalid search tree")
+	}
+
+	d := &decoder{buffer: r.data}
+	v, _, err := d.decode(node - r.nodeCount - dataSeparatorSize)
+	if err != nil {
+		return nil, fmt.Errorf("decode record: %w", err)
+	}
+
+	return v, nil
+}
+
+// decoder is a decoder of fields in the data section, where maps are decoded as map[string]interface{}, arrays as
+// []interface{}, and unsigned integers as uint64.
+type decoder struct {
+	buffer []byte
+	depth  int
+}
+
+func (d *decoder) read(offset, size uint) ([]byte, error) {
+	if offset+size > uint(len(d.buffer)) || offset+size < offset {
+		return nil, errors.New("field out of bounds")
+	}
+
+	return d.buffer[offset : offset+size], nil
+}
+
+// decode returns the field at the offset and the offset of the next field.
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+	if d.depth >= maxDecodeDepth {
+		return nil, 0, errors.New("fields too deep")
+	}
+	d.depth++
+	defer func() {
+		d.depth--
+	}()
+
+	b, err := d.read(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	control := b[0]
+	offset++
+
+	t := uint(control >> 5)
+	if t == typeExtended {
+		b, err := d.read(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		t = 7 + uint(b[0])
+		offset++
+	}
+
+	// Pointers point to fields in the data section, and the field pointed is not a pointer
+	if t == typePointer {
+		ss := uint(control>>3) & 0x3
+		b, err := d.read(offset, ss+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		p := uint(control & 0x7)
+		if ss == 3 {
+			p = 0
+		}
+		for _, c := range b {
+			p = p<<8 | uint(c)
+		}
+		switch ss {
+		case 1:
+			p += 2048
+		case 2:
+			p += 526336
+		}
+
+		v, _, err := d.decode(p)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return v, offset + ss + 1, nil
+	}
+
+	size := uint(control & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.read(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+
+		size = 0
+		for _, c := range b {
+			size = size<<8 | uint(c)
+		}
+		switch n {
+		case 1:
+			size += 29
+		case 2:
+			size += 285
+		default:
+			size += 65821
+		}
+	}
+
+	switch t {
+	case typeString, typeBytes:
+		b, err := d.read(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if t == typeString {
+			return string(b), offset + size, nil
+		}
+		return append([]byte(nil), b...), offset + size, nil
+	case typeDouble, typeFloat:
+		b, err := d.read(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if size == 8 {
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), offset + size, nil
+		}
+		if size == 4 {
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset + size, nil
+		}
+		return nil, 0, fmt.Errorf("float size %d not support", size)
+	case typeUint16, typeUint32, typeUint64, typeUint128, typeInt32:
+		b, err := d.read(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if size > 8 {
+			// 128-bit integers are not used by records looked up, and are skipped
+			return nil, offset + size, nil
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset + size, nil
+	case typeBool:
+		return size != 0, offset, nil
+	case typeMap:
+		m := make(map[string]interface{})
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("invalid map key")
+			}
+			v, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]interface{}, 0)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	default:
+		return nil, 0, fmt.Errorf("type %d not support", t)
+	}
+}
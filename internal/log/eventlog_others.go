@@ -0,0 +1,14 @@
+// +build !windows
+
+package log
+
+import "errors"
+
+// SetEventLog sets the source messages are reported to the Windows Event Log as, which is only supported in Windows.
+func SetEventLog(source string) error {
+	if source == "" {
+		return nil
+	}
+
+	return errors.New("event log not support in this os")
+}
@@ -0,0 +1,47 @@
+// +build windows
+
+package log
+
+import (
+	"fmt"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// eventLogWriter describes an event source in the Windows Event Log.
+type eventLogWriter struct {
+	log *eventlog.Log
+}
+
+// SetEventLog sets the source messages are reported to the Windows Event Log as. The Windows Event Log is disabled if
+// the source is empty.
+func SetEventLog(source string) error {
+	if source == "" {
+		setSink("eventlog", nil)
+		return nil
+	}
+
+	// The source is registered if it is not, which requires administrator, and messages are still reported without
+	// being registered
+	eventlog.InstallAsEventCreate(source, eventlog.Error|eventlog.Warning|eventlog.Info)
+
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	setSink("eventlog", &eventLogWriter{log: l})
+
+	return nil
+}
+
+func (w *eventLogWriter) write(level, s string) error {
+	switch level {
+	case "error":
+		return w.log.Error(1, s)
+	default:
+		return w.log.Info(1, s)
+	}
+}
+
+func (w *eventLogWriter) close() error {
+	return w.log.Close()
+}
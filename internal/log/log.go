@@ -1,19 +1,27 @@
 package log
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strings"
 	"sync"
+	"time"
 )
 
 const warnLogFileSize int64 = 200 * 1024 * 1024
 
 var (
 	allowVerbose bool
+	isJSON       bool
 )
 
+// Fields describes fields of a message, which are printed only in JSON format, like the flow and the client.
+type Fields map[string]interface{}
+
 var (
 	outLogger *logger
 	errLogger *logger
@@ -25,18 +33,95 @@ type logger struct {
 	out  io.Writer
 }
 
-func (l *logger) output(s string) error {
+func (l *logger) output(level, s string, fields Fields) error {
+	if level == "error" {
+		addRecentError(s)
+	}
+
+	s = formatMessage(level, s, fields)
+
 	l.lock.Lock()
 	_, err := l.out.Write([]byte(s))
 	l.lock.Unlock()
 
 	if logLogger != nil {
-		logLogger.Output(2, s)
+		outputLog(s)
 	}
+	outputSinks(level, s)
 
 	return err
 }
 
+// outputLog prints message to the log file, where messages in JSON format have their own timestamps.
+func outputLog(s string) {
+	if isJSON {
+		logLogger.Writer().Write([]byte(s))
+		return
+	}
+
+	logLogger.Output(3, s)
+}
+
+// formatMessage returns the message in the current format. In JSON format, the message is an object in a line with
+// the level, the timestamp, fields, and the chain of the error if the message is an error.
+func formatMessage(level, s string, fields Fields) string {
+	if !isJSON {
+		return s
+	}
+
+	m := make(map[string]interface{})
+	for k, v := range fields {
+		m[k] = v
+	}
+	m["level"] = level
+	m["time"] = time.Now().Format(time.RFC3339Nano)
+	m["msg"] = strings.TrimRight(s, "\n")
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return s
+	}
+
+	return string(b) + "\n"
+}
+
+// chain returns messages of each error in the chain, without messages of errors wrapped.
+func chain(err error) []string {
+	result := make([]string, 0)
+
+	for err != nil {
+		inner := errors.Unwrap(err)
+		if inner == nil {
+			result = append(result, err.Error())
+			break
+		}
+
+		result = append(result, strings.TrimSuffix(err.Error(), ": "+inner.Error()))
+		err = inner
+	}
+
+	return result
+}
+
+// errorFields returns fields with the chain of the error in arguments.
+func errorFields(fields Fields, v ...interface{}) Fields {
+	if !isJSON || len(v) != 1 {
+		return fields
+	}
+	err, ok := v[0].(error)
+	if !ok {
+		return fields
+	}
+
+	result := make(Fields)
+	for k, v := range fields {
+		result[k] = v
+	}
+	result["errors"] = chain(err)
+
+	return result
+}
+
 func init() {
 	allowVerbose = false
 	outLogger = &logger{out: os.Stdout}
@@ -48,24 +133,33 @@ func SetVerbose(allow bool) {
 	allowVerbose = allow
 }
 
-// SetLog sets the path of log file.
+// SetFormat sets the format of messages, which can be text or JSON.
+func SetFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "", "text":
+		isJSON = false
+	case "json":
+		isJSON = true
+	default:
+		return fmt.Errorf("format %s not support", format)
+	}
+
+	return nil
+}
+
+// SetLog sets the path of log file, which is rotated by options of rotation.
 func SetLog(path string) error {
 	if path != "" {
-		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 755)
-		if err != nil {
-			return fmt.Errorf("open: %w", err)
-		}
-
-		stat, err := file.Stat()
+		r, err := newRotator(path, rotateOptions)
 		if err != nil {
-			return fmt.Errorf("stat: %w", err)
+			return err
 		}
 
-		if stat.Size() > warnLogFileSize {
-			Infof("The log file is too large. You may delete %s manually to save disk space.\n", path)
+		if r.size > warnLogFileSize && !rotateOptions.isEnabled() {
+			Infof("The log file is too large. You may delete %s manually or rotate it to save disk space.\n", path)
 		}
 
-		logLogger = log.New(file, "", log.LstdFlags)
+		logLogger = log.New(r, "", log.LstdFlags)
 	}
 
 	return nil
@@ -76,10 +170,10 @@ func Verbosef(format string, v ...interface{}) {
 	s := fmt.Sprintf(format, v...)
 
 	if allowVerbose {
-		outLogger.output(s)
+		outLogger.output("verbose", s, nil)
 	}
 	if !allowVerbose && logLogger != nil {
-		logLogger.Output(2, s)
+		outputLog(formatMessage("verbose", s, nil))
 	}
 }
 
@@ -88,10 +182,10 @@ func Verbose(v ...interface{}) {
 	s := fmt.Sprint(v...)
 
 	if allowVerbose {
-		outLogger.output(s)
+		outLogger.output("verbose", s, nil)
 	}
 	if !allowVerbose && logLogger != nil {
-		logLogger.Output(2, s)
+		outputLog(formatMessage("verbose", s, nil))
 	}
 }
 
@@ -100,41 +194,51 @@ func Verboseln(v ...interface{}) {
 	s := fmt.Sprintln(v...)
 
 	if allowVerbose {
-		outLogger.output(s)
+		outLogger.output("verbose", s, nil)
 	}
 	if !allowVerbose && logLogger != nil {
-		logLogger.Output(2, s)
+		outputLog(formatMessage("verbose", s, nil))
 	}
 }
 
 // Infof prints message to the stdout. Arguments are handled in the manner of fmt.Printf.
 func Infof(format string, v ...interface{}) {
-	outLogger.output(fmt.Sprintf(format, v...))
+	outLogger.output("info", fmt.Sprintf(format, v...), nil)
 }
 
 // Info prints message to the stdout. Arguments are handled in the manner of fmt.Print.
 func Info(v ...interface{}) {
-	outLogger.output(fmt.Sprint(v...))
+	outLogger.output("info", fmt.Sprint(v...), nil)
 }
 
 // Infoln prints message to the stdout. Arguments are handled in the manner of fmt.Println.
 func Infoln(v ...interface{}) {
-	outLogger.output(fmt.Sprintln(v...))
+	outLogger.output("info", fmt.Sprintln(v...), nil)
 }
 
 // Errorf prints message to the stderr. Arguments are handled in the manner of fmt.Printf.
 func Errorf(format string, v ...interface{}) {
-	errLogger.output(fmt.Sprintf(format, v...))
+	errLogger.output("error", fmt.Sprintf(format, v...), nil)
 }
 
 // Error prints message to the stderr. Arguments are handled in the manner of fmt.Print.
 func Error(v ...interface{}) {
-	errLogger.output(fmt.Sprint(v...))
+	errLogger.output("error", fmt.Sprint(v...), errorFields(nil, v...))
 }
 
 // Errorln prints message to the stderr. Arguments are handled in the manner of fmt.Printf.
 func Errorln(v ...interface{}) {
-	errLogger.output(fmt.Sprintln(v...))
+	errLogger.output("error", fmt.Sprintln(v...), errorFields(nil, v...))
+}
+
+// Infow prints message with fields to the stdout. Arguments are handled in the manner of fmt.Printf.
+func Infow(fields Fields, format string, v ...interface{}) {
+	outLogger.output("info", fmt.Sprintf(format, v...), fields)
+}
+
+// Errorw prints message with fields to the stderr. Arguments are handled in the manner of fmt.Println.
+func Errorw(fields Fields, v ...interface{}) {
+	errLogger.output("error", fmt.Sprintln(v...), errorFields(fields, v...))
 }
 
 // Fatalf prints message to the stderr, and ends with os.Exit(1). Arguments are handled in the manner of fmt.Printf.
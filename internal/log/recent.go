@@ -0,0 +1,48 @@
+package log
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRecentErrors is the number of recent errors kept.
+const maxRecentErrors = 100
+
+// RecentError describes an error printed recently.
+type RecentError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+var (
+	recentLock   sync.Mutex
+	recentErrors []RecentError
+)
+
+// addRecentError keeps the error, and drops the oldest one if there are too many errors.
+func addRecentError(s string) {
+	recentLock.Lock()
+	defer recentLock.Unlock()
+
+	if len(recentErrors) >= maxRecentErrors {
+		recentErrors = recentErrors[1:]
+	}
+	recentErrors = append(recentErrors, RecentError{
+		Time:    time.Now(),
+		Message: strings.TrimRight(s, "\n"),
+	})
+}
+
+// RecentErrors returns errors printed recently, from the most recent.
+func RecentErrors() []RecentError {
+	recentLock.Lock()
+	defer recentLock.Unlock()
+
+	result := make([]RecentError, 0, len(recentErrors))
+	for i := len(recentErrors) - 1; i >= 0; i-- {
+		result = append(result, recentErrors[i])
+	}
+
+	return result
+}
@@ -0,0 +1,200 @@
+package log
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateOptions describes when the log file is rotated, and how rotated files are kept.
+type RotateOptions struct {
+	// Size is the size of the log file rotated at, 0 as unlimited.
+	Size int64
+	// Interval is the duration the log file is written for at most, 0 as unlimited.
+	Interval time.Duration
+	// Backups is the number of rotated files kept, 0 as unlimited.
+	Backups int
+	// Compress is if rotated files are compressed in gzip.
+	Compress bool
+}
+
+var rotateOptions RotateOptions
+
+// SetRotateOptions sets the options of rotation, log files set later will use the options.
+func SetRotateOptions(options RotateOptions) {
+	rotateOptions = options
+}
+
+func (options RotateOptions) isEnabled() bool {
+	return options.Size > 0 || options.Interval > 0
+}
+
+// rotateTimeFormat is the format of the time suffixed to rotated files.
+const rotateTimeFormat = "20060102-150405.000"
+
+// rotator describes a log file which is rotated by the size and the time. Rotated files are renamed with the time
+// suffixed, like ikago.log.20200101-000000.000.
+type rotator struct {
+	lock    sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	opened  time.Time
+	options RotateOptions
+}
+
+func newRotator(path string, options RotateOptions) (*rotator, error) {
+	r := &rotator{path: path, options: options}
+
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotator) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 755)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("stat: %w", err)
+	}
+
+	r.file = file
+	r.size = stat.Size()
+	r.opened = time.Now()
+
+	return nil
+}
+
+func (r *rotator) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.options.Size > 0 && r.size > 0 && r.size+int64(len(p)) > r.options.Size ||
+		r.options.Interval > 0 && time.Now().Sub(r.opened) > r.options.Interval {
+		err := r.rotate()
+		if err != nil {
+			return 0, fmt.Errorf("rotate: %w", err)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size = r.size + int64(n)
+
+	return n, err
+}
+
+func (r *rotator) rotate() error {
+	err := r.file.Close()
+	if err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	name := r.path + "." + time.Now().Format(rotateTimeFormat)
+	err = os.Rename(r.path, name)
+	if err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	err = r.open()
+	if err != nil {
+		return err
+	}
+
+	// Compress and remove old files in background
+	go func() {
+		if r.options.Compress {
+			err := compress(name)
+			if err != nil {
+				Errorln(fmt.Errorf("compress log %s: %w", name, err))
+			}
+		}
+		r.prune()
+	}()
+
+	return nil
+}
+
+// prune removes the oldest rotated files beyond the number of backups.
+func (r *rotator) prune() {
+	if r.options.Backups <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+
+	// Files are sorted by the time suffixed, and files being compressed are ignored
+	files := make([]string, 0)
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(match, r.path+"."), ".gz")
+		_, err := time.Parse(rotateTimeFormat, suffix)
+		if err != nil {
+			continue
+		}
+		if r.options.Compress && !strings.HasSuffix(match, ".gz") {
+			continue
+		}
+		files = append(files, match)
+	}
+	sort.Strings(files)
+
+	for i := 0; i < len(files)-r.options.Backups; i++ {
+		err := os.Remove(files[i])
+		if err != nil {
+			Errorln(fmt.Errorf("remove log %s: %w", files[i], err))
+		}
+	}
+}
+
+// compress compresses the file in gzip, and removes the original file.
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+
+	w := gzip.NewWriter(dst)
+	_, err = io.Copy(w, src)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return fmt.Errorf("write: %w", err)
+	}
+
+	src.Close()
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("remove: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package log
+
+import (
+	"strings"
+	"sync"
+)
+
+// sink describes an output of messages besides the stdout, the stderr and the log file, like syslog.
+type sink interface {
+	write(level, s string) error
+	close() error
+}
+
+var (
+	sinkLock sync.RWMutex
+	sinks    = make(map[string]sink)
+)
+
+// setSink replaces the sink of the name, and closes the old one. The sink is removed if it is nil.
+func setSink(name string, s sink) {
+	sinkLock.Lock()
+	old, ok := sinks[name]
+	if s == nil {
+		delete(sinks, name)
+	} else {
+		sinks[name] = s
+	}
+	sinkLock.Unlock()
+
+	if ok {
+		old.close()
+	}
+}
+
+// outputSinks prints message to all sinks. Failures are ignored, because they cannot be logged anywhere else.
+func outputSinks(level, s string) {
+	sinkLock.RLock()
+	defer sinkLock.RUnlock()
+
+	if len(sinks) <= 0 {
+		return
+	}
+
+	s = strings.TrimRight(s, "\n")
+	for _, sink := range sinks {
+		sink.write(level, s)
+	}
+}
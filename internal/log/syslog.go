@@ -0,0 +1,160 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	syslogDialTimeout  = time.Second
+	syslogRetryBackoff = 10 * time.Second
+	// syslogFacility is the facility daemon
+	syslogFacility = 3
+	// syslogTimeFormat is the timestamp in RFC 5424 with microseconds at most
+	syslogTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// syslogWriter describes a syslog client sends messages in RFC 5424. Messages in TCP are framed by octet counting in
+// RFC 6587.
+type syslogWriter struct {
+	lock     sync.Mutex
+	network  string
+	addr     string
+	hostname string
+	tag      string
+	conn     net.Conn
+	failed   time.Time
+}
+
+// SetSyslog sets the syslog server messages are sent to, like udp://localhost:514, tcp://localhost:601 and
+// unixgram:///dev/log, with the tag as the app name. Syslog is disabled if the address is empty.
+func SetSyslog(addr, tag string) error {
+	if addr == "" {
+		setSink("syslog", nil)
+		return nil
+	}
+
+	w, err := newSyslogWriter(addr, tag)
+	if err != nil {
+		return err
+	}
+	setSink("syslog", w)
+
+	return nil
+}
+
+func newSyslogWriter(addr, tag string) (*syslogWriter, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+
+	w := &syslogWriter{network: u.Scheme, tag: tag}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("missing host in %s", addr)
+		}
+		w.addr = u.Host
+		if u.Port() == "" {
+			if u.Scheme == "udp" {
+				w.addr = net.JoinHostPort(u.Hostname(), "514")
+			} else {
+				w.addr = net.JoinHostPort(u.Hostname(), "601")
+			}
+		}
+	case "unixgram":
+		if u.Path == "" {
+			return nil, fmt.Errorf("missing path in %s", addr)
+		}
+		w.addr = u.Path
+	default:
+		return nil, fmt.Errorf("scheme %s not support", u.Scheme)
+	}
+
+	w.hostname, err = os.Hostname()
+	if err != nil || w.hostname == "" {
+		w.hostname = "-"
+	}
+
+	err = w.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *syslogWriter) connect() error {
+	conn, err := net.DialTimeout(w.network, w.addr, syslogDialTimeout)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	w.conn = conn
+
+	return nil
+}
+
+func (w *syslogWriter) write(level, s string) error {
+	var severity int
+	switch level {
+	case "error":
+		severity = 3
+	case "info":
+		severity = 6
+	default:
+		severity = 7
+	}
+
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", syslogFacility*8+severity, time.Now().Format(syslogTimeFormat),
+		w.hostname, w.tag, os.Getpid(), s)
+	if w.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	// Reconnect once in a while, and messages are dropped before then
+	if w.conn == nil {
+		if time.Now().Sub(w.failed) < syslogRetryBackoff {
+			return errors.New("disconnected")
+		}
+
+		err := w.connect()
+		if err != nil {
+			w.failed = time.Now()
+			return err
+		}
+	}
+
+	_, err := w.conn.Write([]byte(msg))
+	if err != nil {
+		w.conn.Close()
+		w.conn = nil
+		w.failed = time.Now()
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return nil
+}
+
+func (w *syslogWriter) close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.conn == nil {
+		return nil
+	}
+
+	err := w.conn.Close()
+	w.conn = nil
+
+	return err
+}
@@ -0,0 +1,108 @@
+package obfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Method describes the method of the obfuscation.
+type Method int
+
+const (
+	// MethodPlain describes the obfuscation is in plain which will not obfuscate the data.
+	MethodPlain Method = iota
+	// MethodTLS describes the obfuscation is in TLS 1.3 records.
+	MethodTLS
+	// MethodScramble describes the obfuscation is in uniform random bytes.
+	MethodScramble
+)
+
+func (m Method) String() string {
+	switch m {
+	case MethodPlain:
+		return "Plain"
+	case MethodTLS:
+		return "TLS"
+	case MethodScramble:
+		return "Scramble"
+	default:
+		return strconv.Itoa(int(m))
+	}
+}
+
+// Obfuscator describes obfuscation of encrypted data before it is framed in FakeTCP.
+type Obfuscator interface {
+	// Hello returns the data the client sends after TCP handshaking, or nil if no data.
+	Hello() ([]byte, error)
+	// Handshake returns if the data is in handshaking of the obfuscation, and the data replies to it, or nil if no
+	// reply.
+	Handshake([]byte) (bool, []byte, error)
+	// Wrap returns the obfuscated data.
+	Wrap([]byte) ([]byte, error)
+	// Unwrap returns the data from the obfuscated data.
+	Unwrap([]byte) ([]byte, error)
+	// Delay returns the duration to wait before the next data is sent.
+	Delay() time.Duration
+	// Method returns the method of obfuscation.
+	Method() Method
+	// Cost returns the size of cost.
+	Cost() int
+}
+
+// IsDelayed returns if the obfuscator delays data sent, so the data needs to be queued not to block writers.
+func IsDelayed(o Obfuscator) bool {
+	s, ok := o.(*ScrambleObfuscator)
+
+	return ok && s.isIAT
+}
+
+// ParseObfuscator returns an obfuscator by the given string, can be empty, plain, tls followed by the server name, or
+// scramble followed by the secret and iat which are both optional.
+func ParseObfuscator(s string) (Obfuscator, error) {
+	fields := strings.Fields(s)
+	if len(fields) <= 0 {
+		return CreatePlainObfuscator(), nil
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "plain":
+		if len(fields) > 1 {
+			return nil, fmt.Errorf("obfs %s not support", s)
+		}
+		return CreatePlainObfuscator(), nil
+	case "tls":
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("obfs %s not support", s)
+		}
+		if len(fields) > 1 {
+			return CreateTLSObfuscator(fields[1]), nil
+		}
+		return CreateTLSObfuscator(""), nil
+	case "scramble":
+		var (
+			secret string
+			iat    bool
+		)
+
+		for _, field := range fields[1:] {
+			if strings.ToLower(field) == "iat" && !iat {
+				iat = true
+			} else if secret == "" {
+				secret = field
+			} else {
+				return nil, fmt.Errorf("obfs %s not support", s)
+			}
+		}
+
+		o, err := CreateScrambleObfuscator(secret, iat)
+		if err != nil {
+			return nil, err
+		}
+
+		return o, nil
+	default:
+		return nil, fmt.Errorf("obfs %s not support", s)
+	}
+}
@@ -0,0 +1,144 @@
+package obfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+// TestWrapUnwrap round-trips data of sizes in obfuscators, including data of more than one TLS record.
+func TestWrapUnwrap(t *testing.T) {
+	obfuscators := []string{"", "plain", "tls", "tls www.example.com", "scramble", "scramble secret", "scramble secret iat"}
+	sizes := []int{0, 1, 1400, tlsRecordMaxSize, tlsRecordMaxSize + 1, 20000}
+
+	for _, s := range obfuscators {
+		o, err := ParseObfuscator(s)
+		if err != nil {
+			t.Fatalf("parse %q: %v", s, err)
+		}
+
+		for _, size := range sizes {
+			data := make([]byte, size)
+			_, err := rand.Read(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wrapped, err := o.Wrap(append([]byte(nil), data...))
+			if err != nil {
+				t.Fatalf("%q: wrap %d bytes: %v", s, size, err)
+			}
+			if o.Method() == MethodScramble && size >= 16 && bytes.Contains(wrapped, data) {
+				t.Errorf("%q: wrap %d bytes in plain", s, size)
+			}
+
+			unwrapped, err := o.Unwrap(wrapped)
+			if err != nil {
+				t.Fatalf("%q: unwrap %d bytes: %v", s, size, err)
+			}
+			if !bytes.Equal(unwrapped, data) {
+				t.Errorf("%q: unwrap %d bytes, want the data wrapped", s, size)
+			}
+		}
+	}
+}
+
+// TestUnwrapMalformed rejects frames which are truncated or not application data.
+func TestUnwrapMalformed(t *testing.T) {
+	tlsObfuscator := CreateTLSObfuscator("")
+	scrambleObfuscator, err := CreateScrambleObfuscator("secret", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := tlsObfuscator.Wrap([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := scrambleObfuscator.Wrap([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		o    Obfuscator
+		data []byte
+	}{
+		{"tls header", tlsObfuscator, record[:tlsRecordHeaderSize-1]},
+		{"tls record", tlsObfuscator, record[:len(record)-1]},
+		{"tls type", tlsObfuscator, append([]byte{tlsRecordHandshake}, record[1:]...)},
+		{"scramble header", scrambleObfuscator, frame[:scrambleIVSize+1]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := test.o.Unwrap(test.data)
+			if err == nil {
+				t.Error("unwrapped")
+			}
+		})
+	}
+}
+
+// TestTLSHandshake runs the forged handshake between a client and a server before data is wrapped.
+func TestTLSHandshake(t *testing.T) {
+	client, server := CreateTLSObfuscator("www.example.com"), CreateTLSObfuscator("")
+
+	hello, err := client.Hello()
+	if err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+
+	ok, serverHello, err := server.Handshake(hello)
+	if err != nil || !ok || len(serverHello) <= 0 {
+		t.Fatalf("server handshake: %t, %d bytes, %v", ok, len(serverHello), err)
+	}
+
+	ok, finished, err := client.Handshake(serverHello)
+	if err != nil || !ok || len(finished) <= 0 {
+		t.Fatalf("client handshake: %t, %d bytes, %v", ok, len(finished), err)
+	}
+
+	ok, reply, err := server.Handshake(finished)
+	if err != nil || !ok || reply != nil {
+		t.Fatalf("server finished: %t, %d bytes, %v", ok, len(reply), err)
+	}
+
+	// Data is not in handshaking
+	wrapped, err := client.Wrap([]byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, _, err = server.Handshake(wrapped)
+	if err != nil || ok {
+		t.Fatalf("server handshake data: %t, %v", ok, err)
+	}
+}
+
+// TestScrambleDelay delays frames only in IAT mode.
+func TestScrambleDelay(t *testing.T) {
+	tests := []struct {
+		iat bool
+	}{
+		{false},
+		{true},
+	}
+
+	for _, test := range tests {
+		o, err := CreateScrambleObfuscator("", test.iat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if IsDelayed(o) != test.iat {
+			t.Errorf("iat %t: delayed %t", test.iat, IsDelayed(o))
+		}
+
+		for i := 0; i < 100; i++ {
+			d := o.Delay()
+			if d < 0 || d >= scrambleDelay || (!test.iat && d != 0) {
+				t.Fatalf("iat %t: delay %s", test.iat, d)
+			}
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package obfs
+
+import "time"
+
+// PlainObfuscator describes a plain obfuscator which will not obfuscate the data.
+type PlainObfuscator struct {
+}
+
+// CreatePlainObfuscator returns a plain obfuscator.
+func CreatePlainObfuscator() *PlainObfuscator {
+	return &PlainObfuscator{}
+}
+
+func (o *PlainObfuscator) Hello() ([]byte, error) {
+	return nil, nil
+}
+
+func (o *PlainObfuscator) Handshake(data []byte) (bool, []byte, error) {
+	return false, nil, nil
+}
+
+func (o *PlainObfuscator) Wrap(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (o *PlainObfuscator) Unwrap(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (o *PlainObfuscator) Delay() time.Duration {
+	return 0
+}
+
+func (o *PlainObfuscator) Method() Method {
+	return MethodPlain
+}
+
+func (o *PlainObfuscator) Cost() int {
+	return 0
+}
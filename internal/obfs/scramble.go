@@ -0,0 +1,111 @@
+package obfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// scrambleIVSize is the size of the random IV of each frame.
+const scrambleIVSize = aes.BlockSize
+
+// scramblePadding is the size of random padding of each frame at most.
+const scramblePadding = 64
+
+// scrambleDelay is the random delay before each frame is sent at most in IAT mode.
+const scrambleDelay = 10 * time.Millisecond
+
+// ScrambleObfuscator describes an obfuscator which scrambles frames into uniform random bytes with random padding, and
+// randomizes inter-arrival times optionally, like obfs4, so the flow survives entropy and length based classification.
+// Each frame is composed of a random IV, and the size of data, data and padding, which are XORed with AES-CTR keyed by
+// the secret.
+type ScrambleObfuscator struct {
+	block cipher.Block
+	isIAT bool
+}
+
+// CreateScrambleObfuscator returns a scramble obfuscator by given secret, and if inter-arrival times are randomized.
+func CreateScrambleObfuscator(secret string, iat bool) (*ScrambleObfuscator, error) {
+	key := sha256.Sum256([]byte("ikago scramble " + secret))
+
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, fmt.Errorf("new cipher: %w", err)
+	}
+
+	return &ScrambleObfuscator{
+		block: block,
+		isIAT: iat,
+	}, nil
+}
+
+func (o *ScrambleObfuscator) Hello() ([]byte, error) {
+	return nil, nil
+}
+
+func (o *ScrambleObfuscator) Handshake(data []byte) (bool, []byte, error) {
+	return false, nil, nil
+}
+
+func (o *ScrambleObfuscator) Wrap(data []byte) ([]byte, error) {
+	size, err := rand.Int(rand.Reader, big.NewInt(scramblePadding+1))
+	if err != nil {
+		return nil, fmt.Errorf("generate padding size: %w", err)
+	}
+
+	result := make([]byte, scrambleIVSize+2+len(data)+int(size.Int64()))
+	_, err = rand.Read(result[:scrambleIVSize])
+	if err != nil {
+		return nil, fmt.Errorf("generate iv: %w", err)
+	}
+	binary.BigEndian.PutUint16(result[scrambleIVSize:], uint16(len(data)))
+	copy(result[scrambleIVSize+2:], data)
+
+	// Padding is left as zeros, which turn random after XOR
+	cipher.NewCTR(o.block, result[:scrambleIVSize]).XORKeyStream(result[scrambleIVSize:], result[scrambleIVSize:])
+
+	return result, nil
+}
+
+func (o *ScrambleObfuscator) Unwrap(data []byte) ([]byte, error) {
+	if len(data) < scrambleIVSize+2 {
+		return nil, errors.New("frame too short")
+	}
+
+	result := make([]byte, len(data)-scrambleIVSize)
+	cipher.NewCTR(o.block, data[:scrambleIVSize]).XORKeyStream(result, data[scrambleIVSize:])
+
+	size := int(binary.BigEndian.Uint16(result))
+	if len(result) < 2+size {
+		return nil, errors.New("frame too short")
+	}
+
+	return result[2 : 2+size], nil
+}
+
+func (o *ScrambleObfuscator) Delay() time.Duration {
+	if !o.isIAT {
+		return 0
+	}
+
+	d, err := rand.Int(rand.Reader, big.NewInt(int64(scrambleDelay)))
+	if err != nil {
+		return 0
+	}
+
+	return time.Duration(d.Int64())
+}
+
+func (o *ScrambleObfuscator) Method() Method {
+	return MethodScramble
+}
+
+func (o *ScrambleObfuscator) Cost() int {
+	return scrambleIVSize + 2 + scramblePadding
+}
@@ -0,0 +1,286 @@
+package obfs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+)
+
+const (
+	tlsRecordChangeCipherSpec = 0x14
+	tlsRecordHandshake        = 0x16
+	tlsRecordApplicationData  = 0x17
+)
+
+const (
+	tlsHandshakeClientHello = 0x01
+	tlsHandshakeServerHello = 0x02
+)
+
+// tlsRecordHeaderSize is the size of the header of a TLS record.
+const tlsRecordHeaderSize = 5
+
+// tlsRecordMaxSize is the size of the fragment of a TLS record at most.
+const tlsRecordMaxSize = 16384
+
+// tlsCipherSuites are cipher suites offered in ClientHello, like browsers do.
+var tlsCipherSuites = []uint16{
+	0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f,
+	0x0035,
+}
+
+// tlsSignatureAlgorithms are signature algorithms offered in ClientHello.
+var tlsSignatureAlgorithms = []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601}
+
+// TLSObfuscator describes an obfuscator which wraps data in TLS 1.3 application data records after a forged
+// ClientHello and ServerHello exchange, so the flow looks like HTTPS.
+type TLSObfuscator struct {
+	serverName string
+}
+
+// CreateTLSObfuscator returns a TLS obfuscator by given server name, which is carried in ClientHello if not empty.
+func CreateTLSObfuscator(serverName string) *TLSObfuscator {
+	return &TLSObfuscator{serverName: serverName}
+}
+
+func (o *TLSObfuscator) Hello() ([]byte, error) {
+	random, err := generateRandom(32)
+	if err != nil {
+		return nil, fmt.Errorf("generate random: %w", err)
+	}
+	sessionID, err := generateRandom(32)
+	if err != nil {
+		return nil, fmt.Errorf("generate session id: %w", err)
+	}
+	key, err := generateRandom(32)
+	if err != nil {
+		return nil, fmt.Errorf("generate key share: %w", err)
+	}
+
+	// Extensions
+	extensions := make([]byte, 0)
+	if o.serverName != "" {
+		name := []byte(o.serverName)
+		data := appendUint16(nil, uint16(3+len(name)))
+		data = append(data, 0)
+		data = appendUint16(data, uint16(len(name)))
+		data = append(data, name...)
+		extensions = appendExtension(extensions, 0x0000, data)
+	}
+	extensions = appendExtension(extensions, 0x0017, nil)
+	extensions = appendExtension(extensions, 0xff01, []byte{0})
+	extensions = appendExtension(extensions, 0x000a, []byte{0, 6, 0, 0x1d, 0, 0x17, 0, 0x18})
+	extensions = appendExtension(extensions, 0x000b, []byte{1, 0})
+	extensions = appendExtension(extensions, 0x0023, nil)
+	extensions = appendExtension(extensions, 0x0010, []byte{0, 12, 2, 'h', '2', 8, 'h', 't', 't', 'p', '/', '1', '.', '1'})
+	extensions = appendExtension(extensions, 0x0005, []byte{1, 0, 0, 0, 0})
+	algorithms := appendUint16(nil, uint16(2*len(tlsSignatureAlgorithms)))
+	for _, algorithm := range tlsSignatureAlgorithms {
+		algorithms = appendUint16(algorithms, algorithm)
+	}
+	extensions = appendExtension(extensions, 0x000d, algorithms)
+	keyShare := appendUint16(nil, uint16(4+len(key)))
+	keyShare = appendUint16(keyShare, 0x001d)
+	keyShare = appendUint16(keyShare, uint16(len(key)))
+	keyShare = append(keyShare, key...)
+	extensions = appendExtension(extensions, 0x0033, keyShare)
+	extensions = appendExtension(extensions, 0x002d, []byte{1, 1})
+	extensions = appendExtension(extensions, 0x002b, []byte{4, 3, 4, 3, 3})
+
+	// ClientHello
+	body := []byte{3, 3}
+	body = append(body, random...)
+	body = append(body, byte(len(sessionID)))
+	body = append(body, sessionID...)
+	body = appendUint16(body, uint16(2*len(tlsCipherSuites)))
+	for _, suite := range tlsCipherSuites {
+		body = appendUint16(body, suite)
+	}
+	body = append(body, 1, 0)
+	body = appendUint16(body, uint16(len(extensions)))
+	body = append(body, extensions...)
+
+	// TLS 1.0 in the record of ClientHello for compatibility
+	result := appendRecord(nil, tlsRecordHandshake, appendHandshake(nil, tlsHandshakeClientHello, body))
+	result[2] = 1
+
+	return result, nil
+}
+
+func (o *TLSObfuscator) Handshake(data []byte) (bool, []byte, error) {
+	if len(data) <= 0 {
+		return false, nil, nil
+	}
+
+	switch data[0] {
+	case tlsRecordHandshake:
+		if len(data) < tlsRecordHeaderSize+1 {
+			return true, nil, errors.New("missing handshake type")
+		}
+
+		switch data[tlsRecordHeaderSize] {
+		case tlsHandshakeClientHello:
+			return o.serverHello(data)
+		case tlsHandshakeServerHello:
+			return o.clientFinished()
+		default:
+			return true, nil, nil
+		}
+	case tlsRecordChangeCipherSpec:
+		return true, nil, nil
+	default:
+		return false, nil, nil
+	}
+}
+
+// serverHello returns the ServerHello replies to the ClientHello, followed by a ChangeCipherSpec and an application
+// data record of the size of encrypted extensions, certificate and finished.
+func (o *TLSObfuscator) serverHello(clientHello []byte) (bool, []byte, error) {
+	// Session ID is echoed
+	offset := tlsRecordHeaderSize + 4 + 2 + 32
+	if len(clientHello) <= offset || len(clientHello) <= offset+int(clientHello[offset]) {
+		return true, nil, errors.New("missing session id")
+	}
+	sessionID := clientHello[offset+1 : offset+1+int(clientHello[offset])]
+
+	random, err := generateRandom(32)
+	if err != nil {
+		return true, nil, fmt.Errorf("generate random: %w", err)
+	}
+	key, err := generateRandom(32)
+	if err != nil {
+		return true, nil, fmt.Errorf("generate key share: %w", err)
+	}
+
+	// Extensions
+	extensions := appendExtension(nil, 0x002b, []byte{3, 4})
+	keyShare := appendUint16(nil, 0x001d)
+	keyShare = appendUint16(keyShare, uint16(len(key)))
+	keyShare = append(keyShare, key...)
+	extensions = appendExtension(extensions, 0x0033, keyShare)
+
+	// ServerHello
+	body := []byte{3, 3}
+	body = append(body, random...)
+	body = append(body, byte(len(sessionID)))
+	body = append(body, sessionID...)
+	body = appendUint16(body, tlsCipherSuites[0])
+	body = append(body, 0)
+	body = appendUint16(body, uint16(len(extensions)))
+	body = append(body, extensions...)
+
+	result := appendRecord(nil, tlsRecordHandshake, appendHandshake(nil, tlsHandshakeServerHello, body))
+	result = appendRecord(result, tlsRecordChangeCipherSpec, []byte{1})
+
+	size, err := rand.Int(rand.Reader, big.NewInt(400))
+	if err != nil {
+		return true, nil, fmt.Errorf("generate size: %w", err)
+	}
+	encrypted, err := generateRandom(800 + int(size.Int64()))
+	if err != nil {
+		return true, nil, fmt.Errorf("generate encrypted extensions: %w", err)
+	}
+	result = appendRecord(result, tlsRecordApplicationData, encrypted)
+
+	return true, result, nil
+}
+
+// clientFinished returns the ChangeCipherSpec and the application data record of the size of finished, which
+// replies to the ServerHello.
+func (o *TLSObfuscator) clientFinished() (bool, []byte, error) {
+	encrypted, err := generateRandom(53)
+	if err != nil {
+		return true, nil, fmt.Errorf("generate finished: %w", err)
+	}
+
+	result := appendRecord(nil, tlsRecordChangeCipherSpec, []byte{1})
+	result = appendRecord(result, tlsRecordApplicationData, encrypted)
+
+	return true, result, nil
+}
+
+func (o *TLSObfuscator) Wrap(data []byte) ([]byte, error) {
+	result := make([]byte, 0, len(data)+o.Cost())
+
+	for len(data) > tlsRecordMaxSize {
+		result = appendRecord(result, tlsRecordApplicationData, data[:tlsRecordMaxSize])
+		data = data[tlsRecordMaxSize:]
+	}
+	result = appendRecord(result, tlsRecordApplicationData, data)
+
+	return result, nil
+}
+
+func (o *TLSObfuscator) Unwrap(data []byte) ([]byte, error) {
+	result := make([]byte, 0, len(data))
+
+	for len(data) > 0 {
+		if len(data) < tlsRecordHeaderSize {
+			return nil, errors.New("record header too short")
+		}
+		if data[0] != tlsRecordApplicationData {
+			return nil, fmt.Errorf("record type %d not support", data[0])
+		}
+
+		size := tlsRecordHeaderSize + int(binary.BigEndian.Uint16(data[3:]))
+		if len(data) < size {
+			return nil, errors.New("record too short")
+		}
+
+		result = append(result, data[tlsRecordHeaderSize:size]...)
+		data = data[size:]
+	}
+
+	return result, nil
+}
+
+func (o *TLSObfuscator) Delay() time.Duration {
+	return 0
+}
+
+func (o *TLSObfuscator) Method() Method {
+	return MethodTLS
+}
+
+func (o *TLSObfuscator) Cost() int {
+	return tlsRecordHeaderSize
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendExtension(b []byte, t uint16, data []byte) []byte {
+	b = appendUint16(b, t)
+	b = appendUint16(b, uint16(len(data)))
+
+	return append(b, data...)
+}
+
+func appendHandshake(b []byte, t byte, body []byte) []byte {
+	b = append(b, t, byte(len(body)>>16), byte(len(body)>>8), byte(len(body)))
+
+	return append(b, body...)
+}
+
+func appendRecord(b []byte, t byte, fragment []byte) []byte {
+	b = append(b, t, 3, 3)
+	b = appendUint16(b, uint16(len(fragment)))
+
+	return append(b, fragment...)
+}
+
+func generateRandom(size int) ([]byte, error) {
+	b := make([]byte, size)
+
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
@@ -0,0 +1,106 @@
+// +build !nopcap
+
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+	"time"
+)
+
+const (
+	afpacketFrameSize = 1 << 14
+	afpacketBlockSize = 1 << 20
+	afpacketNumBlocks = 32
+)
+
+// afpacketBlockTimeout is the timeout a block not full is retired in, so sparse frames are not delayed.
+const afpacketBlockTimeout = time.Millisecond
+
+// afpacketHandle is a handle reads and writes Ethernet frames in a TPACKET_V3 memory-mapped ring, or a TPACKET_V2 one
+// which retries reading when the poll times out in busy poll.
+type afpacketHandle struct {
+	*afpacket.TPacket
+	filter []bpf.RawInstruction
+}
+
+func createAFPacketHandle(dev, filter string) (*afpacketHandle, error) {
+	// Blocks in TPACKET_V3 are delivered only when they are full or retired by timeout, so frames are delivered one by
+	// one in TPACKET_V2 in busy poll
+	version, timeout := afpacket.TPacketVersion3, afpacket.DefaultPollTimeout
+	if isBusyPoll {
+		version, timeout = afpacket.TPacketVersion2, 0
+	}
+
+	tpacket, err := afpacket.NewTPacket(
+		afpacket.OptInterface(dev),
+		afpacket.OptTPacketVersion(version),
+		afpacket.OptFrameSize(afpacketFrameSize),
+		afpacket.OptBlockSize(afpacketBlockSize),
+		afpacket.OptNumBlocks(afpacketNumBlocks),
+		afpacket.OptBlockTimeout(afpacketBlockTimeout),
+		afpacket.OptPollTimeout(timeout),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("open ring: %w", err)
+	}
+
+	// Frames on trunked or PPPoE interfaces may be encapsulated
+	insts, err := compileEncapFilter(filter)
+	if err != nil {
+		tpacket.Close()
+		return nil, fmt.Errorf("compile filter: %w", err)
+	}
+
+	rawInsts := make([]bpf.RawInstruction, 0, len(insts))
+	for _, inst := range insts {
+		rawInsts = append(rawInsts, bpf.RawInstruction{Op: inst.Code, Jt: inst.Jt, Jf: inst.Jf, K: inst.K})
+	}
+
+	err = tpacket.SetBPF(rawInsts)
+	if err != nil {
+		tpacket.Close()
+		return nil, fmt.Errorf("set filter: %w", err)
+	}
+
+	return &afpacketHandle{TPacket: tpacket, filter: rawInsts}, nil
+}
+
+func (h *afpacketHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := h.TPacket.ReadPacketData()
+		if err != afpacket.ErrTimeout {
+			return data, ci, err
+		}
+	}
+}
+
+func (h *afpacketHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (h *afpacketHandle) SetDirection(direction direction) error {
+	switch direction {
+	case directionIn:
+		// Frames sent by the host, including frames written, are rejected by their packet types before the filter
+		insts, err := bpf.Assemble([]bpf.Instruction{
+			bpf.LoadExtension{Num: bpf.ExtType},
+			bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: unix.PACKET_OUTGOING, SkipTrue: 1},
+			bpf.RetConstant{Val: 0},
+		})
+		if err != nil {
+			return fmt.Errorf("assemble: %w", err)
+		}
+
+		return h.TPacket.SetBPF(append(insts, h.filter...))
+	case directionInOut:
+		return h.TPacket.SetBPF(h.filter)
+	default:
+		return errors.New("direction not support")
+	}
+}
@@ -0,0 +1,80 @@
+// +build !nopcap
+
+package pcap
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+// benchmarkPort is the port of datagrams read in benchmarks in the loopback device.
+const benchmarkPort = 50999
+
+// benchmarkRead reads datagrams sent to the port in the loopback device by the handle, which needs privileges.
+func benchmarkRead(b *testing.B, h handle) {
+	defer h.Close()
+
+	// Datagrams are received by a socket, so the kernel replies no ICMP
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: benchmarkPort})
+	if err != nil {
+		b.Skipf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	conn, err := net.DialUDP("udp4", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		payload := make([]byte, 1024)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_, _ = conn.Write(payload)
+			}
+		}
+	}()
+
+	b.SetBytes(1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := h.ReadPacketData()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkAFPacketRead(b *testing.B) {
+	h, err := createAFPacketHandle("lo", fmt.Sprintf("udp && dst port %d", benchmarkPort))
+	if err != nil {
+		b.Skipf("create afpacket handle: %v", err)
+	}
+	err = h.SetDirection(directionIn)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarkRead(b, h)
+}
+
+func BenchmarkPcapRead(b *testing.B) {
+	conn, err := createPureRawConn("lo", fmt.Sprintf("udp && dst port %d", benchmarkPort))
+	if err != nil {
+		b.Skipf("create pcap handle: %v", err)
+	}
+	err = conn.handle.SetDirection(directionIn)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarkRead(b, conn.handle)
+}
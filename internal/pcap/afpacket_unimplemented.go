@@ -0,0 +1,33 @@
+// +build !linux nopcap
+
+package pcap
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type afpacketHandle struct{}
+
+func createAFPacketHandle(dev, filter string) (*afpacketHandle, error) {
+	return nil, errors.New("afpacket not support")
+}
+
+func (h *afpacketHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return nil, gopacket.CaptureInfo{}, errors.New("afpacket not support")
+}
+
+func (h *afpacketHandle) WritePacketData(data []byte) error {
+	return errors.New("afpacket not support")
+}
+
+func (h *afpacketHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeNull
+}
+
+func (h *afpacketHandle) SetDirection(direction direction) error {
+	return errors.New("afpacket not support")
+}
+
+func (h *afpacketHandle) Close() {}
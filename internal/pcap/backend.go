@@ -0,0 +1,65 @@
+package pcap
+
+import "fmt"
+
+// Backend describes how packets of a device are captured and injected.
+type Backend int
+
+const (
+	// BackendPcap captures and injects frames with libpcap.
+	BackendPcap Backend = iota
+	// BackendTun reads and writes IP packets in a TUN device.
+	BackendTun
+	// BackendTap reads and writes Ethernet frames in a TAP device.
+	BackendTap
+	// BackendAFPacket captures and injects frames in a TPACKET_V3 memory-mapped ring of AF_PACKET.
+	BackendAFPacket
+	// BackendXDP receives frames from AF_XDP sockets by an XDP program, and injects frames in them.
+	BackendXDP
+)
+
+var backends map[string]Backend
+
+// ParseBackend returns a backend by the given string, can be empty, pcap, tun, tap, afpacket or xdp.
+func ParseBackend(s string) (Backend, error) {
+	switch s {
+	case "", "pcap":
+		return BackendPcap, nil
+	case "tun":
+		return BackendTun, nil
+	case "tap":
+		return BackendTap, nil
+	case "afpacket":
+		return BackendAFPacket, nil
+	case "xdp":
+		return BackendXDP, nil
+	default:
+		return BackendPcap, fmt.Errorf("backend %s not support", s)
+	}
+}
+
+// SetBackend sets the backend of the device with the given alias, devices found later will use the backend.
+func SetBackend(alias string, backend Backend) {
+	if backends == nil {
+		backends = make(map[string]Backend)
+	}
+
+	backends[alias] = backend
+}
+
+func (backend Backend) String() string {
+	switch backend {
+	case BackendPcap:
+		return "pcap"
+	case BackendTun:
+		return "tun"
+	case BackendTap:
+		return "tap"
+	case BackendAFPacket:
+		return "afpacket"
+	case BackendXDP:
+		return "xdp"
+	default:
+		panic(fmt.Errorf("backend %d not support", backend))
+	}
+}
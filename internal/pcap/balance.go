@@ -0,0 +1,205 @@
+package pcap
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// keepBalancedFlows is the duration a flow is kept on its path after its last packet.
+const keepBalancedFlows = 2 * time.Minute
+
+// BalancePolicy describes how new flows are balanced across paths.
+type BalancePolicy int
+
+const (
+	// BalanceRoundRobin puts new flows on paths in turn.
+	BalanceRoundRobin BalancePolicy = iota
+	// BalanceLeastRTT puts new flows on the path of the least RTT.
+	BalanceLeastRTT
+	// BalanceWeighted puts new flows on paths in proportion to their weights.
+	BalanceWeighted
+)
+
+// ParseBalancePolicy returns a balance policy by the given string, can be round-robin, least-rtt or weighted.
+func ParseBalancePolicy(s string) (BalancePolicy, error) {
+	switch s {
+	case "round-robin":
+		return BalanceRoundRobin, nil
+	case "least-rtt":
+		return BalanceLeastRTT, nil
+	case "weighted":
+		return BalanceWeighted, nil
+	default:
+		return BalanceRoundRobin, fmt.Errorf("balance policy %s not support", s)
+	}
+}
+
+func (policy BalancePolicy) String() string {
+	switch policy {
+	case BalanceRoundRobin:
+		return "round-robin"
+	case BalanceLeastRTT:
+		return "least-rtt"
+	case BalanceWeighted:
+		return "weighted"
+	default:
+		panic(fmt.Errorf("balance policy %d not support", policy))
+	}
+}
+
+type balancedFlow struct {
+	path int
+	last time.Time
+}
+
+// Balancer describes load balancing of flows across paths, which are connections to several servers. Each flow stays
+// on one path while the path is up, so packets of a flow are not reordered, and flows on a path down are moved to other
+// paths.
+type Balancer struct {
+	policy  BalancePolicy
+	weights []int
+	lock    sync.Mutex
+	isUp    []bool
+	rtts    []time.Duration
+	jitters []time.Duration
+	lossy   []bool
+	next    int
+	current []int
+	flows   map[uint64]*balancedFlow
+	swept   time.Time
+}
+
+// NewBalancer returns a new balancer of paths of the weights in the policy. Paths are down until they are set up.
+func NewBalancer(policy BalancePolicy, weights []int) *Balancer {
+	return &Balancer{
+		policy:  policy,
+		weights: weights,
+		isUp:    make([]bool, len(weights)),
+		rtts:    make([]time.Duration, len(weights)),
+		jitters: make([]time.Duration, len(weights)),
+		lossy:   make([]bool, len(weights)),
+		current: make([]int, len(weights)),
+		flows:   make(map[uint64]*balancedFlow),
+		swept:   time.Now(),
+	}
+}
+
+// SetHealth sets if the path is up, its RTT and jitter, and if it is lossy. New flows avoid lossy paths while other
+// paths are up and not lossy.
+func (b *Balancer) SetHealth(path int, isUp bool, rtt, jitter time.Duration, isLossy bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.isUp[path] = isUp
+	b.rtts[path] = rtt
+	b.jitters[path] = jitter
+	b.lossy[path] = isLossy
+}
+
+// IsUp returns if the path is up.
+func (b *Balancer) IsUp(path int) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.isUp[path]
+}
+
+// Pick returns the path of the flow of the hash, which is the path the flow is on if it is up, or a path picked by the
+// policy. It returns -1 if no path is up.
+func (b *Balancer) Pick(hash uint64) int {
+	now := time.Now()
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	// Sweep flows expired
+	if now.Sub(b.swept) >= keepBalancedFlows {
+		for h, flow := range b.flows {
+			if now.Sub(flow.last) >= keepBalancedFlows {
+				delete(b.flows, h)
+			}
+		}
+		b.swept = now
+	}
+
+	flow, ok := b.flows[hash]
+	if ok && b.isUp[flow.path] {
+		flow.last = now
+		return flow.path
+	}
+
+	path := b.pick()
+	if path < 0 {
+		return path
+	}
+	b.flows[hash] = &balancedFlow{path: path, last: now}
+
+	return path
+}
+
+func (b *Balancer) pick() int {
+	path := -1
+
+	// Lossy paths are only picked if all paths up are lossy
+	isUp := make([]bool, len(b.isUp))
+	isClean := false
+	for i := range b.isUp {
+		isClean = isClean || b.isUp[i] && !b.lossy[i]
+	}
+	for i := range b.isUp {
+		isUp[i] = b.isUp[i] && (!isClean || !b.lossy[i])
+	}
+
+	switch b.policy {
+	case BalanceRoundRobin:
+		for i := 0; i < len(isUp); i++ {
+			index := (b.next + i) % len(isUp)
+			if isUp[index] {
+				path = index
+				b.next = index + 1
+				break
+			}
+		}
+	case BalanceLeastRTT:
+		// Jitter is counted, so steady paths are preferred
+		for i := range isUp {
+			if isUp[i] && (path < 0 || b.rtts[i]+2*b.jitters[i] < b.rtts[path]+2*b.jitters[path]) {
+				path = i
+			}
+		}
+	case BalanceWeighted:
+		// Smooth weighted round-robin, which spreads flows of a path evenly rather than in a row
+		total := 0
+		for i := range isUp {
+			if !isUp[i] {
+				continue
+			}
+			b.current[i] = b.current[i] + b.weights[i]
+			total = total + b.weights[i]
+			if path < 0 || b.current[i] > b.current[path] {
+				path = i
+			}
+		}
+		if path >= 0 {
+			b.current[path] = b.current[path] - total
+		}
+	default:
+		panic(fmt.Errorf("balance policy %d not support", b.policy))
+	}
+
+	return path
+}
+
+// Flows returns numbers of flows on each path.
+func (b *Balancer) Flows() []int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	result := make([]int, len(b.isUp))
+	for _, flow := range b.flows {
+		result[flow.path]++
+	}
+
+	return result
+}
@@ -0,0 +1,205 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"ikago/internal/log"
+	"sync"
+)
+
+// batchQueueFactor is the number of batches can be queued in a batch writer before writes block.
+const batchQueueFactor = 4
+
+// batchHandle is a handle reads and writes packets in batches, which amortizes the cost of syscalls.
+type batchHandle interface {
+	// ReadPacketDataBatch reads packets available up to the length of datas, and blocks until at least one packet is
+	// read. Data are valid until the next read.
+	ReadPacketDataBatch(datas [][]byte, cis []gopacket.CaptureInfo) (int, error)
+	// WritePacketDataBatch writes packets, and returns the number of packets written.
+	WritePacketDataBatch(datas [][]byte) (int, error)
+}
+
+var batchSize int
+
+// SetBatchSize sets the max number of packets read and written in a batch, connections created later will use the
+// size. Packets are read and written one by one if the size is not larger than 1 or the backend does not support.
+func SetBatchSize(size int) {
+	batchSize = size
+}
+
+// batchWriter describes a queue of packets written in batches by a goroutine.
+type batchWriter struct {
+	conn  *RawConn
+	size  int
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newBatchWriter(conn *RawConn, size int) *batchWriter {
+	w := &batchWriter{
+		conn:  conn,
+		size:  size,
+		queue: make(chan []byte, size*batchQueueFactor),
+		done:  make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w
+}
+
+// write queues a copy of the packet.
+func (w *batchWriter) write(b []byte) error {
+	data := make([]byte, len(b))
+	copy(data, b)
+
+	select {
+	case w.queue <- data:
+		return nil
+	case <-w.done:
+		return errors.New("closed")
+	}
+}
+
+func (w *batchWriter) run() {
+	h := w.conn.handle.(batchHandle)
+	batch := make([][]byte, 0, w.size)
+
+	for {
+		select {
+		case data := <-w.queue:
+			batch = append(batch[:0], data)
+		case <-w.done:
+			return
+		}
+
+		// Collect packets queued without waiting, so a single packet is not delayed
+	collect:
+		for len(batch) < w.size {
+			select {
+			case data := <-w.queue:
+				batch = append(batch, data)
+			default:
+				break collect
+			}
+		}
+
+		n, err := h.WritePacketDataBatch(batch)
+		if err != nil {
+			log.Errorln(fmt.Errorf("write batch in device %s: %w", w.conn.srcDev.Alias(), err))
+		}
+		for _, data := range batch[:n] {
+			dumpPacket(w.conn.dumpLayer, false, w.conn.handle.LinkType(), data)
+		}
+	}
+}
+
+func (w *batchWriter) close() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
+
+// setBatch sets the connection to read and write in batches if the handle supports.
+func (c *RawConn) setBatch(size int) {
+	if size <= 1 {
+		return
+	}
+	_, ok := c.handle.(batchHandle)
+	if !ok {
+		return
+	}
+
+	c.batchDatas = make([][]byte, size)
+	c.batchCIs = make([]gopacket.CaptureInfo, size)
+	c.writer = newBatchWriter(c, size)
+}
+
+// ReadPackets reads packets available from the connection in a batch, or reads a packet if the connection does not
+// read in batches. Packets may stay in frames lent by the handle, like xdp, without copying, which are released by
+// ReleasePacket once they are handled.
+func (c *RawConn) ReadPackets() ([]gopacket.Packet, error) {
+	if len(c.batchDatas) <= 0 {
+		var (
+			packet gopacket.Packet
+			err    error
+		)
+
+		h, ok := c.handle.(lendingHandle)
+		if ok {
+			packet, err = c.lendPacket(h)
+		} else {
+			packet, err = c.ReadPacket()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return []gopacket.Packet{packet}, nil
+	}
+
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	// Packets left by reading one by one are returned first
+	if len(c.pending) > 0 {
+		packets := c.pending
+		c.pending = nil
+
+		return packets, nil
+	}
+
+	return c.readBatch()
+}
+
+// readPending reads a packet from the batch pending, and reads a new batch if all packets in the batch are read.
+func (c *RawConn) readPending() (gopacket.Packet, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	if len(c.pending) <= 0 {
+		packets, err := c.readBatch()
+		if err != nil {
+			return nil, err
+		}
+		c.pending = packets
+	}
+
+	packet := c.pending[0]
+	c.pending = c.pending[1:]
+
+	return packet, nil
+}
+
+// readBatch reads a batch of packets, which has one packet at least.
+func (c *RawConn) readBatch() ([]gopacket.Packet, error) {
+	for {
+		n, err := c.handle.(batchHandle).ReadPacketDataBatch(c.batchDatas, c.batchCIs)
+		if err != nil {
+			return nil, err
+		}
+
+		packets := make([]gopacket.Packet, 0, n)
+		for i := 0; i < n; i++ {
+			if c.isTruncated(c.batchCIs[i]) {
+				continue
+			}
+
+			d := c.batchDatas[i]
+			dumpPacket(c.dumpLayer, true, c.handle.LinkType(), d)
+
+			// Data are reused in the next read
+			b := make([]byte, len(d))
+			copy(b, d)
+
+			packet := gopacket.NewPacket(b, c.handle.LinkType(), gopacket.NoCopy)
+			packet.Metadata().Timestamp = c.batchCIs[i].Timestamp
+			packets = append(packets, packet)
+		}
+		if len(packets) > 0 {
+			return packets, nil
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package pcap
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type bridgeEntry struct {
+	port     io.Writer
+	lastSeen time.Time
+}
+
+// Bridge is a learning bridge forwards Ethernet frames between ports. Hardware addresses not seen in the deadline age
+// out of the table.
+type Bridge struct {
+	lock      sync.RWMutex
+	ports     map[io.Writer]bool
+	table     map[string]*bridgeEntry
+	deadline  time.Duration
+	lastPurge time.Time
+}
+
+// NewBridge returns a new bridge.
+func NewBridge() *Bridge {
+	return &Bridge{
+		ports: make(map[io.Writer]bool),
+		table: make(map[string]*bridgeEntry),
+	}
+}
+
+// AddPort adds a port to the bridge.
+func (b *Bridge) AddPort(port io.Writer) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.ports[port] = true
+}
+
+// RemovePort removes a port and hardware addresses learned in it from the bridge.
+func (b *Bridge) RemovePort(port io.Writer) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.ports, port)
+	for k, entry := range b.table {
+		if entry.port == port {
+			delete(b.table, k)
+		}
+	}
+}
+
+// Forward learns the source of the frame received from the port, and returns ports the frame should be forwarded to.
+func (b *Bridge) Forward(frame []byte, from io.Writer) ([]io.Writer, error) {
+	if len(frame) < 14 {
+		return nil, errors.New("frame too short")
+	}
+	dst := net.HardwareAddr(frame[0:6])
+	src := net.HardwareAddr(frame[6:12])
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+
+	// Age out
+	if b.deadline > 0 && now.Sub(b.lastPurge) > b.deadline {
+		b.purge(now)
+	}
+
+	// Learn
+	if src[0]&0x01 == 0 {
+		b.table[src.String()] = &bridgeEntry{port: from, lastSeen: now}
+	}
+
+	// Unicast to a known port
+	if dst[0]&0x01 == 0 {
+		entry, ok := b.table[dst.String()]
+		if ok && (b.deadline <= 0 || now.Sub(entry.lastSeen) <= b.deadline) {
+			if entry.port == from {
+				return nil, nil
+			}
+			return append(make([]io.Writer, 0), entry.port), nil
+		}
+	}
+
+	// Flood
+	result := make([]io.Writer, 0)
+	for port := range b.ports {
+		if port != from {
+			result = append(result, port)
+		}
+	}
+
+	return result, nil
+}
+
+// purge removes hardware addresses not seen in the deadline.
+func (b *Bridge) purge(now time.Time) {
+	for k, entry := range b.table {
+		if now.Sub(entry.lastSeen) > b.deadline {
+			delete(b.table, k)
+		}
+	}
+	b.lastPurge = now
+}
+
+// SetDeadline sets the deadline associated with learned hardware addresses.
+func (b *Bridge) SetDeadline(t time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.deadline = t
+}
+
+// WriteFrame writes the frame to the port, frames are encoded unless the port is a raw connection.
+func WriteFrame(port io.Writer, frame []byte) error {
+	var err error
+
+	switch port.(type) {
+	case *RawConn:
+		_, err = port.Write(frame)
+	default:
+		_, err = port.Write(EncodeFrame(frame))
+	}
+
+	return err
+}
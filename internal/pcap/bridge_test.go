@@ -0,0 +1,68 @@
+package pcap
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// bridgeFrame returns a frame from the source to the destination hardware address.
+func bridgeFrame(dst, src byte) []byte {
+	frame := make([]byte, 14)
+	frame[5], frame[11] = dst, src
+
+	return frame
+}
+
+// TestBridgeAging ages out hardware addresses not seen in the deadline, and removes those learned in ports removed.
+func TestBridgeAging(t *testing.T) {
+	var a, c, d bytes.Buffer
+	b := NewBridge()
+	b.SetDeadline(50 * time.Millisecond)
+	for _, port := range []io.Writer{&a, &c, &d} {
+		b.AddPort(port)
+	}
+
+	// Learn
+	for i := byte(1); i <= 8; i++ {
+		_, err := b.Forward(bridgeFrame(0xff, i), &a)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := b.Forward(bridgeFrame(0xff, 9), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.table) != 9 {
+		t.Fatalf("learned %d, want %d", len(b.table), 9)
+	}
+
+	ports, err := b.Forward(bridgeFrame(1, 9), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 1 || ports[0] != &a {
+		t.Fatalf("forward to %d ports, want port a", len(ports))
+	}
+
+	// Age out
+	time.Sleep(100 * time.Millisecond)
+	ports, err = b.Forward(bridgeFrame(1, 10), &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.table) != 1 {
+		t.Errorf("kept %d, want %d", len(b.table), 1)
+	}
+	if len(ports) != 2 {
+		t.Errorf("forward to %d ports, want flooding", len(ports))
+	}
+
+	// Remove
+	b.RemovePort(&d)
+	if len(b.table) != 0 {
+		t.Errorf("kept %d after removal, want %d", len(b.table), 0)
+	}
+}
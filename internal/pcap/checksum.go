@@ -0,0 +1,157 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"net"
+)
+
+// checksumOffloader is a handle whose kernel fills the IPv4 header checksum of packets written, like raw sockets with
+// IP_HDRINCL.
+type checksumOffloader interface {
+	offloadsIPv4Checksum() bool
+}
+
+// IsIPv4ChecksumOffload returns if the IPv4 header checksum of packets written is filled by the kernel, so it can be
+// left zero.
+func (c *RawConn) IsIPv4ChecksumOffload() bool {
+	o, ok := c.handle.(checksumOffloader)
+
+	return ok && o.offloadsIPv4Checksum()
+}
+
+// updateChecksum returns the checksum updated incrementally where the data changes from old to new in RFC 1624, as
+// HC' = ~(~HC + ~m + m'). Data are in 16-bit words.
+func updateChecksum(checksum uint16, old, new []byte) uint16 {
+	sum := uint32(^checksum)
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^(uint16(old[i])<<8 | uint16(old[i+1])))
+		sum += uint32(uint16(new[i])<<8 | uint16(new[i+1]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
+
+// IsRewritable returns if the packet can be rewritten in place by RewriteSrc and RewriteDst, which is a TCP or UDP
+// packet not fragmented without IPv6 extension headers.
+func (indicator *PacketIndicator) IsRewritable() bool {
+	if indicator.NetworkLayer() == nil || indicator.TransportLayer() == nil || indicator.IsFrag() {
+		return false
+	}
+
+	var protocol layers.IPProtocol
+	switch indicator.NetworkLayer().LayerType() {
+	case layers.LayerTypeIPv4:
+		protocol = indicator.IPv4Layer().Protocol
+	case layers.LayerTypeIPv6:
+		protocol = indicator.IPv6Layer().NextHeader
+	default:
+		return false
+	}
+
+	return protocol == layers.IPProtocolTCP || protocol == layers.IPProtocolUDP
+}
+
+// RewriteSrc returns the packet without link layer whose source IP and port are rewritten, where checksums are updated
+// incrementally rather than computed again. The IPv4 header checksum is left zero if it is offloaded.
+func (indicator *PacketIndicator) RewriteSrc(ip net.IP, port uint16, isIPv4ChecksumOffload bool) ([]byte, error) {
+	return indicator.rewrite(ip, port, true, isIPv4ChecksumOffload)
+}
+
+// RewriteDst returns the packet without link layer whose destination IP and port are rewritten, where checksums are
+// updated incrementally rather than computed again. The IPv4 header checksum is left zero if it is offloaded.
+func (indicator *PacketIndicator) RewriteDst(ip net.IP, port uint16, isIPv4ChecksumOffload bool) ([]byte, error) {
+	return indicator.rewrite(ip, port, false, isIPv4ChecksumOffload)
+}
+
+func (indicator *PacketIndicator) rewrite(ip net.IP, port uint16, isSrc, isIPv4ChecksumOffload bool) ([]byte, error) {
+	if !indicator.IsRewritable() {
+		return nil, errors.New("packet not rewritable")
+	}
+
+	header := indicator.NetworkLayer().LayerContents()
+	data := make([]byte, 0, len(header)+len(indicator.NetworkLayer().LayerPayload()))
+	data = append(data, header...)
+	data = append(data, indicator.NetworkLayer().LayerPayload()...)
+
+	// Offsets of addresses in the network layer
+	var (
+		isIPv4 bool
+		offset int
+		newIP  net.IP
+	)
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		isIPv4 = true
+		newIP = ip.To4()
+		offset = 16
+		if isSrc {
+			offset = 12
+		}
+	case layers.LayerTypeIPv6:
+		newIP = ip.To16()
+		offset = 24
+		if isSrc {
+			offset = 8
+		}
+	default:
+		return nil, fmt.Errorf("network layer type %s not support", t)
+	}
+	if newIP == nil {
+		return nil, fmt.Errorf("ip %s mismatch with network layer", ip)
+	}
+
+	// Offsets of the port and the checksum in the transport layer
+	transport := data[len(header):]
+	var portOffset, checksumOffset int
+	switch t := indicator.TransportLayer().LayerType(); t {
+	case layers.LayerTypeTCP:
+		checksumOffset = 16
+	case layers.LayerTypeUDP:
+		checksumOffset = 6
+	default:
+		return nil, fmt.Errorf("transport layer type %s not support", t)
+	}
+	if !isSrc {
+		portOffset = 2
+	}
+	if len(transport) < checksumOffset+2 {
+		return nil, errors.New("transport layer too short")
+	}
+
+	newPort := []byte{byte(port >> 8), byte(port)}
+	oldIP := append(make([]byte, 0, len(newIP)), data[offset:offset+len(newIP)]...)
+	oldPort := append(make([]byte, 0, 2), transport[portOffset:portOffset+2]...)
+
+	// Transport layer checksum covers the pseudo header, and UDP in IPv4 without checksum is kept
+	checksum := uint16(transport[checksumOffset])<<8 | uint16(transport[checksumOffset+1])
+	isUDP := indicator.TransportLayer().LayerType() == layers.LayerTypeUDP
+	if !isUDP || !isIPv4 || checksum != 0 {
+		checksum = updateChecksum(checksum, oldIP, newIP)
+		checksum = updateChecksum(checksum, oldPort, newPort)
+		if isUDP && checksum == 0 {
+			checksum = 0xffff
+		}
+		transport[checksumOffset] = byte(checksum >> 8)
+		transport[checksumOffset+1] = byte(checksum)
+	}
+	copy(transport[portOffset:], newPort)
+
+	// IPv4 header checksum
+	if isIPv4 {
+		checksum = 0
+		if !isIPv4ChecksumOffload {
+			checksum = uint16(data[10])<<8 | uint16(data[11])
+			checksum = updateChecksum(checksum, oldIP, newIP)
+		}
+		data[10] = byte(checksum >> 8)
+		data[11] = byte(checksum)
+	}
+	copy(data[offset:], newIP)
+
+	return data, nil
+}
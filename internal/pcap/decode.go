@@ -0,0 +1,204 @@
+package pcap
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"sync"
+)
+
+// packetLayers describes layers of a packet without link layer, which are allocated together rather than one by one.
+// Layers are referenced by indicators after decoding, so they are not reused.
+type packetLayers struct {
+	ipv4    layers.IPv4
+	ipv6    layers.IPv6
+	tcp     layers.TCP
+	udp     layers.UDP
+	icmpv4  layers.ICMPv4
+	icmpv6  layers.ICMPv6
+	dns     *layers.DNS
+	payload gopacket.Payload
+	decoded []gopacket.LayerType
+	types   [8]gopacket.LayerType
+}
+
+func newPacketLayers() *packetLayers {
+	l := &packetLayers{}
+	l.decoded = l.types[:0]
+
+	return l
+}
+
+// decode decodes data as the layer type first, and decodes layers following it until a layer not supported. Layers
+// decoded are appended, so a packet can be decoded again from its payload, like behind IPv6 extension headers.
+func (l *packetLayers) decode(first gopacket.LayerType, data []byte) error {
+	d := decoders.Get().(*decoder)
+	defer decoders.Put(d)
+
+	d.layers = l
+	err := d.parser(first).DecodeLayers(data, &d.decoded)
+	l.decoded = append(l.decoded, d.decoded...)
+	d.layers = nil
+
+	return err
+}
+
+func (l *packetLayers) has(t gopacket.LayerType) bool {
+	for _, decoded := range l.decoded {
+		if decoded == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// layer returns the layer of the type if it is decoded.
+func (l *packetLayers) layer(t gopacket.LayerType) gopacket.Layer {
+	if !l.has(t) {
+		return nil
+	}
+
+	switch t {
+	case layers.LayerTypeIPv4:
+		return &l.ipv4
+	case layers.LayerTypeIPv6:
+		return &l.ipv6
+	case layers.LayerTypeTCP:
+		return &l.tcp
+	case layers.LayerTypeUDP:
+		return &l.udp
+	case layers.LayerTypeICMPv4:
+		return &l.icmpv4
+	case layers.LayerTypeICMPv6:
+		return &l.icmpv6
+	case layers.LayerTypeDNS:
+		return l.dns
+	default:
+		return nil
+	}
+}
+
+// transportLayer returns the transport layer decoded, or nil if it is not decoded.
+func (l *packetLayers) transportLayer() gopacket.Layer {
+	for _, t := range l.decoded {
+		switch t {
+		case layers.LayerTypeTCP, layers.LayerTypeUDP, layers.LayerTypeICMPv4, layers.LayerTypeICMPv6:
+			return l.layer(t)
+		}
+	}
+
+	return nil
+}
+
+// applicationLayer returns the application layer behind the transport layer, which is DNS if it is decoded, or the
+// payload of the transport layer. ICMPv6 messages decoded as their own layers in gopacket, like echo, have no
+// application layer, and their message bodies are in ICMPv6 indicators.
+func (l *packetLayers) applicationLayer() gopacket.ApplicationLayer {
+	if l.has(layers.LayerTypeDNS) {
+		return l.dns
+	}
+
+	transportLayer := l.transportLayer()
+	if transportLayer == nil || len(transportLayer.LayerPayload()) <= 0 {
+		return nil
+	}
+	if transportLayer.LayerType() == layers.LayerTypeICMPv6 && l.icmpv6.NextLayerType() != gopacket.LayerTypePayload {
+		return nil
+	}
+
+	l.payload = transportLayer.LayerPayload()
+
+	return &l.payload
+}
+
+// layerDecoder decodes a layer into layers of the packet the decoder is decoding, so parsers can be reused across
+// packets while layers are not.
+type layerDecoder struct {
+	layerType gopacket.LayerType
+	decoder   *decoder
+	layer     func(l *packetLayers) gopacket.DecodingLayer
+}
+
+func (d *layerDecoder) current() gopacket.DecodingLayer {
+	return d.layer(d.decoder.layers)
+}
+
+func (d *layerDecoder) CanDecode() gopacket.LayerClass {
+	return d.layerType
+}
+
+func (d *layerDecoder) NextLayerType() gopacket.LayerType {
+	return d.current().NextLayerType()
+}
+
+func (d *layerDecoder) LayerPayload() []byte {
+	return d.current().LayerPayload()
+}
+
+func (d *layerDecoder) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	return d.current().DecodeFromBytes(data, df)
+}
+
+// decoder decodes packets with DecodingLayerParsers into packet layers, which replaces decoding packets by
+// gopacket.NewPacket in the hot path.
+type decoder struct {
+	parsers       map[gopacket.LayerType]*gopacket.DecodingLayerParser
+	layerDecoders []gopacket.DecodingLayer
+	layers        *packetLayers
+	decoded       []gopacket.LayerType
+}
+
+var decoders = sync.Pool{
+	New: func() interface{} {
+		return newDecoder()
+	},
+}
+
+func newDecoder() *decoder {
+	d := &decoder{
+		parsers: make(map[gopacket.LayerType]*gopacket.DecodingLayerParser),
+		decoded: make([]gopacket.LayerType, 0, 8),
+	}
+
+	d.layerDecoders = []gopacket.DecodingLayer{
+		&layerDecoder{layerType: layers.LayerTypeIPv4, decoder: d, layer: func(l *packetLayers) gopacket.DecodingLayer {
+			return &l.ipv4
+		}},
+		&layerDecoder{layerType: layers.LayerTypeIPv6, decoder: d, layer: func(l *packetLayers) gopacket.DecodingLayer {
+			return &l.ipv6
+		}},
+		&layerDecoder{layerType: layers.LayerTypeTCP, decoder: d, layer: func(l *packetLayers) gopacket.DecodingLayer {
+			return &l.tcp
+		}},
+		&layerDecoder{layerType: layers.LayerTypeUDP, decoder: d, layer: func(l *packetLayers) gopacket.DecodingLayer {
+			return &l.udp
+		}},
+		&layerDecoder{layerType: layers.LayerTypeICMPv4, decoder: d, layer: func(l *packetLayers) gopacket.DecodingLayer {
+			return &l.icmpv4
+		}},
+		&layerDecoder{layerType: layers.LayerTypeICMPv6, decoder: d, layer: func(l *packetLayers) gopacket.DecodingLayer {
+			return &l.icmpv6
+		}},
+		// DNS is allocated only in packets carrying it
+		&layerDecoder{layerType: layers.LayerTypeDNS, decoder: d, layer: func(l *packetLayers) gopacket.DecodingLayer {
+			if l.dns == nil {
+				l.dns = &layers.DNS{}
+			}
+			return l.dns
+		}},
+	}
+
+	return d
+}
+
+// parser returns the parser decodes data as the layer type first.
+func (d *decoder) parser(first gopacket.LayerType) *gopacket.DecodingLayerParser {
+	parser, ok := d.parsers[first]
+	if !ok {
+		parser = gopacket.NewDecodingLayerParser(first, d.layerDecoders...)
+		parser.IgnoreUnsupported = true
+		d.parsers[first] = parser
+	}
+
+	return parser
+}
@@ -5,7 +5,6 @@
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/jackpal/gateway"
 	"ikago/internal/addr"
 	"ikago/internal/log"
@@ -20,7 +19,11 @@ type Device struct {
 	alias        string
 	ipAddrs      []*net.IPNet
 	hardwareAddr net.HardwareAddr
+	mtu          int
+	encap        *Encap
+	backend      Backend
 	isLoop       bool
+	isUp         bool
 }
 
 // Name returns the pcap name of the device.
@@ -43,11 +46,31 @@ func (dev *Device) HardwareAddr() net.HardwareAddr {
 	return dev.hardwareAddr
 }
 
+// MTU returns the MTU of the device, or 0 if it is unknown.
+func (dev *Device) MTU() int {
+	return dev.mtu
+}
+
+// Encap returns the encapsulation which frames to the device are encapsulated with, or nil if there is none.
+func (dev *Device) Encap() *Encap {
+	return dev.encap
+}
+
+// Backend returns the backend of the device.
+func (dev *Device) Backend() Backend {
+	return dev.backend
+}
+
 // IsLoop returns if the device is a loopback device.
 func (dev *Device) IsLoop() bool {
 	return dev.isLoop
 }
 
+// IsUp returns if the device is up.
+func (dev *Device) IsUp() bool {
+	return dev.isUp
+}
+
 // IPAddr returns the first IP address of the device.
 func (dev *Device) IPAddr() *net.IPNet {
 	if len(dev.ipAddrs) > 0 {
@@ -57,6 +80,57 @@ func (dev *Device) IPAddr() *net.IPNet {
 	return nil
 }
 
+// IPv4Addr returns the first IPv4 address of the device.
+func (dev *Device) IPv4Addr() *net.IPNet {
+	for _, a := range dev.ipAddrs {
+		if a.IP.To4() != nil {
+			return a
+		}
+	}
+
+	return nil
+}
+
+// IPv6Addr returns the first IPv6 address of the device, global unicast addresses are preferred.
+func (dev *Device) IPv6Addr() *net.IPNet {
+	var result *net.IPNet
+
+	for _, a := range dev.ipAddrs {
+		if a.IP.To4() != nil {
+			continue
+		}
+		if a.IP.IsGlobalUnicast() {
+			return a
+		}
+		if result == nil {
+			result = a
+		}
+	}
+
+	return result
+}
+
+// IPAddrByFamily returns the first IP address of the device in the same family as the given IP.
+func (dev *Device) IPAddrByFamily(ip net.IP) *net.IPNet {
+	if ip.To4() != nil {
+		return dev.IPv4Addr()
+	}
+
+	return dev.IPv6Addr()
+}
+
+func (dev *Device) ipv6Addrs() []*net.IPNet {
+	result := make([]*net.IPNet, 0)
+
+	for _, a := range dev.ipAddrs {
+		if a.IP.To4() == nil {
+			result = append(result, a)
+		}
+	}
+
+	return result
+}
+
 func (dev Device) String() string {
 	var result string
 
@@ -79,7 +153,47 @@ func (dev Device) String() string {
 	return result
 }
 
-const flagPcapLoopback = 1
+// DeviceInfo describes the info of a network device in JSON.
+type DeviceInfo struct {
+	Name         string   `json:"name"`
+	Alias        string   `json:"alias"`
+	HardwareAddr string   `json:"hardwareAddr,omitempty"`
+	IPAddrs      []string `json:"ipAddrs"`
+	Gateway      string   `json:"gateway,omitempty"`
+	MTU          int      `json:"mtu"`
+	IsLoop       bool     `json:"isLoop"`
+	IsUp         bool     `json:"isUp"`
+}
+
+// Info returns the info of the device, with the gateway if it is in networks of the device.
+func (dev *Device) Info(gateway net.IP) *DeviceInfo {
+	info := &DeviceInfo{
+		Name:    dev.name,
+		Alias:   dev.alias,
+		IPAddrs: make([]string, 0),
+		MTU:     dev.mtu,
+		IsLoop:  dev.isLoop,
+		IsUp:    dev.isUp,
+	}
+	if dev.hardwareAddr != nil {
+		info.HardwareAddr = dev.hardwareAddr.String()
+	}
+	for _, a := range dev.ipAddrs {
+		info.IPAddrs = append(info.IPAddrs, a.String())
+		if gateway != nil && !dev.isLoop && a.Contains(gateway) {
+			info.Gateway = gateway.String()
+		}
+	}
+
+	return info
+}
+
+// pcapDev describes a device found by libpcap, or by the system if libpcap is unavailable.
+type pcapDev struct {
+	name   string
+	isLoop bool
+	ips    []net.IP
+}
 
 var blacklist map[string]bool
 
@@ -115,6 +229,7 @@ func FindAllDevs() ([]*Device, error) {
 		}
 
 		as := make([]*net.IPNet, 0)
+		as6 := make([]*net.IPNet, 0)
 		for _, a := range addrs {
 			ipnet, ok := a.(*net.IPNet)
 			if !ok {
@@ -122,61 +237,63 @@ func FindAllDevs() ([]*Device, error) {
 				continue
 			}
 
-			// Only pass IPv4 address
+			// IPv4 addresses are always in front of IPv6 addresses
 			if ipnet.IP.To4() == nil {
+				as6 = append(as6, ipnet)
 				continue
 			}
 
 			as = append(as, ipnet)
 		}
+		as = append(as, as6...)
 
-		t = append(t, &Device{alias: inter.Name, ipAddrs: as, hardwareAddr: inter.HardwareAddr, isLoop: isLoop})
+		t = append(t, &Device{alias: inter.Name, ipAddrs: as, hardwareAddr: inter.HardwareAddr, mtu: inter.MTU, backend: backends[inter.Name], isLoop: isLoop, isUp: inter.Flags&net.FlagUp != 0})
 	}
 
 	// Enumerate pcap devices
 	mid := make([]*Device, 0)
-	devs, err := pcap.FindAllDevs()
+	devs, err := findPcapDevs()
 	if err != nil {
 		return nil, fmt.Errorf("find pcap devices: %w", err)
 	}
 	for _, dev := range devs {
 		// Check blacklist
-		_, ok := blacklist[dev.Name]
+		_, ok := blacklist[dev.name]
 		if ok {
 			continue
 		}
 
 		// Match pcap device with interface
-		if dev.Flags&flagPcapLoopback != 0 {
+		if dev.isLoop {
 			d := FindLoopDev(t)
 			if d == nil {
 				continue
 			}
 			if d.name != "" {
 				// return nil, errors.New("too many loopback devices")
-				blacklist[dev.Name] = true
+				blacklist[dev.name] = true
 				blacklist[d.name] = true
-				log.Infof("Device %s is a loopback device but so is %s, these devices will not be used\n", dev.Name, d.name)
+				log.Infof("Device %s is a loopback device but so is %s, these devices will not be used\n", dev.name, d.name)
 			}
-			d.name = dev.Name
+			d.name = dev.name
 			mid = append(mid, d)
 		} else {
-			if len(dev.Addresses) <= 0 {
+			if len(dev.ips) <= 0 {
 				continue
 			}
-			for _, a := range dev.Addresses {
-				d := FindDev(t, a.IP)
+			for _, ip := range dev.ips {
+				d := FindDev(t, ip)
 				if d == nil {
 					continue
 				}
 				if d.name != "" {
-					// return nil, fmt.Errorf("parse pcap device %s: %w", dev.Name, fmt.Errorf("same address with %s", d.Name))
-					blacklist[dev.Name] = true
+					// return nil, fmt.Errorf("parse pcap device %s: %w", dev.name, fmt.Errorf("same address with %s", d.Name))
+					blacklist[dev.name] = true
 					blacklist[d.name] = true
-					log.Infof("Device %s has the same address with %s, these devices will not be used\n", dev.Name, d.name)
+					log.Infof("Device %s has the same address with %s, these devices will not be used\n", dev.name, d.name)
 					break
 				}
-				d.name = dev.Name
+				d.name = dev.name
 				mid = append(mid, d)
 				break
 			}
@@ -194,6 +311,34 @@ func FindAllDevs() ([]*Device, error) {
 	return result, nil
 }
 
+// DetectMTU returns the smallest MTU of designated devices in the range from 576 to MaxMTU, or DefaultMTU if none of
+// them is known.
+func DetectMTU(devs ...*Device) int {
+	result := 0
+
+	for _, dev := range devs {
+		mtu := dev.mtu
+		if mtu <= 0 {
+			continue
+		}
+		if mtu > MaxMTU {
+			mtu = MaxMTU
+		}
+		if mtu < 576 {
+			mtu = 576
+		}
+		if result == 0 || mtu < result {
+			result = mtu
+		}
+	}
+
+	if result == 0 {
+		return DefaultMTU
+	}
+
+	return result
+}
+
 // FindLoopDev returns the loop device in designated devices.
 func FindLoopDev(devs []*Device) *Device {
 	for _, dev := range devs {
@@ -238,6 +383,13 @@ func FindGatewayDev(dev *Device, ip net.IP) (*Device, error) {
 		return nil, fmt.Errorf("parse filter %s: %w", ip, err)
 	}
 
+	addrs := append(make([]*net.IPNet, 0), &net.IPNet{IP: ip})
+
+	// Raw sockets have no link layer, so the hardware address of the gateway is not needed
+	if !hasLibpcap {
+		return &Device{alias: "Gateway", ipAddrs: addrs}, nil
+	}
+
 	conn, err := createPureRawConn(dev.Name(), fmt.Sprintf("ip && udp && %s", f))
 	if err != nil {
 		return nil, fmt.Errorf("open device %s: %w", dev.Alias(), err)
@@ -276,9 +428,13 @@ func FindGatewayDev(dev *Device, ip net.IP) (*Device, error) {
 		return nil, errors.New("invalid packet")
 	}
 
-	addrs := append(make([]*net.IPNet, 0), &net.IPNet{IP: ip})
+	// Encapsulation
+	encap, _, err := parseEncap(packet, ethernetPacket)
+	if err != nil {
+		return nil, fmt.Errorf("parse encapsulation: %w", err)
+	}
 
-	return &Device{alias: "Gateway", ipAddrs: addrs, hardwareAddr: ethernetPacket.DstMAC}, nil
+	return &Device{alias: "Gateway", ipAddrs: addrs, hardwareAddr: ethernetPacket.DstMAC, encap: encap}, nil
 }
 
 // FindListenDevs returns all valid pcap devices for listening.
@@ -329,8 +485,8 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 			return nil, nil, fmt.Errorf("unknown upstream device %s", name)
 		}
 
-		// Find gateway device
-		if upDev.isLoop {
+		// Find gateway device, TUN and TAP devices have no gateway on the link
+		if upDev.isLoop || upDev.backend == BackendTun || upDev.backend == BackendTap {
 			gatewayDev = upDev
 		} else {
 			// Find gateway's address
@@ -353,9 +509,12 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 					newUpDev = &Device{
 						name:         upDev.name,
 						alias:        upDev.alias,
-						ipAddrs:      append(make([]*net.IPNet, 0), a),
+						ipAddrs:      append(append(make([]*net.IPNet, 0), a), upDev.ipv6Addrs()...),
 						hardwareAddr: upDev.hardwareAddr,
+						mtu:          upDev.mtu,
+						backend:      upDev.backend,
 						isLoop:       upDev.isLoop,
+						isUp:         upDev.isUp,
 					}
 					break
 				}
@@ -391,9 +550,12 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 					upDev = &Device{
 						name:         dev.name,
 						alias:        dev.alias,
-						ipAddrs:      append(make([]*net.IPNet, 0), a),
+						ipAddrs:      append(append(make([]*net.IPNet, 0), a), dev.ipv6Addrs()...),
 						hardwareAddr: dev.hardwareAddr,
+						mtu:          dev.mtu,
+						backend:      dev.backend,
 						isLoop:       dev.isLoop,
+						isUp:         dev.isUp,
 					}
 					break
 				}
@@ -33,10 +33,37 @@ func (indicator *DNSIndicator) Answers() (string, []net.IP) {
 		if i == 0 {
 			name = string(answer.Name)
 		}
-		if answer.IP != nil && answer.IP.To4() != nil {
+		if answer.IP != nil {
 			ips = append(ips, answer.IP)
 		}
 	}
 
 	return name, ips
 }
+
+// Question returns the name in the first question of the DNS layer.
+func (indicator *DNSIndicator) Question() string {
+	if len(indicator.layer.Questions) <= 0 {
+		return ""
+	}
+
+	return string(indicator.layer.Questions[0].Name)
+}
+
+// TTL returns the minimum TTL of recognizable answers in the DNS layer.
+func (indicator *DNSIndicator) TTL() uint32 {
+	var ttl uint32
+
+	isFirst := true
+	for _, answer := range indicator.layer.Answers {
+		if answer.IP == nil {
+			continue
+		}
+		if isFirst || answer.TTL < ttl {
+			ttl = answer.TTL
+			isFirst = false
+		}
+	}
+
+	return ttl
+}
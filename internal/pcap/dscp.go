@@ -0,0 +1,97 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"strconv"
+	"strings"
+)
+
+var dscpClasses = map[string]uint8{
+	"CS0":  0,
+	"CS1":  8,
+	"CS2":  16,
+	"CS3":  24,
+	"CS4":  32,
+	"CS5":  40,
+	"CS6":  48,
+	"CS7":  56,
+	"AF11": 10,
+	"AF12": 12,
+	"AF13": 14,
+	"AF21": 18,
+	"AF22": 20,
+	"AF23": 22,
+	"AF31": 26,
+	"AF32": 28,
+	"AF33": 30,
+	"AF41": 34,
+	"AF42": 36,
+	"AF43": 38,
+	"LE":   1,
+	"VA":   44,
+	"EF":   46,
+}
+
+// DSCP describes the DSCP class marked on crafted packets.
+type DSCP struct {
+	isMarked bool
+	class    uint8
+}
+
+// ParseDSCP returns a DSCP by the given string, can be empty, a class name like EF or AF41, or a number from 0 to 63.
+func ParseDSCP(s string) (*DSCP, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return &DSCP{}, nil
+	}
+
+	class, ok := dscpClasses[strings.ToUpper(s)]
+	if ok {
+		return &DSCP{isMarked: true, class: class}, nil
+	}
+
+	n, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return nil, fmt.Errorf("dscp %s not support", s)
+	}
+	if n > 63 {
+		return nil, fmt.Errorf("dscp %d out of range", n)
+	}
+
+	return &DSCP{isMarked: true, class: uint8(n)}, nil
+}
+
+// IsDefault returns if the DSCP is left unmarked.
+func (dscp *DSCP) IsDefault() bool {
+	return dscp == nil || !dscp.isMarked
+}
+
+// apply marks the DSCP of the network layer and keeps its ECN.
+func (dscp *DSCP) apply(networkLayer gopacket.SerializableLayer) {
+	if dscp.IsDefault() {
+		return
+	}
+
+	switch t := networkLayer.(type) {
+	case *layers.IPv4:
+		t.TOS = dscp.class<<2 | t.TOS&ecnMask
+	case *layers.IPv6:
+		t.TrafficClass = dscp.class<<2 | t.TrafficClass&ecnMask
+	}
+}
+
+func (dscp DSCP) String() string {
+	if !dscp.isMarked {
+		return "default"
+	}
+
+	for name, class := range dscpClasses {
+		if class == dscp.class {
+			return name
+		}
+	}
+
+	return strconv.Itoa(int(dscp.class))
+}
@@ -0,0 +1,210 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"ikago/internal/log"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DumpLayer describes packets of which layer are dumped.
+type DumpLayer int
+
+const (
+	// DumpInner describes packets before encryption, which are from or to sources and destinations.
+	DumpInner DumpLayer = 1 << iota
+	// DumpOuter describes packets after encryption, which are between the client and the server.
+	DumpOuter
+	// DumpAll describes packets in both layers.
+	DumpAll = DumpInner | DumpOuter
+)
+
+// ParseDumpLayer returns the dump layer by its name, which can be inner, outer and all.
+func ParseDumpLayer(s string) (DumpLayer, error) {
+	switch strings.ToLower(s) {
+	case "", "all":
+		return DumpAll, nil
+	case "inner":
+		return DumpInner, nil
+	case "outer":
+		return DumpOuter, nil
+	default:
+		return 0, fmt.Errorf("dump layer %s not support", s)
+	}
+}
+
+func (layer DumpLayer) String() string {
+	switch layer {
+	case DumpInner:
+		return "inner"
+	case DumpOuter:
+		return "outer"
+	case DumpAll:
+		return "all"
+	default:
+		panic(fmt.Errorf("dump layer %d out of range", layer))
+	}
+}
+
+// dumpInterface describes an interface in pcapng, which is decided by the layer, the direction and the link type.
+type dumpInterface struct {
+	layer    DumpLayer
+	isIn     bool
+	linkType layers.LinkType
+}
+
+func (intf dumpInterface) name() string {
+	if intf.isIn {
+		return intf.layer.String() + "-in"
+	}
+
+	return intf.layer.String() + "-out"
+}
+
+func (intf dumpInterface) description() string {
+	var direction, layer string
+	if intf.isIn {
+		direction = "Inbound"
+	} else {
+		direction = "Outbound"
+	}
+	if intf.layer == DumpInner {
+		layer = "before encryption"
+	} else {
+		layer = "after encryption"
+	}
+
+	return fmt.Sprintf("%s packets %s", direction, layer)
+}
+
+// Dumper writes packets to a pcapng file, where packets of each layer and each direction are in their own interfaces.
+type Dumper struct {
+	lock       sync.Mutex
+	file       *os.File
+	w          *pcapgo.NgWriter
+	layer      DumpLayer
+	interfaces map[dumpInterface]int
+	isClosed   bool
+}
+
+// CreateDumper creates a dumper writes packets of the layer to the file.
+func CreateDumper(path string, layer DumpLayer) (*Dumper, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	return &Dumper{
+		file:       file,
+		layer:      layer,
+		interfaces: make(map[dumpInterface]int),
+	}, nil
+}
+
+// Layer returns the layer of packets dumped.
+func (d *Dumper) Layer() DumpLayer {
+	return d.layer
+}
+
+// dump writes the packet. Interfaces are added when packets in them appear for the first time.
+func (d *Dumper) dump(intf dumpInterface, data []byte) error {
+	if d.layer&intf.layer == 0 {
+		return nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.isClosed {
+		return nil
+	}
+
+	// Interface
+	index, ok := d.interfaces[intf]
+	if !ok {
+		ngIntf := pcapgo.NgInterface{
+			Name:                intf.name(),
+			Description:         intf.description(),
+			OS:                  runtime.GOOS,
+			LinkType:            intf.linkType,
+			TimestampResolution: 9,
+		}
+
+		var err error
+		if d.w == nil {
+			d.w, err = pcapgo.NewNgWriterInterface(d.file, ngIntf, pcapgo.NgWriterOptions{
+				SectionInfo: pcapgo.NgSectionInfo{
+					Hardware:    runtime.GOARCH,
+					OS:          runtime.GOOS,
+					Application: "IkaGo",
+				},
+			})
+		} else {
+			index, err = d.w.AddInterface(ngIntf)
+		}
+		if err != nil {
+			return fmt.Errorf("add interface %s: %w", intf.name(), err)
+		}
+		d.interfaces[intf] = index
+	}
+
+	err := d.w.WritePacket(gopacket.CaptureInfo{
+		Timestamp:      time.Now(),
+		CaptureLength:  len(data),
+		Length:         len(data),
+		InterfaceIndex: index,
+	}, data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// Flush every packet so the file can be read while dumping
+	return d.w.Flush()
+}
+
+// Close flushes and closes the file.
+func (d *Dumper) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.isClosed {
+		return errors.New("closed")
+	}
+	d.isClosed = true
+
+	if d.w != nil {
+		err := d.w.Flush()
+		if err != nil {
+			d.file.Close()
+			return fmt.Errorf("flush: %w", err)
+		}
+	}
+
+	return d.file.Close()
+}
+
+var dumper *Dumper
+
+// SetDumper sets the dumper, which dumps packets read and written in connections with dump layers.
+func SetDumper(d *Dumper) {
+	dumper = d
+}
+
+// dumpPacket dumps the packet by the dumper if it is set.
+func dumpPacket(layer DumpLayer, isIn bool, linkType layers.LinkType, data []byte) {
+	if dumper == nil || layer == 0 {
+		return
+	}
+
+	err := dumper.dump(dumpInterface{layer: layer, isIn: isIn, linkType: linkType}, data)
+	if err != nil {
+		log.Errorln(fmt.Errorf("dump: %w", err))
+	}
+}
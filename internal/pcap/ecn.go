@@ -0,0 +1,78 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	ecnNotECT = 0x0
+	ecnCE     = 0x3
+	ecnMask   = 0x3
+)
+
+// trafficClass returns the IPv4 TOS or IPv6 traffic class of the raw IP packet.
+func trafficClass(data []byte) (uint8, bool) {
+	if len(data) < 2 {
+		return 0, false
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return 0, false
+		}
+		return data[1], true
+	case 6:
+		if len(data) < 40 {
+			return 0, false
+		}
+		return data[0]<<4 | data[1]>>4, true
+	default:
+		return 0, false
+	}
+}
+
+// isCE returns if the packet is marked congestion experienced.
+func isCE(indicator *PacketIndicator) bool {
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		return indicator.IPv4Layer().TOS&ecnMask == ecnCE
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().TrafficClass&ecnMask == ecnCE
+	default:
+		return false
+	}
+}
+
+// markCE marks the raw IP packet congestion experienced if it is ECN-capable.
+func markCE(data []byte) {
+	tc, ok := trafficClass(data)
+	if !ok || tc&ecnMask == ecnNotECT {
+		return
+	}
+	tc = tc | ecnCE
+
+	switch data[0] >> 4 {
+	case 4:
+		ihl := int(data[0]&0x0f) * 4
+		if ihl < 20 || len(data) < ihl {
+			return
+		}
+		data[1] = tc
+
+		// Checksum
+		data[10], data[11] = 0, 0
+		var sum uint32
+		for i := 0; i < ihl; i = i + 2 {
+			sum = sum + uint32(binary.BigEndian.Uint16(data[i:i+2]))
+		}
+		for sum > 0xffff {
+			sum = (sum >> 16) + (sum & 0xffff)
+		}
+		binary.BigEndian.PutUint16(data[10:12], ^uint16(sum))
+	case 6:
+		data[0] = data[0]&0xf0 | tc>>4
+		data[1] = data[1]&0x0f | tc<<4
+	}
+}
@@ -0,0 +1,130 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Encap describes layers between an Ethernet layer and a network layer, like an 802.1Q tag and a PPPoE session.
+type Encap struct {
+	// Dot1Q is the 802.1Q layer, can be nil.
+	Dot1Q *layers.Dot1Q
+	// PPPoE is the PPPoE session layer, can be nil.
+	PPPoE *layers.PPPoE
+}
+
+// EncapEthernet is an Ethernet layer with encapsulation, the Ethernet type is the type of the network layer.
+type EncapEthernet struct {
+	*layers.Ethernet
+	Encap *Encap
+}
+
+// SerializeTo serializes the Ethernet layer followed by the encapsulation.
+func (l *EncapEthernet) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	t := l.EthernetType
+
+	// PPPoE
+	if l.Encap.PPPoE != nil {
+		var pppType layers.PPPType
+
+		switch t {
+		case layers.EthernetTypeIPv4:
+			pppType = layers.PPPTypeIPv4
+		case layers.EthernetTypeIPv6:
+			pppType = layers.PPPTypeIPv6
+		default:
+			return fmt.Errorf("ethernet type %s not support", t)
+		}
+
+		pppLayer := &layers.PPP{PPPType: pppType}
+		err := pppLayer.SerializeTo(b, opts)
+		if err != nil {
+			return err
+		}
+
+		// Length is always fixed since lengths of payloads may change in NAT
+		pppoeLayer := *l.Encap.PPPoE
+		pppoeLayer.Length = uint16(len(b.Bytes()))
+		err = pppoeLayer.SerializeTo(b, gopacket.SerializeOptions{})
+		if err != nil {
+			return err
+		}
+
+		t = layers.EthernetTypePPPoESession
+	}
+
+	// 802.1Q
+	if l.Encap.Dot1Q != nil {
+		dot1QLayer := *l.Encap.Dot1Q
+		dot1QLayer.Type = t
+		err := dot1QLayer.SerializeTo(b, opts)
+		if err != nil {
+			return err
+		}
+
+		t = layers.EthernetTypeDot1Q
+	}
+
+	ethernetLayer := *l.Ethernet
+	ethernetLayer.EthernetType = t
+
+	return ethernetLayer.SerializeTo(b, opts)
+}
+
+// parseEncap returns the encapsulation following the Ethernet layer and the Ethernet type of the network layer, the
+// encapsulation is nil if there is none.
+func parseEncap(packet gopacket.Packet, ethernetLayer *layers.Ethernet) (*Encap, layers.EthernetType, error) {
+	encap := &Encap{}
+	t := ethernetLayer.EthernetType
+
+	// 802.1Q
+	if t == layers.EthernetTypeDot1Q {
+		layer := packet.Layer(layers.LayerTypeDot1Q)
+		if layer == nil {
+			return nil, t, errors.New("missing dot1q layer")
+		}
+		encap.Dot1Q = layer.(*layers.Dot1Q)
+		t = encap.Dot1Q.Type
+	}
+
+	// PPPoE
+	if t == layers.EthernetTypePPPoESession {
+		layer := packet.Layer(layers.LayerTypePPPoE)
+		if layer == nil {
+			return nil, t, errors.New("missing pppoe layer")
+		}
+		encap.PPPoE = layer.(*layers.PPPoE)
+
+		layer = packet.Layer(layers.LayerTypePPP)
+		if layer == nil {
+			return nil, t, errors.New("missing ppp layer")
+		}
+		switch pppType := layer.(*layers.PPP).PPPType; pppType {
+		case layers.PPPTypeIPv4:
+			t = layers.EthernetTypeIPv4
+		case layers.PPPTypeIPv6:
+			t = layers.EthernetTypeIPv6
+		default:
+			return nil, t, fmt.Errorf("ppp type %s not support", pppType)
+		}
+	}
+
+	if encap.Dot1Q == nil && encap.PPPoE == nil {
+		return nil, t, nil
+	}
+
+	return encap, t, nil
+}
+
+// encapBPFFilters returns filters of the filter in each encapsulation. Keywords vlan and pppoes shift offsets of all
+// tests following them in an expression, even in alternatives, so each encapsulation is compiled in its own program.
+func encapBPFFilters(filter string) []string {
+	return []string{
+		filter,
+		"vlan && (" + filter + ")",
+		"pppoes && (" + filter + ")",
+		"vlan && pppoes && (" + filter + ")",
+	}
+}
@@ -0,0 +1,153 @@
+// +build !nopcap
+
+package pcap
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+	"net"
+	"testing"
+)
+
+// encapFrame returns an Ethernet frame of a UDP datagram to the port in the encapsulation.
+func encapFrame(t *testing.T, encap *Encap, port uint16) []byte {
+	t.Helper()
+
+	linkLayer := &EncapEthernet{
+		Ethernet: &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+			DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		Encap: encap,
+	}
+	networkLayer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(10, 0, 0, 2).To4(),
+		DstIP:    net.IPv4(10, 0, 0, 1).To4(),
+	}
+	transportLayer := &layers.UDP{SrcPort: 40000, DstPort: layers.UDPPort(port)}
+	err := transportLayer.SetNetworkLayerForChecksum(networkLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		linkLayer, networkLayer, transportLayer, gopacket.Payload("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+// TestCompileEncapFilter runs the filter compiled against frames in each encapsulation.
+func TestCompileEncapFilter(t *testing.T) {
+	insts, err := compileEncapFilter("udp && dst port 53")
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	vm, err := newBPFVM(insts)
+	if err != nil {
+		t.Fatalf("new vm: %v", err)
+	}
+
+	dot1Q := &layers.Dot1Q{VLANIdentifier: 100}
+	pppoe := &layers.PPPoE{Version: 1, Type: 1, Code: layers.PPPoECodeSession, SessionId: 1}
+
+	tests := []struct {
+		name  string
+		encap *Encap
+	}{
+		{"none", &Encap{}},
+		{"vlan", &Encap{Dot1Q: dot1Q}},
+		{"pppoe", &Encap{PPPoE: pppoe}},
+		{"vlan pppoe", &Encap{Dot1Q: dot1Q, PPPoE: pppoe}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n, err := vm.Run(encapFrame(t, test.encap, 53))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n <= 0 {
+				t.Error("frame to port 53 rejected")
+			}
+
+			n, err = vm.Run(encapFrame(t, test.encap, 80))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n > 0 {
+				t.Error("frame to port 80 accepted")
+			}
+		})
+	}
+}
+
+// TestChainBPF chains programs which accept frames of given first bytes.
+func TestChainBPF(t *testing.T) {
+	first := func(b byte) []pcap.BPFInstruction {
+		insts, err := bpf.Assemble([]bpf.Instruction{
+			bpf.LoadAbsolute{Off: 0, Size: 1},
+			bpf.JumpIf{Cond: bpf.JumpEqual, Val: uint32(b), SkipFalse: 1},
+			bpf.RetConstant{Val: maxSnapLen},
+			bpf.RetConstant{Val: 0},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result := make([]pcap.BPFInstruction, 0, len(insts))
+		for _, inst := range insts {
+			result = append(result, pcap.BPFInstruction{Code: inst.Op, Jt: inst.Jt, Jf: inst.Jf, K: inst.K})
+		}
+
+		return result
+	}
+
+	insts := append(chainBPF(first(1), false), chainBPF(first(2), false)...)
+	insts = append(insts, chainBPF(first(3), true)...)
+
+	vm, err := newBPFVM(insts)
+	if err != nil {
+		t.Fatalf("new vm: %v", err)
+	}
+
+	tests := []struct {
+		b        byte
+		accepted bool
+	}{
+		{1, true},
+		{2, true},
+		{3, true},
+		{4, false},
+	}
+
+	for _, test := range tests {
+		n, err := vm.Run([]byte{test.b, 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 0 != test.accepted {
+			t.Errorf("%d: accepted %t, want %t", test.b, n > 0, test.accepted)
+		}
+	}
+}
+
+func newBPFVM(insts []pcap.BPFInstruction) (*bpf.VM, error) {
+	raws := make([]bpf.Instruction, 0, len(insts))
+	for _, inst := range insts {
+		raws = append(raws, bpf.RawInstruction{Op: inst.Code, Jt: inst.Jt, Jf: inst.Jf, K: inst.K}.Disassemble())
+	}
+
+	return bpf.NewVM(raws)
+}
@@ -1,6 +1,8 @@
 package pcap
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -9,20 +11,63 @@
 	"ikago/internal/config"
 	"ikago/internal/crypto"
 	"ikago/internal/log"
+	"ikago/internal/obfs"
+	"ikago/internal/tracing"
+	"io"
+	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type clientIndicator struct {
 	crypt crypto.Crypt
-	seq   uint32
-	ack   uint32
+	state *fakeTCPState
+	// hardwareAddr and encap describe the hop to the client in the device it comes from, which are learned from its
+	// SYN, so clients in different devices are replied to correctly.
+	hardwareAddr net.HardwareAddr
+	encap        *Encap
+	// exchanged is the time of the last hello of key exchange sent.
+	exchanged time.Time
+	// template is the template of segments sent to the client.
+	template *layerTemplate
 }
 
 const establishDeadline = 3 * time.Second
 const keepFragments = 30 * time.Second
 
+// retransmitRate is the rate of segments retransmitted in emulation.
+const retransmitRate = 0.01
+
+// retransmitTimeout is the duration after which a segment is retransmitted in emulation.
+const retransmitTimeout = 200 * time.Millisecond
+
+// ackSegments is the number of segments received before a cumulative ACK is sent in emulation.
+const ackSegments = 2
+
+// persistTimeout is the duration a window closed by the peer is honored.
+const persistTimeout = 200 * time.Millisecond
+
+// finishDeadline is the duration a FIN from the peer is waited for in closing.
+const finishDeadline = time.Second
+
+// FakeTCPDrops describes segments dropped before they are sent in FakeTCP connections.
+type FakeTCPDrops struct {
+	// Window is the number of segments dropped while peers close their receive windows.
+	Window uint64 `json:"window"`
+	// Pace is the number of segments dropped for pacing queues are full.
+	Pace uint64 `json:"pace"`
+}
+
+// load returns a copy of the drops.
+func (d *FakeTCPDrops) load() FakeTCPDrops {
+	return FakeTCPDrops{
+		Window: atomic.LoadUint64(&d.Window),
+		Pace:   atomic.LoadUint64(&d.Pace),
+	}
+}
+
 // FakeTCPConn is a packet pcap network connection add fake TCP header to all traffic.
 type FakeTCPConn struct {
 	lock          sync.Mutex
@@ -32,7 +77,21 @@ type FakeTCPConn struct {
 	dstAddr       *net.TCPAddr
 	crypt         crypto.Crypt
 	mtu           int
+	ecn           bool
+	ttl           *TTLPolicy
+	dscp          *DSCP
+	emulate       bool
+	synOptions    *SYNOptions
+	keepalive     time.Duration
+	fingerprint   *Fingerprint
+	backlog       func() float64
+	pacer         *pacer
+	obfuscator    obfs.Obfuscator
+	drops         *FakeTCPDrops
+	roaming       roamState
 	appear        time.Time
+	health        health
+	isPassive     bool
 	isConnected   bool
 	isReconnected bool
 	isClosed      bool
@@ -45,22 +104,27 @@ type FakeTCPConn struct {
 
 func newConn() *FakeTCPConn {
 	conn := &FakeTCPConn{
-		defrag:  NewEasyDefragmenter(),
-		mtu:     MaxMTU,
-		clients: make(map[string]*clientIndicator),
+		defrag:     NewEasyDefragmenter(),
+		mtu:        DefaultMTU,
+		obfuscator: obfs.CreatePlainObfuscator(),
+		drops:      &FakeTCPDrops{},
+		clients:    make(map[string]*clientIndicator),
 	}
 	conn.defrag.SetDeadline(keepFragments)
 	return conn
 }
 
 // DialFakeTCP establishes FakeTCP connection for pcap networks.
-func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error) {
+func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int, ecn bool, ttl *TTLPolicy, dscp *DSCP, emulate bool, synOptions *SYNOptions, keepalive time.Duration, fingerprint *Fingerprint, pace int, obfuscator obfs.Obfuscator) (*FakeTCPConn, error) {
 	srcAddr := &net.TCPAddr{
-		IP:   srcDev.IPAddr().IP,
 		Port: int(srcPort),
 	}
+	srcIP := srcDev.IPAddrByFamily(dstAddr.IP)
+	if srcIP != nil {
+		srcAddr.IP = srcIP.IP
+	}
 
-	conn, err := dialFakeTCPPassive(srcDev, dstDev, srcPort, dstAddr, crypt, mtu)
+	conn, err := dialFakeTCPPassive(srcDev, dstDev, srcPort, dstAddr, crypt, mtu, ecn, ttl, dscp, emulate, synOptions, keepalive, fingerprint, pace, obfuscator)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -98,37 +162,82 @@ func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, c
 	return conn, nil
 }
 
-func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error) {
-	srcAddr := &net.TCPAddr{
-		IP:   srcDev.IPAddr().IP,
-		Port: int(srcPort),
+func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int, ecn bool, ttl *TTLPolicy, dscp *DSCP, emulate bool, synOptions *SYNOptions, keepalive time.Duration, fingerprint *Fingerprint, pace int, obfuscator obfs.Obfuscator) (*FakeTCPConn, error) {
+	srcIP := srcDev.IPAddrByFamily(dstAddr.IP)
+	if srcIP == nil {
+		return nil, fmt.Errorf("no address in the same family as %s", dstAddr.IP)
 	}
 
-	filter, err := addr.SrcBPFFilter(dstAddr)
+	filter, err := connFilter(srcPort, dstAddr)
 	if err != nil {
-		return nil, fmt.Errorf("parse filter %s: %w", dstAddr, err)
-	}
-	dstIP := &net.IPAddr{IP: dstAddr.IP}
-	filter2, err := addr.SrcBPFFilter(dstIP)
-	if err != nil {
-		return nil, fmt.Errorf("parse filter %s: %w", dstIP, err)
+		return nil, err
 	}
 
-	rawConn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("ip && ((tcp && dst port %d && %s) || ((ip[6:2] & 0x1fff) != 0 && %s))", srcAddr.Port, filter, filter2))
+	rawConn, err := CreateRawConn(srcDev, dstDev, filter)
 	if err != nil {
 		return nil, fmt.Errorf("create raw connection: %w", err)
 	}
+	rawConn.SetDumpLayer(DumpOuter)
 
 	conn := newConn()
 	conn.srcPort = srcPort
 	conn.dstAddr = dstAddr
 	conn.crypt = crypt
 	conn.mtu = mtu
+	conn.ecn = ecn
+	conn.ttl = ttl
+	conn.dscp = dscp
+	conn.emulate = emulate
+	conn.synOptions = synOptions
+	conn.keepalive = keepalive
+	conn.fingerprint = fingerprint
+	conn.obfuscator = obfuscator
 	conn.conn = rawConn
 
+	// Obfuscation
+	if conn.obfuscator == nil {
+		conn.obfuscator = obfs.CreatePlainObfuscator()
+	}
+
+	// Keepalive
+	if keepalive > 0 {
+		go conn.keepAlive()
+	}
+
+	// Pace, and delay segments in the queue of the pacer
+	if pace > 0 || obfs.IsDelayed(conn.obfuscator) {
+		if mtu <= 0 {
+			mtu = DefaultMTU
+		}
+		size := mtu - 40 - crypt.Cost() - conn.obfuscator.Cost()
+		if dstAddr.IP.To4() == nil {
+			size = size - 20
+		}
+		conn.pacer = newPacer(pace, size, conn.obfuscator.Delay, func(b []byte, addr net.Addr, psh bool) error {
+			_, err := conn.writeTo(context.Background(), b, addr, psh)
+			return err
+		})
+	}
+
 	return conn, nil
 }
 
+// connFilter returns the BPF filter of a FakeTCP connection from the local port to the remote address.
+func connFilter(srcPort uint16, dstAddr *net.TCPAddr) (string, error) {
+	filter, err := addr.SrcBPFFilter(dstAddr)
+	if err != nil {
+		return "", fmt.Errorf("parse filter %s: %w", dstAddr, err)
+	}
+	dstIP := &net.IPAddr{IP: dstAddr.IP}
+	filter2, err := addr.SrcBPFFilter(dstIP)
+	if err != nil {
+		return "", fmt.Errorf("parse filter %s: %w", dstIP, err)
+	}
+
+	return fmt.Sprintf("(ip && ((tcp && dst port %d && %s) || ((ip[6:2] & 0x1fff) != 0 && %s))) || (ip6 && ((tcp && dst port %d && %s) || (ip6[6] == 44 && %s)))",
+		srcPort, filter, filter2, srcPort, filter, filter2), nil
+}
+
 func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error) {
 	addrs := make([]*net.TCPAddr, 0)
 	for _, ip := range srcDev.IPAddrs() {
@@ -145,14 +254,20 @@ func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPort uint16, crypt crypto
 			Err:    fmt.Errorf("create connection: %w", err),
 		}
 	}
+	rawConn.SetDumpLayer(DumpOuter)
+
+	return newMulticastConn(rawConn, srcPort, crypt, mtu), nil
+}
 
+// newMulticastConn returns a new connection which accepts clients in the raw connection on the port.
+func newMulticastConn(rawConn *RawConn, srcPort uint16, crypt crypto.Crypt, mtu int) *FakeTCPConn {
 	conn := newConn()
 	conn.srcPort = srcPort
 	conn.crypt = crypt
 	conn.mtu = mtu
 	conn.conn = rawConn
 
-	return conn, nil
+	return conn
 }
 
 func (c *FakeTCPConn) Read(b []byte) (n int, err error) {
@@ -176,11 +291,7 @@ func (c *FakeTCPConn) handshakeSYN() error {
 	client, ok := c.clients[c.RemoteAddr().String()]
 	c.clientsLock.RUnlock()
 	if !ok {
-		// Initial TCP Seq
-		client = &clientIndicator{
-			crypt: c.crypt,
-			seq:   0,
-		}
+		client = &clientIndicator{crypt: c.crypt}
 
 		// Map client
 		c.clientsLock.Lock()
@@ -188,14 +299,25 @@ func (c *FakeTCPConn) handshakeSYN() error {
 		c.clientsLock.Unlock()
 	}
 
+	// A SYN starts a new stream with a new initial TCP Seq and a new session
+	client.state = c.fingerprint.newState()
+	client.crypt = newSession(c.crypt)
+
 	// Create layers
-	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), client.seq, client.ack, c.conn, c.dstAddr.IP, c.id, 128, c.RemoteDev().HardwareAddr())
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), client.state.seq, client.state.ack, c.conn, c.dstAddr.IP, c.id, 128, c.RemoteDev().HardwareAddr(), c.RemoteDev().Encap())
 	if err != nil {
 		return err
 	}
 
 	// Make TCP layer SYN
 	FlagTCPLayer(transportLayer.(*layers.TCP), true, false, false)
+	synOptions := c.fingerprint.synOptions(c.synOptions)
+	client.state.wscale = synOptions.apply(transportLayer.(*layers.TCP), c.mtu, c.dstAddr.IP.To4() == nil, timestamp(client.state.tsOffset), nil)
+
+	// Fingerprint, TTL and DSCP
+	c.fingerprint.apply(client.state, networkLayer)
+	c.ttl.apply(networkLayer, nil)
+	c.dscp.apply(networkLayer)
 
 	// Serialize layers
 	data, err := Serialize(linkLayer, networkLayer, transportLayer)
@@ -210,7 +332,8 @@ func (c *FakeTCPConn) handshakeSYN() error {
 	}
 
 	// TCP Seq
-	client.seq++
+	client.state.sendSYN()
+	c.health.send(true)
 
 	// IPv4 Id
 	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
@@ -218,7 +341,7 @@ func (c *FakeTCPConn) handshakeSYN() error {
 	}
 
 	srcAddr := &net.TCPAddr{
-		IP:   c.LocalDev().IPAddr().IP,
+		IP:   c.LocalDev().IPAddrByFamily(c.dstAddr.IP).IP,
 		Port: int(c.srcPort),
 	}
 	log.Verbosef("Send TCP SYN: %s -> %s\n", srcAddr.String(), c.RemoteAddr().String())
@@ -242,27 +365,37 @@ func (c *FakeTCPConn) handshakeSYNACK(indicator *PacketIndicator) error {
 	client, ok := c.clients[indicator.Src().String()]
 	c.clientsLock.RUnlock()
 	if !ok {
-		// Initial TCP Seq
-		client = &clientIndicator{
-			crypt: c.crypt,
-			seq:   0,
-		}
+		client = &clientIndicator{crypt: c.crypt}
 
 		// Map client
 		c.clientsLock.Lock()
 		c.clients[indicator.Src().String()] = client
 		c.clientsLock.Unlock()
 	}
-	client.ack = indicator.TCPLayer().Seq + 1
+
+	// A SYN starts a new stream with a new initial TCP Seq and a new session
+	client.state = c.fingerprint.newState()
+	client.state.receiveSYN(indicator.TCPLayer().Seq)
+	client.crypt = newSession(c.crypt)
+	client.hardwareAddr = indicator.SrcHardwareAddr()
+	client.encap = indicator.Encap()
 
 	// Create layers
-	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), c.id, 64, indicator.SrcHardwareAddr())
+	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.state.seq, client.state.ack, c.conn, indicator.SrcIP(), c.id, 64, indicator.SrcHardwareAddr(), indicator.Encap())
 	if err != nil {
 		return fmt.Errorf("create layers: %w", err)
 	}
 
 	// Make TCP layer SYN & ACK
 	FlagTCPLayer(newTransportLayer.(*layers.TCP), true, false, true)
+	synOptions := c.fingerprint.synOptions(c.synOptions)
+	wscale := synOptions.apply(newTransportLayer.(*layers.TCP), c.mtu, indicator.SrcIP().To4() == nil, timestamp(client.state.tsOffset), indicator.TCPLayer())
+	client.state.negotiate(wscale, windowScale(indicator.TCPLayer()))
+
+	// Fingerprint, TTL and DSCP
+	c.fingerprint.apply(client.state, newNetworkLayer)
+	c.ttl.apply(newNetworkLayer, nil)
+	c.dscp.apply(newNetworkLayer)
 
 	// Serialize layers
 	data, err := Serialize(newLinkLayer, newNetworkLayer, newTransportLayer)
@@ -277,7 +410,7 @@ func (c *FakeTCPConn) handshakeSYNACK(indicator *PacketIndicator) error {
 	}
 
 	// TCP Seq
-	client.seq++
+	client.state.sendSYN()
 
 	// IPv4 Id
 	if newNetworkLayer.LayerType() == layers.LayerTypeIPv4 {
@@ -285,7 +418,7 @@ func (c *FakeTCPConn) handshakeSYNACK(indicator *PacketIndicator) error {
 	}
 
 	srcAddr := &net.TCPAddr{
-		IP:   c.LocalDev().IPAddr().IP,
+		IP:   c.LocalDev().IPAddrByFamily(indicator.SrcIP()).IP,
 		Port: int(indicator.DstPort()),
 	}
 	log.Verbosef("Send TCP SYN+ACK: %s <- %s\n", indicator.Src().String(), srcAddr.String())
@@ -313,14 +446,21 @@ func (c *FakeTCPConn) handshakeACK(indicator *PacketIndicator) error {
 	}
 
 	// TCP Ack
-	client.ack = indicator.TCPLayer().Seq + 1
+	client.state.receiveSYN(indicator.TCPLayer().Seq)
+	client.state.negotiate(client.state.wscale, windowScale(indicator.TCPLayer()))
 
 	// Create layers
-	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), c.id, 128, indicator.SrcHardwareAddr())
+	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.state.seq, client.state.ack, c.conn, indicator.SrcIP(), c.id, 128, indicator.SrcHardwareAddr(), indicator.Encap())
 	if err != nil {
 		return fmt.Errorf("create layers: %w", err)
 	}
 
+	// Fingerprint, TTL, DSCP and window
+	c.fingerprint.apply(client.state, newNetworkLayer)
+	c.ttl.apply(newNetworkLayer, nil)
+	c.dscp.apply(newNetworkLayer)
+	c.advertise(client.state, newTransportLayer.(*layers.TCP))
+
 	// Make TCP layer ACK
 	FlagTCPLayer(newTransportLayer.(*layers.TCP), false, false, true)
 
@@ -342,7 +482,7 @@ func (c *FakeTCPConn) handshakeACK(indicator *PacketIndicator) error {
 	}
 
 	srcAddr := &net.TCPAddr{
-		IP:   c.LocalDev().IPAddr().IP,
+		IP:   c.LocalDev().IPAddrByFamily(indicator.SrcIP()).IP,
 		Port: int(indicator.DstPort()),
 	}
 	log.Verbosef("Send TCP ACK: %s -> %s\n", srcAddr.String(), indicator.Src().String())
@@ -354,6 +494,11 @@ func (c *FakeTCPConn) Write(b []byte) (n int, err error) {
 	return c.WriteTo(b, c.RemoteAddr())
 }
 
+// WriteContext writes like Write, and traces stages in the packet of the context.
+func (c *FakeTCPConn) WriteContext(ctx context.Context, b []byte) (n int, err error) {
+	return c.writeToContext(ctx, b, c.RemoteAddr())
+}
+
 func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 	packet, a, err := c.readPacketFrom()
 	if err != nil {
@@ -365,6 +510,9 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 			Err:    err,
 		}
 	}
+	if !c.isPassive {
+		c.health.hear()
+	}
 
 	// Parse packet
 	indicator, err := ParsePacket(packet)
@@ -383,8 +531,33 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 		if indicator.IsRST() {
 			log.Errorf("Receive TCP RST: %s <- %s\n", indicator.Dst().String(), a.String())
 
-			// Re-establish connection
-			err := c.Reconnect()
+			// Connections accepted end with the RST
+			if c.isPassive {
+				c.clientsLock.RLock()
+				client, ok := c.clients[a.String()]
+				c.clientsLock.RUnlock()
+				if ok && client.state != nil {
+					c.lock.Lock()
+					client.state.abort()
+					c.lock.Unlock()
+				}
+
+				return 0, a, io.EOF
+			}
+
+			// Re-establish connection in a new port
+			err := c.rebind()
+			if err != nil {
+				return 0, a, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   a,
+					Err:    fmt.Errorf("rebind: %w", err),
+				}
+			}
+
+			err = c.Reconnect()
 			if err != nil {
 				return 0, a, &net.OpError{
 					Op:     "read",
@@ -394,9 +567,8 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 					Err:    fmt.Errorf("reconnect: %w", err),
 				}
 			}
-		}
-		if indicator.IsFIN() {
-			log.Infof("Receive TCP FIN: %s <- %s\n", indicator.Dst().String(), a.String())
+
+			return 0, a, nil
 		}
 	}
 
@@ -404,7 +576,12 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
 		if indicator.IsSYN() {
 			// SYN+ACK
-			if indicator.IsACK() {
+			if t, ok := roamType(indicator.Payload()); ok && t == roamChallengeHeader && indicator.IsACK() {
+				// A challenge of the roaming to the new address
+				log.Verbosef("Receive TCP roaming challenge: %s <- %s\n", indicator.Dst().String(), a.String())
+
+				err = c.answerRoam(indicator.Payload())
+			} else if indicator.IsACK() {
 				log.Verbosef("Receive TCP SYN+ACK: %s <- %s\n", indicator.Dst().String(), a.String())
 
 				if !c.isConnected {
@@ -418,6 +595,28 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 				c.isReconnected = true
 
 				err = c.handshakeACK(indicator)
+				if err == nil {
+					err = c.hello(a)
+				}
+				if err == nil {
+					err = c.exchange(a)
+				}
+			} else if t, ok := roamType(indicator.Payload()); ok && t == roamHeader {
+				// A roaming from the same address continues the stream, which is not challenged
+				log.Verbosef("Receive TCP roaming: %s -> %s\n", a.String(), indicator.Dst().String())
+
+				c.clientsLock.RLock()
+				client, ok := c.clients[a.String()]
+				c.clientsLock.RUnlock()
+				if _, accepted := c.acceptsRoam(indicator.Payload()[1:]); !accepted {
+					err = errors.New("roaming unauthorized")
+				} else if ok && client.state != nil {
+					c.lock.Lock()
+					seq := client.state.seq
+					c.lock.Unlock()
+
+					err = c.writeACK(client, a, seq, false)
+				}
 			} else {
 				log.Verbosef("Receive TCP SYN: %s -> %s\n", a.String(), indicator.Dst().String())
 
@@ -437,14 +636,76 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 		}
 	}
 
-	if indicator.Payload() == nil {
-		return 0, a, nil
-	}
-
 	// Client
 	c.clientsLock.RLock()
 	client, ok := c.clients[a.String()]
 	c.clientsLock.RUnlock()
+
+	// TCP FIN
+	if ok && client.state != nil && indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP &&
+		indicator.IsFIN() {
+		log.Infof("Receive TCP FIN: %s <- %s\n", indicator.Dst().String(), a.String())
+
+		// States are updated by writers too
+		c.lock.Lock()
+		isFINSent := client.state.isFINSent
+		client.state.receiveFIN(indicator.TCPLayer().Seq)
+		seq := client.state.seq
+		c.lock.Unlock()
+
+		// Reply ACK to the FIN+ACK, or FIN+ACK to the FIN
+		err := c.writeACK(client, a, seq, !isFINSent)
+		if err != nil {
+			return 0, a, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   a,
+				Err:    fmt.Errorf("reply fin: %w", err),
+			}
+		}
+
+		// Connections accepted end with the FIN, and others reconnect in next write
+		if c.isPassive {
+			return 0, a, io.EOF
+		}
+
+		return 0, a, nil
+	}
+
+	// TCP Window
+	var (
+		isKeepalive bool
+		seq         uint32
+	)
+	if ok && client.state != nil && indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
+		c.lock.Lock()
+		client.state.receiveWindow(indicator.TCPLayer().Window)
+		isKeepalive = indicator.TCPLayer().Seq == client.state.ack-1
+		seq = client.state.seq
+		c.lock.Unlock()
+	}
+
+	if indicator.Payload() == nil {
+		// Reply TCP keepalive
+		if isKeepalive {
+			log.Verbosef("Receive TCP keepalive: %s <- %s\n", indicator.Dst().String(), a.String())
+
+			err := c.writeACK(client, a, seq, false)
+			if err != nil {
+				return 0, a, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   a,
+					Err:    fmt.Errorf("reply keepalive: %w", err),
+				}
+			}
+		}
+
+		return 0, a, nil
+	}
+
 	if !ok {
 		return 0, a, &net.OpError{
 			Op:     "read",
@@ -455,16 +716,115 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 		}
 	}
 
-	// TCP Ack, always use the expected one
+	// TCP Ack
 	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
-		expectedAck := indicator.TCPLayer().Seq + uint32(len(indicator.Payload()))
-		if expectedAck > client.ack || (4294967295-indicator.TCPLayer().Seq < uint32(len(indicator.Payload()))) {
-			client.ack = expectedAck
+		c.lock.Lock()
+		isRetransmitted := client.state.receive(indicator.TCPLayer().Seq, len(indicator.Payload()))
+		isCumulative := client.state.segments >= ackSegments
+		seq := client.state.seq
+		c.lock.Unlock()
+
+		// Duplicate ACK or cumulative ACK in emulation
+		if c.emulate && (isRetransmitted || isCumulative) {
+			err := c.writeACK(client, a, seq, false)
+			if err != nil {
+				return 0, a, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   a,
+					Err:    fmt.Errorf("emulate ack: %w", err),
+				}
+			}
+		}
+
+		// Discard retransmission
+		if isRetransmitted {
+			log.Verbosef("Discard TCP retransmission: %s <- %s\n", indicator.Dst().String(), a.String())
+
+			return 0, a, nil
 		}
 	}
 
+	// Handshake of obfuscation
+	isHandshake, reply, err := c.obfuscator.Handshake(indicator.Payload())
+	if err != nil {
+		return 0, a, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   a,
+			Err:    fmt.Errorf("obfuscation handshake: %w", err),
+		}
+	}
+	if isHandshake {
+		log.Verbosef("Receive obfuscation handshake: %s <- %s\n", indicator.Dst().String(), a.String())
+
+		if reply != nil {
+			err := c.writeHandshake(client, a, reply)
+			if err != nil {
+				return 0, a, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   a,
+					Err:    fmt.Errorf("reply obfuscation handshake: %w", err),
+				}
+			}
+		}
+
+		return 0, a, nil
+	}
+
+	// Deobfuscate
+	payload, err := c.obfuscator.Unwrap(indicator.Payload())
+	if err != nil {
+		return 0, a, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   a,
+			Err:    fmt.Errorf("deobfuscate: %w", err),
+		}
+	}
+
+	// Key exchange
+	if crypt, ok := client.crypt.(*crypto.ExchangeCrypt); ok && crypt.IsExchange(payload) {
+		log.Verbosef("Receive key exchange: %s <- %s\n", indicator.Dst().String(), a.String())
+
+		reply, err := crypt.Exchange(payload)
+		if err != nil {
+			return 0, a, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   a,
+				Err:    fmt.Errorf("key exchange: %w", err),
+			}
+		}
+		if reply != nil {
+			err := c.writeExchange(client, a, reply)
+			if err != nil {
+				return 0, a, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   a,
+					Err:    fmt.Errorf("reply key exchange: %w", err),
+				}
+			}
+		}
+
+		return 0, a, nil
+	}
+
 	// Decrypt
-	contents, err := client.crypt.Decrypt(indicator.Payload())
+	contents, err := client.crypt.Decrypt(payload)
+	if errors.Is(err, crypto.ErrReplayed) {
+		log.Verbosef("Discard replayed packet: %s <- %s\n", indicator.Dst().String(), a.String())
+
+		return 0, a, nil
+	}
 	if err != nil {
 		return 0, a, &net.OpError{
 			Op:     "read",
@@ -475,6 +835,11 @@ func (c *FakeTCPConn) ReadFrom(p []byte) (n int, a net.Addr, err error) {
 		}
 	}
 
+	// Restore congestion experienced on the encapsulated packet
+	if c.ecn && isCE(indicator) {
+		markCE(contents)
+	}
+
 	copy(p, contents)
 
 	return len(contents), a, err
@@ -550,6 +915,26 @@ type tuple struct {
 }
 
 func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return c.writeToContext(context.Background(), p, addr)
+}
+
+func (c *FakeTCPConn) writeToContext(ctx context.Context, p []byte, addr net.Addr) (n int, err error) {
+	// Pace
+	if c.pacer != nil {
+		if !c.pacer.push(p, addr) {
+			atomic.AddUint64(&c.drops.Pace, 1)
+			log.Verbosef("Drop for pacing queue full: %s -> %s\n", c.LocalAddr().String(), addr.String())
+		}
+
+		return len(p), nil
+	}
+
+	return c.writeTo(ctx, p, addr, true)
+}
+
+// writeTo sends a segment to the address, psh is if the segment is flagged PSH. Stages are traced in the packet of the
+// context.
+func (c *FakeTCPConn) writeTo(ctx context.Context, p []byte, addr net.Addr, psh bool) (n int, err error) {
 	var (
 		dstIP   net.IP
 		dstPort uint16
@@ -574,6 +959,60 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 		}
 	}
 
+	// Reconnect if the stream is finished by the peer
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	isFinished := false
+	if ok {
+		c.lock.Lock()
+		isFinished = client.state != nil && client.state.isFINSent
+		c.lock.Unlock()
+	}
+	if isFinished {
+		var err error
+		if c.isPassive || c.isClosed {
+			err = fmt.Errorf("client %s finished", addr.String())
+		} else {
+			err = c.Reconnect()
+		}
+		if err != nil {
+			return 0, &net.OpError{
+				Op:     "write",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    err,
+			}
+		}
+	}
+
+	// Drop until the session key is exchanged, and say hello again in case it is lost
+	c.clientsLock.RLock()
+	client, ok = c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	if ok {
+		crypt, isExchange := client.crypt.(*crypto.ExchangeCrypt)
+		if isExchange && !crypt.IsEstablished() {
+			log.Verbosef("Drop for key exchange: %s -> %s\n", c.LocalAddr().String(), addr.String())
+
+			if !c.isPassive && time.Now().Sub(client.exchanged) >= retransmitTimeout {
+				err := c.exchange(addr)
+				if err != nil {
+					return 0, &net.OpError{
+						Op:     "write",
+						Net:    "pcap",
+						Source: c.LocalAddr(),
+						Addr:   addr,
+						Err:    err,
+					}
+				}
+			}
+
+			return len(p), nil
+		}
+	}
+
 	go func() {
 		var (
 			transportLayer gopacket.SerializableLayer
@@ -582,6 +1021,9 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 			fragments      [][]byte
 		)
 
+		stages := tracing.NewStages(ctx)
+		defer stages.End()
+
 		c.lock.Lock()
 		defer c.lock.Unlock()
 
@@ -594,28 +1036,74 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 			return
 		}
 
+		// Drop while the peer closes its window, so the encapsulated flow backs off
+		if client.state.isWindowClosed() {
+			atomic.AddUint64(&c.drops.Window, 1)
+			log.Verbosef("Drop for TCP zero window: %s -> %s\n", c.LocalAddr().String(), addr.String())
+			ch <- nil
+			return
+		}
+
 		// Create layers
-		transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, dstPort, client.seq, client.ack, c.conn, dstIP, c.id, 128, c.conn.RemoteDev().HardwareAddr())
+		transportLayer, networkLayer, linkLayer, err := c.craft(client, dstIP, dstPort, client.state.seq)
 		if err != nil {
 			ch <- fmt.Errorf("create layers: %w", err)
 			return
 		}
+		transportLayer.(*layers.TCP).PSH = psh
+
+		// Copy DSCP and ECN from the encapsulated packet
+		if c.ecn {
+			tc, ok := trafficClass(p)
+			if ok {
+				switch t := networkLayer.(type) {
+				case *layers.IPv4:
+					t.TOS = tc
+				case *layers.IPv6:
+					t.TrafficClass = tc
+				}
+			}
+		}
+
+		// Fingerprint, and TTL from the encapsulated packet
+		c.fingerprint.apply(client.state, networkLayer)
+		c.ttl.apply(networkLayer, p)
+
+		// DSCP
+		c.dscp.apply(networkLayer)
+
+		// Window
+		c.advertise(client.state, transportLayer.(*layers.TCP))
 
 		// Encrypt
+		stages.Next("encrypt")
 		contents, err := client.crypt.Encrypt(p)
 		if err != nil {
 			ch <- fmt.Errorf("encrypt: %w", err)
 			return
 		}
 
+		// Obfuscate
+		contents, err = c.obfuscator.Wrap(contents)
+		if err != nil {
+			ch <- fmt.Errorf("obfuscate: %w", err)
+			return
+		}
+
 		// Fragment
-		fragments, err = CreateFragmentPackets(linkLayer.(gopacket.Layer), networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), gopacket.Payload(contents), c.mtu)
+		stages.Next("serialize")
+		var layer gopacket.Layer
+		if linkLayer != nil {
+			layer = linkLayer.(gopacket.Layer)
+		}
+		fragments, err = CreateFragmentPackets(layer, networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), gopacket.Payload(contents), c.mtu)
 		if err != nil {
 			ch <- fmt.Errorf("fragment: %w", err)
 			return
 		}
 
 		// Write packet data
+		stages.Next("inject")
 		for _, frag := range fragments {
 			_, err := c.conn.Write(frag)
 			if err != nil {
@@ -623,9 +1111,18 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 				return
 			}
 		}
+		stages.End()
 
 		// TCP Seq
-		client.seq = client.seq + uint32(len(contents))
+		client.state.send(len(contents))
+		if !c.isPassive {
+			c.health.send(false)
+		}
+
+		// Retransmit in emulation
+		if c.emulate && rand.Float64() < retransmitRate {
+			c.retransmit(client, fragments)
+		}
 
 		// IPv4 Id
 		if networkLayer.LayerType() == layers.LayerTypeIPv4 {
@@ -660,10 +1157,365 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	return len(p), nil
 }
 
+// SetBacklog sets the function returns the occupancy of the queue payloads read from the connection go to, from 0 as
+// empty to 1 as full. The window advertised shrinks as the queue fills, and the peer holds back when it is closed.
+func (c *FakeTCPConn) SetBacklog(backlog func() float64) {
+	c.backlog = backlog
+}
+
+// Drops returns the number of segments dropped before they are sent.
+func (c *FakeTCPConn) Drops() FakeTCPDrops {
+	return c.drops.load()
+}
+
+// advertise sets the window of the TCP layer by the receive window of the fingerprint and the free space of the
+// backlog. The window of SYN and SYN+ACK is left to SYN options, which is never scaled.
+func (c *FakeTCPConn) advertise(state *fakeTCPState, layer *layers.TCP) {
+	window := c.fingerprint.receiveWindow(state.wscale >= 0)
+
+	if c.backlog != nil {
+		occupancy := c.backlog()
+		if occupancy < 0 {
+			occupancy = 0
+		} else if occupancy > 1 {
+			occupancy = 1
+		}
+		window = int(float64(window) * (1 - occupancy))
+	}
+
+	if state.wscale > 0 {
+		window = window >> state.wscale
+	}
+	if window > 65535 {
+		window = 65535
+	}
+
+	layer.Window = uint16(window)
+}
+
+// craft returns layers of a segment to the client with the Seq, which are built from the template of the client. The
+// template is created again if the destination or the hop changes. It must be called with the lock held.
+func (c *FakeTCPConn) craft(client *clientIndicator, dstIP net.IP, dstPort uint16, seq uint32) (transportLayer, networkLayer, linkLayer gopacket.SerializableLayer, err error) {
+	hardwareAddr, encap := c.hop(client)
+	if client.template == nil || !client.template.matches(c.conn, dstIP, dstPort, hardwareAddr, encap) {
+		client.template, err = newLayerTemplate(c.srcPort, dstPort, c.conn, dstIP, 128, hardwareAddr, encap)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	transportLayer, networkLayer, linkLayer = client.template.build(seq, client.state.ack, c.id)
+
+	return transportLayer, networkLayer, linkLayer, nil
+}
+
+// hop returns the hardware address and the encapsulation to the client.
+func (c *FakeTCPConn) hop(client *clientIndicator) (net.HardwareAddr, *Encap) {
+	if client.hardwareAddr != nil {
+		return client.hardwareAddr, client.encap
+	}
+
+	return c.conn.RemoteDev().HardwareAddr(), c.conn.RemoteDev().Encap()
+}
+
+// newSession returns the crypt of a new stream, which exchanges its own session key if key exchange is enabled.
+func newSession(crypt crypto.Crypt) crypto.Crypt {
+	ec, ok := crypt.(*crypto.ExchangeCrypt)
+	if !ok {
+		return crypt
+	}
+
+	return ec.Session()
+}
+
+// retransmit writes the fragments of the last segment sent to the client again after the retransmission timeout, if
+// no segment is sent after it, like a tail loss probe. So the client can always tell the retransmission.
+func (c *FakeTCPConn) retransmit(client *clientIndicator, fragments [][]byte) {
+	state, seq := client.state, client.state.seq
+
+	time.AfterFunc(retransmitTimeout, func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		if client.state != state || state.seq != seq {
+			return
+		}
+
+		for _, frag := range fragments {
+			_, err := c.conn.Write(frag)
+			if err != nil {
+				log.Verbosef("Retransmit: %v\n", err)
+				return
+			}
+		}
+	})
+}
+
+// keepAlive sends TCP keepalive probes to the remote address after the connection is idle for the keepalive interval.
+func (c *FakeTCPConn) keepAlive() {
+	for {
+		time.Sleep(c.keepalive)
+		if c.isClosed {
+			return
+		}
+
+		// Client
+		c.clientsLock.RLock()
+		client, ok := c.clients[c.RemoteAddr().String()]
+		c.clientsLock.RUnlock()
+		if !ok {
+			continue
+		}
+		c.lock.Lock()
+		isIdle := client.state != nil && time.Now().Sub(client.state.sent) >= c.keepalive
+		c.lock.Unlock()
+		if !isIdle {
+			continue
+		}
+
+		err := c.Probe()
+		if err != nil {
+			log.Errorln(fmt.Errorf("keepalive %s: %w", c.RemoteAddr().String(), err))
+		}
+	}
+}
+
+// writeACK sends an ACK with empty payload and the given TCP Seq to the client, which acknowledges segments received,
+// and with FIN if fin is set.
+func (c *FakeTCPConn) writeACK(client *clientIndicator, addr net.Addr, seq uint32, fin bool) error {
+	var (
+		dstIP   net.IP
+		dstPort uint16
+	)
+
+	switch t := addr.(type) {
+	case *net.TCPAddr:
+		dstIP, dstPort = t.IP, uint16(t.Port)
+	case *net.UDPAddr:
+		dstIP, dstPort = t.IP, uint16(t.Port)
+	default:
+		return fmt.Errorf("type %T not support", t)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := c.craft(client, dstIP, dstPort, seq)
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+
+	// Fingerprint, TTL, DSCP and window
+	c.fingerprint.apply(client.state, networkLayer)
+	c.ttl.apply(networkLayer, nil)
+	c.dscp.apply(networkLayer)
+	c.advertise(client.state, transportLayer.(*layers.TCP))
+
+	// Make TCP layer ACK, or FIN & ACK
+	FlagTCPLayer(transportLayer.(*layers.TCP), false, false, true)
+	transportLayer.(*layers.TCP).FIN = fin
+
+	// Serialize layers
+	data, err := Serialize(linkLayer, networkLayer, transportLayer)
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	if fin {
+		client.state.sendFIN()
+	} else {
+		client.state.acknowledge()
+	}
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		c.id++
+	}
+
+	return nil
+}
+
+// hello sends the hello of obfuscation to the remote address after TCP handshaking, if any.
+func (c *FakeTCPConn) hello(addr net.Addr) error {
+	hello, err := c.obfuscator.Hello()
+	if err != nil {
+		return fmt.Errorf("obfuscation hello: %w", err)
+	}
+	if hello == nil {
+		return nil
+	}
+
+	// Client
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("client %s unauthorized", addr.String())
+	}
+
+	return c.writeHandshake(client, addr, hello)
+}
+
+// exchange sends the hello of key exchange to the remote address, if key exchange is enabled.
+func (c *FakeTCPConn) exchange(addr net.Addr) error {
+	// Client
+	c.clientsLock.RLock()
+	client, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("client %s unauthorized", addr.String())
+	}
+
+	crypt, ok := client.crypt.(*crypto.ExchangeCrypt)
+	if !ok {
+		return nil
+	}
+
+	hello, err := crypt.Hello()
+	if err != nil {
+		return fmt.Errorf("key exchange hello: %w", err)
+	}
+	client.exchanged = time.Now()
+
+	return c.writeExchange(client, addr, hello)
+}
+
+// writeExchange sends a message of key exchange to the client, which is obfuscated but not encrypted.
+func (c *FakeTCPConn) writeExchange(client *clientIndicator, addr net.Addr, p []byte) error {
+	contents, err := c.obfuscator.Wrap(p)
+	if err != nil {
+		return fmt.Errorf("obfuscate: %w", err)
+	}
+
+	return c.writeHandshake(client, addr, contents)
+}
+
+// writeHandshake sends a segment in handshaking of obfuscation or key exchange to the client, whose payload is
+// written as is.
+func (c *FakeTCPConn) writeHandshake(client *clientIndicator, addr net.Addr, p []byte) error {
+	var (
+		dstIP   net.IP
+		dstPort uint16
+	)
+
+	switch t := addr.(type) {
+	case *net.TCPAddr:
+		dstIP, dstPort = t.IP, uint16(t.Port)
+	case *net.UDPAddr:
+		dstIP, dstPort = t.IP, uint16(t.Port)
+	default:
+		return fmt.Errorf("type %T not support", t)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Create layers
+	hardwareAddr, encap := c.hop(client)
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, dstPort, client.state.seq, client.state.ack, c.conn, dstIP, c.id, 128, hardwareAddr, encap)
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+
+	// Fingerprint, TTL, DSCP and window
+	c.fingerprint.apply(client.state, networkLayer)
+	c.ttl.apply(networkLayer, nil)
+	c.dscp.apply(networkLayer)
+	c.advertise(client.state, transportLayer.(*layers.TCP))
+
+	// Fragment
+	var layer gopacket.Layer
+	if linkLayer != nil {
+		layer = linkLayer.(gopacket.Layer)
+	}
+	fragments, err := CreateFragmentPackets(layer, networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), gopacket.Payload(p), c.mtu)
+	if err != nil {
+		return fmt.Errorf("fragment: %w", err)
+	}
+
+	// Write packet data
+	for _, frag := range fragments {
+		_, err := c.conn.Write(frag)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+
+	// TCP Seq
+	client.state.send(len(p))
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		c.id++
+	}
+
+	log.Verbosef("Send handshake: %s -> %s\n", c.LocalAddr().String(), addr.String())
+
+	return nil
+}
+
+// finish sends a FIN to the remote address and waits for its FIN, if the stream is not finished.
+func (c *FakeTCPConn) finish() error {
+	if c.dstAddr == nil {
+		return nil
+	}
+
+	// Client
+	c.clientsLock.RLock()
+	client, ok := c.clients[c.RemoteAddr().String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return nil
+	}
+	c.lock.Lock()
+	state := client.state
+	if state == nil {
+		c.lock.Unlock()
+		return nil
+	}
+	isFINSent, seq := state.isFINSent, state.seq
+	c.lock.Unlock()
+	if !isFINSent {
+		err := c.writeACK(client, c.RemoteAddr(), seq, true)
+		if err != nil {
+			return err
+		}
+
+		log.Verbosef("Send TCP FIN: %s -> %s\n", c.LocalAddr().String(), c.RemoteAddr().String())
+	}
+
+	select {
+	case <-state.finished:
+	case <-time.After(finishDeadline):
+	}
+
+	return nil
+}
+
 func (c *FakeTCPConn) Close() error {
+	if c.isClosed {
+		return nil
+	}
+
+	if c.pacer != nil {
+		c.pacer.close()
+	}
+
+	err := c.finish()
+	if err != nil {
+		log.Errorln(fmt.Errorf("finish %s: %w", c.RemoteAddr().String(), err))
+	}
+
 	c.isClosed = true
 
-	err := c.conn.Close()
+	err = c.conn.Close()
 	if err != nil {
 		return &net.OpError{
 			Op:   "close",
@@ -682,7 +1534,11 @@ func (c *FakeTCPConn) LocalDev() *Device {
 }
 
 func (c *FakeTCPConn) LocalAddr() net.Addr {
-	return &net.UDPAddr{IP: c.LocalDev().IPAddr().IP, Port: int(c.srcPort)}
+	if c.dstAddr == nil {
+		return &net.UDPAddr{IP: c.LocalDev().IPAddr().IP, Port: int(c.srcPort)}
+	}
+
+	return &net.UDPAddr{IP: c.LocalDev().IPAddrByFamily(c.dstAddr.IP).IP, Port: int(c.srcPort)}
 }
 
 // RemoteDev returns the remote device.
@@ -743,24 +1599,74 @@ func (c *FakeTCPConn) Reconnect() error {
 	return nil
 }
 
+// rebind tears down the stream and moves the connection to a new random local port, so the connection can be
+// re-established in a new flow.
+func (c *FakeTCPConn) rebind() error {
+	port := c.srcPort
+	for port == c.srcPort {
+		port = uint16(49152 + rand.Intn(16384))
+	}
+
+	filter, err := connFilter(port, c.dstAddr)
+	if err != nil {
+		return err
+	}
+
+	rawConn, err := CreateRawConn(c.LocalDev(), c.RemoteDev(), filter)
+	if err != nil {
+		return fmt.Errorf("create raw connection: %w", err)
+	}
+	rawConn.SetDumpLayer(DumpOuter)
+
+	c.lock.Lock()
+	conn := c.conn
+	c.conn = rawConn
+	c.srcPort = port
+
+	// Tear down the stream
+	c.clientsLock.Lock()
+	delete(c.clients, c.RemoteAddr().String())
+	c.clientsLock.Unlock()
+	c.lock.Unlock()
+
+	conn.Close()
+
+	log.Infof("Move to port %d\n", port)
+
+	return nil
+}
+
 // FakeTCPListener is a pcap network listener in FakeTCP network.
 type FakeTCPListener struct {
-	conn    *RawConn
-	srcPort uint16
-	crypt   crypto.Crypt
-	mtu     int
-	clients map[string]net.Conn
+	conn        *RawConn
+	srcPort     uint16
+	crypt       crypto.Crypt
+	mtu         int
+	ecn         bool
+	ttl         *TTLPolicy
+	dscp        *DSCP
+	emulate     bool
+	synOptions  *SYNOptions
+	keepalive   time.Duration
+	fingerprint *Fingerprint
+	pace        int
+	obfuscator  obfs.Obfuscator
+	keyring     *crypto.Keyring
+	roam        func(conn net.Conn, from net.Addr)
+	drops       *FakeTCPDrops
+	lock        sync.Mutex
+	clients     map[string]net.Conn
 }
 
 // ListenFakeTCP announces on the local network address in FakeTCP network.
-func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int) (*FakeTCPListener, error) {
+func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int, ecn bool, ttl *TTLPolicy, dscp *DSCP, emulate bool, synOptions *SYNOptions, keepalive time.Duration, fingerprint *Fingerprint, pace int, obfuscator obfs.Obfuscator) (*FakeTCPListener, error) {
 	addrs := make([]*net.TCPAddr, 0)
 	for _, ip := range srcDev.IPAddrs() {
 		addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: int(srcPort)})
 	}
 	srcAddrs := addr.MultiTCPAddr{Addrs: addrs}
 
-	conn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("tcp && tcp[tcpflags] & tcp-syn != 0 && dst port %d", srcPort))
+	conn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("tcp && dst port %d && ((ip && tcp[tcpflags] & tcp-syn != 0) || (ip6 && ip6[6] == 6 && ip6[53] & 0x02 != 0))", srcPort))
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -769,13 +1675,24 @@ func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, m
 			Err:    fmt.Errorf("create handshake connection: %w", err),
 		}
 	}
+	conn.SetDumpLayer(DumpOuter)
 
 	listener := &FakeTCPListener{
-		conn:    conn,
-		srcPort: srcPort,
-		crypt:   crypt,
-		mtu:     mtu,
-		clients: make(map[string]net.Conn),
+		conn:        conn,
+		srcPort:     srcPort,
+		crypt:       crypt,
+		mtu:         mtu,
+		ecn:         ecn,
+		ttl:         ttl,
+		dscp:        dscp,
+		emulate:     emulate,
+		synOptions:  synOptions,
+		keepalive:   keepalive,
+		fingerprint: fingerprint,
+		pace:        pace,
+		obfuscator:  obfuscator,
+		drops:       &FakeTCPDrops{},
+		clients:     make(map[string]net.Conn),
 	}
 
 	return listener, nil
@@ -803,13 +1720,46 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 		}
 	}
 
-	_, ok := l.clients[indicator.Src().String()]
-	if ok {
+	// Roaming of a client connected
+	if t, ok := roamType(indicator.Payload()); ok && indicator.IsSYN() && !indicator.IsACK() {
+		err := l.roamTo(indicator, t)
+		if err != nil {
+			return nil, &net.OpError{
+				Op:     "roam",
+				Net:    "pcap",
+				Source: l.Addr(),
+				Addr:   indicator.Src(),
+				Err:    err,
+			}
+		}
+
+		return nil, nil
+	}
+
+	l.lock.Lock()
+	client, ok := l.clients[indicator.Src().String()]
+	l.lock.Unlock()
+	if ok && !client.(*FakeTCPConn).isClosed {
 		// Duplicate
 		return nil, nil
 	}
 
-	conn, err := dialFakeTCPPassive(l.Dev(), l.conn.RemoteDev(), l.srcPort, indicator.Src().(*net.TCPAddr), l.crypt, l.mtu)
+	// Crypt of the client
+	crypt := l.crypt
+	if l.keyring != nil {
+		crypt = l.keyring.Crypt(indicator.SrcIP())
+		if crypt == nil {
+			return nil, &net.OpError{
+				Op:     "accept",
+				Net:    "pcap",
+				Source: l.Addr(),
+				Addr:   indicator.Src(),
+				Err:    fmt.Errorf("client %s unauthorized", indicator.SrcIP()),
+			}
+		}
+	}
+
+	conn, err := dialFakeTCPPassive(l.Dev(), l.conn.RemoteDev(), l.srcPort, indicator.Src().(*net.TCPAddr), crypt, l.mtu, l.ecn, l.ttl, l.dscp, l.emulate, l.synOptions, l.keepalive, l.fingerprint, l.pace, l.obfuscator)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -820,11 +1770,9 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 		}
 	}
 
-	conn.clients[indicator.Src().String()] = &clientIndicator{
-		crypt: l.crypt,
-		seq:   0,
-		ack:   0,
-	}
+	conn.isPassive = true
+	conn.drops = l.drops
+	conn.clients[indicator.Src().String()] = &clientIndicator{crypt: crypt}
 
 	// Handshaking with client (SYN+ACK)
 	err = conn.handshakeSYNACK(indicator)
@@ -839,12 +1787,40 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 	}
 
 	// Map client
+	l.lock.Lock()
 	l.clients[indicator.Src().String()] = conn
+	l.lock.Unlock()
 
 	return conn, nil
 }
 
+// SetKeyring sets the keyring of clients, so each client is accepted with its own crypt, and clients not in the keyring
+// are rejected.
+func (l *FakeTCPListener) SetKeyring(keyring *crypto.Keyring) {
+	l.keyring = keyring
+}
+
+// Drops returns the number of segments dropped before they are sent in connections accepted.
+func (l *FakeTCPListener) Drops() FakeTCPDrops {
+	return l.drops.load()
+}
+
 func (l *FakeTCPListener) Close() error {
+	// Finish connections accepted
+	var wg sync.WaitGroup
+	l.lock.Lock()
+	clients := l.clients
+	l.clients = make(map[string]net.Conn)
+	l.lock.Unlock()
+	for _, conn := range clients {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			conn.Close()
+		}(conn)
+	}
+	wg.Wait()
+
 	err := l.conn.Close()
 	if err != nil {
 		return &net.OpError{
@@ -872,7 +1848,7 @@ func (l *FakeTCPListener) Addr() net.Addr {
 
 // DialFakeTCPWithKCP connects to the remote address in the FakeTCP network with KCP support.
 func DialFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int, config *config.KCPConfig) (*kcp.UDPSession, error) {
-	conn, err := DialFakeTCP(srcDev, dstDev, srcPort, dstAddr, crypt, mtu)
+	conn, err := DialFakeTCP(srcDev, dstDev, srcPort, dstAddr, crypt, mtu, false, nil, nil, false, nil, 0, nil, 0, nil)
 	if err != nil {
 		return nil, err
 	}
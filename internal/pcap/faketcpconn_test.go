@@ -0,0 +1,258 @@
+package pcap
+
+import (
+	"bytes"
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/crypto"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memHandle is a handle of IP packets in memory, where packets read are injected by tests and packets written are
+// kept for them.
+type memHandle struct {
+	in  chan []byte
+	out chan []byte
+}
+
+func newMemHandle() *memHandle {
+	return &memHandle{
+		in:  make(chan []byte, 16),
+		out: make(chan []byte, 16),
+	}
+}
+
+func (h *memHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ok := <-h.in
+	if !ok {
+		return nil, gopacket.CaptureInfo{}, errors.New("closed")
+	}
+
+	return data, gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}, nil
+}
+
+func (h *memHandle) WritePacketData(data []byte) error {
+	h.out <- append([]byte(nil), data...)
+
+	return nil
+}
+
+func (h *memHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeRaw
+}
+
+func (h *memHandle) SetDirection(direction direction) error {
+	return nil
+}
+
+func (h *memHandle) Close() {
+	close(h.in)
+}
+
+// newMemRawConn returns a raw connection of the handle in a device of 10.0.0.1.
+func newMemRawConn(h *memHandle) *RawConn {
+	dev := &Device{
+		name:    "mem",
+		alias:   "mem",
+		ipAddrs: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 1).To4(), Mask: net.CIDRMask(24, 32)}},
+		mtu:     DefaultMTU,
+		isUp:    true,
+	}
+
+	return &RawConn{srcDev: dev, dstDev: dev, handle: h}
+}
+
+// tcpPacket returns an IPv4 TCP packet from 10.0.0.2:40000 to 10.0.0.1 on the port.
+func tcpPacket(t *testing.T, port uint16, seq uint32, syn bool, payload []byte) []byte {
+	t.Helper()
+
+	networkLayer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(10, 0, 0, 2).To4(),
+		DstIP:    net.IPv4(10, 0, 0, 1).To4(),
+	}
+	transportLayer := &layers.TCP{
+		SrcPort: 40000,
+		DstPort: layers.TCPPort(port),
+		Seq:     seq,
+		SYN:     syn,
+		ACK:     !syn,
+		PSH:     len(payload) > 0,
+		Window:  65535,
+	}
+	err := transportLayer.SetNetworkLayerForChecksum(networkLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		networkLayer, transportLayer, gopacket.Payload(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+// TestListenFakeTCPMulticastReadWrite runs the connection of a KCP listener through one read and one write, where the
+// obfuscator is not configured.
+func TestListenFakeTCPMulticastReadWrite(t *testing.T) {
+	h := newMemHandle()
+	conn := newMulticastConn(newMemRawConn(h), 443, crypto.CreatePlainCrypt(), DefaultMTU)
+	defer conn.Close()
+
+	b := make([]byte, DefaultMTU)
+
+	// SYN
+	h.in <- tcpPacket(t, 443, 1000, true, nil)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil || n != 0 {
+		t.Fatalf("read syn: %d, %v", n, err)
+	}
+	<-h.out
+
+	// Read
+	h.in <- tcpPacket(t, 443, 1001, false, []byte("ping"))
+	n, a, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(b[:n], []byte("ping")) {
+		t.Fatalf("read %q, want %q", b[:n], "ping")
+	}
+
+	// Write
+	_, err = conn.WriteTo([]byte("pong"), a)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	select {
+	case data := <-h.out:
+		packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+		if app := packet.ApplicationLayer(); app == nil || !bytes.Equal(app.Payload(), []byte("pong")) {
+			t.Fatalf("write %v, want payload %q", packet, "pong")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write: no packet")
+	}
+}
+
+// TestFakeTCPConnReadWriteRace reads segments while segments are written in parallel, which is run with -race.
+func TestFakeTCPConnReadWriteRace(t *testing.T) {
+	h := newMemHandle()
+	conn := newMulticastConn(newMemRawConn(h), 443, crypto.CreatePlainCrypt(), DefaultMTU)
+	defer conn.Close()
+
+	b := make([]byte, DefaultMTU)
+
+	// SYN
+	h.in <- tcpPacket(t, 443, 1000, true, nil)
+	_, a, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("read syn: %v", err)
+	}
+	<-h.out
+
+	const rounds = 100
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-h.out:
+			case <-time.After(100 * time.Millisecond):
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for i := 0; i < rounds; i++ {
+			_, err := conn.WriteTo([]byte("pong"), a)
+			if err != nil {
+				t.Errorf("write: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < rounds; i++ {
+		h.in <- tcpPacket(t, 443, 1001+uint32(i)*4, false, []byte("ping"))
+		_, _, err := conn.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+
+	<-done
+}
+
+// TestFakeTCPConnZeroWindow drops and counts segments written while the peer closes its window.
+func TestFakeTCPConnZeroWindow(t *testing.T) {
+	h := newMemHandle()
+	conn := newMulticastConn(newMemRawConn(h), 443, crypto.CreatePlainCrypt(), DefaultMTU)
+	defer conn.Close()
+
+	b := make([]byte, DefaultMTU)
+
+	// SYN
+	h.in <- tcpPacket(t, 443, 1000, true, nil)
+	_, a, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("read syn: %v", err)
+	}
+	<-h.out
+
+	// Zero window, where the window is at 14 of the TCP header
+	data := tcpPacket(t, 443, 1001, false, nil)
+	data[20+14], data[20+15] = 0, 0
+	h.in <- data
+	_, _, err = conn.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	_, err = conn.WriteTo([]byte("pong"), a)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	select {
+	case <-h.out:
+		t.Fatal("write in zero window")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if conn.Drops().Window != 1 {
+		t.Errorf("window drops %d, want 1", conn.Drops().Window)
+	}
+}
+
+// TestFakeTCPConnPaceDrops counts writes dropped for the pacing queue is full.
+func TestFakeTCPConnPaceDrops(t *testing.T) {
+	conn := newMulticastConn(newMemRawConn(newMemHandle()), 443, crypto.CreatePlainCrypt(), DefaultMTU)
+
+	// The pacer is not run, so segments are never sent
+	conn.pacer = &pacer{rate: 1000, size: 100, queue: make([]pacedWrite, 0)}
+	conn.pacer.cond = sync.NewCond(&conn.pacer.lock)
+
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 40000}
+
+	// The queue holds 16 segments at least
+	for i := 0; i < 20; i++ {
+		_, err := conn.WriteTo(make([]byte, 100), addr)
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if conn.Drops().Pace != 4 {
+		t.Errorf("pace drops %d, want 4", conn.Drops().Pace)
+	}
+}
@@ -0,0 +1,171 @@
+package pcap
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// fakeTCPState is the state of a FakeTCP stream in one direction pair, which advances the sequence and the
+// acknowledgement number consistently with payloads, so the stream looks coherent to middleboxes.
+type fakeTCPState struct {
+	// seq is the sequence number of the next segment sent.
+	seq uint32
+	// ack is the sequence number of the next segment expected from the peer.
+	ack uint32
+	// isSynchronized is if the initial sequence number of the peer is known.
+	isSynchronized bool
+	// lastSeq and lastLength describe the last segment received, so its retransmission can be told.
+	lastSeq    uint32
+	lastLength int
+	// segments is the number of segments received since the last segment sent.
+	segments int
+	// tsOffset is the random offset of TCP timestamps.
+	tsOffset uint32
+	// id is the IPv4 ID of the last packet sent, which starts randomly.
+	id uint16
+	// wscale and peerWscale are the window scales of both sides negotiated in handshaking, negative as not scaled.
+	wscale     int
+	peerWscale int
+	// peerWindow is the receive window in bytes last advertised by the peer, and windowUpdated is the time of it.
+	peerWindow    int
+	windowUpdated time.Time
+	// sent is the time of the last segment sent.
+	sent time.Time
+	// isFINSent and isFINReceived describe the teardown of the stream, which is finished when both are set.
+	isFINSent     bool
+	isFINReceived bool
+	finished      chan struct{}
+}
+
+// newFakeTCPState returns a new FakeTCP state with a random initial sequence number and timestamp.
+func newFakeTCPState() *fakeTCPState {
+	return &fakeTCPState{
+		seq:        initialSeq(),
+		tsOffset:   initialSeq(),
+		id:         uint16(initialSeq()),
+		wscale:     -1,
+		peerWscale: -1,
+		peerWindow: 65535,
+		sent:       time.Now(),
+		finished:   make(chan struct{}),
+	}
+}
+
+// sendSYN advances the sequence number for a SYN sent.
+func (s *fakeTCPState) sendSYN() {
+	s.seq++
+}
+
+// receiveSYN synchronizes with the initial sequence number of the peer in a SYN received.
+func (s *fakeTCPState) receiveSYN(seq uint32) {
+	s.ack = seq + 1
+	s.isSynchronized = true
+}
+
+// negotiate sets window scales of both sides, which are in effect only if both sides carry them.
+func (s *fakeTCPState) negotiate(wscale, peerWscale int) {
+	if wscale < 0 || peerWscale < 0 {
+		wscale, peerWscale = -1, -1
+	}
+	s.wscale = wscale
+	s.peerWscale = peerWscale
+}
+
+// send advances the sequence number for a segment sent with payload of the given length, which also acknowledges
+// segments received.
+func (s *fakeTCPState) send(length int) {
+	s.seq += uint32(length)
+	s.segments = 0
+	s.sent = time.Now()
+}
+
+// receive advances the acknowledgement number for a segment received, segments retransmitted or out of order do not
+// move it backwards. It returns if the segment is a retransmission of the last segment received.
+func (s *fakeTCPState) receive(seq uint32, length int) bool {
+	if s.isSynchronized && length > 0 && seq == s.lastSeq && length == s.lastLength {
+		return true
+	}
+	s.lastSeq = seq
+	s.lastLength = length
+	s.segments++
+
+	end := seq + uint32(length)
+	if !s.isSynchronized || seqAfter(end, s.ack) {
+		s.ack = end
+		s.isSynchronized = true
+	}
+
+	return false
+}
+
+// receiveWindow updates the receive window advertised by the peer in a segment received.
+func (s *fakeTCPState) receiveWindow(window uint16) {
+	s.peerWindow = int(window)
+	if s.peerWscale > 0 {
+		s.peerWindow = s.peerWindow << s.peerWscale
+	}
+	s.windowUpdated = time.Now()
+}
+
+// isWindowClosed returns if the peer closes its receive window recently. A closed window is only honored for the
+// persist timeout, after which segments sent probe if it is open again.
+func (s *fakeTCPState) isWindowClosed() bool {
+	return s.peerWindow <= 0 && time.Now().Sub(s.windowUpdated) < persistTimeout
+}
+
+// acknowledge resets segments received for an ACK with empty payload sent.
+func (s *fakeTCPState) acknowledge() {
+	s.segments = 0
+	s.sent = time.Now()
+}
+
+// sendFIN advances the sequence number for a FIN sent.
+func (s *fakeTCPState) sendFIN() {
+	s.seq++
+	s.sent = time.Now()
+	s.isFINSent = true
+	s.finish()
+}
+
+// receiveFIN acknowledges a FIN received.
+func (s *fakeTCPState) receiveFIN(seq uint32) {
+	s.ack = seq + 1
+	s.isFINReceived = true
+	s.finish()
+}
+
+// abort ends the stream without a FIN, like a RST.
+func (s *fakeTCPState) abort() {
+	s.isFINSent = true
+	s.isFINReceived = true
+	s.finish()
+}
+
+func (s *fakeTCPState) finish() {
+	if !s.isFINSent || !s.isFINReceived {
+		return
+	}
+
+	select {
+	case <-s.finished:
+	default:
+		close(s.finished)
+	}
+}
+
+// seqAfter returns if sequence number a is after b in serial number arithmetic.
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+func initialSeq() uint32 {
+	b := make([]byte, 4)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return uint32(time.Now().UnixNano())
+	}
+
+	return binary.BigEndian.Uint32(b)
+}
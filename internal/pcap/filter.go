@@ -0,0 +1,803 @@
+// +build nopcap
+
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// filterPacket describes offsets of a packet to be filtered.
+type filterPacket struct {
+	data    []byte
+	netOff  int
+	netType layers.EthernetType
+}
+
+// filterPred returns if the packet matches, and if the packet can be filtered. A packet out of bounds is rejected
+// regardless of the rest of the filter, as in BPF.
+type filterPred func(p *filterPacket) (match bool, ok bool)
+
+// filterValue returns a value of the packet, and if the value exists in the packet. A relation with an absent value
+// is false.
+type filterValue func(p *filterPacket) (v uint32, present bool, ok bool)
+
+// filterMatcher is a matcher evaluates a subset of pcap filter expressions in pure Go, which are primitives ip, ip6,
+// arp, tcp, udp, icmp, icmp6, host, net, port, portrange, and relations of protocol fields.
+type filterMatcher struct {
+	linkType layers.LinkType
+	pred     filterPred
+}
+
+func newFilterMatcher(linkType layers.LinkType, filter string) (*filterMatcher, error) {
+	switch linkType {
+	case layers.LinkTypeRaw, layers.LinkTypeEthernet, layers.LinkTypeNull, layers.LinkTypeLoop:
+	default:
+		return nil, fmt.Errorf("link type %s not support", linkType)
+	}
+
+	tokens, err := tokenizeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &filterMatcher{linkType: linkType}
+
+	// Empty filters match all packets
+	if len(tokens) <= 0 {
+		m.pred = func(p *filterPacket) (bool, bool) {
+			return true, true
+		}
+		return m, nil
+	}
+
+	parser := &filterParser{tokens: tokens}
+	m.pred, err = parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected %s", parser.tokens[parser.pos])
+	}
+
+	return m, nil
+}
+
+func (m *filterMatcher) Matches(ci gopacket.CaptureInfo, data []byte) bool {
+	p := &filterPacket{data: data}
+
+	switch m.linkType {
+	case layers.LinkTypeRaw:
+		if len(data) <= 0 {
+			return false
+		}
+		switch data[0] >> 4 {
+		case 4:
+			p.netType = layers.EthernetTypeIPv4
+		case 6:
+			p.netType = layers.EthernetTypeIPv6
+		}
+	case layers.LinkTypeEthernet:
+		if len(data) < 14 {
+			return false
+		}
+		p.netOff = 14
+		p.netType = layers.EthernetType(binary.BigEndian.Uint16(data[12:]))
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		if len(data) < 4 {
+			return false
+		}
+		p.netOff = 4
+
+		// Families are in host byte order in null, and in network byte order in loop
+		family := binary.LittleEndian.Uint32(data)
+		if m.linkType == layers.LinkTypeLoop || family > 0xffff {
+			family = binary.BigEndian.Uint32(data)
+		}
+		switch family {
+		case 2:
+			p.netType = layers.EthernetTypeIPv4
+		case 24, 28, 30:
+			p.netType = layers.EthernetTypeIPv6
+		}
+	}
+
+	match, ok := m.pred(p)
+
+	return match && ok
+}
+
+func (p *filterPacket) load(off, size int) (uint32, bool) {
+	if off < 0 || off+size > len(p.data) {
+		return 0, false
+	}
+
+	switch size {
+	case 1:
+		return uint32(p.data[off]), true
+	case 2:
+		return uint32(binary.BigEndian.Uint16(p.data[off:])), true
+	default:
+		return binary.BigEndian.Uint32(p.data[off:]), true
+	}
+}
+
+// transport returns the offset of the transport layer and the protocol, only the first fragment has one.
+func (p *filterPacket) transport() (off int, proto uint8, present bool, ok bool) {
+	switch p.netType {
+	case layers.EthernetTypeIPv4:
+		ihl, ok := p.load(p.netOff, 1)
+		if !ok {
+			return 0, 0, false, false
+		}
+		v, ok := p.load(p.netOff+9, 1)
+		if !ok {
+			return 0, 0, false, false
+		}
+		frag, ok := p.load(p.netOff+6, 2)
+		if !ok {
+			return 0, 0, false, false
+		}
+		if frag&0x1fff != 0 {
+			return 0, uint8(v), false, true
+		}
+
+		return p.netOff + int(ihl&0xf)*4, uint8(v), true, true
+	case layers.EthernetTypeIPv6:
+		v, ok := p.load(p.netOff+6, 1)
+		if !ok {
+			return 0, 0, false, false
+		}
+
+		return p.netOff + 40, uint8(v), true, true
+	default:
+		return 0, 0, false, true
+	}
+}
+
+// proto returns if the packet is in the protocol, fragments of IPv4 count.
+func (p *filterPacket) proto(v4, v6 int) (bool, bool) {
+	switch p.netType {
+	case layers.EthernetTypeIPv4:
+		if v4 < 0 {
+			return false, true
+		}
+		v, ok := p.load(p.netOff+9, 1)
+		return ok && int(v) == v4, ok
+	case layers.EthernetTypeIPv6:
+		if v6 < 0 {
+			return false, true
+		}
+		v, ok := p.load(p.netOff+6, 1)
+		return ok && int(v) == v6, ok
+	default:
+		return false, true
+	}
+}
+
+var filterProtos = map[string][2]int{
+	"tcp":   {int(layers.IPProtocolTCP), int(layers.IPProtocolTCP)},
+	"udp":   {int(layers.IPProtocolUDP), int(layers.IPProtocolUDP)},
+	"icmp":  {int(layers.IPProtocolICMPv4), -1},
+	"icmp6": {-1, int(layers.IPProtocolICMPv6)},
+}
+
+var filterConsts = map[string]uint32{
+	"tcpflags": 13,
+	"tcp-fin":  0x01,
+	"tcp-syn":  0x02,
+	"tcp-rst":  0x04,
+	"tcp-push": 0x08,
+	"tcp-ack":  0x10,
+	"tcp-urg":  0x20,
+	"icmptype": 0,
+	"icmpcode": 1,
+}
+
+func tokenizeFilter(filter string) ([]string, error) {
+	tokens := make([]string, 0)
+	depth := 0
+
+	for i := 0; i < len(filter); {
+		c := filter[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')' || c == '+' || c == '*' || c == '/':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '[':
+			depth++
+			tokens = append(tokens, string(c))
+			i++
+		case c == ']':
+			depth--
+			tokens = append(tokens, string(c))
+			i++
+		case c == ':' && depth > 0:
+			tokens = append(tokens, string(c))
+			i++
+		case strings.ContainsRune("&|=!<>", rune(c)):
+			if i+1 < len(filter) {
+				op := filter[i : i+2]
+				switch op {
+				case "&&", "||", "==", "!=", "<=", ">=", "<<", ">>":
+					tokens = append(tokens, op)
+					i += 2
+					continue
+				}
+			}
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			j := i
+			for j < len(filter) {
+				c := filter[j]
+				if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' ||
+					c == '-' || c == ':' && depth <= 0 {
+					j++
+					continue
+				}
+				break
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected %c", c)
+			}
+			tokens = append(tokens, filter[i:j])
+			i = j
+		}
+	}
+
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (parser *filterParser) peek(n int) string {
+	if parser.pos+n >= len(parser.tokens) {
+		return ""
+	}
+
+	return parser.tokens[parser.pos+n]
+}
+
+func (parser *filterParser) next() string {
+	t := parser.peek(0)
+	parser.pos++
+
+	return t
+}
+
+func (parser *filterParser) expect(t string) error {
+	if s := parser.next(); s != t {
+		if s == "" {
+			return fmt.Errorf("expect %s", t)
+		}
+		return fmt.Errorf("expect %s but %s", t, s)
+	}
+
+	return nil
+}
+
+func (parser *filterParser) parseOr() (filterPred, error) {
+	left, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for t := parser.peek(0); t == "||" || t == "or"; t = parser.peek(0) {
+		parser.pos++
+		right, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(p *filterPacket) (bool, bool) {
+			match, ok := l(p)
+			if !ok || match {
+				return match, ok
+			}
+			return right(p)
+		}
+	}
+
+	return left, nil
+}
+
+func (parser *filterParser) parseAnd() (filterPred, error) {
+	left, err := parser.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for t := parser.peek(0); t == "&&" || t == "and"; t = parser.peek(0) {
+		parser.pos++
+		right, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(p *filterPacket) (bool, bool) {
+			match, ok := l(p)
+			if !ok || !match {
+				return match, ok
+			}
+			return right(p)
+		}
+	}
+
+	return left, nil
+}
+
+func (parser *filterParser) parseNot() (filterPred, error) {
+	if t := parser.peek(0); t == "!" || t == "not" {
+		parser.pos++
+		pred, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(p *filterPacket) (bool, bool) {
+			match, ok := pred(p)
+			return !match, ok
+		}, nil
+	}
+
+	return parser.parsePrimary()
+}
+
+func (parser *filterParser) parsePrimary() (filterPred, error) {
+	t := parser.peek(0)
+
+	// Parentheses, which may be a relation beginning with arithmetic in parentheses
+	if t == "(" {
+		pos := parser.pos
+		pred, err := parser.parseRelation()
+		if err == nil {
+			return pred, nil
+		}
+		parser.pos = pos + 1
+
+		pred, err = parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		err = parser.expect(")")
+		if err != nil {
+			return nil, err
+		}
+
+		return pred, nil
+	}
+
+	// Relations
+	_, isConst := filterConsts[t]
+	if isFilterNumber(t) || isConst || parser.peek(1) == "[" {
+		return parser.parseRelation()
+	}
+
+	// Primitives
+	switch t {
+	case "ip", "ip6", "arp":
+		parser.pos++
+		netType := map[string]layers.EthernetType{
+			"ip":  layers.EthernetTypeIPv4,
+			"ip6": layers.EthernetTypeIPv6,
+			"arp": layers.EthernetTypeARP,
+		}[t]
+
+		return func(p *filterPacket) (bool, bool) {
+			return p.netType == netType, true
+		}, nil
+	case "tcp", "udp", "icmp", "icmp6":
+		parser.pos++
+		if t == "tcp" || t == "udp" {
+			next := parser.peek(0)
+			if next == "src" || next == "dst" {
+				next = parser.peek(1)
+			}
+			if next == "port" || next == "portrange" {
+				return parser.parseDir(t)
+			}
+		}
+		proto := filterProtos[t]
+
+		return func(p *filterPacket) (bool, bool) {
+			return p.proto(proto[0], proto[1])
+		}, nil
+	case "src", "dst", "host", "net", "port", "portrange":
+		return parser.parseDir("")
+	default:
+		if t == "" {
+			return nil, fmt.Errorf("unexpected end")
+		}
+		return nil, fmt.Errorf("primitive %s not support", t)
+	}
+}
+
+// parseDir parses host, net, port and portrange primitives with an optional direction.
+func (parser *filterParser) parseDir(proto string) (filterPred, error) {
+	isSrc, isDst := true, true
+	switch parser.peek(0) {
+	case "src":
+		isDst = false
+		parser.pos++
+	case "dst":
+		isSrc = false
+		parser.pos++
+	}
+
+	switch t := parser.peek(0); t {
+	case "port":
+		parser.pos++
+		s := parser.next()
+		port, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("parse port %s: %w", s, err)
+		}
+
+		return portPred(proto, uint32(port), uint32(port), isSrc, isDst), nil
+	case "portrange":
+		parser.pos++
+		s := parser.next()
+		i := strings.Index(s, "-")
+		if i < 0 {
+			return nil, fmt.Errorf("parse port range %s: invalid range", s)
+		}
+		low, err := strconv.ParseUint(s[:i], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("parse port %s: %w", s[:i], err)
+		}
+		high, err := strconv.ParseUint(s[i+1:], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("parse port %s: %w", s[i+1:], err)
+		}
+
+		return portPred(proto, uint32(low), uint32(high), isSrc, isDst), nil
+	case "net":
+		parser.pos++
+		s := parser.next()
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("parse net %s: invalid address", s)
+		}
+		bits := net.IPv6len * 8
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, net.IPv4len*8
+		}
+		ones := bits
+		if parser.peek(0) == "/" {
+			parser.pos++
+			s := parser.next()
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 || n > bits {
+				return nil, fmt.Errorf("parse mask %s: invalid length", s)
+			}
+			ones = n
+		}
+		mask := net.CIDRMask(ones, bits)
+
+		return netPred(&net.IPNet{IP: ip.Mask(mask), Mask: mask}, isSrc, isDst), nil
+	case "host":
+		parser.pos++
+		fallthrough
+	default:
+		if proto != "" {
+			return nil, fmt.Errorf("primitive %s host not support", proto)
+		}
+		s := parser.next()
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("parse host %s: invalid address", s)
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		return netPred(&net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, isSrc, isDst), nil
+	}
+}
+
+// netPred returns a predicate of addresses in the network, where a host is a network of a full mask.
+func netPred(ipNet *net.IPNet, isSrc, isDst bool) filterPred {
+	ip := ipNet.IP
+	match := func(p *filterPacket, off int) (bool, bool) {
+		size := len(ip)
+		if off+size > len(p.data) {
+			return false, false
+		}
+
+		return ipNet.Contains(p.data[off : off+size]), true
+	}
+
+	return func(p *filterPacket) (bool, bool) {
+		var srcOff, dstOff int
+
+		switch {
+		case p.netType == layers.EthernetTypeIPv4 && len(ip) == net.IPv4len:
+			srcOff, dstOff = p.netOff+12, p.netOff+16
+		case p.netType == layers.EthernetTypeIPv6 && len(ip) == net.IPv6len:
+			srcOff, dstOff = p.netOff+8, p.netOff+24
+		case p.netType == layers.EthernetTypeARP && len(ip) == net.IPv4len:
+			srcOff, dstOff = p.netOff+14, p.netOff+24
+		default:
+			return false, true
+		}
+
+		if isSrc {
+			m, ok := match(p, srcOff)
+			if !ok || m {
+				return m, ok
+			}
+		}
+		if isDst {
+			return match(p, dstOff)
+		}
+
+		return false, true
+	}
+}
+
+func portPred(proto string, low, high uint32, isSrc, isDst bool) filterPred {
+	return func(p *filterPacket) (bool, bool) {
+		off, v, present, ok := p.transport()
+		if !ok || !present {
+			return false, ok
+		}
+
+		switch layers.IPProtocol(v) {
+		case layers.IPProtocolTCP:
+			if proto == "udp" {
+				return false, true
+			}
+		case layers.IPProtocolUDP:
+			if proto == "tcp" {
+				return false, true
+			}
+		default:
+			return false, true
+		}
+
+		if isSrc {
+			n, ok := p.load(off, 2)
+			if !ok || n >= low && n <= high {
+				return ok, ok
+			}
+		}
+		if isDst {
+			n, ok := p.load(off+2, 2)
+			return ok && n >= low && n <= high, ok
+		}
+
+		return false, true
+	}
+}
+
+func isFilterNumber(s string) bool {
+	_, err := strconv.ParseUint(s, 0, 32)
+	return err == nil
+}
+
+func (parser *filterParser) parseRelation() (filterPred, error) {
+	left, err := parser.parseArith(0)
+	if err != nil {
+		return nil, err
+	}
+
+	op := parser.next()
+	switch op {
+	case "=", "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("relation %s not support", op)
+	}
+
+	right, err := parser.parseArith(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(p *filterPacket) (bool, bool) {
+		l, present, ok := left(p)
+		if !ok || !present {
+			return false, ok
+		}
+		r, present, ok := right(p)
+		if !ok || !present {
+			return false, ok
+		}
+
+		switch op {
+		case "=", "==":
+			return l == r, true
+		case "!=":
+			return l != r, true
+		case "<":
+			return l < r, true
+		case "<=":
+			return l <= r, true
+		case ">":
+			return l > r, true
+		default:
+			return l >= r, true
+		}
+	}, nil
+}
+
+// Precedences of arithmetic operators, from the lowest to the highest
+var filterArithOps = [][]string{{"|"}, {"&"}, {"<<", ">>"}, {"+", "-"}, {"*", "/"}}
+
+func (parser *filterParser) parseArith(level int) (filterValue, error) {
+	if level >= len(filterArithOps) {
+		return parser.parseOperand()
+	}
+
+	left, err := parser.parseArith(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := parser.peek(0)
+		found := false
+		for _, o := range filterArithOps[level] {
+			if op == o {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return left, nil
+		}
+		parser.pos++
+
+		right, err := parser.parseArith(level + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(p *filterPacket) (uint32, bool, bool) {
+			a, present, ok := l(p)
+			if !ok || !present {
+				return 0, present, ok
+			}
+			b, present, ok := right(p)
+			if !ok || !present {
+				return 0, present, ok
+			}
+
+			switch op {
+			case "|":
+				return a | b, true, true
+			case "&":
+				return a & b, true, true
+			case "<<":
+				return a << b, true, true
+			case ">>":
+				return a >> b, true, true
+			case "+":
+				return a + b, true, true
+			case "-":
+				return a - b, true, true
+			case "*":
+				return a * b, true, true
+			default:
+				// Division by zero rejects the packet
+				if b == 0 {
+					return 0, false, false
+				}
+				return a / b, true, true
+			}
+		}
+	}
+}
+
+func (parser *filterParser) parseOperand() (filterValue, error) {
+	t := parser.next()
+
+	// Parentheses
+	if t == "(" {
+		v, err := parser.parseArith(0)
+		if err != nil {
+			return nil, err
+		}
+		err = parser.expect(")")
+		if err != nil {
+			return nil, err
+		}
+
+		return v, nil
+	}
+
+	// Constants
+	c, ok := filterConsts[t]
+	if ok {
+		return func(p *filterPacket) (uint32, bool, bool) {
+			return c, true, true
+		}, nil
+	}
+	n, err := strconv.ParseUint(t, 0, 32)
+	if err == nil {
+		return func(p *filterPacket) (uint32, bool, bool) {
+			return uint32(n), true, true
+		}, nil
+	}
+
+	// Protocol fields
+	err = parser.expect("[")
+	if err != nil {
+		return nil, fmt.Errorf("operand %s not support", t)
+	}
+	off, err := parser.parseArith(0)
+	if err != nil {
+		return nil, err
+	}
+	size := 1
+	if parser.peek(0) == ":" {
+		parser.pos++
+		s := parser.next()
+		size, err = strconv.Atoi(s)
+		if err != nil || size != 1 && size != 2 && size != 4 {
+			return nil, fmt.Errorf("size %s not support", s)
+		}
+	}
+	err = parser.expect("]")
+	if err != nil {
+		return nil, err
+	}
+
+	var base func(p *filterPacket) (int, bool, bool)
+	switch t {
+	case "ip", "ip6", "arp":
+		netType := map[string]layers.EthernetType{
+			"ip":  layers.EthernetTypeIPv4,
+			"ip6": layers.EthernetTypeIPv6,
+			"arp": layers.EthernetTypeARP,
+		}[t]
+		base = func(p *filterPacket) (int, bool, bool) {
+			return p.netOff, p.netType == netType, true
+		}
+	case "tcp", "udp", "icmp", "icmp6":
+		proto := filterProtos[t]
+		base = func(p *filterPacket) (int, bool, bool) {
+			off, v, present, ok := p.transport()
+			if !ok || !present {
+				return 0, false, ok
+			}
+			switch p.netType {
+			case layers.EthernetTypeIPv4:
+				return off, int(v) == proto[0], true
+			default:
+				return off, int(v) == proto[1], true
+			}
+		}
+	default:
+		return nil, fmt.Errorf("protocol %s not support", t)
+	}
+
+	return func(p *filterPacket) (uint32, bool, bool) {
+		b, present, ok := base(p)
+		if !ok || !present {
+			return 0, present, ok
+		}
+		o, present, ok := off(p)
+		if !ok || !present {
+			return 0, present, ok
+		}
+
+		v, ok := p.load(b+int(o), size)
+		return v, ok, ok
+	}, nil
+}
@@ -0,0 +1,186 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"math/rand"
+	"runtime"
+	"strings"
+	"sync/atomic"
+)
+
+// osProfile describes an OS stack which crafted packets imitate.
+type osProfile int
+
+const (
+	osNone osProfile = iota
+	osLinux
+	osWindows
+	osMacOS
+)
+
+// parseProfile returns an OS profile by the given string, can be none, linux, windows or macos.
+func parseProfile(s string) (osProfile, error) {
+	switch s {
+	case "none":
+		return osNone, nil
+	case "linux":
+		return osLinux, nil
+	case "windows":
+		return osWindows, nil
+	case "macos":
+		return osMacOS, nil
+	default:
+		return osNone, fmt.Errorf("profile %s not support", s)
+	}
+}
+
+// nativeProfile returns the OS profile of the OS IkaGo runs on.
+func nativeProfile() osProfile {
+	switch runtime.GOOS {
+	case "windows":
+		return osWindows
+	case "darwin":
+		return osMacOS
+	default:
+		return osLinux
+	}
+}
+
+func (profile osProfile) String() string {
+	switch profile {
+	case osNone:
+		return "none"
+	case osLinux:
+		return "linux"
+	case osWindows:
+		return "windows"
+	case osMacOS:
+		return "macos"
+	default:
+		panic(fmt.Errorf("profile %d not support", profile))
+	}
+}
+
+// globalIPv4Id is the IPv4 ID shared by all streams, like Windows does.
+var globalIPv4Id = initialSeq()
+
+// Fingerprint describes how crafted packets imitate an OS stack against passive fingerprinting, which decides the
+// initial sequence, the TTL, the IPv4 ID, the Don't Fragment flag and the window. Packets are left as crafted by
+// default, and only imitate a profile set.
+type Fingerprint struct {
+	isDefault bool
+	profile   osProfile
+}
+
+// ParseFingerprint returns a fingerprint by the given string, can be empty, none, linux, windows or macos.
+func ParseFingerprint(s string) (*Fingerprint, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return &Fingerprint{isDefault: true}, nil
+	}
+
+	profile, err := parseProfile(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Fingerprint{profile: profile}, nil
+}
+
+// IsDefault returns if the fingerprint leaves packets as crafted.
+func (fp *Fingerprint) IsDefault() bool {
+	return fp == nil || fp.isDefault
+}
+
+// newState returns a new FakeTCP state, whose initial sequence is random unless the fingerprint is none.
+func (fp *Fingerprint) newState() *fakeTCPState {
+	state := newFakeTCPState()
+	if !fp.IsDefault() && fp.profile == osNone {
+		state.seq = 0
+		state.tsOffset = 0
+	}
+
+	return state
+}
+
+// synOptions returns the SYN options of the fingerprint if the given ones are default and the fingerprint is not.
+func (fp *Fingerprint) synOptions(options *SYNOptions) *SYNOptions {
+	if !options.IsDefault() || fp.IsDefault() {
+		return options
+	}
+
+	result := newSYNOptions(fp.profile)
+	result.isDefault = true
+
+	return result
+}
+
+// receiveWindow returns the receive window in bytes of the fingerprint with an empty buffer.
+func (fp *Fingerprint) receiveWindow(isScaled bool) int {
+	if fp.IsDefault() {
+		return 65535
+	}
+
+	switch fp.profile {
+	case osLinux:
+		if isScaled {
+			return 502 << 7
+		}
+		return 64240
+	case osWindows:
+		if isScaled {
+			return 1026 << 8
+		}
+		return 64240
+	case osMacOS:
+		if isScaled {
+			return 2048 << 6
+		}
+		return 65535
+	default:
+		return 65535
+	}
+}
+
+// apply sets the TTL, the IPv4 ID and the Don't Fragment flag of a packet crafted in the stream.
+func (fp *Fingerprint) apply(state *fakeTCPState, networkLayer gopacket.SerializableLayer) {
+	if fp.IsDefault() {
+		return
+	}
+
+	var ttl uint8
+
+	switch fp.profile {
+	case osLinux, osMacOS:
+		ttl = 64
+	case osWindows:
+		ttl = 128
+	default:
+		return
+	}
+
+	switch t := networkLayer.(type) {
+	case *layers.IPv4:
+		t.TTL = ttl
+		t.Flags = layers.IPv4DontFragment
+
+		// Linux counts from a random ID in each stream, Windows counts globally, and macOS randomizes each packet
+		switch fp.profile {
+		case osLinux:
+			state.id++
+			t.Id = state.id
+		case osWindows:
+			t.Id = uint16(atomic.AddUint32(&globalIPv4Id, 1))
+		case osMacOS:
+			t.Id = uint16(rand.Uint32())
+		}
+	case *layers.IPv6:
+		t.HopLimit = ttl
+	}
+}
+
+func (fp Fingerprint) String() string {
+	return fp.profile.String()
+}
@@ -0,0 +1,62 @@
+package pcap
+
+import (
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+)
+
+func TestFingerprintApply(t *testing.T) {
+	tests := []struct {
+		s     string
+		ttl   uint8
+		flags layers.IPv4Flag
+	}{
+		// Left as crafted by default
+		{s: "", ttl: 63},
+		{s: "none", ttl: 63},
+		{s: "linux", ttl: 64, flags: layers.IPv4DontFragment},
+		{s: "windows", ttl: 128, flags: layers.IPv4DontFragment},
+		{s: "macos", ttl: 64, flags: layers.IPv4DontFragment},
+	}
+
+	for _, test := range tests {
+		fp, err := ParseFingerprint(test.s)
+		if err != nil {
+			t.Fatalf("%q: %v", test.s, err)
+		}
+
+		layer := &layers.IPv4{Version: 4, IHL: 5, TTL: 63, SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)}
+		fp.apply(fp.newState(), layer)
+		if layer.TTL != test.ttl || layer.Flags != test.flags {
+			t.Errorf("%q: ttl %d flags %s, want ttl %d flags %s", test.s, layer.TTL, layer.Flags, test.ttl, test.flags)
+		}
+	}
+}
+
+func TestFingerprintDefault(t *testing.T) {
+	fp, err := ParseFingerprint("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fp.IsDefault() {
+		t.Fatal("empty fingerprint not default")
+	}
+
+	// Initial sequences stay random
+	if fp.newState().seq == 0 && fp.newState().seq == 0 {
+		t.Error("initial sequence not random")
+	}
+
+	// SYN options set are kept
+	options, err := ParseSYNOptions("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp.synOptions(options) != options {
+		t.Error("syn options replaced")
+	}
+	if fp.receiveWindow(true) != 65535 {
+		t.Errorf("window %d, want %d", fp.receiveWindow(true), 65535)
+	}
+}
@@ -8,11 +8,15 @@
 	"github.com/google/gopacket/layers"
 	"ikago/internal/log"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var ipv6FragId uint32
+
 type fragFlow struct {
-	id  uint16
+	id  uint32
 	src string
 }
 
@@ -75,6 +79,20 @@ func (indicator *fragIndicator) concatenate() (*PacketIndicator, error) {
 		newNetworkLayer = &temp
 
 		FlagIPv4Layer(newNetworkLayer.(*layers.IPv4), false, false, 0)
+	case layers.LayerTypeIPv6:
+		ipv6Layer := indicator.frags[0].IPv6Layer()
+		temp := *ipv6Layer
+		newNetworkLayer = &temp
+
+		// Remove the fragment header, contents following the fragment header will be parsed again
+		newIPv6Layer := newNetworkLayer.(*layers.IPv6)
+		if newIPv6Layer.HopByHop != nil {
+			hopByHop := *newIPv6Layer.HopByHop
+			hopByHop.NextHeader = indicator.frags[0].IPv6Indicator().Protocol()
+			newIPv6Layer.HopByHop = &hopByHop
+		} else {
+			newIPv6Layer.NextHeader = indicator.frags[0].IPv6Indicator().Protocol()
+		}
 	default:
 		return nil, fmt.Errorf("network layer type %s not support", t)
 	}
@@ -90,7 +108,7 @@ func (indicator *fragIndicator) concatenate() (*PacketIndicator, error) {
 		data, err = Serialize(newNetworkLayer.(gopacket.SerializableLayer),
 			gopacket.Payload(contents))
 	} else {
-		data, err = Serialize(indicator.frags[0].LinkLayer().(gopacket.SerializableLayer),
+		data, err = Serialize(indicator.frags[0].SerializableLinkLayer(),
 			newNetworkLayer.(gopacket.SerializableLayer),
 			gopacket.Payload(contents))
 	}
@@ -126,8 +144,10 @@ type Defragmenter interface {
 	SetDeadline(t time.Duration)
 }
 
-// EasyDefragmenter is a machine defragments packets which also accepts non-standard packets.
+// EasyDefragmenter is a machine defragments packets which also accepts non-standard packets. It is safe for
+// concurrent use.
 type EasyDefragmenter struct {
+	lock     sync.Mutex
 	frags    map[fragFlow]*fragIndicator
 	deadline time.Duration
 }
@@ -153,6 +173,10 @@ func (defrag *EasyDefragmenter) AppendOriginal(ind *PacketIndicator) (*PacketInd
 		id:  ind.NetworkId(),
 		src: ind.SrcIP().String(),
 	}
+
+	defrag.lock.Lock()
+	defer defrag.lock.Unlock()
+
 	fragIndicator, ok := defrag.frags[flow]
 	if !ok || fragIndicator == nil {
 		fragIndicator = newFragIndicator()
@@ -185,6 +209,9 @@ func (defrag *EasyDefragmenter) AppendOriginal(ind *PacketIndicator) (*PacketInd
 }
 
 func (defrag *EasyDefragmenter) SetDeadline(t time.Duration) {
+	defrag.lock.Lock()
+	defer defrag.lock.Unlock()
+
 	defrag.deadline = t
 }
 
@@ -267,7 +294,12 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 
 	// Fragment
 	if len(networkLayerData)+len(networkLayerPayload) > fragment {
-		var newNetworkLayer gopacket.NetworkLayer
+		var (
+			newNetworkLayer gopacket.NetworkLayer
+			headerLength    int
+			nextHeader      layers.IPProtocol
+			id              uint32
+		)
 
 		// Create new network layer
 		switch t := networkLayer.LayerType(); t {
@@ -275,6 +307,23 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 			newIPv4Layer := networkLayer.(*layers.IPv4)
 			temp := *newIPv4Layer
 			newNetworkLayer = &temp
+		case layers.LayerTypeIPv6:
+			newIPv6Layer := networkLayer.(*layers.IPv6)
+			temp := *newIPv6Layer
+			if temp.HopByHop != nil {
+				hopByHop := *temp.HopByHop
+				nextHeader = hopByHop.NextHeader
+				hopByHop.NextHeader = layers.IPProtocolIPv6Fragment
+				temp.HopByHop = &hopByHop
+			} else {
+				nextHeader = temp.NextHeader
+				temp.NextHeader = layers.IPProtocolIPv6Fragment
+			}
+			newNetworkLayer = &temp
+
+			// Fragment header
+			headerLength = 8
+			id = atomic.AddUint32(&ipv6FragId, 1)
 		default:
 			return nil, fmt.Errorf("network layer type %s not support", t)
 		}
@@ -285,7 +334,7 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 				err  error
 				data []byte
 			)
-			length := min(fragment-len(networkLayerData), len(networkLayerPayload)-i)
+			length := min(fragment-len(networkLayerData)-headerLength, len(networkLayerPayload)-i)
 			remain := len(networkLayerPayload) - i - length
 
 			// Align
@@ -300,15 +349,25 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 				remain = len(networkLayerPayload) - i - length
 			}
 
+			fragmentPayload := networkLayerPayload[i : i+length]
+
 			switch t := newNetworkLayer.LayerType(); t {
 			case layers.LayerTypeIPv4:
 				ipv4Layer := newNetworkLayer.(*layers.IPv4)
 
+				// Options not flagged copied only appear in the first fragment
+				if i > 0 {
+					ipv4Layer.Options = CopiedIPv4Options(ipv4Layer.Options)
+				}
+
 				if remain <= 0 {
 					FlagIPv4Layer(ipv4Layer, false, false, uint16(i/8))
 				} else {
 					FlagIPv4Layer(ipv4Layer, false, true, uint16(i/8))
 				}
+			case layers.LayerTypeIPv6:
+				header := CreateIPv6FragmentHeader(nextHeader, uint16(i/8), remain > 0, id)
+				fragmentPayload = append(header, fragmentPayload...)
 			default:
 				return nil, fmt.Errorf("network layer type %s not support", t)
 			}
@@ -316,11 +375,11 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 			// Serialize layers
 			if linkLayer == nil {
 				data, err = Serialize(newNetworkLayer.(gopacket.SerializableLayer),
-					gopacket.Payload(networkLayerPayload[i:i+length]))
+					gopacket.Payload(fragmentPayload))
 			} else {
 				data, err = Serialize(linkLayer.(gopacket.SerializableLayer),
 					newNetworkLayer.(gopacket.SerializableLayer),
-					gopacket.Payload(networkLayerPayload[i:i+length]))
+					gopacket.Payload(fragmentPayload))
 			}
 			if err != nil {
 				return nil, fmt.Errorf("serialize: %w", err)
@@ -0,0 +1,185 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FTPControlPort is the port of FTP control connections.
+const FTPControlPort = 21
+
+// FTPDataPort is the port FTP servers open active data connections from.
+const FTPDataPort = 20
+
+// ftpCommand matches PORT and EPRT commands which carry the address of the data connection in active mode.
+var ftpCommand = regexp.MustCompile(`(?i)(?:^|\n)(PORT|EPRT) ([^\r\n]*)\r?\n`)
+
+// FTPSession describes an FTP control connection through NAT. Rewriting addresses in PORT and EPRT commands changes
+// the size of the payload, so the session tracks offsets of sequence numbers like the FTP helper of netfilter.
+type FTPSession struct {
+	lock        sync.Mutex
+	isRewritten bool
+	pos         uint32
+	before      int32
+	after       int32
+	last        []byte
+}
+
+// NewFTPSession returns a new FTP session.
+func NewFTPSession() *FTPSession {
+	return &FTPSession{}
+}
+
+// Outbound rewrites a segment from the FTP client, and returns its new sequence number and payload. expect is called
+// with the address in PORT or EPRT command, which returns the address should be replaced with and opens the data
+// connection in NAT. Commands split into multiple segments are not rewritten.
+func (s *FTPSession) Outbound(seq uint32, payload []byte, expect func(a *net.TCPAddr) (*net.TCPAddr, error)) (uint32, []byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Retransmission of the segment rewritten
+	if s.isRewritten && seq == s.pos && len(payload) > 0 {
+		return seq + uint32(s.before), s.last, nil
+	}
+
+	offset := s.after
+	if s.isRewritten && int32(seq-s.pos) < 0 {
+		offset = s.before
+	}
+
+	indices := ftpCommand.FindSubmatchIndex(payload)
+	if indices == nil {
+		return seq + uint32(offset), payload, nil
+	}
+	command, arg := strings.ToUpper(string(payload[indices[2]:indices[3]])), string(payload[indices[4]:indices[5]])
+
+	// Parse
+	var (
+		a   *net.TCPAddr
+		err error
+	)
+	switch command {
+	case "PORT":
+		a, err = parseFTPPort(arg)
+	case "EPRT":
+		a, err = parseFTPEPRT(arg)
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("parse %s: %w", command, err)
+	}
+
+	newAddr, err := expect(a)
+	if err != nil {
+		return 0, nil, fmt.Errorf("expect: %w", err)
+	}
+
+	// Rewrite
+	var newArg string
+	switch command {
+	case "PORT":
+		if newAddr.IP.To4() == nil {
+			return 0, nil, fmt.Errorf("address %s not support in PORT", newAddr.IP)
+		}
+		newArg = formatFTPPort(newAddr)
+	case "EPRT":
+		newArg = formatFTPEPRT(newAddr)
+	}
+
+	result := make([]byte, 0, len(payload)-len(arg)+len(newArg))
+	result = append(result, payload[:indices[4]]...)
+	result = append(result, newArg...)
+	result = append(result, payload[indices[5]:]...)
+
+	s.isRewritten = true
+	s.pos = seq
+	s.before = offset
+	s.after = offset + int32(len(result)-len(payload))
+	s.last = result
+
+	return seq + uint32(s.before), result, nil
+}
+
+// Inbound returns the acknowledgement number of a segment from the FTP server corrected by the offset.
+func (s *FTPSession) Inbound(ack uint32) uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.isRewritten && int32(ack-uint32(s.before)-s.pos) > 0 {
+		return ack - uint32(s.after)
+	}
+
+	return ack - uint32(s.before)
+}
+
+func parseFTPPort(arg string) (*net.TCPAddr, error) {
+	strs := strings.Split(strings.TrimSpace(arg), ",")
+	if len(strs) != 6 {
+		return nil, fmt.Errorf("invalid argument %s", arg)
+	}
+
+	b := make([]byte, 6)
+	for i, str := range strs {
+		n, err := strconv.ParseUint(strings.TrimSpace(str), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", str, err)
+		}
+		b[i] = byte(n)
+	}
+
+	return &net.TCPAddr{
+		IP:   net.IPv4(b[0], b[1], b[2], b[3]),
+		Port: int(b[4])<<8 | int(b[5]),
+	}, nil
+}
+
+func parseFTPEPRT(arg string) (*net.TCPAddr, error) {
+	if len(arg) <= 0 {
+		return nil, errors.New("empty argument")
+	}
+
+	strs := strings.Split(arg, arg[:1])
+	if len(strs) != 5 {
+		return nil, fmt.Errorf("invalid argument %s", arg)
+	}
+
+	ip := net.ParseIP(strs[2])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %s", strs[2])
+	}
+	switch strs[1] {
+	case "1":
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("invalid ipv4 %s", strs[2])
+		}
+	case "2":
+		break
+	default:
+		return nil, fmt.Errorf("protocol %s not support", strs[1])
+	}
+
+	port, err := strconv.ParseUint(strs[3], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("parse port: %w", err)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func formatFTPPort(a *net.TCPAddr) string {
+	ip := a.IP.To4()
+
+	return fmt.Sprintf("%d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], a.Port>>8, a.Port&0xff)
+}
+
+func formatFTPEPRT(a *net.TCPAddr) string {
+	if a.IP.To4() != nil {
+		return fmt.Sprintf("|1|%s|%d|", a.IP, a.Port)
+	}
+
+	return fmt.Sprintf("|2|%s|%d|", a.IP, a.Port)
+}
@@ -0,0 +1,145 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"ikago/internal/crypto"
+	"net"
+)
+
+// FakeTCPSession describes a connection accepted from a client, which is handed off to a standby, so the standby
+// resumes the connection without handshaking again once it takes over the address of the server.
+type FakeTCPSession struct {
+	Client     string `json:"client"`
+	Seq        uint32 `json:"seq"`
+	Ack        uint32 `json:"ack"`
+	TSOffset   uint32 `json:"tsOffset"`
+	Wscale     int    `json:"wscale"`
+	PeerWscale int    `json:"peerWscale"`
+	// Secret is the secret of the session in key exchange, which is empty without key exchange.
+	Secret []byte `json:"secret,omitempty"`
+}
+
+// Sessions returns sessions of connections established with clients. Connections finishing and connections whose
+// key exchange is not established are skipped.
+func (l *FakeTCPListener) Sessions() []FakeTCPSession {
+	l.lock.Lock()
+	conns := make([]*FakeTCPConn, 0, len(l.clients))
+	for _, conn := range l.clients {
+		conns = append(conns, conn.(*FakeTCPConn))
+	}
+	l.lock.Unlock()
+
+	sessions := make([]FakeTCPSession, 0, len(conns))
+	for _, conn := range conns {
+		session, ok := conn.session()
+		if !ok {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
+
+func (c *FakeTCPConn) session() (FakeTCPSession, bool) {
+	if c.isClosed {
+		return FakeTCPSession{}, false
+	}
+
+	c.clientsLock.RLock()
+	client, ok := c.clients[c.RemoteAddr().String()]
+	c.clientsLock.RUnlock()
+	if !ok || client.state == nil {
+		return FakeTCPSession{}, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	state := client.state
+	if state.isFINSent || state.isFINReceived {
+		return FakeTCPSession{}, false
+	}
+
+	session := FakeTCPSession{
+		Client:     c.RemoteAddr().String(),
+		Seq:        state.seq,
+		Ack:        state.ack,
+		TSOffset:   state.tsOffset,
+		Wscale:     state.wscale,
+		PeerWscale: state.peerWscale,
+	}
+	if ec, ok := client.crypt.(*crypto.ExchangeCrypt); ok {
+		session.Secret = ec.Secret()
+		if session.Secret == nil {
+			return FakeTCPSession{}, false
+		}
+	}
+
+	return session, true
+}
+
+// Resume returns a connection accepted from the client of the session handed off, which continues the stream from
+// the state of the session.
+func (l *FakeTCPListener) Resume(session FakeTCPSession) (net.Conn, error) {
+	dstAddr, err := net.ResolveTCPAddr("tcp", session.Client)
+	if err != nil {
+		return nil, fmt.Errorf("resolve client: %w", err)
+	}
+
+	l.lock.Lock()
+	client, ok := l.clients[dstAddr.String()]
+	l.lock.Unlock()
+	if ok && !client.(*FakeTCPConn).isClosed {
+		return nil, fmt.Errorf("client %s connected", dstAddr)
+	}
+
+	// Crypt of the client
+	crypt := l.crypt
+	if l.keyring != nil {
+		crypt = l.keyring.Crypt(dstAddr.IP)
+		if crypt == nil {
+			return nil, fmt.Errorf("client %s unauthorized", dstAddr.IP)
+		}
+	}
+	crypt = newSession(crypt)
+	if ec, ok := crypt.(*crypto.ExchangeCrypt); ok {
+		if len(session.Secret) <= 0 {
+			return nil, errors.New("missing secret")
+		}
+		err := ec.Resume(session.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("resume session: %w", err)
+		}
+	}
+
+	conn, err := dialFakeTCPPassive(l.Dev(), l.conn.RemoteDev(), l.srcPort, dstAddr, crypt, l.mtu, l.ecn, l.ttl, l.dscp, l.emulate, l.synOptions, l.keepalive, l.fingerprint, l.pace, l.obfuscator)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: l.Addr(),
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	// The stream continues without handshaking
+	state := l.fingerprint.newState()
+	state.seq = session.Seq
+	state.ack = session.Ack
+	state.tsOffset = session.TSOffset
+	state.isSynchronized = true
+	state.negotiate(session.Wscale, session.PeerWscale)
+
+	conn.isPassive = true
+	conn.clients[dstAddr.String()] = &clientIndicator{crypt: crypt, state: state}
+
+	// Map client
+	l.lock.Lock()
+	l.clients[dstAddr.String()] = conn
+	l.lock.Unlock()
+
+	return conn, nil
+}
@@ -0,0 +1,175 @@
+package pcap
+
+import (
+	"ikago/internal/log"
+	"sync"
+	"time"
+)
+
+// probeWindow is the number of the last probes loss is measured in.
+const probeWindow = 20
+
+// health describes the liveness of the peer of a connection dialed, which is learned from segments sent to the peer
+// and received from it. A connection is healthy if segments sent are answered in time.
+type health struct {
+	lock sync.Mutex
+	// rtt is the round-trip time of the last probe answered, which is a SYN or a keepalive probe.
+	rtt time.Duration
+	// jitter is the smoothed variation of round-trip times of probes answered in RFC 3550.
+	jitter time.Duration
+	// answered is the number of probes answered.
+	answered int
+	// heard is the time of the last segment received.
+	heard time.Time
+	// probed is the time of the last probe sent, which is zero if it is answered.
+	probed time.Time
+	// sent is the time of the last probe sent.
+	sent time.Time
+	// results are if the last probes are answered in a ring, and probes is the number of probes with results.
+	results [probeWindow]bool
+	probes  int
+	// unanswered is the time of the first segment sent after the last segment received.
+	unanswered time.Time
+}
+
+// send records a segment sent, which is a probe if isProbe is set.
+func (h *health) send(isProbe bool) {
+	now := time.Now()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if isProbe {
+		// A probe still unanswered when the next one is sent is lost
+		if !h.probed.IsZero() {
+			h.record(false)
+		}
+		h.probed, h.sent = now, now
+	}
+	if h.unanswered.IsZero() {
+		h.unanswered = now
+	}
+}
+
+// hear records a segment received, which answers segments sent before.
+func (h *health) hear() {
+	now := time.Now()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.probed.IsZero() {
+		rtt := now.Sub(h.probed)
+		if h.answered > 0 {
+			d := rtt - h.rtt
+			if d < 0 {
+				d = -d
+			}
+			h.jitter = h.jitter + (d-h.jitter)/16
+		}
+		h.rtt = rtt
+		h.answered++
+		h.probed = time.Time{}
+		h.record(true)
+	}
+	h.heard = now
+	h.unanswered = time.Time{}
+}
+
+// record records if a probe is answered.
+func (h *health) record(isAnswered bool) {
+	h.results[h.probes%probeWindow] = isAnswered
+	h.probes++
+}
+
+// RTT returns the round-trip time of the last probe answered by the peer, which is the handshake or a keepalive probe.
+func (c *FakeTCPConn) RTT() time.Duration {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+
+	return c.health.rtt
+}
+
+// Heard returns the time of the last segment received from the peer, which is zero if nothing is received.
+func (c *FakeTCPConn) Heard() time.Time {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+
+	return c.health.heard
+}
+
+// Jitter returns the smoothed variation of round-trip times of probes answered by the peer.
+func (c *FakeTCPConn) Jitter() time.Duration {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+
+	return c.health.jitter
+}
+
+// Loss returns the ratio of probes unanswered by the peer in the last probes, and the number of probes it is measured
+// in, which is 0 if no probe has a result.
+func (c *FakeTCPConn) Loss() (float64, int) {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+
+	n := c.health.probes
+	if n > probeWindow {
+		n = probeWindow
+	}
+	if n <= 0 {
+		return 0, 0
+	}
+
+	lost := 0
+	for i := 0; i < n; i++ {
+		if !c.health.results[i] {
+			lost++
+		}
+	}
+
+	return float64(lost) / float64(n), n
+}
+
+// Probed returns the time of the last probe sent to the peer, which is zero if nothing is probed.
+func (c *FakeTCPConn) Probed() time.Time {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+
+	return c.health.sent
+}
+
+// Unanswered returns the duration since the first segment sent after the last segment received from the peer, which is
+// 0 if all segments sent are answered. The peer is unresponsive if it grows.
+func (c *FakeTCPConn) Unanswered() time.Duration {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+
+	if c.health.unanswered.IsZero() {
+		return 0
+	}
+
+	return time.Now().Sub(c.health.unanswered)
+}
+
+// Probe sends a TCP keepalive probe to the peer, which it replies to with an ACK, so its liveness and the round-trip
+// time are learned even if the connection is idle. Nothing is sent before the connection is established.
+func (c *FakeTCPConn) Probe() error {
+	// Client
+	c.clientsLock.RLock()
+	client, ok := c.clients[c.RemoteAddr().String()]
+	c.clientsLock.RUnlock()
+	if !ok || client.state == nil || client.state.isFINSent {
+		return nil
+	}
+
+	// Probe with the TCP Seq before the next one
+	err := c.writeACK(client, c.RemoteAddr(), client.state.seq-1, false)
+	if err != nil {
+		return err
+	}
+	c.health.send(true)
+
+	log.Verbosef("Send TCP keepalive: %s -> %s\n", c.LocalAddr().String(), c.RemoteAddr().String())
+
+	return nil
+}
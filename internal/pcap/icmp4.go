@@ -41,38 +41,34 @@ func ParseICMPv4Layer(layer *layers.ICMPv4) (*ICMPv4Indicator, error) {
 		layers.ICMPv4TypeTimeExceeded,
 		layers.ICMPv4TypeParameterProblem:
 		// Parse IPv4 header and 8 bytes content
-		packet := gopacket.NewPacket(layer.Payload, layers.LayerTypeIPv4, gopacket.NoCopy)
-		if len(packet.Layers()) <= 0 {
+		l := newPacketLayers()
+		l.decode(layers.LayerTypeIPv4, layer.Payload)
+		if !l.has(layers.LayerTypeIPv4) {
 			return nil, errors.New("missing network layer")
 		}
-		if len(packet.Layers()) <= 1 {
-			return nil, errors.New("missing transport layer")
-		}
 
 		// Parse network layer
-		networkLayer := packet.Layers()[0]
-		if t := networkLayer.LayerType(); t != layers.LayerTypeIPv4 {
-			return nil, fmt.Errorf("network layer type %s not support", t)
-		}
-
-		embIPv4Layer = networkLayer.(*layers.IPv4)
+		embIPv4Layer = &l.ipv4
 		if embIPv4Layer.Version != 4 {
 			return nil, errors.New("network layer type not support")
 		}
 
-		_, err := parseIPProtocol(embIPv4Layer.Protocol)
+		t, err := parseIPProtocol(embIPv4Layer.Protocol)
 		if err != nil {
 			return nil, err
 		}
 
 		// Parse transport layer
-		embTransportLayer = packet.Layers()[1]
-		switch t := embTransportLayer.LayerType(); t {
+		switch t {
 		case layers.LayerTypeTCP, layers.LayerTypeUDP, layers.LayerTypeICMPv4:
 			break
 		default:
 			return nil, fmt.Errorf("transport layer type %s not support", t)
 		}
+		embTransportLayer = l.layer(t)
+		if embTransportLayer == nil {
+			return nil, errors.New("missing transport layer")
+		}
 	default:
 		return nil, fmt.Errorf("icmpv4 type %d not support", t)
 	}
@@ -0,0 +1,335 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/addr"
+	"net"
+)
+
+// ICMPv6Indicator indicates an ICMPv6 layer.
+type ICMPv6Indicator struct {
+	layer             *layers.ICMPv6
+	embIPv6Indicator  *IPv6Indicator
+	embTransportLayer gopacket.Layer
+}
+
+// ParseICMPv6Layer parses an ICMPv6 layer and returns an ICMPv6 indicator.
+func ParseICMPv6Layer(layer *layers.ICMPv6) (*ICMPv6Indicator, error) {
+	var (
+		embIPv6Indicator  *IPv6Indicator
+		embTransportLayer gopacket.Layer
+	)
+
+	switch t := layer.TypeCode.Type(); t {
+	case layers.ICMPv6TypeEchoRequest, layers.ICMPv6TypeEchoReply:
+		// Identifier and sequence number
+		if len(layer.Payload) < 4 {
+			return nil, errors.New("icmpv6 echo too short")
+		}
+	case layers.ICMPv6TypeDestinationUnreachable,
+		layers.ICMPv6TypePacketTooBig,
+		layers.ICMPv6TypeTimeExceeded,
+		layers.ICMPv6TypeParameterProblem:
+		// Skip unused, MTU or pointer and parse the invoking packet
+		if len(layer.Payload) < 4 {
+			return nil, errors.New("missing network layer")
+		}
+		l := newPacketLayers()
+		l.decode(layers.LayerTypeIPv6, layer.Payload[4:])
+		if !l.has(layers.LayerTypeIPv6) {
+			return nil, errors.New("missing network layer")
+		}
+
+		// Parse network layer
+		embIPv6Layer := &l.ipv6
+		if embIPv6Layer.Version != 6 {
+			return nil, errors.New("network layer type not support")
+		}
+
+		var err error
+		embIPv6Indicator, err = ParseIPv6Layer(embIPv6Layer)
+		if err != nil {
+			return nil, fmt.Errorf("parse ipv6 layer: %w", err)
+		}
+		if embIPv6Indicator.IsFrag() {
+			return nil, errors.New("embedded fragment not support")
+		}
+
+		embTransportLayerType, err := parseIPProtocol(embIPv6Indicator.Protocol())
+		if err != nil {
+			return nil, err
+		}
+
+		// Parse transport layer behind extension headers which are not decoded
+		if !l.has(embTransportLayerType) {
+			l.decode(embTransportLayerType, embIPv6Indicator.Payload())
+		}
+		embTransportLayer = l.layer(embTransportLayerType)
+		if embTransportLayer == nil {
+			return nil, errors.New("missing transport layer")
+		}
+		switch t := embTransportLayer.LayerType(); t {
+		case layers.LayerTypeTCP, layers.LayerTypeUDP:
+			break
+		case layers.LayerTypeICMPv6:
+			embICMPv6Layer := embTransportLayer.(*layers.ICMPv6)
+
+			switch t := embICMPv6Layer.TypeCode.Type(); t {
+			case layers.ICMPv6TypeEchoRequest, layers.ICMPv6TypeEchoReply:
+				if len(embICMPv6Layer.Payload) < 4 {
+					return nil, errors.New("embedded icmpv6 echo too short")
+				}
+			default:
+				return nil, fmt.Errorf("embedded icmpv6 type %d not support", t)
+			}
+		default:
+			return nil, fmt.Errorf("transport layer type %s not support", t)
+		}
+	default:
+		return nil, fmt.Errorf("icmpv6 type %d not support", t)
+	}
+
+	return &ICMPv6Indicator{
+		layer:             layer,
+		embIPv6Indicator:  embIPv6Indicator,
+		embTransportLayer: embTransportLayer,
+	}, nil
+}
+
+// NewPureICMPv6Layer returns an new ICMPv6 layer copied from the original ICMPv6 layer without any message body.
+func (indicator *ICMPv6Indicator) NewPureICMPv6Layer() *layers.ICMPv6 {
+	return &layers.ICMPv6{
+		TypeCode: indicator.layer.TypeCode,
+	}
+}
+
+// ICMPv6Layer returns the ICMPv6 layer.
+func (indicator *ICMPv6Indicator) ICMPv6Layer() *layers.ICMPv6 {
+	return indicator.layer
+}
+
+// Body returns the message body of the ICMPv6 layer.
+func (indicator *ICMPv6Indicator) Body() []byte {
+	return indicator.layer.Payload
+}
+
+// NewBody returns a copy of the message body of the ICMPv6 query with the given Id.
+func (indicator *ICMPv6Indicator) NewBody(id uint16) []byte {
+	if !indicator.IsQuery() {
+		panic(errors.New("icmpv6 error not support"))
+	}
+
+	body := make([]byte, len(indicator.layer.Payload))
+	copy(body, indicator.layer.Payload)
+	binary.BigEndian.PutUint16(body[0:2], id)
+
+	return body
+}
+
+// ErrorHeader returns the unused, MTU or pointer field of the ICMPv6 error.
+func (indicator *ICMPv6Indicator) ErrorHeader() []byte {
+	if indicator.IsQuery() {
+		panic(errors.New("icmpv6 query not support"))
+	}
+
+	return indicator.layer.Payload[:4]
+}
+
+// IsQuery returns if the ICMPv6 layer is a query.
+func (indicator *ICMPv6Indicator) IsQuery() bool {
+	switch t := indicator.layer.TypeCode.Type(); t {
+	case layers.ICMPv6TypeEchoRequest, layers.ICMPv6TypeEchoReply:
+		return true
+	case layers.ICMPv6TypeDestinationUnreachable,
+		layers.ICMPv6TypePacketTooBig,
+		layers.ICMPv6TypeTimeExceeded,
+		layers.ICMPv6TypeParameterProblem:
+		return false
+	default:
+		panic(fmt.Errorf("icmpv6 type %d not support", t))
+	}
+}
+
+// Id returns the ICMPv6 Id.
+func (indicator *ICMPv6Indicator) Id() uint16 {
+	return binary.BigEndian.Uint16(indicator.layer.Payload[0:2])
+}
+
+// EmbIPv6Layer returns the embedded IPv6 layer.
+func (indicator *ICMPv6Indicator) EmbIPv6Layer() *layers.IPv6 {
+	return indicator.embIPv6Indicator.IPv6Layer()
+}
+
+// EmbIPv6Indicator returns the embedded IPv6 indicator.
+func (indicator *ICMPv6Indicator) EmbIPv6Indicator() *IPv6Indicator {
+	return indicator.embIPv6Indicator
+}
+
+// EmbSrcIP returns the embedded source IP.
+func (indicator *ICMPv6Indicator) EmbSrcIP() net.IP {
+	return indicator.EmbIPv6Layer().SrcIP
+}
+
+// EmbDstIP returns the embedded destination IP.
+func (indicator *ICMPv6Indicator) EmbDstIP() net.IP {
+	return indicator.EmbIPv6Layer().DstIP
+}
+
+// EmbTransportProtocol returns the protocol of the transport layer.
+func (indicator *ICMPv6Indicator) EmbTransportProtocol() gopacket.LayerType {
+	p, err := parseIPProtocol(indicator.embIPv6Indicator.Protocol())
+	if err != nil {
+		panic(err)
+	}
+
+	return p
+}
+
+// EmbTransportLayer returns the embedded transport layer.
+func (indicator *ICMPv6Indicator) EmbTransportLayer() gopacket.Layer {
+	return indicator.embTransportLayer
+}
+
+// EmbTCPLayer returns the embedded TCP layer.
+func (indicator *ICMPv6Indicator) EmbTCPLayer() *layers.TCP {
+	if indicator.EmbTransportLayer().LayerType() == layers.LayerTypeTCP {
+		return indicator.embTransportLayer.(*layers.TCP)
+	}
+
+	return nil
+}
+
+// EmbUDPLayer returns the embedded UDP layer.
+func (indicator *ICMPv6Indicator) EmbUDPLayer() *layers.UDP {
+	if indicator.EmbTransportLayer().LayerType() == layers.LayerTypeUDP {
+		return indicator.embTransportLayer.(*layers.UDP)
+	}
+
+	return nil
+}
+
+// EmbICMPv6Layer returns the embedded ICMPv6 layer.
+func (indicator *ICMPv6Indicator) EmbICMPv6Layer() *layers.ICMPv6 {
+	if indicator.EmbTransportLayer().LayerType() == layers.LayerTypeICMPv6 {
+		return indicator.embTransportLayer.(*layers.ICMPv6)
+	}
+
+	return nil
+}
+
+// NewEmbBody returns a copy of the message body of the embedded ICMPv6 query with the given Id.
+func (indicator *ICMPv6Indicator) NewEmbBody(id uint16) []byte {
+	if !indicator.IsEmbQuery() {
+		panic(errors.New("embedded icmpv6 error not support"))
+	}
+
+	body := make([]byte, len(indicator.EmbICMPv6Layer().Payload))
+	copy(body, indicator.EmbICMPv6Layer().Payload)
+	binary.BigEndian.PutUint16(body[0:2], id)
+
+	return body
+}
+
+// EmbId returns the embedded ICMPv6 Id.
+func (indicator *ICMPv6Indicator) EmbId() uint16 {
+	switch t := indicator.EmbTransportLayer().LayerType(); t {
+	case layers.LayerTypeICMPv6:
+		return binary.BigEndian.Uint16(indicator.EmbICMPv6Layer().Payload[0:2])
+	default:
+		panic(fmt.Errorf("transport layer type %s not support", t))
+	}
+}
+
+// EmbSrcPort returns the embedded source port.
+func (indicator *ICMPv6Indicator) EmbSrcPort() uint16 {
+	switch t := indicator.EmbTransportLayer().LayerType(); t {
+	case layers.LayerTypeTCP:
+		return uint16(indicator.EmbTCPLayer().SrcPort)
+	case layers.LayerTypeUDP:
+		return uint16(indicator.EmbUDPLayer().SrcPort)
+	default:
+		panic(fmt.Errorf("transport layer type %s not support", t))
+	}
+}
+
+// EmbDstPort returns the embedded destination port.
+func (indicator *ICMPv6Indicator) EmbDstPort() uint16 {
+	switch t := indicator.EmbTransportLayer().LayerType(); t {
+	case layers.LayerTypeTCP:
+		return uint16(indicator.EmbTCPLayer().DstPort)
+	case layers.LayerTypeUDP:
+		return uint16(indicator.EmbUDPLayer().DstPort)
+	default:
+		panic(fmt.Errorf("transport layer type %s not support", t))
+	}
+}
+
+// IsEmbQuery returns if the embedded ICMPv6 layer is a query.
+func (indicator *ICMPv6Indicator) IsEmbQuery() bool {
+	switch t := indicator.EmbICMPv6Layer().TypeCode.Type(); t {
+	case layers.ICMPv6TypeEchoRequest, layers.ICMPv6TypeEchoReply:
+		return true
+	default:
+		panic(fmt.Errorf("icmpv6 type %d not support", t))
+	}
+}
+
+// EmbSrc returns the embedded source.
+func (indicator *ICMPv6Indicator) EmbSrc() net.Addr {
+	if indicator.IsQuery() {
+		panic(errors.New("icmpv6 query not support"))
+	} else {
+		// Flip source and destination
+		switch t := indicator.EmbTransportLayer().LayerType(); t {
+		case layers.LayerTypeTCP:
+			return &net.TCPAddr{
+				IP:   indicator.EmbDstIP(),
+				Port: int(indicator.EmbDstPort()),
+			}
+		case layers.LayerTypeUDP:
+			return &net.UDPAddr{
+				IP:   indicator.EmbDstIP(),
+				Port: int(indicator.EmbDstPort()),
+			}
+		case layers.LayerTypeICMPv6:
+			return &addr.ICMPQueryAddr{
+				IP: indicator.EmbDstIP(),
+				Id: indicator.EmbId(),
+			}
+		default:
+			panic(fmt.Errorf("transport layer type %s not support", t))
+		}
+	}
+}
+
+// EmbDst returns the embedded destination.
+func (indicator *ICMPv6Indicator) EmbDst() net.Addr {
+	if indicator.IsQuery() {
+		panic(errors.New("icmpv6 query not support"))
+	} else {
+		// Flip source and destination
+		switch t := indicator.EmbTransportLayer().LayerType(); t {
+		case layers.LayerTypeTCP:
+			return &net.TCPAddr{
+				IP:   indicator.EmbSrcIP(),
+				Port: int(indicator.EmbSrcPort()),
+			}
+		case layers.LayerTypeUDP:
+			return &net.UDPAddr{
+				IP:   indicator.EmbSrcIP(),
+				Port: int(indicator.EmbSrcPort()),
+			}
+		case layers.LayerTypeICMPv6:
+			return &addr.ICMPQueryAddr{
+				IP: indicator.EmbSrcIP(),
+				Id: indicator.EmbId(),
+			}
+		default:
+			panic(fmt.Errorf("transport layer type %s not support", t))
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket/layers"
+)
+
+// IPv6Indicator indicates an IPv6 layer with its extension headers.
+type IPv6Indicator struct {
+	layer      *layers.IPv6
+	headers    []byte
+	protocol   layers.IPProtocol
+	payload    []byte
+	isFrag     bool
+	fragOffset uint16
+	moreFrags  bool
+	id         uint32
+}
+
+// ParseIPv6Layer parses an IPv6 layer, walks through its extension headers and returns an IPv6 indicator.
+func ParseIPv6Layer(layer *layers.IPv6) (*IPv6Indicator, error) {
+	indicator := &IPv6Indicator{
+		layer:    layer,
+		headers:  make([]byte, 0),
+		protocol: layer.NextHeader,
+		payload:  layer.Payload,
+	}
+
+	// Hop-by-hop options header is decoded as a part of the IPv6 layer
+	if layer.HopByHop != nil {
+		indicator.headers = append(indicator.headers, layer.HopByHop.Contents...)
+		indicator.protocol = layer.HopByHop.NextHeader
+	}
+
+	for {
+		var length int
+
+		switch indicator.protocol {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			if len(indicator.payload) < 2 {
+				return nil, fmt.Errorf("%s header too short", indicator.protocol)
+			}
+			length = (int(indicator.payload[1]) + 1) * 8
+		case layers.IPProtocolAH:
+			if len(indicator.payload) < 2 {
+				return nil, fmt.Errorf("%s header too short", indicator.protocol)
+			}
+			length = (int(indicator.payload[1]) + 2) * 4
+		case layers.IPProtocolIPv6Fragment:
+			length = 8
+		default:
+			return indicator, nil
+		}
+		if len(indicator.payload) < length {
+			return nil, fmt.Errorf("%s header too short", indicator.protocol)
+		}
+
+		header := indicator.payload[:length]
+		indicator.headers = append(indicator.headers, header...)
+		indicator.payload = indicator.payload[length:]
+
+		// Fragment header, contents following belong to the fragment
+		if indicator.protocol == layers.IPProtocolIPv6Fragment {
+			indicator.fragOffset = binary.BigEndian.Uint16(header[2:4]) >> 3
+			indicator.moreFrags = header[3]&0x1 != 0
+			indicator.id = binary.BigEndian.Uint32(header[4:8])
+			indicator.isFrag = indicator.fragOffset != 0 || indicator.moreFrags
+			indicator.protocol = layers.IPProtocol(header[0])
+
+			return indicator, nil
+		}
+
+		indicator.protocol = layers.IPProtocol(header[0])
+	}
+}
+
+// NewPureIPv6Layer returns a new IPv6 layer copied from the original IPv6 layer without extension headers except the
+// hop-by-hop options header.
+func (indicator *IPv6Indicator) NewPureIPv6Layer() *layers.IPv6 {
+	if indicator.isFrag {
+		panic(errors.New("ipv6 fragment not support"))
+	}
+
+	temp := *indicator.layer
+	newLayer := &temp
+
+	if newLayer.HopByHop != nil {
+		hopByHop := *newLayer.HopByHop
+		hopByHop.NextHeader = indicator.protocol
+		newLayer.HopByHop = &hopByHop
+	} else {
+		newLayer.NextHeader = indicator.protocol
+	}
+
+	return newLayer
+}
+
+// CreateIPv6FragmentHeader returns an IPv6 fragment header.
+func CreateIPv6FragmentHeader(nextHeader layers.IPProtocol, offset uint16, moreFrags bool, id uint32) []byte {
+	header := make([]byte, 8)
+
+	header[0] = byte(nextHeader)
+	binary.BigEndian.PutUint16(header[2:4], offset<<3)
+	if moreFrags {
+		header[3] = header[3] | 0x1
+	}
+	binary.BigEndian.PutUint32(header[4:8], id)
+
+	return header
+}
+
+// IPv6Layer returns the IPv6 layer.
+func (indicator *IPv6Indicator) IPv6Layer() *layers.IPv6 {
+	return indicator.layer
+}
+
+// Headers returns the contents of the extension headers.
+func (indicator *IPv6Indicator) Headers() []byte {
+	return indicator.headers
+}
+
+// Protocol returns the protocol following the extension headers.
+func (indicator *IPv6Indicator) Protocol() layers.IPProtocol {
+	return indicator.protocol
+}
+
+// Payload returns the payload following the extension headers.
+func (indicator *IPv6Indicator) Payload() []byte {
+	return indicator.payload
+}
+
+// IsFrag returns if the packet is a fragment.
+func (indicator *IPv6Indicator) IsFrag() bool {
+	return indicator.isFrag
+}
+
+// FragOffset returns the fragment offset.
+func (indicator *IPv6Indicator) FragOffset() uint16 {
+	return indicator.fragOffset
+}
+
+// MoreFragments returns if more fragments follow.
+func (indicator *IPv6Indicator) MoreFragments() bool {
+	return indicator.moreFrags
+}
+
+// Id returns the identification in the fragment header.
+func (indicator *IPv6Indicator) Id() uint32 {
+	return indicator.id
+}
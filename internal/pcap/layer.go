@@ -5,6 +5,7 @@
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"net"
+	"sync"
 )
 
 // CreateTCPLayer returns a TCP layer.
@@ -80,6 +81,44 @@ func CreateIPv4Layer(srcIP, dstIP net.IP, id uint16, ttl uint8, transportLayer g
 	return ipv4Layer, nil
 }
 
+// CreateIPv6Layer returns an IPv6 layer.
+func CreateIPv6Layer(srcIP, dstIP net.IP, hopLimit uint8, transportLayer gopacket.TransportLayer) (*layers.IPv6, error) {
+	ipv6Layer := &layers.IPv6{
+		Version: 6,
+		// Length: 0,
+		// NextHeader: 0,
+		HopLimit: hopLimit,
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
+	}
+
+	// Next header
+	switch t := transportLayer.LayerType(); t {
+	case layers.LayerTypeTCP:
+		ipv6Layer.NextHeader = layers.IPProtocolTCP
+
+		// Checksum of transport layer
+		tcpLayer := transportLayer.(*layers.TCP)
+		err := tcpLayer.SetNetworkLayerForChecksum(ipv6Layer)
+		if err != nil {
+			return nil, fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	case layers.LayerTypeUDP:
+		ipv6Layer.NextHeader = layers.IPProtocolUDP
+
+		// Checksum of transport layer
+		udpLayer := transportLayer.(*layers.UDP)
+		err := udpLayer.SetNetworkLayerForChecksum(ipv6Layer)
+		if err != nil {
+			return nil, fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("transport layer type %s not support", t)
+	}
+
+	return ipv6Layer, nil
+}
+
 // FlagIPv4Layer reflags flags in an IPv4 layer.
 func FlagIPv4Layer(layer *layers.IPv4, df, mf bool, offset uint16) {
 	if df {
@@ -95,13 +134,26 @@ func FlagIPv4Layer(layer *layers.IPv4, df, mf bool, offset uint16) {
 	layer.FragOffset = offset
 }
 
+// CopiedIPv4Options returns IPv4 options which are flagged copied, these options will be kept in all fragments.
+func CopiedIPv4Options(options []layers.IPv4Option) []layers.IPv4Option {
+	result := make([]layers.IPv4Option, 0)
+
+	for _, option := range options {
+		if option.OptionType&0x80 != 0 {
+			result = append(result, option)
+		}
+	}
+
+	return result
+}
+
 // CreateLoopbackLayer returns a loopback layer.
 func CreateLoopbackLayer() *layers.Loopback {
 	return &layers.Loopback{}
 }
 
-// CreateEthernetLayer returns an Ethernet layer.
-func CreateEthernetLayer(srcMAC, dstMAC net.HardwareAddr, networkLayer gopacket.NetworkLayer) (*layers.Ethernet, error) {
+// CreateEthernetLayer returns an Ethernet layer, which is encapsulated if the encapsulation is given.
+func CreateEthernetLayer(srcMAC, dstMAC net.HardwareAddr, encap *Encap, networkLayer gopacket.NetworkLayer) (gopacket.Layer, error) {
 	ethernetLayer := &layers.Ethernet{
 		SrcMAC: srcMAC,
 		DstMAC: dstMAC,
@@ -112,44 +164,84 @@ func CreateEthernetLayer(srcMAC, dstMAC net.HardwareAddr, networkLayer gopacket.
 	switch t := networkLayer.LayerType(); t {
 	case layers.LayerTypeIPv4:
 		ethernetLayer.EthernetType = layers.EthernetTypeIPv4
+	case layers.LayerTypeIPv6:
+		ethernetLayer.EthernetType = layers.EthernetTypeIPv6
 	default:
 		return nil, fmt.Errorf("network layer type %s not support", t)
 	}
 
+	// Encapsulation
+	if encap != nil {
+		return &EncapEthernet{Ethernet: ethernetLayer, Encap: encap}, nil
+	}
+
 	return ethernetLayer, nil
 }
 
-// Serialize serializes layers to byte array.
+// serializeBuffers reuses serialize buffers, which have room for headers of all layers and a payload in common MTUs,
+// so they rarely grow while serializing. Buffers grown by large packets are reused as well.
+var serializeBuffers = sync.Pool{
+	New: func() interface{} {
+		return gopacket.NewSerializeBufferExpectedSize(128, 2048)
+	},
+}
+
+// Serialize serializes layers to byte array, nil layers are skipped.
 func Serialize(layers ...gopacket.SerializableLayer) ([]byte, error) {
 	// Recalculate checksum and length
-	options := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
-	buffer := gopacket.NewSerializeBuffer()
+	return serialize(gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}, layers)
+}
 
-	err := gopacket.SerializeLayers(buffer, options, layers...)
+// SerializeRaw serializes layers to byte array without computing checksums and updating lengths, nil layers are
+// skipped.
+func SerializeRaw(layers ...gopacket.SerializableLayer) ([]byte, error) {
+	return serialize(gopacket.SerializeOptions{}, layers)
+}
+
+func serialize(options gopacket.SerializeOptions, layers []gopacket.SerializableLayer) ([]byte, error) {
+	buffer := serializeBuffers.Get().(gopacket.SerializeBuffer)
+	defer serializeBuffers.Put(buffer)
+
+	err := gopacket.SerializeLayers(buffer, options, skipNilLayers(layers)...)
 	if err != nil {
 		return nil, err
 	}
 
-	return buffer.Bytes(), nil
+	// The buffer is reused, so the result is copied out in its exact size
+	b := buffer.Bytes()
+	result := make([]byte, len(b))
+	copy(result, b)
+
+	return result, nil
 }
 
-// SerializeRaw serializes layers to byte array without computing checksums and updating lengths.
-func SerializeRaw(layers ...gopacket.SerializableLayer) ([]byte, error) {
-	// Recalculate checksum and length
-	options := gopacket.SerializeOptions{}
-	buffer := gopacket.NewSerializeBuffer()
+func skipNilLayers(layers []gopacket.SerializableLayer) []gopacket.SerializableLayer {
+	// Layers are used as they are if none is nil
+	isNil := false
+	for _, layer := range layers {
+		if layer == nil {
+			isNil = true
+			break
+		}
+	}
+	if !isNil {
+		return layers
+	}
 
-	err := gopacket.SerializeLayers(buffer, options, layers...)
-	if err != nil {
-		return nil, err
+	result := make([]gopacket.SerializableLayer, 0, len(layers))
+
+	for _, layer := range layers {
+		if layer != nil {
+			result = append(result, layer)
+		}
 	}
 
-	return buffer.Bytes(), nil
+	return result
 }
 
 // CreateLayers return layers of transmission between client and server.
 func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP net.IP, id uint16, hop uint8,
-	dstHardwareAddr net.HardwareAddr) (transportLayer, networkLayer, linkLayer gopacket.SerializableLayer, err error) {
+	dstHardwareAddr net.HardwareAddr, encap *Encap) (transportLayer, networkLayer, linkLayer gopacket.SerializableLayer, err error) {
 	var (
 		linkLayerType gopacket.LayerType
 	)
@@ -158,11 +250,24 @@ func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP
 	transportLayer = CreateTCPLayer(srcPort, dstPort, seq, ack)
 
 	// Create new network layer
-	networkLayer, err = CreateIPv4Layer(conn.LocalDev().IPAddr().IP, dstIP, id, hop-1, transportLayer.(gopacket.TransportLayer))
+	srcIP := conn.LocalDev().IPAddrByFamily(dstIP)
+	if srcIP == nil {
+		return nil, nil, nil, fmt.Errorf("create network layer: no address in the same family as %s", dstIP)
+	}
+	if dstIP.To4() != nil {
+		networkLayer, err = CreateIPv4Layer(srcIP.IP, dstIP, id, hop-1, transportLayer.(gopacket.TransportLayer))
+	} else {
+		networkLayer, err = CreateIPv6Layer(srcIP.IP, dstIP, hop-1, transportLayer.(gopacket.TransportLayer))
+	}
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("create network layer: %w", err)
 	}
 
+	// TUN devices have no link layer
+	if conn.IsTun() {
+		return transportLayer, networkLayer, nil, nil
+	}
+
 	// Decide Loopback or Ethernet
 	if conn.IsLoop() {
 		linkLayerType = layers.LayerTypeLoopback
@@ -175,7 +280,11 @@ func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP
 	case layers.LayerTypeLoopback:
 		linkLayer = CreateLoopbackLayer()
 	case layers.LayerTypeEthernet:
-		linkLayer, err = CreateEthernetLayer(conn.LocalDev().HardwareAddr(), dstHardwareAddr, networkLayer.(gopacket.NetworkLayer))
+		var layer gopacket.Layer
+		layer, err = CreateEthernetLayer(conn.LocalDev().HardwareAddr(), dstHardwareAddr, encap, networkLayer.(gopacket.NetworkLayer))
+		if err == nil {
+			linkLayer = layer.(gopacket.SerializableLayer)
+		}
 	default:
 		return nil, nil, nil, fmt.Errorf("link layer type %s not support", linkLayerType)
 	}
@@ -0,0 +1,228 @@
+// +build !nopcap
+
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"net"
+)
+
+// hasLibpcap is if packets are captured and injected by libpcap, or by raw sockets without it.
+const hasLibpcap = true
+
+// Classic BPF instructions rewritten in chaining programs
+const (
+	bpfJA   = 0x05
+	bpfRetK = 0x06
+)
+
+const flagPcapLoopback = 1
+
+type direction = pcap.Direction
+
+const (
+	directionIn    = pcap.DirectionIn
+	directionInOut = pcap.DirectionInOut
+)
+
+func newMatcher(linkType layers.LinkType, filter string) (matcher, error) {
+	return pcap.NewBPF(linkType, maxSnapLen, filter)
+}
+
+func findPcapDevs() ([]pcapDev, error) {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]pcapDev, 0, len(devs))
+	for _, dev := range devs {
+		ips := make([]net.IP, 0, len(dev.Addresses))
+		for _, a := range dev.Addresses {
+			ips = append(ips, a.IP)
+		}
+
+		result = append(result, pcapDev{name: dev.Name, isLoop: dev.Flags&flagPcapLoopback != 0, ips: ips})
+	}
+
+	return result, nil
+}
+
+// pcapHandle is a handle of libpcap which retries reading when the timeout expires.
+type pcapHandle struct {
+	*pcap.Handle
+}
+
+func (h *pcapHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	for {
+		data, ci, err = h.Handle.ReadPacketData()
+		if err != pcap.NextErrorTimeoutExpired {
+			return
+		}
+	}
+}
+
+func openLive(dev string) (*pcap.Handle, error) {
+	inactive, err := pcap.NewInactiveHandle(dev)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	// Packets of the MTU are captured in full
+	mtu := DefaultMTU
+	inter, err := net.InterfaceByName(dev)
+	if err == nil && inter.MTU > 0 {
+		mtu = inter.MTU
+		if mtu > MaxMTU {
+			mtu = MaxMTU
+		}
+	}
+	if snapLen() < MinSnapLen(mtu) {
+		return nil, fmt.Errorf("snap length %d less than mtu %d and link layers", snapLen(), mtu)
+	}
+
+	err = inactive.SetSnapLen(snapLen())
+	if err != nil {
+		return nil, fmt.Errorf("set snap len: %w", err)
+	}
+
+	err = inactive.SetPromisc(true)
+	if err != nil {
+		return nil, fmt.Errorf("set promisc: %w", err)
+	}
+
+	timeout := pcap.BlockForever
+	if pcapOptions.Timeout > 0 {
+		timeout = pcapOptions.Timeout
+	}
+	err = inactive.SetTimeout(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("set timeout: %w", err)
+	}
+
+	if pcapOptions.IsImmediate || isBusyPoll {
+		err = inactive.SetImmediateMode(true)
+		if err != nil {
+			return nil, fmt.Errorf("set immediate mode: %w", err)
+		}
+	}
+
+	if pcapOptions.BufferSize > 0 {
+		err = inactive.SetBufferSize(pcapOptions.BufferSize)
+		if err != nil {
+			return nil, fmt.Errorf("set buffer size: %w", err)
+		}
+	}
+
+	return inactive.Activate()
+}
+
+// compileEncapFilter returns the program of the filter for Ethernet frames, which accepts frames encapsulated in
+// 802.1Q, PPPoE or both. Programs of encapsulations are chained, and a frame rejected by one program falls through to
+// the next one.
+func compileEncapFilter(filter string) ([]pcap.BPFInstruction, error) {
+	filters := encapBPFFilters(filter)
+
+	result := make([]pcap.BPFInstruction, 0)
+	for i, f := range filters {
+		insts, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, maxSnapLen, f)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, chainBPF(insts, i == len(filters)-1)...)
+	}
+
+	return result, nil
+}
+
+// chainBPF returns the program which jumps to the end of it instead of rejecting, so the program following it runs,
+// unless it is the last one.
+func chainBPF(insts []pcap.BPFInstruction, isLast bool) []pcap.BPFInstruction {
+	result := make([]pcap.BPFInstruction, 0, len(insts))
+	for i, inst := range insts {
+		if !isLast && inst.Code == bpfRetK && inst.K == 0 {
+			inst = pcap.BPFInstruction{Code: bpfJA, K: uint32(len(insts) - i - 1)}
+		}
+		result = append(result, inst)
+	}
+
+	return result
+}
+
+func createPureRawConn(dev, filter string) (*RawConn, error) {
+	handle, err := openLive(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	// Frames on trunked or PPPoE interfaces may be encapsulated
+	if handle.LinkType() == layers.LinkTypeEthernet {
+		var insts []pcap.BPFInstruction
+		insts, err = compileEncapFilter(filter)
+		if err == nil {
+			err = handle.SetBPFInstructionFilter(insts)
+		}
+	} else {
+		err = handle.SetBPFFilter(filter)
+	}
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	return &RawConn{
+		handle: &pcapHandle{Handle: handle},
+	}, nil
+}
+
+// Reader is a reader reads packets from a pcap file.
+type Reader struct {
+	handle *pcap.Handle
+	ps     *gopacket.PacketSource
+}
+
+// CreateReader creates a reader reading a pcap file.
+func CreateReader(file string) (*Reader, error) {
+	handle, err := pcap.OpenOffline(file)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := gopacket.NewPacketSource(handle, handle.LinkType())
+
+	return &Reader{
+		handle: handle,
+		ps:     ps,
+	}, nil
+}
+
+func (r *Reader) Read(b []byte) (n int, err error) {
+	packet, err := r.ReadPacket()
+	if err != nil {
+		return 0, err
+	}
+
+	copy(b, packet.Data())
+
+	return len(packet.Data()), nil
+}
+
+func (r *Reader) ReadPacket() (gopacket.Packet, error) {
+	packet, err := r.ps.NextPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+func (r *Reader) Close() error {
+	r.handle.Close()
+
+	return nil
+}
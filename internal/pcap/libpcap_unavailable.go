@@ -0,0 +1,84 @@
+// +build nopcap
+
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+)
+
+// hasLibpcap is if packets are captured and injected by libpcap, or by raw sockets without it.
+const hasLibpcap = false
+
+type direction uint8
+
+const (
+	directionIn direction = iota + 1
+	directionOut
+	directionInOut
+)
+
+func newMatcher(linkType layers.LinkType, filter string) (matcher, error) {
+	return newFilterMatcher(linkType, filter)
+}
+
+func findPcapDevs() ([]pcapDev, error) {
+	inters, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]pcapDev, 0, len(inters))
+	for _, inter := range inters {
+		addrs, err := inter.Addrs()
+		if err != nil {
+			continue
+		}
+
+		ips := make([]net.IP, 0, len(addrs))
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if ok {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+
+		result = append(result, pcapDev{name: inter.Name, isLoop: inter.Flags&net.FlagLoopback != 0, ips: ips})
+	}
+
+	return result, nil
+}
+
+func createPureRawConn(dev, filter string) (*RawConn, error) {
+	handle, err := createRawSocketHandle(dev, filter)
+	if err != nil {
+		return nil, fmt.Errorf("create raw socket: %w", err)
+	}
+
+	return &RawConn{
+		handle: handle,
+	}, nil
+}
+
+// Reader is a reader reads packets from a pcap file.
+type Reader struct{}
+
+// CreateReader creates a reader reading a pcap file.
+func CreateReader(file string) (*Reader, error) {
+	return nil, errors.New("pcap file not support without libpcap")
+}
+
+func (r *Reader) Read(b []byte) (n int, err error) {
+	return 0, errors.New("pcap file not support without libpcap")
+}
+
+func (r *Reader) ReadPacket() (gopacket.Packet, error) {
+	return nil, errors.New("pcap file not support without libpcap")
+}
+
+func (r *Reader) Close() error {
+	return nil
+}
@@ -0,0 +1,122 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// duplicateHeader is the first byte of a duplicate in multipath, which is not a version of IP, so duplicates are
+	// told from packets in the tunnel.
+	duplicateHeader = 0xd0
+	// duplicateHeaderSize is the size of the header of a duplicate, which is the first byte, the ID of the client and
+	// the sequence number.
+	duplicateHeaderSize = 13
+	// dedupWindowSize is the number of sequence numbers behind the highest one a window of deduplication accepts.
+	dedupWindowSize = 1024
+	// dedupClients is the number of clients a deduplicator keeps windows for.
+	dedupClients = 256
+)
+
+// EncodeDuplicate prefixes the packet with the ID of the client and its sequence number, so copies of the packet sent
+// through different paths are told by the peer.
+func EncodeDuplicate(id uint32, seq uint64, data []byte) []byte {
+	result := make([]byte, duplicateHeaderSize, duplicateHeaderSize+len(data))
+	result[0] = duplicateHeader
+	binary.BigEndian.PutUint32(result[1:], id)
+	binary.BigEndian.PutUint64(result[5:], seq)
+
+	return append(result, data...)
+}
+
+// DecodeDuplicate returns the ID of the client, the sequence number and the packet of a duplicate encoded by
+// EncodeDuplicate, and false if the contents are not a duplicate.
+func DecodeDuplicate(contents []byte) (uint32, uint64, []byte, bool) {
+	if len(contents) < duplicateHeaderSize || contents[0] != duplicateHeader {
+		return 0, 0, nil, false
+	}
+
+	return binary.BigEndian.Uint32(contents[1:]), binary.BigEndian.Uint64(contents[5:]), contents[duplicateHeaderSize:], true
+}
+
+// dedupWindow describes a sliding window of sequence numbers received from a client.
+type dedupWindow struct {
+	top    uint64
+	bitmap [dedupWindowSize / 64]uint64
+}
+
+// accept returns if the sequence number is neither received nor behind the window, and marks it received.
+func (w *dedupWindow) accept(seq uint64) bool {
+	// Slide forward
+	if seq > w.top {
+		if seq-w.top >= dedupWindowSize {
+			w.bitmap = [dedupWindowSize / 64]uint64{}
+		} else {
+			for i := w.top + 1; i <= seq; i++ {
+				w.bitmap[(i/64)%uint64(len(w.bitmap))] &^= 1 << (i % 64)
+			}
+		}
+		w.top = seq
+	} else if w.top-seq >= dedupWindowSize {
+		// Stale
+		return false
+	}
+
+	index, bit := (seq/64)%uint64(len(w.bitmap)), uint64(1)<<(seq%64)
+	if w.bitmap[index]&bit != 0 {
+		return false
+	}
+	w.bitmap[index] |= bit
+
+	return true
+}
+
+// Deduplicator describes deduplication of duplicates in multipath by their sequence numbers, where the first copy of
+// a packet wins and later copies are dropped. Each client has its own window.
+type Deduplicator struct {
+	drops   uint64
+	lock    sync.Mutex
+	windows map[uint32]*dedupWindow
+	ids     []uint32
+}
+
+// NewDeduplicator returns a new deduplicator.
+func NewDeduplicator() *Deduplicator {
+	return &Deduplicator{
+		windows: make(map[uint32]*dedupWindow),
+		ids:     make([]uint32, 0),
+	}
+}
+
+// Accept returns if the copy of the sequence number from the client of the ID is the first one. Later copies are
+// counted as drops.
+func (d *Deduplicator) Accept(id uint32, seq uint64) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	w, ok := d.windows[id]
+	if !ok {
+		// Evict the oldest client
+		if len(d.ids) >= dedupClients {
+			delete(d.windows, d.ids[0])
+			d.ids = d.ids[1:]
+		}
+
+		w = &dedupWindow{}
+		d.windows[id] = w
+		d.ids = append(d.ids, id)
+	}
+
+	if !w.accept(seq) {
+		atomic.AddUint64(&d.drops, 1)
+		return false
+	}
+
+	return true
+}
+
+// Drops returns the number of copies dropped.
+func (d *Deduplicator) Drops() uint64 {
+	return atomic.LoadUint64(&d.drops)
+}
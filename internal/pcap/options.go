@@ -0,0 +1,50 @@
+package pcap
+
+import "time"
+
+// PcapOptions describes how handles of libpcap are opened.
+type PcapOptions struct {
+	// SnapLen is the max size of each packet captured, 0 as default.
+	SnapLen int
+	// BufferSize is the size of the buffer in Bytes, 0 as the default of libpcap.
+	BufferSize int
+	// IsImmediate is if packets are delivered as soon as they arrive rather than when the buffer is full.
+	IsImmediate bool
+	// Timeout is the duration the buffer is waited for before packets are delivered, 0 as default.
+	Timeout time.Duration
+}
+
+var pcapOptions PcapOptions
+
+// SetPcapOptions sets the options of libpcap, devices opened later will use the options. They do not work without
+// libpcap.
+func SetPcapOptions(options PcapOptions) {
+	pcapOptions = options
+}
+
+var isBusyPoll bool
+
+// SetBusyPoll sets handles opened later to busy poll, where readers spin on checking for packets rather than sleep
+// until packets arrive, which gives the lowest latency at the cost of a CPU for each reader. Libpcap can only wait in
+// itself, so it is set to immediate mode instead.
+func SetBusyPoll(busyPoll bool) {
+	isBusyPoll = busyPoll
+}
+
+// pollTimeout returns the timeout in milliseconds readers wait for packets in poll, which is 0 in busy poll.
+func pollTimeout(period int) int {
+	if isBusyPoll {
+		return 0
+	}
+
+	return period
+}
+
+// snapLen returns the max size of each packet captured.
+func snapLen() int {
+	if pcapOptions.SnapLen > 0 {
+		return pcapOptions.SnapLen
+	}
+
+	return maxSnapLen
+}
@@ -0,0 +1,146 @@
+package pcap
+
+import (
+	"fmt"
+	"ikago/internal/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// pacedBacklog is the duration of traffic a pacer queues at most, beyond which writes are dropped.
+const pacedBacklog = 100 * time.Millisecond
+
+type pacedWrite struct {
+	b    []byte
+	addr net.Addr
+}
+
+// pacer spaces segments sent at a rate, and aggregates small writes queued meanwhile into one segment, like a
+// congestion-controlled TCP sender does. Segments are also delayed by the obfuscator, so writers never wait for it.
+type pacer struct {
+	// rate is the pacing rate in Bytes per second, 0 as unlimited.
+	rate int
+	// size is the size of payload of a segment at most.
+	size     int
+	lock     sync.Mutex
+	cond     *sync.Cond
+	queue    []pacedWrite
+	queued   int
+	isClosed bool
+	// delay returns the duration to wait before the next segment is sent.
+	delay func() time.Duration
+	// write sends a segment, psh is if the queue is drained by it.
+	write func(b []byte, addr net.Addr, psh bool) error
+}
+
+// newPacer returns a new pacer with the pacing rate in Kbps, 0 as unlimited, which starts sending segments by the given
+// function after delays of the given function.
+func newPacer(rate, size int, delay func() time.Duration, write func(b []byte, addr net.Addr, psh bool) error) *pacer {
+	p := &pacer{
+		rate:  rate * 1000 / 8,
+		size:  size,
+		queue: make([]pacedWrite, 0),
+		delay: delay,
+		write: write,
+	}
+	p.cond = sync.NewCond(&p.lock)
+
+	go p.run()
+
+	return p
+}
+
+// push queues a write to the address, and returns false if it is dropped for the queue is full.
+func (p *pacer) push(b []byte, addr net.Addr) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	limit := int(int64(p.rate) * int64(pacedBacklog) / int64(time.Second))
+	if limit < 16*p.size {
+		limit = 16 * p.size
+	}
+	if p.isClosed || p.queued+len(b) > limit {
+		return false
+	}
+
+	newB := make([]byte, len(b))
+	copy(newB, b)
+	p.queue = append(p.queue, pacedWrite{b: newB, addr: addr})
+	p.queued = p.queued + len(b)
+	p.cond.Signal()
+
+	return true
+}
+
+func (p *pacer) run() {
+	next := time.Now()
+
+	for {
+		p.lock.Lock()
+		for len(p.queue) <= 0 && !p.isClosed {
+			p.cond.Wait()
+		}
+		if p.isClosed {
+			p.lock.Unlock()
+			return
+		}
+		p.lock.Unlock()
+
+		// Wait for the pace and the delay, while writes are queued
+		duration := next.Sub(time.Now())
+		if duration < 0 {
+			duration = 0
+		}
+		duration = duration + p.delay()
+		if duration > 0 {
+			time.Sleep(duration)
+		}
+
+		// Aggregate writes to the same address
+		p.lock.Lock()
+		if p.isClosed {
+			p.lock.Unlock()
+			return
+		}
+		first := p.queue[0]
+		b := first.b
+		i := 1
+		for ; i < len(p.queue); i++ {
+			if p.queue[i].addr.String() != first.addr.String() || len(b)+len(p.queue[i].b) > p.size {
+				break
+			}
+			b = append(b, p.queue[i].b...)
+		}
+		p.queue = p.queue[i:]
+		p.queued = p.queued - len(b)
+		psh := len(p.queue) <= 0
+		p.lock.Unlock()
+
+		err := p.write(b, first.addr, psh)
+		if err != nil {
+			log.Errorln(fmt.Errorf("pace: %w", err))
+		}
+
+		// Next segment, idle time is not accumulated as burst
+		if p.rate <= 0 {
+			continue
+		}
+		t := time.Now()
+		if next.Before(t) {
+			next = t
+		}
+		next = next.Add(time.Duration(int64(len(b)) * int64(time.Second) / int64(p.rate)))
+	}
+}
+
+// close stops the pacer, and drops writes queued.
+func (p *pacer) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.isClosed = true
+	p.queue = nil
+	p.queued = 0
+	p.cond.Broadcast()
+}
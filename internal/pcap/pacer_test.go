@@ -0,0 +1,63 @@
+package pcap
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPacerDelay queues writes delayed by the obfuscator without pacing, where writers never wait for delays.
+func TestPacerDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	var (
+		lock    sync.Mutex
+		written [][]byte
+	)
+	done := make(chan struct{}, 16)
+	p := newPacer(0, 1000, func() time.Duration {
+		return delay
+	}, func(b []byte, addr net.Addr, psh bool) error {
+		lock.Lock()
+		written = append(written, append([]byte(nil), b...))
+		lock.Unlock()
+		done <- struct{}{}
+
+		return nil
+	})
+	defer p.close()
+
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 40000}
+
+	start := time.Now()
+	for _, b := range []string{"a", "b", "c"} {
+		if !p.push([]byte(b), addr) {
+			t.Fatalf("push %s: dropped", b)
+		}
+	}
+	if d := time.Since(start); d >= delay {
+		t.Fatalf("push waited for %s", d)
+	}
+
+	// Delayed, and aggregated while queued
+	received := 0
+	for received < 3 {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("no write")
+		}
+
+		lock.Lock()
+		received = len(bytes.Join(written, nil))
+		lock.Unlock()
+	}
+	if d := time.Since(start); d < delay {
+		t.Errorf("written after %s, want delay %s", d, delay)
+	}
+	if !bytes.Equal(bytes.Join(written, nil), []byte("abc")) {
+		t.Errorf("written %q, want %q", bytes.Join(written, nil), "abc")
+	}
+}
@@ -25,6 +25,8 @@ type ConnBytes struct {
 	Conn net.Conn
 	// Destick is the desticker of the connection.
 	Destick *Desticker
+	// Defrag is the defragmenter of the connection.
+	Defrag *EasyDefragmenter
 }
 
 // NATGuide describes simplified information about a NAT.
@@ -35,13 +37,40 @@ type NATGuide struct {
 	Protocol gopacket.LayerType
 }
 
+// Flow returns the flow of the packet in fields of addresses, ports and the protocol, for structured logging.
+func Flow(packet gopacket.Packet) map[string]interface{} {
+	result := make(map[string]interface{})
+
+	networkLayer := packet.NetworkLayer()
+	if networkLayer == nil {
+		return result
+	}
+	src, dst := networkLayer.NetworkFlow().Endpoints()
+	result["src"], result["dst"] = src.String(), dst.String()
+
+	transportLayer := packet.TransportLayer()
+	if transportLayer == nil {
+		result["protocol"] = networkLayer.LayerType().String()
+		return result
+	}
+	srcPort, dstPort := transportLayer.TransportFlow().Endpoints()
+	result["srcPort"], result["dstPort"] = srcPort.String(), dstPort.String()
+	result["protocol"] = transportLayer.LayerType().String()
+
+	return result
+}
+
 // PacketIndicator indicates a packet.
 type PacketIndicator struct {
 	packet           gopacket.Packet
+	contents         []byte
 	linkLayer        gopacket.Layer
+	encap            *Encap
 	networkLayer     gopacket.Layer
+	ipv6Indicator    *IPv6Indicator
 	transportLayer   gopacket.Layer
 	icmpv4Indicator  *ICMPv4Indicator
+	icmpv6Indicator  *ICMPv6Indicator
 	applicationLayer gopacket.ApplicationLayer
 	dnsIndicator     *DNSIndicator
 }
@@ -56,8 +85,46 @@ func (indicator *PacketIndicator) LinkLayerType() gopacket.LayerType {
 	return indicator.linkLayer.LayerType()
 }
 
+// Encap returns the encapsulation between the link layer and the network layer, or nil if there is none.
+func (indicator *PacketIndicator) Encap() *Encap {
+	return indicator.encap
+}
+
+// SerializableLinkLayer returns the link layer which can be serialized, the encapsulation is kept.
+func (indicator *PacketIndicator) SerializableLinkLayer() gopacket.SerializableLayer {
+	if indicator.linkLayer == nil {
+		return nil
+	}
+	if indicator.encap != nil {
+		ethernetLayer := *indicator.linkLayer.(*layers.Ethernet)
+		ethernetLayer.EthernetType = indicator.NetworkLayerEthernetType()
+
+		return &EncapEthernet{Ethernet: &ethernetLayer, Encap: indicator.encap}
+	}
+
+	return indicator.linkLayer.(gopacket.SerializableLayer)
+}
+
+// NetworkLayerEthernetType returns the Ethernet type of the network layer.
+func (indicator *PacketIndicator) NetworkLayerEthernetType() layers.EthernetType {
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		return layers.EthernetTypeIPv4
+	case layers.LayerTypeIPv6:
+		return layers.EthernetTypeIPv6
+	case layers.LayerTypeARP:
+		return layers.EthernetTypeARP
+	default:
+		panic(fmt.Errorf("network layer type %s not support", t))
+	}
+}
+
 // SrcHardwareAddr returns the source hardware address.
 func (indicator *PacketIndicator) SrcHardwareAddr() net.HardwareAddr {
+	if indicator.linkLayer == nil {
+		return nil
+	}
+
 	switch t := indicator.LinkLayerType(); t {
 	case layers.LayerTypeLoopback:
 		return nil
@@ -70,6 +137,10 @@ func (indicator *PacketIndicator) SrcHardwareAddr() net.HardwareAddr {
 
 // DstHardwareAddr returns the destination hardware address.
 func (indicator *PacketIndicator) DstHardwareAddr() net.HardwareAddr {
+	if indicator.linkLayer == nil {
+		return nil
+	}
+
 	switch t := indicator.LinkLayerType(); t {
 	case layers.LayerTypeLoopback:
 		return nil
@@ -94,6 +165,20 @@ func (indicator *PacketIndicator) IPv4Layer() *layers.IPv4 {
 	return nil
 }
 
+// IPv6Layer returns the IPv6 layer.
+func (indicator *PacketIndicator) IPv6Layer() *layers.IPv6 {
+	if indicator.NetworkLayer().LayerType() == layers.LayerTypeIPv6 {
+		return indicator.networkLayer.(*layers.IPv6)
+	}
+
+	return nil
+}
+
+// IPv6Indicator returns the IPv6 indicator.
+func (indicator *PacketIndicator) IPv6Indicator() *IPv6Indicator {
+	return indicator.ipv6Indicator
+}
+
 // ARPLayer returns the ARP layer.
 func (indicator *PacketIndicator) ARPLayer() *layers.ARP {
 	if indicator.NetworkLayer().LayerType() == layers.LayerTypeARP {
@@ -108,6 +193,8 @@ func (indicator *PacketIndicator) SrcIP() net.IP {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().SrcIP
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().SrcIP
 	case layers.LayerTypeARP:
 		return indicator.ARPLayer().SourceProtAddress
 	default:
@@ -120,6 +207,8 @@ func (indicator *PacketIndicator) DstIP() net.IP {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().DstIP
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().DstIP
 	case layers.LayerTypeARP:
 		return indicator.ARPLayer().DstProtAddress
 	default:
@@ -127,21 +216,25 @@ func (indicator *PacketIndicator) DstIP() net.IP {
 	}
 }
 
-// TTL returns the TTL.
+// TTL returns the TTL, or the hop limit in IPv6.
 func (indicator *PacketIndicator) TTL() uint8 {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().TTL
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().HopLimit
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
 }
 
-// Id returns the Id in the network layer.
-func (indicator *PacketIndicator) NetworkId() uint16 {
+// NetworkId returns the Id in the network layer.
+func (indicator *PacketIndicator) NetworkId() uint32 {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
-		return indicator.IPv4Layer().Id
+		return uint32(indicator.IPv4Layer().Id)
+	case layers.LayerTypeIPv6:
+		return indicator.ipv6Indicator.Id()
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -158,6 +251,8 @@ func (indicator *PacketIndicator) IsFrag() bool {
 		}
 
 		return ipv4Layer.FragOffset != 0
+	case layers.LayerTypeIPv6:
+		return indicator.ipv6Indicator.IsFrag()
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -168,6 +263,8 @@ func (indicator *PacketIndicator) FragOffset() uint16 {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().FragOffset
+	case layers.LayerTypeIPv6:
+		return indicator.ipv6Indicator.FragOffset()
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -178,6 +275,20 @@ func (indicator *PacketIndicator) MoreFragments() bool {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().Flags&layers.IPv4MoreFragments != 0
+	case layers.LayerTypeIPv6:
+		return indicator.ipv6Indicator.MoreFragments()
+	default:
+		panic(fmt.Errorf("network layer type %s not support", t))
+	}
+}
+
+// DontFragment returns if the packet should not be fragmented.
+func (indicator *PacketIndicator) DontFragment() bool {
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		return indicator.IPv4Layer().Flags&layers.IPv4DontFragment != 0
+	case layers.LayerTypeIPv6:
+		return true
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -192,6 +303,13 @@ func (indicator *PacketIndicator) TransportProtocol() gopacket.LayerType {
 			panic(err)
 		}
 
+		return p
+	case layers.LayerTypeIPv6:
+		p, err := parseIPProtocol(indicator.ipv6Indicator.Protocol())
+		if err != nil {
+			panic(err)
+		}
+
 		return p
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
@@ -226,6 +344,11 @@ func (indicator *PacketIndicator) ICMPv4Indicator() *ICMPv4Indicator {
 	return indicator.icmpv4Indicator
 }
 
+// ICMPv6Indicator returns the ICMPv6 indicator.
+func (indicator *PacketIndicator) ICMPv6Indicator() *ICMPv6Indicator {
+	return indicator.icmpv6Indicator
+}
+
 // SrcPort returns the source port.
 func (indicator *PacketIndicator) SrcPort() uint16 {
 	switch t := indicator.TransportLayer().LayerType(); t {
@@ -312,6 +435,15 @@ func (indicator *PacketIndicator) NATSrc() net.Addr {
 		}
 
 		return indicator.icmpv4Indicator.EmbSrc()
+	case layers.LayerTypeICMPv6:
+		if indicator.icmpv6Indicator.IsQuery() {
+			return &addr.ICMPQueryAddr{
+				IP: indicator.SrcIP(),
+				Id: indicator.icmpv6Indicator.Id(),
+			}
+		}
+
+		return indicator.icmpv6Indicator.EmbSrc()
 	default:
 		panic(fmt.Errorf("transport layer type %s not support", t))
 	}
@@ -339,6 +471,15 @@ func (indicator *PacketIndicator) NATDst() net.Addr {
 		}
 
 		return indicator.icmpv4Indicator.EmbDst()
+	case layers.LayerTypeICMPv6:
+		if indicator.icmpv6Indicator.IsQuery() {
+			return &addr.ICMPQueryAddr{
+				IP: indicator.DstIP(),
+				Id: indicator.icmpv6Indicator.Id(),
+			}
+		}
+
+		return indicator.icmpv6Indicator.EmbDst()
 	default:
 		panic(fmt.Errorf("transport layer type %s not support", t))
 	}
@@ -355,6 +496,12 @@ func (indicator *PacketIndicator) NATProtocol() gopacket.LayerType {
 		}
 
 		return indicator.icmpv4Indicator.EmbTransportLayer().LayerType()
+	case layers.LayerTypeICMPv6:
+		if indicator.icmpv6Indicator.IsQuery() {
+			return t
+		}
+
+		return indicator.icmpv6Indicator.EmbTransportLayer().LayerType()
 	default:
 		panic(fmt.Errorf("transport layer type %s not support", t))
 	}
@@ -387,6 +534,15 @@ func (indicator *PacketIndicator) Src() net.Addr {
 			}
 		}
 
+		return &net.IPAddr{IP: indicator.SrcIP()}
+	case layers.LayerTypeICMPv6:
+		if indicator.icmpv6Indicator.IsQuery() {
+			return &addr.ICMPQueryAddr{
+				IP: indicator.SrcIP(),
+				Id: indicator.icmpv6Indicator.Id(),
+			}
+		}
+
 		return &net.IPAddr{IP: indicator.SrcIP()}
 	default:
 		panic(fmt.Errorf("transport layer type %s not support", t))
@@ -420,6 +576,15 @@ func (indicator *PacketIndicator) Dst() net.Addr {
 			}
 		}
 
+		return &net.IPAddr{IP: indicator.DstIP()}
+	case layers.LayerTypeICMPv6:
+		if indicator.icmpv6Indicator.IsQuery() {
+			return &addr.ICMPQueryAddr{
+				IP: indicator.DstIP(),
+				Id: indicator.icmpv6Indicator.Id(),
+			}
+		}
+
 		return &net.IPAddr{IP: indicator.DstIP()}
 	default:
 		panic(fmt.Errorf("transport layer type %s not support", t))
@@ -431,12 +596,16 @@ func (indicator *PacketIndicator) DNSIndicator() *DNSIndicator {
 	return indicator.dnsIndicator
 }
 
-// NetworkPayload returns the payload of network layer, used for fragmentation.
+// NetworkPayload returns the payload of network layer following extension headers, used for fragmentation.
 func (indicator *PacketIndicator) NetworkPayload() []byte {
 	if indicator.NetworkLayer() == nil {
 		return nil
 	}
 
+	if indicator.ipv6Indicator != nil {
+		return indicator.ipv6Indicator.Payload()
+	}
+
 	return indicator.NetworkLayer().LayerPayload()
 }
 
@@ -449,25 +618,39 @@ func (indicator *PacketIndicator) Payload() []byte {
 	return indicator.applicationLayer.LayerContents()
 }
 
+// NetworkLength returns the total length of the network layer described in its header.
+func (indicator *PacketIndicator) NetworkLength() int {
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		return int(indicator.IPv4Layer().Length)
+	case layers.LayerTypeIPv6:
+		return 40 + int(indicator.IPv6Layer().Length)
+	default:
+		panic(fmt.Errorf("network layer type %s not support", t))
+	}
+}
+
 // MTU returns the required MTU of the packet.
 func (indicator *PacketIndicator) MTU() int {
+	if indicator.ipv6Indicator != nil {
+		return len(indicator.NetworkLayer().LayerContents()) + len(indicator.ipv6Indicator.Headers()) + len(indicator.NetworkPayload())
+	}
+
 	return len(indicator.NetworkLayer().LayerContents()) + len(indicator.NetworkPayload())
 }
 
 // Size returns the size of the packet.
 func (indicator *PacketIndicator) Size() int {
-	return len(indicator.packet.Data())
+	return len(indicator.contents)
 }
 
 // ParsePacket parses a packet and returns a packet indicator.
 func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 	var (
-		linkLayer        gopacket.Layer
-		networkLayer     gopacket.Layer
-		transportLayer   gopacket.Layer
-		icmpv4Indicator  *ICMPv4Indicator
-		applicationLayer gopacket.ApplicationLayer
-		dnsIndicator     *DNSIndicator
+		linkLayer      gopacket.Layer
+		encap          *Encap
+		networkLayer   gopacket.Layer
+		transportLayer gopacket.Layer
 	)
 
 	// Parse packet
@@ -485,9 +668,12 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		}
 
 		return &PacketIndicator{
+			packet:           packet,
+			contents:         packet.Data(),
 			networkLayer:     networkLayer,
 			transportLayer:   nil,
 			icmpv4Indicator:  nil,
+			icmpv6Indicator:  nil,
 			applicationLayer: nil,
 		}, nil
 	}
@@ -495,6 +681,10 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 	if transportLayer == nil {
 		// Guess ICMPv4
 		transportLayer = packet.Layer(layers.LayerTypeICMPv4)
+		if transportLayer == nil {
+			// Guess ICMPv6
+			transportLayer = packet.Layer(layers.LayerTypeICMPv6)
+		}
 		if transportLayer == nil {
 			// Guess fragment
 			if packet.Layer(gopacket.LayerTypeFragment) == nil {
@@ -502,7 +692,6 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 			}
 		}
 	}
-	applicationLayer = packet.ApplicationLayer()
 
 	// Parse link layer
 	if linkLayer != nil {
@@ -512,7 +701,16 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		case layers.LayerTypeEthernet:
 			ethernetLayer := linkLayer.(*layers.Ethernet)
 
-			_, err := parseEthernetType(ethernetLayer.EthernetType)
+			var (
+				t   layers.EthernetType
+				err error
+			)
+			encap, t, err = parseEncap(packet, ethernetLayer)
+			if err != nil {
+				return nil, fmt.Errorf("parse encapsulation: %w", err)
+			}
+
+			_, err = parseEthernetType(t)
 			if err != nil {
 				return nil, err
 			}
@@ -521,78 +719,152 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		}
 	}
 
+	indicator := &PacketIndicator{
+		packet:           packet,
+		contents:         packet.Data(),
+		linkLayer:        linkLayer,
+		encap:            encap,
+		networkLayer:     networkLayer,
+		transportLayer:   transportLayer,
+		applicationLayer: packet.ApplicationLayer(),
+	}
+
+	err := indicator.parseLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	return indicator, nil
+}
+
+// parseLayers parses the network layer, the transport layer and the application layer of the packet indicator. The
+// transport layer behind IPv6 extension headers which are not decoded is decoded here.
+func (indicator *PacketIndicator) parseLayers() error {
 	// Parse network layer
-	switch t := networkLayer.LayerType(); t {
+	switch t := indicator.networkLayer.LayerType(); t {
 	case layers.LayerTypeIPv4:
-		ipv4Layer := networkLayer.(*layers.IPv4)
+		ipv4Layer := indicator.networkLayer.(*layers.IPv4)
 
 		_, err := parseIPProtocol(ipv4Layer.Protocol)
 		if err != nil {
-			return nil, err
+			return err
+		}
+	case layers.LayerTypeIPv6:
+		var err error
+		indicator.ipv6Indicator, err = ParseIPv6Layer(indicator.networkLayer.(*layers.IPv6))
+		if err != nil {
+			return fmt.Errorf("parse ipv6 layer: %w", err)
+		}
+
+		t, err := parseIPProtocol(indicator.ipv6Indicator.Protocol())
+		if err != nil {
+			return err
+		}
+
+		// Guess transport layer behind extension headers which are not decoded, like an atomic fragment
+		if indicator.transportLayer == nil && !indicator.ipv6Indicator.IsFrag() {
+			l := newPacketLayers()
+			l.decode(t, indicator.ipv6Indicator.Payload())
+
+			indicator.transportLayer = l.layer(t)
+			if indicator.transportLayer == nil {
+				return errors.New("missing transport layer")
+			}
+			indicator.applicationLayer = l.applicationLayer()
 		}
 	case layers.LayerTypeARP:
 		break
 	default:
-		return nil, fmt.Errorf("network layer type %s not support", t)
+		return fmt.Errorf("network layer type %s not support", t)
 	}
 
 	// Parse transport layer
-	if transportLayer != nil {
-		switch t := transportLayer.LayerType(); t {
+	if indicator.transportLayer != nil {
+		switch t := indicator.transportLayer.LayerType(); t {
 		case layers.LayerTypeTCP, layers.LayerTypeUDP:
 			break
 		case layers.LayerTypeICMPv4:
 			var err error
-			icmpv4Indicator, err = ParseICMPv4Layer(transportLayer.(*layers.ICMPv4))
+			indicator.icmpv4Indicator, err = ParseICMPv4Layer(indicator.transportLayer.(*layers.ICMPv4))
+			if err != nil {
+				return fmt.Errorf("parse icmpv4 layer: %w", err)
+			}
+		case layers.LayerTypeICMPv6:
+			var err error
+			indicator.icmpv6Indicator, err = ParseICMPv6Layer(indicator.transportLayer.(*layers.ICMPv6))
 			if err != nil {
-				return nil, fmt.Errorf("parse icmpv4 layer: %w", err)
+				return fmt.Errorf("parse icmpv6 layer: %w", err)
 			}
 		default:
-			return nil, fmt.Errorf("transport layer type %s not support", t)
+			return fmt.Errorf("transport layer type %s not support", t)
 		}
 	}
 
 	// Parse application layer
-	if applicationLayer != nil {
-		if applicationLayer.LayerType() == layers.LayerTypeDNS {
-			dnsIndicator, _ = ParseDNSLayer(applicationLayer.(*layers.DNS))
+	if indicator.applicationLayer != nil {
+		if indicator.applicationLayer.LayerType() == layers.LayerTypeDNS {
+			indicator.dnsIndicator, _ = ParseDNSLayer(indicator.applicationLayer.(*layers.DNS))
 		}
 	}
 
-	return &PacketIndicator{
-		packet:           packet,
-		linkLayer:        linkLayer,
-		networkLayer:     networkLayer,
-		transportLayer:   transportLayer,
-		icmpv4Indicator:  icmpv4Indicator,
-		applicationLayer: applicationLayer,
-		dnsIndicator:     dnsIndicator,
-	}, nil
+	return nil
 }
 
-// ParseEmbPacket parses an embedded packet used in transmission between client and server without link layer.
+// ParseEmbPacket parses an embedded packet used in transmission between client and server without link layer. Layers
+// are decoded by a DecodingLayerParser rather than gopacket.NewPacket, so the packet indicator has no packet.
 func ParseEmbPacket(contents []byte) (*PacketIndicator, error) {
-	// Guess network layer type
-	packet := gopacket.NewPacket(contents, layers.LayerTypeIPv4, gopacket.NoCopy)
-	networkLayer := packet.NetworkLayer()
-	if networkLayer == nil {
+	var networkLayerType gopacket.LayerType
+
+	if len(contents) <= 0 {
 		return nil, errors.New("missing network layer")
 	}
-	if networkLayer.LayerType() != layers.LayerTypeIPv4 {
-		return nil, errors.New("network layer type not support")
-	}
-	switch networkLayer.(*layers.IPv4).Version {
+
+	// Guess network layer type by version
+	switch contents[0] >> 4 {
 	case 4:
-		break
+		networkLayerType = layers.LayerTypeIPv4
+	case 6:
+		networkLayerType = layers.LayerTypeIPv6
 	default:
 		return nil, errors.New("network layer type not support")
 	}
 
+	// Layers behind the transport layer failed are ignored, like a malformed DNS message
+	l := newPacketLayers()
+	err := l.decode(networkLayerType, contents)
+	networkLayer := l.layer(networkLayerType)
+	if networkLayer == nil {
+		if err != nil {
+			return nil, fmt.Errorf("decode network layer: %w", err)
+		}
+		return nil, errors.New("missing network layer")
+	}
+
+	indicator := &PacketIndicator{
+		contents:         contents,
+		networkLayer:     networkLayer,
+		transportLayer:   l.transportLayer(),
+		applicationLayer: l.applicationLayer(),
+	}
+
+	// Guess fragment
+	if indicator.transportLayer == nil && networkLayerType == layers.LayerTypeIPv4 &&
+		l.ipv4.Flags&layers.IPv4MoreFragments == 0 && l.ipv4.FragOffset == 0 {
+		return nil, errors.New("missing transport layer")
+	}
+
 	// Parse packet
-	indicator, err := ParsePacket(packet)
+	err = indicator.parseLayers()
 	if err != nil {
 		return nil, err
 	}
+
+	// Fragments have their payloads as the application layer like in gopacket
+	if indicator.transportLayer == nil {
+		fragment := gopacket.Fragment(indicator.NetworkPayload())
+		indicator.applicationLayer = &fragment
+	}
+
 	return indicator, nil
 }
 
@@ -666,6 +938,8 @@ func parseIPProtocol(protocol layers.IPProtocol) (gopacket.LayerType, error) {
 		return layers.LayerTypeUDP, nil
 	case layers.IPProtocolICMPv4:
 		return layers.LayerTypeICMPv4, nil
+	case layers.IPProtocolICMPv6:
+		return layers.LayerTypeICMPv6, nil
 	default:
 		return gopacket.LayerTypeZero, fmt.Errorf("ip protocol %s not support", protocol)
 	}
@@ -675,6 +949,8 @@ func parseEthernetType(t layers.EthernetType) (gopacket.LayerType, error) {
 	switch t {
 	case layers.EthernetTypeIPv4:
 		return layers.LayerTypeIPv4, nil
+	case layers.EthernetTypeIPv6:
+		return layers.LayerTypeIPv6, nil
 	case layers.EthernetTypeARP:
 		return layers.LayerTypeARP, nil
 	default:
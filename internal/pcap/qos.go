@@ -0,0 +1,337 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/log"
+	"ikago/internal/schedule"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDropFlows is the maximum number of flows whose matches of drop rules are counted for logging, and counts are
+// cleared when it is full.
+const maxDropFlows = 65536
+
+// qosRule describes a rule classifying flows of a protocol with a range of ports, or packets of a DSCP, into a traffic
+// class, or dropping them, which is only in effect in its schedule.
+type qosRule struct {
+	class    TrafficClass
+	isDrop   bool
+	protocol string
+	low      uint16
+	high     uint16
+	dscp     int
+	schedule *schedule.Schedule
+}
+
+// matches returns if the packet matches the rule. Ports match either the source port or the destination port, so
+// packets of a flow in both directions are in the same class.
+func (rule *qosRule) matches(packet gopacket.Packet) bool {
+	if rule.dscp >= 0 {
+		switch t := packet.NetworkLayer().(type) {
+		case *layers.IPv4:
+			return int(t.TOS>>2) == rule.dscp
+		case *layers.IPv6:
+			return int(t.TrafficClass>>2) == rule.dscp
+		default:
+			return false
+		}
+	}
+
+	var src, dst uint16
+	switch rule.protocol {
+	case "tcp":
+		t, ok := packet.TransportLayer().(*layers.TCP)
+		if !ok {
+			return false
+		}
+		src, dst = uint16(t.SrcPort), uint16(t.DstPort)
+	case "udp":
+		t, ok := packet.TransportLayer().(*layers.UDP)
+		if !ok {
+			return false
+		}
+		src, dst = uint16(t.SrcPort), uint16(t.DstPort)
+	case "icmp":
+		return packet.Layer(layers.LayerTypeICMPv4) != nil || packet.Layer(layers.LayerTypeICMPv6) != nil
+	default:
+		panic(fmt.Errorf("protocol %s not support", rule.protocol))
+	}
+	if rule.high <= 0 {
+		return true
+	}
+
+	return src >= rule.low && src <= rule.high || dst >= rule.low && dst <= rule.high
+}
+
+func (rule *qosRule) String() string {
+	var s string
+	switch {
+	case rule.dscp >= 0:
+		s = fmt.Sprintf("dscp %d", rule.dscp)
+	case rule.high <= 0:
+		s = rule.protocol
+	case rule.low == rule.high:
+		s = fmt.Sprintf("%s %d", rule.protocol, rule.low)
+	default:
+		s = fmt.Sprintf("%s %d-%d", rule.protocol, rule.low, rule.high)
+	}
+
+	if rule.isDrop {
+		s = fmt.Sprintf("drop %s", s)
+	} else {
+		s = fmt.Sprintf("%s as %s", s, rule.class)
+	}
+	if rule.schedule != nil {
+		s = fmt.Sprintf("%s in %s", s, rule.schedule)
+	}
+
+	return s
+}
+
+// Classifier describes QoS rules classifying packets into traffic classes, which are priority bands in workers, or
+// dropping them. The first rule in effect matching a packet decides its class or drops it, and packets matching no rule
+// are classified by Classify. A nil classifier classifies packets by Classify only.
+type Classifier struct {
+	rules      []*qosRule
+	dropLog    int
+	activeLock sync.RWMutex
+	active     []*qosRule
+	lock       sync.Mutex
+	drops      map[uint64]int
+}
+
+// ParseClassifier returns a classifier by the given rules, which are a traffic class or drop followed by a protocol
+// tcp, udp or icmp with an optional port or a range of ports, or a DSCP class name or number, like
+// realtime:udp:27015-27030, interactive:tcp:22, realtime:dscp:EF and drop:udp:1900, and an optional schedule the rule
+// is in effect in, like bulk:tcp@20:00-23:00. The first matches of drop rules up to dropLog in each flow are logged.
+func ParseClassifier(rules []string, dropLog int) (*Classifier, error) {
+	c := &Classifier{rules: make([]*qosRule, 0, len(rules)), dropLog: dropLog, drops: make(map[uint64]int)}
+
+	for _, s := range rules {
+		rule, err := parseQoSRule(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse rule %s: %w", s, err)
+		}
+		c.rules = append(c.rules, rule)
+	}
+	c.Apply(time.Now())
+
+	return c, nil
+}
+
+func parseQoSRule(s string) (*qosRule, error) {
+	rule := &qosRule{dscp: -1}
+
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		sched, err := schedule.Parse(s[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("parse schedule: %w", err)
+		}
+		rule.schedule = sched
+		s = s[:i]
+	}
+
+	strs := strings.SplitN(s, ":", 3)
+	if len(strs) < 2 {
+		return nil, errors.New("missing match")
+	}
+	rule.protocol = strs[1]
+	if strs[0] == "drop" {
+		rule.isDrop = true
+	} else {
+		class, err := ParseTrafficClass(strs[0])
+		if err != nil {
+			return nil, err
+		}
+		rule.class = class
+	}
+
+	switch rule.protocol {
+	case "dscp":
+		if len(strs) < 3 {
+			return nil, errors.New("missing dscp")
+		}
+		dscp, err := ParseDSCP(strs[2])
+		if err != nil {
+			return nil, err
+		}
+		if dscp.IsDefault() {
+			return nil, errors.New("missing dscp")
+		}
+		rule.dscp = int(dscp.class)
+
+		return rule, nil
+	case "tcp", "udp", "icmp":
+	default:
+		return nil, fmt.Errorf("protocol %s not support", rule.protocol)
+	}
+	if len(strs) < 3 {
+		return rule, nil
+	}
+	if rule.protocol == "icmp" {
+		return nil, errors.New("ports of icmp not support")
+	}
+
+	portStr := strs[2]
+	lowStr, highStr := portStr, portStr
+	if i := strings.Index(portStr, "-"); i >= 0 {
+		lowStr, highStr = portStr[:i], portStr[i+1:]
+	}
+	low, err := strconv.ParseUint(lowStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("parse port %s: %w", lowStr, err)
+	}
+	high, err := strconv.ParseUint(highStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("parse port %s: %w", highStr, err)
+	}
+	if low <= 0 || low > high {
+		return nil, fmt.Errorf("port range %s out of range", portStr)
+	}
+	rule.low, rule.high = uint16(low), uint16(high)
+
+	return rule, nil
+}
+
+// IsEmpty returns if the classifier has no rule.
+func (c *Classifier) IsEmpty() bool {
+	return c == nil || len(c.rules) <= 0
+}
+
+// IsScheduled returns if any rule has a schedule.
+func (c *Classifier) IsScheduled() bool {
+	if c == nil {
+		return false
+	}
+
+	for _, rule := range c.rules {
+		if rule.schedule != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply puts rules whose schedules contain the time in effect, and returns if rules in effect change.
+func (c *Classifier) Apply(now time.Time) bool {
+	if c == nil {
+		return false
+	}
+
+	active := make([]*qosRule, 0, len(c.rules))
+	for _, rule := range c.rules {
+		if rule.schedule.Contains(now) {
+			active = append(active, rule)
+		}
+	}
+
+	c.activeLock.Lock()
+	defer c.activeLock.Unlock()
+
+	isChanged := len(active) != len(c.active)
+	for i := 0; !isChanged && i < len(active); i++ {
+		isChanged = active[i] != c.active[i]
+	}
+	c.active = active
+
+	return isChanged
+}
+
+// Active returns rules in effect.
+func (c *Classifier) Active() string {
+	c.activeLock.RLock()
+	defer c.activeLock.RUnlock()
+
+	return formatQoSRules(c.active)
+}
+
+func (c *Classifier) activeRules() []*qosRule {
+	c.activeLock.RLock()
+	defer c.activeLock.RUnlock()
+
+	return c.active
+}
+
+// Allows returns if the packet is not dropped, which is the first rule matching it is not a drop rule. The first
+// matches in each flow are logged.
+func (c *Classifier) Allows(packet gopacket.Packet) bool {
+	if c.IsEmpty() {
+		return true
+	}
+
+	var matched *qosRule
+	for _, rule := range c.activeRules() {
+		if rule.matches(packet) {
+			matched = rule
+			break
+		}
+	}
+	if matched == nil || !matched.isDrop {
+		return true
+	}
+	if c.dropLog <= 0 {
+		return false
+	}
+
+	hash := FlowHash(packet)
+	c.lock.Lock()
+	if len(c.drops) >= maxDropFlows {
+		c.drops = make(map[uint64]int)
+	}
+	n := c.drops[hash]
+	if n < c.dropLog {
+		c.drops[hash] = n + 1
+	}
+	c.lock.Unlock()
+	if n >= c.dropLog {
+		return false
+	}
+
+	src, dst := packet.NetworkLayer().NetworkFlow().Endpoints()
+	if transportLayer := packet.TransportLayer(); transportLayer != nil {
+		srcPort, dstPort := transportLayer.TransportFlow().Endpoints()
+		log.Infof("Drop a packet by rule %s: %s:%s -> %s:%s (%d of %d in flow)\n", matched, src, srcPort, dst, dstPort, n+1, c.dropLog)
+	} else {
+		log.Infof("Drop a packet by rule %s: %s -> %s (%d of %d in flow)\n", matched, src, dst, n+1, c.dropLog)
+	}
+
+	return false
+}
+
+// Classify returns the traffic class of the packet by the first rule matching it except drop rules, or by Classify if
+// no rule matches.
+func (c *Classifier) Classify(packet gopacket.Packet) TrafficClass {
+	if c != nil {
+		for _, rule := range c.activeRules() {
+			if !rule.isDrop && rule.matches(packet) {
+				return rule.class
+			}
+		}
+	}
+
+	return Classify(packet)
+}
+
+func (c *Classifier) String() string {
+	return formatQoSRules(c.rules)
+}
+
+func formatQoSRules(rules []*qosRule) string {
+	if len(rules) <= 0 {
+		return "none"
+	}
+
+	s := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		s = append(s, rule.String())
+	}
+
+	return strings.Join(s, ", ")
+}
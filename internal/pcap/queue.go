@@ -0,0 +1,189 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// QueuePolicy describes what a bounded queue does with a value submitted when it is full.
+type QueuePolicy int
+
+const (
+	// QueueBlock blocks submitting until the queue has room, which pushes back to the producer.
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldest drops the oldest value in the queue, which keeps values fresh.
+	QueueDropOldest
+	// QueueDropNewest drops the value submitted, which is tail drop.
+	QueueDropNewest
+)
+
+// ParseQueuePolicy returns a queue policy by the given string, can be block, drop-oldest or drop-newest.
+func ParseQueuePolicy(s string) (QueuePolicy, error) {
+	switch s {
+	case "block":
+		return QueueBlock, nil
+	case "drop-oldest":
+		return QueueDropOldest, nil
+	case "drop-newest":
+		return QueueDropNewest, nil
+	default:
+		return QueueBlock, fmt.Errorf("queue policy %s not support", s)
+	}
+}
+
+func (policy QueuePolicy) String() string {
+	switch policy {
+	case QueueBlock:
+		return "block"
+	case QueueDropOldest:
+		return "drop-oldest"
+	case QueueDropNewest:
+		return "drop-newest"
+	default:
+		panic(fmt.Errorf("queue policy %d not support", policy))
+	}
+}
+
+// TrafficClass describes the class of a flow, which is queued separately in workers.
+type TrafficClass int
+
+const (
+	// ClassRealtime describes flows most sensitive to latency, like games, which are only classified by QoS rules.
+	// Values of the class are handled before values of other classes.
+	ClassRealtime TrafficClass = iota
+	// ClassInteractive describes flows sensitive to latency but light in volume, like ICMP and DNS.
+	ClassInteractive
+	// ClassBulk describes other flows.
+	ClassBulk
+	classes
+)
+
+// DefaultQueuePolicies are queue policies of traffic classes by default.
+var DefaultQueuePolicies = map[TrafficClass]QueuePolicy{
+	ClassRealtime:    QueueDropOldest,
+	ClassInteractive: QueueDropOldest,
+	ClassBulk:        QueueDropNewest,
+}
+
+// ParseTrafficClass returns a traffic class by the given string, can be realtime, interactive or bulk.
+func ParseTrafficClass(s string) (TrafficClass, error) {
+	switch s {
+	case "realtime":
+		return ClassRealtime, nil
+	case "interactive":
+		return ClassInteractive, nil
+	case "bulk":
+		return ClassBulk, nil
+	default:
+		return ClassBulk, fmt.Errorf("traffic class %s not support", s)
+	}
+}
+
+func (class TrafficClass) String() string {
+	switch class {
+	case ClassRealtime:
+		return "realtime"
+	case ClassInteractive:
+		return "interactive"
+	case ClassBulk:
+		return "bulk"
+	default:
+		panic(fmt.Errorf("traffic class %d not support", class))
+	}
+}
+
+// Classify returns the traffic class of the packet. Packets are classified by their flows rather than their contents,
+// so packets of a flow are always in the same class and are handled in order.
+func Classify(packet gopacket.Packet) TrafficClass {
+	transportLayer := packet.TransportLayer()
+	if transportLayer == nil {
+		if packet.Layer(layers.LayerTypeICMPv4) != nil || packet.Layer(layers.LayerTypeICMPv6) != nil {
+			return ClassInteractive
+		}
+
+		return ClassBulk
+	}
+
+	switch t := transportLayer.(type) {
+	case *layers.TCP:
+		if t.SrcPort == 53 || t.DstPort == 53 {
+			return ClassInteractive
+		}
+	case *layers.UDP:
+		if t.SrcPort == 53 || t.DstPort == 53 {
+			return ClassInteractive
+		}
+	}
+
+	return ClassBulk
+}
+
+// ringQueue describes a bounded FIFO queue in a ring buffer, which is not safe for concurrent use.
+type ringQueue struct {
+	items   []interface{}
+	head    int
+	length  int
+	policy  QueuePolicy
+	packets uint64
+	bytes   uint64
+	drops   uint64
+}
+
+func newRingQueue(length int, policy QueuePolicy) *ringQueue {
+	if length <= 0 {
+		length = 1
+	}
+
+	return &ringQueue{items: make([]interface{}, length), policy: policy}
+}
+
+func (q *ringQueue) isEmpty() bool {
+	return q.length <= 0
+}
+
+func (q *ringQueue) isFull() bool {
+	return q.length >= len(q.items)
+}
+
+// push queues the value, and drops a value by the policy if the queue is full. It returns false if the value
+// submitted is dropped. The queue must not be full with policy block.
+func (q *ringQueue) push(v interface{}) bool {
+	if q.isFull() {
+		switch q.policy {
+		case QueueDropOldest:
+			q.pop()
+			q.drops++
+		case QueueDropNewest:
+			q.drops++
+			return false
+		default:
+			panic(fmt.Errorf("push to full queue with policy %s", q.policy))
+		}
+	}
+
+	q.items[(q.head+q.length)%len(q.items)] = v
+	q.length++
+
+	return true
+}
+
+func (q *ringQueue) pop() interface{} {
+	v := q.items[q.head]
+	q.items[q.head] = nil
+	q.head = (q.head + 1) % len(q.items)
+	q.length--
+
+	return v
+}
+
+// QueueStat describes the status of queues of a traffic class in workers.
+type QueueStat struct {
+	Class    string `json:"class"`
+	Policy   string `json:"policy"`
+	Length   int    `json:"length"`
+	Capacity int    `json:"capacity"`
+	Packets  uint64 `json:"packets"`
+	Bytes    uint64 `json:"bytes"`
+	Drops    uint64 `json:"drops"`
+}
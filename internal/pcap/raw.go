@@ -1,8 +1,15 @@
 package pcap
 
 import (
+	"context"
+	"fmt"
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/log"
+	"ikago/internal/tracing"
+	"net"
+	"sync"
+	"sync/atomic"
 )
 
 type timeoutError struct {
@@ -17,86 +24,293 @@ func (err *timeoutError) Timeout() bool {
 	return true
 }
 
-// MaxMTU is the max transmission and receive unit in pcap raw conn.
-const MaxMTU = 1500
+// DefaultMTU is the transmission and receive unit in pcap raw conn if it cannot be detected.
+const DefaultMTU = 1500
+
+// MaxMTU is the max transmission and receive unit in pcap raw conn, which allows jumbo frames.
+const MaxMTU = 9000
 
 // IPv4MaxSize is the max size of an IPv4 packet.
 const IPv4MaxSize = 65535
 
+// MaxLinkOverhead is the max size of layers before network layers in pcap raw conn, which is an Ethernet layer with an
+// 802.1Q tag and a PPPoE session.
+const MaxLinkOverhead = 14 + 4 + 8
+
 // maxSnapLen is the max size of each packet in pcap raw conn.
-const maxSnapLen = 1600
+const maxSnapLen = MaxMTU + 100
 
-// RawConn is a raw network connection.
-type RawConn struct {
-	srcDev *Device
-	dstDev *Device
-	handle *pcap.Handle
+// MinSnapLen returns the min snap length capturing packets of the MTU in full, DefaultMTU if the MTU is 0.
+func MinSnapLen(mtu int) int {
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
+
+	return mtu + MaxLinkOverhead
 }
 
-func createPureRawConn(dev, filter string) (*RawConn, error) {
-	handle, err := pcap.OpenLive(dev, maxSnapLen, true, pcap.BlockForever)
-	if err != nil {
-		return nil, err
-	}
+// matcher is a BPF filter matches packets in user space.
+type matcher interface {
+	Matches(ci gopacket.CaptureInfo, data []byte) bool
+}
 
-	err = handle.SetBPFFilter(filter)
-	if err != nil {
-		return nil, err
-	}
+// handle is a handle reads and writes packets in a device.
+type handle interface {
+	ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error)
+	WritePacketData(data []byte) error
+	LinkType() layers.LinkType
+	SetDirection(direction direction) error
+	Close()
+}
 
-	return &RawConn{
-		handle: handle,
-	}, nil
+// lendingHandle is a handle lends frames in its memory to packets read instead of copying them, where each frame lent
+// carries a loan in its ancillary data.
+type lendingHandle interface {
+	LendPacketData() (data []byte, ci gopacket.CaptureInfo, err error)
+}
+
+// loan describes a frame lent to a packet, which returns the frame to its handle once released.
+type loan interface {
+	Release()
+}
+
+// RawConn is a raw network connection.
+type RawConn struct {
+	// truncated is the number of packets dropped for they are truncated, which is first for 64-bit alignment.
+	truncated  uint64
+	srcDev     *Device
+	dstDev     *Device
+	handle     handle
+	dumpLayer  DumpLayer
+	batchDatas [][]byte
+	batchCIs   []gopacket.CaptureInfo
+	pending    []gopacket.Packet
+	readLock   sync.Mutex
+	writer     *batchWriter
 }
 
 // CreateRawConn creates a raw connection between devices with BPF filter.
 func CreateRawConn(srcDev, dstDev *Device, filter string) (*RawConn, error) {
-	conn, err := createPureRawConn(srcDev.Name(), filter)
+	return CreateOwnedRawConn(srcDev, dstDev, filter, "")
+}
+
+// CreateOwnedRawConn creates a raw connection between devices with BPF filter, where backends taking frames from the
+// kernel, like xdp, only take frames matched by the owned filter too, and leave the others to the kernel. All frames
+// matched are owned if owned is empty.
+func CreateOwnedRawConn(srcDev, dstDev *Device, filter, owned string) (*RawConn, error) {
+	var (
+		conn *RawConn
+		err  error
+	)
+
+	switch t := srcDev.Backend(); t {
+	case BackendPcap:
+		conn, err = createPureRawConn(srcDev.Name(), filter)
+	case BackendTun, BackendTap:
+		var h *tunHandle
+		h, err = createTunHandle(srcDev.Alias(), filter, t == BackendTap)
+		if err == nil {
+			conn = &RawConn{handle: h}
+		}
+	case BackendAFPacket:
+		var h *afpacketHandle
+		h, err = createAFPacketHandle(srcDev.Name(), filter)
+		if err == nil {
+			conn = &RawConn{handle: h}
+		}
+	case BackendXDP:
+		var h *xdpHandle
+		h, err = createXDPHandle(srcDev.Name(), filter, owned)
+		if err == nil {
+			conn = &RawConn{handle: h}
+			break
+		}
+
+		// Fall back to pcap if the kernel or the driver does not support
+		log.Infof("Device %s falls back to pcap: %v\n", srcDev.Alias(), err)
+		conn, err = createPureRawConn(srcDev.Name(), filter)
+	default:
+		return nil, fmt.Errorf("backend %s not support", t)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	conn.srcDev = srcDev
 	conn.dstDev = dstDev
+	conn.setBatch(batchSize)
 
 	return conn, nil
 }
 
 func (c *RawConn) Read(b []byte) (n int, err error) {
-	d, _, err := c.handle.ReadPacketData()
+	n, _, err = c.read(b)
+
+	return n, err
+}
+
+func (c *RawConn) read(b []byte) (int, gopacket.CaptureInfo, error) {
+	d, ci, err := c.handle.ReadPacketData()
 	if err != nil {
-		return 0, err
+		return 0, ci, err
 	}
 
 	copy(b, d)
+	dumpPacket(c.dumpLayer, true, c.handle.LinkType(), d)
 
-	return len(d), nil
+	return len(d), ci, nil
 }
 
 // ReadPacket reads packet from the connection.
 func (c *RawConn) ReadPacket() (gopacket.Packet, error) {
-	b := make([]byte, maxSnapLen)
+	if len(c.batchDatas) > 0 {
+		return c.readPending()
+	}
 
-	_, err := c.Read(b)
-	if err != nil {
-		return nil, err
+	size := maxSnapLen
+	if pcapOptions.SnapLen > size {
+		size = pcapOptions.SnapLen
+	}
+	b := make([]byte, size)
+
+	var (
+		n   int
+		ci  gopacket.CaptureInfo
+		err error
+	)
+	for {
+		n, ci, err = c.read(b)
+		if err != nil {
+			return nil, err
+		}
+		if !c.isTruncated(ci) {
+			break
+		}
+	}
+	if n > len(b) {
+		n = len(b)
+	}
+
+	packet := gopacket.NewPacket(b[:n], c.handle.LinkType(), gopacket.NoCopy)
+	// Keep the time captured, which is traced
+	packet.Metadata().Timestamp = ci.Timestamp
+
+	return packet, nil
+}
+
+// lendPacket reads a packet in a frame lent by the handle. Fragments are kept by defragmenters after they are handled,
+// so they are copied and their frames are returned at once.
+func (c *RawConn) lendPacket(h lendingHandle) (gopacket.Packet, error) {
+	var (
+		d   []byte
+		ci  gopacket.CaptureInfo
+		err error
+	)
+	for {
+		d, ci, err = h.LendPacketData()
+		if err != nil {
+			return nil, err
+		}
+		if !c.isTruncated(ci) {
+			break
+		}
+		release(ci)
 	}
+	dumpPacket(c.dumpLayer, true, c.handle.LinkType(), d)
 
-	packet := gopacket.NewPacket(b, c.handle.LinkType(), gopacket.NoCopy)
+	packet := gopacket.NewPacket(d, c.handle.LinkType(), gopacket.NoCopy)
+	if len(ci.AncillaryData) > 0 && isFragment(packet) {
+		b := make([]byte, len(d))
+		copy(b, d)
+		release(ci)
+		ci.AncillaryData = nil
+
+		packet = gopacket.NewPacket(b, c.handle.LinkType(), gopacket.NoCopy)
+	}
+	packet.Metadata().CaptureInfo = ci
 
 	return packet, nil
 }
 
+// isTruncated returns if the packet captured is truncated by the snap length, which is counted and dropped since it
+// cannot be forwarded in full.
+func (c *RawConn) isTruncated(ci gopacket.CaptureInfo) bool {
+	if ci.CaptureLength >= ci.Length {
+		return false
+	}
+
+	if atomic.AddUint64(&c.truncated, 1) == 1 {
+		log.Errorf("Drop packets truncated from %d to %d Bytes in device %s, increase the snap length\n", ci.Length,
+			ci.CaptureLength, c.srcDev.Alias())
+	}
+
+	return true
+}
+
+// Truncated returns the number of packets dropped for they are truncated by the snap length.
+func (c *RawConn) Truncated() uint64 {
+	return atomic.LoadUint64(&c.truncated)
+}
+
+// ReleasePacket returns the frame lent to the packet read by ReadPackets, if any, to the connection. The packet is not
+// used after it is released.
+func ReleasePacket(packet gopacket.Packet) {
+	release(packet.Metadata().CaptureInfo)
+}
+
+func release(ci gopacket.CaptureInfo) {
+	for _, v := range ci.AncillaryData {
+		l, ok := v.(loan)
+		if ok {
+			l.Release()
+		}
+	}
+}
+
+// isFragment returns if the packet is a fragment of IPv4 or IPv6.
+func isFragment(packet gopacket.Packet) bool {
+	if packet.Layer(layers.LayerTypeIPv6Fragment) != nil {
+		return true
+	}
+
+	layer := packet.Layer(layers.LayerTypeIPv4)
+	if layer == nil {
+		return false
+	}
+	ipv4Layer := layer.(*layers.IPv4)
+
+	return ipv4Layer.Flags&layers.IPv4MoreFragments != 0 || ipv4Layer.FragOffset != 0
+}
+
+// Decode returns the packet decoded from the data in the link type of the connection.
+func (c *RawConn) Decode(data []byte) gopacket.Packet {
+	return gopacket.NewPacket(data, c.handle.LinkType(), gopacket.Default)
+}
+
 func (c *RawConn) Write(b []byte) (n int, err error) {
+	// Packets in batches are dumped after they are written
+	if c.writer != nil {
+		err = c.writer.write(b)
+		if err != nil {
+			return 0, err
+		}
+
+		return len(b), nil
+	}
+
 	err = c.handle.WritePacketData(b)
 	if err != nil {
 		return 0, err
 	}
+	dumpPacket(c.dumpLayer, false, c.handle.LinkType(), b)
 
 	return len(b), nil
 }
 
 func (c *RawConn) Close() error {
+	if c.writer != nil {
+		c.writer.close()
+	}
 	c.handle.Close()
 
 	return nil
@@ -112,54 +326,38 @@ func (c *RawConn) RemoteDev() *Device {
 	return c.dstDev
 }
 
-// IsLoop returns if the connection is to a loopback device.
-func (c *RawConn) IsLoop() bool {
-	return c.dstDev.IsLoop()
+// IsTun returns if packets of the connection have no link layer, like in a TUN device or in raw sockets.
+func (c *RawConn) IsTun() bool {
+	return c.handle.LinkType() == layers.LinkTypeRaw
 }
 
-// Reader is a reader reads packets from a pcap file.
-type Reader struct {
-	handle *pcap.Handle
-	ps     *gopacket.PacketSource
+// SetInbound sets the connection only to read packets received, so packets written will not be read back.
+func (c *RawConn) SetInbound() error {
+	return c.handle.SetDirection(directionIn)
 }
 
-// CreateReader creates a reader reading a pcap file.
-func CreateReader(file string) (*Reader, error) {
-	handle, err := pcap.OpenOffline(file)
-	if err != nil {
-		return nil, err
+// WriteContext writes the data to the connection, and traces stages in the packet of the context. Connections which
+// cannot trace their own stages are traced as the inject stage.
+func WriteContext(ctx context.Context, conn net.Conn, b []byte) (int, error) {
+	w, ok := conn.(interface {
+		WriteContext(ctx context.Context, b []byte) (int, error)
+	})
+	if ok {
+		return w.WriteContext(ctx, b)
 	}
 
-	ps := gopacket.NewPacketSource(handle, handle.LinkType())
+	_, span := tracing.Start(ctx, "inject")
+	defer span.End()
 
-	return &Reader{
-		handle: handle,
-		ps:     ps,
-	}, nil
+	return conn.Write(b)
 }
 
-func (r *Reader) Read(b []byte) (n int, err error) {
-	packet, err := r.ReadPacket()
-	if err != nil {
-		return 0, err
-	}
-
-	copy(b, packet.Data())
-
-	return len(packet.Data()), nil
+// SetDumpLayer sets the layer of packets read and written in the connection, which are dumped if the dumper is set.
+func (c *RawConn) SetDumpLayer(layer DumpLayer) {
+	c.dumpLayer = layer
 }
 
-func (r *Reader) ReadPacket() (gopacket.Packet, error) {
-	packet, err := r.ps.NextPacket()
-	if err != nil {
-		return nil, err
-	}
-
-	return packet, nil
-}
-
-func (r *Reader) Close() error {
-	r.handle.Close()
-
-	return nil
+// IsLoop returns if the connection is to a loopback device.
+func (c *RawConn) IsLoop() bool {
+	return c.dstDev.IsLoop()
 }
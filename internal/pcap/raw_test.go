@@ -0,0 +1,124 @@
+package pcap
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// countLoan counts frames released.
+type countLoan struct {
+	released *int32
+}
+
+func (l countLoan) Release() {
+	atomic.AddInt32(l.released, 1)
+}
+
+// lendHandle is a memory handle which lends frames read.
+type lendHandle struct {
+	*memHandle
+	released int32
+}
+
+func (h *lendHandle) LendPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := h.ReadPacketData()
+	if err != nil {
+		return nil, ci, err
+	}
+	ci.AncillaryData = []interface{}{countLoan{released: &h.released}}
+
+	return data, ci, nil
+}
+
+// TestReadPacketsLent reads packets in frames lent, which are returned once released, and fragments are copied and
+// returned at once.
+func TestReadPacketsLent(t *testing.T) {
+	h := &lendHandle{memHandle: newMemHandle()}
+	conn := newMemRawConn(h.memHandle)
+	conn.handle = h
+
+	// Lent
+	h.in <- tcpPacket(t, 443, 1000, false, []byte("data"))
+	packets, err := conn.ReadPackets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&h.released) != 0 {
+		t.Fatal("released before handled")
+	}
+	ReleasePacket(packets[0])
+	if atomic.LoadInt32(&h.released) != 1 {
+		t.Fatal("not released")
+	}
+
+	// Fragment
+	networkLayer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Flags:    layers.IPv4MoreFragments,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(10, 0, 0, 2).To4(),
+		DstIP:    net.IPv4(10, 0, 0, 1).To4(),
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true}, networkLayer,
+		gopacket.Payload("fragment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.in <- buffer.Bytes()
+	packets, err = conn.ReadPackets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&h.released) != 2 {
+		t.Fatal("fragment kept in frame")
+	}
+	ReleasePacket(packets[0])
+	if atomic.LoadInt32(&h.released) != 2 {
+		t.Fatal("fragment released twice")
+	}
+}
+
+// truncHandle is a memory handle which captures packets larger than 45 Bytes truncated by a byte.
+type truncHandle struct {
+	*memHandle
+}
+
+func (h *truncHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := h.memHandle.ReadPacketData()
+	if err != nil {
+		return nil, ci, err
+	}
+	if ci.Length > 20+20+5 {
+		ci.Length++
+	}
+
+	return data, ci, nil
+}
+
+// TestReadPacketTruncated drops packets truncated and reads the next one.
+func TestReadPacketTruncated(t *testing.T) {
+	h := &truncHandle{memHandle: newMemHandle()}
+	conn := newMemRawConn(h.memHandle)
+	conn.handle = h
+
+	h.in <- tcpPacket(t, 443, 1000, false, []byte("truncated"))
+	h.in <- tcpPacket(t, 443, 1000, false, []byte("data"))
+
+	packet, err := conn.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(packet.ApplicationLayer().Payload()) != "data" {
+		t.Errorf("read %q, want the packet not truncated", packet.ApplicationLayer().Payload())
+	}
+	if conn.Truncated() != 1 {
+		t.Errorf("truncated %d, want 1", conn.Truncated())
+	}
+}
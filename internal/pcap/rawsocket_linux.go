@@ -0,0 +1,290 @@
+// +build nopcap
+
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	rawSocketPollPeriod = 100
+	// rawSocketBusyPoll is the time in microseconds the driver is busy polled in each receive
+	rawSocketBusyPoll = 50
+)
+
+// mmsghdr is the struct mmsghdr used in recvmmsg and sendmmsg.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// rawSocketHandle is a handle reads IPv4 packets of TCP, UDP and ICMPv4 received in raw sockets, and writes IPv4
+// packets with IP_HDRINCL. Packets are filtered in user space, and can be read and written in batches with recvmmsg
+// and sendmmsg.
+type rawSocketHandle struct {
+	fds       []unix.PollFd
+	sendFD    int
+	buf       []byte
+	matcher   matcher
+	isClosed  int32
+	readMsgs  []mmsghdr
+	readIovs  []unix.Iovec
+	readBufs  [][]byte
+	writeLock sync.Mutex
+	writeMsgs []mmsghdr
+	writeIovs []unix.Iovec
+	addrs     []unix.RawSockaddrInet4
+}
+
+func createRawSocketHandle(dev, filter string) (handle, error) {
+	m, err := newMatcher(layers.LinkTypeRaw, filter)
+	if err != nil {
+		return nil, fmt.Errorf("compile filter: %w", err)
+	}
+
+	h := &rawSocketHandle{sendFD: -1, buf: make([]byte, maxSnapLen), matcher: m}
+
+	err = h.open(dev)
+	if err != nil {
+		h.release()
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (h *rawSocketHandle) open(dev string) error {
+	for _, proto := range []int{unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_ICMP} {
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, proto)
+		if err != nil {
+			return fmt.Errorf("create socket: %w", err)
+		}
+		h.fds = append(h.fds, unix.PollFd{Fd: int32(fd), Events: unix.POLLIN})
+
+		err = unix.BindToDevice(fd, dev)
+		if err != nil {
+			return fmt.Errorf("bind to device: %w", err)
+		}
+
+		// The driver is busy polled in receiving, which is ignored if the kernel does not support
+		if isBusyPoll {
+			unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_BUSY_POLL, rawSocketBusyPoll)
+		}
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.IPPROTO_RAW)
+	if err != nil {
+		return fmt.Errorf("create socket: %w", err)
+	}
+	h.sendFD = fd
+
+	err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_HDRINCL, 1)
+	if err != nil {
+		return fmt.Errorf("set header included: %w", err)
+	}
+
+	err = unix.BindToDevice(fd, dev)
+	if err != nil {
+		return fmt.Errorf("bind to device: %w", err)
+	}
+
+	return nil
+}
+
+func (h *rawSocketHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for atomic.LoadInt32(&h.isClosed) == 0 {
+		_, err := unix.Poll(h.fds, pollTimeout(rawSocketPollPeriod))
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return nil, gopacket.CaptureInfo{}, err
+		}
+
+		for _, fd := range h.fds {
+			if fd.Revents&unix.POLLIN == 0 {
+				continue
+			}
+
+			n, err := unix.Read(int(fd.Fd), h.buf)
+			if err != nil {
+				if err == unix.EAGAIN || err == unix.EINTR {
+					continue
+				}
+				return nil, gopacket.CaptureInfo{}, err
+			}
+
+			ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: n, Length: n}
+			if h.matcher.Matches(ci, h.buf[:n]) {
+				return h.buf[:n], ci, nil
+			}
+		}
+	}
+
+	return nil, gopacket.CaptureInfo{}, io.EOF
+}
+
+func (h *rawSocketHandle) ReadPacketDataBatch(datas [][]byte, cis []gopacket.CaptureInfo) (int, error) {
+	// Buffers are allocated in the first read
+	if len(h.readMsgs) < len(datas) {
+		h.readMsgs = make([]mmsghdr, len(datas))
+		h.readIovs = make([]unix.Iovec, len(datas))
+		h.readBufs = make([][]byte, len(datas))
+		for i := range h.readMsgs {
+			h.readBufs[i] = make([]byte, maxSnapLen)
+			h.readIovs[i].Base = &h.readBufs[i][0]
+			h.readIovs[i].SetLen(maxSnapLen)
+			h.readMsgs[i].hdr.Iov = &h.readIovs[i]
+			h.readMsgs[i].hdr.SetIovlen(1)
+		}
+	}
+
+	for atomic.LoadInt32(&h.isClosed) == 0 {
+		_, err := unix.Poll(h.fds, pollTimeout(rawSocketPollPeriod))
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return 0, err
+		}
+
+		count := 0
+		for _, fd := range h.fds {
+			if fd.Revents&unix.POLLIN == 0 || count >= len(datas) {
+				continue
+			}
+
+			n, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, uintptr(fd.Fd), uintptr(unsafe.Pointer(&h.readMsgs[count])),
+				uintptr(len(datas)-count), unix.MSG_DONTWAIT, 0, 0)
+			if errno != 0 {
+				if errno == unix.EAGAIN || errno == unix.EINTR {
+					continue
+				}
+				return 0, errno
+			}
+
+			now := time.Now()
+			end := count + int(n)
+			for i := count; i < end; i++ {
+				size := int(h.readMsgs[i].len)
+				ci := gopacket.CaptureInfo{Timestamp: now, CaptureLength: size, Length: size}
+				if !h.matcher.Matches(ci, h.readBufs[i][:size]) {
+					continue
+				}
+
+				// Packets matched are moved forward, and their buffers are swapped
+				h.readBufs[count], h.readBufs[i] = h.readBufs[i], h.readBufs[count]
+				h.readIovs[count].Base, h.readIovs[i].Base = h.readIovs[i].Base, h.readIovs[count].Base
+				datas[count] = h.readBufs[count][:size]
+				cis[count] = ci
+				count++
+			}
+		}
+		if count > 0 {
+			return count, nil
+		}
+	}
+
+	return 0, io.EOF
+}
+
+func (h *rawSocketHandle) WritePacketDataBatch(datas [][]byte) (int, error) {
+	if len(datas) <= 0 {
+		return 0, nil
+	}
+
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	if len(h.writeMsgs) < len(datas) {
+		h.writeMsgs = make([]mmsghdr, len(datas))
+		h.writeIovs = make([]unix.Iovec, len(datas))
+		h.addrs = make([]unix.RawSockaddrInet4, len(datas))
+	}
+
+	for i, data := range datas {
+		if len(data) < 20 || data[0]>>4 != 4 {
+			return 0, errors.New("ipv6 not support in raw sockets")
+		}
+
+		h.addrs[i].Family = unix.AF_INET
+		copy(h.addrs[i].Addr[:], data[16:20])
+		h.writeIovs[i].Base = &data[0]
+		h.writeIovs[i].SetLen(len(data))
+		h.writeMsgs[i].hdr.Name = (*byte)(unsafe.Pointer(&h.addrs[i]))
+		h.writeMsgs[i].hdr.Namelen = unix.SizeofSockaddrInet4
+		h.writeMsgs[i].hdr.Iov = &h.writeIovs[i]
+		h.writeMsgs[i].hdr.SetIovlen(1)
+	}
+
+	// Sendmmsg may send part of messages
+	sent := 0
+	for sent < len(datas) {
+		n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(h.sendFD), uintptr(unsafe.Pointer(&h.writeMsgs[sent])),
+			uintptr(len(datas)-sent), 0, 0, 0)
+		if errno != 0 {
+			if errno == unix.EINTR {
+				continue
+			}
+			return sent, errno
+		}
+		sent += int(n)
+	}
+
+	return sent, nil
+}
+
+func (h *rawSocketHandle) WritePacketData(data []byte) error {
+	if len(data) < 20 || data[0]>>4 != 4 {
+		return errors.New("ipv6 not support in raw sockets")
+	}
+
+	addr := &unix.SockaddrInet4{}
+	copy(addr.Addr[:], data[16:20])
+
+	return unix.Sendto(h.sendFD, data, 0, addr)
+}
+
+// offloadsIPv4Checksum returns true, where the kernel always fills the IPv4 header checksum with IP_HDRINCL.
+func (h *rawSocketHandle) offloadsIPv4Checksum() bool {
+	return true
+}
+
+func (h *rawSocketHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeRaw
+}
+
+func (h *rawSocketHandle) SetDirection(direction direction) error {
+	// Raw sockets only receive packets received
+	if direction == directionIn {
+		return nil
+	}
+
+	return errors.New("direction not support")
+}
+
+func (h *rawSocketHandle) Close() {
+	if !atomic.CompareAndSwapInt32(&h.isClosed, 0, 1) {
+		return
+	}
+
+	h.release()
+}
+
+func (h *rawSocketHandle) release() {
+	for _, fd := range h.fds {
+		unix.Close(int(fd.Fd))
+	}
+	if h.sendFD >= 0 {
+		unix.Close(h.sendFD)
+	}
+}
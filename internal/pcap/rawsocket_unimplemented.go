@@ -0,0 +1,9 @@
+// +build nopcap,!linux
+
+package pcap
+
+import "errors"
+
+func createRawSocketHandle(dev, filter string) (handle, error) {
+	return nil, errors.New("raw socket not support")
+}
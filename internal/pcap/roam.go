@@ -0,0 +1,485 @@
+package pcap
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/crypto"
+	"ikago/internal/log"
+	"net"
+	"time"
+)
+
+const (
+	// roamHeader is the first byte of the payload of a SYN announcing a client roaming to a new address.
+	roamHeader = 0xd1
+	// roamChallengeHeader is the first byte of the payload of a SYN+ACK challenging the new address of a roaming.
+	roamChallengeHeader = 0xd2
+	// roamResponseHeader is the first byte of the payload of a SYN answering a challenge from the new address.
+	roamResponseHeader = 0xd3
+)
+
+const (
+	// roamTagSize is the size of the tag of a roaming, which tells the session.
+	roamTagSize = 16
+	// roamNonceSize is the size of the nonce of a challenge.
+	roamNonceSize = 16
+	// roamAddrSize is the size of an address in a challenge, which is the IP in 16 Bytes and the port.
+	roamAddrSize = net.IPv6len + 2
+)
+
+const (
+	// roamWindow is the number of roamings a server accepts from the next one, so responses lost do not lose the
+	// session.
+	roamWindow = 8
+	// roamChallengeTimeout is the duration a challenge is answered in.
+	roamChallengeTimeout = 5 * time.Second
+	// roamChallenges is the number of challenges pending in a connection at most.
+	roamChallenges = 4
+)
+
+// roamState describes roamings of a connection, which is guarded by the lock of the connection.
+type roamState struct {
+	// index is the index of the next roaming of the client, or of the first roaming the server accepts.
+	index uint64
+	// tags are tags of roamings the server accepts from the index, which are computed once.
+	tags [][]byte
+	// nonce is the nonce of the last challenge the client answers.
+	nonce []byte
+	// challenges are challenges the server sends to new addresses, by the addresses.
+	challenges map[string]*roamChallenge
+}
+
+// roamChallenge describes a challenge sent to the new address of a roaming.
+type roamChallenge struct {
+	nonce   []byte
+	index   uint64
+	expires time.Time
+}
+
+// roamType returns the type of a message of roaming, and false if the payload is not a message of roaming.
+func roamType(payload []byte) (byte, bool) {
+	if len(payload) <= 0 {
+		return 0, false
+	}
+
+	switch t := payload[0]; t {
+	case roamHeader:
+		return t, len(payload) == 1+roamTagSize
+	case roamChallengeHeader:
+		return t, len(payload) == 1+roamNonceSize+roamAddrSize+sha256.Size
+	case roamResponseHeader:
+		return t, len(payload) == 1+roamNonceSize+sha256.Size
+	default:
+		return 0, false
+	}
+}
+
+// roamMAC returns the MAC of the message of the type with its contents by the key of roaming.
+func roamMAC(key []byte, t byte, contents ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{t})
+	for _, content := range contents {
+		mac.Write(content)
+	}
+
+	return mac.Sum(nil)
+}
+
+// roamTag returns the tag of the roaming of the index. Tags of different roamings cannot be linked by others, so the
+// client is not tracked across addresses.
+func roamTag(key []byte, index uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, index)
+
+	return roamMAC(key, roamHeader, b)[:roamTagSize]
+}
+
+// roamAddr returns the address in a challenge.
+func roamAddr(a *net.TCPAddr) []byte {
+	result := make([]byte, roamAddrSize)
+	copy(result, a.IP.To16())
+	binary.BigEndian.PutUint16(result[net.IPv6len:], uint16(a.Port))
+
+	return result
+}
+
+// roamKey returns the key authenticating roamings of the session with the peer, which is known only if key exchange is
+// established.
+func (c *FakeTCPConn) roamKey() ([]byte, bool) {
+	c.clientsLock.RLock()
+	client, ok := c.clients[c.RemoteAddr().String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	ec, ok := client.crypt.(*crypto.ExchangeCrypt)
+	if !ok {
+		return nil, false
+	}
+
+	return ec.RoamKey()
+}
+
+// Roam announces the session to the server from the current address of the client, so the server moves the session
+// to the address if the address is changed, like a handover of the network, without handshaking again. It is a SYN
+// carrying the tag of the next roaming, which does not start a new stream. The server challenges a new address before
+// the session is moved, so roamings replayed from other addresses are never accepted. Nothing is sent before key
+// exchange is established.
+func (c *FakeTCPConn) Roam() error {
+	key, ok := c.roamKey()
+	if !ok {
+		return nil
+	}
+
+	c.lock.Lock()
+	index := c.roaming.index
+	c.lock.Unlock()
+
+	err := c.writeRoam(append([]byte{roamHeader}, roamTag(key, index)...))
+	if err != nil {
+		return err
+	}
+
+	log.Verbosef("Send TCP roaming: %s -> %s\n", c.LocalAddr().String(), c.RemoteAddr().String())
+
+	return nil
+}
+
+// answerRoam answers the challenge of the server from the new address, which proves the client holds the session and
+// receives in the address. Roamings later use the next tag once a challenge is answered.
+func (c *FakeTCPConn) answerRoam(payload []byte) error {
+	key, ok := c.roamKey()
+	if !ok {
+		return errors.New("missing session")
+	}
+
+	nonce := payload[1 : 1+roamNonceSize]
+	addr := payload[1+roamNonceSize : 1+roamNonceSize+roamAddrSize]
+	if !hmac.Equal(payload[1+roamNonceSize+roamAddrSize:], roamMAC(key, roamChallengeHeader, nonce, addr)) {
+		return errors.New("challenge unauthorized")
+	}
+
+	c.lock.Lock()
+	if !bytes.Equal(nonce, c.roaming.nonce) {
+		c.roaming.nonce = append([]byte{}, nonce...)
+		c.roaming.index++
+	}
+	c.lock.Unlock()
+
+	err := c.writeRoam(append(append([]byte{roamResponseHeader}, nonce...), roamMAC(key, roamResponseHeader, nonce, addr)...))
+	if err != nil {
+		return err
+	}
+
+	log.Verbosef("Answer TCP roaming challenge: %s -> %s\n", c.LocalAddr().String(), c.RemoteAddr().String())
+
+	return nil
+}
+
+// writeRoam sends a SYN carrying the message of roaming to the server.
+func (c *FakeTCPConn) writeRoam(payload []byte) error {
+	c.clientsLock.RLock()
+	client, ok := c.clients[c.RemoteAddr().String()]
+	c.clientsLock.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if client.state == nil || client.state.isFINSent {
+		return nil
+	}
+
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), client.state.seq, client.state.ack, c.conn, c.dstAddr.IP, c.id, 128, c.RemoteDev().HardwareAddr(), c.RemoteDev().Encap())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+
+	// Make TCP layer SYN
+	FlagTCPLayer(transportLayer.(*layers.TCP), true, false, false)
+
+	// Fingerprint, TTL and DSCP
+	c.fingerprint.apply(client.state, networkLayer)
+	c.ttl.apply(networkLayer, nil)
+	c.dscp.apply(networkLayer)
+
+	// Serialize layers
+	data, err := Serialize(linkLayer, networkLayer, transportLayer, gopacket.Payload(payload))
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	c.health.send(true)
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		c.id++
+	}
+
+	return nil
+}
+
+// acceptsRoam returns the index of the roaming of the tag, and false if the tag is not of a roaming the session
+// accepts, which are the next roamings in the window.
+func (c *FakeTCPConn) acceptsRoam(tag []byte) (uint64, bool) {
+	key, ok := c.roamKey()
+	if !ok {
+		return 0, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.roaming.tags == nil {
+		c.roaming.tags = make([][]byte, 0, roamWindow)
+		for i := 0; i < roamWindow; i++ {
+			c.roaming.tags = append(c.roaming.tags, roamTag(key, c.roaming.index+uint64(i)))
+		}
+	}
+
+	for i, t := range c.roaming.tags {
+		if hmac.Equal(t, tag) {
+			return c.roaming.index + uint64(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// challengeRoam challenges the new address of the client in the roaming of the index, which is answered in the
+// challenge timeout.
+func (c *FakeTCPConn) challengeRoam(dstAddr *net.TCPAddr, index uint64, indicator *PacketIndicator) error {
+	key, ok := c.roamKey()
+	if !ok {
+		return errors.New("missing session")
+	}
+
+	nonce, err := crypto.GenerateNonce(roamNonceSize)
+	if err != nil {
+		return fmt.Errorf("generate nonce: %w", err)
+	}
+	addr := roamAddr(dstAddr)
+	payload := append(append([]byte{roamChallengeHeader}, nonce...), addr...)
+	payload = append(payload, roamMAC(key, roamChallengeHeader, nonce, addr)...)
+
+	c.clientsLock.RLock()
+	client, ok := c.clients[c.RemoteAddr().String()]
+	c.clientsLock.RUnlock()
+	if !ok || client.state == nil {
+		return errors.New("missing client")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Challenges expired or beyond the number are discarded
+	now := time.Now()
+	if c.roaming.challenges == nil {
+		c.roaming.challenges = make(map[string]*roamChallenge)
+	}
+	for a, ch := range c.roaming.challenges {
+		if now.After(ch.expires) || len(c.roaming.challenges) >= roamChallenges {
+			delete(c.roaming.challenges, a)
+		}
+	}
+	c.roaming.challenges[dstAddr.String()] = &roamChallenge{nonce: nonce, index: index, expires: now.Add(roamChallengeTimeout)}
+
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(dstAddr.Port), client.state.seq, client.state.ack, c.conn, dstAddr.IP, c.id, 64, indicator.SrcHardwareAddr(), indicator.Encap())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+
+	// Make TCP layer SYN & ACK
+	FlagTCPLayer(transportLayer.(*layers.TCP), true, false, true)
+
+	// Fingerprint, TTL and DSCP
+	c.fingerprint.apply(client.state, networkLayer)
+	c.ttl.apply(networkLayer, nil)
+	c.dscp.apply(networkLayer)
+
+	// Serialize layers
+	data, err := Serialize(linkLayer, networkLayer, transportLayer, gopacket.Payload(payload))
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		c.id++
+	}
+
+	log.Verbosef("Send TCP roaming challenge: %s -> %s\n", c.LocalAddr().String(), dstAddr.String())
+
+	return nil
+}
+
+// verifyRoam returns the index of the roaming if the response from the address answers the challenge to it, and
+// discards the challenge.
+func (c *FakeTCPConn) verifyRoam(src *net.TCPAddr, payload []byte) (uint64, bool) {
+	key, ok := c.roamKey()
+	if !ok {
+		return 0, false
+	}
+
+	nonce := payload[1 : 1+roamNonceSize]
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ch, ok := c.roaming.challenges[src.String()]
+	if !ok || time.Now().After(ch.expires) || !bytes.Equal(ch.nonce, nonce) {
+		return 0, false
+	}
+	if !hmac.Equal(payload[1+roamNonceSize:], roamMAC(key, roamResponseHeader, nonce, roamAddr(src))) {
+		return 0, false
+	}
+	delete(c.roaming.challenges, src.String())
+
+	return ch.index, true
+}
+
+// SetRoaming sets the function called after a connection accepted roams to a new address from the address.
+func (l *FakeTCPListener) SetRoaming(roam func(conn net.Conn, from net.Addr)) {
+	l.roam = roam
+}
+
+// roamTo handles the message of roaming to the source address. The server challenges the address in a roaming, and
+// moves the connection of the session to the address once the challenge is answered, so sessions cannot be taken over
+// by others, nor be moved by roamings replayed from other addresses.
+func (l *FakeTCPListener) roamTo(indicator *PacketIndicator, t byte) error {
+	src := indicator.Src().(*net.TCPAddr)
+
+	conns := make([]*FakeTCPConn, 0)
+	l.lock.Lock()
+	for _, c := range l.clients {
+		c := c.(*FakeTCPConn)
+		if !c.isClosed {
+			conns = append(conns, c)
+		}
+	}
+	l.lock.Unlock()
+
+	switch t {
+	case roamHeader:
+		for _, conn := range conns {
+			index, ok := conn.acceptsRoam(indicator.Payload()[1:])
+			if !ok {
+				continue
+			}
+
+			// Roaming from the same address is handled in the connection
+			if conn.RemoteAddr().String() == src.String() {
+				return nil
+			}
+
+			return conn.challengeRoam(src, index, indicator)
+		}
+
+		return errors.New("roaming unauthorized")
+	case roamResponseHeader:
+		for _, conn := range conns {
+			index, ok := conn.verifyRoam(src, indicator.Payload())
+			if !ok {
+				continue
+			}
+
+			return l.move(conn, src, index, indicator)
+		}
+
+		return errors.New("roaming response unauthorized")
+	default:
+		return fmt.Errorf("roaming type %d not support", t)
+	}
+}
+
+// move moves the connection to the new address of the client in the roaming of the index.
+func (l *FakeTCPListener) move(conn *FakeTCPConn, src *net.TCPAddr, index uint64, indicator *PacketIndicator) error {
+	from := conn.RemoteAddr()
+
+	err := conn.migrate(src, indicator)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+
+	// Roamings before are never accepted again
+	conn.lock.Lock()
+	conn.roaming.index = index + 1
+	conn.roaming.tags = nil
+	conn.lock.Unlock()
+
+	l.lock.Lock()
+	delete(l.clients, from.String())
+	l.clients[src.String()] = conn
+	l.lock.Unlock()
+
+	log.Infof("Client %s roams to %s\n", from, src)
+
+	if l.roam != nil {
+		l.roam(conn, from)
+	}
+
+	return nil
+}
+
+// migrate moves the connection to the new address of the client in the roaming, and acknowledges the roaming.
+func (c *FakeTCPConn) migrate(dstAddr *net.TCPAddr, indicator *PacketIndicator) error {
+	filter, err := connFilter(c.srcPort, dstAddr)
+	if err != nil {
+		return err
+	}
+
+	rawConn, err := CreateRawConn(c.LocalDev(), c.RemoteDev(), filter)
+	if err != nil {
+		return fmt.Errorf("create raw connection: %w", err)
+	}
+	rawConn.SetDumpLayer(DumpOuter)
+
+	c.lock.Lock()
+	conn := c.conn
+	c.conn = rawConn
+
+	c.clientsLock.Lock()
+	client, ok := c.clients[c.dstAddr.String()]
+	if !ok {
+		c.clientsLock.Unlock()
+		c.conn = conn
+		c.lock.Unlock()
+		rawConn.Close()
+		return errors.New("missing client")
+	}
+	delete(c.clients, c.dstAddr.String())
+	client.hardwareAddr = indicator.SrcHardwareAddr()
+	client.encap = indicator.Encap()
+	client.template = nil
+	c.clients[dstAddr.String()] = client
+	c.dstAddr = dstAddr
+	c.clientsLock.Unlock()
+	seq := client.state.seq
+	c.lock.Unlock()
+
+	conn.Close()
+
+	return c.writeACK(client, dstAddr, seq, false)
+}
@@ -0,0 +1,162 @@
+package pcap
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/crypto"
+	"net"
+	"testing"
+	"time"
+)
+
+// newRoamConn returns a connection of the handle to the address in a session of the secret.
+func newRoamConn(t *testing.T, h *memHandle, addr *net.TCPAddr, secret []byte) *FakeTCPConn {
+	t.Helper()
+
+	crypto.SetKeyExchange(true)
+	defer crypto.SetKeyExchange(false)
+
+	crypt, err := crypto.ParseCrypt("aes-256-gcm", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = crypt.(*crypto.ExchangeCrypt).Resume(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := newMulticastConn(newMemRawConn(h), 443, crypt, DefaultMTU)
+	conn.dstAddr = addr
+	conn.clients[addr.String()] = &clientIndicator{crypt: crypt, state: newFakeTCPState()}
+
+	return conn
+}
+
+// readRoam returns the payload of the segment written to the handle.
+func readRoam(t *testing.T, h *memHandle) []byte {
+	t.Helper()
+
+	select {
+	case data := <-h.out:
+		packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+		if packet.ApplicationLayer() == nil {
+			t.Fatal("write no payload")
+		}
+
+		return packet.ApplicationLayer().Payload()
+	case <-time.After(time.Second):
+		t.Fatal("write: no packet")
+	}
+
+	return nil
+}
+
+// TestRoam challenges the new address in a roaming, which is answered only from the address, and roamings before are
+// not accepted again.
+func TestRoam(t *testing.T) {
+	secret := bytes.Repeat([]byte{1}, 32)
+	serverAddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 443}
+	oldAddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 40000}
+	newAddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 3).To4(), Port: 40001}
+
+	clientHandle, serverHandle := newMemHandle(), newMemHandle()
+	defer clientHandle.Close()
+	defer serverHandle.Close()
+	client := newRoamConn(t, clientHandle, serverAddr, secret)
+	server := newRoamConn(t, serverHandle, oldAddr, secret)
+
+	// Roaming
+	err := client.Roam()
+	if err != nil {
+		t.Fatalf("roam: %v", err)
+	}
+	roaming := readRoam(t, clientHandle)
+	if typ, ok := roamType(roaming); !ok || typ != roamHeader {
+		t.Fatalf("roam %x, want a roaming", roaming)
+	}
+	index, ok := server.acceptsRoam(roaming[1:])
+	if !ok || index != 0 {
+		t.Fatalf("accept roaming: %d, %t", index, ok)
+	}
+
+	// Challenge
+	indicator, err := ParsePacket(gopacket.NewPacket(tcpPacket(t, 443, 1000, true, roaming), layers.LayerTypeIPv4, gopacket.Default))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.challengeRoam(newAddr, index, indicator)
+	if err != nil {
+		t.Fatalf("challenge: %v", err)
+	}
+	challenge := readRoam(t, serverHandle)
+
+	// Response
+	err = client.answerRoam(challenge)
+	if err != nil {
+		t.Fatalf("answer: %v", err)
+	}
+	response := readRoam(t, clientHandle)
+
+	_, ok = server.verifyRoam(oldAddr, response)
+	if ok {
+		t.Error("response verified from another address")
+	}
+	index, ok = server.verifyRoam(newAddr, response)
+	if !ok || index != 0 {
+		t.Fatalf("verify response: %d, %t", index, ok)
+	}
+	_, ok = server.verifyRoam(newAddr, response)
+	if ok {
+		t.Error("response replayed verified")
+	}
+
+	// Roamings after
+	err = client.Roam()
+	if err != nil {
+		t.Fatalf("roam: %v", err)
+	}
+	next := readRoam(t, clientHandle)
+	if bytes.Equal(next, roaming) {
+		t.Error("roaming not rotated")
+	}
+}
+
+// TestRoamAccept accepts roamings in the window only, and challenges from the server only.
+func TestRoamAccept(t *testing.T) {
+	secret := bytes.Repeat([]byte{1}, 32)
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 40000}
+
+	h := newMemHandle()
+	defer h.Close()
+	conn := newRoamConn(t, h, addr, secret)
+	key, _ := conn.roamKey()
+
+	tests := []struct {
+		name     string
+		tag      []byte
+		accepted bool
+	}{
+		{"first", roamTag(key, 0), true},
+		{"last", roamTag(key, roamWindow-1), true},
+		{"beyond", roamTag(key, roamWindow), false},
+		{"another session", roamTag(bytes.Repeat([]byte{2}, 32), 0), false},
+	}
+
+	for _, test := range tests {
+		_, ok := conn.acceptsRoam(test.tag)
+		if ok != test.accepted {
+			t.Errorf("%s: accepted %t, want %t", test.name, ok, test.accepted)
+		}
+	}
+
+	// Challenge forged
+	nonce := bytes.Repeat([]byte{3}, roamNonceSize)
+	a := roamAddr(addr)
+	forged := append(append([]byte{roamChallengeHeader}, nonce...), a...)
+	forged = append(forged, roamMAC(bytes.Repeat([]byte{2}, 32), roamChallengeHeader, nonce, a)...)
+	err := conn.answerRoam(forged)
+	if err == nil {
+		t.Error("challenge forged answered")
+	}
+}
@@ -0,0 +1,325 @@
+package pcap
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SIPPort is the port of SIP signaling.
+const SIPPort = 5060
+
+// sipAddrHeaders are headers whose addresses are rewritten, in full and compact forms.
+var sipAddrHeaders = []string{"via", "v", "contact", "m", "record-route", "route"}
+
+// RewriteSIP rewrites a SIP message over UDP from the source to the address in NAT. Addresses of the source in Via,
+// Contact and route headers are replaced, and RTP and RTCP streams of the source in SDP are replaced with addresses
+// returned by expect, which opens them in NAT. Only IPv4 is supported.
+func RewriteSIP(payload []byte, src, nat *net.UDPAddr, expect func(a *net.UDPAddr) (*net.UDPAddr, error)) ([]byte, error) {
+	if src.IP.To4() == nil || nat.IP.To4() == nil {
+		return payload, nil
+	}
+
+	header, body, ok := splitSIP(payload)
+	if !ok {
+		return payload, nil
+	}
+
+	// SDP
+	if strings.Contains(strings.ToLower(sipHeader(header, "content-type", "c")), "application/sdp") {
+		var err error
+		body, err = rewriteSDP(body, src.IP, nat.IP, expect)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite sdp: %w", err)
+		}
+	}
+
+	return joinSIP(rewriteSIPHeader(header, src, nat), body), nil
+}
+
+// RestoreSIP restores addresses in NAT in Via, Contact and route headers of a SIP message over UDP to the source.
+func RestoreSIP(payload []byte, nat, src *net.UDPAddr) []byte {
+	if src.IP.To4() == nil || nat.IP.To4() == nil {
+		return payload
+	}
+
+	header, body, ok := splitSIP(payload)
+	if !ok {
+		return payload
+	}
+
+	return joinSIP(rewriteSIPHeader(header, nat, src), body)
+}
+
+// splitSIP splits the SIP message into header lines and the body.
+func splitSIP(payload []byte) ([]string, []byte, bool) {
+	index := bytes.Index(payload, []byte("\r\n\r\n"))
+	if index < 0 {
+		return nil, nil, false
+	}
+
+	header := strings.Split(string(payload[:index]), "\r\n")
+	if !strings.Contains(header[0], "SIP/2.0") {
+		return nil, nil, false
+	}
+
+	return header, payload[index+4:], true
+}
+
+// joinSIP joins header lines and the body into a SIP message, and updates Content-Length.
+func joinSIP(header []string, body []byte) []byte {
+	for i, line := range header {
+		name, _, ok := parseSIPHeader(line)
+		if ok && (name == "content-length" || name == "l") {
+			header[i] = line[:strings.Index(line, ":")+1] + " " + strconv.Itoa(len(body))
+		}
+	}
+
+	result := make([]byte, 0)
+	result = append(result, strings.Join(header, "\r\n")...)
+	result = append(result, "\r\n\r\n"...)
+	result = append(result, body...)
+
+	return result
+}
+
+// parseSIPHeader returns the name in lower case and the value of the header line.
+func parseSIPHeader(line string) (string, string, bool) {
+	index := strings.Index(line, ":")
+	if index < 0 {
+		return "", "", false
+	}
+
+	return strings.ToLower(strings.TrimSpace(line[:index])), strings.TrimSpace(line[index+1:]), true
+}
+
+// sipHeader returns the value of the first header in names.
+func sipHeader(header []string, names ...string) string {
+	for _, line := range header[1:] {
+		name, value, ok := parseSIPHeader(line)
+		if !ok {
+			continue
+		}
+		for _, n := range names {
+			if name == n {
+				return value
+			}
+		}
+	}
+
+	return ""
+}
+
+// rewriteSIPHeader replaces the address from with to in headers with addresses. Addresses without a port are replaced
+// only if from is in the default port.
+func rewriteSIPHeader(header []string, from, to *net.UDPAddr) []string {
+	result := make([]string, len(header))
+	copy(result, header)
+
+	for i, line := range result[1:] {
+		name, _, ok := parseSIPHeader(line)
+		if !ok {
+			continue
+		}
+		for _, n := range sipAddrHeaders {
+			if name == n {
+				result[i+1] = replaceSIPAddr(line, from, to)
+				break
+			}
+		}
+	}
+
+	return result
+}
+
+func replaceSIPAddr(s string, from, to *net.UDPAddr) string {
+	ip := from.IP.String()
+
+	var b strings.Builder
+	for {
+		index := strings.Index(s, ip)
+		if index < 0 {
+			b.WriteString(s)
+			break
+		}
+
+		end := index + len(ip)
+		if index > 0 && isSIPAddrChar(s[index-1]) || end < len(s) && isSIPAddrChar(s[end]) && s[end] != ':' {
+			// Part of another address
+			b.WriteString(s[:end])
+			s = s[end:]
+			continue
+		}
+
+		// Port
+		port, portEnd := SIPPort, end
+		if end < len(s) && s[end] == ':' {
+			portEnd = end + 1
+			for portEnd < len(s) && s[portEnd] >= '0' && s[portEnd] <= '9' {
+				portEnd++
+			}
+			p, err := strconv.Atoi(s[end+1 : portEnd])
+			if err != nil {
+				b.WriteString(s[:end])
+				s = s[end:]
+				continue
+			}
+			port = p
+		}
+
+		b.WriteString(s[:index])
+		if port == from.Port {
+			b.WriteString(to.String())
+		} else {
+			b.WriteString(s[index:portEnd])
+		}
+		s = s[portEnd:]
+	}
+
+	return b.String()
+}
+
+func isSIPAddrChar(c byte) bool {
+	return c >= '0' && c <= '9' || c == '.'
+}
+
+// sdpMedia describes a media description in SDP.
+type sdpMedia struct {
+	lines []string
+	ip    net.IP
+}
+
+// rewriteSDP replaces the address of the source with the address in NAT in connection and origin lines, and replaces
+// ports of RTP and RTCP streams of the source with ports returned by expect.
+func rewriteSDP(body []byte, src, nat net.IP, expect func(a *net.UDPAddr) (*net.UDPAddr, error)) ([]byte, error) {
+	lines := strings.Split(strings.TrimRight(string(body), "\r\n"), "\r\n")
+
+	// Split session and media descriptions
+	var sessionIP net.IP
+	session := make([]string, 0)
+	medias := make([]*sdpMedia, 0)
+	for _, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			medias = append(medias, &sdpMedia{lines: []string{line}})
+			continue
+		}
+
+		if strings.HasPrefix(line, "c=") {
+			ip := parseSDPConnection(line)
+			if len(medias) <= 0 {
+				sessionIP = ip
+			} else {
+				medias[len(medias)-1].ip = ip
+			}
+		}
+
+		if len(medias) <= 0 {
+			session = append(session, line)
+		} else {
+			medias[len(medias)-1].lines = append(medias[len(medias)-1].lines, line)
+		}
+	}
+
+	result := make([]string, 0, len(lines)+len(medias))
+	result = append(result, rewriteSDPAddr(session, src, nat)...)
+
+	for _, media := range medias {
+		ip := media.ip
+		if ip == nil {
+			ip = sessionIP
+		}
+		if ip == nil || !ip.Equal(src) {
+			result = append(result, media.lines...)
+			continue
+		}
+
+		// m=<media> <port> <proto> <fmt> ...
+		fields := strings.Fields(media.lines[0])
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid media %s", media.lines[0])
+		}
+		port, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("parse port: %w", err)
+		}
+		if port <= 0 {
+			// Disabled stream
+			result = append(result, rewriteSDPAddr(media.lines, src, nat)...)
+			continue
+		}
+
+		// RTP
+		rtp, err := expect(&net.UDPAddr{IP: src, Port: port})
+		if err != nil {
+			return nil, fmt.Errorf("expect rtp: %w", err)
+		}
+		fields[1] = strconv.Itoa(rtp.Port)
+		media.lines[0] = strings.Join(fields, " ")
+
+		// RTCP in the next port by default, or in a=rtcp
+		rtcpPort := port + 1
+		rtcpIndex := -1
+		for i, line := range media.lines {
+			if strings.HasPrefix(line, "a=rtcp:") {
+				rtcpIndex = i
+				fields := strings.Fields(line[len("a=rtcp:"):])
+				if len(fields) <= 0 {
+					return nil, fmt.Errorf("invalid rtcp %s", line)
+				}
+				p, err := strconv.Atoi(fields[0])
+				if err != nil {
+					return nil, fmt.Errorf("parse rtcp port: %w", err)
+				}
+				rtcpPort = p
+			}
+		}
+		rtcp, err := expect(&net.UDPAddr{IP: src, Port: rtcpPort})
+		if err != nil {
+			return nil, fmt.Errorf("expect rtcp: %w", err)
+		}
+		if rtcpIndex >= 0 {
+			media.lines[rtcpIndex] = fmt.Sprintf("a=rtcp:%d", rtcp.Port)
+		} else if rtcp.Port != rtp.Port+1 {
+			// RFC 3605
+			media.lines = append(media.lines, fmt.Sprintf("a=rtcp:%d", rtcp.Port))
+		}
+
+		result = append(result, rewriteSDPAddr(media.lines, src, nat)...)
+	}
+
+	return []byte(strings.Join(result, "\r\n") + "\r\n"), nil
+}
+
+// parseSDPConnection returns the address in the connection line.
+func parseSDPConnection(line string) net.IP {
+	// c=IN IP4 <address>
+	fields := strings.Fields(line[len("c="):])
+	if len(fields) < 3 {
+		return nil
+	}
+
+	return net.ParseIP(strings.SplitN(fields[2], "/", 2)[0])
+}
+
+// rewriteSDPAddr replaces the address of the source with the address in NAT in connection and origin lines.
+func rewriteSDPAddr(lines []string, src, nat net.IP) []string {
+	result := make([]string, len(lines))
+
+	for i, line := range lines {
+		result[i] = line
+		if !strings.HasPrefix(line, "c=") && !strings.HasPrefix(line, "o=") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		last := len(fields) - 1
+		if last >= 0 && net.ParseIP(fields[last]).Equal(src) {
+			fields[last] = nat.String()
+			result[i] = strings.Join(fields, " ")
+		}
+	}
+
+	return result
+}
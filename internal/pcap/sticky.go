@@ -1,6 +1,7 @@
 package pcap
 
 import (
+	"encoding/binary"
 	"ikago/internal/log"
 	"time"
 )
@@ -11,6 +12,7 @@ type Desticker struct {
 	deadline  time.Duration
 	appear    time.Time
 	indicator *PacketIndicator
+	isFrame   bool
 }
 
 // NewDesticker returns a new desticker.
@@ -18,6 +20,19 @@ func NewDesticker() *Desticker {
 	return &Desticker{data: make([]byte, 0), appear: time.Now()}
 }
 
+// NewFrameDesticker returns a new desticker separates frames encoded by EncodeFrame.
+func NewFrameDesticker() *Desticker {
+	return &Desticker{data: make([]byte, 0), appear: time.Now(), isFrame: true}
+}
+
+// EncodeFrame prefixes the frame with its length, so it can be separated by a frame desticker.
+func EncodeFrame(frame []byte) []byte {
+	result := make([]byte, 2, 2+len(frame))
+	binary.BigEndian.PutUint16(result, uint16(len(frame)))
+
+	return append(result, frame...)
+}
+
 // Append adds a sticky data to the Desticker.
 func (d *Desticker) Append(data []byte) ([][]byte, error) {
 	datas := make([][]byte, 0)
@@ -34,12 +49,25 @@ func (d *Desticker) Append(data []byte) ([][]byte, error) {
 	d.data = append(d.data, data...)
 
 	for length := len(d.data); length > 0; {
-		if d.indicator != nil {
-			if len(d.data) >= int(d.indicator.IPv4Layer().Length) {
-				datas = append(datas, d.data[:d.indicator.IPv4Layer().Length])
+		if d.isFrame {
+			if len(d.data) < 2 {
+				break
+			}
+			size := 2 + int(binary.BigEndian.Uint16(d.data))
+			if len(d.data) < size {
+				break
+			}
+
+			datas = append(datas, d.data[2:size])
+			d.data = d.data[size:]
+			length = len(d.data)
+		} else if d.indicator != nil {
+			size := d.indicator.NetworkLength()
+			if len(d.data) >= size {
+				datas = append(datas, d.data[:size])
 
-				if len(d.data) > int(d.indicator.IPv4Layer().Length) {
-					d.data = d.data[d.indicator.IPv4Layer().Length:]
+				if len(d.data) > size {
+					d.data = d.data[size:]
 				} else {
 					d.data = make([]byte, 0)
 				}
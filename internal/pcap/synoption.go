@@ -0,0 +1,258 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SYNOptions describes TCP options carried in crafted SYN and SYN+ACK, which imitate the handshake of an OS stack.
+type SYNOptions struct {
+	isDefault bool
+	profile   osProfile
+	// mss is the maximum segment size, 0 as derived from the MTU.
+	mss uint16
+	// wscale is the window scale, negative as not carried.
+	wscale int
+	sack   bool
+	ts     bool
+	window uint16
+}
+
+// timestampStart is the start of the clock of TCP timestamps.
+var timestampStart = time.Now()
+
+func newSYNOptions(profile osProfile) *SYNOptions {
+	switch profile {
+	case osLinux:
+		return &SYNOptions{profile: osLinux, wscale: 7, sack: true, ts: true, window: 64240}
+	case osWindows:
+		return &SYNOptions{profile: osWindows, wscale: 8, sack: true, window: 64240}
+	case osMacOS:
+		return &SYNOptions{profile: osMacOS, wscale: 6, sack: true, ts: true, window: 65535}
+	default:
+		return &SYNOptions{profile: osNone, wscale: -1, window: 65535}
+	}
+}
+
+// nativeSYNOptions returns the SYN options imitating the OS IkaGo runs on.
+func nativeSYNOptions() *SYNOptions {
+	options := newSYNOptions(nativeProfile())
+	options.isDefault = true
+
+	return options
+}
+
+// ParseSYNOptions returns SYN options by the given string, can be empty, or a profile of none, linux, windows or macos
+// followed by overrides of mss N, wscale N, sack, no-sack, ts and no-ts.
+func ParseSYNOptions(s string) (*SYNOptions, error) {
+	fields := strings.Fields(s)
+	if len(fields) <= 0 {
+		return nativeSYNOptions(), nil
+	}
+
+	profile, err := parseProfile(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse profile: %w", err)
+	}
+	options := newSYNOptions(profile)
+
+	// Overrides
+	for i := 1; i < len(fields); i++ {
+		if options.profile == osNone {
+			return nil, fmt.Errorf("syn options %s not support", s)
+		}
+
+		switch fields[i] {
+		case "mss":
+			if i+1 >= len(fields) {
+				return nil, fmt.Errorf("syn options %s not support", s)
+			}
+			i++
+			mss, err := strconv.ParseUint(fields[i], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("parse mss %s: %w", fields[i], err)
+			}
+			if mss < 536 {
+				return nil, fmt.Errorf("mss %d out of range", mss)
+			}
+			options.mss = uint16(mss)
+		case "wscale":
+			if i+1 >= len(fields) {
+				return nil, fmt.Errorf("syn options %s not support", s)
+			}
+			i++
+			wscale, err := strconv.ParseUint(fields[i], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("parse wscale %s: %w", fields[i], err)
+			}
+			if wscale > 14 {
+				return nil, fmt.Errorf("wscale %d out of range", wscale)
+			}
+			options.wscale = int(wscale)
+		case "sack":
+			options.sack = true
+		case "no-sack":
+			options.sack = false
+		case "ts":
+			options.ts = true
+		case "no-ts":
+			options.ts = false
+		default:
+			return nil, fmt.Errorf("syn options %s not support", s)
+		}
+	}
+
+	return options, nil
+}
+
+// IsDefault returns if the options imitate the OS IkaGo runs on.
+func (options *SYNOptions) IsDefault() bool {
+	return options == nil || options.isDefault
+}
+
+// apply sets TCP options of the SYN or SYN+ACK, and returns the window scale carried, negative as not carried. The
+// SYN+ACK only carries options offered in the SYN, which is nil in a SYN.
+func (options *SYNOptions) apply(layer *layers.TCP, mtu int, isIPv6 bool, tsval uint32, syn *layers.TCP) int {
+	if options == nil {
+		options = nativeSYNOptions()
+	}
+
+	layer.Window = options.window
+	if options.profile == osNone {
+		return -1
+	}
+
+	// Negotiate
+	wscale, sack, ts, tsecr := options.wscale, options.sack, options.ts, uint32(0)
+	if syn != nil {
+		var isSACK, isTS bool
+		for _, option := range syn.Options {
+			switch option.OptionType {
+			case layers.TCPOptionKindSACKPermitted:
+				isSACK = true
+			case layers.TCPOptionKindTimestamps:
+				if len(option.OptionData) == 8 {
+					isTS = true
+					tsecr = binary.BigEndian.Uint32(option.OptionData)
+				}
+			}
+		}
+		if windowScale(syn) < 0 {
+			wscale = -1
+		}
+		sack = sack && isSACK
+		ts = ts && isTS
+	}
+
+	// MSS
+	mss := options.mss
+	if mss == 0 {
+		if mtu <= 0 {
+			mtu = DefaultMTU
+		}
+		if isIPv6 {
+			mss = uint16(mtu - 60)
+		} else {
+			mss = uint16(mtu - 40)
+		}
+	}
+
+	mssOption := layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionData: make([]byte, 2)}
+	binary.BigEndian.PutUint16(mssOption.OptionData, mss)
+	nop := layers.TCPOption{OptionType: layers.TCPOptionKindNop}
+	sackOption := layers.TCPOption{OptionType: layers.TCPOptionKindSACKPermitted}
+	tsOption := layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionData: make([]byte, 8)}
+	binary.BigEndian.PutUint32(tsOption.OptionData, tsval)
+	binary.BigEndian.PutUint32(tsOption.OptionData[4:], tsecr)
+	wscaleOption := layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionData: []byte{byte(wscale)}}
+
+	// Layouts of each OS
+	result := []layers.TCPOption{mssOption}
+	switch options.profile {
+	case osLinux:
+		switch {
+		case sack && ts:
+			result = append(result, sackOption, tsOption)
+		case ts:
+			result = append(result, nop, nop, tsOption)
+		case sack:
+			result = append(result, nop, nop, sackOption)
+		}
+		if wscale >= 0 {
+			result = append(result, nop, wscaleOption)
+		}
+	case osWindows:
+		if wscale >= 0 {
+			result = append(result, nop, wscaleOption)
+		}
+		switch {
+		case sack && ts:
+			result = append(result, sackOption, tsOption)
+		case ts:
+			result = append(result, nop, nop, tsOption)
+		case sack:
+			result = append(result, nop, nop, sackOption)
+		}
+	case osMacOS:
+		if wscale >= 0 {
+			result = append(result, nop, wscaleOption)
+		}
+		if ts {
+			result = append(result, nop, nop, tsOption)
+		}
+		if sack {
+			result = append(result, sackOption, layers.TCPOption{OptionType: layers.TCPOptionKindEndList})
+		}
+	}
+
+	layer.Options = result
+
+	return wscale
+}
+
+// windowScale returns the window scale carried by the TCP layer, negative as not carried.
+func windowScale(layer *layers.TCP) int {
+	for _, option := range layer.Options {
+		if option.OptionType == layers.TCPOptionKindWindowScale && len(option.OptionData) == 1 {
+			wscale := int(option.OptionData[0])
+			if wscale > 14 {
+				wscale = 14
+			}
+
+			return wscale
+		}
+	}
+
+	return -1
+}
+
+func (options SYNOptions) String() string {
+	s := options.profile.String()
+	if options.profile == osNone {
+		return s
+	}
+
+	if options.mss != 0 {
+		s = s + fmt.Sprintf(" mss %d", options.mss)
+	}
+	if options.wscale >= 0 {
+		s = s + fmt.Sprintf(" wscale %d", options.wscale)
+	}
+	if options.sack {
+		s = s + " sack"
+	}
+	if options.ts {
+		s = s + " ts"
+	}
+
+	return s
+}
+
+// timestamp returns the TCP timestamp value of a stream with the given offset.
+func timestamp(offset uint32) uint32 {
+	return offset + uint32(time.Now().Sub(timestampStart).Milliseconds())
+}
@@ -1,10 +1,13 @@
 package pcap
 
 import (
+	"errors"
 	"fmt"
+	"ikago/internal/addr"
 	"ikago/internal/crypto"
 	"ikago/internal/log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -16,15 +19,18 @@ type TCPConn struct {
 // DialTCP acts like DialTCP for pcap networks.
 func DialTCP(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt) (*TCPConn, error) {
 	srcAddr := &net.TCPAddr{
-		IP:   dev.IPAddr().IP,
 		Port: int(srcPort),
 	}
+	srcIP := dev.IPAddrByFamily(dstAddr.IP)
+	if srcIP != nil {
+		srcAddr.IP = srcIP.IP
+	}
 
 	log.Infof("Connect to server %s\n", dstAddr.String())
 
 	t := time.Now()
 
-	conn, err := net.DialTCP("tcp4", srcAddr, dstAddr)
+	conn, err := net.DialTCP("tcp", srcAddr, dstAddr)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -39,10 +45,63 @@ func DialTCP(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Cry
 
 	log.Infof("Connected to server %s in %.3f ms (RTT)\n", dstAddr.String(), float64(duration.Microseconds())/1000)
 
-	return &TCPConn{
+	c := &TCPConn{
 		conn:  conn,
-		crypt: crypt,
-	}, nil
+		crypt: newSession(crypt),
+	}
+
+	// Key exchange
+	err = c.exchange()
+	if err != nil {
+		conn.Close()
+
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    fmt.Errorf("key exchange: %w", err),
+		}
+	}
+
+	return c, nil
+}
+
+// exchange exchanges the session key with the server, if key exchange is enabled.
+func (c *TCPConn) exchange() error {
+	crypt, ok := c.crypt.(*crypto.ExchangeCrypt)
+	if !ok {
+		return nil
+	}
+
+	hello, err := crypt.Hello()
+	if err != nil {
+		return fmt.Errorf("hello: %w", err)
+	}
+
+	_, err = c.conn.Write(hello)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// Reply
+	err = c.conn.SetReadDeadline(time.Now().Add(establishDeadline))
+	if err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	p := make([]byte, 65535)
+	n, err := c.conn.Read(p)
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	_, err = crypt.Exchange(p[:n])
+	if err != nil {
+		return err
+	}
+
+	return c.conn.SetReadDeadline(time.Time{})
 }
 
 func (c *TCPConn) Read(b []byte) (n int, err error) {
@@ -52,6 +111,34 @@ func (c *TCPConn) Read(b []byte) (n int, err error) {
 		return 0, err
 	}
 
+	// Key exchange
+	if crypt, ok := c.crypt.(*crypto.ExchangeCrypt); ok && crypt.IsExchange(p[:n]) {
+		reply, err := crypt.Exchange(p[:n])
+		if err != nil {
+			return 0, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   c.RemoteAddr(),
+				Err:    fmt.Errorf("key exchange: %w", err),
+			}
+		}
+		if reply != nil {
+			_, err := c.conn.Write(reply)
+			if err != nil {
+				return 0, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   c.RemoteAddr(),
+					Err:    fmt.Errorf("reply key exchange: %w", err),
+				}
+			}
+		}
+
+		return 0, nil
+	}
+
 	dp, err := c.crypt.Decrypt(p[:n])
 	if err != nil {
 		return 0, &net.OpError{
@@ -108,50 +195,154 @@ func (c *TCPConn) SetWriteDeadline(t time.Time) error {
 	return c.conn.SetWriteDeadline(t)
 }
 
+type tcpAccept struct {
+	conn *net.TCPConn
+	err  error
+}
+
 type TCPListener struct {
-	listener *net.TCPListener
-	crypt    crypto.Crypt
+	listeners []*net.TCPListener
+	crypt     crypto.Crypt
+	keyring   *crypto.Keyring
+	accepts   chan tcpAccept
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
-// ListenTCP acts like ListenTCP for pcap networks.
+// ListenTCP acts like ListenTCP for pcap networks, it announces on both IPv4 and IPv6 addresses of the device.
 func ListenTCP(dev *Device, srcPort uint16, crypt crypto.Crypt) (*TCPListener, error) {
-	srcAddr := &net.TCPAddr{
-		IP:   dev.IPAddr().IP,
-		Port: int(srcPort),
+	ips := make([]*net.IPNet, 0)
+	if ip := dev.IPv4Addr(); ip != nil {
+		ips = append(ips, ip)
+	}
+	if ip := dev.IPv6Addr(); ip != nil {
+		ips = append(ips, ip)
 	}
 
-	listener, err := net.ListenTCP("tcp4", srcAddr)
-	if err != nil {
+	l := &TCPListener{
+		listeners: make([]*net.TCPListener, 0),
+		crypt:     crypt,
+		accepts:   make(chan tcpAccept),
+		closed:    make(chan struct{}),
+	}
+
+	for _, ip := range ips {
+		srcAddr := &net.TCPAddr{
+			IP:   ip.IP,
+			Port: int(srcPort),
+		}
+
+		listener, err := net.ListenTCP("tcp", srcAddr)
+		if err != nil {
+			l.Close()
+
+			return nil, &net.OpError{
+				Op:     "listen",
+				Net:    "pcap",
+				Source: srcAddr,
+				Err:    err,
+			}
+		}
+
+		l.listeners = append(l.listeners, listener)
+	}
+	if len(l.listeners) <= 0 {
 		return nil, &net.OpError{
 			Op:     "listen",
 			Net:    "pcap",
-			Source: srcAddr,
-			Err:    err,
+			Source: &net.TCPAddr{Port: int(srcPort)},
+			Err:    fmt.Errorf("no address in device %s", dev.Alias()),
 		}
 	}
 
-	return &TCPListener{
-		listener: listener,
-		crypt:    crypt,
-	}, nil
+	for _, listener := range l.listeners {
+		go func(listener *net.TCPListener) {
+			for {
+				conn, err := listener.AcceptTCP()
+				select {
+				case l.accepts <- tcpAccept{conn: conn, err: err}:
+				case <-l.closed:
+					if conn != nil {
+						conn.Close()
+					}
+					return
+				}
+			}
+		}(listener)
+	}
+
+	return l, nil
 }
 
 func (l *TCPListener) Accept() (net.Conn, error) {
-	conn, err := l.listener.AcceptTCP()
-	if err != nil {
-		return nil, err
+	var accept tcpAccept
+
+	select {
+	case accept = <-l.accepts:
+	case <-l.closed:
+		return nil, &net.OpError{
+			Op:     "accept",
+			Net:    "pcap",
+			Source: l.Addr(),
+			Err:    errors.New("use of closed listener"),
+		}
+	}
+	if accept.err != nil {
+		return nil, accept.err
+	}
+
+	// Crypt of the client
+	crypt := l.crypt
+	if l.keyring != nil {
+		addr := accept.conn.RemoteAddr().(*net.TCPAddr)
+		crypt = l.keyring.Crypt(addr.IP)
+		if crypt == nil {
+			accept.conn.Close()
+
+			return nil, &net.OpError{
+				Op:     "accept",
+				Net:    "pcap",
+				Source: l.Addr(),
+				Addr:   addr,
+				Err:    fmt.Errorf("client %s unauthorized", addr.IP),
+			}
+		}
 	}
 
 	return &TCPConn{
-		conn:  conn,
-		crypt: l.crypt,
+		conn:  accept.conn,
+		crypt: newSession(crypt),
 	}, nil
 }
 
+// SetKeyring sets the keyring of clients, so each client is accepted with its own crypt, and clients not in the keyring
+// are rejected.
+func (l *TCPListener) SetKeyring(keyring *crypto.Keyring) {
+	l.keyring = keyring
+}
+
 func (l *TCPListener) Close() error {
-	return l.listener.Close()
+	var result error
+
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+
+	for _, listener := range l.listeners {
+		err := listener.Close()
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+
+	return result
 }
 
 func (l *TCPListener) Addr() net.Addr {
-	return l.listener.Addr()
+	addrs := make([]*net.TCPAddr, 0)
+	for _, listener := range l.listeners {
+		addrs = append(addrs, listener.Addr().(*net.TCPAddr))
+	}
+
+	return addr.MultiTCPAddr{Addrs: addrs}
 }
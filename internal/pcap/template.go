@@ -0,0 +1,85 @@
+package pcap
+
+import (
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+)
+
+// layerTemplate describes layers of segments crafted to a client in a stream. Layers are created once, and each
+// segment is built by resetting the layers to the template and setting fields vary in segments, like Seq, Ack and the
+// IPv4 Id, which saves allocating layers in every segment. Layers built are reused, so they must be serialized before
+// the next segment is built.
+type layerTemplate struct {
+	srcIP          net.IP
+	dstIP          net.IP
+	dstPort        uint16
+	hardwareAddr   net.HardwareAddr
+	encap          *Encap
+	transportLayer *layers.TCP
+	networkLayer   gopacket.SerializableLayer
+	linkLayer      gopacket.SerializableLayer
+	tcp            layers.TCP
+	ipv4           layers.IPv4
+	ipv6           layers.IPv6
+}
+
+func newLayerTemplate(srcPort, dstPort uint16, conn *RawConn, dstIP net.IP, hop uint8, hardwareAddr net.HardwareAddr,
+	encap *Encap) (*layerTemplate, error) {
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(srcPort, dstPort, 0, 0, conn, dstIP, 0, hop, hardwareAddr, encap)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &layerTemplate{
+		srcIP:          conn.LocalDev().IPAddrByFamily(dstIP).IP,
+		dstIP:          dstIP,
+		dstPort:        dstPort,
+		hardwareAddr:   hardwareAddr,
+		encap:          encap,
+		transportLayer: transportLayer.(*layers.TCP),
+		networkLayer:   networkLayer,
+		linkLayer:      linkLayer,
+	}
+
+	// The TCP layer keeps the network layer for checksum, which is reset in place, so the reference is kept
+	t.tcp = *t.transportLayer
+	switch l := networkLayer.(type) {
+	case *layers.IPv4:
+		t.ipv4 = *l
+	case *layers.IPv6:
+		t.ipv6 = *l
+	}
+
+	return t, nil
+}
+
+// matches returns if the template crafts segments to the destination through the hop in the connection.
+func (t *layerTemplate) matches(conn *RawConn, dstIP net.IP, dstPort uint16, hardwareAddr net.HardwareAddr, encap *Encap) bool {
+	if t.dstPort != dstPort || !t.dstIP.Equal(dstIP) || !bytes.Equal(t.hardwareAddr, hardwareAddr) || t.encap != encap {
+		return false
+	}
+
+	// Addresses of the device may change
+	srcIP := conn.LocalDev().IPAddrByFamily(dstIP)
+
+	return srcIP != nil && t.srcIP.Equal(srcIP.IP)
+}
+
+// build resets layers to the template with the Seq, the Ack and the IPv4 Id, and returns them.
+func (t *layerTemplate) build(seq, ack uint32, id uint16) (transportLayer, networkLayer, linkLayer gopacket.SerializableLayer) {
+	*t.transportLayer = t.tcp
+	t.transportLayer.Seq = seq
+	t.transportLayer.Ack = ack
+
+	switch l := t.networkLayer.(type) {
+	case *layers.IPv4:
+		*l = t.ipv4
+		l.Id = id
+	case *layers.IPv6:
+		*l = t.ipv6
+	}
+
+	return t.transportLayer, t.networkLayer, t.linkLayer
+}
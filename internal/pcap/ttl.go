@@ -0,0 +1,133 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"strconv"
+	"strings"
+)
+
+type ttlMode int
+
+const (
+	ttlDefault ttlMode = iota
+	ttlPreserve
+	ttlDecrement
+	ttlFixed
+)
+
+// TTLPolicy describes how the TTL or hop limit of crafted packets is decided.
+type TTLPolicy struct {
+	mode ttlMode
+	ttl  uint8
+}
+
+// ParseTTLPolicy returns a TTL policy by the given string, can be empty, preserve, decrement or fixed N.
+func ParseTTLPolicy(s string) (*TTLPolicy, error) {
+	fields := strings.Fields(s)
+	if len(fields) <= 0 {
+		return &TTLPolicy{mode: ttlDefault}, nil
+	}
+
+	switch fields[0] {
+	case "preserve":
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("ttl policy %s not support", s)
+		}
+		return &TTLPolicy{mode: ttlPreserve}, nil
+	case "decrement":
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("ttl policy %s not support", s)
+		}
+		return &TTLPolicy{mode: ttlDecrement}, nil
+	case "fixed":
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("ttl policy %s not support", s)
+		}
+		ttl, err := strconv.ParseUint(fields[1], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("parse ttl %s: %w", fields[1], err)
+		}
+		if ttl <= 0 {
+			return nil, fmt.Errorf("ttl %d out of range", ttl)
+		}
+		return &TTLPolicy{mode: ttlFixed, ttl: uint8(ttl)}, nil
+	default:
+		return nil, fmt.Errorf("ttl policy %s not support", s)
+	}
+}
+
+// IsDefault returns if the policy keeps the default TTL.
+func (policy *TTLPolicy) IsDefault() bool {
+	return policy == nil || policy.mode == ttlDefault
+}
+
+// apply sets the TTL or hop limit of the network layer encapsulating the raw IP packet, the packet can be nil.
+func (policy *TTLPolicy) apply(networkLayer gopacket.SerializableLayer, data []byte) {
+	if policy.IsDefault() {
+		return
+	}
+
+	var ttl uint8
+
+	switch policy.mode {
+	case ttlPreserve, ttlDecrement:
+		t, ok := hopLimit(data)
+		if !ok {
+			return
+		}
+		ttl = t
+		if policy.mode == ttlDecrement && ttl > 1 {
+			ttl--
+		}
+	case ttlFixed:
+		ttl = policy.ttl
+	default:
+		panic(fmt.Errorf("ttl mode %d not support", policy.mode))
+	}
+
+	switch t := networkLayer.(type) {
+	case *layers.IPv4:
+		t.TTL = ttl
+	case *layers.IPv6:
+		t.HopLimit = ttl
+	}
+}
+
+func (policy TTLPolicy) String() string {
+	switch policy.mode {
+	case ttlDefault:
+		return "default"
+	case ttlPreserve:
+		return "preserve"
+	case ttlDecrement:
+		return "decrement"
+	case ttlFixed:
+		return fmt.Sprintf("fixed %d", policy.ttl)
+	default:
+		panic(fmt.Errorf("ttl mode %d not support", policy.mode))
+	}
+}
+
+// hopLimit returns the IPv4 TTL or IPv6 hop limit of the raw IP packet.
+func hopLimit(data []byte) (uint8, bool) {
+	if len(data) < 1 {
+		return 0, false
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return 0, false
+		}
+		return data[8], true
+	case 6:
+		if len(data) < 40 {
+			return 0, false
+		}
+		return data[7], true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,71 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"os"
+	"time"
+)
+
+// tunHandle is a handle reads and writes IP packets in a TUN device, or Ethernet frames in a TAP device, packets are
+// filtered in user space.
+type tunHandle struct {
+	file     *os.File
+	bpf      matcher
+	linkType layers.LinkType
+}
+
+func createTunHandle(dev, filter string, isTap bool) (*tunHandle, error) {
+	linkType := layers.LinkTypeRaw
+	if isTap {
+		linkType = layers.LinkTypeEthernet
+	}
+
+	bpf, err := newMatcher(linkType, filter)
+	if err != nil {
+		return nil, fmt.Errorf("compile filter: %w", err)
+	}
+
+	file, err := openTun(dev, isTap)
+	if err != nil {
+		return nil, fmt.Errorf("open tun: %w", err)
+	}
+
+	return &tunHandle{file: file, bpf: bpf, linkType: linkType}, nil
+}
+
+func (h *tunHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	b := make([]byte, maxSnapLen)
+
+	for {
+		n, err := h.file.Read(b)
+		if err != nil {
+			return nil, gopacket.CaptureInfo{}, err
+		}
+
+		ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: n, Length: n}
+		if h.bpf.Matches(ci, b[:n]) {
+			return b[:n], ci, nil
+		}
+	}
+}
+
+func (h *tunHandle) WritePacketData(data []byte) error {
+	_, err := h.file.Write(data)
+
+	return err
+}
+
+func (h *tunHandle) LinkType() layers.LinkType {
+	return h.linkType
+}
+
+func (h *tunHandle) SetDirection(direction direction) error {
+	// Packets written are never read back
+	return nil
+}
+
+func (h *tunHandle) Close() {
+	h.file.Close()
+}
@@ -0,0 +1,50 @@
+package pcap
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	tunSetIff = 0x400454ca
+	iffTun    = 0x0001
+	iffTap    = 0x0002
+	iffNoPI   = 0x1000
+)
+
+type ifReq struct {
+	name  [16]byte
+	flags uint16
+	_     [22]byte
+}
+
+func openTun(dev string, isTap bool) (*os.File, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Attach to the device
+	var req ifReq
+	copy(req.name[:len(req.name)-1], dev)
+	if isTap {
+		req.flags = iffTap | iffNoPI
+	} else {
+		req.flags = iffTun | iffNoPI
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIff, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, errno
+	}
+
+	// Non-blocking so that reads can be interrupted by closing
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package pcap
+
+import (
+	"errors"
+	"os"
+)
+
+func openTun(dev string, isTap bool) (*os.File, error) {
+	return nil, errors.New("tun not support")
+}
@@ -0,0 +1,152 @@
+package pcap
+
+import (
+	"github.com/google/gopacket"
+	"math"
+	"sync"
+)
+
+// WorkerPool describes a pool of goroutines handling values, like packets, where values of the same flow are always
+// handled by the same worker. Values in a flow are handled in order, and flows are handled in parallel.
+type WorkerPool struct {
+	workers []*worker
+}
+
+// worker describes a goroutine handling values in bounded queues of traffic classes, where values in a class are
+// handled only if classes before it are empty.
+type worker struct {
+	lock     sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	queues   [classes]*ringQueue
+}
+
+// NewWorkerPool returns a new worker pool of the size, where each worker queues values of each traffic class up to
+// the length. Values submitted to a full queue are dropped or block by the policy of the class, and classes without
+// policies block.
+func NewWorkerPool(size, length int, policies map[TrafficClass]QueuePolicy, handle func(v interface{})) *WorkerPool {
+	if size <= 0 {
+		size = 1
+	}
+
+	p := &WorkerPool{workers: make([]*worker, size)}
+	for i := range p.workers {
+		w := &worker{}
+		w.notEmpty = sync.NewCond(&w.lock)
+		w.notFull = sync.NewCond(&w.lock)
+		for class := range w.queues {
+			w.queues[class] = newRingQueue(length, policies[TrafficClass(class)])
+		}
+		p.workers[i] = w
+
+		go w.run(handle)
+	}
+
+	return p
+}
+
+func (w *worker) run(handle func(v interface{})) {
+	for {
+		w.lock.Lock()
+		queue := w.next()
+		for queue == nil {
+			w.notEmpty.Wait()
+			queue = w.next()
+		}
+		v := queue.pop()
+		w.notFull.Broadcast()
+		w.lock.Unlock()
+
+		handle(v)
+	}
+}
+
+// next returns the first queue not empty, or nil if all queues are empty.
+func (w *worker) next() *ringQueue {
+	for _, queue := range w.queues {
+		if !queue.isEmpty() {
+			return queue
+		}
+	}
+
+	return nil
+}
+
+// Submit queues the value of the traffic class in the size to the worker of the hash of its flow. It returns false if
+// the value is dropped.
+func (p *WorkerPool) Submit(hash uint64, class TrafficClass, size int, v interface{}) bool {
+	w := p.workers[hash%uint64(len(p.workers))]
+	queue := w.queues[class]
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if queue.policy == QueueBlock {
+		for queue.isFull() {
+			w.notFull.Wait()
+		}
+	}
+	if !queue.push(v) {
+		return false
+	}
+	queue.packets++
+	queue.bytes = queue.bytes + uint64(size)
+	w.notEmpty.Signal()
+
+	return true
+}
+
+// Backlog returns the fraction in use of the fullest queue of the worker of the hash.
+func (p *WorkerPool) Backlog(hash uint64) float64 {
+	w := p.workers[hash%uint64(len(p.workers))]
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var backlog float64
+	for _, queue := range w.queues {
+		backlog = math.Max(backlog, float64(queue.length)/float64(len(queue.items)))
+	}
+
+	return backlog
+}
+
+// Stats returns the status of queues of each traffic class in all workers.
+func (p *WorkerPool) Stats() []QueueStat {
+	stats := make([]QueueStat, classes)
+	for class := range stats {
+		stats[class].Class = TrafficClass(class).String()
+	}
+
+	for _, w := range p.workers {
+		w.lock.Lock()
+		for class, queue := range w.queues {
+			stats[class].Policy = queue.policy.String()
+			stats[class].Length += queue.length
+			stats[class].Capacity += len(queue.items)
+			stats[class].Packets += queue.packets
+			stats[class].Bytes += queue.bytes
+			stats[class].Drops += queue.drops
+		}
+		w.lock.Unlock()
+	}
+
+	return stats
+}
+
+// FlowHash returns the hash of the flow of the packet, which is the same in both directions. Packets without transport
+// layers, like fragments and ICMP, are hashed by their network layers.
+func FlowHash(packet gopacket.Packet) uint64 {
+	var h uint64
+
+	networkLayer := packet.NetworkLayer()
+	if networkLayer != nil {
+		h = networkLayer.NetworkFlow().FastHash()
+	}
+	transportLayer := packet.TransportLayer()
+	if transportLayer != nil {
+		h = h*31 + transportLayer.TransportFlow().FastHash()
+	}
+
+	return h
+}
@@ -0,0 +1,498 @@
+// +build !nopcap
+
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	xdpFrameSize  = 4096
+	xdpNumFrames  = 2048
+	xdpRingSize   = 1024
+	xdpPollPeriod = 100
+)
+
+// xdpLendMax is the number of frames of a socket lent to packets at most, beyond which frames are copied, so frames
+// released late or never do not starve the fill ring.
+const xdpLendMax = xdpRingSize / 2
+
+// xdpRing is a ring shared with the kernel, whose descriptors are addresses in fill and completion rings, or
+// unix.XDPDesc in RX and TX rings.
+type xdpRing struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	descs    unsafe.Pointer
+	mask     uint32
+}
+
+func mmapXDPRing(fd int, pgoff int64, off unix.XDPRingOffset, descSize int) (*xdpRing, error) {
+	mem, err := unix.Mmap(fd, pgoff, int(off.Desc)+xdpRingSize*descSize, unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return nil, err
+	}
+
+	return &xdpRing{
+		mem:      mem,
+		producer: (*uint32)(unsafe.Pointer(&mem[off.Producer])),
+		consumer: (*uint32)(unsafe.Pointer(&mem[off.Consumer])),
+		descs:    unsafe.Pointer(&mem[off.Desc]),
+		mask:     xdpRingSize - 1,
+	}, nil
+}
+
+func (r *xdpRing) addr(i uint32) *uint64 {
+	return (*uint64)(unsafe.Pointer(uintptr(r.descs) + uintptr(i&r.mask)*8))
+}
+
+func (r *xdpRing) desc(i uint32) *unix.XDPDesc {
+	return (*unix.XDPDesc)(unsafe.Pointer(uintptr(r.descs) + uintptr(i&r.mask)*unsafe.Sizeof(unix.XDPDesc{})))
+}
+
+// xdpSocket is an XDP socket bound to a queue of the device with its own UMEM.
+type xdpSocket struct {
+	fd       int
+	umem     []byte
+	fill     *xdpRing
+	fillLock sync.Mutex
+	comp     *xdpRing
+	rx       *xdpRing
+	tx       *xdpRing
+	frames   []uint64
+	lent     int32
+}
+
+// xdpLoan is a frame of a socket lent to a packet, which is returned to the fill ring once the packet is released.
+type xdpLoan struct {
+	socket     *xdpSocket
+	addr       uint64
+	isReleased int32
+}
+
+func (l *xdpLoan) Release() {
+	if !atomic.CompareAndSwapInt32(&l.isReleased, 0, 1) {
+		return
+	}
+
+	l.socket.refill(l.addr)
+	atomic.AddInt32(&l.socket.lent, -1)
+}
+
+func getsockopt(fd, level, opt int, val unsafe.Pointer, size uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt), uintptr(val),
+		uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func setsockopt(fd, level, opt int, val unsafe.Pointer, size uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt), uintptr(val), size, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func createXDPSocket(ifIndex, queue int) (*xdpSocket, error) {
+	fd, err := unix.Socket(unix.AF_XDP, unix.SOCK_RAW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("create socket: %w", err)
+	}
+
+	s := &xdpSocket{fd: fd}
+
+	err = s.setup(ifIndex, queue)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *xdpSocket) setup(ifIndex, queue int) error {
+	var err error
+
+	// UMEM
+	s.umem, err = unix.Mmap(-1, 0, xdpNumFrames*xdpFrameSize, unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("map umem: %w", err)
+	}
+
+	reg := unix.XDPUmemReg{
+		Addr: uint64(uintptr(unsafe.Pointer(&s.umem[0]))),
+		Len:  uint64(len(s.umem)),
+		Size: xdpFrameSize,
+	}
+	err = setsockopt(s.fd, unix.SOL_XDP, unix.XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg))
+	if err != nil {
+		return fmt.Errorf("register umem: %w", err)
+	}
+
+	// Rings
+	for _, opt := range []int{unix.XDP_UMEM_FILL_RING, unix.XDP_UMEM_COMPLETION_RING, unix.XDP_RX_RING, unix.XDP_TX_RING} {
+		err = unix.SetsockoptInt(s.fd, unix.SOL_XDP, opt, xdpRingSize)
+		if err != nil {
+			return fmt.Errorf("set ring: %w", err)
+		}
+	}
+
+	var off unix.XDPMmapOffsets
+	err = getsockopt(s.fd, unix.SOL_XDP, unix.XDP_MMAP_OFFSETS, unsafe.Pointer(&off), unsafe.Sizeof(off))
+	if err != nil {
+		return fmt.Errorf("get ring offsets: %w", err)
+	}
+
+	s.fill, err = mmapXDPRing(s.fd, unix.XDP_UMEM_PGOFF_FILL_RING, off.Fr, 8)
+	if err != nil {
+		return fmt.Errorf("map fill ring: %w", err)
+	}
+	s.comp, err = mmapXDPRing(s.fd, unix.XDP_UMEM_PGOFF_COMPLETION_RING, off.Cr, 8)
+	if err != nil {
+		return fmt.Errorf("map completion ring: %w", err)
+	}
+	s.rx, err = mmapXDPRing(s.fd, unix.XDP_PGOFF_RX_RING, off.Rx, int(unsafe.Sizeof(unix.XDPDesc{})))
+	if err != nil {
+		return fmt.Errorf("map rx ring: %w", err)
+	}
+	s.tx, err = mmapXDPRing(s.fd, unix.XDP_PGOFF_TX_RING, off.Tx, int(unsafe.Sizeof(unix.XDPDesc{})))
+	if err != nil {
+		return fmt.Errorf("map tx ring: %w", err)
+	}
+
+	// Half of frames are for receiving, and the other half are for transmitting
+	for i := 0; i < xdpRingSize; i++ {
+		*s.fill.addr(uint32(i)) = uint64(i * xdpFrameSize)
+	}
+	atomic.StoreUint32(s.fill.producer, xdpRingSize)
+
+	s.frames = make([]uint64, 0, xdpNumFrames-xdpRingSize)
+	for i := xdpRingSize; i < xdpNumFrames; i++ {
+		s.frames = append(s.frames, uint64(i*xdpFrameSize))
+	}
+
+	// Bind in zero-copy mode, or in copy mode if the driver does not support
+	err = unix.Bind(s.fd, &unix.SockaddrXDP{Flags: unix.XDP_ZEROCOPY, Ifindex: uint32(ifIndex), QueueID: uint32(queue)})
+	if err != nil {
+		err = unix.Bind(s.fd, &unix.SockaddrXDP{Flags: unix.XDP_COPY, Ifindex: uint32(ifIndex), QueueID: uint32(queue)})
+		if err != nil {
+			return fmt.Errorf("bind: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// receive returns a frame in the RX ring, the frame should be refilled after used.
+func (s *xdpSocket) receive() (uint64, []byte, bool) {
+	cons := atomic.LoadUint32(s.rx.consumer)
+	if cons == atomic.LoadUint32(s.rx.producer) {
+		return 0, nil, false
+	}
+
+	desc := *s.rx.desc(cons)
+	atomic.StoreUint32(s.rx.consumer, cons+1)
+
+	// Addresses may carry an offset in the frame
+	frame := desc.Addr &^ (xdpFrameSize - 1)
+
+	return frame, s.umem[desc.Addr : desc.Addr+uint64(desc.Len)], true
+}
+
+// refill returns the frame to the fill ring, frames are returned by the reader and by packets released in parallel.
+func (s *xdpSocket) refill(frame uint64) {
+	s.fillLock.Lock()
+	defer s.fillLock.Unlock()
+
+	prod := atomic.LoadUint32(s.fill.producer)
+	*s.fill.addr(prod) = frame
+	atomic.StoreUint32(s.fill.producer, prod+1)
+}
+
+// complete takes frames transmitted back.
+func (s *xdpSocket) complete() {
+	cons := atomic.LoadUint32(s.comp.consumer)
+	prod := atomic.LoadUint32(s.comp.producer)
+	for ; cons != prod; cons++ {
+		s.frames = append(s.frames, *s.comp.addr(cons)&^(xdpFrameSize-1))
+	}
+	atomic.StoreUint32(s.comp.consumer, cons)
+}
+
+func (s *xdpSocket) transmit(data []byte) error {
+	if len(data) > xdpFrameSize {
+		return fmt.Errorf("frame size %d out of range", len(data))
+	}
+
+	s.complete()
+	if len(s.frames) <= 0 {
+		s.kick()
+		s.complete()
+		if len(s.frames) <= 0 {
+			return errors.New("tx ring full")
+		}
+	}
+
+	frame := s.frames[len(s.frames)-1]
+	s.frames = s.frames[:len(s.frames)-1]
+	copy(s.umem[frame:], data)
+
+	prod := atomic.LoadUint32(s.tx.producer)
+	*s.tx.desc(prod) = unix.XDPDesc{Addr: frame, Len: uint32(len(data))}
+	atomic.StoreUint32(s.tx.producer, prod+1)
+
+	s.kick()
+
+	return nil
+}
+
+func (s *xdpSocket) kick() {
+	_, _, _ = unix.Syscall6(unix.SYS_SENDTO, uintptr(s.fd), 0, 0, unix.MSG_DONTWAIT, 0, 0)
+}
+
+func (s *xdpSocket) close() {
+	for _, r := range []*xdpRing{s.fill, s.comp, s.rx, s.tx} {
+		if r != nil {
+			unix.Munmap(r.mem)
+		}
+	}
+	unix.Close(s.fd)
+	if s.umem != nil {
+		unix.Munmap(s.umem)
+	}
+}
+
+// xdpHandle is a handle reads Ethernet frames redirected by an XDP program to XDP sockets in all queues of the
+// device, and writes frames in the first queue. Frames received are passed to the caller without copying, and are
+// returned to the kernel at the next read, or once packets they are lent to are released.
+type xdpHandle struct {
+	sockets  []*xdpSocket
+	fds      []unix.PollFd
+	mapFD    int
+	progFD   int
+	linkFD   int
+	next     int
+	last     *xdpSocket
+	lastAddr uint64
+	isClosed int32
+	mutex    sync.Mutex
+}
+
+func xdpQueues(dev string) int {
+	infos, err := ioutil.ReadDir("/sys/class/net/" + dev + "/queues")
+	if err != nil {
+		return 1
+	}
+
+	n := 0
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), "rx-") {
+			n++
+		}
+	}
+	if n <= 0 {
+		return 1
+	}
+
+	return n
+}
+
+// createXDPHandle returns a handle of frames matched by the filter, where frames not owned are passed to the kernel
+// even if they are matched, so traffic of the host is kept. All frames matched are owned if owned is empty.
+func createXDPHandle(dev, filter, owned string) (*xdpHandle, error) {
+	inter, err := net.InterfaceByName(dev)
+	if err != nil {
+		return nil, fmt.Errorf("find interface: %w", err)
+	}
+
+	if owned != "" {
+		filter = fmt.Sprintf("(%s) && (%s)", filter, owned)
+	}
+
+	// Frames on trunked or PPPoE interfaces may be encapsulated
+	insts, err := compileEncapFilter(filter)
+	if err != nil {
+		return nil, fmt.Errorf("compile filter: %w", err)
+	}
+
+	h := &xdpHandle{mapFD: -1, progFD: -1, linkFD: -1}
+
+	err = h.setup(inter.Index, xdpQueues(dev), insts)
+	if err != nil {
+		h.release()
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (h *xdpHandle) setup(ifIndex, queues int, insts []pcap.BPFInstruction) error {
+	var err error
+
+	h.mapFD, err = createXSKMap(queues)
+	if err != nil {
+		return fmt.Errorf("create map: %w", err)
+	}
+
+	for i := 0; i < queues; i++ {
+		s, err := createXDPSocket(ifIndex, i)
+		if err != nil {
+			return fmt.Errorf("create socket in queue %d: %w", i, err)
+		}
+		h.sockets = append(h.sockets, s)
+		h.fds = append(h.fds, unix.PollFd{Fd: int32(s.fd), Events: unix.POLLIN})
+
+		err = updateXSKMap(h.mapFD, i, s.fd)
+		if err != nil {
+			return fmt.Errorf("update map: %w", err)
+		}
+	}
+
+	prog, err := compileXDPProg(insts, h.mapFD)
+	if err != nil {
+		return fmt.Errorf("compile program: %w", err)
+	}
+
+	h.progFD, err = loadXDPProg(prog)
+	if err != nil {
+		return fmt.Errorf("load program: %w", err)
+	}
+
+	h.linkFD, err = attachXDPProg(h.progFD, ifIndex)
+	if err != nil {
+		return fmt.Errorf("attach program: %w", err)
+	}
+
+	return nil
+}
+
+func (h *xdpHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	// Return the previous frame
+	if h.last != nil {
+		h.last.refill(h.lastAddr)
+		h.last = nil
+	}
+
+	s, addr, data, err := h.receive()
+	if err != nil {
+		return nil, gopacket.CaptureInfo{}, err
+	}
+	h.last = s
+	h.lastAddr = addr
+
+	return data, gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}, nil
+}
+
+// LendPacketData returns a frame lent to the caller, which is returned to the socket once it is released by the
+// release in the ancillary data. Frames are copied instead if too many frames are lent.
+func (h *xdpHandle) LendPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	s, addr, data, err := h.receive()
+	if err != nil {
+		return nil, gopacket.CaptureInfo{}, err
+	}
+
+	ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}
+	if atomic.AddInt32(&s.lent, 1) > xdpLendMax {
+		atomic.AddInt32(&s.lent, -1)
+		b := make([]byte, len(data))
+		copy(b, data)
+		s.refill(addr)
+
+		return b, ci, nil
+	}
+	ci.AncillaryData = []interface{}{&xdpLoan{socket: s, addr: addr}}
+
+	return data, ci, nil
+}
+
+// receive returns a frame received in any socket in turn, and waits if there is none.
+func (h *xdpHandle) receive() (*xdpSocket, uint64, []byte, error) {
+	for atomic.LoadInt32(&h.isClosed) == 0 {
+		for i := 0; i < len(h.sockets); i++ {
+			s := h.sockets[(h.next+i)%len(h.sockets)]
+
+			addr, data, ok := s.receive()
+			if !ok {
+				continue
+			}
+
+			h.next = (h.next + i + 1) % len(h.sockets)
+
+			return s, addr, data, nil
+		}
+
+		_, err := unix.Poll(h.fds, pollTimeout(xdpPollPeriod))
+		if err != nil && err != unix.EINTR {
+			return nil, 0, nil, err
+		}
+	}
+
+	return nil, 0, nil, io.EOF
+}
+
+func (h *xdpHandle) WritePacketData(data []byte) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.sockets[0].transmit(data)
+}
+
+func (h *xdpHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (h *xdpHandle) SetDirection(direction direction) error {
+	// XDP only sees frames received
+	if direction == directionIn {
+		return nil
+	}
+
+	return errors.New("direction not support")
+}
+
+func (h *xdpHandle) Close() {
+	if !atomic.CompareAndSwapInt32(&h.isClosed, 0, 1) {
+		return
+	}
+
+	// Rings and UMEM are kept mapped since the reader may be still in them
+	h.detach()
+	for _, s := range h.sockets {
+		unix.Close(s.fd)
+	}
+}
+
+func (h *xdpHandle) detach() {
+	for _, fd := range []int{h.linkFD, h.progFD, h.mapFD} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+}
+
+func (h *xdpHandle) release() {
+	h.detach()
+	for _, s := range h.sockets {
+		s.close()
+	}
+}
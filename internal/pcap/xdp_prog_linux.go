@@ -0,0 +1,466 @@
+// +build !nopcap
+
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/sys/unix"
+	"runtime"
+	"unsafe"
+)
+
+// Classic BPF
+const (
+	cbpfLD   = 0x00
+	cbpfLDX  = 0x01
+	cbpfST   = 0x02
+	cbpfSTX  = 0x03
+	cbpfALU  = 0x04
+	cbpfJMP  = 0x05
+	cbpfRET  = 0x06
+	cbpfMISC = 0x07
+
+	cbpfW = 0x00
+	cbpfH = 0x08
+	cbpfB = 0x10
+
+	cbpfIMM = 0x00
+	cbpfABS = 0x20
+	cbpfIND = 0x40
+	cbpfMEM = 0x60
+	cbpfLEN = 0x80
+	cbpfMSH = 0xa0
+
+	cbpfK = 0x00
+	cbpfX = 0x08
+	cbpfA = 0x10
+
+	cbpfNEG = 0x80
+	cbpfDIV = 0x30
+	cbpfMOD = 0x90
+
+	cbpfJA = 0x00
+
+	cbpfTAX = 0x00
+	cbpfTXA = 0x80
+
+	cbpfMemWords = 16
+)
+
+// eBPF
+const (
+	ebpfLD    = 0x00
+	ebpfLDX   = 0x01
+	ebpfST    = 0x02
+	ebpfSTX   = 0x03
+	ebpfALU   = 0x04
+	ebpfJMP   = 0x05
+	ebpfJMP32 = 0x06
+	ebpfALU64 = 0x07
+
+	ebpfW  = 0x00
+	ebpfH  = 0x08
+	ebpfB  = 0x10
+	ebpfDW = 0x18
+
+	ebpfIMM = 0x00
+	ebpfMEM = 0x60
+
+	ebpfK = 0x00
+	ebpfX = 0x08
+
+	ebpfADD         = 0x00
+	ebpfSUB         = 0x10
+	ebpfAND         = 0x50
+	ebpfLSH         = 0x60
+	ebpfMOV         = 0xb0
+	ebpfEND         = 0xd0
+	ebpfToBE        = 0x08
+	ebpfJA          = 0x00
+	ebpfJEQ         = 0x10
+	ebpfJGT         = 0x20
+	ebpfCALL        = 0x80
+	ebpfEXIT        = 0x90
+	ebpfPseudoMapFD = 1
+
+	ebpfFuncRedirectMap = 51
+)
+
+// eBPF registers, A and X of classic BPF are kept in R8 and R9, packet pointers in R6 and R7
+const (
+	r0 = iota
+	r1
+	r2
+	r3
+	r4
+	r5
+	r6
+	r7
+	r8
+	r9
+	r10
+)
+
+// Offsets in the stack, scratch memory of classic BPF is followed by the RX queue index
+const (
+	stackMem   = -4 * cbpfMemWords
+	stackQueue = stackMem - 8
+)
+
+const (
+	xdpPass = 2
+
+	xdpMdData         = 0
+	xdpMdDataEnd      = 4
+	xdpMdRxQueueIndex = 16
+)
+
+const (
+	bpfMapCreate     = 0
+	bpfMapUpdateElem = 2
+	bpfProgLoad      = 5
+	bpfLinkCreate    = 28
+
+	bpfMapTypeXSKMap = 17
+	bpfProgTypeXDP   = 6
+	bpfAttachXDP     = 37
+)
+
+type ebpfInst struct {
+	code uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+func newEBPFInst(code uint8, dst, src uint8, off int16, imm int32) ebpfInst {
+	return ebpfInst{code: code, regs: src<<4 | dst, off: off, imm: imm}
+}
+
+// xdpJump is a jump to be fixed up, the target is an index of the classic BPF, or a label if negative.
+type xdpJump struct {
+	inst   int
+	target int
+}
+
+const (
+	labelPass     = -1
+	labelRedirect = -2
+)
+
+type xdpProgBuilder struct {
+	insts []ebpfInst
+	jumps []xdpJump
+}
+
+func (b *xdpProgBuilder) emit(code uint8, dst, src uint8, off int16, imm int32) {
+	b.insts = append(b.insts, newEBPFInst(code, dst, src, off, imm))
+}
+
+func (b *xdpProgBuilder) emitJump(code uint8, dst, src uint8, imm int32, target int) {
+	b.jumps = append(b.jumps, xdpJump{inst: len(b.insts), target: target})
+	b.emit(code, dst, src, 0, imm)
+}
+
+// emitLoad loads size bytes at the offset of the packet pointer in R2 to the register, packets too short are passed.
+func (b *xdpProgBuilder) emitLoad(dst uint8, size int) {
+	var s uint8
+	switch size {
+	case 1:
+		s = ebpfB
+	case 2:
+		s = ebpfH
+	case 4:
+		s = ebpfW
+	}
+
+	b.emit(ebpfALU64|ebpfMOV|ebpfX, r3, r2, 0, 0)
+	b.emit(ebpfALU64|ebpfADD|ebpfK, r3, 0, 0, int32(size))
+	b.emitJump(ebpfJMP|ebpfJGT|ebpfX, r3, r7, 0, labelPass)
+	b.emit(ebpfLDX|ebpfMEM|s, dst, r2, 0, 0)
+	if size > 1 {
+		b.emit(ebpfALU|ebpfEND|ebpfToBE, dst, 0, 0, int32(size*8))
+	}
+}
+
+func cbpfSize(code uint16) int {
+	switch code & 0x18 {
+	case cbpfW:
+		return 4
+	case cbpfH:
+		return 2
+	case cbpfB:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// compileXDPProg translates a classic BPF program to an XDP program, which redirects packets accepted to the XSK map
+// by the RX queue index, and passes the others to the kernel.
+func compileXDPProg(filter []pcap.BPFInstruction, mapFD int) ([]ebpfInst, error) {
+	b := &xdpProgBuilder{}
+	starts := make([]int, len(filter))
+
+	// Prologue
+	b.emit(ebpfLDX|ebpfMEM|ebpfW, r6, r1, xdpMdData, 0)
+	b.emit(ebpfLDX|ebpfMEM|ebpfW, r7, r1, xdpMdDataEnd, 0)
+	b.emit(ebpfLDX|ebpfMEM|ebpfW, r2, r1, xdpMdRxQueueIndex, 0)
+	b.emit(ebpfSTX|ebpfMEM|ebpfW, r10, r2, stackQueue, 0)
+	b.emit(ebpfALU64|ebpfMOV|ebpfK, r8, 0, 0, 0)
+	b.emit(ebpfALU64|ebpfMOV|ebpfK, r9, 0, 0, 0)
+	for i := 0; i < cbpfMemWords; i++ {
+		b.emit(ebpfST|ebpfMEM|ebpfW, r10, 0, int16(stackMem+4*i), 0)
+	}
+
+	for i, inst := range filter {
+		starts[i] = len(b.insts)
+		k := int32(inst.K)
+
+		switch class := inst.Code & 0x07; class {
+		case cbpfLD, cbpfLDX:
+			dst := uint8(r8)
+			if class == cbpfLDX {
+				dst = r9
+			}
+
+			switch mode := inst.Code & 0xe0; mode {
+			case cbpfIMM:
+				b.emit(ebpfALU|ebpfMOV|ebpfK, dst, 0, 0, k)
+			case cbpfMEM:
+				if inst.K >= cbpfMemWords {
+					return nil, fmt.Errorf("memory %d out of range", inst.K)
+				}
+				b.emit(ebpfLDX|ebpfMEM|ebpfW, dst, r10, int16(stackMem+4*k), 0)
+			case cbpfABS, cbpfIND, cbpfMSH:
+				if class == cbpfLD && mode == cbpfMSH || class == cbpfLDX && mode != cbpfMSH {
+					return nil, fmt.Errorf("instruction %#x not support", inst.Code)
+				}
+				if inst.K > 0xffff {
+					return nil, fmt.Errorf("offset %d out of range", inst.K)
+				}
+
+				b.emit(ebpfALU64|ebpfMOV|ebpfX, r2, r6, 0, 0)
+				if mode == cbpfIND {
+					// Offsets are bounded for the verifier
+					b.emitJump(ebpfJMP|ebpfJGT|ebpfK, r9, 0, 0xffff, labelPass)
+					b.emit(ebpfALU64|ebpfADD|ebpfX, r2, r9, 0, 0)
+				}
+				b.emit(ebpfALU64|ebpfADD|ebpfK, r2, 0, 0, k)
+
+				if mode == cbpfMSH {
+					b.emitLoad(dst, 1)
+					b.emit(ebpfALU|ebpfAND|ebpfK, dst, 0, 0, 0xf)
+					b.emit(ebpfALU|ebpfLSH|ebpfK, dst, 0, 0, 2)
+				} else {
+					size := cbpfSize(inst.Code)
+					if size == 0 {
+						return nil, fmt.Errorf("instruction %#x not support", inst.Code)
+					}
+					b.emitLoad(dst, size)
+				}
+			default:
+				// Lengths of packets can not be told since pointers can not be subtracted
+				return nil, fmt.Errorf("instruction %#x not support", inst.Code)
+			}
+		case cbpfST, cbpfSTX:
+			if inst.K >= cbpfMemWords {
+				return nil, fmt.Errorf("memory %d out of range", inst.K)
+			}
+
+			src := uint8(r8)
+			if class == cbpfSTX {
+				src = r9
+			}
+			b.emit(ebpfSTX|ebpfMEM|ebpfW, r10, src, int16(stackMem+4*k), 0)
+		case cbpfALU:
+			op := uint8(inst.Code & 0xf0)
+			if op == cbpfNEG {
+				b.emit(ebpfALU|op, r8, 0, 0, 0)
+				break
+			}
+
+			if inst.Code&0x08 == cbpfX {
+				// Division by zero rejects the packet
+				if op == cbpfDIV || op == cbpfMOD {
+					b.emitJump(ebpfJMP|ebpfJEQ|ebpfK, r9, 0, 0, labelPass)
+				}
+				b.emit(ebpfALU|op|ebpfX, r8, r9, 0, 0)
+			} else {
+				if (op == cbpfDIV || op == cbpfMOD) && k == 0 {
+					return nil, errors.New("division by zero")
+				}
+				b.emit(ebpfALU|op|ebpfK, r8, 0, 0, k)
+			}
+		case cbpfJMP:
+			op := uint8(inst.Code & 0xf0)
+			if op == cbpfJA {
+				b.emitJump(ebpfJMP|ebpfJA, 0, 0, 0, i+1+int(inst.K))
+				break
+			}
+
+			if inst.Code&0x08 == cbpfX {
+				b.emitJump(ebpfJMP32|op|ebpfX, r8, r9, 0, i+1+int(inst.Jt))
+			} else {
+				b.emitJump(ebpfJMP32|op|ebpfK, r8, 0, k, i+1+int(inst.Jt))
+			}
+			if inst.Jf != 0 {
+				b.emitJump(ebpfJMP|ebpfJA, 0, 0, 0, i+1+int(inst.Jf))
+			}
+		case cbpfRET:
+			switch inst.Code & 0x18 {
+			case cbpfK:
+				if inst.K == 0 {
+					b.emitJump(ebpfJMP|ebpfJA, 0, 0, 0, labelPass)
+				} else {
+					b.emitJump(ebpfJMP|ebpfJA, 0, 0, 0, labelRedirect)
+				}
+			case cbpfA:
+				b.emitJump(ebpfJMP32|ebpfJEQ|ebpfK, r8, 0, 0, labelPass)
+				b.emitJump(ebpfJMP|ebpfJA, 0, 0, 0, labelRedirect)
+			default:
+				return nil, fmt.Errorf("instruction %#x not support", inst.Code)
+			}
+		case cbpfMISC:
+			switch inst.Code & 0xf8 {
+			case cbpfTAX:
+				b.emit(ebpfALU|ebpfMOV|ebpfX, r9, r8, 0, 0)
+			case cbpfTXA:
+				b.emit(ebpfALU|ebpfMOV|ebpfX, r8, r9, 0, 0)
+			default:
+				return nil, fmt.Errorf("instruction %#x not support", inst.Code)
+			}
+		default:
+			return nil, fmt.Errorf("instruction %#x not support", inst.Code)
+		}
+	}
+
+	// Pass
+	pass := len(b.insts)
+	b.emit(ebpfALU64|ebpfMOV|ebpfK, r0, 0, 0, xdpPass)
+	b.emit(ebpfJMP|ebpfEXIT, 0, 0, 0, 0)
+
+	// Redirect, and pass if there is no socket in the queue
+	redirect := len(b.insts)
+	b.emit(ebpfLD|ebpfIMM|ebpfDW, r1, ebpfPseudoMapFD, 0, int32(mapFD))
+	b.emit(0, 0, 0, 0, 0)
+	b.emit(ebpfLDX|ebpfMEM|ebpfW, r2, r10, stackQueue, 0)
+	b.emit(ebpfALU64|ebpfMOV|ebpfK, r3, 0, 0, xdpPass)
+	b.emit(ebpfJMP|ebpfCALL, 0, 0, 0, ebpfFuncRedirectMap)
+	b.emit(ebpfJMP|ebpfEXIT, 0, 0, 0, 0)
+
+	// Fix up jumps
+	for _, jump := range b.jumps {
+		var target int
+		switch {
+		case jump.target == labelPass:
+			target = pass
+		case jump.target == labelRedirect:
+			target = redirect
+		case jump.target < len(starts):
+			target = starts[jump.target]
+		default:
+			return nil, fmt.Errorf("jump %d out of range", jump.target)
+		}
+
+		off := target - jump.inst - 1
+		if off > 0x7fff {
+			return nil, fmt.Errorf("jump %d out of range", off)
+		}
+		b.insts[jump.inst].off = int16(off)
+	}
+
+	return b.insts, nil
+}
+
+func sysBPF(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return int(fd), nil
+}
+
+func createXSKMap(entries int) (int, error) {
+	attr := struct {
+		mapType    uint32
+		keySize    uint32
+		valueSize  uint32
+		maxEntries uint32
+	}{mapType: bpfMapTypeXSKMap, keySize: 4, valueSize: 4, maxEntries: uint32(entries)}
+
+	return sysBPF(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func updateXSKMap(mapFD int, queue, fd int) error {
+	key, value := uint32(queue), uint32(fd)
+	attr := struct {
+		mapFD uint32
+		_     uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{mapFD: uint32(mapFD), key: uint64(uintptr(unsafe.Pointer(&key))), value: uint64(uintptr(unsafe.Pointer(&value)))}
+
+	_, err := sysBPF(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&key)
+	runtime.KeepAlive(&value)
+
+	return err
+}
+
+func loadXDPProg(insts []ebpfInst) (int, error) {
+	license := []byte("GPL\x00")
+	attr := struct {
+		progType uint32
+		instCnt  uint32
+		insts    uint64
+		license  uint64
+		logLevel uint32
+		logSize  uint32
+		logBuf   uint64
+	}{
+		progType: bpfProgTypeXDP,
+		instCnt:  uint32(len(insts)),
+		insts:    uint64(uintptr(unsafe.Pointer(&insts[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+
+	fd, err := sysBPF(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		// Load again for the log of the verifier
+		logBuf := make([]byte, 1<<16)
+		attr.logLevel = 1
+		attr.logSize = uint32(len(logBuf))
+		attr.logBuf = uint64(uintptr(unsafe.Pointer(&logBuf[0])))
+
+		_, _ = sysBPF(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		runtime.KeepAlive(logBuf)
+
+		n := 0
+		for n < len(logBuf) && logBuf[n] != 0 {
+			n++
+		}
+		if n > 0 {
+			err = fmt.Errorf("%w: %s", err, logBuf[:n])
+		}
+	}
+	runtime.KeepAlive(insts)
+	runtime.KeepAlive(license)
+
+	return fd, err
+}
+
+func attachXDPProg(progFD, ifIndex int) (int, error) {
+	attr := struct {
+		progFD     uint32
+		ifIndex    uint32
+		attachType uint32
+		flags      uint32
+	}{progFD: uint32(progFD), ifIndex: uint32(ifIndex), attachType: bpfAttachXDP}
+
+	return sysBPF(bpfLinkCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
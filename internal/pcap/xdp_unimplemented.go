@@ -0,0 +1,33 @@
+// +build !linux nopcap
+
+package pcap
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type xdpHandle struct{}
+
+func createXDPHandle(dev, filter, owned string) (*xdpHandle, error) {
+	return nil, errors.New("xdp not support")
+}
+
+func (h *xdpHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return nil, gopacket.CaptureInfo{}, errors.New("xdp not support")
+}
+
+func (h *xdpHandle) WritePacketData(data []byte) error {
+	return errors.New("xdp not support")
+}
+
+func (h *xdpHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeNull
+}
+
+func (h *xdpHandle) SetDirection(direction direction) error {
+	return errors.New("xdp not support")
+}
+
+func (h *xdpHandle) Close() {}
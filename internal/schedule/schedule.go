@@ -0,0 +1,84 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule describes a daily period in local time, like 20:00-23:00, which may wrap midnight, like 22:00-06:00. A nil
+// schedule contains any time.
+type Schedule struct {
+	// start and end are minutes of the day, where the start is included and the end is not.
+	start int
+	end   int
+}
+
+// Parse returns a schedule by the given string, a period in hh:mm-hh:mm.
+func Parse(s string) (*Schedule, error) {
+	strs := strings.Split(s, "-")
+	if len(strs) != 2 {
+		return nil, fmt.Errorf("invalid period %s", s)
+	}
+
+	start, err := parseMinute(strs[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse start: %w", err)
+	}
+	end, err := parseMinute(strs[1])
+	if err != nil {
+		return nil, fmt.Errorf("parse end: %w", err)
+	}
+	if start == end {
+		return nil, errors.New("empty period")
+	}
+
+	return &Schedule{start: start, end: end}, nil
+}
+
+func parseMinute(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		// 24:00 is the end of the day
+		if strings.TrimSpace(s) == "24:00" {
+			return 24 * 60, nil
+		}
+
+		return 0, err
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains returns if the time is in the schedule.
+func (s *Schedule) Contains(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	if s.start < s.end {
+		return minute >= s.start && minute < s.end
+	}
+
+	return minute >= s.start || minute < s.end
+}
+
+func (s *Schedule) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", s.start/60, s.start%60, s.end/60, s.end%60)
+}
+
+// Start calls the function with the current time now and at the start of every minute in the background, so things
+// scheduled are applied when their schedules begin and end.
+func Start(apply func(now time.Time)) {
+	apply(time.Now())
+
+	go func() {
+		for {
+			now := time.Now()
+			time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+			apply(time.Now())
+		}
+	}()
+}
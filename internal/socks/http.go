@@ -0,0 +1,146 @@
+package socks
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"ikago/internal/log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// hopHeaders are headers of a hop, which are not forwarded to origins.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// ListenHTTP returns a new HTTP proxy server listening on the address, whose destinations are checked by the function.
+// Tunnels are made by CONNECT, and other requests in absolute form are forwarded to origins one per connection.
+func ListenHTTP(address string, stack *Stack, allows func(net.Addr) bool) (*Server, error) {
+	s, err := listen(address, stack, allows)
+	if err != nil {
+		return nil, err
+	}
+	s.handle = s.handleHTTP
+
+	return s, nil
+}
+
+func (s *Server) handleHTTP(conn net.Conn) error {
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return fmt.Errorf("read request: %w", err)
+	}
+
+	// Destination
+	host, port := req.URL.Hostname(), req.URL.Port()
+	if req.Method == http.MethodConnect {
+		host, port, err = net.SplitHostPort(req.RequestURI)
+		if err != nil {
+			writeStatus(conn, http.StatusBadRequest)
+			return fmt.Errorf("parse host: %w", err)
+		}
+	} else {
+		if req.URL.Scheme != "http" || host == "" {
+			writeStatus(conn, http.StatusBadRequest)
+			return fmt.Errorf("url %s not support", req.URL)
+		}
+		if port == "" {
+			port = "80"
+		}
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		writeStatus(conn, http.StatusBadRequest)
+		return fmt.Errorf("invalid port %s", port)
+	}
+
+	upConn, err := s.dial(host, p)
+	if err != nil {
+		status := http.StatusBadGateway
+		switch {
+		case errors.Is(err, errNotAllowed):
+			status = http.StatusForbidden
+		case errors.Is(err, errTimeout):
+			status = http.StatusGatewayTimeout
+		}
+		writeStatus(conn, status)
+		return err
+	}
+	defer upConn.Close()
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	// Tunnel
+	if req.Method == http.MethodConnect {
+		_, err = fmt.Fprintf(conn, "HTTP/%d.%d 200 Connection established\r\n\r\n", req.ProtoMajor, req.ProtoMinor)
+		if err != nil {
+			return fmt.Errorf("write response: %w", err)
+		}
+
+		log.Verbosef("Connect HTTP client %s to %s\n", conn.RemoteAddr(), upConn.RemoteAddr())
+
+		pipe(conn, r, upConn)
+
+		return nil
+	}
+
+	// Forward, where the connection is closed after the response, so requests to other origins are not sent to it
+	for _, header := range hopHeaders {
+		req.Header.Del(header)
+	}
+	req.Header.Set("Connection", "close")
+	req.RequestURI = ""
+
+	log.Verbosef("Forward HTTP client %s to %s\n", conn.RemoteAddr(), upConn.RemoteAddr())
+
+	go func() {
+		err := req.Write(upConn)
+		if err != nil {
+			upConn.Close()
+		}
+	}()
+
+	resp, err := http.ReadResponse(bufio.NewReader(upConn), req)
+	if err != nil {
+		writeStatus(conn, http.StatusBadGateway)
+		return fmt.Errorf("read response: %w", err)
+	}
+	defer resp.Body.Close()
+
+	for _, header := range hopHeaders {
+		resp.Header.Del(header)
+	}
+	resp.Close = true
+
+	err = resp.Write(conn)
+	if err != nil {
+		return fmt.Errorf("write response: %w", err)
+	}
+
+	return nil
+}
+
+// writeStatus writes a response of the status, and the connection is closed after it.
+func writeStatus(conn net.Conn, status int) {
+	_, _ = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+}
@@ -0,0 +1,505 @@
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"ikago/internal/log"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	socksVersion = 5
+	// Methods
+	methodNoAuth       = 0x00
+	methodNoAcceptable = 0xff
+	// Commands
+	cmdConnect      = 0x01
+	cmdBind         = 0x02
+	cmdUDPAssociate = 0x03
+	// Address types
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+	// Replies
+	repSucceeded         = 0x00
+	repGeneralFailure    = 0x01
+	repNotAllowed        = 0x02
+	repHostUnreachable   = 0x04
+	repConnectionRefused = 0x05
+	repCmdNotSupported   = 0x07
+	repAtypNotSupported  = 0x08
+	// handshakeTimeout is the duration a client has to finish its request.
+	handshakeTimeout = 10 * time.Second
+	// resolveTimeout is the duration domains are resolved in.
+	resolveTimeout = 5 * time.Second
+)
+
+var errNotAllowed = errors.New("not allowed")
+
+// Server describes a proxy server without authentication, which is SOCKS5, HTTP or transparent, whose requests are
+// carried by the stack. Domains in requests are resolved locally.
+type Server struct {
+	listener   net.Listener
+	packetConn *net.UDPConn
+	stack      *Stack
+	allows     func(net.Addr) bool
+	handle     func(net.Conn) error
+	lock       sync.Mutex
+	conns      map[net.Conn]bool
+	sessions   map[string]*udpSession
+	isClosed   bool
+}
+
+// Listen returns a new SOCKS5 server listening on the address, whose destinations are checked by the function.
+func Listen(address string, stack *Stack, allows func(net.Addr) bool) (*Server, error) {
+	s, err := listen(address, stack, allows)
+	if err != nil {
+		return nil, err
+	}
+	s.handle = s.handleSocks
+
+	return s, nil
+}
+
+func listen(address string, stack *Stack, allows func(net.Addr) bool) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+
+	return &Server{
+		listener: listener,
+		stack:    stack,
+		allows:   allows,
+		conns:    make(map[net.Conn]bool),
+	}, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts clients until the server is closed.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.lock.Lock()
+			isClosed := s.isClosed
+			s.lock.Unlock()
+			if isClosed {
+				return nil
+			}
+			return fmt.Errorf("accept: %w", err)
+		}
+
+		s.lock.Lock()
+		s.conns[conn] = true
+		s.lock.Unlock()
+
+		go func() {
+			defer func() {
+				s.lock.Lock()
+				delete(s.conns, conn)
+				s.lock.Unlock()
+				conn.Close()
+			}()
+
+			err := s.handle(conn)
+			if err != nil {
+				log.Verboseln(fmt.Errorf("handle client %s: %w", conn.RemoteAddr(), err))
+			}
+		}()
+	}
+}
+
+// Close closes the server and its clients.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.isClosed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.packetConn != nil {
+		s.packetConn.Close()
+	}
+	for key, session := range s.sessions {
+		session.conn.Close()
+		delete(s.sessions, key)
+	}
+
+	return s.listener.Close()
+}
+
+func (s *Server) handleSocks(conn net.Conn) error {
+	err := conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	// Methods
+	b := make([]byte, 262)
+	_, err = io.ReadFull(conn, b[:2])
+	if err != nil {
+		return fmt.Errorf("read methods: %w", err)
+	}
+	if b[0] != socksVersion {
+		return fmt.Errorf("version %d not support", b[0])
+	}
+	methods := b[2 : 2+int(b[1])]
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return fmt.Errorf("read methods: %w", err)
+	}
+	method := byte(methodNoAcceptable)
+	for _, m := range methods {
+		if m == methodNoAuth {
+			method = methodNoAuth
+			break
+		}
+	}
+	_, err = conn.Write([]byte{socksVersion, method})
+	if err != nil {
+		return fmt.Errorf("write method: %w", err)
+	}
+	if method == methodNoAcceptable {
+		return errors.New("missing method without authentication")
+	}
+
+	// Request
+	_, err = io.ReadFull(conn, b[:3])
+	if err != nil {
+		return fmt.Errorf("read request: %w", err)
+	}
+	if b[0] != socksVersion {
+		return fmt.Errorf("version %d not support", b[0])
+	}
+	cmd := b[1]
+	host, port, err := readAddr(conn)
+	if err != nil {
+		if errors.Is(err, errAtypNotSupported) {
+			_ = reply(conn, repAtypNotSupported, nil)
+		}
+		return fmt.Errorf("read address: %w", err)
+	}
+
+	switch cmd {
+	case cmdConnect:
+		return s.connect(conn, host, port)
+	case cmdUDPAssociate:
+		return s.associate(conn)
+	case cmdBind:
+		_ = reply(conn, repCmdNotSupported, nil)
+		return errors.New("bind not support")
+	default:
+		_ = reply(conn, repCmdNotSupported, nil)
+		return fmt.Errorf("command %d not support", cmd)
+	}
+}
+
+// connect connects to the destination through the stack, and relays streams between the client and the destination.
+func (s *Server) connect(conn net.Conn, host string, port int) error {
+	upConn, err := s.dial(host, port)
+	if err != nil {
+		var dnsErr *net.DNSError
+		rep := byte(repGeneralFailure)
+		switch {
+		case errors.Is(err, errNotAllowed):
+			rep = repNotAllowed
+		case errors.Is(err, errRefused):
+			rep = repConnectionRefused
+		case errors.Is(err, errTimeout), errors.As(err, &dnsErr):
+			rep = repHostUnreachable
+		}
+		_ = reply(conn, rep, nil)
+		return err
+	}
+	defer upConn.Close()
+
+	err = reply(conn, repSucceeded, upConn.LocalAddr().(*net.TCPAddr))
+	if err != nil {
+		return fmt.Errorf("write reply: %w", err)
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	log.Verbosef("Connect SOCKS client %s to %s\n", conn.RemoteAddr(), upConn.RemoteAddr())
+
+	pipe(conn, conn, upConn)
+
+	return nil
+}
+
+// dial resolves the host, and connects to it through the stack if it is allowed.
+func (s *Server) dial(host string, port int) (net.Conn, error) {
+	ip, err := resolve(host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", host, err)
+	}
+	dst := &net.TCPAddr{IP: ip, Port: port}
+	if !s.allows(dst) {
+		return nil, fmt.Errorf("connect to %s: %w", dst, errNotAllowed)
+	}
+
+	conn, err := s.stack.DialTCP(dst)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", dst, err)
+	}
+
+	return conn, nil
+}
+
+// pipe relays streams between the client, which is read from the reader, and the connection through the stack until
+// both of them end. Streams are closed in each direction after its end.
+func pipe(conn net.Conn, r io.Reader, upConn net.Conn) {
+	c := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upConn, r)
+		_ = upConn.(*tcpConn).CloseWrite()
+		c <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, upConn)
+		if t, ok := conn.(*net.TCPConn); ok {
+			_ = t.CloseWrite()
+		}
+		c <- struct{}{}
+	}()
+	<-c
+	<-c
+}
+
+// associate relays datagrams between the client and the stack until the control connection is closed.
+func (s *Server) associate(conn net.Conn) error {
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		_ = reply(conn, repGeneralFailure, nil)
+		return fmt.Errorf("listen udp: %w", err)
+	}
+	defer relay.Close()
+
+	upConn, err := s.stack.ListenUDP()
+	if err != nil {
+		_ = reply(conn, repGeneralFailure, nil)
+		return fmt.Errorf("listen stack: %w", err)
+	}
+	defer upConn.Close()
+
+	relayAddr := relay.LocalAddr().(*net.UDPAddr)
+	err = reply(conn, repSucceeded, &net.TCPAddr{IP: relayAddr.IP, Port: relayAddr.Port})
+	if err != nil {
+		return fmt.Errorf("write reply: %w", err)
+	}
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+
+	log.Verbosef("Associate SOCKS client %s in %s\n", conn.RemoteAddr(), relayAddr)
+
+	// The address of the client is learned from its first datagram
+	var (
+		clientLock sync.Mutex
+		clientAddr *net.UDPAddr
+	)
+
+	// Client to the stack
+	go func() {
+		b := make([]byte, 65535)
+		for {
+			n, addr, err := relay.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			if !addr.IP.Equal(clientIP) {
+				continue
+			}
+			clientLock.Lock()
+			clientAddr = addr
+			clientLock.Unlock()
+
+			err = s.forward(b[:n], upConn)
+			if err != nil {
+				log.Verboseln(fmt.Errorf("forward datagram from socks client %s: %w", addr, err))
+			}
+		}
+	}()
+
+	// Stack to the client
+	go func() {
+		b := make([]byte, 65535)
+		for {
+			n, addr, err := upConn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			clientLock.Lock()
+			to := clientAddr
+			clientLock.Unlock()
+			if to == nil {
+				continue
+			}
+
+			_, err = relay.WriteToUDP(append(encodeAddr(&net.TCPAddr{IP: addr.IP, Port: addr.Port}, []byte{0, 0, 0}), b[:n]...), to)
+			if err != nil {
+				log.Verboseln(fmt.Errorf("write datagram to socks client %s: %w", to, err))
+			}
+		}
+	}()
+
+	// The association ends with the control connection
+	_, _ = io.Copy(ioutil.Discard, conn)
+
+	return nil
+}
+
+// forward sends the datagram of a SOCKS client, which is prefixed with a header of its destination, through the stack.
+// Fragments are not supported and are dropped.
+func (s *Server) forward(datagram []byte, upConn *UDPConn) error {
+	if len(datagram) < 4 {
+		return errors.New("datagram too short")
+	}
+	if datagram[2] != 0 {
+		return errors.New("fragment not support")
+	}
+
+	r := &byteReader{b: datagram[3:]}
+	host, port, err := readAddr(r)
+	if err != nil {
+		return fmt.Errorf("read address: %w", err)
+	}
+	ip, err := resolve(host)
+	if err != nil {
+		return fmt.Errorf("resolve %s: %w", host, err)
+	}
+	dst := &net.UDPAddr{IP: ip, Port: port}
+	if !s.allows(dst) {
+		return fmt.Errorf("send to %s: %w", dst, errNotAllowed)
+	}
+
+	return upConn.WriteTo(r.b, dst)
+}
+
+var errAtypNotSupported = errors.New("address type not support")
+
+// readAddr reads an address of an address type, a host and a port.
+func readAddr(r io.Reader) (string, int, error) {
+	b := make([]byte, 256)
+	_, err := io.ReadFull(r, b[:1])
+	if err != nil {
+		return "", 0, err
+	}
+
+	var host string
+	switch b[0] {
+	case atypIPv4:
+		_, err = io.ReadFull(r, b[:net.IPv4len])
+		if err != nil {
+			return "", 0, err
+		}
+		host = net.IP(b[:net.IPv4len]).String()
+	case atypIPv6:
+		_, err = io.ReadFull(r, b[:net.IPv6len])
+		if err != nil {
+			return "", 0, err
+		}
+		host = net.IP(b[:net.IPv6len]).String()
+	case atypDomain:
+		_, err = io.ReadFull(r, b[:1])
+		if err != nil {
+			return "", 0, err
+		}
+		n := int(b[0])
+		_, err = io.ReadFull(r, b[:n])
+		if err != nil {
+			return "", 0, err
+		}
+		host = string(b[:n])
+	default:
+		return "", 0, errAtypNotSupported
+	}
+
+	_, err = io.ReadFull(r, b[:2])
+	if err != nil {
+		return "", 0, err
+	}
+
+	return host, int(binary.BigEndian.Uint16(b[:2])), nil
+}
+
+// encodeAddr appends the address in an address type, an IP and a port to the bytes.
+func encodeAddr(addr *net.TCPAddr, b []byte) []byte {
+	if ip := addr.IP.To4(); ip != nil {
+		b = append(append(b, atypIPv4), ip...)
+	} else {
+		b = append(append(b, atypIPv6), addr.IP.To16()...)
+	}
+
+	return append(b, byte(addr.Port>>8), byte(addr.Port))
+}
+
+// reply writes a reply with the bound address, which is unspecified if it is nil.
+func reply(conn net.Conn, rep byte, addr *net.TCPAddr) error {
+	if addr == nil {
+		addr = &net.TCPAddr{IP: net.IPv4zero}
+	}
+
+	_, err := conn.Write(encodeAddr(addr, []byte{socksVersion, rep, 0}))
+
+	return err
+}
+
+// resolve returns the IP of the host, IPv4 addresses are preferred.
+func resolve(host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return addr.IP, nil
+		}
+	}
+	if len(addrs) <= 0 {
+		return nil, errors.New("no address")
+	}
+
+	return addrs[0].IP, nil
+}
+
+// byteReader reads bytes in order, and keeps the rest.
+type byteReader struct {
+	b []byte
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.b) <= 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+
+	return n, nil
+}
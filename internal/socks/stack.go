@@ -0,0 +1,252 @@
+package socks
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"sync"
+)
+
+const (
+	// stackPortLow and stackPortHigh are the range of ports endpoints of the stack are bound to.
+	stackPortLow  = 32768
+	stackPortHigh = 60999
+)
+
+var (
+	// stackIPv4 and stackIPv6 are addresses of the stack, which are in ranges reserved for benchmarking and unique local
+	// addresses, so they do not conflict with sources.
+	stackIPv4 = net.IPv4(198, 18, 0, 1).To4()
+	stackIPv6 = net.ParseIP("fd00:1ca:60::1")
+)
+
+// Stack describes a user-space network stack of TCP and UDP endpoints, which makes IP packets from streams and
+// datagrams of SOCKS clients, and takes IP packets to them, so they are carried in the tunnel without capturing.
+type Stack struct {
+	mtu   int
+	write func([]byte) error
+	lock  sync.Mutex
+	id    uint16
+	next  uint16
+	tcp   map[uint16]*tcpConn
+	udp   map[uint16]*UDPConn
+}
+
+// NewStack returns a new stack whose packets are no larger than the MTU, and are written by the function.
+func NewStack(mtu int, write func([]byte) error) *Stack {
+	return &Stack{
+		mtu:   mtu,
+		write: write,
+		next:  stackPortLow,
+		tcp:   make(map[uint16]*tcpConn),
+		udp:   make(map[uint16]*UDPConn),
+	}
+}
+
+// IsStackIP returns if the IP is an address of the stack.
+func IsStackIP(ip net.IP) bool {
+	return ip.Equal(stackIPv4) || ip.Equal(stackIPv6)
+}
+
+func stackIP(dst net.IP) net.IP {
+	if dst.To4() != nil {
+		return stackIPv4
+	}
+
+	return stackIPv6
+}
+
+// mss returns the maximum segment size of TCP to the IP.
+func (s *Stack) mss(dst net.IP) int {
+	if dst.To4() != nil {
+		return s.mtu - 40
+	}
+
+	return s.mtu - 60
+}
+
+// allocPort returns a port not bound by endpoints of the protocol. The lock must be held.
+func (s *Stack) allocPort(isTCP bool) (uint16, error) {
+	for i := 0; i <= stackPortHigh-stackPortLow; i++ {
+		port := s.next
+		s.next++
+		if s.next > stackPortHigh {
+			s.next = stackPortLow
+		}
+
+		var ok bool
+		if isTCP {
+			_, ok = s.tcp[port]
+		} else {
+			_, ok = s.udp[port]
+		}
+		if !ok {
+			return port, nil
+		}
+	}
+
+	return 0, errors.New("ports exhausted")
+}
+
+// send writes a packet of the transport layer and the payload to the IP.
+func (s *Stack) send(dst net.IP, transportLayer gopacket.SerializableLayer, payload []byte) error {
+	var (
+		networkLayer gopacket.NetworkLayer
+		protocol     layers.IPProtocol
+	)
+
+	switch transportLayer.LayerType() {
+	case layers.LayerTypeTCP:
+		protocol = layers.IPProtocolTCP
+	case layers.LayerTypeUDP:
+		protocol = layers.IPProtocolUDP
+	default:
+		return fmt.Errorf("transport layer type %s not support", transportLayer.LayerType())
+	}
+
+	if dst.To4() != nil {
+		s.lock.Lock()
+		s.id++
+		id := s.id
+		s.lock.Unlock()
+
+		networkLayer = &layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			Id:       id,
+			TTL:      64,
+			Protocol: protocol,
+			SrcIP:    stackIPv4,
+			DstIP:    dst.To4(),
+		}
+	} else {
+		networkLayer = &layers.IPv6{
+			Version:    6,
+			NextHeader: protocol,
+			HopLimit:   64,
+			SrcIP:      stackIPv6,
+			DstIP:      dst,
+		}
+	}
+
+	switch t := transportLayer.(type) {
+	case *layers.TCP:
+		err := t.SetNetworkLayerForChecksum(networkLayer)
+		if err != nil {
+			return fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	case *layers.UDP:
+		err := t.SetNetworkLayerForChecksum(networkLayer)
+		if err != nil {
+			return fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		networkLayer.(gopacket.SerializableLayer), transportLayer, gopacket.Payload(payload))
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	return s.write(buffer.Bytes())
+}
+
+// Deliver takes the IP packet to the endpoint it is sent to, and returns false if it is not sent to the stack.
+func (s *Stack) Deliver(contents []byte) bool {
+	if len(contents) <= 0 {
+		return false
+	}
+
+	var packet gopacket.Packet
+	switch contents[0] >> 4 {
+	case 4:
+		packet = gopacket.NewPacket(contents, layers.LayerTypeIPv4, gopacket.Default)
+	case 6:
+		packet = gopacket.NewPacket(contents, layers.LayerTypeIPv6, gopacket.Default)
+	default:
+		return false
+	}
+
+	networkLayer := packet.NetworkLayer()
+	if networkLayer == nil {
+		return false
+	}
+	var src, dst net.IP
+	switch t := networkLayer.(type) {
+	case *layers.IPv4:
+		src, dst = t.SrcIP, t.DstIP
+	case *layers.IPv6:
+		src, dst = t.SrcIP, t.DstIP
+	}
+	if !IsStackIP(dst) {
+		return false
+	}
+
+	switch t := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		s.lock.Lock()
+		conn, ok := s.tcp[uint16(t.DstPort)]
+		s.lock.Unlock()
+		if !ok || !conn.remote.IP.Equal(src) || conn.remote.Port != int(t.SrcPort) {
+			// Connections unknown are reset, so peers do not wait for them
+			if !t.RST {
+				s.reset(src, t)
+			}
+			return true
+		}
+		conn.handle(t)
+	case *layers.UDP:
+		s.lock.Lock()
+		conn, ok := s.udp[uint16(t.DstPort)]
+		s.lock.Unlock()
+		if ok {
+			conn.deliver(t.Payload, &net.UDPAddr{IP: src, Port: int(t.SrcPort)})
+		}
+	}
+
+	return true
+}
+
+// reset replies to the segment of a connection unknown with a RST.
+func (s *Stack) reset(src net.IP, segment *layers.TCP) {
+	transportLayer := &layers.TCP{
+		SrcPort: segment.DstPort,
+		DstPort: segment.SrcPort,
+		RST:     true,
+	}
+	if segment.ACK {
+		transportLayer.Seq = segment.Ack
+	} else {
+		transportLayer.ACK = true
+		transportLayer.Ack = segment.Seq + uint32(len(segment.Payload))
+		if segment.SYN {
+			transportLayer.Ack++
+		}
+	}
+
+	_ = s.send(src, transportLayer, nil)
+}
+
+// Close closes all endpoints of the stack.
+func (s *Stack) Close() {
+	s.lock.Lock()
+	tcpConns := make([]*tcpConn, 0, len(s.tcp))
+	for _, conn := range s.tcp {
+		tcpConns = append(tcpConns, conn)
+	}
+	udpConns := make([]*UDPConn, 0, len(s.udp))
+	for _, conn := range s.udp {
+		udpConns = append(udpConns, conn)
+	}
+	s.lock.Unlock()
+
+	for _, conn := range tcpConns {
+		conn.abort(errClosed)
+	}
+	for _, conn := range udpConns {
+		conn.Close()
+	}
+}
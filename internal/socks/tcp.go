@@ -0,0 +1,675 @@
+package socks
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/google/gopacket/layers"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// tcpWindow is the receive window, which is not scaled.
+	tcpWindow = 65535
+	// tcpSendBuffer is the size of data written but not acknowledged a connection holds at most.
+	tcpSendBuffer = 256 * 1024
+	// tcpInitialRTO, tcpMinRTO and tcpMaxRTO are bounds of the retransmission timeout.
+	tcpInitialRTO = time.Second
+	tcpMinRTO     = 200 * time.Millisecond
+	tcpMaxRTO     = 60 * time.Second
+	// tcpRetries is the number of retransmissions of a segment before the connection is aborted.
+	tcpRetries = 8
+	// tcpInitialWindow is the initial congestion window in segments.
+	tcpInitialWindow = 10
+	// tcpLinger is the duration a connection closed waits for the peer to close before it is reset.
+	tcpLinger = time.Minute
+)
+
+var (
+	errClosed  = errors.New("use of closed connection")
+	errRefused = errors.New("connection refused")
+	errReset   = errors.New("connection reset by peer")
+	errTimeout = errors.New("connection timed out")
+)
+
+// timeoutError describes an error of a deadline exceeded.
+type timeoutError struct{}
+
+func (e timeoutError) Error() string {
+	return "i/o timeout"
+}
+
+func (e timeoutError) Timeout() bool {
+	return true
+}
+
+func (e timeoutError) Temporary() bool {
+	return true
+}
+
+const (
+	tcpSYNSent = iota
+	tcpEstablished
+	tcpClosed
+)
+
+// tcpConn describes a TCP connection of the stack, which is an active open to a remote address. Out-of-order segments
+// are dropped and retransmitted by the peer, and segments are retransmitted from the first one unacknowledged in
+// timeout and in 3 duplicate ACKs in a congestion window of Reno.
+type tcpConn struct {
+	stack  *Stack
+	local  *net.TCPAddr
+	remote *net.TCPAddr
+	lock   sync.Mutex
+	cond   *sync.Cond
+	state  int
+	err    error
+	mss    int
+	// Send
+	iss        uint32
+	sndUna     uint32
+	sndNxt     uint32
+	sndWnd     int
+	sndBuf     []byte
+	isFINQueue bool
+	isFINSent  bool
+	isFINAcked bool
+	cwnd       int
+	ssthresh   int
+	dupACKs    int
+	// Retransmission
+	timer   *time.Timer
+	rto     time.Duration
+	srtt    time.Duration
+	rttvar  time.Duration
+	retries int
+	timed   uint32
+	timedAt time.Time
+	// Receive
+	rcvNxt    uint32
+	rcvBuf    []byte
+	isPeerFIN bool
+	isClosed  bool
+	// Deadlines
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func seqLEQ(a, b uint32) bool {
+	return int32(a-b) <= 0
+}
+
+// DialTCP connects to the address through the stack.
+func (s *Stack) DialTCP(addr *net.TCPAddr) (net.Conn, error) {
+	s.lock.Lock()
+	port, err := s.allocPort(true)
+	if err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+
+	iss := rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
+	conn := &tcpConn{
+		stack:    s,
+		local:    &net.TCPAddr{IP: stackIP(addr.IP), Port: int(port)},
+		remote:   addr,
+		mss:      s.mss(addr.IP),
+		iss:      iss,
+		sndUna:   iss,
+		sndNxt:   iss + 1,
+		ssthresh: tcpSendBuffer,
+		rto:      tcpInitialRTO,
+	}
+	conn.cond = sync.NewCond(&conn.lock)
+	conn.cwnd = tcpInitialWindow * conn.mss
+	s.tcp[port] = conn
+	s.lock.Unlock()
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	conn.sendSYN()
+	conn.arm()
+
+	for conn.state == tcpSYNSent {
+		conn.cond.Wait()
+	}
+	if conn.state == tcpClosed {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Source: conn.local, Addr: addr, Err: conn.err}
+	}
+
+	return conn, nil
+}
+
+func (c *tcpConn) sendSYN() {
+	mssOption := layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: make([]byte, 2)}
+	binary.BigEndian.PutUint16(mssOption.OptionData, uint16(c.mss))
+
+	_ = c.stack.send(c.remote.IP, &layers.TCP{
+		SrcPort: layers.TCPPort(c.local.Port),
+		DstPort: layers.TCPPort(c.remote.Port),
+		Seq:     c.iss,
+		SYN:     true,
+		Window:  tcpWindow,
+		Options: []layers.TCPOption{mssOption},
+	}, nil)
+}
+
+// sendSegment sends a segment of the sequence with the payload, and with FIN if isFIN is set. The lock must be held.
+func (c *tcpConn) sendSegment(seq uint32, payload []byte, isFIN bool) {
+	_ = c.stack.send(c.remote.IP, &layers.TCP{
+		SrcPort: layers.TCPPort(c.local.Port),
+		DstPort: layers.TCPPort(c.remote.Port),
+		Seq:     seq,
+		Ack:     c.rcvNxt,
+		ACK:     true,
+		PSH:     len(payload) > 0,
+		FIN:     isFIN,
+		Window:  c.window(),
+	}, payload)
+}
+
+// window returns the receive window. The lock must be held.
+func (c *tcpConn) window() uint16 {
+	return uint16(tcpWindow - len(c.rcvBuf))
+}
+
+// inflight returns the number of sequences sent but not acknowledged. The lock must be held.
+func (c *tcpConn) inflight() int {
+	return int(c.sndNxt - c.sndUna)
+}
+
+// output sends data and FIN queued in the windows. The lock must be held.
+func (c *tcpConn) output() {
+	if c.state != tcpEstablished {
+		return
+	}
+
+	wnd := c.sndWnd
+	if c.cwnd < wnd {
+		wnd = c.cwnd
+	}
+
+	for {
+		offset := c.inflight()
+		if c.isFINSent {
+			return
+		}
+
+		unsent := len(c.sndBuf) - offset
+		if unsent <= 0 {
+			if c.isFINQueue {
+				c.sendSegment(c.sndNxt, nil, true)
+				c.sndNxt++
+				c.isFINSent = true
+				c.arm()
+			}
+			return
+		}
+
+		n := unsent
+		if n > c.mss {
+			n = c.mss
+		}
+		if n > wnd-offset {
+			n = wnd - offset
+		}
+		if n <= 0 {
+			// Probe the window closed in timeout
+			c.arm()
+			return
+		}
+
+		c.sendSegment(c.sndNxt, c.sndBuf[offset:offset+n], false)
+		if c.timedAt.IsZero() {
+			c.timed, c.timedAt = c.sndNxt, time.Now()
+		}
+		c.sndNxt = c.sndNxt + uint32(n)
+		c.arm()
+	}
+}
+
+// arm starts the retransmission timer if it is not started. The lock must be held.
+func (c *tcpConn) arm() {
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.rto, c.timeout)
+	}
+}
+
+// disarm stops the retransmission timer. The lock must be held.
+func (c *tcpConn) disarm() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// retransmit sends the first segment unacknowledged again, or a byte beyond the window closed as a probe. The lock
+// must be held.
+func (c *tcpConn) retransmit() {
+	if c.state == tcpSYNSent {
+		c.sendSYN()
+		return
+	}
+
+	n := len(c.sndBuf)
+	if n > c.mss {
+		n = c.mss
+	}
+	if c.inflight() <= 0 {
+		// Window probe
+		if n <= 0 {
+			return
+		}
+		n = 1
+		c.sndNxt = c.sndUna + 1
+	}
+	isFIN := c.isFINSent && n >= len(c.sndBuf)
+
+	c.sendSegment(c.sndUna, c.sndBuf[:n], isFIN)
+}
+
+func (c *tcpConn) timeout() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.timer = nil
+	if c.state == tcpClosed {
+		return
+	}
+	if c.inflight() <= 0 && len(c.sndBuf) <= 0 {
+		return
+	}
+
+	c.retries++
+	if c.retries > tcpRetries {
+		c.close(errTimeout)
+		return
+	}
+
+	// Karn's algorithm, segments retransmitted are not timed
+	c.timedAt = time.Time{}
+	c.rto = c.rto * 2
+	if c.rto > tcpMaxRTO {
+		c.rto = tcpMaxRTO
+	}
+	c.ssthresh = c.inflight() / 2
+	if c.ssthresh < 2*c.mss {
+		c.ssthresh = 2 * c.mss
+	}
+	c.cwnd = c.mss
+
+	c.retransmit()
+	c.arm()
+}
+
+// handle handles a segment from the peer.
+func (c *tcpConn) handle(segment *layers.TCP) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	defer c.cond.Broadcast()
+
+	if c.state == tcpClosed {
+		return
+	}
+
+	if segment.RST {
+		if c.state == tcpSYNSent {
+			if segment.ACK && segment.Ack == c.iss+1 {
+				c.close(errRefused)
+			}
+			return
+		}
+		if seqLEQ(c.rcvNxt, segment.Seq) && seqLT(segment.Seq, c.rcvNxt+tcpWindow) {
+			c.close(errReset)
+		}
+		return
+	}
+
+	if c.state == tcpSYNSent {
+		if !segment.SYN || !segment.ACK || segment.Ack != c.iss+1 {
+			return
+		}
+
+		for _, option := range segment.Options {
+			if option.OptionType == layers.TCPOptionKindMSS && len(option.OptionData) == 2 {
+				mss := int(binary.BigEndian.Uint16(option.OptionData))
+				if mss > 0 && mss < c.mss {
+					c.mss = mss
+					c.cwnd = tcpInitialWindow * mss
+				}
+			}
+		}
+
+		c.state = tcpEstablished
+		c.sndUna, c.sndWnd = segment.Ack, int(segment.Window)
+		c.rcvNxt = segment.Seq + 1
+		c.retries = 0
+		c.disarm()
+		c.sendSegment(c.sndNxt, nil, false)
+		return
+	}
+
+	if !segment.ACK {
+		return
+	}
+
+	// ACK
+	inflight := c.inflight()
+	switch {
+	case seqLT(c.sndUna, segment.Ack) && seqLEQ(segment.Ack, c.sndNxt):
+		acked := int(segment.Ack - c.sndUna)
+		if c.isFINSent && segment.Ack == c.sndNxt {
+			c.isFINAcked = true
+			acked--
+		}
+		if acked > len(c.sndBuf) {
+			acked = len(c.sndBuf)
+		}
+		c.sndBuf = c.sndBuf[acked:]
+		c.sndUna = segment.Ack
+
+		// RTT
+		if !c.timedAt.IsZero() && seqLT(c.timed, segment.Ack) {
+			c.sample(time.Now().Sub(c.timedAt))
+			c.timedAt = time.Time{}
+		}
+
+		// Congestion window
+		if c.cwnd < c.ssthresh {
+			c.cwnd = c.cwnd + acked
+		} else if c.cwnd > 0 {
+			c.cwnd = c.cwnd + c.mss*c.mss/c.cwnd
+		}
+		if c.cwnd > tcpSendBuffer {
+			c.cwnd = tcpSendBuffer
+		}
+
+		c.retries, c.dupACKs = 0, 0
+		c.disarm()
+		if c.inflight() > 0 {
+			c.arm()
+		}
+	case segment.Ack == c.sndUna && len(segment.Payload) <= 0 && !segment.FIN && inflight > 0 && int(segment.Window) == c.sndWnd:
+		c.dupACKs++
+		if c.dupACKs == 3 {
+			c.ssthresh = inflight / 2
+			if c.ssthresh < 2*c.mss {
+				c.ssthresh = 2 * c.mss
+			}
+			c.cwnd = c.ssthresh
+			c.timedAt = time.Time{}
+			c.retransmit()
+		}
+	}
+	c.sndWnd = int(segment.Window)
+
+	// Data to a connection closed can not be read
+	if c.isClosed && len(segment.Payload) > 0 {
+		c.sendSegment(c.sndNxt, nil, false)
+		_ = c.stack.send(c.remote.IP, &layers.TCP{
+			SrcPort: layers.TCPPort(c.local.Port),
+			DstPort: layers.TCPPort(c.remote.Port),
+			Seq:     c.sndNxt,
+			RST:     true,
+		}, nil)
+		c.close(errClosed)
+		return
+	}
+
+	// Data in order, others are dropped and acknowledged, so the peer retransmits them
+	isACK := false
+	if len(segment.Payload) > 0 {
+		isACK = true
+		if segment.Seq == c.rcvNxt && !c.isPeerFIN {
+			payload := segment.Payload
+			if space := tcpWindow - len(c.rcvBuf); len(payload) > space {
+				payload = payload[:space]
+			}
+			c.rcvBuf = append(c.rcvBuf, payload...)
+			c.rcvNxt = c.rcvNxt + uint32(len(payload))
+		}
+	}
+	if segment.FIN {
+		isACK = true
+		if segment.Seq+uint32(len(segment.Payload)) == c.rcvNxt && !c.isPeerFIN {
+			c.rcvNxt++
+			c.isPeerFIN = true
+		}
+	}
+	if isACK {
+		c.sendSegment(c.sndNxt, nil, false)
+	}
+
+	// Closed in both directions
+	if c.isFINAcked && c.isPeerFIN {
+		c.close(nil)
+		return
+	}
+
+	c.output()
+}
+
+// sample updates the retransmission timeout by the RTT in RFC 6298. The lock must be held.
+func (c *tcpConn) sample(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt, c.rttvar = rtt, rtt/2
+	} else {
+		d := c.srtt - rtt
+		if d < 0 {
+			d = -d
+		}
+		c.rttvar = (3*c.rttvar + d) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+
+	c.rto = c.srtt + 4*c.rttvar
+	if c.rto < tcpMinRTO {
+		c.rto = tcpMinRTO
+	}
+	if c.rto > tcpMaxRTO {
+		c.rto = tcpMaxRTO
+	}
+}
+
+// close closes the connection with the error, and unbinds it from the stack. The lock must be held.
+func (c *tcpConn) close(err error) {
+	if c.state == tcpClosed {
+		return
+	}
+
+	c.state, c.err = tcpClosed, err
+	c.disarm()
+	c.cond.Broadcast()
+
+	c.stack.lock.Lock()
+	if c.stack.tcp[uint16(c.local.Port)] == c {
+		delete(c.stack.tcp, uint16(c.local.Port))
+	}
+	c.stack.lock.Unlock()
+}
+
+// abort resets the connection.
+func (c *tcpConn) abort(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state == tcpEstablished {
+		_ = c.stack.send(c.remote.IP, &layers.TCP{
+			SrcPort: layers.TCPPort(c.local.Port),
+			DstPort: layers.TCPPort(c.remote.Port),
+			Seq:     c.sndNxt,
+			RST:     true,
+		}, nil)
+	}
+	c.close(err)
+}
+
+func (c *tcpConn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for {
+		if len(c.rcvBuf) > 0 {
+			break
+		}
+		if c.isClosed {
+			return 0, errClosed
+		}
+		if c.isPeerFIN {
+			return 0, io.EOF
+		}
+		if c.state == tcpClosed {
+			if c.err == nil {
+				return 0, io.EOF
+			}
+			return 0, c.err
+		}
+		if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) {
+			return 0, timeoutError{}
+		}
+		c.cond.Wait()
+	}
+
+	isSmall := c.window() < uint16(c.mss)
+	n := copy(b, c.rcvBuf)
+	c.rcvBuf = c.rcvBuf[n:]
+
+	// Update the window opened
+	if isSmall && c.window() >= uint16(c.mss) && c.state == tcpEstablished {
+		c.sendSegment(c.sndNxt, nil, false)
+	}
+
+	return n, nil
+}
+
+func (c *tcpConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	n := 0
+	for n < len(b) {
+		if c.isClosed || c.isFINQueue {
+			return n, errClosed
+		}
+		if c.state == tcpClosed {
+			if c.err == nil {
+				return n, errClosed
+			}
+			return n, c.err
+		}
+		if !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline) {
+			return n, timeoutError{}
+		}
+
+		space := tcpSendBuffer - len(c.sndBuf)
+		if space <= 0 {
+			c.cond.Wait()
+			continue
+		}
+		if space > len(b)-n {
+			space = len(b) - n
+		}
+		c.sndBuf = append(c.sndBuf, b[n:n+space]...)
+		n = n + space
+		c.output()
+	}
+
+	return n, nil
+}
+
+// CloseWrite sends FIN after data written, and data from the peer can be still read.
+func (c *tcpConn) CloseWrite() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state == tcpClosed {
+		return nil
+	}
+	c.isFINQueue = true
+	c.output()
+
+	return nil
+}
+
+func (c *tcpConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	defer c.cond.Broadcast()
+
+	if c.isClosed {
+		return errClosed
+	}
+	c.isClosed = true
+	if c.state == tcpClosed {
+		return nil
+	}
+	c.isFINQueue = true
+	c.output()
+
+	// The peer may never close
+	time.AfterFunc(tcpLinger, func() {
+		c.abort(errTimeout)
+	})
+
+	return nil
+}
+
+func (c *tcpConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *tcpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *tcpConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+func (c *tcpConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.readDeadline = t
+	c.wakeAt(t)
+
+	return nil
+}
+
+func (c *tcpConn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.writeDeadline = t
+	c.wakeAt(t)
+
+	return nil
+}
+
+// wakeAt wakes readers and writers waiting at the time, so they find the deadline exceeded. The lock must be held.
+func (c *tcpConn) wakeAt(t time.Time) {
+	c.cond.Broadcast()
+	if t.IsZero() {
+		return
+	}
+
+	time.AfterFunc(time.Until(t), func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		c.cond.Broadcast()
+	})
+}
@@ -0,0 +1,203 @@
+package socks
+
+import (
+	"fmt"
+	"ikago/internal/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// transparentTimeout is the duration a UDP session of transparent proxy is kept without datagrams.
+const transparentTimeout = time.Minute
+
+// udpSession describes datagrams from a client of transparent proxy, whose replies are sent from addresses they are
+// from, so the client finds them from its destinations.
+type udpSession struct {
+	conn     *UDPConn
+	lock     sync.Mutex
+	replies  map[string]*net.UDPConn
+	activeAt time.Time
+}
+
+// ListenTransparent returns a new transparent proxy server listening on the address, whose destinations are checked by
+// the function. Connections redirected by iptables REDIRECT have their original destinations in SO_ORIGINAL_DST, and
+// connections and datagrams diverted by TPROXY keep their destinations with IP_TRANSPARENT, where UDP is also proxied.
+// It only works in Linux.
+func ListenTransparent(address string, isTProxy bool, stack *Stack, allows func(net.Addr) bool) (*Server, error) {
+	listener, err := listenTCP(address, isTProxy)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+
+	s := &Server{
+		listener: listener,
+		stack:    stack,
+		allows:   allows,
+		conns:    make(map[net.Conn]bool),
+	}
+	s.handle = s.handleTransparent
+
+	if isTProxy {
+		s.packetConn, err = listenUDP(address)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("listen udp: %w", err)
+		}
+		s.sessions = make(map[string]*udpSession)
+
+		go s.servePackets()
+	}
+
+	return s, nil
+}
+
+func (s *Server) handleTransparent(conn net.Conn) error {
+	dst, err := originalDst(conn.(*net.TCPConn))
+	if err != nil {
+		return fmt.Errorf("get original destination: %w", err)
+	}
+
+	// Connections to the server itself are not redirected, and would loop
+	listenAddr := s.listener.Addr().(*net.TCPAddr)
+	if dst.Port == listenAddr.Port && (dst.IP.Equal(listenAddr.IP) || dst.IP.IsLoopback()) {
+		return fmt.Errorf("connection to %s not redirected", dst)
+	}
+
+	upConn, err := s.dial(dst.IP.String(), dst.Port)
+	if err != nil {
+		return err
+	}
+	defer upConn.Close()
+
+	log.Verbosef("Connect transparent client %s to %s\n", conn.RemoteAddr(), dst)
+
+	pipe(conn, conn, upConn)
+
+	return nil
+}
+
+// servePackets relays datagrams diverted by TPROXY through the stack until the server is closed.
+func (s *Server) servePackets() {
+	go s.expireSessions()
+
+	b := make([]byte, 65535)
+	for {
+		n, src, dst, err := readFromUDP(s.packetConn, b)
+		if err != nil {
+			s.lock.Lock()
+			isClosed := s.isClosed
+			s.lock.Unlock()
+			if isClosed {
+				return
+			}
+			log.Errorln(fmt.Errorf("read transparent udp: %w", err))
+			continue
+		}
+		if !s.allows(dst) {
+			log.Verbosef("Deny a transparent datagram: %s -> %s\n", src, dst)
+			continue
+		}
+
+		session, err := s.session(src)
+		if err != nil {
+			log.Errorln(fmt.Errorf("open transparent udp session of %s: %w", src, err))
+			continue
+		}
+
+		err = session.conn.WriteTo(b[:n], dst)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("forward transparent datagram from %s to %s: %w", src, dst, err))
+		}
+	}
+}
+
+// session returns the session of the client, and opens one if it does not exist.
+func (s *Server) session(src *net.UDPAddr) (*udpSession, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[src.String()]
+	if ok {
+		session.lock.Lock()
+		session.activeAt = time.Now()
+		session.lock.Unlock()
+		return session, nil
+	}
+
+	conn, err := s.stack.ListenUDP()
+	if err != nil {
+		return nil, err
+	}
+	session = &udpSession{
+		conn:     conn,
+		replies:  make(map[string]*net.UDPConn),
+		activeAt: time.Now(),
+	}
+	s.sessions[src.String()] = session
+
+	go s.reply(src, session)
+
+	return session, nil
+}
+
+// reply sends datagrams from the stack to the client from addresses they are from.
+func (s *Server) reply(src *net.UDPAddr, session *udpSession) {
+	defer func() {
+		session.lock.Lock()
+		for _, conn := range session.replies {
+			conn.Close()
+		}
+		session.lock.Unlock()
+	}()
+
+	b := make([]byte, 65535)
+	for {
+		n, addr, err := session.conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+
+		session.lock.Lock()
+		session.activeAt = time.Now()
+		conn, ok := session.replies[addr.String()]
+		if !ok {
+			conn, err = dialUDPFrom(addr)
+			if err != nil {
+				session.lock.Unlock()
+				log.Verboseln(fmt.Errorf("reply transparent datagram from %s: %w", addr, err))
+				continue
+			}
+			session.replies[addr.String()] = conn
+		}
+		session.lock.Unlock()
+
+		_, err = conn.WriteToUDP(b[:n], src)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("reply transparent datagram from %s to %s: %w", addr, src, err))
+		}
+	}
+}
+
+// expireSessions closes sessions without datagrams in the timeout.
+func (s *Server) expireSessions() {
+	for {
+		time.Sleep(transparentTimeout / 2)
+
+		s.lock.Lock()
+		if s.isClosed {
+			s.lock.Unlock()
+			return
+		}
+		for key, session := range s.sessions {
+			session.lock.Lock()
+			isExpired := time.Since(session.activeAt) > transparentTimeout
+			session.lock.Unlock()
+			if isExpired {
+				session.conn.Close()
+				delete(s.sessions, key)
+			}
+		}
+		s.lock.Unlock()
+	}
+}
@@ -0,0 +1,171 @@
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST of netfilter, which is also IP6T_SO_ORIGINAL_DST.
+const soOriginalDst = 80
+
+// transparentControl sets IP_TRANSPARENT in the socket, so it accepts and sends packets of addresses not local.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		if sockErr == nil && (network == "tcp6" || network == "udp6") {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		}
+		if sockErr == nil {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+func listenTCP(address string, isTransparent bool) (net.Listener, error) {
+	if !isTransparent {
+		return net.Listen("tcp", address)
+	}
+
+	lc := net.ListenConfig{Control: transparentControl}
+
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+func listenUDP(address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		err := transparentControl(network, address, c)
+		if err != nil {
+			return err
+		}
+
+		var sockErr error
+		err = c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+			if sockErr == nil && network == "udp6" {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		return sockErr
+	}}
+
+	conn, err := lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+// originalDst returns the destination of the connection before it is redirected. Connections diverted by TPROXY keep
+// their destinations, which are their local addresses.
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	local := conn.LocalAddr().(*net.TCPAddr)
+	level := unix.SOL_IP
+	if local.IP.To4() == nil {
+		level = unix.SOL_IPV6
+	}
+
+	var (
+		addr    unix.RawSockaddrAny
+		sockErr error
+	)
+	err = rawConn.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(addr))
+		_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, fd, uintptr(level), soOriginalDst,
+			uintptr(unsafe.Pointer(&addr)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		// Not redirected by netfilter, which is diverted by TPROXY
+		return local, nil
+	}
+
+	return parseSockaddr(&addr)
+}
+
+func parseSockaddr(addr *unix.RawSockaddrAny) (*net.TCPAddr, error) {
+	switch addr.Addr.Family {
+	case unix.AF_INET:
+		sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(addr))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		return &net.TCPAddr{IP: net.IP(append([]byte{}, sa.Addr[:]...)), Port: int(binary.BigEndian.Uint16(port[:]))}, nil
+	case unix.AF_INET6:
+		sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(addr))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		return &net.TCPAddr{IP: net.IP(append([]byte{}, sa.Addr[:]...)), Port: int(binary.BigEndian.Uint16(port[:]))}, nil
+	default:
+		return nil, errors.New("address family not support")
+	}
+}
+
+// readFromUDP reads a datagram diverted by TPROXY, and returns its size, the address it is from and its original
+// destination.
+func readFromUDP(conn *net.UDPConn, b []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	oob := make([]byte, 64)
+	n, oobn, _, src, err := conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for _, msg := range msgs {
+		if (msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR) ||
+			(msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR) {
+			var addr unix.RawSockaddrAny
+			copy((*[unix.SizeofSockaddrAny]byte)(unsafe.Pointer(&addr))[:], msg.Data)
+
+			dst, err := parseSockaddr(&addr)
+			if err != nil {
+				return 0, nil, nil, err
+			}
+
+			return n, src, &net.UDPAddr{IP: dst.IP, Port: dst.Port}, nil
+		}
+	}
+
+	return 0, nil, nil, errors.New("missing original destination")
+}
+
+// dialUDPFrom returns a socket bound to the address not local, which sends replies from it.
+func dialUDPFrom(addr *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp4"
+	if addr.IP.To4() == nil {
+		network = "udp6"
+	}
+
+	lc := net.ListenConfig{Control: transparentControl}
+	conn, err := lc.ListenPacket(context.Background(), network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,28 @@
+// +build !linux
+
+package socks
+
+import (
+	"errors"
+	"net"
+)
+
+func listenTCP(address string, isTransparent bool) (net.Listener, error) {
+	return nil, errors.New("transparent proxy not support")
+}
+
+func listenUDP(address string) (*net.UDPConn, error) {
+	return nil, errors.New("transparent proxy not support")
+}
+
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errors.New("transparent proxy not support")
+}
+
+func readFromUDP(conn *net.UDPConn, b []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	return 0, nil, nil, errors.New("transparent proxy not support")
+}
+
+func dialUDPFrom(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errors.New("transparent proxy not support")
+}
@@ -0,0 +1,97 @@
+package socks
+
+import (
+	"github.com/google/gopacket/layers"
+	"net"
+	"sync"
+)
+
+// udpQueueSize is the number of datagrams an endpoint queues at most before it is read, and datagrams beyond it are
+// dropped.
+const udpQueueSize = 256
+
+type udpDatagram struct {
+	payload []byte
+	addr    *net.UDPAddr
+}
+
+// UDPConn describes a UDP endpoint of the stack, which sends datagrams to and receives datagrams from any address.
+type UDPConn struct {
+	stack    *Stack
+	port     uint16
+	queue    chan udpDatagram
+	lock     sync.Mutex
+	done     chan struct{}
+	isClosed bool
+}
+
+// ListenUDP binds a UDP endpoint to a port of the stack.
+func (s *Stack) ListenUDP() (*UDPConn, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	port, err := s.allocPort(false)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &UDPConn{
+		stack: s,
+		port:  port,
+		queue: make(chan udpDatagram, udpQueueSize),
+		done:  make(chan struct{}),
+	}
+	s.udp[port] = conn
+
+	return conn, nil
+}
+
+// deliver queues the datagram from the address, and drops it if the queue is full.
+func (c *UDPConn) deliver(payload []byte, addr *net.UDPAddr) {
+	select {
+	case c.queue <- udpDatagram{payload: append(make([]byte, 0, len(payload)), payload...), addr: addr}:
+	default:
+	}
+}
+
+// ReadFrom reads a datagram, and returns its size and the address it is from.
+func (c *UDPConn) ReadFrom(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case d := <-c.queue:
+		return copy(b, d.payload), d.addr, nil
+	case <-c.done:
+		return 0, nil, errClosed
+	}
+}
+
+// WriteTo writes a datagram to the address.
+func (c *UDPConn) WriteTo(b []byte, addr *net.UDPAddr) error {
+	select {
+	case <-c.done:
+		return errClosed
+	default:
+	}
+
+	return c.stack.send(addr.IP, &layers.UDP{
+		SrcPort: layers.UDPPort(c.port),
+		DstPort: layers.UDPPort(addr.Port),
+	}, b)
+}
+
+// Close unbinds the endpoint from the stack.
+func (c *UDPConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.isClosed {
+		return errClosed
+	}
+	c.isClosed = true
+	close(c.done)
+
+	c.stack.lock.Lock()
+	delete(c.stack.udp, c.port)
+	c.stack.lock.Unlock()
+
+	return nil
+}
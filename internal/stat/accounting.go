@@ -0,0 +1,179 @@
+package stat
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Account describes cumulative traffic and sessions of a client.
+type Account struct {
+	Client     string    `json:"client"`
+	BytesIn    uint64    `json:"bytesIn"`
+	BytesOut   uint64    `json:"bytesOut"`
+	PacketsIn  uint64    `json:"packetsIn"`
+	PacketsOut uint64    `json:"packetsOut"`
+	Sessions   uint64    `json:"sessions"`
+	Active     int       `json:"active"`
+	Duration   int64     `json:"duration"`
+	FirstSeen  time.Time `json:"firstSeen"`
+	LastSeen   time.Time `json:"lastSeen"`
+}
+
+// accountSession describes a session of a client in progress.
+type accountSession struct {
+	account *Account
+	start   time.Time
+}
+
+// Accounting describes traffic and sessions of clients, where each session is a connection keyed by its address, and
+// sessions of the same client are accounted together.
+type Accounting struct {
+	lock     sync.Mutex
+	accounts map[string]*Account
+	sessions map[string]*accountSession
+}
+
+// NewAccounting returns a new accounting.
+func NewAccounting() *Accounting {
+	return &Accounting{
+		accounts: make(map[string]*Account),
+		sessions: make(map[string]*accountSession),
+	}
+}
+
+// Connect starts a session of the client.
+func (a *Accounting) Connect(session string, client string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+
+	// Finish the session if it is not disconnected
+	a.disconnect(session, now)
+
+	account, ok := a.accounts[client]
+	if !ok {
+		account = &Account{Client: client, FirstSeen: now}
+		a.accounts[client] = account
+	}
+	account.Sessions++
+	account.Active++
+	account.LastSeen = now
+
+	a.sessions[session] = &accountSession{account: account, start: now}
+}
+
+// Disconnect finishes the session, and adds its duration to the client.
+func (a *Accounting) Disconnect(session string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.disconnect(session, time.Now())
+}
+
+func (a *Accounting) disconnect(session string, now time.Time) {
+	s, ok := a.sessions[session]
+	if !ok {
+		return
+	}
+	delete(a.sessions, session)
+
+	s.account.Active--
+	s.account.Duration = s.account.Duration + int64(now.Sub(s.start)/time.Second)
+	s.account.LastSeen = now
+}
+
+// Move moves the session to a new key, like a connection roaming to a new address.
+func (a *Accounting) Move(session string, to string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	s, ok := a.sessions[session]
+	if !ok {
+		return
+	}
+	delete(a.sessions, session)
+	a.sessions[to] = s
+}
+
+// Add adds a packet of traffic to the client of the session. Traffic of unknown sessions is ignored.
+func (a *Accounting) Add(session string, direction Direction, size uint) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	s, ok := a.sessions[session]
+	if !ok {
+		return
+	}
+
+	switch direction {
+	case DirectionIn:
+		s.account.BytesIn = s.account.BytesIn + uint64(size)
+		s.account.PacketsIn++
+	case DirectionOut:
+		s.account.BytesOut = s.account.BytesOut + uint64(size)
+		s.account.PacketsOut++
+	default:
+		panic(fmt.Errorf("direction %d out of range", direction))
+	}
+	s.account.LastSeen = time.Now()
+}
+
+// Accounts returns copies of accounts of all clients sorted by clients. Durations include sessions in progress.
+func (a *Accounting) Accounts() []Account {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+
+	result := make([]Account, 0, len(a.accounts))
+	for _, account := range a.accounts {
+		result = append(result, *account)
+	}
+	for _, s := range a.sessions {
+		for i := range result {
+			if result[i].Client == s.account.Client {
+				result[i].Duration = result[i].Duration + int64(now.Sub(s.start)/time.Second)
+				break
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Client < result[j].Client
+	})
+
+	return result
+}
+
+// Restore restores accounts, like which are saved before restart. Accounts of clients already known are merged.
+func (a *Accounting) Restore(accounts []Account) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, restored := range accounts {
+		restored.Active = 0
+
+		account, ok := a.accounts[restored.Client]
+		if !ok {
+			account := restored
+			a.accounts[restored.Client] = &account
+			continue
+		}
+
+		account.BytesIn = account.BytesIn + restored.BytesIn
+		account.BytesOut = account.BytesOut + restored.BytesOut
+		account.PacketsIn = account.PacketsIn + restored.PacketsIn
+		account.PacketsOut = account.PacketsOut + restored.PacketsOut
+		account.Sessions = account.Sessions + restored.Sessions
+		account.Duration = account.Duration + restored.Duration
+		if !restored.FirstSeen.IsZero() && restored.FirstSeen.Before(account.FirstSeen) {
+			account.FirstSeen = restored.FirstSeen
+		}
+		if restored.LastSeen.After(account.LastSeen) {
+			account.LastSeen = restored.LastSeen
+		}
+	}
+}
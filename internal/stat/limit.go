@@ -0,0 +1,289 @@
+package stat
+
+import (
+	"fmt"
+	"ikago/internal/schedule"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// rateBurst is the duration of traffic at the rate a bucket holds at most, which is the burst allowed after idle.
+	rateBurst = time.Second
+	// rateMinBurst is the size a bucket of Bytes holds at least, so packets larger than the burst still pass.
+	rateMinBurst = 65535
+)
+
+// Rate describes limits of traffic in packets and Bytes per second, 0 as unlimited.
+type Rate struct {
+	Packets int
+	Bytes   int
+}
+
+// IsEmpty returns if the rate is unlimited.
+func (rate Rate) IsEmpty() bool {
+	return rate.Packets <= 0 && rate.Bytes <= 0
+}
+
+func (rate Rate) String() string {
+	s := make([]string, 0, 2)
+	if rate.Packets > 0 {
+		s = append(s, fmt.Sprintf("%d pps", rate.Packets))
+	}
+	if rate.Bytes > 0 {
+		s = append(s, fmt.Sprintf("%d Bps", rate.Bytes))
+	}
+	if len(s) <= 0 {
+		return "unlimited"
+	}
+
+	return strings.Join(s, " and ")
+}
+
+// bucket is a token bucket of packets and Bytes, which is refilled at the rate.
+type bucket struct {
+	rate    Rate
+	packets float64
+	bytes   float64
+	last    time.Time
+}
+
+func newBucket(rate Rate) *bucket {
+	b := &bucket{rate: rate, last: time.Now()}
+	b.packets, b.bytes = b.capacity()
+
+	return b
+}
+
+// capacity returns numbers of packets and Bytes the bucket holds at most.
+func (b *bucket) capacity() (float64, float64) {
+	packets := float64(b.rate.Packets) * rateBurst.Seconds()
+	bytes := float64(b.rate.Bytes) * rateBurst.Seconds()
+	if bytes < rateMinBurst {
+		bytes = rateMinBurst
+	}
+
+	return packets, bytes
+}
+
+// take takes a packet of the size from the bucket, and returns false if there are not enough tokens.
+func (b *bucket) take(size uint, now time.Time) bool {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+
+	maxPackets, maxBytes := b.capacity()
+	b.packets = b.packets + elapsed*float64(b.rate.Packets)
+	if b.packets > maxPackets {
+		b.packets = maxPackets
+	}
+	b.bytes = b.bytes + elapsed*float64(b.rate.Bytes)
+	if b.bytes > maxBytes {
+		b.bytes = maxBytes
+	}
+
+	if b.rate.Packets > 0 && b.packets < 1 {
+		return false
+	}
+	if b.rate.Bytes > 0 && b.bytes < float64(size) {
+		return false
+	}
+	if b.rate.Packets > 0 {
+		b.packets--
+	}
+	if b.rate.Bytes > 0 {
+		b.bytes = b.bytes - float64(size)
+	}
+
+	return true
+}
+
+// RateLimiter describes rate limits of clients in both directions by token buckets, where each client has its own
+// buckets. Clients without their own limits are limited by the default limits of *. Limits with schedules are only in
+// effect in their schedules. A nil rate limiter limits no client.
+type RateLimiter struct {
+	limits    map[string]map[Direction]Rate
+	schedules map[string]*schedule.Schedule
+	lock      sync.Mutex
+	inactive  map[string]bool
+	buckets   map[string]map[Direction]*bucket
+	drops     map[string]uint64
+}
+
+// NewRateLimiter returns a new rate limiter.
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		limits:    make(map[string]map[Direction]Rate),
+		schedules: make(map[string]*schedule.Schedule),
+		inactive:  make(map[string]bool),
+		buckets:   make(map[string]map[Direction]*bucket),
+		drops:     make(map[string]uint64),
+	}
+}
+
+// SetLimit sets the rate limit of the client in the direction, or the default limit if the client is *.
+func (l *RateLimiter) SetLimit(client string, direction Direction, rate Rate) {
+	if rate.IsEmpty() {
+		return
+	}
+
+	limits, ok := l.limits[client]
+	if !ok {
+		limits = make(map[Direction]Rate)
+		l.limits[client] = limits
+	}
+	limits[direction] = rate
+}
+
+// SetSchedule sets the schedule limits of the client are in effect in.
+func (l *RateLimiter) SetSchedule(client string, sched *schedule.Schedule) {
+	l.schedules[client] = sched
+	l.Apply(time.Now())
+}
+
+// IsEmpty returns if the rate limiter limits no client.
+func (l *RateLimiter) IsEmpty() bool {
+	return l == nil || len(l.limits) <= 0
+}
+
+// IsScheduled returns if limits of any client have a schedule.
+func (l *RateLimiter) IsScheduled() bool {
+	return l != nil && len(l.schedules) > 0
+}
+
+// Apply puts limits whose schedules contain the time in effect, and returns if limits in effect change.
+func (l *RateLimiter) Apply(now time.Time) bool {
+	if l == nil {
+		return false
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	isChanged := false
+	for client, sched := range l.schedules {
+		isInactive := !sched.Contains(now)
+		if isInactive == l.inactive[client] {
+			continue
+		}
+		l.inactive[client] = isInactive
+		isChanged = true
+	}
+
+	// Limits come into effect with full buckets
+	if isChanged {
+		l.buckets = make(map[string]map[Direction]*bucket)
+	}
+
+	return isChanged
+}
+
+// Active returns clients whose limits are in effect.
+func (l *RateLimiter) Active() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	clients := make([]string, 0, len(l.limits))
+	for client := range l.limits {
+		if !l.inactive[client] {
+			clients = append(clients, client)
+		}
+	}
+	sort.Strings(clients)
+	if len(clients) <= 0 {
+		return "none"
+	}
+
+	return strings.Join(clients, ", ")
+}
+
+// Allow returns if a packet of the size of the client in the direction is in its rate limit. Packets exceeding the limit
+// are counted as drops.
+func (l *RateLimiter) Allow(client string, direction Direction, size uint) bool {
+	if l.IsEmpty() {
+		return true
+	}
+
+	key := client
+	limits, ok := l.limits[key]
+	if !ok {
+		key = "*"
+		limits, ok = l.limits[key]
+		if !ok {
+			return true
+		}
+	}
+	rate, ok := limits[direction]
+	if !ok {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.inactive[key] {
+		return true
+	}
+
+	buckets, ok := l.buckets[client]
+	if !ok {
+		buckets = make(map[Direction]*bucket)
+		l.buckets[client] = buckets
+	}
+	b, ok := buckets[direction]
+	if !ok {
+		b = newBucket(rate)
+		buckets[direction] = b
+	}
+
+	if !b.take(size, time.Now()) {
+		l.drops[client]++
+		return false
+	}
+
+	return true
+}
+
+// Drops returns copies of numbers of packets dropped of each client.
+func (l *RateLimiter) Drops() map[string]uint64 {
+	result := make(map[string]uint64)
+	if l == nil {
+		return result
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for client, n := range l.drops {
+		result[client] = n
+	}
+
+	return result
+}
+
+func (l *RateLimiter) String() string {
+	clients := make([]string, 0, len(l.limits))
+	for client := range l.limits {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+
+	s := make([]string, 0, len(clients))
+	for _, client := range clients {
+		limits := l.limits[client]
+		directions := make([]string, 0, 2)
+		if rate, ok := limits[DirectionOut]; ok {
+			directions = append(directions, fmt.Sprintf("up %s", rate))
+		}
+		if rate, ok := limits[DirectionIn]; ok {
+			directions = append(directions, fmt.Sprintf("down %s", rate))
+		}
+		if sched, ok := l.schedules[client]; ok {
+			directions = append(directions, fmt.Sprintf("in %s", sched))
+		}
+		s = append(s, fmt.Sprintf("%s %s", client, strings.Join(directions, ", ")))
+	}
+
+	return strings.Join(s, "; ")
+}
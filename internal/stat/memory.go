@@ -0,0 +1,135 @@
+package stat
+
+import (
+	"encoding/json"
+	"fmt"
+	"ikago/internal/log"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// memorySamplePeriod is the period the heap is sampled in.
+	memorySamplePeriod = time.Second
+	// memoryFragmentsRatio is the ratio of the heap to the budget from which fragments are shed.
+	memoryFragmentsRatio = 0.8
+	// memoryFlowsRatio is the ratio of the heap to the budget from which new flows are shed.
+	memoryFlowsRatio = 0.9
+)
+
+// MemoryPressure describes how close the heap is to the memory budget, and what is shed.
+type MemoryPressure int32
+
+const (
+	// PressureNone sheds nothing.
+	PressureNone MemoryPressure = iota
+	// PressureFragments sheds fragments, whose reassembly buffers are held until they complete or expire.
+	PressureFragments
+	// PressureFlows sheds new flows besides fragments, so mappings and states of flows are not created. Packets of
+	// flows existing are kept.
+	PressureFlows
+)
+
+func (pressure MemoryPressure) String() string {
+	switch pressure {
+	case PressureNone:
+		return "none"
+	case PressureFragments:
+		return "fragments"
+	case PressureFlows:
+		return "flows"
+	default:
+		panic(fmt.Errorf("memory pressure %d not support", pressure))
+	}
+}
+
+// MemoryBudget describes a cap of the heap, which sheds load deterministically by the pressure sampled in every period
+// rather than letting the heap grow. A nil budget sheds nothing. 64-bit fields are placed first, so they are aligned
+// for atomic operations.
+type MemoryBudget struct {
+	limit     uint64
+	heap      uint64
+	fragments uint64
+	flows     uint64
+	pressure  int32
+}
+
+// NewMemoryBudget returns a new memory budget of the limit in Bytes, and samples the heap in the background.
+func NewMemoryBudget(limit uint64) *MemoryBudget {
+	b := &MemoryBudget{limit: limit}
+	b.sample()
+
+	go func() {
+		for range time.Tick(memorySamplePeriod) {
+			b.sample()
+		}
+	}()
+
+	return b
+}
+
+func (b *MemoryBudget) sample() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	atomic.StoreUint64(&b.heap, stats.HeapAlloc)
+
+	pressure := PressureNone
+	if float64(stats.HeapAlloc) >= float64(b.limit)*memoryFlowsRatio {
+		pressure = PressureFlows
+	} else if float64(stats.HeapAlloc) >= float64(b.limit)*memoryFragmentsRatio {
+		pressure = PressureFragments
+	}
+
+	last := MemoryPressure(atomic.SwapInt32(&b.pressure, int32(pressure)))
+	if last != pressure {
+		log.Infof("Memory pressure changes from %s to %s with heap %s of %s\n", last, pressure,
+			formatSize(stats.HeapAlloc), formatSize(b.limit))
+	}
+}
+
+// Pressure returns the memory pressure sampled last.
+func (b *MemoryBudget) Pressure() MemoryPressure {
+	if b == nil {
+		return PressureNone
+	}
+
+	return MemoryPressure(atomic.LoadInt32(&b.pressure))
+}
+
+// AllowFragment returns if a fragment can be reassembled, and counts it as shed if not.
+func (b *MemoryBudget) AllowFragment() bool {
+	if b.Pressure() < PressureFragments {
+		return true
+	}
+	atomic.AddUint64(&b.fragments, 1)
+
+	return false
+}
+
+// AllowFlow returns if a new flow can be created, and counts it as shed if not.
+func (b *MemoryBudget) AllowFlow() bool {
+	if b.Pressure() < PressureFlows {
+		return true
+	}
+	atomic.AddUint64(&b.flows, 1)
+
+	return false
+}
+
+// MarshalJSON returns the limit, the heap and the pressure sampled last, and the number of fragments and flows shed.
+func (b *MemoryBudget) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Limit     uint64 `json:"limit"`
+		Heap      uint64 `json:"heap"`
+		Pressure  string `json:"pressure"`
+		Fragments uint64 `json:"shedFragments"`
+		Flows     uint64 `json:"shedFlows"`
+	}{
+		Limit:     b.limit,
+		Heap:      atomic.LoadUint64(&b.heap),
+		Pressure:  b.Pressure().String(),
+		Fragments: atomic.LoadUint64(&b.fragments),
+		Flows:     atomic.LoadUint64(&b.flows),
+	})
+}
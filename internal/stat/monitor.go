@@ -5,6 +5,7 @@
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Direction describes the direction of the traffic.
@@ -24,6 +25,22 @@ type TrafficMonitor struct {
 	localOutManager  *TrafficManager
 	remoteInManager  *TrafficManager
 	remoteOutManager *TrafficManager
+	flows            map[flowKey]*FlowIndicator
+	flowKeys         []flowKey
+}
+
+// flowKey describes the local node and the remote node of a flow.
+type flowKey struct {
+	local  string
+	remote string
+}
+
+// FlowIndicator describes inbound and outbound traffic statistics between a local node and a remote node.
+type FlowIndicator struct {
+	Local  string            `json:"local"`
+	Remote string            `json:"remote"`
+	In     *TrafficIndicator `json:"in"`
+	Out    *TrafficIndicator `json:"out"`
 }
 
 // NewTrafficMonitor returns a new traffic monitor.
@@ -31,6 +48,8 @@ func NewTrafficMonitor() *TrafficMonitor {
 	return &TrafficMonitor{
 		localInManager:  NewTrafficManager(),
 		localOutManager: NewTrafficManager(),
+		flows:           make(map[flowKey]*FlowIndicator),
+		flowKeys:        make([]flowKey, 0),
 	}
 }
 
@@ -54,8 +73,22 @@ func (monitor *TrafficMonitor) AddBidirectional(local string, remote string, dir
 	monitor.lock.Lock()
 	defer monitor.lock.Unlock()
 
+	// Flow
+	key := flowKey{local: local, remote: remote}
+	flow, ok := monitor.flows[key]
+	if !ok {
+		flow = &FlowIndicator{Local: local, Remote: remote}
+		monitor.flows[key] = flow
+		monitor.flowKeys = append(monitor.flowKeys, key)
+	}
+
 	switch direction {
 	case DirectionIn:
+		if flow.In == nil {
+			flow.In = &TrafficIndicator{appear: time.Now()}
+		}
+		flow.In.Add(size)
+
 		monitor.localInManager.Add(local, size)
 
 		if monitor.remoteInManager == nil {
@@ -63,6 +96,11 @@ func (monitor *TrafficMonitor) AddBidirectional(local string, remote string, dir
 		}
 		monitor.remoteInManager.Add(remote, size)
 	case DirectionOut:
+		if flow.Out == nil {
+			flow.Out = &TrafficIndicator{appear: time.Now()}
+		}
+		flow.Out.Add(size)
+
 		monitor.localOutManager.Add(local, size)
 
 		if monitor.remoteOutManager == nil {
@@ -74,9 +112,46 @@ func (monitor *TrafficMonitor) AddBidirectional(local string, remote string, dir
 	}
 }
 
+// Local returns copies of inbound and outbound traffic statistics of a local node, nil if the direction is untracked.
+func (monitor *TrafficMonitor) Local(node string) (*TrafficIndicator, *TrafficIndicator) {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	var in, out *TrafficIndicator
+	indicator, err := monitor.localInManager.Indicator(node)
+	if err == nil {
+		in = indicator.copy()
+	}
+	indicator, err = monitor.localOutManager.Indicator(node)
+	if err == nil {
+		out = indicator.copy()
+	}
+
+	return in, out
+}
+
+// Flows returns copies of traffic statistics of flows added bidirectionally, in the order they appear.
+func (monitor *TrafficMonitor) Flows() []FlowIndicator {
+	monitor.lock.RLock()
+	defer monitor.lock.RUnlock()
+
+	result := make([]FlowIndicator, 0, len(monitor.flowKeys))
+	for _, key := range monitor.flowKeys {
+		flow := monitor.flows[key]
+		result = append(result, FlowIndicator{
+			Local:  flow.Local,
+			Remote: flow.Remote,
+			In:     flow.In.copy(),
+			Out:    flow.Out.copy(),
+		})
+	}
+
+	return result
+}
+
 func (monitor *TrafficMonitor) MarshalJSON() ([]byte, error) {
 	monitor.lock.RLock()
-	monitor.lock.RUnlock()
+	defer monitor.lock.RUnlock()
 
 	type UnidirectionalTrafficMonitor struct {
 		InManager  *TrafficManager `json:"in"`
@@ -0,0 +1,101 @@
+package stat
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// shapeBacklog is the duration a packet waits in the shaper at most, beyond which it is dropped, so the shaper does
+	// not bloat buffers itself.
+	shapeBacklog = 50 * time.Millisecond
+	// shapeBurst is the duration of traffic at the rate the shaper allows in a burst by default.
+	shapeBurst = 10 * time.Millisecond
+)
+
+// Shaper describes a shaper of egress traffic at a rate with a burst by a token bucket. Packets over the rate wait for
+// tokens instead of being sent back-to-back, so traffic is capped below the capacity of the access link, and queues
+// build up in the shaper rather than in the modem. A nil shaper shapes nothing. 64-bit fields are placed first, so they
+// are aligned for atomic operations.
+type Shaper struct {
+	packets uint64
+	drops   uint64
+	rate    float64
+	burst   float64
+	lock    sync.Mutex
+	tokens  float64
+	last    time.Time
+}
+
+// NewShaper returns a new shaper of the rate in Kbps and the burst in KB, where 0 burst is 10 ms of the rate.
+func NewShaper(rate, burst int) *Shaper {
+	s := &Shaper{
+		rate:  float64(rate) * 1000 / 8,
+		burst: float64(burst) * 1024,
+		last:  time.Now(),
+	}
+	if s.burst <= 0 {
+		s.burst = s.rate * shapeBurst.Seconds()
+	}
+	s.tokens = s.burst
+
+	return s
+}
+
+// Wait waits until a packet of the size can be sent at the rate. Priority packets are sent without waiting, but take
+// tokens as well, so they preempt packets waiting. It returns false if the packet is dropped for it would wait too
+// long.
+func (s *Shaper) Wait(size int, isPriority bool) bool {
+	if s == nil {
+		return true
+	}
+
+	s.lock.Lock()
+	now := time.Now()
+	s.tokens = s.tokens + now.Sub(s.last).Seconds()*s.rate
+	if s.tokens > s.burst {
+		s.tokens = s.burst
+	}
+	s.last = now
+
+	// Packets are dropped by the backlog before them, so a packet larger than the backlog is still sent if the shaper is
+	// idle
+	if -s.tokens/s.rate > shapeBacklog.Seconds() {
+		s.lock.Unlock()
+		atomic.AddUint64(&s.drops, 1)
+
+		return false
+	}
+
+	// Tokens are reserved in advance, so packets waiting are sent in order
+	s.tokens = s.tokens - float64(size)
+	var wait time.Duration
+	if s.tokens < 0 {
+		wait = time.Duration(-s.tokens / s.rate * float64(time.Second))
+	}
+	s.lock.Unlock()
+	atomic.AddUint64(&s.packets, 1)
+
+	if wait > 0 && !isPriority {
+		time.Sleep(wait)
+	}
+
+	return true
+}
+
+// MarshalJSON returns the rate in Kbps, the burst in Bytes, and the number of packets shaped and dropped.
+func (s *Shaper) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Rate    int    `json:"rate"`
+		Burst   int    `json:"burst"`
+		Packets uint64 `json:"packets"`
+		Drops   uint64 `json:"drops"`
+	}{
+		Rate:    int(s.rate * 8 / 1000),
+		Burst:   int(s.burst),
+		Packets: atomic.LoadUint64(&s.packets),
+		Drops:   atomic.LoadUint64(&s.drops),
+	})
+}
@@ -44,6 +44,15 @@ func (indicator *TrafficIndicator) Add(size uint) {
 	indicator.lastSeen = time.Now()
 }
 
+func (indicator *TrafficIndicator) copy() *TrafficIndicator {
+	if indicator == nil {
+		return nil
+	}
+
+	result := *indicator
+	return &result
+}
+
 func (indicator *TrafficIndicator) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&struct {
 		Count    uint64 `json:"count"`
@@ -0,0 +1,157 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/url"
+	"time"
+)
+
+// DefaultSample is the number of packets one of which is traced by default.
+const DefaultSample = 100
+
+const shutdownTimeout = 5 * time.Second
+
+// Options describes where spans are exported to, and how packets are sampled.
+type Options struct {
+	// Endpoint is the URL of the OTLP/HTTP collector, like http://localhost:4318.
+	Endpoint string
+	// Sample is the number of packets one of which is traced.
+	Sample int
+	// Service is the name of the service in spans.
+	Service string
+	// Version is the version of the service in spans.
+	Version string
+}
+
+var (
+	provider *sdktrace.TracerProvider
+	tracer   = trace.NewNoopTracerProvider().Tracer("")
+)
+
+// Setup sets up tracing by options. Packets are not traced until it is set up.
+func Setup(options Options) error {
+	if options.Sample <= 0 {
+		options.Sample = DefaultSample
+	}
+
+	u, err := url.Parse(options.Endpoint)
+	if err != nil {
+		return fmt.Errorf("parse endpoint: %w", err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("missing host in endpoint %s", options.Endpoint)
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	switch u.Scheme {
+	case "http":
+		opts = append(opts, otlptracehttp.WithInsecure())
+	case "https":
+	default:
+		return fmt.Errorf("scheme %s not support", u.Scheme)
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return fmt.Errorf("create exporter: %w", err)
+	}
+
+	attrs := []attribute.KeyValue{semconv.ServiceNameKey.String(options.Service)}
+	if options.Version != "" {
+		attrs = append(attrs, semconv.ServiceVersionKey.String(options.Version))
+	}
+
+	// Stages follow the sampling of their packets
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(1/float64(options.Sample)))),
+	)
+	tracer = provider.Tracer("ikago")
+
+	return nil
+}
+
+// Shutdown exports spans remained and stops tracing.
+func Shutdown() error {
+	if provider == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	return provider.Shutdown(ctx)
+}
+
+// StartPacket starts the span of a packet, which may be sampled. If the packet is captured at the time, the span starts
+// then, and the time waiting for handling is traced as the capture stage.
+func StartPacket(name string, captured time.Time) (context.Context, trace.Span) {
+	if captured.IsZero() {
+		return tracer.Start(context.Background(), name)
+	}
+
+	ctx, span := tracer.Start(context.Background(), name, trace.WithTimestamp(captured))
+	if span.IsRecording() {
+		_, capture := tracer.Start(ctx, "capture", trace.WithTimestamp(captured))
+		capture.End()
+	}
+
+	return ctx, span
+}
+
+// End ends the span, and records the error if the packet fails.
+func End(span trace.Span, err error) {
+	if err != nil && span.IsRecording() {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// Start starts the span of a stage in the packet of the context. The stage is not traced if the packet is not sampled.
+func Start(ctx context.Context, name string) (context.Context, trace.Span) {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.IsRecording() {
+		return ctx, trace.SpanFromContext(context.Background())
+	}
+
+	return tracer.Start(ctx, name)
+}
+
+// Stages describes sequential stages in a packet, where each stage ends when the next one starts.
+type Stages struct {
+	ctx  context.Context
+	span trace.Span
+}
+
+// NewStages returns stages in the packet of the context.
+func NewStages(ctx context.Context) *Stages {
+	return &Stages{ctx: ctx}
+}
+
+// Next ends the current stage and starts the next one.
+func (s *Stages) Next(name string) {
+	s.End()
+	_, s.span = Start(s.ctx, name)
+}
+
+// End ends the current stage.
+func (s *Stages) End() {
+	if s.span != nil {
+		s.span.End()
+		s.span = nil
+	}
+}